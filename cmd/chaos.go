@@ -0,0 +1,28 @@
+//go:build chaos
+// +build chaos
+
+package main
+
+import (
+	"github.com/namsral/flag"
+
+	"github.com/tilezen/tapalcatl/pkg/server"
+)
+
+// addChaosFlags adds the flags injecting faults, which are only built into
+// binaries for staging with -tags chaos. It returns the options they set, nil
+// when none are.
+func addChaosFlags(f *flag.FlagSet) func() *server.ChaosOptions {
+	var chaos server.ChaosOptions
+	f.DurationVar(&chaos.Storage.Latency, "chaos-storage-latency", 0, "Delay storage fetches chosen by -chaos-storage-latency-rate by up to this long.")
+	f.Float64Var(&chaos.Storage.LatencyRate, "chaos-storage-latency-rate", 0, "Fraction of storage fetches to delay, from 0 to 1.")
+	f.Float64Var(&chaos.Storage.ErrorRate, "chaos-storage-error-rate", 0, "Fraction of storage fetches to fail, from 0 to 1.")
+	f.Float64Var(&chaos.CacheTimeoutRate, "chaos-cache-timeout-rate", 0, "Fraction of cache calls to time out, from 0 to 1.")
+
+	return func() *server.ChaosOptions {
+		if chaos == (server.ChaosOptions{}) {
+			return nil
+		}
+		return &chaos
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !chaos
+// +build !chaos
+
+package main
+
+import (
+	"github.com/namsral/flag"
+
+	"github.com/tilezen/tapalcatl/pkg/server"
+)
+
+// addChaosFlags adds no flags, as faults can only be injected by binaries
+// built with -tags chaos.
+func addChaosFlags(f *flag.FlagSet) func() *server.ChaosOptions {
+	return func() *server.ChaosOptions { return nil }
+}
@@ -2,36 +2,27 @@ package main
 
 import (
 	"context"
+	"fmt"
 	golog "log"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"sync/atomic"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/NYTimes/gziphandler"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/go-redis/redis/v8"
-	"github.com/gorilla/handlers"
-	"github.com/gorilla/mux"
 	"github.com/namsral/flag"
-	"github.com/oxtoacart/bpool"
 	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/h2c"
 
-	"github.com/tilezen/tapalcatl/pkg/buffer"
 	"github.com/tilezen/tapalcatl/pkg/cache"
 	"github.com/tilezen/tapalcatl/pkg/config"
 	"github.com/tilezen/tapalcatl/pkg/handler"
 	"github.com/tilezen/tapalcatl/pkg/log"
 	"github.com/tilezen/tapalcatl/pkg/metrics"
-	"github.com/tilezen/tapalcatl/pkg/storage"
+	"github.com/tilezen/tapalcatl/pkg/middleware"
+	"github.com/tilezen/tapalcatl/pkg/router"
+	"github.com/tilezen/tapalcatl/pkg/server"
+	"github.com/tilezen/tapalcatl/pkg/state"
 	"github.com/tilezen/tapalcatl/pkg/tile"
 )
 
@@ -40,13 +31,92 @@ const (
 	gracefulShutdownSleep = 20 * time.Second
 	// The time to wait for the in-flight HTTP requests to complete before exiting
 	gracefulShutdownTimeout = 5 * time.Second
+	// How often to report the outstanding work while shutting down
+	drainReportInterval = 2 * time.Second
+	// The time to wait for background cache sets to flush after the HTTP server has shut down
+	cacheFlushTimeout = 2 * time.Second
+	// The number of keys to ask the storage for at a time with -list
+	listPageSize = 1000
 )
 
 func main() {
 	var listen, healthcheck, readyCheck string
+	var workers int
+	var readyCheckCache bool
+	var healthcheckInterval, healthcheckTimeout time.Duration
 	var poolNumEntries, poolEntrySize int
 	var metricsStatsdAddr, metricsStatsdPrefix string
+	var metricsBuildDimension bool
+	var metricsNaming string
+	var metricsDoubleWritePeriod time.Duration
+	var metricsFormats string
+	var captureHeaders string
+	var accessLogFormat string
+	var accessLogOnly bool
+	var logSingleLine bool
 	var redisAddr string
+	var dynamoDBCacheTable, dynamoDBTTLAttribute string
+	var memcachedAddrs string
+	var h2cEnabled bool
+	var http2MaxConcurrentStreams uint
+	var readTimeout, readHeaderTimeout, writeTimeout, idleTimeout time.Duration
+	var maxHeaderBytes int
+	var adminEnabled bool
+	var hotTiles int
+	var buildWebhookToken string
+	var warmPaths string
+	var goldenPaths string
+	var goldenStore string
+	var selfTest bool
+	var listPattern string
+	var listFormat string
+	var listPrefix string
+	var maxZoom int
+	var maxZoomPolicy string
+	var tombstonePolicy string
+	var tombstoneMaxAge time.Duration
+	var archivedPolicy string
+	var archivedRetryAfter time.Duration
+	var duplicateEntryPolicy string
+	var validateTiles bool
+	var allowUnknownFormats bool
+	var cacheCompressedTiles, storeCompressedTiles bool
+	var cacheStaleTTL time.Duration
+	var cacheTTLJitter float64
+	var serveStale bool
+	var diskCacheDir string
+	var diskCacheBytes int64
+	var diskCacheMmap bool
+	var diskCacheFillTTL time.Duration
+	var watchdogStall time.Duration
+	var degradeErrorRate float64
+	var degradeWindow time.Duration
+	var degradeMinFetches int
+	var gzipBufferSize int
+	var instrumentCompression bool
+	var serverTiming bool
+	var timingUnit string
+	var varyHeaders, etagStyle string
+	var stripErrorValidators bool
+	var selfTestTile string
+	var routerName string
+	var shedMaxInFlight, shedMaxQueue int
+	var shedQueueTimeout time.Duration
+	var apiKeys, apiKeyVariable string
+	var rateLimit float64
+	var rateLimitBurst int
+	var banMalformedStrikes int
+	var banMalformedWindow time.Duration
+	var banMalformedDuration time.Duration
+	var mirrorURL string
+	var mirrorFraction float64
+	var mirrorTimeout time.Duration
+	var mirrorMaxInFlight int
+	var maxURLLength int
+	var cacheKeyParams string
+	var requestTimeout time.Duration
+	var requestDeadline time.Duration
+	var requestDeadlineHeader bool
 
 	hc := config.HandlerConfig{}
 
@@ -69,45 +139,300 @@ func main() {
    }
    Storage { key -> storage definition mapping
      storage name string -> {
-        Type string storage type, can be "s3" or "file
+        Type string storage type, can be "s3", "http", "postgres", "file", "memory", "sftp", "webdav", "replicated" or
+                    "fallback"
         MetatileSize int      Number of 256px tiles in each dimension of the metatile.
         MetatileMaxDetailZoom int Maximum level of detail available in the metatiles.
         TileSize int        Size of tile in 256px tile units.
+        BuildMetadata string  Name of an object under each build's prefix declaring metatile_size, tile_size
+                              and metatile_max_detail_zoom, overriding the sizes above for builds which have one.
+        BuildManifest string  Name of an object under the default prefix listing the builds as
+                              {"builds": [{"build_id": ..., "created": RFC 3339 time}]}, so that tile requests
+                              can select the newest build as of a date with ?asof= or the X-Tile-AsOf header.
+        BuildManifestRefresh string  How often to read the build manifest again, default "1m".
+        Retries int         Most times to make a fetch again after a transient error, such as a timeout, a 5xx
+                            response or S3 SlowDown, backing off with jitter. 0 leaves s3 to the aws sdk's retries
+                            and doesn't retry other storages. Not allowed for replicated or fallback storages,
+                            which retry through theirs.
+        RetryBaseDelay string  Backoff before the first retry, doubling for each after, default "50ms".
+        RetryMaxDelay string  Longest backoff between retries, default "1s".
+        FanOutPrefixes []string  Build prefixes to fetch each metatile from in parallel, serving the newest by
+                            Last-Modified, to roll out a build gradually. The prefix served is logged and counted
+                            as the storage source. Requests with a buildid are served from that build alone.
+        DiskCacheDir string  Local directory to cache the metatiles fetched from this storage in, eg. on the NVMe
+                            of edge instances, which is cleared at startup. Each storage needs its own. Not allowed
+                            with RangedReads.
+        DiskCacheMaxBytes int  Most bytes of metatiles cached on disk, evicting the least recently used.
+        DiskCacheTTL string  How long a metatile is served from disk before revalidating it with its ETag, which
+                            only fetches it again if it changed, eg "5m". Default revalidates on every fetch.
+        BundlePattern string  Read metatiles from bundles holding every metatile of a zoom, rather than an object
+                            each, eg. "bundles/{z}.zip" under the prefix. Each has an index alongside with a .index
+                            suffix and a "z/x/y offset length" line per metatile, which are loaded at startup, and
+                            metatiles are read from the bundle with ranged reads. For s3, file and memory storages.
+        BundleMaxZoom int   Highest zoom of the bundled metatiles.
+        BundleIndexTTL string  How long bundle indexes are used before they're reloaded, eg "5m", default "1m". A
+                            bundle rewritten in place may be read with its old index until then.
 
        (s3 storage)
         Layer      string   Name of layer to use in this bucket. Only relevant for s3.
         Bucket     string   Name of S3 bucket to fetch from.
         KeyPattern string   Pattern to fill with variables from the main pattern to make the S3 key.
+        Region string       Overrides the aws region for this bucket, eg. for the copies of a replicated bucket.
+        Endpoint string     URL or host of an S3 compatible service to use instead of S3, eg. MinIO, Ceph RGW or
+                            localstack at http://localhost:9000.
+        ForcePathStyle bool  Address buckets in the path (host/bucket/key) rather than the host name, as S3
+                            compatible services usually need.
+        DisableSSL bool     Use http for an Endpoint given as a host without a scheme.
+        RequesterPays bool  Set for requester pays buckets, such as community mirrors, accepting that requests
+                            are charged to this account.
+        SSECustomerKeyFile string  File holding the base64 encoded 256 bit key the objects are encrypted with by S3
+                            (SSE-C), eg. a mounted secret. Objects encrypted with KMS keys (SSE-KMS) need no key,
+                            only kms:Decrypt permission on it.
+        MaxIdleConnsPerHost int  Idle connections kept open to S3, default 2, to avoid reconnecting at high QPS.
+        IdleConnTimeout string  How long an idle connection is kept, default "90s".
+        DialTimeout string  Timeout connecting to S3, default "30s".
+        TLSHandshakeTimeout string  Timeout of the TLS handshake, default "10s".
+        ResponseHeaderTimeout string  Timeout waiting for S3 to respond once a request is sent, default none.
+        DisableHTTP2 bool   Connect with HTTP/1.1 only, eg. to an S3 compatible Endpoint with a broken HTTP/2.
         Healthcheck string Name of S3 key to use when querying health of S3 system.
+        HealthcheckMethod string  How to check the healthcheck key: "head" (default), "get" or "list".
+        HashScheme string   How to compute {hash}: "none", "md5-N" (default "md5-5"), "sha1-N" or "crc32-hex".
+        HashCompatibility string  The path hashed for {hash}: "legacy-layer-slash" (/layer/z/x/y.fmt) or
+                                  "tilequeue-344" (z/x/y.fmt). Inferred from whether Layer is set when empty.
+        RequestTags { name -> value } Sent with each request as x-name=value query parameters, which S3
+                            records in its server access logs, eg. to attribute costs to deployments.
+        RevalidateTTL string  If set, how long to keep tilejson and metadata objects before revalidating
+                            them with their ETag, eg "30s".
+        RangedReads bool    Fetch only the zip central directory and the tile's entry of metatiles with Range
+                            requests, rather than whole metatiles, for large metatiles. Metatiles aren't cached
+                            then, only tiles.
+        RangeMinBytes int   The least fetched by each Range request, default 65536.
+        HeadConditional bool  For requests with If-None-Match or If-Modified-Since, check the metatile with
+                            HeadObject first and respond 304 without fetching its body if it matches, eg. for
+                            S3 compatible services ignoring conditions on GetObject. Costs a request more when
+                            it doesn't match.
+        BuildVersions { buildid -> time }  Builds which can be requested from a versioned bucket, by the RFC 3339
+                            time of the build, eg. "20210331": "2021-03-31T00:00:00Z". Each metatile of one of
+                            these builds is the version of its object under the defaultPrefix current at that
+                            time, found with ListObjectVersions, rather than under a prefix named by the build.
+
+       (http storage)
+        URLPattern string   URL of metatiles on an upstream origin, with the same variables as KeyPattern, eg.
+                            https://origin/{prefix}/{hash}/{z}/{x}/{y}.{fmt}. Conditional requests are forwarded.
+        MetadataURLPattern string  URL of build metadata and tilejson, with {prefix} and {name} variables, eg.
+                            https://origin/{prefix}/{name}. Optional.
+        Healthcheck string  URL requested with HEAD when querying health of the origin.
+        HashScheme, HashCompatibility  As for s3 storage.
+
+       (postgres storage)
+        ConnectionString string  Connection string of the database, eg. postgres://user@host/db?sslmode=require.
+                            The password can be left to the PGPASSWORD environment variable.
+        Table string        Table with z, x, y, build and data columns, default "tiles". The build is the
+                            pattern's defaultPrefix, or the request's buildid.
+        Tiles bool          The rows are individual tiles with a format column rather than metatiles, for
+                            patterns with a metatileSize of 1.
+        MaxOpenConns int    Most connections open at once, default unlimited.
+        MaxIdleConns int    Most idle connections kept in the pool, default 2.
+        ConnMaxLifetime string  If set, how long to reuse a connection for, eg "5m".
+        Healthcheck string  Query run when querying health of the database, default "SELECT 1".
 
        (file storage)
         BaseDir    string   Base directory to look for files under.
         Healthcheck string  Path to a file (inside BaseDir) when querying health of system.
+
+       (memory storage)
+        BaseDir, Healthcheck  As for file storage. Every file under BaseDir is loaded into memory at startup and
+                            served from there, eg. for integration tests and demos. Later changes aren't seen.
+        MemoryMaxBytes int  If set, startup fails when the files under BaseDir are larger than this in total.
+
+       (sftp storage)
+        Address string      Host and port of the SSH server, eg. files.example.com:22. The port defaults to 22.
+        User string         User to log in as.
+        PrivateKeyFile string  Unencrypted private key to authenticate with, eg. a mounted secret.
+        KnownHostsFile string  The server's host keys in OpenSSH known_hosts format, which it must present.
+        BaseDir, Healthcheck  As for file storage, on the server.
+        MaxOpenConns int    Connections kept open to the server, default 4. Fetches wait when all are in use.
+        DialTimeout string  Timeout connecting to the server, default none.
+
+       (webdav storage)
+        BaseURL string      URL of the directory on the WebDAV server to look for files under, laid out as for file
+                            storage, eg. https://cloud.example.com/remote.php/dav/files/tiles.
+        Healthcheck string  Path to a file (inside BaseURL) checked with PROPFIND when querying health of the server.
+        User string         User to authenticate as with basic auth, if any.
+        PasswordFile string  File holding the password of the User, eg. a mounted secret.
+
+       (replicated storage)
+        Replicas []{ Storage string name of storage definition, Weight int relative share of requests (default 1) }
+        ReplicaCooldown string  Duration a failing replica is excluded for, eg "30s".
+        ReplicaHealthCheckInterval string  If set, how often to actively healthcheck the replicas.
+        ReplicaHealthCheckTimeout string  Duration after which a replica's healthcheck fails, default "5s".
+        ReplicaLatencyThreshold string  If set, a replica is excluded for the cooldown when the moving average
+                            of its fetch durations goes over this, eg "500ms".
+        For failover between regions, make an s3 storage with the Region of each copy of the bucket, and give
+        the standby regions a Weight of 0, so they're only used while the primary is failing or slow.
+
+       (fallback storage)
+        Fallback []string   Names of storage definitions to try in order until one has the metatile, eg. a partial
+                            local mirror on an edge node and then s3. Logged and counted by the storage serving it.
      }
    }
    Pattern { request pattern -> storage configuration mapping
      request pattern string -> {
        storage string Name of storage defintion to use
+       type string  "metatile" (default) to serve the tiles in metatiles, "tilejson", or "archive" to serve whole
+         metatiles at their own coordinates, eg. /meta/{z}/{x}/{y}.{fmt} with the zip format.
+       storageByFormat { format -> storage definition name, overriding storage for those formats }
        list of optional storage configuration to use:
          defaultPrefix is required for s3, others are optional overrides of relevant definition
          DefaultPrefix string  DefaultPrefix to use in this bucket.
+         KeyVariables { name -> value } Extra variables for the s3 key or http url pattern.
+       MaxZoom int  Overrides -max-zoom for this pattern.
+       MaxZoomPolicy string  Overrides -max-zoom-policy for this pattern.
+       TombstonePolicy string  Overrides -tombstone-policy for this pattern.
+       ServeStale bool  Overrides -serve-stale for this pattern.
+       WrapX bool  Wrap X coordinates across the antimeridian to their canonical tile. The pattern's
+         x variable must allow negative numbers, eg {x:-?[0-9]+}.
+       ValidateTiles bool  Overrides -validate-tiles for this pattern.
+       FormatFallbacks { format -> []format } Formats of the metatile entries to serve when there's none
+         in the requested format. Entries which can't be transcoded are served as they are and tried first.
+       Transcode bool  Convert fallback entries to the requested format where possible, eg. mvt to json,
+         rather than skipping them. They're skipped while degraded.
+       ContentHashes bool  Add an X-Tile-Hash header with the hash of each tile's content, for content-addressed
+         URLs on a pattern with a {hash} variable, eg /tiles/{hash}/{z}/{x}/{y}.{fmt}. Those tiles are only served
+         when the hash matches, and are cacheable forever.
+       NotFoundLogSample float64  Fraction of 404 responses to log, from 0 to 1, eg. 0.01 where ocean tiles at high
+         zooms flood the logs. Defaults to 1, and metrics count every response.
+       KeyQueryVariables { query parameter -> regexp } Query parameters usable as s3 key pattern variables.
+       KeyPathVariables []string  Request pattern variables, eg "lang" for /tiles/{lang}/{z}/{x}/{y}.{fmt},
+         usable as s3 key pattern variables.
+       KeyHeaderVariables { variable -> { Header string, Pattern string } } Request headers usable as s3 key pattern
+         variables, with the regexp their values must match, eg. "date": {"Header": "X-Build-Date", "Pattern":
+         "[0-9]{8}"} for a key pattern of /{date}/{z}/{x}/{y}.{fmt}. Responses vary by the headers. Key variables
+         from the request take precedence over KeyVariables, which can give defaults.
+       SelfTestTile string  z/x/y.fmt tile to fetch for this pattern when running with -selftest.
+       ZoomPriorities []{ MinZoom int, MaxZoom int, Weight int } Priority of queued requests by zoom
+         when load shedding, higher weights first. Defaults to lower zooms first.
+       CacheTTLs []{ MinZoom int, MaxZoom int, TTL string } How long to cache tiles by zoom, eg "24h",
+         in the tile cache and with Cache-Control max-age. The first band containing a zoom is used.
      }
    }
    Mime { extension -> content-type used in http response
    }
+   TileJson { tilejson format name -> name of the document in storage, without .json, eg "terrain": "terrain-v2".
+     Adds to the builtin mapbox, geojson and topojson formats.
+   }
+   Tenants { tenant name -> {
+       ApiKeys []string  Keys the tenant's requests pass as api_key.
+       Prefix string     Storage prefix the tenant's requests are confined to, builds selected with
+                         buildid or asof are found under it.
+     }
+   }
 `)
 	f.StringVar(&listen, "listen", ":8080", "interface and port to listen on")
+	f.IntVar(&workers, "workers", 0, "Run this many worker processes sharing the listen address with SO_REUSEPORT, supervised and restarted by this process, so that GC pauses and panics only affect one worker. The supervisor exits if a worker keeps exiting as soon as it starts, eg. with an invalid config. Can't be used with -admin, as each worker has its own admin state. 0 serves from this process.")
 	f.String("config", "", "Config file to read values from.")
 	f.StringVar(&healthcheck, "healthcheck", "", "A URL path for healthcheck. Intended for use by load balancer health checks.")
+	f.DurationVar(&healthcheckInterval, "healthcheck-interval", 10*time.Second, "How long to reuse the result of the storage healthchecks for, so that frequent load balancer probes don't each make requests to the storages. 0 checks them on every probe.")
+	f.DurationVar(&healthcheckTimeout, "healthcheck-timeout", 2*time.Second, "How long to wait for the healthcheck of each storage before reporting it as failed, so that a slow storage doesn't time out load balancer probes. 0 waits indefinitely.")
 	f.StringVar(&readyCheck, "readycheck", "", "A URL path for readiness check. Intended for use by Kubernetes readinessProbe.")
+	f.BoolVar(&readyCheckCache, "readycheck-cache", false, "Fail the readiness check while the cache is unhealthy.")
 
 	f.IntVar(&poolNumEntries, "poolnumentries", 0, "Number of buffers to pool.")
 	f.IntVar(&poolEntrySize, "poolentrysize", 0, "Size of each buffer in pool.")
 
 	f.StringVar(&metricsStatsdAddr, "metrics-statsd-addr", "", "host:port to use to send data to statsd")
 	f.StringVar(&metricsStatsdPrefix, "metrics-statsd-prefix", "", "prefix to prepend to metrics")
+	f.BoolVar(&metricsBuildDimension, "metrics-build-dimension", false, "count response states per requested build, to compare builds during rollouts")
+	f.StringVar(&metricsNaming, "metrics-naming", metrics.MetricNaming_Legacy, "metric names to write: \"legacy\", \"normalized\" or \"both\" while migrating dashboards")
+	f.StringVar(&metricsFormats, "metrics-formats", "", "comma separated formats to count by name, others are counted as \"other\". Defaults to the formats in the handler Mime config")
+	f.DurationVar(&metricsDoubleWritePeriod, "metrics-double-write-period", 0, "with metrics-naming both, how long after startup to write both names before only writing normalized ones, 0 for no limit")
+
+	f.StringVar(&accessLogFormat, "access-log-format", "", "Also write an access log line for each request to stdout, in \"common\" or \"combined\" log format.")
+	f.BoolVar(&logSingleLine, "log-single-line", false, "Log the metrics, warnings and errors of each tile request in its request log line, rather than on their own lines.")
+	f.BoolVar(&accessLogOnly, "access-log-only", false, "Write only the access log line for each request, without the JSON line.")
+	f.StringVar(&captureHeaders, "capture-headers", "", "Comma separated request headers to log with each request, eg. X-Client-Version.")
 
 	f.StringVar(&redisAddr, "redis-addr", "", "Redis connection address for caching purposes")
+	f.StringVar(&dynamoDBCacheTable, "dynamodb-cache-table", "", "DynamoDB table to cache tiles in, in place of redis. Its partition key must be the string attribute \"key\", and its TTL attribute -dynamodb-ttl-attribute so that expired tiles are deleted. Items are limited to 400KB, so the largest metatiles aren't cached.")
+	f.StringVar(&dynamoDBTTLAttribute, "dynamodb-ttl-attribute", cache.DefaultDynamoDBTTLAttribute, "Attribute of the -dynamodb-cache-table items holding when they expire, in seconds since the epoch.")
+	f.StringVar(&memcachedAddrs, "memcached-addrs", "", "Comma separated memcached host:port addresses to cache tiles in, in place of redis, with keys spread between them. Items are limited to memcached's item size, so the largest metatiles aren't cached.")
+	f.IntVar(&gzipBufferSize, "gzip-buffer-size", 0, "Compress responses up to this many bytes in a buffer, so they have a Content-Length. 0 always streams compressed responses.")
+	f.BoolVar(&instrumentCompression, "instrument-compression", false, "Record the time spent compressing tiles, and their compressed size, in the tile metrics.")
+	f.StringVar(&varyHeaders, "vary", "Accept-Encoding", "Comma separated request headers to list in the Vary header of every response, eg. add Origin when CORS origins are restricted.")
+	f.StringVar(&etagStyle, "etag-style", handler.ETagStyle_Preserve, "How to normalize ETags: \"preserve\" their weakness, make them all \"strong\" or all \"weak\", or add the \"encoding\" to those of compressed responses.")
+	f.BoolVar(&stripErrorValidators, "strip-error-validators", false, "Remove ETag and Last-Modified from error responses.")
+	f.BoolVar(&cacheCompressedTiles, "cache-compressed-tiles", false, "Cache gzipped tiles alongside the uncompressed ones, so that they are only compressed once. Requires a tile cache.")
+	f.BoolVar(&storeCompressedTiles, "store-compressed-tiles", false, "Cache tiles gzipped in place of the uncompressed ones, decompressing them for clients which don't accept gzip. Requires a tile cache.")
+	f.DurationVar(&cacheStaleTTL, "cache-stale-ttl", 0, "Keep cached tiles this long past their TTL, to serve with -serve-stale when storage is unavailable.")
+	f.Float64Var(&cacheTTLJitter, "cache-ttl-jitter", 0, "Shorten cache TTLs and Cache-Control max-ages by a random fraction of them up to this, eg. 0.1, so that tiles cached together during a build cutover don't all expire together.")
+	f.BoolVar(&serveStale, "serve-stale", false, "Serve stale cached tiles, with a Warning header, when storage fetches fail. Requires redis-addr or dynamodb-cache-table.")
+	f.StringVar(&diskCacheDir, "disk-cache-dir", "", "Keep metatiles in this local directory, eg. on NVMe, in front of redis. Metatiles already in it are removed on start.")
+	f.Int64Var(&diskCacheBytes, "disk-cache-bytes", 1<<30, "Maximum size of the metatiles kept in -disk-cache-dir, evicting the least recently used.")
+	f.BoolVar(&diskCacheMmap, "disk-cache-mmap", false, "Read metatiles from -disk-cache-dir by mapping them into memory.")
+	f.DurationVar(&diskCacheFillTTL, "disk-cache-fill-ttl", 0, "Keep metatiles found in redis in -disk-cache-dir for this long, 0 to only keep metatiles fetched from storage.")
+	f.DurationVar(&watchdogStall, "watchdog-stall", 0, "Restart the metrics worker, and abandon background cache sets, when they've made no progress for this long, eg. blocked on an unreachable statsd or redis. 0 disables the watchdog.")
+
+	f.BoolVar(&h2cEnabled, "h2c", true, "Allow upgrading cleartext connections to HTTP/2.")
+	f.UintVar(&http2MaxConcurrentStreams, "http2-max-concurrent-streams", 0, "Maximum concurrent streams per HTTP/2 client, 0 for the library default.")
+	f.DurationVar(&readTimeout, "read-timeout", 0, "Maximum duration for reading an entire request, 0 for no limit.")
+	f.DurationVar(&readHeaderTimeout, "read-header-timeout", 0, "Maximum duration for reading request headers, 0 to use read-timeout.")
+	f.DurationVar(&writeTimeout, "write-timeout", 0, "Maximum duration before timing out writing a response, 0 for no limit.")
+	f.DurationVar(&idleTimeout, "idle-timeout", 0, "Maximum time to wait for the next request on a keep-alive connection, 0 to use read-timeout.")
+	f.IntVar(&maxHeaderBytes, "max-header-bytes", 0, "Maximum size of request headers, 0 for the library default.")
+
+	f.IntVar(&maxZoom, "max-zoom", 0, "Deepest zoom level served by metatile patterns, 0 for no limit.")
+	f.StringVar(&maxZoomPolicy, "max-zoom-policy", handler.MaxZoomPolicy_NotFound, "What to do with requests above max-zoom: \"notfound\" or \"overzoom\" to serve the ancestor tile.")
+	f.StringVar(&tombstonePolicy, "tombstone-policy", handler.TombstonePolicy_Ignore, "What to do with zero-byte metatiles and tiles, marking deleted tiles: \"ignore\" them, respond \"notfound\" or serve a \"blank\" tile.")
+	f.StringVar(&duplicateEntryPolicy, "duplicate-entry-policy", tile.DuplicateEntryPolicy_First, "Which of the entries to serve when a metatile has more than one for a tile: the \"first\", the \"last\", or respond with an \"error\". Duplicates are logged and counted whatever the policy.")
+	f.DurationVar(&tombstoneMaxAge, "tombstone-max-age", 168*time.Hour, "Cache-Control max-age of responses for deleted tiles, 0 to leave it out.")
+	f.StringVar(&archivedPolicy, "archived-policy", handler.ArchivedPolicy_Unavailable, "How to respond to tiles whose metatile is archived in storage, eg. in S3 Glacier: \"unavailable\" (503) or \"notfound\" (404).")
+	f.DurationVar(&archivedRetryAfter, "archived-retry-after", time.Hour, "Retry-After of unavailable responses for archived metatiles, 0 to leave it out.")
+
+	f.IntVar(&shedMaxInFlight, "shed-max-inflight", 0, "Maximum tile requests handled at once before queueing, 0 to disable load shedding.")
+	f.IntVar(&shedMaxQueue, "shed-max-queue", 0, "Maximum tile requests queued when load shedding, the lowest priority is shed beyond this.")
+	f.DurationVar(&shedQueueTimeout, "shed-queue-timeout", time.Second, "Maximum time a tile request waits in the load shedding queue, 0 for no limit.")
+
+	f.Float64Var(&degradeErrorRate, "degrade-error-rate", 0, "Storage error rate, between 0 and 1, at which to turn off cache sets and tile validation to shed load. 0 only degrades with the /admin/degradation endpoint.")
+	f.DurationVar(&degradeWindow, "degrade-window", time.Minute, "How long the storage error rate must stay over, or under, degrade-error-rate to enter, or leave, degraded mode.")
+	f.IntVar(&degradeMinFetches, "degrade-min-fetches", 100, "Storage fetches needed in a degrade-window for its error rate to count.")
+
+	f.StringVar(&apiKeys, "api-keys", "", "Comma separated keys, one of which tile requests must pass as api_key. Empty allows all requests.")
+	f.StringVar(&apiKeyVariable, "api-key-variable", "", "Pattern variable holding the API key, for patterns with the key in their path, such as /v1/{apikey}/tiles/{z}/{x}/{y}.mvt.")
+	f.Float64Var(&rateLimit, "rate-limit", 0, "Maximum tile requests per second across all patterns, 0 for no limit.")
+	f.IntVar(&rateLimitBurst, "rate-limit-burst", 1, "Tile requests allowed at once above rate-limit.")
+	f.IntVar(&banMalformedStrikes, "ban-malformed-strikes", 0, "Ban clients, by remote address, after this many malformed tile requests within -ban-malformed-window. 0 never bans them.")
+	f.DurationVar(&banMalformedWindow, "ban-malformed-window", time.Minute, "Window in which malformed tile requests are counted towards a ban.")
+	f.DurationVar(&banMalformedDuration, "ban-malformed-duration", 10*time.Minute, "How long banned clients are refused with 403.")
+	f.StringVar(&mirrorURL, "mirror-url", "", "Shadow deployment to replay a sample of tile requests to in the background, eg. https://shadow.example.com, logging and counting the responses which differ in status or size. Empty disables mirroring.")
+	f.Float64Var(&mirrorFraction, "mirror-fraction", 0.01, "Share of tile requests replayed to -mirror-url, from 0 to 1.")
+	f.DurationVar(&mirrorTimeout, "mirror-timeout", 10*time.Second, "Maximum time for a replay to -mirror-url.")
+	f.IntVar(&mirrorMaxInFlight, "mirror-max-inflight", 64, "Maximum replays to -mirror-url at once, beyond which sampled requests aren't replayed.")
+	f.IntVar(&maxURLLength, "max-url-length", 0, "Reject tile requests with a longer path and query as malformed, 0 for no limit.")
+	f.StringVar(&cacheKeyParams, "cache-key-params", "", "Comma separated query parameters which affect tiles, eg. buildid,lang. When set, all others but api_key are ignored, and the significant ones are part of the cache keys and echoed normalized in an X-Cache-Key-Params header for CDNs to key on.")
+	f.DurationVar(&requestTimeout, "request-timeout", 0, "Maximum time to respond to a tile request before responding 503, 0 for no limit.")
+	f.DurationVar(&requestDeadline, "request-deadline", 0, "Default budget for the cache and storage calls of a tile request, after which they're abandoned and the request gets a 504, 0 for no limit.")
+	f.BoolVar(&requestDeadlineHeader, "request-deadline-header", false, "Take the budget of tile requests from their X-Request-Deadline-Ms header, eg. as set by an upstream gateway, when they have one.")
+
+	f.BoolVar(&serverTiming, "server-timing", false, "Add a Server-Timing header with the duration of each phase to tile responses.")
+	f.StringVar(&timingUnit, "timing-unit", state.TimingUnit_Milliseconds, "Unit of the timings in request logs, ms or us. With us, statsd timers are sent as fractional milliseconds with microsecond precision.")
+	f.BoolVar(&allowUnknownFormats, "allow-unknown-formats", false, "Serve tile formats missing from the Mime config as application/octet-stream, rather than responding 404.")
+	f.BoolVar(&validateTiles, "validate-tiles", false, "Check mvt tiles are well formed before serving them, responding 502 to corrupt tiles.")
+
+	f.BoolVar(&selfTest, "selftest", false, "Fetch one tile per pattern before listening, and exit if any fail.")
+	f.StringVar(&selfTestTile, "selftest-tile", "0/0/0.mvt", "Default z/x/y.fmt tile to fetch for each pattern during the self-test.")
+	f.StringVar(&listPattern, "list", "", "Print the keys in the storage of this pattern, eg. to drive cache warming or exports, and exit rather than listening.")
+	f.StringVar(&listFormat, "list-format", "", "Format whose storage to list with -list, for patterns with one storage per format.")
+	f.StringVar(&listPrefix, "list-prefix", "", "Only print the keys beginning with this prefix with -list, eg. a build's.")
+	f.StringVar(&routerName, "router", router.Router_Mux, "How to match tile patterns: mux tries each pattern in turn and allows regexps in pattern variables, tree is faster with many patterns but doesn't allow regexps.")
+
+	f.BoolVar(&adminEnabled, "admin", false, "Enable the /admin endpoints. These expose internal state and should not be publicly reachable.")
+	f.IntVar(&hotTiles, "hot-tiles", 0, "Track this many of the most requested tiles of each pattern, approximately, and list them at /admin/hot?pattern=&limit=. Requires -admin.")
+	f.StringVar(&buildWebhookToken, "build-webhook-token", "", "Bearer token for the build pipeline to call POST /admin/builds with when a build lands. The endpoint is only enabled with -admin and a token.")
+	f.StringVar(&warmPaths, "warm-paths", "", "Comma separated tile paths to request after a build lands, eg. /osm/0/0/0.mvt, including any api_key they need.")
+	f.StringVar(&goldenPaths, "golden-paths", "", "Comma separated tile paths to record with POST /admin/golden/record and compare against a build with /admin/golden/compare, including any api_key they need.")
+	f.StringVar(&goldenStore, "golden-store", "", "Directory or s3://bucket/prefix URL to keep golden tile recordings in. The golden endpoints are only enabled with -admin, -golden-paths and a store.")
+
+	chaosOptions := addChaosFlags(f)
 
 	err = f.Parse(os.Args[1:])
 	if err == flag.ErrHelp {
@@ -116,268 +441,147 @@ func main() {
 		logFatalCfgErr(logger, "Unable to parse input command line, environment or config: %s", err.Error())
 	}
 
-	if len(hc.Pattern) == 0 {
-		logFatalCfgErr(logger, "You must provide at least one pattern.")
-	}
-	if len(hc.Storage) == 0 {
-		logFatalCfgErr(logger, "You must provide at least one storage.")
+	// keep stdout for the keys listed
+	if listPattern != "" {
+		systemLogger.SetOutput(os.Stderr)
 	}
 
-	r := mux.NewRouter()
-
-	// buffer manager shared by all handlers
-	var bufferManager buffer.BufferManager
-
-	if poolNumEntries > 0 && poolEntrySize > 0 {
-		bufferManager = bpool.NewSizedBufferPool(poolNumEntries, poolEntrySize)
-	} else {
-		bufferManager = &buffer.OnDemandBufferManager{}
+	// the admin endpoints' state, eg. forced degradation, is kept by each
+	// process, so would only reach whichever worker took the request
+	if workers > 0 && adminEnabled {
+		logFatalCfgErr(logger, "-admin can't be used with -workers, as each worker has its own admin state")
 	}
 
-	var tileCache cache.Cache
-	if redisAddr != "" {
-		client := redis.NewClient(&redis.Options{
-			Addr: redisAddr,
-		})
-
-		// Ping Redis to make sure it's available before starting.
-		// Using a longer timeout to give time for network connections to spin up, etc.
-		timeoutCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-		defer cancel()
-		if err := client.Ping(timeoutCtx).Err(); err != nil {
-			logFatalCfgErr(logger, "Couldn't reach Redis service at %s: %s", redisAddr, err.Error())
-		}
-
-		logger.Info("Redis connected to %s", redisAddr)
-		tileCache = cache.NewRedisCache(client)
-	} else {
-		tileCache = cache.NilCache
+	worker, isWorker := server.WorkerNumber()
+	if workers > 0 && !isWorker && listPattern == "" {
+		supervise(logger, workers)
+		return
 	}
 
-	// metrics writer configuration
-	var mw metrics.MetricsWriter
-	if metricsStatsdAddr != "" {
-		udpAddr, err := net.ResolveUDPAddr("udp4", metricsStatsdAddr)
-		if err != nil {
-			logFatalCfgErr(logger, "Invalid metricsstatsdaddr %s: %s", metricsStatsdAddr, err)
-		}
-		mw = metrics.NewStatsdMetricsWriter(udpAddr, metricsStatsdPrefix, logger)
-	} else {
-		mw = &metrics.NilMetricsWriter{}
+	options := server.Options{
+		Logger:                   logger,
+		AccessLog:                log.LoggingOptions{AccessLogFormat: accessLogFormat, OmitJson: accessLogOnly, Consolidate: logSingleLine},
+		Healthcheck:              healthcheck,
+		HealthcheckInterval:      healthcheckInterval,
+		HealthcheckTimeout:       healthcheckTimeout,
+		ReadyCheck:               readyCheck,
+		ReadyCheckCache:          readyCheckCache,
+		PoolNumEntries:           poolNumEntries,
+		PoolEntrySize:            poolEntrySize,
+		MetricsStatsdAddr:        metricsStatsdAddr,
+		MetricsStatsdPrefix:      metricsStatsdPrefix,
+		MetricsBuildDimension:    metricsBuildDimension,
+		MetricsNaming:            metricsNaming,
+		MetricsDoubleWritePeriod: metricsDoubleWritePeriod,
+		MetricsFormats:           splitList(metricsFormats),
+		CaptureHeaders:           splitList(captureHeaders),
+		RedisAddr:                redisAddr,
+		DynamoDBCacheTable:       dynamoDBCacheTable,
+		DynamoDBTTLAttribute:     dynamoDBTTLAttribute,
+		MemcachedAddrs:           splitList(memcachedAddrs),
+		CacheCompressedTiles:     cacheCompressedTiles,
+		StoreCompressedTiles:     storeCompressedTiles,
+		CacheStaleTTL:            cacheStaleTTL,
+		CacheTTLJitter:           cacheTTLJitter,
+		ServeStale:               serveStale,
+		DiskCache:                cache.DiskCacheOptions{Dir: diskCacheDir, MaxBytes: diskCacheBytes, Mmap: diskCacheMmap, FillTTL: diskCacheFillTTL},
+		WatchdogStall:            watchdogStall,
+		MaxZoom:                  maxZoom,
+		MaxZoomPolicy:            maxZoomPolicy,
+		TombstonePolicy:          tombstonePolicy,
+		TombstoneMaxAge:          tombstoneMaxAge,
+		ArchivedPolicy:           archivedPolicy,
+		ArchivedRetryAfter:       archivedRetryAfter,
+		DuplicateEntryPolicy:     duplicateEntryPolicy,
+		ValidateTiles:            validateTiles,
+		AllowUnknownFormats:      allowUnknownFormats,
+		ServerTiming:             serverTiming,
+		TimingUnit:               timingUnit,
+		Worker:                   worker,
+		ShedMaxInFlight:          shedMaxInFlight,
+		ShedMaxQueue:             shedMaxQueue,
+		ShedQueueTimeout:         shedQueueTimeout,
+		Degradation:              handler.DegradationOptions{ErrorRate: degradeErrorRate, Window: degradeWindow, MinFetches: degradeMinFetches},
+		APIKeys:                  splitList(apiKeys),
+		APIKeyVariable:           apiKeyVariable,
+		RateLimit:                rateLimit,
+		RateLimitBurst:           rateLimitBurst,
+		BanMalformedStrikes:      banMalformedStrikes,
+		BanMalformedWindow:       banMalformedWindow,
+		BanMalformedDuration:     banMalformedDuration,
+		MirrorURL:                mirrorURL,
+		Mirror:                   middleware.MirrorOptions{Fraction: mirrorFraction, Timeout: mirrorTimeout, MaxInFlight: mirrorMaxInFlight},
+		MaxURLLength:             maxURLLength,
+		CacheKeyParams:           splitList(cacheKeyParams),
+		RequestTimeout:           requestTimeout,
+		RequestDeadline:          requestDeadline,
+		RequestDeadlineHeader:    requestDeadlineHeader,
+		GzipBufferSize:           gzipBufferSize,
+		InstrumentCompression:    instrumentCompression,
+		Vary:                     splitList(varyHeaders),
+		ETagStyle:                etagStyle,
+		StripErrorValidators:     stripErrorValidators,
+		SelfTest:                 selfTest,
+		SelfTestTile:             selfTestTile,
+		Router:                   routerName,
+		Admin:                    adminEnabled,
+		HotTiles:                 hotTiles,
+		BuildWebhookToken:        buildWebhookToken,
+		WarmPaths:                splitList(warmPaths),
+		GoldenPaths:              splitList(goldenPaths),
+		GoldenStore:              goldenStore,
+		Chaos:                    chaosOptions(),
 	}
-
-	// set if we have s3 storage configured, and shared across all s3 sessions
-	var awsSession *session.Session
-
-	for sName, sd := range hc.Storage {
-		t := sd.Type
-		switch t {
-		case "s3":
-		case "file":
-		default:
-			logFatalCfgErr(logger, "Unknown storage type for storage %s: %s", sName, t)
+	if h2cEnabled {
+		options.HTTP2 = &http2.Server{
+			MaxConcurrentStreams: uint32(http2MaxConcurrentStreams),
+			IdleTimeout:          idleTimeout,
 		}
 	}
-
-	// keep track of the storages so we can healthcheck them
-	// we only need to check unique type/healthcheck configurations
-	healthCheckStorages := make(map[config.HealthCheckConfig]storage.Storage)
-
-	// create the storage implementations and handler routes for patterns
-	var stg storage.Storage
-	for reqPattern, rhc := range hc.Pattern {
-
-		storageDefinitionName := rhc.Storage
-		sd, ok := hc.Storage[storageDefinitionName]
-		if !ok {
-			logFatalCfgErr(logger, "Unknown storage definition: %s", storageDefinitionName)
-		}
-		metatileSize := sd.MetatileSize
-		if rhc.MetatileSize != nil {
-			metatileSize = *rhc.MetatileSize
-		}
-		if !tile.IsPowerOfTwo(metatileSize) {
-			logFatalCfgErr(logger, "Metatile size must be power of two, but %d is not", metatileSize)
-		}
-
-		tileSize := 1
-		if sd.TileSize != nil {
-			tileSize = *sd.TileSize
-		}
-		if rhc.TileSize != nil {
-			tileSize = *rhc.TileSize
-		}
-		if !tile.IsPowerOfTwo(tileSize) {
-			logFatalCfgErr(logger, "Tile size must be power of two, but %d is not", tileSize)
-		}
-
-		metatileMaxDetailZoom := 0
-		if sd.MetatileMaxDetailZoom != nil {
-			metatileMaxDetailZoom = *sd.MetatileMaxDetailZoom
-		}
-
-		layer := sd.Layer
-		if rhc.Layer != nil {
-			layer = *rhc.Layer
-		}
-
-		var healthcheck string
-
-		switch sd.Type {
-		case "s3":
-			if rhc.DefaultPrefix == nil {
-				logFatalCfgErr(logger, "S3 configuration requires defaultPrefix")
-			}
-			prefix := *rhc.DefaultPrefix
-
-			if awsSession == nil {
-				if hc.Aws != nil && hc.Aws.Region != nil {
-					awsSession, err = session.NewSessionWithOptions(session.Options{
-						Config:            aws.Config{Region: hc.Aws.Region},
-						SharedConfigState: session.SharedConfigEnable,
-					})
-				} else {
-					awsSession, err = session.NewSessionWithOptions(session.Options{
-						SharedConfigState: session.SharedConfigEnable,
-					})
-				}
-			}
-			if err != nil {
-				logFatalCfgErr(logger, "Unable to set up AWS session: %s", err.Error())
-			}
-
-			var s3Client s3iface.S3API
-			if hc.Aws.Role != nil {
-				creds := stscreds.NewCredentials(awsSession, *hc.Aws.Role)
-				s3Client = s3.New(awsSession, &aws.Config{Credentials: creds})
-			} else {
-				s3Client = s3.New(awsSession)
-			}
-
-			keyPattern := sd.KeyPattern
-			if rhc.KeyPattern != nil {
-				keyPattern = *rhc.KeyPattern
-			}
-
-			if sd.Bucket == "" {
-				logFatalCfgErr(logger, "S3 storage missing bucket configuration")
-			}
-			if keyPattern == "" {
-				logFatalCfgErr(logger, "S3 storage missing key pattern")
-			}
-
-			if sd.Healthcheck == "" {
-				logger.Warning(log.LogCategory_ConfigError, "Missing healthcheck for storage s3")
-			}
-
-			healthcheck = sd.Healthcheck
-			stg = storage.NewS3Storage(s3Client, sd.Bucket, keyPattern, prefix, layer, healthcheck)
-
-		case "file":
-			if sd.BaseDir == "" {
-				logFatalCfgErr(logger, "File storage missing base dir")
-			}
-
-			if sd.Healthcheck == "" {
-				logger.Warning(log.LogCategory_ConfigError, "Missing healthcheck for storage file")
-			}
-
-			healthcheck = sd.Healthcheck
-			stg = storage.NewFileStorage(sd.BaseDir, layer, healthcheck)
-
-		default:
-			logFatalCfgErr(logger, "Unknown storage type: %s", sd.Type)
-		}
-
-		if healthcheck != "" {
-			storageErr := stg.HealthCheck()
-			if storageErr != nil {
-				logger.Warning(log.LogCategory_ConfigError, "Healthcheck failed on storage: %s", storageErr)
-			}
-
-			hcc := config.HealthCheckConfig{
-				Type:        sd.Type,
-				Healthcheck: healthcheck,
-			}
-
-			if _, ok := healthCheckStorages[hcc]; !ok {
-				healthCheckStorages[hcc] = stg
-			}
-		}
-
-		if rhc.Type == nil || *rhc.Type == "metatile" {
-			parser := &handler.MetatileMuxParser{
-				MimeMap: hc.Mime,
+	if adminEnabled {
+		// the handler flag's value is dumped as the structured handler config instead
+		options.AdminSettings = make(map[string]string)
+		f.VisitAll(func(fl *flag.Flag) {
+			if fl.Name != "handler" {
+				options.AdminSettings[fl.Name] = fl.Value.String()
 			}
-
-			h := handler.MetatileHandler(parser, metatileSize, tileSize, metatileMaxDetailZoom, stg, bufferManager, mw, logger, tileCache)
-			gzipped := gziphandler.GzipHandler(h)
-
-			r.Handle(reqPattern, gzipped).Methods("GET")
-
-		} else if rhc.Type != nil && *rhc.Type == "tilejson" {
-			parser := &handler.TileJsonParser{}
-			h := handler.TileJsonHandler(parser, stg, mw, logger)
-			gzipped := gziphandler.GzipHandler(h)
-			r.Handle(reqPattern, gzipped).Methods("GET")
-		} else {
-			systemLogger.Fatalf("ERROR: Invalid route handler type: %s\n", *rhc.Type)
-		}
-
+		})
 	}
 
-	if hc.Preview != nil {
-		if hc.Preview.Path == nil || hc.Preview.Template == nil {
-			systemLogger.Fatalf("ERROR: Preview must have path and template specified")
-		}
-
-		var templateData map[string]interface{}
-		if hc.Preview.Data != nil {
-			templateData = *hc.Preview.Data
-		}
-
-		fileHandler, err := handler.NewFileHandler(*hc.Preview.Template, templateData)
-		if err != nil {
-			systemLogger.Fatalf("ERROR: Couldn't load preview template: %+v", err)
-		}
-
-		r.Handle(*hc.Preview.Path, fileHandler).Methods("GET")
+	tileServer, err := server.New(hc, options)
+	if err != nil {
+		logFatalCfgErr(logger, "%s", err.Error())
 	}
 
-	if len(healthcheck) > 0 {
-		storagesToCheck := make([]storage.Storage, len(healthCheckStorages))
-		i := 0
-		for _, s := range healthCheckStorages {
-			storagesToCheck[i] = s
-			i++
+	if listPattern != "" {
+		err := listKeys(tileServer, listPattern, listFormat, listPrefix)
+		tileServer.Close()
+		if err != nil {
+			logger.Error(log.LogCategory_StorageError, "Failed to list storage: %s", err.Error())
+			os.Exit(1)
 		}
-		hc := handler.HealthCheckHandler(storagesToCheck, logger)
-		r.Handle(healthcheck, hc).Methods("GET")
-	}
-
-	// Readiness probe for graceful shutdown support
-	readinessResponseCode := uint32(http.StatusOK)
-	if len(readyCheck) > 0 {
-		r.HandleFunc(readyCheck, func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(int(atomic.LoadUint32(&readinessResponseCode)))
-		})
+		return
 	}
 
-	corsHandler := handlers.CORS()(r)
-	loggingHandler := log.LoggingMiddleware(logger)(corsHandler)
-
 	logger.Info("Server started and listening on %s", listen)
 
-	// Support for upgrading an http/1.1 connection to http/2
-	// See https://github.com/thrawn01/h2c-golang-example
-	http2Server := &http2.Server{}
-	server := &http.Server{
-		Addr:    listen,
-		Handler: h2c.NewHandler(loggingHandler, http2Server),
+	httpServer := &http.Server{
+		Addr:              listen,
+		Handler:           tileServer.Handler(),
+		ReadTimeout:       readTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
 	}
 
 	// Code to handle shutdown gracefully
 	shutdownChan := make(chan struct{})
+
+	// Restart the background workers if they get stuck, until shutdown completes
+	if watchdog := tileServer.Watchdog(); watchdog != nil {
+		go watchdog.Run(shutdownChan)
+	}
 	go func() {
 		defer close(shutdownChan)
 
@@ -387,26 +591,143 @@ func main() {
 		<-signals
 
 		logger.Info("SIGTERM received. Starting graceful shutdown.")
+		shutdownStart := time.Now()
+
+		drainState := func(done bool) *state.DrainState {
+			return tileServer.DrainState(time.Since(shutdownStart), done)
+		}
+		reportDrain := func(ds *state.DrainState) {
+			logData := ds.AsJsonMap()
+			logData["type"] = "info"
+			logData["category"] = log.LogCategory_Shutdown.String()
+			logger.Log(logData)
+			tileServer.MetricsWriter().WriteDrainState(ds)
+		}
+
+		// Report the outstanding work periodically until shutdown completes
+		drainDone := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(drainReportInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					reportDrain(drainState(false))
+				case <-drainDone:
+					return
+				}
+			}
+		}()
 
 		// Start failing readiness probes
-		atomic.StoreUint32(&readinessResponseCode, http.StatusInternalServerError)
+		tileServer.SetReady(false)
 		// Wait for upstream clients
 		time.Sleep(gracefulShutdownSleep)
 		// Begin shutdown of in-flight requests
 		shutdownCtx, shutdownCtxCancel := context.WithTimeout(context.Background(), gracefulShutdownTimeout)
-		if err := server.Shutdown(shutdownCtx); err != nil {
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
 			logger.Info("Error waiting for server shutdown: %+v", err)
 		}
 		shutdownCtxCancel()
+
+		// Give the background cache sets a chance to reach redis
+		flushDeadline := time.Now().Add(cacheFlushTimeout)
+		for handler.PendingCacheSets() > 0 && time.Now().Before(flushDeadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		close(drainDone)
+		reportDrain(drainState(true))
+		tileServer.Close()
 	}()
 
 	logger.Info("Service started")
-	if err := server.ListenAndServe(); err != nil {
+	if isWorker {
+		// the workers share the address, with the kernel balancing
+		// connections between them
+		listener, err := server.ListenReusePort(listen)
+		if err == nil {
+			err = httpServer.Serve(listener)
+		}
+		// a worker which can't serve exits, for the supervisor to restart
+		// it, rather than running on without serving
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error(log.LogCategory_WorkerExit, "Couldn't serve HTTP: %+v", err)
+			os.Exit(1)
+		}
+	} else if err := httpServer.ListenAndServe(); err != nil {
 		logger.Info("Couldn't start HTTP server: %+v", err)
 	}
 	<-shutdownChan
 }
 
+// supervise runs the worker processes, each this executable with the same
+// arguments, until SIGTERM, which is passed on to the workers to drain. A
+// worker which keeps exiting as soon as it starts stops them all and exits
+// non-zero, as they'd all fail alike, eg. with an invalid config.
+func supervise(logger log.JsonLogger, workers int) {
+	command, err := os.Executable()
+	if err != nil {
+		command = os.Args[0]
+	}
+	supervisor, err := server.NewSupervisor(server.SupervisorOptions{
+		Workers: workers,
+		Command: command,
+		Args:    os.Args[1:],
+	}, logger)
+	if err != nil {
+		logFatalCfgErr(logger, "%s", err.Error())
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+
+	if err := supervisor.Start(); err != nil {
+		logFatalCfgErr(logger, "%s", err.Error())
+	}
+	logger.Info("Supervising %d workers", workers)
+
+	select {
+	case <-signals:
+		logger.Info("SIGTERM received. Stopping the workers.")
+		supervisor.Stop()
+	case err := <-supervisor.Failed():
+		logger.Error(log.LogCategory_WorkerExit, "Stopping the workers: %s", err.Error())
+		supervisor.Stop()
+		os.Exit(1)
+	}
+}
+
+// listKeys prints every key in the storage of the pattern with the prefix,
+// one per line, a page at a time.
+func listKeys(tileServer *server.Server, pattern, format, prefix string) error {
+	after := ""
+	for {
+		result, err := tileServer.List(pattern, format, prefix, after, listPageSize)
+		if err != nil {
+			return err
+		}
+		for _, key := range result.Keys {
+			fmt.Println(key)
+		}
+		if !result.Truncated || len(result.Keys) == 0 {
+			return nil
+		}
+		after = result.Keys[len(result.Keys)-1]
+	}
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func logFatalCfgErr(logger log.JsonLogger, msg string, xs ...interface{}) {
 	logger.Error(log.LogCategory_ConfigError, msg, xs...)
 	os.Exit(1)
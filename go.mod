@@ -5,12 +5,17 @@ go 1.15
 require (
 	github.com/NYTimes/gziphandler v1.1.1
 	github.com/aws/aws-sdk-go v1.35.23
+	github.com/bradfitz/gomemcache v0.0.0-20230905024940-24af94b03874
 	github.com/go-redis/redis/v8 v8.10.0
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
 	github.com/imkira/go-interpol v1.1.0
+	github.com/lib/pq v1.10.9
 	github.com/namsral/flag v1.7.4-pre
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c
+	github.com/pkg/sftp v1.13.6
 	github.com/vmihailenco/msgpack/v5 v5.3.4
+	golang.org/x/crypto v0.1.0
 	golang.org/x/net v0.7.0
+	golang.org/x/sys v0.5.0
 )
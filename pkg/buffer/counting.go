@@ -0,0 +1,32 @@
+package buffer
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// CountingBufferManager wraps a BufferManager, counting the buffers which
+// have been taken from it and not yet put back.
+type CountingBufferManager struct {
+	bm    BufferManager
+	inUse int64
+}
+
+func NewCountingBufferManager(bm BufferManager) *CountingBufferManager {
+	return &CountingBufferManager{bm: bm}
+}
+
+func (c *CountingBufferManager) Get() *bytes.Buffer {
+	atomic.AddInt64(&c.inUse, 1)
+	return c.bm.Get()
+}
+
+func (c *CountingBufferManager) Put(buf *bytes.Buffer) {
+	atomic.AddInt64(&c.inUse, -1)
+	c.bm.Put(buf)
+}
+
+// InUse returns the number of buffers currently taken.
+func (c *CountingBufferManager) InUse() int64 {
+	return atomic.LoadInt64(&c.inUse)
+}
@@ -3,6 +3,8 @@ package cache
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/tilezen/tapalcatl/pkg/state"
@@ -13,38 +15,120 @@ import (
 type Cache interface {
 	GetTile(ctx context.Context, req *state.ParseResult) (*state.VectorTileResponseData, error)
 	SetTile(ctx context.Context, req *state.ParseResult, resp *state.VectorTileResponseData, ttl time.Duration) error
+	// GetTileVariant and SetTileVariant store the vector tile compressed
+	// with the given content encoding, alongside the uncompressed tile.
+	GetTileVariant(ctx context.Context, req *state.ParseResult, encoding string) (*state.VectorTileResponseData, error)
+	SetTileVariant(ctx context.Context, req *state.ParseResult, encoding string, resp *state.VectorTileResponseData, ttl time.Duration) error
 	GetMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord) (*state.MetatileResponseData, error)
 	SetMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord, resp *state.MetatileResponseData, ttl time.Duration) error
 	Get(ctx context.Context, key string) ([]byte, error)
 	Set(ctx context.Context, key string, val []byte, ttl time.Duration) error
+	// HealthCheck returns an error when the cache backend can't be reached.
+	HealthCheck(ctx context.Context) error
 }
 
-func buildVectorTileKey(req *state.ParseResult) string {
-	buildID := "default"
-	if req.BuildID != "" {
-		buildID = req.BuildID
+// StaleCache is implemented by caches which keep entries for a while past
+// their TTL. Stale entries are misses for the Cache methods, but can be
+// served when storage is unavailable.
+type StaleCache interface {
+	GetStaleTile(ctx context.Context, req *state.ParseResult) (*state.VectorTileResponseData, error)
+	GetStaleMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord) (*state.MetatileResponseData, error)
+}
+
+// Purger is implemented by caches which can remove everything cached for a
+// build, eg. when the build has been replaced.
+type Purger interface {
+	// Purge removes the tiles and metatiles of the build, the default build
+	// if buildID is empty, returning the number of entries removed.
+	Purge(ctx context.Context, buildID string) (int, error)
+}
+
+// keyVariablesSuffix returns a stable suffix for the request's key variables,
+// which select different objects in storage so must also separate the cache.
+func keyVariablesSuffix(req *state.ParseResult) string {
+	if len(req.KeyVariables) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(req.KeyVariables))
+	for name := range req.KeyVariables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for i, name := range names {
+		if i == 0 {
+			sb.WriteString(":")
+		} else {
+			sb.WriteString(",")
+		}
+		sb.WriteString(name)
+		sb.WriteString("=")
+		sb.WriteString(req.KeyVariables[name])
 	}
+	return sb.String()
+}
+
+// cacheKeyParamsSuffix returns a suffix for the request's significant query
+// parameters, which can change the tile served. Metatiles only depend on
+// where they are stored, so their keys don't have it.
+func cacheKeyParamsSuffix(req *state.ParseResult) string {
+	if req.CacheKeyParams == nil || *req.CacheKeyParams == "" {
+		return ""
+	}
+	return "?" + *req.CacheKeyParams
+}
+
+// buildNamespace returns the part of the cache keys for the build, which
+// separates the entries of each build.
+func buildNamespace(buildID string) string {
+	if buildID == "" {
+		return "default"
+	}
+	return buildID
+}
+
+// BuildVectorTileKey returns the cache key used to store the vector tile for the request.
+func BuildVectorTileKey(req *state.ParseResult) string {
+	buildID := buildNamespace(req.BuildID)
 
 	if metatileHandlerExtra, ok := req.AdditionalData.(*state.MetatileParseData); ok {
 		return fmt.Sprintf(
-			"vector:%s:%d/%d/%d.%s",
+			"vector:%s:%d/%d/%d.%s%s",
 			buildID,
 			metatileHandlerExtra.Coord.Z,
 			metatileHandlerExtra.Coord.X,
 			metatileHandlerExtra.Coord.Y,
 			metatileHandlerExtra.Coord.Format,
-		)
+			keyVariablesSuffix(req),
+		) + cacheKeyParamsSuffix(req)
 	}
 	return ""
 }
 
-func buildMetatileKey(req *state.ParseResult, coord tile.TileCoord) string {
-	buildID := "default"
-	if req.BuildID != "" {
-		buildID = req.BuildID
+// BuildVectorTileVariantKey returns the cache key used to store the vector
+// tile for the request compressed with the given content encoding.
+func BuildVectorTileVariantKey(req *state.ParseResult, encoding string) string {
+	key := BuildVectorTileKey(req)
+	if key == "" {
+		return ""
 	}
+	return key + ":" + encoding
+}
 
-	return fmt.Sprintf("metatile:%s:%d/%d/%d.%s", buildID, coord.Z, coord.X, coord.Y, coord.Format)
+// BuildMetatileKey returns the cache key used to store the metatile at coord for the request.
+// The request's storage namespace follows the build, so that the metatiles of each storage
+// are kept apart while purging a build still removes them all.
+func BuildMetatileKey(req *state.ParseResult, coord tile.TileCoord) string {
+	buildID := buildNamespace(req.BuildID)
+
+	storageNamespace := ""
+	if req.StorageNamespace != "" {
+		storageNamespace = req.StorageNamespace + ":"
+	}
+
+	return fmt.Sprintf("metatile:%s:%s%d/%d/%d.%s%s", buildID, storageNamespace, coord.Z, coord.X, coord.Y, coord.Format, keyVariablesSuffix(req))
 }
 
 func marshallVectorTileData(data *state.VectorTileResponseData) ([]byte, error) {
@@ -110,6 +194,14 @@ func (n nilCache) SetTile(ctx context.Context, req *state.ParseResult, resp *sta
 	return nil
 }
 
+func (n nilCache) GetTileVariant(ctx context.Context, req *state.ParseResult, encoding string) (*state.VectorTileResponseData, error) {
+	return nil, nil
+}
+
+func (n nilCache) SetTileVariant(ctx context.Context, req *state.ParseResult, encoding string, resp *state.VectorTileResponseData, ttl time.Duration) error {
+	return nil
+}
+
 func (n nilCache) Get(ctx context.Context, key string) ([]byte, error) {
 	return nil, nil
 }
@@ -117,3 +209,7 @@ func (n nilCache) Get(ctx context.Context, key string) ([]byte, error) {
 func (n nilCache) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
 	return nil
 }
+
+func (n nilCache) HealthCheck(ctx context.Context) error {
+	return nil
+}
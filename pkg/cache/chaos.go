@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// chaosCache makes a fraction of the calls to another cache time out, so
+// that the handling of a slow cache can be exercised in staging. Health
+// checks aren't affected.
+type chaosCache struct {
+	cache       Cache
+	timeoutRate float64
+	// rand returns a number in [0, 1), replaced by tests
+	rand func() float64
+}
+
+// NewChaosCache wraps the cache so that timeoutRate of its calls, from 0 to
+// 1, wait until their context is done and fail with its error.
+func NewChaosCache(cache Cache, timeoutRate float64) (Cache, error) {
+	if timeoutRate < 0 || timeoutRate > 1 {
+		return nil, fmt.Errorf("chaos cache timeout rate must be between 0 and 1, but is %g", timeoutRate)
+	}
+	return &chaosCache{cache: cache, timeoutRate: timeoutRate, rand: rand.Float64}, nil
+}
+
+// timeout returns an error once the context is done for the calls chosen to
+// time out, and nil for the others.
+func (c *chaosCache) timeout(ctx context.Context) error {
+	if c.timeoutRate == 0 || c.rand() >= c.timeoutRate {
+		return nil
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		// don't hang calls which would never time out
+		return context.DeadlineExceeded
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (c *chaosCache) GetTile(ctx context.Context, req *state.ParseResult) (*state.VectorTileResponseData, error) {
+	if err := c.timeout(ctx); err != nil {
+		return nil, err
+	}
+	return c.cache.GetTile(ctx, req)
+}
+
+func (c *chaosCache) SetTile(ctx context.Context, req *state.ParseResult, resp *state.VectorTileResponseData, ttl time.Duration) error {
+	if err := c.timeout(ctx); err != nil {
+		return err
+	}
+	return c.cache.SetTile(ctx, req, resp, ttl)
+}
+
+func (c *chaosCache) GetTileVariant(ctx context.Context, req *state.ParseResult, encoding string) (*state.VectorTileResponseData, error) {
+	if err := c.timeout(ctx); err != nil {
+		return nil, err
+	}
+	return c.cache.GetTileVariant(ctx, req, encoding)
+}
+
+func (c *chaosCache) SetTileVariant(ctx context.Context, req *state.ParseResult, encoding string, resp *state.VectorTileResponseData, ttl time.Duration) error {
+	if err := c.timeout(ctx); err != nil {
+		return err
+	}
+	return c.cache.SetTileVariant(ctx, req, encoding, resp, ttl)
+}
+
+func (c *chaosCache) GetMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord) (*state.MetatileResponseData, error) {
+	if err := c.timeout(ctx); err != nil {
+		return nil, err
+	}
+	return c.cache.GetMetatile(ctx, req, metaCoord)
+}
+
+func (c *chaosCache) SetMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord, resp *state.MetatileResponseData, ttl time.Duration) error {
+	if err := c.timeout(ctx); err != nil {
+		return err
+	}
+	return c.cache.SetMetatile(ctx, req, metaCoord, resp, ttl)
+}
+
+func (c *chaosCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := c.timeout(ctx); err != nil {
+		return nil, err
+	}
+	return c.cache.Get(ctx, key)
+}
+
+func (c *chaosCache) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	if err := c.timeout(ctx); err != nil {
+		return err
+	}
+	return c.cache.Set(ctx, key, val, ttl)
+}
+
+// GetStaleTile and GetStaleMetatile miss when the cache doesn't keep stale
+// entries.
+func (c *chaosCache) GetStaleTile(ctx context.Context, req *state.ParseResult) (*state.VectorTileResponseData, error) {
+	staleCache, ok := c.cache.(StaleCache)
+	if !ok {
+		return nil, nil
+	}
+	if err := c.timeout(ctx); err != nil {
+		return nil, err
+	}
+	return staleCache.GetStaleTile(ctx, req)
+}
+
+func (c *chaosCache) GetStaleMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord) (*state.MetatileResponseData, error) {
+	staleCache, ok := c.cache.(StaleCache)
+	if !ok {
+		return nil, nil
+	}
+	if err := c.timeout(ctx); err != nil {
+		return nil, err
+	}
+	return staleCache.GetStaleMetatile(ctx, req, metaCoord)
+}
+
+func (c *chaosCache) Purge(ctx context.Context, buildID string) (int, error) {
+	purger, ok := c.cache.(Purger)
+	if !ok {
+		return 0, fmt.Errorf("cache can't be purged")
+	}
+	return purger.Purge(ctx, buildID)
+}
+
+func (c *chaosCache) HealthCheck(ctx context.Context) error {
+	return c.cache.HealthCheck(ctx)
+}
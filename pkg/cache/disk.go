@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/diskstore"
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// DiskCacheOptions are the settings of a disk cache.
+type DiskCacheOptions struct {
+	// Dir is the directory to keep metatiles in, created if missing.
+	// Metatiles left in it by a previous process are removed, as their
+	// TTLs aren't known.
+	Dir string
+	// MaxBytes bounds the size of the metatiles kept, evicting the least
+	// recently used ones to stay under it.
+	MaxBytes int64
+	// Mmap reads metatiles by mapping their files into memory, where the
+	// platform supports it, rather than copying them into a buffer first.
+	Mmap bool
+	// FillTTL is how long metatiles found in the next cache are kept on
+	// disk, as the next cache doesn't say how long they have left. 0 only
+	// keeps the metatiles set through the disk cache.
+	FillTTL time.Duration
+}
+
+// diskCache keeps metatiles in files on local disk, in front of another
+// cache, for metatiles too large to keep in memory but too often requested
+// to fetch from redis or storage each time. Metatiles missing from the disk
+// are read from the next cache, and kept on disk when found there. Tiles,
+// and the other methods, go straight to the next cache.
+type diskCache struct {
+	next    Cache
+	options DiskCacheOptions
+	// store holds the metatiles, with the time they expire as their Meta
+	store *diskstore.Store
+	// now returns the current time, replaced by tests
+	now func() time.Time
+}
+
+// NewDiskCache returns a cache keeping metatiles in the options' Dir in
+// front of the next cache, eg. redis or NilCache.
+func NewDiskCache(next Cache, options DiskCacheOptions) (Cache, error) {
+	store, err := diskstore.New(diskstore.Options{
+		Dir:      options.Dir,
+		MaxBytes: options.MaxBytes,
+		Mmap:     options.Mmap,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &diskCache{
+		next:    next,
+		options: options,
+		store:   store,
+		now:     time.Now,
+	}, nil
+}
+
+// read returns the metatile at key, or nil on a miss. Expired metatiles,
+// and those whose files can't be read, are dropped and miss.
+func (c *diskCache) read(key string) (*state.MetatileResponseData, error) {
+	entry, ok := c.store.Lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	if !c.now().Before(entry.Meta.(time.Time)) {
+		c.store.Remove(entry)
+		return nil, nil
+	}
+
+	data, release, ok := c.store.Read(entry)
+	if !ok {
+		return nil, nil
+	}
+	// unmarshalling copies the bytes out of the mapped file
+	defer release()
+
+	return unmarshallMetatileData(data)
+}
+
+// write keeps the metatile at key for ttl. Metatiles larger than MaxBytes
+// aren't kept.
+func (c *diskCache) write(key string, resp *state.MetatileResponseData, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	marshalled, err := marshallMetatileData(resp)
+	if err != nil {
+		return err
+	}
+	return c.store.Write(key, marshalled, c.now().Add(ttl))
+}
+
+func (c *diskCache) GetMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord) (*state.MetatileResponseData, error) {
+	key := BuildMetatileKey(req, metaCoord)
+
+	resp, err := c.read(key)
+	if err != nil {
+		return nil, fmt.Errorf("error getting from disk cache: %w", err)
+	}
+	if resp != nil {
+		return resp, nil
+	}
+
+	resp, err = c.next.GetMetatile(ctx, req, metaCoord)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+	// failing to keep the metatile on disk doesn't fail the get
+	_ = c.write(key, resp, c.options.FillTTL)
+	return resp, nil
+}
+
+func (c *diskCache) SetMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord, resp *state.MetatileResponseData, ttl time.Duration) error {
+	if err := c.write(BuildMetatileKey(req, metaCoord), resp, ttl); err != nil {
+		return fmt.Errorf("error setting to disk cache: %w", err)
+	}
+	return c.next.SetMetatile(ctx, req, metaCoord, resp, ttl)
+}
+
+func (c *diskCache) GetTile(ctx context.Context, req *state.ParseResult) (*state.VectorTileResponseData, error) {
+	return c.next.GetTile(ctx, req)
+}
+
+func (c *diskCache) SetTile(ctx context.Context, req *state.ParseResult, resp *state.VectorTileResponseData, ttl time.Duration) error {
+	return c.next.SetTile(ctx, req, resp, ttl)
+}
+
+func (c *diskCache) GetTileVariant(ctx context.Context, req *state.ParseResult, encoding string) (*state.VectorTileResponseData, error) {
+	return c.next.GetTileVariant(ctx, req, encoding)
+}
+
+func (c *diskCache) SetTileVariant(ctx context.Context, req *state.ParseResult, encoding string, resp *state.VectorTileResponseData, ttl time.Duration) error {
+	return c.next.SetTileVariant(ctx, req, encoding, resp, ttl)
+}
+
+func (c *diskCache) Get(ctx context.Context, key string) ([]byte, error) {
+	return c.next.Get(ctx, key)
+}
+
+func (c *diskCache) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	return c.next.Set(ctx, key, val, ttl)
+}
+
+// GetStaleTile and GetStaleMetatile go to the next cache, as metatiles are
+// removed from disk once their TTL is up.
+func (c *diskCache) GetStaleTile(ctx context.Context, req *state.ParseResult) (*state.VectorTileResponseData, error) {
+	staleCache, ok := c.next.(StaleCache)
+	if !ok {
+		return nil, nil
+	}
+	return staleCache.GetStaleTile(ctx, req)
+}
+
+func (c *diskCache) GetStaleMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord) (*state.MetatileResponseData, error) {
+	staleCache, ok := c.next.(StaleCache)
+	if !ok {
+		return nil, nil
+	}
+	return staleCache.GetStaleMetatile(ctx, req, metaCoord)
+}
+
+// Purge removes the build's metatiles from disk, then purges the next
+// cache if it can be.
+func (c *diskCache) Purge(ctx context.Context, buildID string) (int, error) {
+	purged := c.store.DropPrefix("metatile:" + buildNamespace(buildID) + ":")
+
+	purger, ok := c.next.(Purger)
+	if !ok {
+		return purged, nil
+	}
+	n, err := purger.Purge(ctx, buildID)
+	return purged + n, err
+}
+
+func (c *diskCache) HealthCheck(ctx context.Context) error {
+	return c.next.HealthCheck(ctx)
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/diskstore"
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	leftover := filepath.Join(dir, "leftover"+diskstore.Suffix)
+	if err := ioutil.WriteFile(leftover, []byte("old"), 0644); err != nil {
+		t.Fatalf("Unable to write leftover file: %s", err.Error())
+	}
+
+	ctx := context.Background()
+	req := &state.ParseResult{}
+	metatile := func(x int) (tile.TileCoord, *state.MetatileResponseData) {
+		return tile.TileCoord{Z: 1, X: x, Y: 0, Format: "zip"}, &state.MetatileResponseData{Data: bytes.Repeat([]byte{byte(x)}, 100)}
+	}
+	coordA, respA := metatile(0)
+	coordB, respB := metatile(1)
+	coordC, respC := metatile(2)
+
+	size, err := marshallMetatileData(respA)
+	if err != nil {
+		t.Fatalf("Unable to marshall metatile: %s", err.Error())
+	}
+
+	for _, mmap := range []bool{false, true} {
+		c, err := NewDiskCache(NilCache, DiskCacheOptions{Dir: dir, MaxBytes: int64(2 * len(size)), Mmap: mmap})
+		if err != nil {
+			t.Fatalf("Unable to create disk cache: %s", err.Error())
+		}
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Fatalf("Expected the leftover metatile to be removed, got %v", err)
+		}
+		dc := c.(*diskCache)
+		now := time.Now()
+		dc.now = func() time.Time { return now }
+
+		for _, set := range []struct {
+			coord tile.TileCoord
+			resp  *state.MetatileResponseData
+		}{{coordA, respA}, {coordB, respB}} {
+			if err := c.SetMetatile(ctx, req, set.coord, set.resp, time.Minute); err != nil {
+				t.Fatalf("Unable to set metatile: %s", err.Error())
+			}
+		}
+		// using A leaves B the least recently used, to be evicted for C
+		if got, err := c.GetMetatile(ctx, req, coordA); err != nil || got == nil || !bytes.Equal(got.Data, respA.Data) {
+			t.Fatalf("Expected metatile A from disk, got %v, %v", got, err)
+		}
+		if err := c.SetMetatile(ctx, req, coordC, respC, time.Minute); err != nil {
+			t.Fatalf("Unable to set metatile: %s", err.Error())
+		}
+		if got, err := c.GetMetatile(ctx, req, coordB); err != nil || got != nil {
+			t.Fatalf("Expected metatile B to have been evicted, got %v, %v", got, err)
+		}
+		if got, err := c.GetMetatile(ctx, req, coordC); err != nil || got == nil || !bytes.Equal(got.Data, respC.Data) {
+			t.Fatalf("Expected metatile C from disk, got %v, %v", got, err)
+		}
+		if size := dc.store.Size(); size > dc.options.MaxBytes {
+			t.Fatalf("Expected at most %d bytes on disk, got %d", dc.options.MaxBytes, size)
+		}
+
+		now = now.Add(time.Minute)
+		if got, err := c.GetMetatile(ctx, req, coordA); err != nil || got != nil {
+			t.Fatalf("Expected metatile A to have expired, got %v, %v", got, err)
+		}
+
+		purged, err := c.(Purger).Purge(ctx, "")
+		if err != nil || purged != 1 {
+			t.Fatalf("Expected to purge metatile C, got %d, %v", purged, err)
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		if len(files) != 0 {
+			t.Fatalf("Expected no files left on disk, got %v", files)
+		}
+	}
+}
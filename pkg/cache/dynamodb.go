@@ -0,0 +1,230 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// The attributes of the items of a DynamoDB cache. The table's partition key
+// is the string attribute "key".
+const (
+	dynamoDBKeyAttribute   = "key"
+	dynamoDBValueAttribute = "value"
+	// DefaultDynamoDBTTLAttribute is the attribute holding when an item
+	// expires, in seconds since the epoch, unless configured otherwise.
+	DefaultDynamoDBTTLAttribute = "expires"
+)
+
+// DynamoDBCacheOptions holds the optional settings of a DynamoDB cache. The
+// zero value gives the default behaviour.
+type DynamoDBCacheOptions struct {
+	// TTLAttribute is the number attribute holding when an item expires, in
+	// seconds since the epoch. It should be the table's TTL attribute, so
+	// that DynamoDB deletes expired items.
+	TTLAttribute string
+	// StaleTTL keeps tiles and metatiles this long past their TTL, for the
+	// StaleCache methods to serve when storage is unavailable.
+	StaleTTL time.Duration
+}
+
+// dynamoDBCache caches in a DynamoDB table. DynamoDB deletes expired items
+// only eventually, so they're checked for expiry when they're read. Items
+// are limited to 400KB, so the largest metatiles fail to be cached.
+type dynamoDBCache struct {
+	client  dynamodbiface.DynamoDBAPI
+	table   string
+	options DynamoDBCacheOptions
+	// now returns the current time, replaced by tests
+	now func() time.Time
+}
+
+var _ StaleCache = &dynamoDBCache{}
+
+// getItem gets the value at key and how long it has left until it
+// expires, which is negative when it doesn't.
+func (m *dynamoDBCache) getItem(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	out, err := m.client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(m.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamoDBKeyAttribute: {S: aws.String(key)},
+		},
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting from dynamodb: %w", err)
+	}
+	value, ok := out.Item[dynamoDBValueAttribute]
+	if !ok {
+		return nil, 0, nil
+	}
+
+	remaining := time.Duration(-1)
+	if expires, ok := out.Item[m.options.TTLAttribute]; ok && expires.N != nil {
+		seconds, err := strconv.ParseInt(*expires.N, 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid %s of dynamodb item %s: %w", m.options.TTLAttribute, key, err)
+		}
+		remaining = time.Unix(seconds, 0).Sub(m.now())
+		if remaining <= 0 {
+			return nil, 0, nil
+		}
+	}
+	return value.B, remaining, nil
+}
+
+func (m *dynamoDBCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := m.getItem(ctx, key)
+	return value, err
+}
+
+// Set puts the value at key, expiring after ttl, or never if ttl isn't
+// positive.
+func (m *dynamoDBCache) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	item := map[string]*dynamodb.AttributeValue{
+		dynamoDBKeyAttribute:   {S: aws.String(key)},
+		dynamoDBValueAttribute: {B: val},
+	}
+	if ttl > 0 {
+		expires := m.now().Add(ttl).Unix()
+		item[m.options.TTLAttribute] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expires, 10))}
+	}
+
+	_, err := m.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(m.table),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("error setting to dynamodb: %w", err)
+	}
+
+	return nil
+}
+
+// getFresh gets the value at key, treating values within StaleTTL of
+// expiring as misses.
+func (m *dynamoDBCache) getFresh(ctx context.Context, key string) ([]byte, error) {
+	value, remaining, err := m.getItem(ctx, key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	if m.options.StaleTTL > 0 && remaining >= 0 && remaining <= m.options.StaleTTL {
+		return nil, nil
+	}
+	return value, nil
+}
+
+// setStale sets the value at key to expire StaleTTL after ttl.
+func (m *dynamoDBCache) setStale(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	if m.options.StaleTTL > 0 && ttl > 0 {
+		ttl += m.options.StaleTTL
+	}
+	return m.Set(ctx, key, val, ttl)
+}
+
+func (m *dynamoDBCache) GetTile(ctx context.Context, req *state.ParseResult) (*state.VectorTileResponseData, error) {
+	item, err := m.getFresh(ctx, BuildVectorTileKey(req))
+	if err != nil || item == nil {
+		return nil, err
+	}
+
+	return unmarshallVectorTileData(item)
+}
+
+func (m *dynamoDBCache) SetTile(ctx context.Context, req *state.ParseResult, resp *state.VectorTileResponseData, ttl time.Duration) error {
+	marshalled, err := marshallVectorTileData(resp)
+	if err != nil {
+		return fmt.Errorf("error marshalling to dynamodb: %w", err)
+	}
+
+	return m.setStale(ctx, BuildVectorTileKey(req), marshalled, ttl)
+}
+
+func (m *dynamoDBCache) GetTileVariant(ctx context.Context, req *state.ParseResult, encoding string) (*state.VectorTileResponseData, error) {
+	item, err := m.Get(ctx, BuildVectorTileVariantKey(req, encoding))
+	if err != nil || item == nil {
+		return nil, err
+	}
+
+	return unmarshallVectorTileData(item)
+}
+
+func (m *dynamoDBCache) SetTileVariant(ctx context.Context, req *state.ParseResult, encoding string, resp *state.VectorTileResponseData, ttl time.Duration) error {
+	marshalled, err := marshallVectorTileData(resp)
+	if err != nil {
+		return fmt.Errorf("error marshalling to dynamodb: %w", err)
+	}
+
+	return m.Set(ctx, BuildVectorTileVariantKey(req, encoding), marshalled, ttl)
+}
+
+func (m *dynamoDBCache) GetMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord) (*state.MetatileResponseData, error) {
+	item, err := m.getFresh(ctx, BuildMetatileKey(req, metaCoord))
+	if err != nil || item == nil {
+		return nil, err
+	}
+
+	return unmarshallMetatileData(item)
+}
+
+func (m *dynamoDBCache) SetMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord, resp *state.MetatileResponseData, ttl time.Duration) error {
+	marshalled, err := marshallMetatileData(resp)
+	if err != nil {
+		return fmt.Errorf("error marshalling to dynamodb: %w", err)
+	}
+
+	return m.setStale(ctx, BuildMetatileKey(req, metaCoord), marshalled, ttl)
+}
+
+func (m *dynamoDBCache) GetStaleTile(ctx context.Context, req *state.ParseResult) (*state.VectorTileResponseData, error) {
+	item, err := m.Get(ctx, BuildVectorTileKey(req))
+	if err != nil || item == nil {
+		return nil, err
+	}
+
+	return unmarshallVectorTileData(item)
+}
+
+func (m *dynamoDBCache) GetStaleMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord) (*state.MetatileResponseData, error) {
+	item, err := m.Get(ctx, BuildMetatileKey(req, metaCoord))
+	if err != nil || item == nil {
+		return nil, err
+	}
+
+	return unmarshallMetatileData(item)
+}
+
+// HealthCheck describes the table, which fails if it can't be reached or
+// doesn't exist.
+func (m *dynamoDBCache) HealthCheck(ctx context.Context) error {
+	_, err := m.client.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(m.table),
+	})
+	if err != nil {
+		return fmt.Errorf("error describing dynamodb table %s: %w", m.table, err)
+	}
+
+	return nil
+}
+
+func NewDynamoDBCache(client dynamodbiface.DynamoDBAPI, table string) Cache {
+	return NewDynamoDBCacheWithOptions(client, table, DynamoDBCacheOptions{})
+}
+
+func NewDynamoDBCacheWithOptions(client dynamodbiface.DynamoDBAPI, table string, options DynamoDBCacheOptions) Cache {
+	if options.TTLAttribute == "" {
+		options.TTLAttribute = DefaultDynamoDBTTLAttribute
+	}
+	return &dynamoDBCache{
+		client:  client,
+		table:   table,
+		options: options,
+		now:     time.Now,
+	}
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// memoryDynamoDB is a table of items by their key, which doesn't delete
+// expired items, like DynamoDB until it gets around to it.
+type memoryDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (m *memoryDynamoDB) GetItemWithContext(_ aws.Context, i *dynamodb.GetItemInput, _ ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: m.items[*i.Key[dynamoDBKeyAttribute].S]}, nil
+}
+
+func (m *memoryDynamoDB) PutItemWithContext(_ aws.Context, i *dynamodb.PutItemInput, _ ...request.Option) (*dynamodb.PutItemOutput, error) {
+	m.items[*i.Item[dynamoDBKeyAttribute].S] = i.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestDynamoDBCache(t *testing.T) {
+	db := &memoryDynamoDB{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	c := NewDynamoDBCacheWithOptions(db, "tiles", DynamoDBCacheOptions{TTLAttribute: "ttl", StaleTTL: time.Hour}).(*dynamoDBCache)
+	now := time.Unix(1600000000, 0)
+	c.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	req := &state.ParseResult{BuildID: "build"}
+	coord := tile.TileCoord{Z: 1, X: 0, Y: 1, Format: "zip"}
+	metatile := &state.MetatileResponseData{Data: []byte("metatile")}
+	if err := c.SetMetatile(ctx, req, coord, metatile, time.Minute); err != nil {
+		t.Fatalf("Unable to set metatile: %s", err.Error())
+	}
+
+	item := db.items[BuildMetatileKey(req, coord)]
+	if item["ttl"] == nil || *item["ttl"].N != "1600003660" {
+		t.Fatalf("Expected the metatile to expire after its TTL and the stale TTL, got %#v", item["ttl"])
+	}
+
+	got, err := c.GetMetatile(ctx, req, coord)
+	if err != nil || got == nil || !bytes.Equal(got.Data, metatile.Data) {
+		t.Fatalf("Expected the metatile back, got %#v, %v", got, err)
+	}
+
+	// past its TTL, it's only served stale
+	now = now.Add(2 * time.Minute)
+	if got, err = c.GetMetatile(ctx, req, coord); err != nil || got != nil {
+		t.Fatalf("Expected a miss for an expired metatile, got %#v, %v", got, err)
+	}
+	if got, err = c.GetStaleMetatile(ctx, req, coord); err != nil || got == nil {
+		t.Fatalf("Expected the stale metatile, got %#v, %v", got, err)
+	}
+
+	// past the stale TTL, the item is a miss even before DynamoDB deletes it
+	now = now.Add(time.Hour)
+	if got, err = c.GetStaleMetatile(ctx, req, coord); err != nil || got != nil {
+		t.Fatalf("Expected a miss for a metatile past its stale TTL, got %#v, %v", got, err)
+	}
+
+	// without a TTL, values don't expire
+	if err := c.Set(ctx, "forever", []byte("value"), 0); err != nil {
+		t.Fatalf("Unable to set value: %s", err.Error())
+	}
+	now = now.Add(24 * time.Hour)
+	if val, err := c.Get(ctx, "forever"); err != nil || string(val) != "value" {
+		t.Fatalf("Expected a value without a TTL not to expire, got %#v, %v", val, err)
+	}
+	if val, err := c.Get(ctx, "missing"); err != nil || val != nil {
+		t.Fatalf("Expected a miss for a missing key, got %#v, %v", val, err)
+	}
+}
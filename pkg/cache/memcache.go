@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// memcacheMaxRelativeTTL is the longest expiry memcached takes relative to
+// now. Longer ones are taken as a time in seconds since the epoch.
+const memcacheMaxRelativeTTL = 30 * 24 * time.Hour
+
+// memcacheClient is the part of memcache.Client used by the cache, replaced
+// by tests.
+type memcacheClient interface {
+	Get(key string) (*memcache.Item, error)
+	Set(item *memcache.Item) error
+	Ping() error
+}
+
+// memcacheCache caches in memcached, across several servers with keys
+// spread between them. The client isn't aware of contexts, so done contexts
+// only stop calls from being made. Values are limited to memcached's item
+// size, 1MB by default, so the largest metatiles fail to be cached.
+type memcacheCache struct {
+	client memcacheClient
+	// now returns the current time, replaced by tests
+	now func() time.Time
+}
+
+// memcacheKey returns key if memcached accepts it, otherwise its hash, eg.
+// for keys with spaces in key variables from headers.
+func memcacheKey(key string) string {
+	if len(key) <= 250 {
+		legal := true
+		for i := 0; i < len(key); i++ {
+			if key[i] <= ' ' || key[i] == 0x7f {
+				legal = false
+				break
+			}
+		}
+		if legal {
+			return key
+		}
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// expiration returns the memcached expiration of an item set now with ttl.
+func (m *memcacheCache) expiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl > memcacheMaxRelativeTTL {
+		return int32(m.now().Add(ttl).Unix())
+	}
+	// round up, as 0 would never expire
+	return int32((ttl + time.Second - 1) / time.Second)
+}
+
+func (m *memcacheCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	item, err := m.client.Get(memcacheKey(key))
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("error getting from memcache: %w", err)
+	}
+
+	return item.Value, nil
+}
+
+func (m *memcacheCache) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := m.client.Set(&memcache.Item{
+		Key:        memcacheKey(key),
+		Value:      val,
+		Expiration: m.expiration(ttl),
+	})
+	if err != nil {
+		return fmt.Errorf("error setting to memcache: %w", err)
+	}
+
+	return nil
+}
+
+func (m *memcacheCache) GetTile(ctx context.Context, req *state.ParseResult) (*state.VectorTileResponseData, error) {
+	item, err := m.Get(ctx, BuildVectorTileKey(req))
+	if err != nil || item == nil {
+		return nil, err
+	}
+
+	return unmarshallVectorTileData(item)
+}
+
+func (m *memcacheCache) SetTile(ctx context.Context, req *state.ParseResult, resp *state.VectorTileResponseData, ttl time.Duration) error {
+	marshalled, err := marshallVectorTileData(resp)
+	if err != nil {
+		return fmt.Errorf("error marshalling to memcache: %w", err)
+	}
+
+	return m.Set(ctx, BuildVectorTileKey(req), marshalled, ttl)
+}
+
+func (m *memcacheCache) GetTileVariant(ctx context.Context, req *state.ParseResult, encoding string) (*state.VectorTileResponseData, error) {
+	item, err := m.Get(ctx, BuildVectorTileVariantKey(req, encoding))
+	if err != nil || item == nil {
+		return nil, err
+	}
+
+	return unmarshallVectorTileData(item)
+}
+
+func (m *memcacheCache) SetTileVariant(ctx context.Context, req *state.ParseResult, encoding string, resp *state.VectorTileResponseData, ttl time.Duration) error {
+	marshalled, err := marshallVectorTileData(resp)
+	if err != nil {
+		return fmt.Errorf("error marshalling to memcache: %w", err)
+	}
+
+	return m.Set(ctx, BuildVectorTileVariantKey(req, encoding), marshalled, ttl)
+}
+
+func (m *memcacheCache) GetMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord) (*state.MetatileResponseData, error) {
+	item, err := m.Get(ctx, BuildMetatileKey(req, metaCoord))
+	if err != nil || item == nil {
+		return nil, err
+	}
+
+	return unmarshallMetatileData(item)
+}
+
+func (m *memcacheCache) SetMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord, resp *state.MetatileResponseData, ttl time.Duration) error {
+	marshalled, err := marshallMetatileData(resp)
+	if err != nil {
+		return fmt.Errorf("error marshalling to memcache: %w", err)
+	}
+
+	return m.Set(ctx, BuildMetatileKey(req, metaCoord), marshalled, ttl)
+}
+
+// HealthCheck pings every server, failing if any can't be reached.
+func (m *memcacheCache) HealthCheck(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := m.client.Ping()
+	if err != nil {
+		return fmt.Errorf("error pinging memcache: %w", err)
+	}
+
+	return nil
+}
+
+// NewMemcacheCache caches in the memcached servers at addrs, as host:port.
+func NewMemcacheCache(addrs []string) Cache {
+	return &memcacheCache{
+		client: memcache.New(addrs...),
+		now:    time.Now,
+	}
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// memoryMemcache keeps items by their key, without expiring them.
+type memoryMemcache struct {
+	items map[string]*memcache.Item
+}
+
+func (m *memoryMemcache) Get(key string) (*memcache.Item, error) {
+	item, ok := m.items[key]
+	if !ok {
+		return nil, memcache.ErrCacheMiss
+	}
+	return item, nil
+}
+
+func (m *memoryMemcache) Set(item *memcache.Item) error {
+	if len(item.Key) > 250 || strings.ContainsAny(item.Key, " \n") {
+		return memcache.ErrMalformedKey
+	}
+	m.items[item.Key] = item
+	return nil
+}
+
+func (m *memoryMemcache) Ping() error {
+	return nil
+}
+
+func TestMemcacheCache(t *testing.T) {
+	mc := &memoryMemcache{items: make(map[string]*memcache.Item)}
+	now := time.Unix(1600000000, 0)
+	c := &memcacheCache{client: mc, now: func() time.Time { return now }}
+
+	ctx := context.Background()
+	req := &state.ParseResult{KeyVariables: map[string]string{"style": "a b"}}
+	coord := tile.TileCoord{Z: 1, X: 0, Y: 1, Format: "zip"}
+	metatile := &state.MetatileResponseData{Data: []byte("metatile")}
+	if err := c.SetMetatile(ctx, req, coord, metatile, 1500*time.Millisecond); err != nil {
+		t.Fatalf("Unable to set metatile with a space in its key: %s", err.Error())
+	}
+
+	item := mc.items[memcacheKey(BuildMetatileKey(req, coord))]
+	if item == nil || item.Expiration != 2 {
+		t.Fatalf("Expected the metatile to expire after its TTL rounded up to seconds, got %#v", item)
+	}
+
+	got, err := c.GetMetatile(ctx, req, coord)
+	if err != nil || got == nil || !bytes.Equal(got.Data, metatile.Data) {
+		t.Fatalf("Expected the metatile back, got %#v, %v", got, err)
+	}
+	if got, err = c.GetMetatile(ctx, &state.ParseResult{}, coord); err != nil || got != nil {
+		t.Fatalf("Expected a miss for another metatile, got %#v, %v", got, err)
+	}
+
+	// TTLs past 30 days are sent as the time they expire
+	if err := c.Set(ctx, "long", []byte("value"), 60*24*time.Hour); err != nil {
+		t.Fatalf("Unable to set value: %s", err.Error())
+	}
+	if exp := mc.items["long"].Expiration; exp != int32(now.Add(60*24*time.Hour).Unix()) {
+		t.Fatalf("Expected a long TTL to be sent as the time it expires, got %d", exp)
+	}
+
+	// abandoned requests don't call memcached
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.Get(cancelled, "long"); err != context.Canceled {
+		t.Fatalf("Expected a get with a done context to fail, got %v", err)
+	}
+}
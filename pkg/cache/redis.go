@@ -10,8 +10,17 @@ import (
 	"github.com/tilezen/tapalcatl/pkg/tile"
 )
 
+// RedisCacheOptions holds the optional settings of a redis cache. The zero
+// value gives the default behaviour.
+type RedisCacheOptions struct {
+	// StaleTTL keeps tiles and metatiles this long past their TTL, for the
+	// StaleCache methods to serve when storage is unavailable.
+	StaleTTL time.Duration
+}
+
 type redisCache struct {
-	client *redis.Client
+	client  *redis.Client
+	options RedisCacheOptions
 }
 
 func (m *redisCache) Get(ctx context.Context, key string) ([]byte, error) {
@@ -37,10 +46,48 @@ func (m *redisCache) Set(ctx context.Context, key string, val []byte, ttl time.D
 	return nil
 }
 
+// getFresh gets the value at key, treating values within StaleTTL of
+// expiring as misses.
+func (m *redisCache) getFresh(ctx context.Context, key string) ([]byte, error) {
+	if m.options.StaleTTL <= 0 {
+		return m.Get(ctx, key)
+	}
+
+	pipe := m.client.Pipeline()
+	get := pipe.Get(ctx, key)
+	ttl := pipe.TTL(ctx, key)
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	bytes, err := get.Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// negative TTLs mean the key has no expiry, or has just gone
+	if remaining := ttl.Val(); remaining >= 0 && remaining <= m.options.StaleTTL {
+		return nil, nil
+	}
+
+	return bytes, nil
+}
+
+// setStale sets the value at key to expire StaleTTL after ttl.
+func (m *redisCache) setStale(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	if m.options.StaleTTL > 0 {
+		ttl += m.options.StaleTTL
+	}
+	return m.Set(ctx, key, val, ttl)
+}
+
 func (m *redisCache) GetTile(ctx context.Context, req *state.ParseResult) (*state.VectorTileResponseData, error) {
-	key := buildVectorTileKey(req)
+	key := BuildVectorTileKey(req)
 
-	item, err := m.Get(ctx, key)
+	item, err := m.getFresh(ctx, key)
 	if err != nil {
 		return nil, fmt.Errorf("error getting from redis: %w", err)
 	}
@@ -58,7 +105,43 @@ func (m *redisCache) GetTile(ctx context.Context, req *state.ParseResult) (*stat
 }
 
 func (m *redisCache) SetTile(ctx context.Context, req *state.ParseResult, resp *state.VectorTileResponseData, ttl time.Duration) error {
-	key := buildVectorTileKey(req)
+	key := BuildVectorTileKey(req)
+
+	marshalled, err := marshallVectorTileData(resp)
+	if err != nil {
+		return fmt.Errorf("error marshalling to redis: %w", err)
+	}
+
+	err = m.setStale(ctx, key, marshalled, ttl)
+	if err != nil {
+		return fmt.Errorf("error setting to redis: %w", err)
+	}
+
+	return nil
+}
+
+func (m *redisCache) GetTileVariant(ctx context.Context, req *state.ParseResult, encoding string) (*state.VectorTileResponseData, error) {
+	key := BuildVectorTileVariantKey(req, encoding)
+
+	item, err := m.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("error getting from redis: %w", err)
+	}
+
+	if item == nil {
+		return nil, nil
+	}
+
+	response, err := unmarshallVectorTileData(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (m *redisCache) SetTileVariant(ctx context.Context, req *state.ParseResult, encoding string, resp *state.VectorTileResponseData, ttl time.Duration) error {
+	key := BuildVectorTileVariantKey(req, encoding)
 
 	marshalled, err := marshallVectorTileData(resp)
 	if err != nil {
@@ -74,9 +157,9 @@ func (m *redisCache) SetTile(ctx context.Context, req *state.ParseResult, resp *
 }
 
 func (m *redisCache) GetMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord) (*state.MetatileResponseData, error) {
-	key := buildMetatileKey(req, metaCoord)
+	key := BuildMetatileKey(req, metaCoord)
 
-	item, err := m.Get(ctx, key)
+	item, err := m.getFresh(ctx, key)
 	if err != nil {
 		return nil, fmt.Errorf("error getting from redis: %w", err)
 	}
@@ -94,14 +177,14 @@ func (m *redisCache) GetMetatile(ctx context.Context, req *state.ParseResult, me
 }
 
 func (m *redisCache) SetMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord, resp *state.MetatileResponseData, ttl time.Duration) error {
-	key := buildMetatileKey(req, metaCoord)
+	key := BuildMetatileKey(req, metaCoord)
 
 	marshalled, err := marshallMetatileData(resp)
 	if err != nil {
 		return fmt.Errorf("error marshalling to redis: %w", err)
 	}
 
-	err = m.Set(ctx, key, marshalled, ttl)
+	err = m.setStale(ctx, key, marshalled, ttl)
 	if err != nil {
 		return fmt.Errorf("error setting to redis: %w", err)
 	}
@@ -109,8 +192,79 @@ func (m *redisCache) SetMetatile(ctx context.Context, req *state.ParseResult, me
 	return nil
 }
 
+func (m *redisCache) GetStaleTile(ctx context.Context, req *state.ParseResult) (*state.VectorTileResponseData, error) {
+	item, err := m.Get(ctx, BuildVectorTileKey(req))
+	if err != nil {
+		return nil, fmt.Errorf("error getting from redis: %w", err)
+	}
+
+	if item == nil {
+		return nil, nil
+	}
+
+	return unmarshallVectorTileData(item)
+}
+
+func (m *redisCache) GetStaleMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord) (*state.MetatileResponseData, error) {
+	item, err := m.Get(ctx, BuildMetatileKey(req, metaCoord))
+	if err != nil {
+		return nil, fmt.Errorf("error getting from redis: %w", err)
+	}
+
+	if item == nil {
+		return nil, nil
+	}
+
+	return unmarshallMetatileData(item)
+}
+
+func (m *redisCache) HealthCheck(ctx context.Context) error {
+	err := m.client.Ping(ctx).Err()
+	if err != nil {
+		return fmt.Errorf("error pinging redis: %w", err)
+	}
+
+	return nil
+}
+
+// purgeBatchSize is the number of keys scanned, and then deleted, at once.
+const purgeBatchSize = 1000
+
+// Purge scans for the keys of the build's tiles and metatiles, and deletes
+// them in batches.
+func (m *redisCache) Purge(ctx context.Context, buildID string) (int, error) {
+	namespace := buildNamespace(buildID)
+	purged := 0
+	for _, match := range []string{"vector:" + namespace + ":*", "metatile:" + namespace + ":*"} {
+		var cursor uint64
+		for {
+			keys, next, err := m.client.Scan(ctx, cursor, match, purgeBatchSize).Result()
+			if err != nil {
+				return purged, fmt.Errorf("error scanning redis: %w", err)
+			}
+			if len(keys) > 0 {
+				deleted, err := m.client.Del(ctx, keys...).Result()
+				if err != nil {
+					return purged, fmt.Errorf("error deleting from redis: %w", err)
+				}
+				purged += int(deleted)
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	}
+	return purged, nil
+}
+
 func NewRedisCache(client *redis.Client) Cache {
+	return NewRedisCacheWithOptions(client, RedisCacheOptions{})
+}
+
+func NewRedisCacheWithOptions(client *redis.Client, options RedisCacheOptions) Cache {
 	return &redisCache{
-		client: client,
+		client:  client,
+		options: options,
 	}
 }
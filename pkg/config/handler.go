@@ -6,11 +6,16 @@ import (
 )
 
 type HandlerConfig struct {
-	Aws     *awsConfig
-	Storage map[string]storageDefinition
-	Pattern map[string]routeHandlerConfig
+	Aws     *AwsConfig
+	Storage map[string]StorageDefinition
+	Pattern map[string]RouteHandlerConfig
 	Mime    map[string]string
-	Preview *previewConfig
+	// TileJson maps the format names of tilejson requests to the names of
+	// their documents in storage, without the .json extension, in addition
+	// to the builtin mapbox, geojson and topojson formats.
+	TileJson map[string]string
+	Preview  *PreviewConfig
+	Tenants  map[string]TenantConfig
 }
 
 func (h *HandlerConfig) String() string {
@@ -26,24 +31,34 @@ func (h *HandlerConfig) Set(line string) error {
 }
 
 // the handler config is the container for the json configuration
-// storageDefinition contains the base options for a particular storage
-// storageConfig contains the specific options for a particular pattern
-// pattern ties together request patterns with storageConfig
-// awsConfig contains session-wide options for aws backed storage
+// StorageDefinition contains the base options for a particular storage
+// StorageConfig contains the specific options for a particular pattern
+// pattern ties together request patterns with StorageConfig
+// AwsConfig contains session-wide options for aws backed storage
 
-// "s3" and "file" are the possible storage definition types
+// "s3", "http", "postgres", "file", "memory", "sftp", "webdav", "replicated" and "fallback" are the possible storage definition types
 
 // generic aws configuration applied to whole session
-type awsConfig struct {
+type AwsConfig struct {
 	// the AWS region requests will be coming from
 	Region *string
 	// attempt to assume this AWS IAM role when making requests to S3
 	Role *string
 }
 
-// previewConfig is the container for configuring a preview webpage.
+// TenantConfig gives a customer its own tiles under a prefix, which requests
+// made with its API keys are confined to.
+type TenantConfig struct {
+	// ApiKeys are the keys the tenant makes requests with
+	ApiKeys []string
+	// Prefix overrides the storage prefix of the tenant's requests, and
+	// builds selected with buildid are found under it
+	Prefix string
+}
+
+// PreviewConfig is the container for configuring a preview webpage.
 // Both attributes are required if preview is specified.
-type previewConfig struct {
+type PreviewConfig struct {
 	// Path is the HTTP path to register to serve the given template.
 	Path *string
 	// Template is a path on disk to the template to serve at the above URL.
@@ -52,7 +67,7 @@ type previewConfig struct {
 	Data *map[string]interface{}
 }
 
-type storageDefinition struct {
+type StorageDefinition struct {
 	Type string
 
 	// common fields across all storage types
@@ -66,20 +81,196 @@ type storageDefinition struct {
 	// TileSize indicates the size of tile for this pattern. The default is 1.
 	TileSize *int
 
+	// BuildMetadata is the name of an object under each build's prefix
+	// declaring its metatile size, tile size and max detail zoom. When set,
+	// those override the sizes above for builds which have the object.
+	BuildMetadata string
+
+	// BuildManifest is the name of an object under the default prefix
+	// listing the builds and when they were made, to select them by date.
+	BuildManifest string
+	// BuildManifestRefresh is how often to read the manifest again, eg "1m"
+	BuildManifestRefresh string
+
 	// S3 key or file path to check for during healthcheck
 	Healthcheck string
 
+	// Retries is the most times a fetch is made again after a transient
+	// error, such as a timeout, 5xx response or S3 SlowDown, 0 to leave it
+	// to the aws sdk's retries for s3 and not retry others
+	Retries int
+	// RetryBaseDelay is the backoff before the first retry, doubling up to
+	// RetryMaxDelay, eg "50ms" and "1s" (the defaults)
+	RetryBaseDelay string
+	RetryMaxDelay  string
+
+	// FanOutPrefixes, when set, fetches metatiles from each of these build
+	// prefixes in parallel, serving the newest by Last-Modified, to roll
+	// out a build gradually rather than switching the default prefix
+	FanOutPrefixes []string
+
+	// DiskCacheDir, when set, caches the metatiles fetched from the storage
+	// in this local directory, up to DiskCacheMaxBytes, evicting the least
+	// recently used. They're served from disk for DiskCacheTTL, eg "5m",
+	// then revalidated with their ETag (default on every fetch).
+	DiskCacheDir      string
+	DiskCacheMaxBytes int64
+	DiskCacheTTL      string
+
+	// BundlePattern, when set, reads metatiles from bundles holding every
+	// metatile of a zoom, named by this pattern under the prefix with a {z}
+	// variable, eg "bundles/{z}.zip", located by an index alongside each
+	// with a .index suffix. Allowed for s3, file and memory storages.
+	BundlePattern string
+	// BundleMaxZoom is the highest zoom of the bundled metatiles
+	BundleMaxZoom int
+	// BundleIndexTTL is how long bundle indexes are used before they're
+	// reloaded, eg "5m", default 1m
+	BundleIndexTTL string
+
 	// s3 specific fields
 	Layer      string
 	Bucket     string
 	KeyPattern string
+	// Region overrides the aws region for this storage's bucket, eg. for
+	// the replicas of a bucket in several regions
+	Region string
+	// Endpoint, ForcePathStyle and DisableSSL point the storage at an S3
+	// compatible service, such as MinIO, Ceph RGW or localstack, which
+	// usually needs path style addressing (host/bucket/key)
+	Endpoint       string
+	ForcePathStyle bool
+	DisableSSL     bool
+	// RequesterPays is set for requester pays buckets, whose requests are
+	// charged to the account making them
+	RequesterPays bool
+	// SSECustomerKeyFile is a file holding the base64 encoded 256 bit key
+	// the objects are encrypted with (SSE-C), eg. a mounted secret. Objects
+	// encrypted with KMS keys (SSE-KMS) are read without one, given
+	// kms:Decrypt permission on the key.
+	SSECustomerKeyFile string
+	// MaxIdleConnsPerHost, IdleConnTimeout, DialTimeout,
+	// TLSHandshakeTimeout and ResponseHeaderTimeout tune the storage's
+	// http connections to S3, which otherwise use Go's default transport,
+	// keeping only 2 idle connections per host. Timeouts are durations, eg
+	// "5s". DisableHTTP2 sticks to HTTP/1.1.
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       string
+	DialTimeout           string
+	TLSHandshakeTimeout   string
+	ResponseHeaderTimeout string
+	DisableHTTP2          bool
+	// HealthcheckMethod is how the healthcheck key is checked: "head" (default), "get" or "list"
+	HealthcheckMethod string
+	// HashScheme computes the {hash} key variable: "none", "md5-N" (default "md5-5"), "sha1-N" or "crc32-hex"
+	HashScheme string
+	// HashCompatibility is the path hashed for {hash}: "legacy-layer-slash"
+	// hashes /layer/z/x/y.fmt and "tilequeue-344" hashes z/x/y.fmt. When
+	// empty it's inferred from whether Layer is set.
+	HashCompatibility string
+	// RequestTags are sent with each request as x-name=value query
+	// parameters, which S3 ignores but records in its server access logs
+	RequestTags map[string]string
+	// RevalidateTTL keeps tilejson and metadata objects in process for this
+	// long, then revalidates them with their ETag, eg "30s"
+	RevalidateTTL string
+	// RangedReads fetches only the zip central directory and the tile's
+	// entry of metatiles with Range requests, rather than whole metatiles,
+	// which are then not cached
+	RangedReads bool
+	// RangeMinBytes is the least fetched by a Range request, default 64KiB
+	RangeMinBytes int64
+	// HeadConditional checks metatiles with HeadObject before fetching them
+	// for conditional requests, responding 304 without the body if they
+	// match
+	HeadConditional bool
+	// BuildVersions maps the build IDs which can be requested from a
+	// versioned bucket to the time of the build, eg "2021-03-31T00:00:00Z".
+	// They're served from the versions of the default prefix's objects
+	// current at that time.
+	BuildVersions map[string]string
 
-	// file specific fields
+	// http specific fields, with HashScheme and HashCompatibility
+	// URLPattern is the URL of metatiles on the origin, with the same
+	// variables as KeyPattern
+	URLPattern string
+	// MetadataURLPattern is the URL of objects under a build's prefix,
+	// with {prefix} and {name} variables
+	MetadataURLPattern string
+
+	// postgres specific fields, with Healthcheck being a query, default
+	// "SELECT 1"
+	// ConnectionString is the lib/pq connection string, eg.
+	// "postgres://user@host/db?sslmode=require". Passwords can be left to
+	// the PGPASSWORD environment variable.
+	ConnectionString string
+	// Table has z, x, y, build and data columns, default "tiles"
+	Table string
+	// Tiles is set when the rows are individual tiles with a format column,
+	// rather than metatiles, for patterns with a metatile size of 1
+	Tiles bool
+	// MaxOpenConns and MaxIdleConns size the connection pool, default
+	// unlimited open and 2 idle connections
+	MaxOpenConns int
+	MaxIdleConns int
+	// ConnMaxLifetime closes pooled connections after this long, eg "5m"
+	ConnMaxLifetime string
+
+	// file specific fields, also used by memory storage
 	BaseDir string
+
+	// memory specific fields, with BaseDir and Healthcheck as for file
+	// MemoryMaxBytes, when set, fails startup if the files under BaseDir
+	// are larger in total, rather than loading them all into memory
+	MemoryMaxBytes int64
+
+	// sftp specific fields, with BaseDir and Healthcheck as for file, MaxOpenConns
+	// sizing the connection pool (default 4) and DialTimeout
+	// Address is the host and port of the SSH server, eg "files:22"
+	Address string
+	User    string
+	// PrivateKeyFile is the unencrypted private key to authenticate with
+	PrivateKeyFile string
+	// KnownHostsFile lists the server's host keys, in OpenSSH format
+	KnownHostsFile string
+
+	// webdav specific fields, with Healthcheck as for file and User as for
+	// sftp
+	// BaseURL is the directory on the WebDAV server the files are under,
+	// eg "https://cloud/remote.php/dav/files/tiles"
+	BaseURL string
+	// PasswordFile holds the password of the User, eg. a mounted secret
+	PasswordFile string
+
+	// replicated specific fields
+	Replicas []ReplicaConfig
+	// ReplicaCooldown is how long a failing replica is excluded, eg "30s"
+	ReplicaCooldown string
+	// ReplicaHealthCheckInterval enables periodic healthchecks of the replicas when set
+	ReplicaHealthCheckInterval string
+	// ReplicaHealthCheckTimeout fails the healthcheck of a replica which
+	// hasn't answered within it, default "5s"
+	ReplicaHealthCheckTimeout string
+	// ReplicaLatencyThreshold, when set, excludes a replica for the cooldown
+	// when its average fetch duration goes over it, eg "500ms"
+	ReplicaLatencyThreshold string
+
+	// fallback specific fields
+	// Fallback is the storages to try in order until one has the metatile,
+	// eg. a partial local mirror and then s3
+	Fallback []string
+}
+
+// ReplicaConfig references one of the equivalent storages of a replicated storage
+type ReplicaConfig struct {
+	// matches storage definition name
+	Storage string
+	// Weight is the relative share of requests for this replica, default 1
+	Weight *int
 }
 
 // storage configuration, specific to a pattern
-type storageConfig struct {
+type StorageConfig struct {
 	// matches storage definition name
 	Storage string
 
@@ -88,15 +279,95 @@ type storageConfig struct {
 	// TileSize indicates the size of tile for this pattern. The default is 1.
 	TileSize *int
 
+	// BuildMetadata is the name of an object under each build's prefix
+	// declaring its metatile size, tile size and max detail zoom. When set,
+	// those override the sizes above for builds which have the object.
+	BuildMetadata string
+
 	// DefaultPrefix is required to be set for s3 storage
 	DefaultPrefix *string
 	KeyPattern    *string
 	Layer         *string
+	// KeyVariables are extra fixed variables available to the s3 key pattern
+	KeyVariables map[string]string
 
 	BaseDir *string
 }
 
-type routeHandlerConfig struct {
-	storageConfig
+type RouteHandlerConfig struct {
+	StorageConfig
+	// Type is "metatile" (default), "tilejson" or "archive"
 	Type *string
+
+	// MaxZoom overrides the -max-zoom flag for this pattern
+	MaxZoom *int
+	// MaxZoomPolicy overrides the -max-zoom-policy flag for this pattern
+	MaxZoomPolicy *string
+	// TombstonePolicy overrides the -tombstone-policy flag for this pattern
+	TombstonePolicy *string
+	// ServeStale overrides the -serve-stale flag for this pattern
+	ServeStale *bool
+	// WrapX wraps X coordinates around the antimeridian instead of
+	// responding 400 to them
+	WrapX bool
+	// ValidateTiles overrides the -validate-tiles flag for this pattern
+	ValidateTiles *bool
+	// FormatFallbacks lists, by requested format, the formats whose
+	// metatile entries are served when there's none in the requested
+	// format, eg. "json": ["geojson", "mvt"].
+	FormatFallbacks map[string][]string
+	// Transcode converts fallback entries to the requested format where
+	// possible, eg. mvt to json, rather than skipping them.
+	Transcode bool
+	// ContentHashes adds the X-Tile-Hash header to tile responses, so that
+	// clients can request them from a pattern with a {hash} variable.
+	ContentHashes bool
+	// NotFoundLogSample is the fraction of 404 responses to log, from 0 to
+	// 1, default all of them. Metrics count every response.
+	NotFoundLogSample *float64
+
+	// KeyQueryVariables allows the named query parameters to be used as
+	// variables in the s3 key pattern. Values must match the given regexp.
+	KeyQueryVariables map[string]string
+	// KeyPathVariables allows the named variables of the request pattern,
+	// eg. {lang}, to be used as variables in the s3 key pattern.
+	KeyPathVariables []string
+	// KeyHeaderVariables allows the named variables of the s3 key pattern
+	// to be taken from request headers, eg. a build date sent by clients.
+	KeyHeaderVariables map[string]KeyHeaderVariableConfig
+
+	// StorageByFormat maps a tile format to the name of the storage
+	// definition to fetch it from. Formats not listed use Storage.
+	StorageByFormat map[string]string
+
+	// SelfTestTile is the "z/x/y.fmt" tile fetched for this pattern when
+	// running with -selftest, overriding the -selftest-tile default.
+	SelfTestTile *string
+
+	// ZoomPriorities weight queued requests by zoom when load shedding is
+	// enabled. Requests in bands with a higher weight are served first.
+	ZoomPriorities []ZoomBandConfig
+	// CacheTTLs set how long tiles are cached for by zoom, both by the tile
+	// cache and by clients through the Cache-Control header.
+	CacheTTLs []ZoomTTLConfig
+}
+
+// KeyHeaderVariableConfig is a request header usable as a key variable
+type KeyHeaderVariableConfig struct {
+	Header string
+	// Pattern is the regexp the whole value must match
+	Pattern string
+}
+
+type ZoomBandConfig struct {
+	MinZoom int
+	MaxZoom int
+	Weight  int
+}
+
+type ZoomTTLConfig struct {
+	MinZoom int
+	MaxZoom int
+	// TTL is a duration, eg "24h"
+	TTL string
 }
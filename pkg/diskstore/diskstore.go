@@ -0,0 +1,246 @@
+// Package diskstore keeps values in files on local disk, evicting the least
+// recently used to stay under a size, for the metatile caches on disk.
+package diskstore
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Suffix is the extension of the files written by a store, which are the
+// only files it removes from its directory.
+const Suffix = ".metatile"
+
+// Options are the settings of a Store.
+type Options struct {
+	// Dir is the directory to keep the files in, created if missing. Files
+	// left in it by a previous process are removed, as what they hold isn't
+	// known.
+	Dir string
+	// MaxBytes bounds the size of the values kept, evicting the least
+	// recently used ones to stay under it.
+	MaxBytes int64
+	// Mmap reads values by mapping their files into memory, where the
+	// platform supports it, rather than copying them into a buffer first.
+	Mmap bool
+}
+
+// Entry is a value kept on disk. Lookups return copies, which stay valid
+// after the value at the key is replaced.
+type Entry struct {
+	Key  string
+	Size int64
+	// Meta is what the user of the store keeps alongside the value, eg.
+	// when it expires.
+	Meta interface{}
+
+	path string
+	// gen tells apart the values written at the same key
+	gen uint64
+}
+
+// Store keeps values in files in a directory, each written to a file of its
+// own and renamed into place, so that readers never see a partial value and
+// a value being read isn't replaced from under its reader.
+type Store struct {
+	options Options
+
+	mu sync.Mutex
+	// lru holds the *Entry values, most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+	gen     uint64
+}
+
+// New clears the options' Dir of files left by a previous process, creating
+// it if needed.
+func New(options Options) (*Store, error) {
+	if options.Dir == "" {
+		return nil, fmt.Errorf("disk cache needs a directory")
+	}
+	if options.MaxBytes <= 0 {
+		return nil, fmt.Errorf("disk cache max bytes must be positive, but is %d", options.MaxBytes)
+	}
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating disk cache directory: %w", err)
+	}
+	leftover, err := filepath.Glob(filepath.Join(options.Dir, "*"+Suffix))
+	if err != nil {
+		return nil, fmt.Errorf("error listing disk cache directory: %w", err)
+	}
+	for _, path := range leftover {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("error clearing disk cache directory: %w", err)
+		}
+	}
+
+	return &Store{
+		options: options,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}, nil
+}
+
+// Size returns the bytes of the values kept.
+func (s *Store) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// path returns the file the value written at key with gen is kept in. The
+// keys are hashed as they contain slashes and key variables.
+func (s *Store) path(key string, gen uint64) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(s.options.Dir, hex.EncodeToString(sum[:])+"-"+strconv.FormatUint(gen, 36)+Suffix)
+}
+
+// Lookup returns a copy of the entry at key, moving it to the front of the
+// LRU, or false on a miss.
+func (s *Store) Lookup(key string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return Entry{}, false
+	}
+	s.lru.MoveToFront(elem)
+	return *elem.Value.(*Entry), true
+}
+
+// Read returns the value of the entry and a function to release it once
+// it's no longer used, or false if its file can't be read, eg. removed from
+// under the store, in which case the entry is removed.
+func (s *Store) Read(entry Entry) ([]byte, func(), bool) {
+	var data []byte
+	var release func()
+	var err error
+	if s.options.Mmap {
+		data, release, err = mmapFile(entry.path)
+	} else {
+		data, err = ioutil.ReadFile(entry.path)
+		release = func() {}
+	}
+	if err != nil {
+		s.Remove(entry)
+		return nil, nil, false
+	}
+	if int64(len(data)) != entry.Size {
+		release()
+		s.Remove(entry)
+		return nil, nil, false
+	}
+	return data, release, true
+}
+
+// SetMeta replaces the Meta of the entry, unless the value at its key has
+// since been replaced or removed.
+func (s *Store) SetMeta(entry Entry, meta interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[entry.Key]; ok && elem.Value.(*Entry).gen == entry.gen {
+		elem.Value.(*Entry).Meta = meta
+	}
+}
+
+// Write keeps the value at key with its meta, evicting the least recently
+// used values to make room for it. Values larger than MaxBytes aren't kept,
+// and remove the value they replace.
+func (s *Store) Write(key string, data []byte, meta interface{}) error {
+	size := int64(len(data))
+	if size > s.options.MaxBytes {
+		s.Drop(key)
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(s.options.Dir, "tmp-")
+	if err != nil {
+		return fmt.Errorf("error creating disk cache file: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing disk cache file: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		s.removeLocked(elem)
+	}
+	for s.size+size > s.options.MaxBytes && s.lru.Len() > 0 {
+		s.removeLocked(s.lru.Back())
+	}
+
+	s.gen++
+	path := s.path(key, s.gen)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing disk cache file: %w", err)
+	}
+	entry := &Entry{Key: key, Size: size, Meta: meta, path: path, gen: s.gen}
+	s.entries[key] = s.lru.PushFront(entry)
+	s.size += size
+	return nil
+}
+
+// Remove removes the entry, unless the value at its key has since been
+// replaced, so that a reader of an old value doesn't remove the new one.
+func (s *Store) Remove(entry Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[entry.Key]; ok && elem.Value.(*Entry).gen == entry.gen {
+		s.removeLocked(elem)
+	}
+}
+
+// Drop removes the value at key, if any.
+func (s *Store) Drop(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		s.removeLocked(elem)
+	}
+}
+
+// DropPrefix removes the values at keys with the prefix, returning how many
+// were removed.
+func (s *Store) DropPrefix(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dropped := 0
+	for key, elem := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			s.removeLocked(elem)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// removeLocked removes the entry and its file. The caller holds mu.
+func (s *Store) removeLocked(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*Entry)
+	delete(s.entries, entry.Key)
+	s.size -= entry.Size
+	// an error leaves the file to be cleared on restart
+	_ = os.Remove(entry.path)
+}
@@ -0,0 +1,54 @@
+package diskstore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestStoreReplacedWhileRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(Options{Dir: dir, MaxBytes: 100})
+	if err != nil {
+		t.Fatalf("Unable to create store: %s", err.Error())
+	}
+	if err := s.Write("key", []byte("old"), 1); err != nil {
+		t.Fatalf("Unable to write: %s", err.Error())
+	}
+	old, ok := s.Lookup("key")
+	if !ok {
+		t.Fatalf("Expected the old value to be kept")
+	}
+
+	// a write replaces the value, and its file, while the old one is read
+	if err := s.Write("key", []byte("newer"), 2); err != nil {
+		t.Fatalf("Unable to write: %s", err.Error())
+	}
+	if _, _, ok := s.Read(old); ok {
+		t.Fatalf("Expected the replaced value's file to be gone")
+	}
+
+	entry, ok := s.Lookup("key")
+	if !ok || entry.Meta != 2 {
+		t.Fatalf("Expected failing to read the old value to leave the new one, got %#v", entry)
+	}
+	data, release, ok := s.Read(entry)
+	if !ok || string(data) != "newer" {
+		t.Fatalf("Expected the new value, got %#v", string(data))
+	}
+	release()
+
+	// nor do updates to the old value's meta apply to the new one
+	s.SetMeta(old, 3)
+	if entry, _ := s.Lookup("key"); entry.Meta != 2 {
+		t.Fatalf("Expected the meta of the old value not to replace the new one's, got %#v", entry.Meta)
+	}
+	if s.Size() != 5 {
+		t.Fatalf("Expected only the new value to be counted, got %d bytes", s.Size())
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package diskstore
+
+import "io/ioutil"
+
+// mmapFile reads the file at path into a buffer, on platforms without mmap.
+func mmapFile(path string) ([]byte, func(), error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() {}, nil
+}
@@ -0,0 +1,285 @@
+package golden
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// ErrExists is returned when creating a recording with the name of one which
+// already exists, as recordings are never overwritten.
+var ErrExists = errors.New("recording already exists")
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// IsValidName returns true when name can be used for a recording.
+func IsValidName(name string) bool {
+	return validName.MatchString(name) && name != "." && name != ".."
+}
+
+// Record summarises the response for one golden tile.
+type Record struct {
+	Path     string `json:"path"`
+	Status   int    `json:"status"`
+	Size     int    `json:"size"`
+	Checksum string `json:"checksum"`
+	// Layers are the layer names of mvt and json tiles, sorted.
+	Layers []string `json:"layers,omitempty"`
+}
+
+// Recording holds the records of all the golden tiles, made at one time.
+type Recording struct {
+	Name    string    `json:"name"`
+	BuildID string    `json:"build_id,omitempty"`
+	Created time.Time `json:"created"`
+	Records []*Record `json:"records"`
+}
+
+// TileDiff lists how the response for a golden tile differs from the
+// recorded one.
+type TileDiff struct {
+	Path     string   `json:"path"`
+	Changes  []string `json:"changes"`
+	Recorded *Record  `json:"recorded,omitempty"`
+	Current  *Record  `json:"current,omitempty"`
+}
+
+// Report is the result of comparing the current responses for the golden
+// tiles with a recording.
+type Report struct {
+	Name    string      `json:"name"`
+	BuildID string      `json:"build_id,omitempty"`
+	Total   int         `json:"total"`
+	Changed int         `json:"changed"`
+	Tiles   []*TileDiff `json:"tiles"`
+}
+
+// Store keeps recordings by name.
+type Store interface {
+	// Read returns the recording's data, or nil if there's no such recording.
+	Read(name string) ([]byte, error)
+	// Create stores the recording's data, returning ErrExists rather than
+	// replacing an existing recording.
+	Create(name string, data []byte) error
+}
+
+// Recorder requests the golden tiles through the server's own handlers, to
+// record their responses or compare them with a recording.
+type Recorder struct {
+	Handler http.Handler
+	Paths   []string
+	Store   Store
+}
+
+// Record requests the golden tiles from the build, the default build if
+// buildID is empty, and stores their records under the name.
+func (r *Recorder) Record(name, buildID string) (*Recording, error) {
+	if !IsValidName(name) {
+		return nil, fmt.Errorf("invalid recording name %#v", name)
+	}
+	recording := &Recording{
+		Name:    name,
+		BuildID: buildID,
+		Created: time.Now().UTC(),
+		Records: r.records(buildID),
+	}
+	data, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Store.Create(name, data); err != nil {
+		return nil, err
+	}
+	return recording, nil
+}
+
+// Compare requests the golden tiles from the build and reports those which
+// differ from the named recording. It returns nil if there's no such
+// recording.
+func (r *Recorder) Compare(name, buildID string) (*Report, error) {
+	if !IsValidName(name) {
+		return nil, fmt.Errorf("invalid recording name %#v", name)
+	}
+	data, err := r.Store.Read(name)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	recording := &Recording{}
+	if err := json.Unmarshal(data, recording); err != nil {
+		return nil, fmt.Errorf("invalid recording %s: %s", name, err.Error())
+	}
+
+	recorded := make(map[string]*Record, len(recording.Records))
+	for _, record := range recording.Records {
+		recorded[record.Path] = record
+	}
+
+	report := &Report{Name: name, BuildID: buildID, Tiles: []*TileDiff{}}
+	for _, current := range r.records(buildID) {
+		report.Total++
+		previous, ok := recorded[current.Path]
+		if !ok {
+			report.Changed++
+			report.Tiles = append(report.Tiles, &TileDiff{Path: current.Path, Changes: []string{"not recorded"}, Current: current})
+			continue
+		}
+		if changes := diff(previous, current); len(changes) > 0 {
+			report.Changed++
+			report.Tiles = append(report.Tiles, &TileDiff{Path: current.Path, Changes: changes, Recorded: previous, Current: current})
+		}
+	}
+	return report, nil
+}
+
+// records requests each golden tile from the build.
+func (r *Recorder) records(buildID string) []*Record {
+	records := make([]*Record, 0, len(r.Paths))
+	for _, path := range r.Paths {
+		records = append(records, r.record(path, buildID))
+	}
+	return records
+}
+
+func (r *Recorder) record(path, buildID string) *Record {
+	record := &Record{Path: path}
+
+	u, err := url.Parse(path)
+	if err != nil {
+		record.Status = http.StatusBadRequest
+		return record
+	}
+	if buildID != "" {
+		q := u.Query()
+		q.Set("buildid", buildID)
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		record.Status = http.StatusBadRequest
+		return record
+	}
+
+	rw := &responseRecorder{header: make(http.Header)}
+	r.Handler.ServeHTTP(rw, req)
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	body := rw.body.Bytes()
+	sum := sha256.Sum256(body)
+	record.Status = rw.status
+	record.Size = len(body)
+	record.Checksum = hex.EncodeToString(sum[:])
+	if rw.status == http.StatusOK {
+		record.Layers = layerNames(rw.header.Get("Content-Type"), body)
+	}
+	return record
+}
+
+// layerNames returns the sorted layer names of an mvt, geojson or topojson
+// tile, or nil for other formats and tiles which can't be read.
+func layerNames(contentType string, body []byte) []string {
+	var names []string
+	if strings.Contains(contentType, "protobuf") {
+		names, _ = tile.MvtLayerNames(body)
+	} else if strings.Contains(contentType, "json") {
+		var layers map[string]json.RawMessage
+		if json.Unmarshal(body, &layers) != nil {
+			return nil
+		}
+		// topojson keeps its layers as objects of the topology
+		if objects, ok := layers["objects"]; ok && string(layers["type"]) == `"Topology"` {
+			layers = nil
+			if json.Unmarshal(objects, &layers) != nil {
+				return nil
+			}
+		}
+		for name := range layers {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// diff describes the differences between a recorded and a current record.
+func diff(recorded, current *Record) []string {
+	var changes []string
+	if recorded.Status != current.Status {
+		changes = append(changes, fmt.Sprintf("status %d -> %d", recorded.Status, current.Status))
+	}
+	if recorded.Size != current.Size {
+		change := fmt.Sprintf("size %d -> %d", recorded.Size, current.Size)
+		if recorded.Size > 0 {
+			change += fmt.Sprintf(" (%+.1f%%)", 100*float64(current.Size-recorded.Size)/float64(recorded.Size))
+		}
+		changes = append(changes, change)
+	}
+	if recorded.Checksum != current.Checksum {
+		changes = append(changes, "checksum")
+	}
+
+	added, removed := compareLayers(recorded.Layers, current.Layers)
+	if len(added) > 0 {
+		changes = append(changes, "layers added: "+strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		changes = append(changes, "layers removed: "+strings.Join(removed, ", "))
+	}
+	return changes
+}
+
+func compareLayers(recorded, current []string) (added, removed []string) {
+	had := make(map[string]bool, len(recorded))
+	for _, name := range recorded {
+		had[name] = true
+	}
+	has := make(map[string]bool, len(current))
+	for _, name := range current {
+		has[name] = true
+		if !had[name] {
+			added = append(added, name)
+		}
+	}
+	for _, name := range recorded {
+		if !has[name] {
+			removed = append(removed, name)
+		}
+	}
+	return added, removed
+}
+
+// responseRecorder keeps the response to a golden tile request.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(p)
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
@@ -0,0 +1,84 @@
+package golden
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	tiles := map[string]string{
+		"20230801": `{"water": {}, "roads": {}}`,
+		"20230901": `{"water": {}, "buildings": {}}`,
+	}
+	h := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, ok := tiles[req.URL.Query().Get("buildid")]
+		if !ok || req.URL.Path != "/osm/0/0/0.json" {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(body))
+	})
+	recorder := &Recorder{Handler: h, Paths: []string{"/osm/0/0/0.json"}, Store: NewFileStore(dir)}
+
+	recording, err := recorder.Record("baseline", "20230801")
+	if err != nil {
+		t.Fatalf("Unable to record: %s", err.Error())
+	}
+	record := recording.Records[0]
+	if record.Status != http.StatusOK || record.Size != len(tiles["20230801"]) || len(record.Layers) != 2 || record.Layers[0] != "roads" {
+		t.Fatalf("Unexpected record %#v", record)
+	}
+	if _, err := recorder.Record("baseline", "20230901"); err != ErrExists {
+		t.Fatalf("Expected recording to be write-once, got %v", err)
+	}
+
+	report, err := recorder.Compare("baseline", "20230801")
+	if err != nil {
+		t.Fatalf("Unable to compare: %s", err.Error())
+	}
+	if report.Total != 1 || report.Changed != 0 {
+		t.Fatalf("Expected no changes against the same build, got %#v", report)
+	}
+
+	report, err = recorder.Compare("baseline", "20230901")
+	if err != nil {
+		t.Fatalf("Unable to compare: %s", err.Error())
+	}
+	if report.Changed != 1 {
+		t.Fatalf("Expected the tile to have changed, got %#v", report)
+	}
+	expected := []string{"size 26 -> 30 (+15.4%)", "checksum", "layers added: buildings", "layers removed: roads"}
+	changes := report.Tiles[0].Changes
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected changes %#v, got %#v", expected, changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Fatalf("Expected changes %#v, got %#v", expected, changes)
+		}
+	}
+
+	if report, err := recorder.Compare("missing", ""); report != nil || err != nil {
+		t.Fatalf("Expected no report for a missing recording, got %#v %v", report, err)
+	}
+	if _, err := recorder.Record("../escape", ""); err == nil {
+		t.Fatalf("Expected invalid recording name to be rejected")
+	}
+}
+
+func TestLayerNamesTopojson(t *testing.T) {
+	body := []byte(`{"type": "Topology", "objects": {"water": {}, "earth": {}}, "arcs": []}`)
+	names := layerNames("application/json", body)
+	if len(names) != 2 || names[0] != "earth" || names[1] != "water" {
+		t.Fatalf("Expected topojson objects as layers, got %#v", names)
+	}
+}
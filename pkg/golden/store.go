@@ -0,0 +1,109 @@
+package golden
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// FileStore keeps recordings as JSON files in a directory.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+func (s *FileStore) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+func (s *FileStore) Read(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Create creates the file exclusively, so that concurrent recordings with
+// the same name can't replace each other.
+func (s *FileStore) Create(name string, data []byte) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return ErrExists
+		}
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// S3Store keeps recordings as JSON objects under a prefix of a bucket.
+type S3Store struct {
+	client s3iface.S3API
+	bucket string
+	prefix string
+}
+
+func NewS3Store(client s3iface.S3API, bucket, prefix string) *S3Store {
+	return &S3Store{client: client, bucket: bucket, prefix: strings.Trim(prefix, "/")}
+}
+
+func (s *S3Store) key(name string) string {
+	if s.prefix == "" {
+		return name + ".json"
+	}
+	return s.prefix + "/" + name + ".json"
+}
+
+func (s *S3Store) Read(name string) ([]byte, error) {
+	key := s.key(name)
+	output, err := s.client.GetObject(&s3.GetObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer output.Body.Close()
+	return ioutil.ReadAll(output.Body)
+}
+
+// Create checks the object doesn't exist before putting it. S3 can't put
+// objects exclusively, so two recordings with the same name made at the
+// same time could still replace each other.
+func (s *S3Store) Create(name string, data []byte) error {
+	key := s.key(name)
+	_, err := s.client.HeadObject(&s3.HeadObjectInput{Bucket: &s.bucket, Key: &key})
+	if err == nil {
+		return ErrExists
+	}
+	if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "NotFound" {
+		return fmt.Errorf("checking for existing recording: %w", err)
+	}
+
+	contentType := "application/json"
+	_, err = s.client.PutObject(&s3.PutObjectInput{
+		Bucket:      &s.bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(data),
+		ContentType: &contentType,
+	})
+	return err
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/tilezen/tapalcatl/pkg/log"
+)
+
+// writeJson serializes the value as JSON and writes it to the response with a 200 status.
+func writeJson(rw http.ResponseWriter, logger log.JsonLogger, value interface{}) {
+	writeJsonStatus(rw, logger, http.StatusOK, value)
+}
+
+// writeJsonStatus serializes the value as JSON and writes it to the response with the given status.
+func writeJsonStatus(rw http.ResponseWriter, logger log.JsonLogger, status int, value interface{}) {
+	body, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		logger.Error(log.LogCategory_ResponseError, "Failed to marshal JSON response: %s", err.Error())
+		http.Error(rw, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_, err = rw.Write(body)
+	if err != nil {
+		logger.Error(log.LogCategory_ResponseError, "Failed to write JSON response body: %s", err.Error())
+	}
+}
+
+// ConfigHandler serves the effective configuration of the running instance.
+// The dump is expected to have been redacted already, see config.Dump.
+func ConfigHandler(dump map[string]interface{}, logger log.JsonLogger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		writeJson(rw, logger, dump)
+	})
+}
@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/cache"
+	"github.com/tilezen/tapalcatl/pkg/log"
+	"github.com/tilezen/tapalcatl/pkg/metrics"
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/storage"
+)
+
+// ArchiveOptions holds the optional settings of an ArchiveHandler. The zero
+// value gives the default behaviour.
+type ArchiveOptions struct {
+	// BuildManifest, if set, selects builds for requests made with asof.
+	BuildManifest *storage.BuildManifestSource
+	// BanList, if set, counts malformed requests towards banning clients.
+	BanList *BanList
+	// TTLJitter shortens the metatile cache TTL by a random fraction of it,
+	// up to this fraction from 0 to 1.
+	TTLJitter float64
+	// TimingUnit is one of the state.TimingUnit_ constants, the unit of the
+	// logged timings, default milliseconds.
+	TimingUnit string
+	// ArchivedPolicy and ArchivedRetryAfter respond to metatiles archived
+	// in storage, as for a MetatileHandler.
+	ArchivedPolicy     string
+	ArchivedRetryAfter time.Duration
+	// StorageNamespace names the storage in the keys of cached metatiles,
+	// as for a MetatileHandler, so that they're shared with its handlers.
+	StorageNamespace string
+}
+
+// ArchiveHandler serves whole metatiles, for offline clients and downstream
+// processors to download in bulk. The parser's coordinate is that of the
+// metatile rather than a tile within it, eg. /meta/{z}/{x}/{y}.{fmt} with
+// zip as the only format. Metatiles are cached with those fetched for tile
+// requests, and the requests are logged and counted like tile requests.
+func ArchiveHandler(
+	p state.Parser,
+	stg storage.Storage,
+	mw metrics.MetricsWriter,
+	logger log.JsonLogger,
+	tileCache cache.Cache,
+	options ArchiveOptions) http.Handler {
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		logger := log.ForRequest(req.Context(), logger)
+		reqState := &state.RequestState{TimingUnit: options.TimingUnit}
+		reqState.Duration.Queue = queueWait(req.Context())
+
+		startTime := time.Now()
+
+		defer func() {
+			reqState.Duration.Total = time.Since(startTime)
+
+			if reqState.ResponseState == state.ResponseState_Nil {
+				logger.Error(log.LogCategory_InvalidCodeState, "handler did not set response state for metatile %+v", reqState.Coord)
+			}
+
+			log.Metrics(logger, reqState)
+			mw.WriteMetatileState(reqState)
+		}()
+
+		parseStart := time.Now()
+		parseResult, err := p.Parse(req)
+		reqState.Duration.Parse = time.Since(parseStart)
+		if err != nil && respondParseError(rw, req, reqState, err, options.BanList, logger) {
+			return
+		}
+
+		parseResult.StorageNamespace = options.StorageNamespace
+		metaCoord := parseResult.AdditionalData.(*state.MetatileParseData).Coord
+		reqState.Coord = &metaCoord
+		reqState.Format = metaCoord.Format
+		reqState.HttpData = parseResult.HttpData
+		reqState.Build = parseResult.BuildID
+		if parseResult.CacheKeyParams != nil {
+			rw.Header().Set(cacheKeyParamsHeader, *parseResult.CacheKeyParams)
+		}
+
+		if options.BuildManifest != nil {
+			rw.Header().Add("Vary", asOfHeader)
+		}
+		for _, header := range parseResult.KeyHeaders {
+			rw.Header().Add("Vary", header)
+		}
+		if !resolveAsOf(rw, reqState, parseResult, options.BuildManifest, logger) {
+			return
+		}
+		applyTenant(req, parseResult)
+
+		metaCacheLookupStart := time.Now()
+		timeoutCtx, cancel := context.WithTimeout(req.Context(), cacheTimeout)
+		metatileResponseData, err := tileCache.GetMetatile(timeoutCtx, parseResult, metaCoord)
+		cancel()
+		reqState.Duration.MetatileCacheLookup = time.Since(metaCacheLookupStart)
+		if err != nil {
+			reqState.IsCacheLookupError = true
+			logger.Warning(log.LogCategory_ResponseError, "Error checking metatile cache: %+v", err)
+		}
+
+		if metatileResponseData == nil {
+			metatileResponseData, err = fetchMetatile(req.Context(), reqState, stg, parseResult, metaCoord, false)
+			if err != nil && req.Context().Err() != nil {
+				http.Error(rw, "Request deadline exceeded", http.StatusGatewayTimeout)
+				reqState.IsDeadlineExceeded = true
+				return
+			}
+			if err != nil {
+				if respondArchived(rw, req, reqState, err, options.ArchivedPolicy, options.ArchivedRetryAfter) {
+					return
+				}
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				reqState.ResponseState = state.ResponseState_Error
+				return
+			}
+
+			// a not modified response has no metatile to cache
+			if metatileResponseData.ResponseState != state.ResponseState_NotModified {
+				metatileTTL := jitterTTL(cacheMetatileTTL, options.TTLJitter)
+				goCacheSet(func() {
+					timeoutCtx, cancel := context.WithTimeout(context.Background(), cacheSetTimeout)
+					err := tileCache.SetMetatile(timeoutCtx, parseResult, metaCoord, metatileResponseData, metatileTTL)
+					cancel()
+					if err != nil {
+						logger.Warning(log.LogCategory_ResponseError, "Failed to set metatile cache: %+v", err)
+					}
+				})
+			}
+		} else {
+			reqState.Cache.MetatileCacheHit = true
+		}
+
+		switch metatileResponseData.ResponseState {
+		case state.ResponseState_NotFound:
+			http.NotFound(rw, req)
+			reqState.ResponseState = state.ResponseState_NotFound
+			return
+		case state.ResponseState_NotModified:
+			rw.WriteHeader(http.StatusNotModified)
+			reqState.ResponseState = state.ResponseState_NotModified
+			return
+		}
+
+		err = writeVectorTileResponse(reqState, rw, &state.VectorTileResponseData{
+			ContentType:  parseResult.ContentType,
+			Data:         metatileResponseData.Data,
+			ETag:         metatileResponseData.ETag,
+			LastModified: metatileResponseData.LastModified,
+		})
+		if err != nil {
+			logger.Error(log.LogCategory_ResponseError, "Failed to write response body: %#v", err)
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BanList temporarily bans clients which make too many malformed requests,
+// such as bots scanning for vulnerable paths. Clients are told apart by
+// their remote address, so it's only useful when clients connect directly
+// rather than through a proxy.
+type BanList struct {
+	strikes  int
+	window   time.Duration
+	duration time.Duration
+
+	mu        sync.Mutex
+	clients   map[string]*banClient
+	lastPrune time.Time
+}
+
+type banClient struct {
+	strikes     int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+// NewBanList bans a client for duration once it has made strikes malformed
+// requests within window.
+func NewBanList(strikes int, window, duration time.Duration) *BanList {
+	if strikes < 1 {
+		strikes = 1
+	}
+	return &BanList{
+		strikes:   strikes,
+		window:    window,
+		duration:  duration,
+		clients:   make(map[string]*banClient),
+		lastPrune: time.Now(),
+	}
+}
+
+func clientAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// Strike records a malformed request from the request's client, returning
+// true if the client is now banned.
+func (b *BanList) Strike(req *http.Request) bool {
+	addr := clientAddr(req)
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pruneLocked(now)
+
+	client, ok := b.clients[addr]
+	if !ok || now.Sub(client.windowStart) > b.window {
+		client = &banClient{windowStart: now}
+		b.clients[addr] = client
+	}
+	client.strikes++
+	if client.strikes >= b.strikes {
+		client.bannedUntil = now.Add(b.duration)
+		client.strikes = 0
+		client.windowStart = now
+		return true
+	}
+	return false
+}
+
+// pruneLocked forgets clients which are neither banned nor within their
+// strike window, at most once per window so that the cost is spread out.
+func (b *BanList) pruneLocked(now time.Time) {
+	if now.Sub(b.lastPrune) < b.window {
+		return
+	}
+	b.lastPrune = now
+	for addr, client := range b.clients {
+		if now.After(client.bannedUntil) && now.Sub(client.windowStart) > b.window {
+			delete(b.clients, addr)
+		}
+	}
+}
+
+// Banned returns true if the request's client is currently banned.
+func (b *BanList) Banned(req *http.Request) bool {
+	addr := clientAddr(req)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	client, ok := b.clients[addr]
+	return ok && time.Now().Before(client.bannedUntil)
+}
+
+// Len returns the number of clients currently banned.
+func (b *BanList) Len() int {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	banned := 0
+	for _, client := range b.clients {
+		if now.Before(client.bannedUntil) {
+			banned++
+		}
+	}
+	return banned
+}
+
+// Handler responds 403 to requests from banned clients.
+func (b *BanList) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if b.Banned(req) {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
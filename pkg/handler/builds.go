@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/tilezen/tapalcatl/pkg/cache"
+	"github.com/tilezen/tapalcatl/pkg/log"
+	"github.com/tilezen/tapalcatl/pkg/storage"
+)
+
+// BuildWebhookOptions holds what the build webhook acts on when told a new
+// build has landed.
+type BuildWebhookOptions struct {
+	// Token is the bearer token callers must present.
+	Token string
+	// Manifests are refreshed so that the new build can be selected at once.
+	Manifests []*storage.BuildManifestSource
+	// Cache is purged of the default build's entries, and the new build's,
+	// if it can be purged.
+	Cache cache.Cache
+	// WarmPaths are requested from Warmer once the cache has been purged,
+	// eg. /osm/0/0/0.mvt, to fill the cache before clients ask for them.
+	WarmPaths []string
+	Warmer    http.Handler
+}
+
+// buildWebhookRequest is the optional JSON body of a webhook call.
+type buildWebhookRequest struct {
+	BuildID string `json:"build_id"`
+}
+
+// BuildWebhookHandler is called by the tile build pipeline when a new build
+// lands. It refreshes the build manifests and purges the cached tiles of the
+// default build, which the new build may have replaced, and of the new build
+// itself, in case it reused an id. Warming the cache continues in the
+// background after responding.
+func BuildWebhookHandler(options BuildWebhookOptions, logger log.JsonLogger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(options.Token)) != 1 {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var body buildWebhookRequest
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				http.Error(rw, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if !validBuildID.MatchString(body.BuildID) {
+			http.Error(rw, "Invalid build_id", http.StatusBadRequest)
+			return
+		}
+
+		var errs []string
+		for _, manifest := range options.Manifests {
+			if _, err := manifest.Refresh(); err != nil {
+				errs = append(errs, "refreshing build manifest: "+err.Error())
+			}
+		}
+
+		purged := 0
+		if purger, ok := options.Cache.(cache.Purger); ok {
+			builds := []string{""}
+			if body.BuildID != "" {
+				builds = append(builds, body.BuildID)
+			}
+			for _, buildID := range builds {
+				n, err := purger.Purge(req.Context(), buildID)
+				purged += n
+				if err != nil {
+					errs = append(errs, "purging cache: "+err.Error())
+				}
+			}
+		}
+
+		result := map[string]interface{}{
+			"build_id":            body.BuildID,
+			"manifests_refreshed": len(options.Manifests),
+			"purged":              purged,
+			"warming":             len(options.WarmPaths),
+		}
+		if len(errs) > 0 {
+			for _, err := range errs {
+				logger.Error(log.LogCategory_StorageError, "Build webhook failed %s", err)
+			}
+			result["errors"] = errs
+			writeJsonStatus(rw, logger, http.StatusInternalServerError, result)
+			return
+		}
+
+		logger.Info("Build webhook for build %#v refreshed %d manifests and purged %d cache entries", body.BuildID, len(options.Manifests), purged)
+		if len(options.WarmPaths) > 0 {
+			go warmPaths(options.Warmer, options.WarmPaths, logger)
+		}
+		writeJson(rw, logger, result)
+	})
+}
+
+// warmResponseWriter discards the response to a warming request, keeping
+// only its status.
+type warmResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *warmResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *warmResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (w *warmResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// warmPaths requests each path from h in turn, so that the tiles are cached
+// by the time clients request them.
+func warmPaths(h http.Handler, paths []string, logger log.JsonLogger) {
+	failed := 0
+	for _, path := range paths {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			logger.Warning(log.LogCategory_ConfigError, "Invalid warm path %s: %s", path, err.Error())
+			failed++
+			continue
+		}
+		rw := &warmResponseWriter{header: make(http.Header)}
+		h.ServeHTTP(rw, req)
+		if rw.status >= http.StatusBadRequest {
+			logger.Warning(log.LogCategory_ResponseError, "Warming %s failed with status %d", path, rw.status)
+			failed++
+		}
+	}
+	logger.Info("Warmed %d of %d paths", len(paths)-failed, len(paths))
+}
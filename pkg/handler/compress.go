@@ -0,0 +1,304 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NYTimes/gziphandler"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+)
+
+const encodingGzip = "gzip"
+
+// acceptsEncoding reports whether the request's Accept-Encoding header allows
+// the given content encoding, ie. lists it or "*" without a zero q value.
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	for _, header := range req.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			params := strings.Split(part, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name != encoding && name != "*" {
+				continue
+			}
+
+			accepted := true
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(param[2:], 64)
+					accepted = err == nil && q > 0
+				}
+			}
+			return accepted
+		}
+	}
+	return false
+}
+
+// gzipVariant returns the vector tile to serve to clients accepting gzip.
+// Tiles too small to be worth compressing, by the same threshold as the
+// gziphandler which compresses other responses, are returned unchanged.
+func gzipVariant(vectorData *state.VectorTileResponseData) (*state.VectorTileResponseData, error) {
+	if len(vectorData.Data) < gziphandler.DefaultMinSize {
+		return vectorData, nil
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(vectorData.Data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	variant := *vectorData
+	variant.ContentEncoding = encodingGzip
+	variant.Data = buf.Bytes()
+	return &variant, nil
+}
+
+// gunzipVariant returns the uncompressed tile for a gzipped variant, for
+// clients which don't accept gzip.
+func gunzipVariant(variant *state.VectorTileResponseData) (*state.VectorTileResponseData, error) {
+	r, err := gzip.NewReader(bytes.NewReader(variant.Data))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	vectorData := *variant
+	vectorData.ContentEncoding = ""
+	vectorData.Data = data
+	return &vectorData, nil
+}
+
+// bufferedGzipWriter holds back the response until it is complete, so that
+// it can be compressed with a known Content-Length. Once more than maxBuffer
+// bytes have been written, it falls back to streaming the compressed body.
+type bufferedGzipWriter struct {
+	http.ResponseWriter
+	maxBuffer int
+
+	status int
+	buf    bytes.Buffer
+	// set once the response has been sent on, compressed or not
+	gw          *gzip.Writer
+	passthrough bool
+}
+
+func (w *bufferedGzipWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedGzipWriter) sendHeader() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *bufferedGzipWriter) Write(b []byte) (int, error) {
+	if w.passthrough {
+		return w.ResponseWriter.Write(b)
+	}
+	if w.gw != nil {
+		return w.gw.Write(b)
+	}
+
+	// already encoded, eg. a cached compressed tile
+	if w.Header().Get("Content-Encoding") != "" {
+		w.passthrough = true
+		w.sendHeader()
+		return w.ResponseWriter.Write(b)
+	}
+
+	if w.buf.Len()+len(b) <= w.maxBuffer {
+		return w.buf.Write(b)
+	}
+
+	// too big to buffer, so stream it without a Content-Length
+	headers := w.Header()
+	headers.Set("Content-Encoding", encodingGzip)
+	headers.Del("Content-Length")
+	w.sendHeader()
+	w.gw = gzip.NewWriter(w.ResponseWriter)
+	if _, err := w.gw.Write(w.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	w.buf.Reset()
+	return w.gw.Write(b)
+}
+
+// finish sends the buffered response, if it hasn't been sent already.
+func (w *bufferedGzipWriter) finish() error {
+	if w.passthrough {
+		return nil
+	}
+	if w.gw != nil {
+		return w.gw.Close()
+	}
+
+	headers := w.Header()
+	body := w.buf.Bytes()
+	if len(body) >= gziphandler.DefaultMinSize && headers.Get("Content-Encoding") == "" {
+		var compressed bytes.Buffer
+		gw := gzip.NewWriter(&compressed)
+		if _, err := gw.Write(body); err != nil {
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			return err
+		}
+		headers.Set("Content-Encoding", encodingGzip)
+		body = compressed.Bytes()
+	}
+
+	if w.status != http.StatusNotModified && w.status != http.StatusNoContent {
+		headers.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.sendHeader()
+	_, err := w.ResponseWriter.Write(body)
+	return err
+}
+
+// BufferedGzipHandler compresses responses with gzip like the gziphandler,
+// but buffers responses up to maxBuffer bytes so that they can be sent with a
+// Content-Length rather than chunked, which some clients and CDNs handle
+// poorly. Larger responses are streamed.
+func BufferedGzipHandler(h http.Handler, maxBuffer int) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsEncoding(req, encodingGzip) {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		w := &bufferedGzipWriter{ResponseWriter: rw, maxBuffer: maxBuffer}
+		h.ServeHTTP(w, req)
+		// the handler has already finished, so there's nowhere to report a
+		// failure to write the response
+		_ = w.finish()
+	})
+}
+
+type compressionContextKey struct{}
+
+// compressionTiming measures a response passing through a compressing
+// handler. Writing to the client happens within the compressing handler's
+// writes, so its time is taken off to leave the time spent compressing.
+type compressionTiming struct {
+	// time spent in the handler's writes, and in the compressing handler
+	// after the handler returned
+	total time.Duration
+	// time spent writing to the client
+	writing time.Duration
+	size    int
+	// set when the handler wrote a response which was already encoded
+	preEncoded bool
+	// set by the handler to report its metrics once compression is done
+	report func(*state.ReqCompression)
+}
+
+// result returns the compression of the response, or nil if it wasn't
+// compressed by the compressing handler.
+func (ct *compressionTiming) result(header http.Header) *state.ReqCompression {
+	if ct.preEncoded || header.Get("Content-Encoding") != encodingGzip {
+		return nil
+	}
+	return &state.ReqCompression{
+		Duration: ct.total - ct.writing,
+		Size:     ct.size,
+	}
+}
+
+// compressedWriter counts the time and bytes written to the client by the
+// compressing handler.
+type compressedWriter struct {
+	http.ResponseWriter
+	timing *compressionTiming
+}
+
+func (w *compressedWriter) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := w.ResponseWriter.Write(b)
+	w.timing.writing += time.Since(start)
+	w.timing.size += n
+	return n, err
+}
+
+// uncompressedWriter counts the time the handler spends writing to the
+// compressing handler.
+type uncompressedWriter struct {
+	http.ResponseWriter
+	timing *compressionTiming
+	wrote  bool
+}
+
+func (w *uncompressedWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.wrote = true
+		w.timing.preEncoded = w.Header().Get("Content-Encoding") != ""
+	}
+	start := time.Now()
+	n, err := w.ResponseWriter.Write(b)
+	w.timing.total += time.Since(start)
+	return n, err
+}
+
+// InstrumentCompression serves h through the compressing handler returned by
+// compress, measuring the time spent compressing its response and the size
+// of the compressed body. Handlers which record their metrics with
+// reportAfterCompression then have them reported once the response has been
+// compressed, rather than when they return.
+func InstrumentCompression(h http.Handler, compress func(http.Handler) http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ct := &compressionTiming{}
+		var handlerDone time.Time
+		inner := compress(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			h.ServeHTTP(&uncompressedWriter{ResponseWriter: rw, timing: ct}, req)
+			handlerDone = time.Now()
+		}))
+
+		// report even if the handler panics, as it would have without
+		// instrumentation
+		defer func() {
+			if ct.report != nil {
+				ct.report(ct.result(rw.Header()))
+			}
+		}()
+
+		req = req.WithContext(context.WithValue(req.Context(), compressionContextKey{}, ct))
+		inner.ServeHTTP(&compressedWriter{ResponseWriter: rw, timing: ct}, req)
+		if !handlerDone.IsZero() {
+			ct.total += time.Since(handlerDone)
+		}
+	})
+}
+
+// reportAfterCompression has report called with the request's compression
+// set in reqState once its response has been compressed, returning false when
+// the response isn't being instrumented and report should be called now.
+func reportAfterCompression(ctx context.Context, reqState *state.RequestState, report func()) bool {
+	ct, ok := ctx.Value(compressionContextKey{}).(*compressionTiming)
+	if !ok {
+		return false
+	}
+	ct.report = func(compression *state.ReqCompression) {
+		reqState.Compression = compression
+		report()
+	}
+	return true
+}
@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/log"
+)
+
+const (
+	// DegradationMode_Auto enters degraded mode while the storage error rate
+	// is over the threshold.
+	DegradationMode_Auto = "auto"
+	// DegradationMode_On forces degraded mode.
+	DegradationMode_On = "on"
+	// DegradationMode_Off never degrades.
+	DegradationMode_Off = "off"
+)
+
+// DegradationOptions holds the settings for entering degraded mode
+// automatically. The zero value never does.
+type DegradationOptions struct {
+	// ErrorRate is the fraction of storage fetches failing, between 0 and 1,
+	// at or above which degraded mode is entered, or 0 to only enter it
+	// manually.
+	ErrorRate float64
+	// Window is how long the error rate is measured over, and so how long it
+	// must stay over the threshold before degrading and under it before
+	// recovering.
+	Window time.Duration
+	// MinFetches is how many fetches a window needs for its error rate to
+	// count, so that a couple of failures on a quiet instance don't degrade it.
+	MinFetches int
+}
+
+// Degradation is a switch for turning off the expensive features of the
+// metatile handler to shed load: setting the cache, compressing cached
+// variants and validating tiles. Tiles are still served, and cache lookups
+// still made, so degrading takes load off storage as well as the instance.
+type Degradation struct {
+	options DegradationOptions
+	logger  log.JsonLogger
+
+	mu          sync.Mutex
+	mode        string
+	auto        bool
+	since       time.Time
+	windowStart time.Time
+	fetches     int
+	errors      int
+	lastRate    float64
+}
+
+func NewDegradation(options DegradationOptions, logger log.JsonLogger) *Degradation {
+	now := time.Now()
+	return &Degradation{
+		options:     options,
+		logger:      logger,
+		mode:        DegradationMode_Auto,
+		since:       now,
+		windowStart: now,
+	}
+}
+
+// IsValidDegradationMode returns true when mode is one of the
+// DegradationMode_ constants.
+func IsValidDegradationMode(mode string) bool {
+	switch mode {
+	case DegradationMode_Auto, DegradationMode_On, DegradationMode_Off:
+		return true
+	}
+	return false
+}
+
+// Active returns true while expensive features should be turned off.
+func (d *Degradation) Active() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.activeLocked()
+}
+
+func (d *Degradation) activeLocked() bool {
+	switch d.mode {
+	case DegradationMode_On:
+		return true
+	case DegradationMode_Off:
+		return false
+	}
+	return d.auto
+}
+
+// RecordFetch counts a storage fetch towards the error rate, re-evaluating
+// the automatic mode at the end of each window.
+func (d *Degradation) RecordFetch(failed bool) {
+	if d.options.ErrorRate <= 0 || d.options.Window <= 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.windowStart) >= d.options.Window {
+		if d.fetches >= d.options.MinFetches && d.fetches > 0 {
+			d.lastRate = float64(d.errors) / float64(d.fetches)
+			d.setAutoLocked(d.lastRate >= d.options.ErrorRate, now)
+		} else {
+			d.lastRate = 0
+			d.setAutoLocked(false, now)
+		}
+		d.windowStart = now
+		d.fetches = 0
+		d.errors = 0
+	}
+
+	d.fetches++
+	if failed {
+		d.errors++
+	}
+}
+
+func (d *Degradation) setAutoLocked(auto bool, now time.Time) {
+	if auto == d.auto {
+		return
+	}
+	wasActive := d.activeLocked()
+	d.auto = auto
+	if d.mode != DegradationMode_Auto {
+		return
+	}
+	if auto {
+		d.logger.Warning(log.LogCategory_StorageError, "Entering degraded mode, storage error rate %.3f over the last %s", d.lastRate, d.options.Window)
+	} else {
+		d.logger.Info("Leaving degraded mode, storage error rate %.3f over the last %s", d.lastRate, d.options.Window)
+	}
+	if wasActive != d.activeLocked() {
+		d.since = now
+	}
+}
+
+// SetMode switches between forcing degraded mode on or off, and entering it
+// automatically. It returns false for an unknown mode.
+func (d *Degradation) SetMode(mode string) bool {
+	if !IsValidDegradationMode(mode) {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	wasActive := d.activeLocked()
+	d.mode = mode
+	if wasActive != d.activeLocked() {
+		d.since = time.Now()
+	}
+	d.logger.Info("Degradation mode set to %s, degraded: %t", mode, d.activeLocked())
+	return true
+}
+
+// DegradationStatus is the state of a Degradation, as served by its admin
+// endpoint.
+type DegradationStatus struct {
+	Mode   string `json:"mode"`
+	Active bool   `json:"active"`
+	// Since is when Active last changed
+	Since time.Time `json:"since"`
+	// ErrorRate is the storage error rate over the last full window
+	ErrorRate float64 `json:"error_rate"`
+}
+
+func (d *Degradation) Status() DegradationStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return DegradationStatus{
+		Mode:      d.mode,
+		Active:    d.activeLocked(),
+		Since:     d.since,
+		ErrorRate: d.lastRate,
+	}
+}
+
+// DegradationHandler serves the status of the degradation switch, and sets
+// its mode on POST with a mode parameter of "on", "off" or "auto".
+func DegradationHandler(d *Degradation, logger log.JsonLogger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			mode := req.FormValue("mode")
+			if !d.SetMode(mode) {
+				http.Error(rw, "mode must be one of on, off or auto", http.StatusBadRequest)
+				return
+			}
+		}
+		writeJson(rw, logger, d.Status())
+	})
+}
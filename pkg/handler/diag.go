@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/tilezen/tapalcatl/pkg/log"
+)
+
+// Diagnostics is a snapshot of the server's internal state, as served by
+// the admin diag endpoint.
+type Diagnostics struct {
+	Goroutines int `json:"goroutines"`
+	// BuffersInUse counts the buffers taken from the buffer manager, and
+	// BufferPoolSize is the number of buffers it keeps, 0 when buffers
+	// aren't pooled.
+	BuffersInUse     int64 `json:"buffers_in_use"`
+	BufferPoolSize   int   `json:"buffer_pool_size"`
+	PendingCacheSets int64 `json:"pending_cache_sets"`
+	ShedQueue        int   `json:"shed_queue"`
+	MetricsQueue     int   `json:"metrics_queue"`
+	InFlight         int64 `json:"in_flight"`
+	BannedClients    int   `json:"banned_clients"`
+	// InFlightByPattern counts the requests being handled for each tile
+	// pattern, so doesn't include admin and other requests.
+	InFlightByPattern map[string]int64 `json:"in_flight_by_pattern"`
+}
+
+// DiagHandler serves a snapshot of the server's internal state, taken when
+// each request is made.
+func DiagHandler(snapshot func() *Diagnostics, logger log.JsonLogger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		writeJson(rw, logger, snapshot())
+	})
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheSets keeps track of the cache writes still running in the background
+// after their response has been sent.
+var cacheSets struct {
+	sync.Mutex
+	pending int64
+	// lastProgress is when a write last completed, or when the first of the
+	// pending writes started
+	lastProgress time.Time
+	// generation is incremented when the pending writes are abandoned, so
+	// that they aren't counted if they ever complete
+	generation int
+}
+
+// PendingCacheSets returns the number of background cache writes which have
+// not yet completed.
+func PendingCacheSets() int64 {
+	cacheSets.Lock()
+	defer cacheSets.Unlock()
+	return cacheSets.pending
+}
+
+// CacheSetsStalled returns how long the background cache writes have gone
+// without one completing, or 0 if there are none pending.
+func CacheSetsStalled() time.Duration {
+	cacheSets.Lock()
+	defer cacheSets.Unlock()
+	if cacheSets.pending == 0 {
+		return 0
+	}
+	return time.Since(cacheSets.lastProgress)
+}
+
+// AbandonCacheSets stops counting the pending background cache writes, so
+// that shutdown doesn't wait for writes which are stuck, and returns how many
+// there were.
+func AbandonCacheSets() int64 {
+	cacheSets.Lock()
+	defer cacheSets.Unlock()
+	abandoned := cacheSets.pending
+	cacheSets.pending = 0
+	cacheSets.generation++
+	return abandoned
+}
+
+// goCacheSet runs a cache write in the background, keeping track of it so
+// that shutdown can tell whether all writes were flushed.
+func goCacheSet(set func()) {
+	cacheSets.Lock()
+	if cacheSets.pending == 0 {
+		cacheSets.lastProgress = time.Now()
+	}
+	cacheSets.pending++
+	generation := cacheSets.generation
+	cacheSets.Unlock()
+
+	go func() {
+		set()
+
+		cacheSets.Lock()
+		if cacheSets.generation == generation {
+			cacheSets.pending--
+			cacheSets.lastProgress = time.Now()
+		}
+		cacheSets.Unlock()
+	}()
+}
+
+// InFlightCounter counts the requests currently being handled.
+type InFlightCounter struct {
+	count int64
+}
+
+func (c *InFlightCounter) Count() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+func (c *InFlightCounter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&c.count, 1)
+		defer atomic.AddInt64(&c.count, -1)
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tilezen/tapalcatl/pkg/cache"
+	"github.com/tilezen/tapalcatl/pkg/log"
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/storage"
+)
+
+// ExplainRoute holds what the explain handler needs to know about a
+// configured pattern to resolve a request against it.
+type ExplainRoute struct {
+	Type                  string
+	Parser                state.Parser
+	MetatileSize          int
+	TileSize              int
+	MetatileMaxDetailZoom int
+	Storage               storage.Storage
+	// StorageNamespace is the handler's MetatileOptions.StorageNamespace.
+	StorageNamespace string
+	// BuildMetadata overrides the sizes above for builds which have metadata.
+	BuildMetadata *storage.BuildMetadataSource
+	// ByFormat overrides the above for patterns with per-format storage.
+	ByFormat map[string]*ExplainRoute
+}
+
+func coordJson(z, x, y int, format string) map[string]interface{} {
+	return map[string]interface{}{
+		"z":      z,
+		"x":      x,
+		"y":      y,
+		"format": format,
+	}
+}
+
+// ExplainHandler runs the routing, parsing and key resolution for the path
+// given in the "path" query parameter without fetching anything, and reports
+// the result. Routes are looked up by their path template in the router.
+func ExplainHandler(router *mux.Router, routes map[string]*ExplainRoute, logger log.JsonLogger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		path := q.Get("path")
+		if path == "" {
+			http.Error(rw, "Missing path parameter", http.StatusBadRequest)
+			return
+		}
+
+		target, err := url.Parse(path)
+		if err != nil {
+			http.Error(rw, "Invalid path parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if buildID := q.Get("buildid"); buildID != "" {
+			targetQuery := target.Query()
+			targetQuery.Set("buildid", buildID)
+			target.RawQuery = targetQuery.Encode()
+		}
+
+		explainReq, err := http.NewRequest("GET", target.String(), nil)
+		if err != nil {
+			http.Error(rw, "Invalid path parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		explainReq.Header = req.Header.Clone()
+
+		result := map[string]interface{}{
+			"path": target.String(),
+		}
+
+		var match mux.RouteMatch
+		if !router.Match(explainReq, &match) || match.Route == nil {
+			result["matched"] = false
+			writeJson(rw, logger, result)
+			return
+		}
+		pattern, err := match.Route.GetPathTemplate()
+		if err != nil {
+			http.Error(rw, "Unable to get pattern for route: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result["pattern"] = pattern
+
+		route, ok := routes[pattern]
+		if !ok {
+			// matched a route which isn't a tile pattern, eg. the healthcheck
+			result["matched"] = false
+			writeJson(rw, logger, result)
+			return
+		}
+		result["matched"] = true
+		result["type"] = route.Type
+
+		explainReq = mux.SetURLVars(explainReq, match.Vars)
+		parseResult, err := route.Parser.Parse(explainReq)
+		if err != nil {
+			result["parse_error"] = err.Error()
+		}
+		if parseResult == nil {
+			writeJson(rw, logger, result)
+			return
+		}
+		result["build_id"] = parseResult.BuildID
+		result["content_type"] = parseResult.ContentType
+
+		metatileData, ok := parseResult.AdditionalData.(*state.MetatileParseData)
+		if !ok || err != nil {
+			writeJson(rw, logger, result)
+			return
+		}
+
+		coord := metatileData.Coord
+		result["coord"] = coordJson(coord.Z, coord.X, coord.Y, coord.Format)
+
+		if formatRoute, ok := route.ByFormat[coord.Format]; ok {
+			route = formatRoute
+		} else if route.Storage == nil {
+			result["storage_error"] = "no storage configured for format " + coord.Format
+			writeJson(rw, logger, result)
+			return
+		}
+
+		metatileSize, tileSize, metatileMaxDetailZoom := route.MetatileSize, route.TileSize, route.MetatileMaxDetailZoom
+		if route.BuildMetadata != nil {
+			metadata, err := route.BuildMetadata.Get(parseResult.BuildID)
+			if err != nil {
+				result["build_metadata_error"] = err.Error()
+				writeJson(rw, logger, result)
+				return
+			}
+			if metadata != nil {
+				result["build_metadata"] = metadata
+				metatileSize, tileSize, metatileMaxDetailZoom = metadata.MetatileSize, metadata.TileSize, metadata.MetatileMaxDetailZoom
+			}
+		}
+
+		metaCoord, offset, err := coord.MetaAndOffset(metatileSize, tileSize, metatileMaxDetailZoom)
+		if err != nil {
+			result["metatile_error"] = err.Error()
+			writeJson(rw, logger, result)
+			return
+		}
+		result["metatile"] = coordJson(metaCoord.Z, metaCoord.X, metaCoord.Y, metaCoord.Format)
+		result["offset"] = coordJson(offset.Z, offset.X, offset.Y, offset.Format)
+
+		if resolver, ok := route.Storage.(storage.KeyResolver); ok {
+			key, err := resolver.ResolveKey(metaCoord, parseResult.BuildID, parseResult.KeyVariables)
+			if err != nil {
+				result["storage_key_error"] = err.Error()
+			} else {
+				result["storage_key"] = key
+			}
+		}
+
+		parseResult.StorageNamespace = route.StorageNamespace
+		result["cache_keys"] = map[string]string{
+			"vector":   cache.BuildVectorTileKey(parseResult),
+			"metatile": cache.BuildMetatileKey(parseResult, metaCoord),
+		}
+
+		writeJson(rw, logger, result)
+	})
+}
@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// FormatHandler dispatches requests to a handler chosen by the "fmt" route
+// variable, so that a single pattern can serve different formats from
+// different storages. Formats without a handler go to defaultHandler, or 404
+// when that is nil.
+func FormatHandler(handlers map[string]http.Handler, defaultHandler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if h, ok := handlers[mux.Vars(req)["fmt"]]; ok {
+			h.ServeHTTP(rw, req)
+		} else if defaultHandler != nil {
+			defaultHandler.ServeHTTP(rw, req)
+		} else {
+			http.NotFound(rw, req)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/tilezen/tapalcatl/pkg/golden"
+	"github.com/tilezen/tapalcatl/pkg/log"
+)
+
+// GoldenRecordHandler records the responses for the golden tiles under the
+// name in the "name" query parameter, from the build in "buildid" if given.
+// Existing recordings are never replaced.
+func GoldenRecordHandler(recorder *golden.Recorder, logger log.JsonLogger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		name, buildID, ok := goldenParams(rw, req)
+		if !ok {
+			return
+		}
+
+		recording, err := recorder.Record(name, buildID)
+		if err == golden.ErrExists {
+			http.Error(rw, "Recording "+name+" already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			logger.Error(log.LogCategory_StorageError, "Failed to record golden tiles as %s: %s", name, err.Error())
+			http.Error(rw, "Failed to record golden tiles: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJsonStatus(rw, logger, http.StatusCreated, recording)
+	})
+}
+
+// GoldenCompareHandler compares the responses for the golden tiles from the
+// build in the "buildid" query parameter with the recording in "name", and
+// reports those which changed.
+func GoldenCompareHandler(recorder *golden.Recorder, logger log.JsonLogger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		name, buildID, ok := goldenParams(rw, req)
+		if !ok {
+			return
+		}
+
+		report, err := recorder.Compare(name, buildID)
+		if err != nil {
+			logger.Error(log.LogCategory_StorageError, "Failed to compare golden tiles with %s: %s", name, err.Error())
+			http.Error(rw, "Failed to compare golden tiles: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if report == nil {
+			http.Error(rw, "No recording "+name, http.StatusNotFound)
+			return
+		}
+		writeJson(rw, logger, report)
+	})
+}
+
+func goldenParams(rw http.ResponseWriter, req *http.Request) (string, string, bool) {
+	name := req.URL.Query().Get("name")
+	if !golden.IsValidName(name) {
+		http.Error(rw, "Invalid name parameter", http.StatusBadRequest)
+		return "", "", false
+	}
+	buildID, queryErr := ParseBuildID(req)
+	if queryErr != nil {
+		http.Error(rw, queryErr.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	return name, buildID, true
+}
@@ -3,12 +3,28 @@ package handler
 import (
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	golog "log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gorilla/mux"
+
 	"github.com/tilezen/tapalcatl/pkg/buffer"
 	"github.com/tilezen/tapalcatl/pkg/cache"
 	"github.com/tilezen/tapalcatl/pkg/log"
@@ -25,7 +41,7 @@ func makeTestZip(tile tile.TileCoord, content string) (*bytes.Buffer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Unable to create file %#v in zip: %s", tile.FileName(), err.Error())
 	}
-	_, err = f.Write([]byte("{}"))
+	_, err = f.Write([]byte(content))
 	if err != nil {
 		return nil, fmt.Errorf("Unable to write JSON file to zip: %s", err.Error())
 	}
@@ -52,7 +68,7 @@ type fakeStorage struct {
 	storage map[tile.TileCoord]*storage.StorageResponse
 }
 
-func (f *fakeStorage) Fetch(t tile.TileCoord, _ state.Condition, prefix string) (*storage.StorageResponse, error) {
+func (f *fakeStorage) Fetch(t tile.TileCoord, _ state.Condition, prefix string, _ map[string]string) (*storage.StorageResponse, error) {
 	resp, ok := f.storage[t]
 	if ok {
 		return resp, nil
@@ -154,3 +170,1781 @@ func TestHandlerHit(t *testing.T) {
 	checkHeader("Last-Modified", lastModifiedStr)
 	checkHeader("X-Mz-Ignore-Me", "")
 }
+
+func TestSelfTestMetatile(t *testing.T) {
+	theTile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+
+	err := SelfTestMetatile(theTile, 1, 1, 0, stg, &buffer.OnDemandBufferManager{})
+	if err == nil {
+		t.Fatalf("Expected self-test to fail on empty storage")
+	}
+
+	zipfile, err := makeTestZip(theTile, "{}")
+	if err != nil {
+		t.Fatalf("Unable to make test zip: %s", err.Error())
+	}
+	metatile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	stg.storage[metatile] = &storage.StorageResponse{
+		Response: &storage.SuccessfulResponse{Body: zipfile.Bytes()},
+	}
+
+	err = SelfTestMetatile(theTile, 1, 1, 0, stg, &buffer.OnDemandBufferManager{})
+	if err != nil {
+		t.Fatalf("Expected self-test to pass, but got error: %s", err.Error())
+	}
+}
+
+func TestExplainHandler(t *testing.T) {
+	pattern := "/osm/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}"
+	parser := &MetatileMuxParser{MimeMap: map[string]string{"mvt": "application/x-protobuf"}}
+	stg := storage.NewFileStorage("/tiles", "all", "")
+
+	r := mux.NewRouter()
+	r.Handle(pattern, http.NotFoundHandler()).Methods("GET")
+	routes := map[string]*ExplainRoute{
+		pattern: {Type: "metatile", Parser: parser, MetatileSize: 8, TileSize: 1, Storage: stg},
+	}
+	h := ExplainHandler(r, routes, &log.NilJsonLogger{})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/admin/explain?path=/osm/10/163/395.mvt&buildid=20210331", nil)
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != 200 {
+		t.Fatalf("Expected 200 OK response, but got %d", rec.Code)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Unable to parse explain response: %s", err.Error())
+	}
+	if result["pattern"] != pattern {
+		t.Fatalf("Expected pattern %#v, but got %#v", pattern, result["pattern"])
+	}
+	expKey := "/tiles/20210331/all/7/20/49.zip"
+	if result["storage_key"] != expKey {
+		t.Fatalf("Expected storage key %#v, but got %#v", expKey, result["storage_key"])
+	}
+	cacheKeys := result["cache_keys"].(map[string]interface{})
+	expCacheKey := "vector:20210331:10/163/395.mvt"
+	if cacheKeys["vector"] != expCacheKey {
+		t.Fatalf("Expected vector cache key %#v, but got %#v", expCacheKey, cacheKeys["vector"])
+	}
+}
+
+func TestListHandler(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+	for _, name := range []string{"0/0/0.zip", "1/0/0.zip", "1/1/0.zip"} {
+		path := filepath.Join(baseDir, "all", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Unable to create dir: %s", err.Error())
+		}
+		if err := ioutil.WriteFile(path, []byte("zip"), 0644); err != nil {
+			t.Fatalf("Unable to write tile: %s", err.Error())
+		}
+	}
+
+	pattern := "/osm/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}"
+	routes := map[string]*ExplainRoute{
+		pattern: {Type: "metatile", Storage: storage.NewFileStorage(baseDir, "all", "")},
+	}
+	h := ListHandler(routes, &log.NilJsonLogger{})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/admin/list?pattern="+url.QueryEscape(pattern)+"&prefix=all/1/&limit=1", nil)
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != 200 {
+		t.Fatalf("Expected 200 OK response, but got %d", rec.Code)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Unable to parse list response: %s", err.Error())
+	}
+	keys := result["keys"].([]interface{})
+	if len(keys) != 1 || keys[0] != "all/1/0/0.zip" {
+		t.Fatalf("Expected keys [all/1/0/0.zip], but got %#v", keys)
+	}
+	if result["truncated"] != true || result["next"] != "all/1/0/0.zip" {
+		t.Fatalf("Expected truncated result with next key, but got %#v", result)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/admin/list?pattern=/unknown", nil)
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 response for unknown pattern, but got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/admin/list?pattern="+url.QueryEscape(pattern)+"&prefix=../../etc/", nil)
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 response for a prefix outside the storage, but got %d", rec.Code)
+	}
+}
+
+func TestHandlerMaxZoom(t *testing.T) {
+	deepTile := tile.TileCoord{Z: 2, X: 3, Y: 1, Format: "json"}
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+
+	// with 1x1 metatiles, the z1 ancestor 1/1/0 is the only tile in its metatile
+	zipfile, err := makeTestZip(tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}, "{}")
+	if err != nil {
+		t.Fatalf("Unable to make test zip: %s", err.Error())
+	}
+	metatile := tile.TileCoord{Z: 1, X: 1, Y: 0, Format: "zip"}
+	stg.storage[metatile] = &storage.StorageResponse{
+		Response: &storage.SuccessfulResponse{Body: zipfile.Bytes()},
+	}
+
+	checkStatus := func(policy string, exp int) {
+		parser := &fakeParser{tile: deepTile}
+		options := MetatileOptions{MaxZoom: 1, MaxZoomPolicy: policy}
+		h := MetatileHandlerWithOptions(parser, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, &metrics.NilMetricsWriter{}, &log.NilJsonLogger{}, cache.NilCache, options)
+
+		rw := &fakeResponseWriter{header: make(http.Header), status: 0}
+		req := &http.Request{URL: &url.URL{Path: "tile"}}
+		h.ServeHTTP(rw, req)
+
+		if rw.status != exp {
+			t.Fatalf("Expected %d response with %s policy, but got %d", exp, policy, rw.status)
+		}
+	}
+
+	checkStatus(MaxZoomPolicy_NotFound, 404)
+	checkStatus(MaxZoomPolicy_Overzoom, 200)
+}
+
+type recordingMetricsWriter struct {
+	metrics.NilMetricsWriter
+	metatileStates []*state.RequestState
+}
+
+func (r *recordingMetricsWriter) WriteMetatileState(reqState *state.RequestState) {
+	r.metatileStates = append(r.metatileStates, reqState)
+}
+
+func TestHandlerBuildIsolation(t *testing.T) {
+	pattern := "/osm/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}"
+	parser := &MetatileMuxParser{MimeMap: map[string]string{"json": "application/json"}}
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+	mw := &recordingMetricsWriter{}
+
+	r := mux.NewRouter()
+	h := MetatileHandler(parser, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, mw, &log.NilJsonLogger{}, cache.NilCache)
+	r.Handle(pattern, h)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/osm/0/0/0.json?buildid=20210331", nil))
+	if len(mw.metatileStates) != 1 || mw.metatileStates[0].Build != "20210331" {
+		t.Fatalf("Expected request state with build 20210331")
+	}
+	if mw.metatileStates[0].AsJsonMap()["build"] != "20210331" {
+		t.Fatalf("Expected build to be logged")
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/osm/0/0/0.json?buildid=../../etc", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 response for invalid build, but got %d", rec.Code)
+	}
+}
+
+func TestHandlerCacheKeyParams(t *testing.T) {
+	pattern := "/osm/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}"
+	parser := &MetatileMuxParser{
+		MimeMap:           map[string]string{"json": "application/json"},
+		KeyQueryVariables: map[string]*regexp.Regexp{"lang": regexp.MustCompile(`^[a-z]+$`)},
+		CacheKeyParams:    []string{"lang", "buildid"},
+	}
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+	mw := &recordingMetricsWriter{}
+
+	r := mux.NewRouter()
+	h := MetatileHandler(parser, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, mw, &log.NilJsonLogger{}, cache.NilCache)
+	r.Handle(pattern, h)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/osm/0/0/0.json?utm_source=x&lang=en&buildid=b1&api_key=k", nil))
+	if got := rec.Header().Get(cacheKeyParamsHeader); got != "buildid=b1&lang=en" {
+		t.Fatalf("Expected the normalized significant params, got %#v", got)
+	}
+	if len(mw.metatileStates) != 1 || mw.metatileStates[0].Build != "b1" || mw.metatileStates[0].HttpData.ApiKey != "k" {
+		t.Fatalf("Expected the build and api key to be read")
+	}
+
+	parser.CacheKeyParams = []string{"lang"}
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/osm/0/0/0.json?buildid=../../etc", nil))
+	if rec.Code == http.StatusBadRequest {
+		t.Fatalf("Expected buildid to be ignored when it isn't significant")
+	}
+	if values, ok := rec.Header()[cacheKeyParamsHeader]; !ok || values[0] != "" {
+		t.Fatalf("Expected an empty %s header, got %v", cacheKeyParamsHeader, values)
+	}
+}
+
+func TestArchiveHandler(t *testing.T) {
+	pattern := "/meta/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}"
+	parser := &MetatileMuxParser{MimeMap: map[string]string{"zip": "application/zip"}}
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+	mw := &recordingMetricsWriter{}
+
+	metatile := tile.TileCoord{Z: 2, X: 1, Y: 3, Format: "zip"}
+	buf, err := makeTestZip(tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}, "{}")
+	if err != nil {
+		t.Fatalf("Unable to make test zip: %s", err.Error())
+	}
+	etag := `"abc"`
+	stg.storage[metatile] = &storage.StorageResponse{
+		Response: &storage.SuccessfulResponse{Body: buf.Bytes(), ETag: &etag},
+	}
+
+	r := mux.NewRouter()
+	r.Handle(pattern, ArchiveHandler(parser, stg, mw, &log.NilJsonLogger{}, cache.NilCache, ArchiveOptions{}))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/meta/2/1/3.zip", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK response, but got %d", rec.Code)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), buf.Bytes()) {
+		t.Fatalf("Expected the whole metatile to be served")
+	}
+	if rec.Header().Get("Content-Type") != "application/zip" || rec.Header().Get("ETag") != etag {
+		t.Fatalf("Expected zip content type and the metatile's ETag, got %v", rec.Header())
+	}
+	if len(mw.metatileStates) != 1 || mw.metatileStates[0].ResponseState != state.ResponseState_Success {
+		t.Fatalf("Expected the request to be counted as a success")
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/meta/2/1/2.zip", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing metatile, but got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/meta/2/1/3.mvt", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a format other than zip, but got %d", rec.Code)
+	}
+}
+
+func TestLoadShedderPriority(t *testing.T) {
+	ls := NewLoadShedder(1, 1, 0)
+
+	if !ls.acquire(0) {
+		t.Fatalf("Expected the first request to be handled immediately")
+	}
+
+	waitQueued := func(n int) {
+		for i := 0; i < 1000; i++ {
+			ls.mu.Lock()
+			queued := ls.queue.Len()
+			ls.mu.Unlock()
+			if queued == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("Expected %d queued requests", n)
+	}
+
+	lowResult := make(chan bool)
+	go func() { lowResult <- ls.acquire(1) }()
+	waitQueued(1)
+
+	highResult := make(chan bool)
+	go func() { highResult <- ls.acquire(10) }()
+
+	// the queue only holds one, so the low priority request is shed
+	if <-lowResult {
+		t.Fatalf("Expected the low priority request to be shed")
+	}
+
+	ls.release()
+	if !<-highResult {
+		t.Fatalf("Expected the high priority request to be handled")
+	}
+	ls.release()
+
+	if ls.inFlight != 0 {
+		t.Fatalf("Expected no requests in flight, got %d", ls.inFlight)
+	}
+}
+
+func TestLoadShedderQueueWait(t *testing.T) {
+	ls := NewLoadShedder(1, 1, 0)
+	waits := make(chan time.Duration, 1)
+	h := ls.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		waits <- queueWait(req.Context())
+	}), func(*http.Request) int { return 0 })
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if wait := <-waits; wait != 0 {
+		t.Fatalf("Expected no queue wait with a free slot, got %s", wait)
+	}
+
+	// hold the only slot so that the next request is queued
+	ls.acquire(0)
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		close(done)
+	}()
+	for ls.QueueLength() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+	ls.release()
+	<-done
+	if wait := <-waits; wait < 5*time.Millisecond {
+		t.Fatalf("Expected the queue wait to be recorded, got %s", wait)
+	}
+}
+
+func TestZoomPriority(t *testing.T) {
+	priority := ZoomPriority([]ZoomBand{
+		{MinZoom: 0, MaxZoom: 8, Weight: 10},
+		{MinZoom: 9, MaxZoom: 16, Weight: 5},
+	})
+
+	for z, expected := range map[string]int{"3": 10, "12": 5, "18": 0} {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), map[string]string{"z": z})
+		if actual := priority(req); actual != expected {
+			t.Fatalf("Expected priority %d for zoom %s, got %d", expected, z, actual)
+		}
+	}
+}
+
+func TestHandlerValidateTiles(t *testing.T) {
+	theTile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "mvt"}
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+
+	// JSON isn't a valid protobuf, so is a corrupt mvt tile
+	zipfile, err := makeTestZip(theTile, "{}")
+	if err != nil {
+		t.Fatalf("Unable to make test zip: %s", err.Error())
+	}
+	metatile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	stg.storage[metatile] = &storage.StorageResponse{
+		Response: &storage.SuccessfulResponse{Body: zipfile.Bytes()},
+	}
+
+	checkStatus := func(validate bool, exp int) {
+		mw := &recordingMetricsWriter{}
+		options := MetatileOptions{ValidateTiles: validate}
+		h := MetatileHandlerWithOptions(&fakeParser{tile: theTile}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, mw, &log.NilJsonLogger{}, cache.NilCache, options)
+
+		rw := &fakeResponseWriter{header: make(http.Header), status: 0}
+		req := &http.Request{URL: &url.URL{Path: "tile"}}
+		h.ServeHTTP(rw, req)
+
+		if rw.status != exp {
+			t.Fatalf("Expected %d response with validation %t, but got %d", exp, validate, rw.status)
+		}
+		if len(mw.metatileStates) != 1 || mw.metatileStates[0].IsTileInvalid != validate {
+			t.Fatalf("Expected tile to be recorded as invalid only when validating")
+		}
+	}
+
+	checkStatus(false, 200)
+	checkStatus(true, 502)
+}
+
+// variantCache is a cache which only stores compressed tile variants.
+type variantCache struct {
+	cache.Cache
+	mu       sync.Mutex
+	variants map[string]*state.VectorTileResponseData
+}
+
+func (c *variantCache) GetTileVariant(ctx context.Context, req *state.ParseResult, encoding string) (*state.VectorTileResponseData, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.variants[encoding], nil
+}
+
+func (c *variantCache) SetTileVariant(ctx context.Context, req *state.ParseResult, encoding string, resp *state.VectorTileResponseData, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.variants[encoding] = resp
+	return nil
+}
+
+func TestHandlerCacheCompressedTiles(t *testing.T) {
+	theTile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+
+	content := "{\"features\": [" + strings.Repeat("{}, ", 1000) + "{}]}"
+	zipfile, err := makeTestZip(theTile, content)
+	if err != nil {
+		t.Fatalf("Unable to make test zip: %s", err.Error())
+	}
+	metatile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	stg.storage[metatile] = &storage.StorageResponse{
+		Response: &storage.SuccessfulResponse{Body: zipfile.Bytes()},
+	}
+
+	tileCache := &variantCache{Cache: cache.NilCache, variants: make(map[string]*state.VectorTileResponseData)}
+	options := MetatileOptions{CacheCompressedTiles: true}
+	h := MetatileHandlerWithOptions(&fakeParser{tile: theTile}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, &metrics.NilMetricsWriter{}, &log.NilJsonLogger{}, tileCache, options)
+
+	request := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/tile", nil)
+		req.Header.Set("Accept-Encoding", "br;q=1.0, gzip;q=0.8")
+		h.ServeHTTP(rw, req)
+		if rw.Code != 200 {
+			t.Fatalf("Expected 200 OK response, but got %d", rw.Code)
+		}
+		if encoding := rw.Header().Get("Content-Encoding"); encoding != "gzip" {
+			t.Fatalf("Expected gzip response, but got encoding %#v", encoding)
+		}
+		return rw
+	}
+
+	first := request()
+	for i := 0; i < 1000 && PendingCacheSets() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if tileCache.variants["gzip"] == nil {
+		t.Fatalf("Expected compressed tile to be cached")
+	}
+
+	// remove the metatile, so the second request can only be served from the cache
+	delete(stg.storage, metatile)
+	second := request()
+	if !bytes.Equal(first.Body.Bytes(), second.Body.Bytes()) {
+		t.Fatalf("Expected cached compressed tile to match the original")
+	}
+
+	r, err := gzip.NewReader(second.Body)
+	if err != nil {
+		t.Fatalf("Unable to read gzip response: %s", err.Error())
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil || string(body) != content {
+		t.Fatalf("Expected gzip response to decompress to the tile")
+	}
+}
+
+// uncompressedSetCache records whether uncompressed tiles were cached.
+type uncompressedSetCache struct {
+	*variantCache
+	setTile bool
+}
+
+func (c *uncompressedSetCache) SetTile(ctx context.Context, req *state.ParseResult, resp *state.VectorTileResponseData, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setTile = true
+	return nil
+}
+
+func TestHandlerStoreCompressedTiles(t *testing.T) {
+	theTile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+
+	content := "{\"features\": [" + strings.Repeat("{}, ", 1000) + "{}]}"
+	zipfile, err := makeTestZip(theTile, content)
+	if err != nil {
+		t.Fatalf("Unable to make test zip: %s", err.Error())
+	}
+	metatile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	stg.storage[metatile] = &storage.StorageResponse{
+		Response: &storage.SuccessfulResponse{Body: zipfile.Bytes()},
+	}
+
+	tileCache := &uncompressedSetCache{variantCache: &variantCache{Cache: cache.NilCache, variants: make(map[string]*state.VectorTileResponseData)}}
+	options := MetatileOptions{StoreCompressedTiles: true}
+	h := MetatileHandlerWithOptions(&fakeParser{tile: theTile}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, &metrics.NilMetricsWriter{}, &log.NilJsonLogger{}, tileCache, options)
+
+	request := func(acceptEncoding, expectedEncoding string) string {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/tile", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		h.ServeHTTP(rw, req)
+		if rw.Code != 200 {
+			t.Fatalf("Expected 200 OK response, but got %d", rw.Code)
+		}
+		if encoding := rw.Header().Get("Content-Encoding"); encoding != expectedEncoding {
+			t.Fatalf("Expected encoding %#v for Accept-Encoding %#v, but got %#v", expectedEncoding, acceptEncoding, encoding)
+		}
+		if expectedEncoding == "" {
+			return rw.Body.String()
+		}
+		r, err := gzip.NewReader(rw.Body)
+		if err != nil {
+			t.Fatalf("Unable to read gzip response: %s", err.Error())
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Unable to read gzip response: %s", err.Error())
+		}
+		return string(body)
+	}
+
+	// filled by a client which doesn't accept gzip
+	if body := request("identity", ""); body != content {
+		t.Fatalf("Expected the uncompressed tile")
+	}
+	for i := 0; i < 1000 && PendingCacheSets() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if tileCache.variants["gzip"] == nil || tileCache.variants["gzip"].ContentEncoding != "gzip" {
+		t.Fatalf("Expected compressed tile to be cached")
+	}
+	if tileCache.setTile {
+		t.Fatalf("Expected the uncompressed tile not to be cached")
+	}
+
+	// remove the metatile, so the tile can only be served from the cache
+	delete(stg.storage, metatile)
+	if body := request("gzip", "gzip"); body != content {
+		t.Fatalf("Expected cached tile to decompress to the tile")
+	}
+	if body := request("identity", ""); body != content {
+		t.Fatalf("Expected cached tile to be decompressed for clients not accepting gzip")
+	}
+}
+
+func TestBufferedGzipHandler(t *testing.T) {
+	small := strings.Repeat("a", 2000)
+	large := strings.Repeat("b", 10000)
+	h := BufferedGzipHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body := small
+		if req.URL.Path == "/large" {
+			body = large
+		}
+		rw.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+		rw.WriteHeader(http.StatusOK)
+		// write in pieces, as a handler copying from a reader would
+		for i := 0; i < len(body); i += 1000 {
+			rw.Write([]byte(body[i : i+1000]))
+		}
+	}), 4096)
+
+	check := func(path, expected string, expectLength bool) {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		h.ServeHTTP(rw, req)
+
+		if rw.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("Expected %s to be gzipped", path)
+		}
+		length := rw.Header().Get("Content-Length")
+		if expectLength && length != fmt.Sprintf("%d", rw.Body.Len()) {
+			t.Fatalf("Expected %s to have Content-Length %d, got %#v", path, rw.Body.Len(), length)
+		}
+		if !expectLength && length != "" {
+			t.Fatalf("Expected %s to be streamed without Content-Length, got %#v", path, length)
+		}
+
+		r, err := gzip.NewReader(rw.Body)
+		if err != nil {
+			t.Fatalf("Unable to read gzip response: %s", err.Error())
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil || string(body) != expected {
+			t.Fatalf("Expected %s to decompress to the original body", path)
+		}
+	}
+
+	check("/small", small, true)
+	check("/large", large, false)
+}
+
+func TestInstrumentCompression(t *testing.T) {
+	theTile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+
+	content := "{\"features\": [" + strings.Repeat("{}, ", 1000) + "{}]}"
+	zipfile, err := makeTestZip(theTile, content)
+	if err != nil {
+		t.Fatalf("Unable to make test zip: %s", err.Error())
+	}
+	metatile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	stg.storage[metatile] = &storage.StorageResponse{
+		Response: &storage.SuccessfulResponse{Body: zipfile.Bytes()},
+	}
+
+	mw := &recordingMetricsWriter{}
+	h := MetatileHandler(&fakeParser{tile: theTile}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, mw, &log.NilJsonLogger{}, cache.NilCache)
+	h = InstrumentCompression(h, func(h http.Handler) http.Handler {
+		return BufferedGzipHandler(h, 4096)
+	})
+
+	request := func(acceptEncoding string) (*httptest.ResponseRecorder, *state.RequestState) {
+		mw.metatileStates = nil
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/tile", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		h.ServeHTTP(rw, req)
+		if len(mw.metatileStates) != 1 {
+			t.Fatalf("Expected the request's metrics to be written once, got %d", len(mw.metatileStates))
+		}
+		return rw, mw.metatileStates[0]
+	}
+
+	rw, reqState := request("gzip")
+	if reqState.Compression == nil {
+		t.Fatalf("Expected compression to be recorded")
+	}
+	if reqState.Compression.Size != rw.Body.Len() {
+		t.Fatalf("Expected compressed size %d, got %d", rw.Body.Len(), reqState.Compression.Size)
+	}
+	if _, ok := reqState.AsJsonMap()["timing"].(map[string]int64)["compress"]; !ok {
+		t.Fatalf("Expected compression time to be logged")
+	}
+
+	_, reqState = request("identity")
+	if reqState.Compression != nil {
+		t.Fatalf("Expected no compression to be recorded for an uncompressed response")
+	}
+}
+
+func TestNormalizeHeaders(t *testing.T) {
+	serve := func(options HeaderOptions, status int, etag string) http.Header {
+		h := NormalizeHeaders(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Add("Vary", "accept-encoding")
+			rw.Header().Set("ETag", etag)
+			rw.Header().Set("Last-Modified", "Thu, 17 Nov 2016 12:27:00 GMT")
+			rw.WriteHeader(status)
+		}), options)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", "/tile", nil))
+		return rw.Header()
+	}
+
+	headers := serve(HeaderOptions{Vary: []string{"Accept-Encoding", "Origin"}}, 200, "abc")
+	if vary := headers.Values("Vary"); len(vary) != 1 || vary[0] != "accept-encoding, Origin" {
+		t.Fatalf("Expected merged Vary header, got %#v", vary)
+	}
+	if etag := headers.Get("ETag"); etag != `"abc"` {
+		t.Fatalf("Expected unquoted ETag to be quoted, got %#v", etag)
+	}
+
+	for style, expected := range map[string]string{
+		ETagStyle_Preserve: `W/"abc"`,
+		ETagStyle_Strong:   `"abc"`,
+		ETagStyle_Weak:     `W/"abc"`,
+	} {
+		if etag := serve(HeaderOptions{ETagStyle: style}, 200, `W/"abc"`).Get("ETag"); etag != expected {
+			t.Fatalf("Expected %s ETag %#v, got %#v", style, expected, etag)
+		}
+	}
+	if etag := serve(HeaderOptions{ETagStyle: ETagStyle_Weak}, 200, `"abc"`).Get("ETag"); etag != `W/"abc"` {
+		t.Fatalf("Expected weak ETag, got %#v", etag)
+	}
+
+	compressed := NormalizeHeaders(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if inm := req.Header.Get("If-None-Match"); inm != `"abc", W/"def"` {
+			t.Fatalf("Expected encoding to be removed from If-None-Match, got %#v", inm)
+		}
+		rw.Header().Set("ETag", `"abc"`)
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.WriteHeader(200)
+	}), HeaderOptions{ETagStyle: ETagStyle_Encoding})
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/tile", nil)
+	req.Header.Set("If-None-Match", `"abc-gzip", W/"def"`)
+	compressed.ServeHTTP(rw, req)
+	if etag := rw.Header().Get("ETag"); etag != `"abc-gzip"` {
+		t.Fatalf("Expected encoding ETag, got %#v", etag)
+	}
+	if etag := serve(HeaderOptions{ETagStyle: ETagStyle_Encoding}, 200, `"abc"`).Get("ETag"); etag != `"abc"` {
+		t.Fatalf("Expected uncompressed response ETag to be unchanged, got %#v", etag)
+	}
+
+	headers = serve(HeaderOptions{StripErrorValidators: true}, 500, `"abc"`)
+	if headers.Get("ETag") != "" || headers.Get("Last-Modified") != "" {
+		t.Fatalf("Expected validators to be removed from error response")
+	}
+	headers = serve(HeaderOptions{StripErrorValidators: true}, 304, `"abc"`)
+	if headers.Get("ETag") == "" || headers.Get("Last-Modified") == "" {
+		t.Fatalf("Expected validators to be kept on not modified response")
+	}
+}
+
+func TestHandlerServerTiming(t *testing.T) {
+	theTile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+
+	zipfile, err := makeTestZip(theTile, "{}")
+	if err != nil {
+		t.Fatalf("Unable to make test zip: %s", err.Error())
+	}
+	metatile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	stg.storage[metatile] = &storage.StorageResponse{
+		Response: &storage.SuccessfulResponse{Body: zipfile.Bytes()},
+	}
+
+	options := MetatileOptions{ServerTiming: true}
+	h := MetatileHandlerWithOptions(&fakeParser{tile: theTile}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, &metrics.NilMetricsWriter{}, &log.NilJsonLogger{}, cache.NilCache, options)
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/tile", nil))
+
+	timing := rw.Header().Get("Server-Timing")
+	for _, phase := range []string{"fetch;dur=", "extract;dur="} {
+		if !strings.Contains(timing, phase) {
+			t.Fatalf("Expected Server-Timing to contain %s, got %#v", phase, timing)
+		}
+	}
+}
+
+func TestHandlerAsOf(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	theTile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	for _, build := range []string{"20230801", "20230901"} {
+		zipfile, err := makeTestZip(theTile, `{"build":"`+build+`"}`)
+		if err != nil {
+			t.Fatalf("Unable to make test zip: %s", err.Error())
+		}
+		dir := filepath.Join(baseDir, build, "0", "0")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Unable to create tile dir: %s", err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "0.zip"), zipfile.Bytes(), 0644); err != nil {
+			t.Fatalf("Unable to write tile: %s", err.Error())
+		}
+	}
+	manifest := `{"builds": [
+		{"build_id": "20230801", "created": "2023-08-01T10:00:00Z"},
+		{"build_id": "20230901", "created": "2023-09-01T10:00:00Z"}
+	]}`
+	if err := ioutil.WriteFile(filepath.Join(baseDir, "manifest.json"), []byte(manifest), 0644); err != nil {
+		t.Fatalf("Unable to write manifest: %s", err.Error())
+	}
+
+	pattern := "/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}"
+	parser := &MetatileMuxParser{MimeMap: map[string]string{"json": "application/json"}}
+	stg := storage.NewFileStorage(baseDir, "", "")
+	newRouter := func(options MetatileOptions) *mux.Router {
+		r := mux.NewRouter()
+		r.Handle(pattern, MetatileHandlerWithOptions(parser, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, &metrics.NilMetricsWriter{}, &log.NilJsonLogger{}, cache.NilCache, options))
+		return r
+	}
+	r := newRouter(MetatileOptions{BuildManifest: storage.NewBuildManifestSource(stg, "manifest.json", time.Minute)})
+
+	check := func(req *http.Request, status int, body string) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Fatalf("Expected %d for %s, got %d", status, req.URL, rec.Code)
+		}
+		if body != "" && rec.Body.String() != body {
+			t.Fatalf("Expected %s for %s, got %s", body, req.URL, rec.Body.String())
+		}
+	}
+	check(httptest.NewRequest("GET", "/0/0/0.json?asof=2023-09-01", nil), 200, `{"build":"20230901"}`)
+	check(httptest.NewRequest("GET", "/0/0/0.json?asof=2023-08-31T23:00:00Z", nil), 200, `{"build":"20230801"}`)
+	check(httptest.NewRequest("GET", "/0/0/0.json?asof=2023-07-01", nil), 404, "")
+	check(httptest.NewRequest("GET", "/0/0/0.json?asof=yesterday", nil), 400, "")
+	check(httptest.NewRequest("GET", "/0/0/0.json?asof=2023-09-01&buildid=20230801", nil), 400, "")
+
+	req := httptest.NewRequest("GET", "/0/0/0.json", nil)
+	req.Header.Set("X-Tile-AsOf", "2023-08-15")
+	check(req, 200, `{"build":"20230801"}`)
+
+	r = newRouter(MetatileOptions{})
+	check(httptest.NewRequest("GET", "/0/0/0.json?asof=2023-09-01", nil), 400, "")
+}
+
+func TestHandlerTombstone(t *testing.T) {
+	theTile := tile.TileCoord{Z: 1, X: 0, Y: 0, Format: "json"}
+	deletedTile := tile.TileCoord{Z: 1, X: 1, Y: 0, Format: "json"}
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+
+	// the whole of one metatile is deleted, the other has an empty tile
+	stg.storage[tile.TileCoord{Z: 1, X: 1, Y: 0, Format: "zip"}] = &storage.StorageResponse{
+		Response: &storage.SuccessfulResponse{Body: []byte{}},
+	}
+	zipfile, err := makeTestZip(tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}, "")
+	if err != nil {
+		t.Fatalf("Unable to make test zip: %s", err.Error())
+	}
+	stg.storage[tile.TileCoord{Z: 1, X: 0, Y: 0, Format: "zip"}] = &storage.StorageResponse{
+		Response: &storage.SuccessfulResponse{Body: zipfile.Bytes()},
+	}
+
+	check := func(coord tile.TileCoord, policy string, expStatus int, expBody string) {
+		mw := &recordingMetricsWriter{}
+		options := MetatileOptions{TombstonePolicy: policy, TombstoneMaxAge: time.Hour}
+		h := MetatileHandlerWithOptions(&fakeParser{tile: coord}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, mw, &log.NilJsonLogger{}, cache.NilCache, options)
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", "/tile", nil))
+
+		if rw.Code != expStatus {
+			t.Fatalf("Expected %d response for %s with policy %s, but got %d", expStatus, coord.FileName(), policy, rw.Code)
+		}
+		if len(mw.metatileStates) != 1 || !mw.metatileStates[0].IsTombstone {
+			t.Fatalf("Expected %s to be recorded as a tombstone with policy %s", coord.FileName(), policy)
+		}
+		if cc := rw.Header().Get("Cache-Control"); cc != "public, max-age=3600" {
+			t.Fatalf("Expected long Cache-Control for tombstone, but got %#v", cc)
+		}
+		if expBody != "" && rw.Body.String() != expBody {
+			t.Fatalf("Expected blank tile %#v, but got %#v", expBody, rw.Body.String())
+		}
+	}
+
+	for _, coord := range []tile.TileCoord{theTile, deletedTile} {
+		check(coord, TombstonePolicy_NotFound, 404, "")
+		check(coord, TombstonePolicy_Blank, 200, `{"type":"FeatureCollection","features":[]}`)
+	}
+
+	// by default, an empty metatile is an invalid zip
+	rw := httptest.NewRecorder()
+	h := MetatileHandler(&fakeParser{tile: deletedTile}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, &metrics.NilMetricsWriter{}, &log.NilJsonLogger{}, cache.NilCache)
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/tile", nil))
+	if rw.Code != 500 {
+		t.Fatalf("Expected 500 for empty metatile when tombstones are ignored, but got %d", rw.Code)
+	}
+}
+
+// failingStorage fails every fetch, as during a storage outage.
+type failingStorage struct {
+	fakeStorage
+}
+
+func (f *failingStorage) Fetch(t tile.TileCoord, _ state.Condition, prefix string, _ map[string]string) (*storage.StorageResponse, error) {
+	return nil, errors.New("storage unavailable")
+}
+
+// staleCache is a cache which only has stale copies of tiles.
+type staleCache struct {
+	cache.Cache
+	tile     *state.VectorTileResponseData
+	metatile *state.MetatileResponseData
+}
+
+func (c *staleCache) GetStaleTile(ctx context.Context, req *state.ParseResult) (*state.VectorTileResponseData, error) {
+	return c.tile, nil
+}
+
+func (c *staleCache) GetStaleMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord) (*state.MetatileResponseData, error) {
+	return c.metatile, nil
+}
+
+func TestHandlerServeStale(t *testing.T) {
+	theTile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	zipfile, err := makeTestZip(theTile, "{\"stale\": true}")
+	if err != nil {
+		t.Fatalf("Unable to make test zip: %s", err.Error())
+	}
+
+	check := func(tileCache cache.Cache, serveStale bool, expStatus int) {
+		mw := &recordingMetricsWriter{}
+		options := MetatileOptions{ServeStale: serveStale}
+		h := MetatileHandlerWithOptions(&fakeParser{tile: theTile}, 1, 1, 0, &failingStorage{}, &buffer.OnDemandBufferManager{}, mw, &log.NilJsonLogger{}, tileCache, options)
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", "/tile", nil))
+
+		if rw.Code != expStatus {
+			t.Fatalf("Expected %d response with serve stale %t, but got %d", expStatus, serveStale, rw.Code)
+		}
+		isStale := expStatus == http.StatusOK
+		if len(mw.metatileStates) != 1 || mw.metatileStates[0].IsStale != isStale {
+			t.Fatalf("Expected tile to be recorded as stale only when served stale")
+		}
+		if isStale {
+			if rw.Header().Get("X-Cache") != "STALE" || !strings.HasPrefix(rw.Header().Get("Warning"), "110 ") {
+				t.Fatalf("Expected stale response headers, but got %#v", rw.Header())
+			}
+			if rw.Body.String() != "{\"stale\": true}" {
+				t.Fatalf("Expected stale tile body, but got %#v", rw.Body.String())
+			}
+		}
+	}
+
+	staleTile := &staleCache{Cache: cache.NilCache, tile: &state.VectorTileResponseData{ContentType: "application/json", Data: []byte("{\"stale\": true}")}}
+	staleMetatile := &staleCache{Cache: cache.NilCache, metatile: &state.MetatileResponseData{Data: zipfile.Bytes(), BodySize: int64(zipfile.Len())}}
+
+	check(staleTile, true, 200)
+	check(staleMetatile, true, 200)
+	check(staleTile, false, 500)
+	check(&staleCache{Cache: cache.NilCache}, true, 500)
+	check(cache.NilCache, true, 500)
+}
+
+// archivedStorage fails every fetch as the metatiles are in Glacier.
+type archivedStorage struct {
+	fakeStorage
+}
+
+func (a *archivedStorage) Fetch(t tile.TileCoord, _ state.Condition, prefix string, _ map[string]string) (*storage.StorageResponse, error) {
+	return nil, &storage.ArchivedError{Err: errors.New("InvalidObjectState")}
+}
+
+func TestHandlerArchivedPolicy(t *testing.T) {
+	theTile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	check := func(options MetatileOptions, expStatus int, expRetryAfter string) {
+		mw := &recordingMetricsWriter{}
+		h := MetatileHandlerWithOptions(&fakeParser{tile: theTile}, 1, 1, 0, &archivedStorage{}, &buffer.OnDemandBufferManager{}, mw, &log.NilJsonLogger{}, cache.NilCache, options)
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", "/tile", nil))
+		if rw.Code != expStatus {
+			t.Fatalf("Expected %d for an archived metatile under policy %#v, but got %d", expStatus, options.ArchivedPolicy, rw.Code)
+		}
+		if got := rw.Header().Get("Retry-After"); got != expRetryAfter {
+			t.Fatalf("Expected Retry-After %#v, but got %#v", expRetryAfter, got)
+		}
+		if len(mw.metatileStates) != 1 || mw.metatileStates[0].FetchState != state.FetchState_Archived {
+			t.Fatalf("Expected the fetch to be recorded as archived")
+		}
+	}
+
+	check(MetatileOptions{}, http.StatusServiceUnavailable, "")
+	check(MetatileOptions{ArchivedPolicy: ArchivedPolicy_Unavailable, ArchivedRetryAfter: time.Hour}, http.StatusServiceUnavailable, "3600")
+	check(MetatileOptions{ArchivedPolicy: ArchivedPolicy_NotFound, ArchivedRetryAfter: time.Hour}, http.StatusNotFound, "")
+}
+
+func TestDegradation(t *testing.T) {
+	d := NewDegradation(DegradationOptions{ErrorRate: 0.5, Window: 50 * time.Millisecond, MinFetches: 2}, &log.NilJsonLogger{})
+
+	// a window with too few fetches doesn't count
+	d.RecordFetch(true)
+	time.Sleep(60 * time.Millisecond)
+	d.RecordFetch(true)
+	if d.Active() {
+		t.Fatalf("Expected a window with too few fetches not to degrade")
+	}
+	d.RecordFetch(false)
+	time.Sleep(60 * time.Millisecond)
+	d.RecordFetch(false)
+	if !d.Active() {
+		t.Fatalf("Expected degraded mode at error rate %.2f", d.Status().ErrorRate)
+	}
+	d.RecordFetch(false)
+	time.Sleep(60 * time.Millisecond)
+	d.RecordFetch(false)
+	if d.Active() {
+		t.Fatalf("Expected to leave degraded mode once errors stop")
+	}
+
+	// switched on through the admin endpoint, invalid tiles are served
+	rec := httptest.NewRecorder()
+	DegradationHandler(d, &log.NilJsonLogger{}).ServeHTTP(rec, httptest.NewRequest("POST", "/admin/degradation?mode=on", nil))
+	if rec.Code != 200 || !d.Active() {
+		t.Fatalf("Expected degraded mode to be switched on, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	DegradationHandler(d, &log.NilJsonLogger{}).ServeHTTP(rec, httptest.NewRequest("POST", "/admin/degradation?mode=maybe", nil))
+	if rec.Code != 400 {
+		t.Fatalf("Expected 400 for an invalid mode, got %d", rec.Code)
+	}
+
+	theTile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "mvt"}
+	zipfile, err := makeTestZip(theTile, "{}")
+	if err != nil {
+		t.Fatalf("Unable to make test zip: %s", err.Error())
+	}
+	stg := &fakeStorage{storage: map[tile.TileCoord]*storage.StorageResponse{
+		{Z: 0, X: 0, Y: 0, Format: "zip"}: {Response: &storage.SuccessfulResponse{Body: zipfile.Bytes()}},
+	}}
+	mw := &recordingMetricsWriter{}
+	options := MetatileOptions{ValidateTiles: true, Degradation: d}
+	h := MetatileHandlerWithOptions(&fakeParser{tile: theTile}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, mw, &log.NilJsonLogger{}, cache.NilCache, options)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/tile", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Expected tile validation to be skipped when degraded, but got %d", rec.Code)
+	}
+	if len(mw.metatileStates) != 1 || !mw.metatileStates[0].IsDegraded {
+		t.Fatalf("Expected request to be recorded as degraded")
+	}
+}
+
+// ttlCache records the TTL tiles are cached for.
+type ttlCache struct {
+	cache.Cache
+	tileTTLs chan time.Duration
+}
+
+func (c *ttlCache) SetTile(ctx context.Context, req *state.ParseResult, resp *state.VectorTileResponseData, ttl time.Duration) error {
+	c.tileTTLs <- ttl
+	return nil
+}
+
+func TestHandlerCacheTTLs(t *testing.T) {
+	schedule := []ZoomTTL{
+		{MinZoom: 0, MaxZoom: 8, TTL: 7 * 24 * time.Hour},
+		{MinZoom: 9, MaxZoom: 14, TTL: 24 * time.Hour},
+	}
+
+	check := func(coord tile.TileCoord, expTTL time.Duration, expCacheControl string) {
+		zipfile, err := makeTestZip(tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}, "{}")
+		if err != nil {
+			t.Fatalf("Unable to make test zip: %s", err.Error())
+		}
+		metatile := coord
+		metatile.Format = "zip"
+		stg := &fakeStorage{storage: map[tile.TileCoord]*storage.StorageResponse{
+			metatile: {Response: &storage.SuccessfulResponse{Body: zipfile.Bytes()}},
+		}}
+		tileCache := &ttlCache{Cache: cache.NilCache, tileTTLs: make(chan time.Duration, 1)}
+		options := MetatileOptions{TTLSchedule: schedule}
+		h := MetatileHandlerWithOptions(&fakeParser{tile: coord}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, &metrics.NilMetricsWriter{}, &log.NilJsonLogger{}, tileCache, options)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/tile", nil))
+		if rec.Code != 200 {
+			t.Fatalf("Expected 200 for %s, but got %d", coord.FileName(), rec.Code)
+		}
+		if cc := rec.Header().Get("Cache-Control"); cc != expCacheControl {
+			t.Fatalf("Expected Cache-Control %#v for %s, but got %#v", expCacheControl, coord.FileName(), cc)
+		}
+		select {
+		case ttl := <-tileCache.tileTTLs:
+			if ttl != expTTL {
+				t.Fatalf("Expected %s to be cached for %s, but got %s", coord.FileName(), expTTL, ttl)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %s to be cached", coord.FileName())
+		}
+	}
+
+	check(tile.TileCoord{Z: 3, X: 1, Y: 1, Format: "json"}, 7*24*time.Hour, "public, max-age=604800")
+	check(tile.TileCoord{Z: 12, X: 1, Y: 1, Format: "json"}, 24*time.Hour, "public, max-age=86400")
+	check(tile.TileCoord{Z: 16, X: 1, Y: 1, Format: "json"}, cacheVectorTileTTL, "")
+}
+
+func TestJitterTTL(t *testing.T) {
+	if ttl := jitterTTL(time.Hour, 0); ttl != time.Hour {
+		t.Fatalf("Expected no jitter, got %s", ttl)
+	}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		ttl := jitterTTL(time.Hour, 0.1)
+		if ttl > time.Hour || ttl < 54*time.Minute {
+			t.Fatalf("Expected a TTL within 10%% under an hour, got %s", ttl)
+		}
+		seen[ttl] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("Expected jittered TTLs to vary")
+	}
+}
+
+func TestParserWrapX(t *testing.T) {
+	parse := func(wrapX bool, path string) (*state.ParseResult, error) {
+		parser := &MetatileMuxParser{MimeMap: map[string]string{"mvt": "application/x-protobuf"}, WrapX: wrapX}
+		var result *state.ParseResult
+		var err error
+		r := mux.NewRouter()
+		r.HandleFunc("/osm/{z:[0-9]+}/{x:-?[0-9]+}/{y:[0-9]+}.{fmt}", func(rw http.ResponseWriter, req *http.Request) {
+			result, err = parser.Parse(req)
+		})
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		return result, err
+	}
+
+	if _, err := parse(false, "/osm/2/-1/1.mvt"); err == nil {
+		t.Fatalf("Expected wrapped coordinate to be rejected by default")
+	}
+	for path, expected := range map[string]tile.TileCoord{
+		"/osm/2/-1/1.mvt": {Z: 2, X: 3, Y: 1, Format: "mvt"},
+		"/osm/2/5/1.mvt":  {Z: 2, X: 1, Y: 1, Format: "mvt"},
+	} {
+		result, err := parse(true, path)
+		if err != nil {
+			t.Fatalf("Unable to parse %s: %s", path, err.Error())
+		}
+		if coord := result.AdditionalData.(*state.MetatileParseData).Coord; coord != expected {
+			t.Fatalf("Expected %s to wrap to %s, but got %s", path, expected.FileName(), coord.FileName())
+		}
+	}
+	if _, err := parse(true, "/osm/2/1/5.mvt"); err == nil {
+		t.Fatalf("Expected out of range y to still be rejected")
+	}
+}
+
+func TestParserKeyPathVariables(t *testing.T) {
+	parser := &MetatileMuxParser{MimeMap: map[string]string{"mvt": "application/x-protobuf"}, KeyPathVariables: []string{"lang"}}
+	var result *state.ParseResult
+	var err error
+	r := mux.NewRouter()
+	r.HandleFunc("/tiles/{lang:[a-z]{2}}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", func(rw http.ResponseWriter, req *http.Request) {
+		result, err = parser.Parse(req)
+	})
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/tiles/fr/0/0/0.mvt", nil))
+	if err != nil {
+		t.Fatalf("Unable to parse request: %s", err.Error())
+	}
+	if result.KeyVariables["lang"] != "fr" {
+		t.Fatalf("Expected lang path variable to be a key variable, got %#v", result.KeyVariables)
+	}
+}
+
+func TestParserKeyHeaderVariables(t *testing.T) {
+	parser := &MetatileMuxParser{
+		MimeMap: map[string]string{"mvt": "application/x-protobuf"},
+		KeyHeaderVariables: map[string]*KeyHeaderVariable{
+			"date": {Header: "X-Build-Date", Pattern: regexp.MustCompile(`^[0-9]{8}$`)},
+		},
+	}
+	parse := func(date string) (*state.ParseResult, error) {
+		var result *state.ParseResult
+		var err error
+		r := mux.NewRouter()
+		r.HandleFunc("/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", func(rw http.ResponseWriter, req *http.Request) {
+			result, err = parser.Parse(req)
+		})
+		req := httptest.NewRequest("GET", "/0/0/0.mvt", nil)
+		if date != "" {
+			req.Header.Set("X-Build-Date", date)
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		return result, err
+	}
+
+	result, err := parse("20210331")
+	if err != nil {
+		t.Fatalf("Unable to parse request: %s", err.Error())
+	}
+	if result.KeyVariables["date"] != "20210331" {
+		t.Fatalf("Expected the header to be a key variable, got %#v", result.KeyVariables)
+	}
+	if len(result.KeyHeaders) != 1 || result.KeyHeaders[0] != "X-Build-Date" {
+		t.Fatalf("Expected the header to be recorded, got %v", result.KeyHeaders)
+	}
+
+	result, err = parse("")
+	if err != nil || result.KeyVariables != nil || len(result.KeyHeaders) != 1 {
+		t.Fatalf("Expected no key variables without the header, but still the header recorded, got %#v, %v", result, err)
+	}
+
+	if _, err = parse("../etc"); err == nil {
+		t.Fatalf("Expected a value not matching the pattern to fail")
+	}
+}
+
+func TestParserUnknownFormat(t *testing.T) {
+	parse := func(unknownFormatContentType string) (*state.ParseResult, error) {
+		parser := &MetatileMuxParser{MimeMap: map[string]string{"mvt": "application/x-protobuf"}, UnknownFormatContentType: unknownFormatContentType}
+		var result *state.ParseResult
+		var err error
+		r := mux.NewRouter()
+		r.HandleFunc("/osm/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}", func(rw http.ResponseWriter, req *http.Request) {
+			result, err = parser.Parse(req)
+		})
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/osm/0/0/0.pbf", nil))
+		return result, err
+	}
+
+	_, err := parse("")
+	if pe, ok := err.(*ParseError); !ok || pe.MimeError == nil {
+		t.Fatalf("Expected a mime parse error by default, got %#v", err)
+	}
+
+	result, err := parse("application/octet-stream")
+	if err != nil {
+		t.Fatalf("Unable to parse unknown format: %s", err.Error())
+	}
+	if result.ContentType != "application/octet-stream" {
+		t.Fatalf("Expected fallback content type, got %#v", result.ContentType)
+	}
+	metatileData := result.AdditionalData.(*state.MetatileParseData)
+	if !metatileData.IsUnknownFormat || metatileData.Coord.Format != "pbf" {
+		t.Fatalf("Expected unknown pbf format, got %#v", metatileData)
+	}
+}
+
+func TestParserCaptureHeaders(t *testing.T) {
+	parser := &TileJsonParser{CaptureHeaders: []string{"x-client-version", "CloudFront-Viewer-Country"}}
+	req := httptest.NewRequest("GET", "/tilejson/mapbox.json", nil)
+	req.Header.Set("X-Client-Version", "1.2.3")
+	result, err := parser.Parse(mux.SetURLVars(req, map[string]string{"fmt": "mapbox"}))
+	if err != nil {
+		t.Fatalf("Unable to parse request: %s", err.Error())
+	}
+	headers := result.HttpData.Headers
+	if len(headers) != 1 || headers["X-Client-Version"] != "1.2.3" {
+		t.Fatalf("Expected only the present header to be captured, got %#v", headers)
+	}
+
+	reqState := &state.TileJsonRequestState{HttpData: result.HttpData}
+	logged := reqState.AsJsonMap()["http"].(map[string]interface{})["headers"]
+	if !reflect.DeepEqual(logged, headers) {
+		t.Fatalf("Expected captured headers to be logged, got %#v", logged)
+	}
+}
+
+type purgeCache struct {
+	cache.Cache
+	purged []string
+}
+
+func (p *purgeCache) Purge(ctx context.Context, buildID string) (int, error) {
+	p.purged = append(p.purged, buildID)
+	return 1, nil
+}
+
+func TestBuildWebhookHandler(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+	writeManifest := func(buildID string) {
+		manifest := fmt.Sprintf(`{"builds": [{"build_id": "%s", "created": "2023-08-01T10:00:00Z"}]}`, buildID)
+		if err := ioutil.WriteFile(filepath.Join(baseDir, "manifest.json"), []byte(manifest), 0644); err != nil {
+			t.Fatalf("Unable to write manifest: %s", err.Error())
+		}
+	}
+	writeManifest("20230801")
+	manifest := storage.NewBuildManifestSource(storage.NewFileStorage(baseDir, "", ""), "manifest.json", time.Hour)
+	if buildID, _, _ := manifest.AsOf(time.Now()); buildID != "20230801" {
+		t.Fatalf("Expected first build from manifest, got %#v", buildID)
+	}
+
+	tileCache := &purgeCache{Cache: cache.NilCache}
+	warmed := make(chan string, 1)
+	options := BuildWebhookOptions{
+		Token:     "sekrit",
+		Manifests: []*storage.BuildManifestSource{manifest},
+		Cache:     tileCache,
+		WarmPaths: []string{"/osm/0/0/0.mvt"},
+		Warmer: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			warmed <- req.URL.Path
+		}),
+	}
+	h := BuildWebhookHandler(options, &log.NilJsonLogger{})
+
+	for token, expected := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusForbidden} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/admin/builds", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		h.ServeHTTP(rec, req)
+		if rec.Code != expected {
+			t.Fatalf("Expected %d response for token %#v, but got %d", expected, token, rec.Code)
+		}
+	}
+
+	writeManifest("20230901")
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/admin/builds", strings.NewReader(`{"build_id": "20230901"}`))
+	req.Header.Set("Authorization", "Bearer sekrit")
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected 200 OK response, but got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if buildID, _, _ := manifest.AsOf(time.Now()); buildID != "20230901" {
+		t.Fatalf("Expected manifest to be refreshed, got build %#v", buildID)
+	}
+	if !reflect.DeepEqual(tileCache.purged, []string{"", "20230901"}) {
+		t.Fatalf("Expected default and new build to be purged, got %#v", tileCache.purged)
+	}
+	select {
+	case path := <-warmed:
+		if path != "/osm/0/0/0.mvt" {
+			t.Fatalf("Expected /osm/0/0/0.mvt to be warmed, got %s", path)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected warm path to be requested")
+	}
+}
+
+func TestHandlerDeadlineExceeded(t *testing.T) {
+	theTile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+	mw := &recordingMetricsWriter{}
+	degradation := NewDegradation(DegradationOptions{ErrorRate: 0.5, Window: time.Minute, MinFetches: 1}, &log.NilJsonLogger{})
+	options := MetatileOptions{Degradation: degradation}
+	h := MetatileHandlerWithOptions(&fakeParser{tile: theTile}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, mw, &log.NilJsonLogger{}, cache.NilCache, options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/tile", nil).WithContext(ctx))
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected 504 response once the deadline passed, got %d", rec.Code)
+	}
+	if len(mw.metatileStates) != 1 || !mw.metatileStates[0].IsDeadlineExceeded {
+		t.Fatalf("Expected the exceeded deadline to be recorded")
+	}
+	if degradation.fetches != 0 {
+		t.Fatalf("Expected an abandoned fetch not to count towards the storage error rate")
+	}
+}
+
+func TestHandlerMalformedBan(t *testing.T) {
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+	mw := &recordingMetricsWriter{}
+	banList := NewBanList(3, time.Minute, time.Minute)
+	parser := &MetatileMuxParser{MimeMap: map[string]string{"mvt": "application/x-protobuf"}, MaxURLLength: 40}
+	options := MetatileOptions{BanList: banList}
+	r := mux.NewRouter()
+	r.Handle("/osm/{z}/{x}/{y}.{fmt}", banList.Handler(MetatileHandlerWithOptions(parser, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, mw, &log.NilJsonLogger{}, cache.NilCache, options)))
+
+	request := func(path, remoteAddr string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, tc := range []struct {
+		path      string
+		malformed string
+	}{
+		{"/osm/0/0/0.php", state.Malformed_Format},
+		{"/osm/0/9/0.mvt", state.Malformed_Coord},
+		{"/osm/0/0/0.mvt?junk=" + strings.Repeat("x", 40), state.Malformed_Query},
+	} {
+		mw.metatileStates = nil
+		request(tc.path, "192.0.2.1:1234")
+		if len(mw.metatileStates) != 1 || mw.metatileStates[0].Malformed != tc.malformed {
+			t.Fatalf("Expected %s to be malformed %s", tc.path, tc.malformed)
+		}
+	}
+
+	if code := request("/osm/0/0/0.mvt", "192.0.2.1:1234"); code != http.StatusForbidden {
+		t.Fatalf("Expected the client to be banned after malformed requests, got %d", code)
+	}
+	if code := request("/osm/0/0/0.mvt", "192.0.2.2:1234"); code != http.StatusNotFound {
+		t.Fatalf("Expected other clients not to be banned, got %d", code)
+	}
+	if banList.Len() != 1 {
+		t.Fatalf("Expected 1 banned client, got %d", banList.Len())
+	}
+}
+
+func TestHandlerFormatFallbacks(t *testing.T) {
+	requested := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	metatile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	// a vector tile with an empty water layer
+	mvt := []byte{0x1a, 0x07, 0x0a, 0x05, 'w', 'a', 't', 'e', 'r'}
+
+	serve := func(entry tile.TileCoord, content string, options MetatileOptions) (*httptest.ResponseRecorder, *state.RequestState) {
+		zipfile, err := makeTestZip(entry, content)
+		if err != nil {
+			t.Fatalf("Unable to make test zip: %s", err.Error())
+		}
+		stg := &fakeStorage{storage: map[tile.TileCoord]*storage.StorageResponse{
+			metatile: {Response: &storage.SuccessfulResponse{Body: zipfile.Bytes()}},
+		}}
+		mw := &recordingMetricsWriter{}
+		h := MetatileHandlerWithOptions(&fakeParser{tile: requested}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, mw, &log.NilJsonLogger{}, cache.NilCache, options)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/tile", nil))
+		return rec, mw.metatileStates[0]
+	}
+
+	fallbacks := map[string][]string{"json": {"geojson", "mvt"}}
+	geojson := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "geojson"}
+	rec, reqState := serve(geojson, `{"a": 1}`, MetatileOptions{FormatFallbacks: fallbacks})
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"a": 1}` || reqState.FormatFallback != "geojson" {
+		t.Fatalf("Expected the geojson entry to be served, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	mvtEntry := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "mvt"}
+	rec, _ = serve(mvtEntry, string(mvt), MetatileOptions{FormatFallbacks: fallbacks})
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 without transcoding, got %d", rec.Code)
+	}
+
+	rec, reqState = serve(mvtEntry, string(mvt), MetatileOptions{FormatFallbacks: fallbacks, Transcode: true})
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"water":{"type":"FeatureCollection","features":[]}}` {
+		t.Fatalf("Expected the mvt entry to be transcoded, got %d %s", rec.Code, rec.Body.String())
+	}
+	if !reqState.IsTranscoded || reqState.FormatFallback != "mvt" || reqState.IsZipError {
+		t.Fatalf("Expected the transcoded fallback to be recorded, got %#v", reqState)
+	}
+
+	// transcoding is skipped while degraded
+	degradation := NewDegradation(DegradationOptions{}, &log.NilJsonLogger{})
+	degradation.SetMode(DegradationMode_On)
+	rec, reqState = serve(mvtEntry, string(mvt), MetatileOptions{FormatFallbacks: fallbacks, Transcode: true, Degradation: degradation})
+	if rec.Code != http.StatusNotFound || reqState.IsTranscoded {
+		t.Fatalf("Expected 404 without transcoding while degraded, got %d", rec.Code)
+	}
+}
+
+func TestWatchdogAbandonsStuckCacheSets(t *testing.T) {
+	wd := &Watchdog{Stall: time.Minute, MetricsWriter: &metrics.NilMetricsWriter{}, Logger: &log.NilJsonLogger{}}
+
+	// don't count the cache sets of other tests
+	AbandonCacheSets()
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	goCacheSet(func() { <-unblock })
+	if stalled := wd.Check(); len(stalled) != 0 {
+		t.Fatalf("Expected a recent cache set not to be stalled, got %#v", stalled)
+	}
+
+	// pretend the cache set has been stuck for longer than allowed
+	cacheSets.Lock()
+	cacheSets.lastProgress = time.Now().Add(-2 * time.Minute)
+	cacheSets.Unlock()
+
+	stalled := wd.Check()
+	if len(stalled) != 1 || stalled[0].Worker != "cache-set" || stalled[0].Pending != 1 || stalled[0].Stalled < 2*time.Minute {
+		t.Fatalf("Expected the stuck cache set to be found, got %#v", stalled)
+	}
+	if pending := PendingCacheSets(); pending != 0 {
+		t.Fatalf("Expected the stuck cache set to be abandoned, got %d pending", pending)
+	}
+}
+
+func TestHandlerContentHash(t *testing.T) {
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	zipfile, err := makeTestZip(coord, `{"a": 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stg := &fakeStorage{storage: map[tile.TileCoord]*storage.StorageResponse{
+		{Z: 0, X: 0, Y: 0, Format: "zip"}: {Response: &storage.SuccessfulResponse{Body: zipfile.Bytes()}},
+	}}
+	parser := &MetatileMuxParser{MimeMap: map[string]string{"json": "application/json"}}
+	h := MetatileHandlerWithOptions(parser, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, &metrics.NilMetricsWriter{}, &log.NilJsonLogger{}, cache.NilCache, MetatileOptions{ContentHashes: true})
+	r := mux.NewRouter()
+	r.Handle("/tiles/{z}/{x}/{y}.{fmt}", h)
+	r.Handle("/tiles/{hash}/{z}/{x}/{y}.{fmt}", h)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/tiles/0/0/0.json", nil))
+	hash := rec.Header().Get(contentHashHeader)
+	if rec.Code != http.StatusOK || !validContentHash.MatchString(hash) {
+		t.Fatalf("Expected the tile with its content hash, got %d %q", rec.Code, hash)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/tiles/"+hash+"/0/0/0.json", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"a": 1}` {
+		t.Fatalf("Expected the tile to be served by its hash, got %d %s", rec.Code, rec.Body.String())
+	}
+	if cc := rec.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Fatalf("Expected the tile to be immutable, got Cache-Control %q", cc)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/tiles/"+strings.Repeat("0", 32)+"/0/0/0.json", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for another tile's hash, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/tiles/nothex/0/0/0.json", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a malformed hash, got %d", rec.Code)
+	}
+}
+
+func TestHandlerSkipNotFoundLogs(t *testing.T) {
+	var jsonLog bytes.Buffer
+	logger := log.NewJsonLogger(golog.New(&jsonLog, "", 0), "test")
+	mw := &recordingMetricsWriter{}
+	stg := &fakeStorage{storage: make(map[tile.TileCoord]*storage.StorageResponse)}
+	requested := tile.TileCoord{Z: 16, X: 0, Y: 0, Format: "mvt"}
+	h := MetatileHandlerWithOptions(&fakeParser{tile: requested}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, mw, logger, cache.NilCache, MetatileOptions{SkipNotFoundLogs: 1})
+	h = log.LoggingMiddleware(logger)(h)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/tile", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404, got %d", rec.Code)
+	}
+	if jsonLog.Len() != 0 {
+		t.Fatalf("Expected the not found response not to be logged, got %#v", jsonLog.String())
+	}
+	if len(mw.metatileStates) != 1 || mw.metatileStates[0].ResponseState != state.ResponseState_NotFound {
+		t.Fatalf("Expected the not found response to be counted")
+	}
+}
+
+func TestTileTracker(t *testing.T) {
+	tt := NewTileTracker(2)
+	hot := tile.TileCoord{Z: 10, X: 163, Y: 395, Format: "mvt"}
+	warm := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "mvt"}
+	for i := 0; i < 10; i++ {
+		tt.Record(hot)
+	}
+	for i := 0; i < 5; i++ {
+		tt.Record(warm)
+	}
+	for x := 0; x < 100; x++ {
+		tt.Record(tile.TileCoord{Z: 16, X: x, Y: 0, Format: "mvt"})
+	}
+
+	result := tt.Hot()
+	if result.Requests != 115 || len(result.Tiles) != 2 {
+		t.Fatalf("Expected 2 tiles of 115 requests, got %#v", result)
+	}
+	if result.Tiles[0].Tile != "10/163/395.mvt" || result.Tiles[0].Count < 10 || result.Tiles[1].Tile != "0/0/0.mvt" {
+		t.Fatalf("Expected the hot tile then the warm tile, got %#v", result.Tiles)
+	}
+
+	h := HotTilesHandler(map[string]*TileTracker{"/osm/{z}/{x}/{y}.{fmt}": tt}, &log.NilJsonLogger{})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/hot?limit=1", nil))
+	var body map[string]*HotTiles
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if hot := body["/osm/{z}/{x}/{y}.{fmt}"]; hot == nil || len(hot.Tiles) != 1 || hot.Tiles[0].Tile != "10/163/395.mvt" {
+		t.Fatalf("Expected the hottest tile, got %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/hot?pattern=/other", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown pattern, got %d", rec.Code)
+	}
+}
+
+// rangedStorage responds to FetchRanges with the metatile as a reader, in
+// place of its body.
+type rangedStorage struct {
+	fakeStorage
+}
+
+func (r *rangedStorage) FetchRanges(ctx context.Context, t tile.TileCoord, c state.Condition, prefix string, keyVars map[string]string) (*storage.StorageResponse, error) {
+	resp, _ := r.Fetch(t, c, prefix, keyVars)
+	if resp.Response == nil {
+		return resp, nil
+	}
+	body := resp.Response.Body
+	return &storage.StorageResponse{Response: &storage.SuccessfulResponse{
+		Size:   uint64(len(body)),
+		Ranges: bytes.NewReader(body),
+	}}, nil
+}
+
+type metatileSetCache struct {
+	cache.Cache
+	metatileSets int32
+}
+
+func (c *metatileSetCache) SetMetatile(ctx context.Context, req *state.ParseResult, metaCoord tile.TileCoord, resp *state.MetatileResponseData, ttl time.Duration) error {
+	atomic.AddInt32(&c.metatileSets, 1)
+	return nil
+}
+
+func TestHandlerRangedReads(t *testing.T) {
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	zipfile, err := makeTestZip(coord, `{"ranged": true}`)
+	if err != nil {
+		t.Fatalf("Unable to make test zip: %s", err.Error())
+	}
+	stg := &rangedStorage{fakeStorage{storage: map[tile.TileCoord]*storage.StorageResponse{
+		{Z: 0, X: 0, Y: 0, Format: "zip"}: {Response: &storage.SuccessfulResponse{Body: zipfile.Bytes()}},
+	}}}
+	tileCache := &metatileSetCache{Cache: cache.NilCache}
+	h := MetatileHandlerWithOptions(&fakeParser{tile: coord}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, &metrics.NilMetricsWriter{}, &log.NilJsonLogger{}, tileCache, MetatileOptions{RangedReads: true})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/tile", nil))
+	if rec.Code != 200 || rec.Body.String() != `{"ranged": true}` {
+		t.Fatalf("Expected the tile read from the ranges, got %d %#v", rec.Code, rec.Body.String())
+	}
+	for deadline := time.Now().Add(time.Second); PendingCacheSets() > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if sets := atomic.LoadInt32(&tileCache.metatileSets); sets != 0 {
+		t.Fatalf("Expected a metatile read in ranges not to be cached, got %d sets", sets)
+	}
+}
+
+// checkedStorage counts its healthchecks, failing them with err.
+type checkedStorage struct {
+	fakeStorage
+	checks int
+	err    error
+}
+
+func (c *checkedStorage) HealthCheck() error {
+	c.checks++
+	return c.err
+}
+
+func TestHealthCheckInterval(t *testing.T) {
+	stg := &checkedStorage{}
+	h := HealthCheckHandlerWithOptions([]storage.Storage{stg}, cache.NilCache, &log.NilJsonLogger{}, HealthCheckOptions{Interval: time.Hour})
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected a healthy response, got %d", rec.Code)
+		}
+	}
+	if stg.checks != 1 {
+		t.Fatalf("Expected the storage to be checked once within the interval, but was checked %d times", stg.checks)
+	}
+
+	// without an interval, every probe checks the storage
+	stg.err = errors.New("storage down")
+	rec := httptest.NewRecorder()
+	HealthCheckHandler([]storage.Storage{stg}, cache.NilCache, &log.NilJsonLogger{}).ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusInternalServerError || stg.checks != 2 {
+		t.Fatalf("Expected an unhealthy response from a fresh check, got %d after %d checks", rec.Code, stg.checks)
+	}
+}
+
+// slowStorage's healthcheck takes until release is closed, counting the
+// checks started.
+type slowStorage struct {
+	fakeStorage
+	release chan struct{}
+	checks  int32
+}
+
+func (s *slowStorage) HealthCheck() error {
+	atomic.AddInt32(&s.checks, 1)
+	<-s.release
+	return nil
+}
+
+// namedCheckedStorage is a checkedStorage with the name of its definition.
+type namedCheckedStorage struct {
+	checkedStorage
+	name string
+}
+
+func (n *namedCheckedStorage) Name() string {
+	return n.name
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	slow := &slowStorage{release: make(chan struct{})}
+	failing := &namedCheckedStorage{checkedStorage: checkedStorage{err: errors.New("storage down")}, name: "failing"}
+	healthy := &namedCheckedStorage{name: "healthy"}
+	// the same definition used for two patterns
+	shared := &namedCheckedStorage{name: "healthy"}
+	h := HealthCheckHandlerWithOptions([]storage.Storage{slow, failing, healthy, shared}, cache.NilCache, &log.NilJsonLogger{}, HealthCheckOptions{Timeout: 10 * time.Millisecond})
+
+	probe := func() (int, string, map[string]string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+		var body struct {
+			Storage  string
+			Storages map[string]string
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Unable to parse the healthcheck response: %s", err.Error())
+		}
+		return rec.Code, body.Storage, body.Storages
+	}
+
+	code, first, storages := probe()
+	if code != http.StatusInternalServerError {
+		t.Fatalf("Expected an unhealthy response, got %d", code)
+	}
+	if !strings.Contains(first, "timed out") {
+		t.Fatalf("Expected the first failure to be the timeout, got %#v", first)
+	}
+	if len(storages) != 4 || !strings.Contains(storages["storage0"], "timed out") || storages["failing"] != "storage down" || storages["healthy#2"] != "ok" || storages["healthy#3"] != "ok" {
+		t.Fatalf("Unexpected storage results: %#v", storages)
+	}
+
+	// later probes wait for the hung check rather than starting another
+	if code, _, storages = probe(); !strings.Contains(storages["storage0"], "timed out") {
+		t.Fatalf("Expected the slow storage to time out again, got %d %#v", code, storages)
+	}
+	if checks := atomic.LoadInt32(&slow.checks); checks != 1 {
+		t.Fatalf("Expected one check of the hung storage, got %d", checks)
+	}
+
+	// once it finishes, its result is used, and the next probe checks again
+	close(slow.release)
+	if _, _, storages = probe(); storages["storage0"] != "ok" {
+		t.Fatalf("Expected the finished check's result, got %#v", storages)
+	}
+	if _, _, storages = probe(); storages["storage0"] != "ok" || atomic.LoadInt32(&slow.checks) != 2 {
+		t.Fatalf("Expected a fresh check, got %#v after %d checks", storages, atomic.LoadInt32(&slow.checks))
+	}
+}
+
+// conditionalParser is a fakeParser which takes the request's If-None-Match
+// as the condition.
+type conditionalParser struct {
+	fakeParser
+}
+
+func (c *conditionalParser) Parse(req *http.Request) (*state.ParseResult, error) {
+	result, err := c.fakeParser.Parse(req)
+	if etag := req.Header.Get("If-None-Match"); etag != "" {
+		result.Cond.IfNoneMatch = &etag
+	}
+	return result, err
+}
+
+// conditionalStorage responds not modified when the condition matches the
+// metatile's ETag.
+type conditionalStorage struct {
+	fakeStorage
+}
+
+func (c *conditionalStorage) Fetch(t tile.TileCoord, cond state.Condition, prefix string, keyVars map[string]string) (*storage.StorageResponse, error) {
+	resp, err := c.fakeStorage.Fetch(t, cond, prefix, keyVars)
+	if resp.Response != nil && cond.IfNoneMatch != nil && *cond.IfNoneMatch == *resp.Response.ETag {
+		return &storage.StorageResponse{NotModified: true}, nil
+	}
+	return resp, err
+}
+
+func TestHandlerConditionalNotCached(t *testing.T) {
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	zipfile, err := makeTestZip(coord, "{}")
+	if err != nil {
+		t.Fatalf("Unable to make test zip: %s", err.Error())
+	}
+	etag := `"1234"`
+	stg := &conditionalStorage{fakeStorage{storage: map[tile.TileCoord]*storage.StorageResponse{
+		{Z: 0, X: 0, Y: 0, Format: "zip"}: {Response: &storage.SuccessfulResponse{Body: zipfile.Bytes(), ETag: &etag}},
+	}}}
+
+	dir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	tileCache, err := cache.NewDiskCache(cache.NilCache, cache.DiskCacheOptions{Dir: dir, MaxBytes: 1048576})
+	if err != nil {
+		t.Fatalf("Unable to create disk cache: %s", err.Error())
+	}
+	h := MetatileHandler(&conditionalParser{fakeParser{tile: coord}}, 1, 1, 0, stg, &buffer.OnDemandBufferManager{}, &metrics.NilMetricsWriter{}, &log.NilJsonLogger{}, tileCache)
+
+	req := httptest.NewRequest("GET", "/tile", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("Expected a conditional request to be not modified, got %d", rec.Code)
+	}
+	for deadline := time.Now().Add(time.Second); PendingCacheSets() > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the not modified response isn't served to other clients from the cache
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/tile", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "{}" {
+		t.Fatalf("Expected an unconditional request to get the tile, got %d %#v", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+)
+
+// contentHashHeader gives the hash of a tile's content, for clients to make
+// content-addressed URLs of it.
+const contentHashHeader = "X-Tile-Hash"
+
+// validContentHash matches the hashes made by contentHash.
+var validContentHash = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// contentHash returns the hash identifying a tile's content, which is the
+// first half of the sha256 of its uncompressed bytes in hex.
+func contentHash(vectorData *state.VectorTileResponseData) (string, error) {
+	if vectorData.ContentEncoding == encodingGzip {
+		var err error
+		vectorData, err = gunzipVariant(vectorData)
+		if err != nil {
+			return "", err
+		}
+	}
+	sum := sha256.Sum256(vectorData.Data)
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// immutableMaxAge is the Cache-Control max-age of content-addressed tiles,
+// which can be cached for as long as clients like.
+const immutableMaxAge = 365 * 24 * 60 * 60
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// ETagStyle_Preserve leaves the weakness of ETags as the storage set it.
+	ETagStyle_Preserve = "preserve"
+	// ETagStyle_Strong removes any weak prefix from ETags.
+	ETagStyle_Strong = "strong"
+	// ETagStyle_Weak marks all ETags as weak, eg. because the CDN may
+	// compress responses differently from the origin.
+	ETagStyle_Weak = "weak"
+	// ETagStyle_Encoding preserves the weakness of ETags, but adds the
+	// content encoding to those of compressed responses, eg. "abc-gzip", so
+	// that each representation has its own validator. The encoding is
+	// removed again from the If-None-Match header of requests.
+	ETagStyle_Encoding = "encoding"
+)
+
+// HeaderOptions configures NormalizeHeaders. The zero value only makes the
+// quoting of ETags and the Vary header consistent.
+type HeaderOptions struct {
+	// Vary lists request headers to add to the Vary header of every response.
+	Vary []string
+	// ETagStyle is one of the ETagStyle_ constants, default preserve.
+	ETagStyle string
+	// StripErrorValidators removes ETag and Last-Modified from error
+	// responses, so that caches don't revalidate errors as if they were tiles.
+	StripErrorValidators bool
+}
+
+// normalizeETag quotes the entity tag if it isn't already, and applies the
+// weakness style.
+func normalizeETag(etag, style string) string {
+	etag = strings.TrimSpace(etag)
+	weak := strings.HasPrefix(etag, "W/")
+	opaque := strings.TrimPrefix(etag, "W/")
+	if len(opaque) < 2 || opaque[0] != '"' || opaque[len(opaque)-1] != '"' {
+		opaque = `"` + strings.Trim(opaque, `"`) + `"`
+	}
+
+	switch style {
+	case ETagStyle_Strong:
+		weak = false
+	case ETagStyle_Weak:
+		weak = true
+	}
+	if weak {
+		return "W/" + opaque
+	}
+	return opaque
+}
+
+// encodingETag adds the content encoding to the quoted entity tag.
+func encodingETag(etag, encoding string) string {
+	return etag[:len(etag)-1] + "-" + encoding + `"`
+}
+
+// stripEncodingETags removes the content encodings added by encodingETag
+// from each entity tag in an If-None-Match header value.
+func stripEncodingETags(ifNoneMatch string) string {
+	suffix := "-" + encodingGzip + `"`
+	parts := strings.Split(ifNoneMatch, ",")
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if strings.HasSuffix(part, suffix) {
+			part = part[:len(part)-len(suffix)] + `"`
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, ", ")
+}
+
+// mergeVary combines the values of all Vary headers with the extra names,
+// dropping duplicates, which handlers and middleware can each add.
+func mergeVary(values []string, extra []string) string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		name = strings.TrimSpace(name)
+		key := strings.ToLower(name)
+		if name == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+		names = append(names, name)
+	}
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			add(name)
+		}
+	}
+	for _, name := range extra {
+		add(name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (options *HeaderOptions) apply(headers http.Header, status int) {
+	if vary := mergeVary(headers.Values("Vary"), options.Vary); vary != "" {
+		headers.Set("Vary", vary)
+	}
+
+	if options.StripErrorValidators && status >= http.StatusBadRequest {
+		headers.Del("ETag")
+		headers.Del("Last-Modified")
+		return
+	}
+
+	if etag := headers.Get("ETag"); etag != "" {
+		etag = normalizeETag(etag, options.ETagStyle)
+		if encoding := headers.Get("Content-Encoding"); options.ETagStyle == ETagStyle_Encoding && encoding != "" && encoding != "identity" {
+			etag = encodingETag(etag, encoding)
+		}
+		headers.Set("ETag", etag)
+	}
+}
+
+type headerNormalizingWriter struct {
+	http.ResponseWriter
+	options     *HeaderOptions
+	wroteHeader bool
+}
+
+func (w *headerNormalizingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.options.apply(w.Header(), status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerNormalizingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerNormalizingWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// NormalizeHeaders post-processes the headers of every response from h just
+// before they are sent, so that caches see consistent Vary and validator
+// headers however the response was produced.
+func NormalizeHeaders(h http.Handler, options HeaderOptions) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if ifNoneMatch := req.Header.Get("If-None-Match"); options.ETagStyle == ETagStyle_Encoding && ifNoneMatch != "" {
+			req = req.Clone(req.Context())
+			req.Header.Set("If-None-Match", stripEncodingETags(ifNoneMatch))
+		}
+		h.ServeHTTP(&headerNormalizingWriter{ResponseWriter: rw, options: &options}, req)
+	})
+}
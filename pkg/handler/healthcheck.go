@@ -1,31 +1,199 @@
 package handler
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/tilezen/tapalcatl/pkg/cache"
 	"github.com/tilezen/tapalcatl/pkg/log"
 	"github.com/tilezen/tapalcatl/pkg/storage"
 )
 
-func HealthCheckHandler(storages []storage.Storage, logger log.JsonLogger) http.Handler {
+// cacheHealthCheckTimeout is the amount of time to wait for the cache to respond to a healthcheck.
+const cacheHealthCheckTimeout = 1 * time.Second
+
+// CheckCacheHealth runs the cache healthcheck with a timeout.
+func CheckCacheHealth(ctx context.Context, tileCache cache.Cache) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, cacheHealthCheckTimeout)
+	defer cancel()
+	return tileCache.HealthCheck(timeoutCtx)
+}
+
+// HealthCheckOptions holds the optional settings of a HealthCheckHandler.
+// The zero value gives the default behaviour.
+type HealthCheckOptions struct {
+	// Interval, if positive, reuses the result of the storage checks for
+	// this long, so that frequent load balancer probes don't each make
+	// requests to the storages. Probes while a check is running wait for it.
+	Interval time.Duration
+	// Timeout, if positive, fails the check of a storage which hasn't
+	// answered within it, so that one slow storage doesn't time out the
+	// load balancer's probe. Later probes wait for a check which timed out
+	// to finish, rather than starting another.
+	Timeout time.Duration
+}
+
+// namedStorage is a storage which can report the name of its definition.
+type namedStorage interface {
+	Name() string
+}
+
+// storageNames returns the names to report the health of the storages
+// under. Names shared by several storages, eg. a definition used for
+// several patterns, are suffixed with the storage's index to tell them
+// apart.
+func storageNames(storages []storage.Storage) []string {
+	names := make([]string, len(storages))
+	counts := make(map[string]int, len(storages))
+	for i, s := range storages {
+		names[i] = fmt.Sprintf("storage%d", i)
+		if named, ok := s.(namedStorage); ok {
+			names[i] = named.Name()
+		}
+		counts[names[i]]++
+	}
+	for i, name := range names {
+		if counts[name] > 1 {
+			names[i] = fmt.Sprintf("%s#%d", name, i)
+		}
+	}
+	return names
+}
+
+// storageHealth checks the storages, reusing the last result within the
+// interval.
+type storageHealth struct {
+	storages []storage.Storage
+	names    []string
+	interval time.Duration
+	timeout  time.Duration
+	logger   log.JsonLogger
+
+	mu sync.Mutex
+	// running holds the result of each storage's check which timed out
+	// and is still running, or nil
+	running   []chan error
+	checkedAt time.Time
+	errs      map[string]error
+	err       error
+}
+
+// checkOne runs the healthcheck of the i'th storage, giving up after the
+// timeout. The storage's HealthCheck can't be cancelled, so one which times
+// out is left to finish in the background, and later checks wait for it
+// rather than starting another against a storage which may be hung. The
+// caller holds mu.
+func (sh *storageHealth) checkOne(i int) error {
+	if sh.timeout <= 0 {
+		return sh.storages[i].HealthCheck()
+	}
+
+	result := sh.running[i]
+	if result == nil {
+		result = make(chan error, 1)
+		go func(s storage.Storage) {
+			result <- s.HealthCheck()
+		}(sh.storages[i])
+	}
+
+	timer := time.NewTimer(sh.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		sh.running[i] = nil
+		return err
+	case <-timer.C:
+		sh.running[i] = result
+		return fmt.Errorf("healthcheck timed out after %s", sh.timeout)
+	}
+}
+
+// check checks the storages in parallel, returning the error of each by
+// name and the first error in the order of the storages, if any.
+func (sh *storageHealth) check() (map[string]error, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.interval > 0 && !sh.checkedAt.IsZero() && time.Since(sh.checkedAt) < sh.interval {
+		return sh.errs, sh.err
+	}
+
+	errs := make([]error, len(sh.storages))
+	var wg sync.WaitGroup
+	for i := range sh.storages {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = sh.checkOne(i)
+		}(i)
+	}
+	wg.Wait()
+
+	sh.errs = make(map[string]error, len(sh.storages))
+	sh.err = nil
+	for i, name := range sh.names {
+		sh.errs[name] = errs[i]
+		if errs[i] != nil {
+			sh.logger.Error(log.LogCategory_StorageError, "Healthcheck on storage %s failed: %s", name, errs[i].Error())
+			if sh.err == nil {
+				sh.err = errs[i]
+			}
+		}
+	}
+	sh.checkedAt = time.Now()
+	return sh.errs, sh.err
+}
+
+// HealthCheckHandler checks the storages and the cache, responding with the
+// result of each as JSON: "storage" has the first storage failure, and
+// "storages" the result of each by name. Only storage failures make the
+// response unhealthy, as tiles can still be served without the cache.
+func HealthCheckHandler(storages []storage.Storage, tileCache cache.Cache, logger log.JsonLogger) http.Handler {
+	return HealthCheckHandlerWithOptions(storages, tileCache, logger, HealthCheckOptions{})
+}
+
+func HealthCheckHandlerWithOptions(storages []storage.Storage, tileCache cache.Cache, logger log.JsonLogger, options HealthCheckOptions) http.Handler {
+	health := &storageHealth{
+		storages: storages,
+		names:    storageNames(storages),
+		running:  make([]chan error, len(storages)),
+		interval: options.Interval,
+		timeout:  options.Timeout,
+		logger:   logger,
+	}
 
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		healthy := true
+		result := make(map[string]interface{})
 
-		for _, s := range storages {
-			storageErr := s.HealthCheck()
-
-			if storageErr != nil {
-				logger.Error(log.LogCategory_StorageError, "Healthcheck on storage %s failed: %s", s, storageErr.Error())
-				healthy = false
-				break
+		storageErrs, storageErr := health.check()
+		result["storage"] = "ok"
+		if storageErr != nil {
+			result["storage"] = storageErr.Error()
+			healthy = false
+		}
+		storages := make(map[string]string, len(storageErrs))
+		for name, err := range storageErrs {
+			storages[name] = "ok"
+			if err != nil {
+				storages[name] = err.Error()
 			}
 		}
+		result["storages"] = storages
+
+		result["cache"] = "ok"
+		if cacheErr := CheckCacheHealth(req.Context(), tileCache); cacheErr != nil {
+			logger.Warning(log.LogCategory_StorageError, "Healthcheck on cache failed: %s", cacheErr.Error())
+			result["cache"] = cacheErr.Error()
+		}
 
-		if healthy {
-			rw.WriteHeader(http.StatusOK)
-		} else {
-			rw.WriteHeader(http.StatusInternalServerError)
+		status := http.StatusOK
+		if !healthy {
+			status = http.StatusInternalServerError
 		}
+		writeJsonStatus(rw, logger, status, result)
 	})
 }
@@ -3,6 +3,9 @@ package handler
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/tilezen/tapalcatl/pkg/state"
@@ -22,6 +25,53 @@ func ParseHttpData(req *http.Request) state.HttpRequestData {
 	}
 }
 
+// CaptureHeaders returns the values of the named request headers which the
+// request has, keyed by their canonical names, or nil if it has none of them.
+func CaptureHeaders(req *http.Request, names []string) map[string]string {
+	var result map[string]string
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		if result == nil {
+			result = make(map[string]string, len(names))
+		}
+		result[http.CanonicalHeaderKey(name)] = value
+	}
+	return result
+}
+
+// cacheKeyParamsHeader echoes the significant query parameters of a tile
+// request, normalized, for CDNs to use in their cache key in place of the
+// whole query string.
+const cacheKeyParamsHeader = "X-Cache-Key-Params"
+
+// SignificantQuery returns the request with only the named query parameters,
+// and the api_key used to authenticate it, so that no others can affect the
+// response. The named parameters are also returned encoded in a normalized
+// order, without the api_key, to key caches with. Only the first value of a
+// repeated parameter is kept.
+func SignificantQuery(req *http.Request, names []string) (*http.Request, string) {
+	q := req.URL.Query()
+	significant := make(url.Values, len(names))
+	for _, name := range names {
+		if value := q.Get(name); value != "" {
+			significant.Set(name, value)
+		}
+	}
+	normalized := significant.Encode()
+
+	if apiKey := q.Get("api_key"); apiKey != "" {
+		significant.Set("api_key", apiKey)
+	}
+	u := *req.URL
+	u.RawQuery = significant.Encode()
+	req = req.Clone(req.Context())
+	req.URL = &u
+	return req, normalized
+}
+
 // try and parse a range of different date formats which are allowed by HTTP.
 func parseHTTPDates(date string) (*time.Time, error) {
 	timeLayouts := []string{
@@ -65,6 +115,115 @@ func ParseCondition(req *http.Request) (state.Condition, *CondParseError) {
 	return result, nil
 }
 
+// validBuildID restricts build IDs to characters which are safe to use in
+// storage keys, file paths and metric names.
+var validBuildID = regexp.MustCompile(`^[A-Za-z0-9._/-]*$`)
+
+// ParseBuildID returns the "buildid" query parameter, which selects a build
+// other than the default by overriding the storage prefix.
+func ParseBuildID(req *http.Request) (string, *QueryParseError) {
+	buildID := req.URL.Query().Get("buildid")
+	if !validBuildID.MatchString(buildID) {
+		return "", &QueryParseError{Name: "buildid", Value: buildID}
+	}
+	for _, segment := range strings.Split(buildID, "/") {
+		if segment == ".." {
+			return "", &QueryParseError{Name: "buildid", Value: buildID}
+		}
+	}
+	return buildID, nil
+}
+
+// asOfHeader selects a build by date like the "asof" query parameter, for
+// clients which can't change the tile URLs.
+const asOfHeader = "X-Tile-AsOf"
+
+// ParseAsOf returns the time given by the "asof" query parameter or the
+// X-Tile-AsOf header, if any, which selects the newest build made at or
+// before it. Either an RFC 3339 time or a date may be given, and a date
+// includes builds made at any time that day in UTC.
+func ParseAsOf(req *http.Request) (*time.Time, *QueryParseError) {
+	name := "asof"
+	value := req.URL.Query().Get(name)
+	if value == "" {
+		name = asOfHeader
+		value = req.Header.Get(name)
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	if day, err := time.Parse("2006-01-02", value); err == nil {
+		t := day.Add(24*time.Hour - time.Nanosecond)
+		return &t, nil
+	}
+	return nil, &QueryParseError{Name: name, Value: value}
+}
+
+// ParseKeyVariables extracts the allow-listed query parameters from the
+// request, checking each value against its pattern.
+func ParseKeyVariables(req *http.Request, allowed map[string]*regexp.Regexp) (map[string]string, *QueryParseError) {
+	if len(allowed) == 0 {
+		return nil, nil
+	}
+
+	q := req.URL.Query()
+	var result map[string]string
+	for name, pattern := range allowed {
+		value := q.Get(name)
+		if value == "" {
+			continue
+		}
+		if !pattern.MatchString(value) {
+			return nil, &QueryParseError{Name: name, Value: value}
+		}
+		if result == nil {
+			result = make(map[string]string)
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+// KeyHeaderVariable is a request header passed through to the storage key
+// pattern, with the pattern its values must match.
+type KeyHeaderVariable struct {
+	Header  string
+	Pattern *regexp.Regexp
+}
+
+// ParseKeyHeaderVariables extracts the allow-listed headers of the request
+// as the named key variables, checking each value against its pattern.
+func ParseKeyHeaderVariables(req *http.Request, allowed map[string]*KeyHeaderVariable) (map[string]string, *QueryParseError) {
+	var result map[string]string
+	for name, variable := range allowed {
+		value := req.Header.Get(variable.Header)
+		if value == "" {
+			continue
+		}
+		if !variable.Pattern.MatchString(value) {
+			return nil, &QueryParseError{Name: variable.Header, Value: value}
+		}
+		if result == nil {
+			result = make(map[string]string)
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+type QueryParseError struct {
+	Name  string
+	Value string
+}
+
+func (qpe *QueryParseError) Error() string {
+	return fmt.Sprintf("Invalid %s: %s", qpe.Name, qpe.Value)
+}
+
 type CondParseError struct {
 	IfModifiedSinceError error
 }
@@ -76,6 +235,7 @@ func (cpe *CondParseError) Error() string {
 type ParseError struct {
 	MimeError  *MimeParseError
 	CoordError *CoordParseError
+	QueryError *QueryParseError
 	CondError  *CondParseError
 }
 
@@ -84,6 +244,8 @@ func (pe *ParseError) Error() string {
 		return pe.MimeError.Error()
 	} else if pe.CoordError != nil {
 		return pe.CoordError.Error()
+	} else if pe.QueryError != nil {
+		return pe.QueryError.Error()
 	} else if pe.CondError != nil {
 		return pe.CondError.Error()
 	} else {
@@ -104,10 +266,12 @@ type CoordParseError struct {
 	BadZ string
 	BadX string
 	BadY string
+	// set when the coordinate parses, but is outside the world
+	OutOfRange error
 }
 
 func (cpe *CoordParseError) IsError() bool {
-	return cpe.BadZ != "" || cpe.BadX != "" || cpe.BadY != ""
+	return cpe.BadZ != "" || cpe.BadX != "" || cpe.BadY != "" || cpe.OutOfRange != nil
 }
 
 func (cpe *CoordParseError) Error() string {
@@ -121,5 +285,8 @@ func (cpe *CoordParseError) Error() string {
 	if cpe.BadY != "" {
 		return fmt.Sprintf("Invalid y: %s", cpe.BadY)
 	}
+	if cpe.OutOfRange != nil {
+		return fmt.Sprintf("Invalid coordinate: %s", cpe.OutOfRange.Error())
+	}
 	panic("No coord parse error")
 }
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/tilezen/tapalcatl/pkg/log"
+	"github.com/tilezen/tapalcatl/pkg/storage"
+)
+
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 1000
+)
+
+// ListHandler lists the keys in the storage of the pattern given in the
+// "pattern" query parameter, for tools enumerating the available metatiles
+// and builds. The "prefix", "after" and "limit" parameters are passed to the
+// storage, and "format" picks the storage of patterns with one per format.
+func ListHandler(routes map[string]*ExplainRoute, logger log.JsonLogger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		pattern := q.Get("pattern")
+		route, ok := routes[pattern]
+		if !ok {
+			http.Error(rw, "Unknown pattern parameter", http.StatusBadRequest)
+			return
+		}
+		if format := q.Get("format"); format != "" {
+			formatRoute, ok := route.ByFormat[format]
+			if !ok {
+				http.Error(rw, "No storage configured for format "+format, http.StatusBadRequest)
+				return
+			}
+			route = formatRoute
+		}
+
+		limit := defaultListLimit
+		if limitStr := q.Get("limit"); limitStr != "" {
+			var err error
+			limit, err = strconv.Atoi(limitStr)
+			if err != nil || limit <= 0 || limit > maxListLimit {
+				http.Error(rw, "Invalid limit parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		lister, ok := route.Storage.(storage.Lister)
+		if !ok {
+			http.Error(rw, "Storage for pattern can't list keys", http.StatusNotImplemented)
+			return
+		}
+
+		result, err := lister.List(q.Get("prefix"), q.Get("after"), limit)
+		if errors.Is(err, storage.ErrInvalidListPrefix) {
+			http.Error(rw, "Invalid prefix parameter", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logger.Error(log.LogCategory_StorageError, "Failed to list storage for pattern %s: %s", pattern, err.Error())
+			http.Error(rw, "Failed to list storage: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		response := map[string]interface{}{
+			"pattern":   pattern,
+			"keys":      result.Keys,
+			"truncated": result.Truncated,
+		}
+		if result.Truncated && len(result.Keys) > 0 {
+			response["next"] = result.Keys[len(result.Keys)-1]
+		}
+		writeJson(rw, logger, response)
+	})
+}
@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"container/heap"
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ZoomBand gives requests for zooms between MinZoom and MaxZoom inclusive a
+// priority weight when queued by the LoadShedder.
+type ZoomBand struct {
+	MinZoom int
+	MaxZoom int
+	Weight  int
+}
+
+// ZoomPriority returns a priority function for LoadShedder.Handler which
+// weights requests by the "z" route variable according to the bands. Zooms
+// not in any band, and requests without a zoom, get zero weight. With no
+// bands, lower zooms simply get higher priority.
+func ZoomPriority(bands []ZoomBand) func(*http.Request) int {
+	return func(req *http.Request) int {
+		z, err := strconv.Atoi(mux.Vars(req)["z"])
+		if err != nil {
+			return 0
+		}
+		if len(bands) == 0 {
+			return -z
+		}
+		for _, band := range bands {
+			if z >= band.MinZoom && z <= band.MaxZoom {
+				return band.Weight
+			}
+		}
+		return 0
+	}
+}
+
+type shedWaiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+	// granted is set when the waiter is given a slot rather than shed.
+	granted bool
+	// index in the queue, or -1 once removed
+	index int
+}
+
+// waiterQueue is a heap of waiters, highest priority first, then oldest first.
+type waiterQueue []*shedWaiter
+
+func (q waiterQueue) Len() int { return len(q) }
+
+func (q waiterQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q waiterQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waiterQueue) Push(x interface{}) {
+	w := x.(*shedWaiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waiterQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	w.index = -1
+	*q = old[:n-1]
+	return w
+}
+
+// lowest returns the index of the waiter which would be served last.
+func (q waiterQueue) lowest() int {
+	lowest := 0
+	for i := 1; i < len(q); i++ {
+		if q.Less(lowest, i) {
+			lowest = i
+		}
+	}
+	return lowest
+}
+
+// LoadShedder limits the number of requests handled concurrently. Requests
+// over the limit wait in a priority queue, and are shed with a 503 when the
+// queue is full or they have waited too long. When the queue is full, the
+// lowest priority request is the one shed, so that eg. overview tiles keep
+// being served while deep zoom requests are dropped.
+type LoadShedder struct {
+	maxInFlight  int
+	maxQueue     int
+	queueTimeout time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	seq      uint64
+	queue    waiterQueue
+}
+
+func NewLoadShedder(maxInFlight, maxQueue int, queueTimeout time.Duration) *LoadShedder {
+	return &LoadShedder{
+		maxInFlight:  maxInFlight,
+		maxQueue:     maxQueue,
+		queueTimeout: queueTimeout,
+	}
+}
+
+// acquire waits for a slot to handle a request, returning false if the
+// request was shed instead.
+func (ls *LoadShedder) acquire(priority int) bool {
+	granted, _ := ls.acquireQueued(priority)
+	return granted
+}
+
+// acquireQueued is acquire, also returning how long the request was queued
+// for, which is 0 when there was a slot free.
+func (ls *LoadShedder) acquireQueued(priority int) (bool, time.Duration) {
+	ls.mu.Lock()
+	if ls.inFlight < ls.maxInFlight {
+		ls.inFlight++
+		ls.mu.Unlock()
+		return true, 0
+	}
+	queuedAt := time.Now()
+
+	ls.seq++
+	w := &shedWaiter{priority: priority, seq: ls.seq, ready: make(chan struct{})}
+	heap.Push(&ls.queue, w)
+	if ls.queue.Len() > ls.maxQueue {
+		shed := heap.Remove(&ls.queue, ls.queue.lowest()).(*shedWaiter)
+		close(shed.ready)
+	}
+	ls.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if ls.queueTimeout > 0 {
+		timer := time.NewTimer(ls.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-w.ready:
+	case <-timeout:
+		ls.mu.Lock()
+		if w.index >= 0 {
+			heap.Remove(&ls.queue, w.index)
+		}
+		ls.mu.Unlock()
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return w.granted, time.Since(queuedAt)
+}
+
+// release frees a slot, handing it to the highest priority waiter if any.
+func (ls *LoadShedder) release() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.queue.Len() > 0 {
+		w := heap.Pop(&ls.queue).(*shedWaiter)
+		w.granted = true
+		close(w.ready)
+		return
+	}
+	ls.inFlight--
+}
+
+// Handler wraps next, prioritising queued requests by the given function,
+// where a higher value is served first.
+func (ls *LoadShedder) Handler(next http.Handler, priority func(*http.Request) int) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		granted, wait := ls.acquireQueued(priority(req))
+		if !granted {
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, "Service overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		defer ls.release()
+		if wait > 0 {
+			req = req.WithContext(context.WithValue(req.Context(), queueWaitContextKey{}, wait))
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+type queueWaitContextKey struct{}
+
+// queueWait returns how long the request waited in the load shedder's queue
+// before being handled, 0 if it didn't.
+func queueWait(ctx context.Context) time.Duration {
+	wait, _ := ctx.Value(queueWaitContextKey{}).(time.Duration)
+	return wait
+}
+
+// QueueLength returns the number of requests waiting for a slot.
+func (ls *LoadShedder) QueueLength() int {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.queue.Len()
+}
@@ -3,9 +3,13 @@ package handler
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
 	"time"
 
@@ -32,6 +36,186 @@ const (
 	cacheVectorTileTTL = 168 * time.Hour
 )
 
+const (
+	// MaxZoomPolicy_NotFound responds 404 to requests above the maximum zoom.
+	MaxZoomPolicy_NotFound = "notfound"
+	// MaxZoomPolicy_Overzoom serves the ancestor tile at the maximum zoom to
+	// requests above it, leaving the client to overzoom.
+	MaxZoomPolicy_Overzoom = "overzoom"
+)
+
+const (
+	// TombstonePolicy_Ignore treats empty metatiles and tiles like any other,
+	// so an empty metatile is an invalid zip and an empty tile is served.
+	TombstonePolicy_Ignore = "ignore"
+	// TombstonePolicy_NotFound responds 404 to tombstoned tiles.
+	TombstonePolicy_NotFound = "notfound"
+	// TombstonePolicy_Blank serves a blank tile of the requested format in
+	// place of tombstoned tiles.
+	TombstonePolicy_Blank = "blank"
+)
+
+// blankTiles holds the body served for a tombstoned tile by format under
+// TombstonePolicy_Blank. Formats not listed get an empty body, which is a
+// valid empty mvt tile.
+var blankTiles = map[string][]byte{
+	"json":     []byte(`{"type":"FeatureCollection","features":[]}`),
+	"geojson":  []byte(`{"type":"FeatureCollection","features":[]}`),
+	"topojson": []byte(`{"type":"Topology","objects":{},"arcs":[]}`),
+}
+
+// IsValidTombstonePolicy returns true when policy is one of the
+// TombstonePolicy_ constants.
+func IsValidTombstonePolicy(policy string) bool {
+	switch policy {
+	case TombstonePolicy_Ignore, TombstonePolicy_NotFound, TombstonePolicy_Blank:
+		return true
+	}
+	return false
+}
+
+const (
+	// ArchivedPolicy_Unavailable responds 503 to tiles whose metatile is
+	// archived, with a Retry-After for when it may have been restored.
+	ArchivedPolicy_Unavailable = "unavailable"
+	// ArchivedPolicy_NotFound responds 404 to tiles whose metatile is
+	// archived, for builds which won't be restored.
+	ArchivedPolicy_NotFound = "notfound"
+)
+
+// IsValidArchivedPolicy returns true when policy is one of the
+// ArchivedPolicy_ constants.
+func IsValidArchivedPolicy(policy string) bool {
+	switch policy {
+	case ArchivedPolicy_Unavailable, ArchivedPolicy_NotFound:
+		return true
+	}
+	return false
+}
+
+// isArchived returns true when a fetch failed as the metatile is archived.
+func isArchived(err error) bool {
+	var archived *storage.ArchivedError
+	return errors.As(err, &archived)
+}
+
+// respondArchived responds to a fetch which failed as the metatile is
+// archived according to the policy, default unavailable, returning false
+// when it failed otherwise.
+func respondArchived(rw http.ResponseWriter, req *http.Request, reqState *state.RequestState, err error, policy string, retryAfter time.Duration) bool {
+	if !isArchived(err) {
+		return false
+	}
+	if policy == ArchivedPolicy_NotFound {
+		http.NotFound(rw, req)
+		reqState.ResponseState = state.ResponseState_NotFound
+		return true
+	}
+	if retryAfter > 0 {
+		rw.Header().Set("Retry-After", strconv.FormatInt(int64(retryAfter/time.Second), 10))
+	}
+	http.Error(rw, "Metatile is archived", http.StatusServiceUnavailable)
+	reqState.ResponseState = state.ResponseState_Error
+	return true
+}
+
+// MetatileOptions holds the optional settings of a MetatileHandler. The zero
+// value gives the default behaviour.
+type MetatileOptions struct {
+	// MaxZoom is the deepest zoom served, or 0 for no limit.
+	MaxZoom int
+	// MaxZoomPolicy is one of the MaxZoomPolicy_ constants, default notfound.
+	MaxZoomPolicy string
+	// CacheCompressedTiles serves clients accepting gzip a compressed tile,
+	// caching it alongside the uncompressed one so that hot tiles are only
+	// compressed once.
+	CacheCompressedTiles bool
+	// StoreCompressedTiles caches tiles gzipped in place of the uncompressed
+	// ones, so that tiles are compressed once when the cache is filled.
+	// Clients accepting gzip are served the cached tile as it is, and it's
+	// decompressed for the others.
+	StoreCompressedTiles bool
+	// ServerTiming adds a Server-Timing header with the duration of each
+	// phase of handling the request to tile responses.
+	ServerTiming bool
+	// TimingUnit is one of the state.TimingUnit_ constants, the unit of the
+	// logged timings, default milliseconds.
+	TimingUnit string
+	// ValidateTiles checks that mvt tiles are well formed before serving or
+	// caching them, responding 502 to corrupt ones.
+	ValidateTiles bool
+	// BuildMetadata, if set, provides the metatile sizes of each build,
+	// overriding the configured sizes for builds which have metadata.
+	BuildMetadata *storage.BuildMetadataSource
+	// BuildManifest, if set, lists the builds to select from by date when a
+	// request has an asof parameter.
+	BuildManifest *storage.BuildManifestSource
+	// TombstonePolicy is one of the TombstonePolicy_ constants, default
+	// ignore. Zero-byte metatiles, and zero-byte tiles within a metatile,
+	// are tombstones marking tiles which were deleted on purpose.
+	TombstonePolicy string
+	// TombstoneMaxAge, if positive, is sent as the max-age of tombstone
+	// responses so that clients and caches don't keep asking for them.
+	TombstoneMaxAge time.Duration
+	// ArchivedPolicy is one of the ArchivedPolicy_ constants, default
+	// unavailable, for metatiles archived in storage, eg. old builds
+	// lifecycled to Glacier.
+	ArchivedPolicy string
+	// ArchivedRetryAfter, if positive, is sent as the Retry-After of
+	// responses for archived metatiles under ArchivedPolicy_Unavailable.
+	ArchivedRetryAfter time.Duration
+	// DuplicateEntryPolicy is one of the tile.DuplicateEntryPolicy_
+	// constants, default first. It chooses between entries with the same
+	// name in malformed metatiles, which are logged whatever the policy.
+	DuplicateEntryPolicy string
+	// ServeStale serves a stale copy of the tile from the cache, if it
+	// keeps them, when the metatile can't be fetched from storage.
+	ServeStale bool
+	// RangedReads fetches only the parts of metatiles needed for the tile,
+	// from storages which can, rather than whole metatiles. The metatiles
+	// aren't cached then, only the tiles.
+	RangedReads bool
+	// Degradation, if set, turns off caching tiles, compressing cached
+	// variants and validating tiles while it's active.
+	Degradation *Degradation
+	// TTLSchedule sets the cache TTLs of tiles by zoom, and the max-age of
+	// their responses. Zooms outside the schedule are cached for the default
+	// TTLs and responses have no Cache-Control header.
+	TTLSchedule []ZoomTTL
+	// TTLJitter shortens each cache TTL and max-age by a random fraction of
+	// it, up to this fraction from 0 to 1, so that tiles cached together
+	// don't all expire together.
+	TTLJitter float64
+	// FormatFallbacks lists, by requested format, the formats whose entries
+	// to serve when a metatile has no entry in the requested format. Those
+	// which can't be transcoded to the requested format are served as they
+	// are, and are tried first.
+	FormatFallbacks map[string][]string
+	// Transcode converts fallback entries which can be transcoded to the
+	// requested format, eg. mvt to json. Otherwise, or while degraded,
+	// they're skipped.
+	Transcode bool
+	// BanList, if set, is given a strike for each malformed request, so
+	// that clients making many of them are banned for a while.
+	BanList *BanList
+	// ContentHashes adds the X-Tile-Hash header, with the hash of the tile's
+	// content, to tile responses. Whether or not it's set, tiles requested
+	// with a {hash} in the URL are only served when it matches, and are
+	// then cacheable forever.
+	ContentHashes bool
+	// SkipNotFoundLogs is the fraction of not found responses, from 0 to 1,
+	// which aren't logged, eg. as ocean tiles at high zooms are a lot of
+	// noise. Their metrics are still written.
+	SkipNotFoundLogs float64
+	// TileTracker, if set, records each tile requested to find the most
+	// requested ones.
+	TileTracker *TileTracker
+	// StorageNamespace names the storage in the keys of cached metatiles,
+	// so that handlers for other storages sharing the cache, eg. of other
+	// formats, don't serve its metatiles.
+	StorageNamespace string
+}
+
 func MetatileHandler(
 	p state.Parser,
 	metatileSize, tileSize, metatileMaxDetailZoom int,
@@ -41,8 +225,23 @@ func MetatileHandler(
 	logger log.JsonLogger,
 	tileCache cache.Cache) http.Handler {
 
+	return MetatileHandlerWithOptions(p, metatileSize, tileSize, metatileMaxDetailZoom, stg, bufferManager, mw, logger, tileCache, MetatileOptions{})
+}
+
+func MetatileHandlerWithOptions(
+	p state.Parser,
+	metatileSize, tileSize, metatileMaxDetailZoom int,
+	stg storage.Storage,
+	bufferManager buffer.BufferManager,
+	mw metrics.MetricsWriter,
+	logger log.JsonLogger,
+	tileCache cache.Cache,
+	options MetatileOptions) http.Handler {
+
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		reqState := &state.RequestState{}
+		logger := log.ForRequest(req.Context(), logger)
+		reqState := &state.RequestState{TimingUnit: options.TimingUnit}
+		reqState.Duration.Queue = queueWait(req.Context())
 
 		startTime := time.Now()
 
@@ -54,69 +253,177 @@ func MetatileHandler(
 				logger.Error(log.LogCategory_InvalidCodeState, "handler did not set response state for tile %+v", reqState.Coord)
 			}
 
-			jsonReqData := reqState.AsJsonMap()
-			logger.Metrics(jsonReqData)
-
-			// write out metrics
-			mw.WriteMetatileState(reqState)
+			report := func() {
+				if reqState.ResponseState == state.ResponseState_NotFound && options.SkipNotFoundLogs > 0 && rand.Float64() < options.SkipNotFoundLogs {
+					log.SkipRequestLog(req.Context())
+				} else {
+					log.Metrics(logger, reqState)
+				}
 
+				// write out metrics
+				mw.WriteMetatileState(reqState)
+			}
+			if !reportAfterCompression(req.Context(), reqState, report) {
+				report()
+			}
 		}()
 
 		parseStart := time.Now()
 		parseResult, err := p.Parse(req)
 		reqState.Duration.Parse = time.Since(parseStart)
-		if err != nil {
-			var sc int
-			var response string
-
-			if pe, ok := err.(*ParseError); ok {
-				logger.Warning(log.LogCategory_ParseError, err.Error())
-				if pe.MimeError != nil {
-					sc = http.StatusNotFound
-					reqState.ResponseState = state.ResponseState_NotFound
-					response = pe.MimeError.Error()
-				} else if pe.CoordError != nil {
-					sc = http.StatusBadRequest
-					reqState.ResponseState = state.ResponseState_BadRequest
-					response = pe.CoordError.Error()
-				} else if pe.CondError != nil {
-					reqState.IsCondError = true
-					logger.Warning(log.LogCategory_ConditionError, pe.CondError.Error())
-				}
-			} else {
-				logger.Error(log.LogCategory_ParseError, "Unknown parse error: %#v\n", err)
-				sc = http.StatusInternalServerError
-				response = "Internal server error"
-				reqState.ResponseState = state.ResponseState_Error
-			}
-
-			// only return an error response when not a condition parse error
-			// NOTE: maybe it's better to not consider this an error, but
-			// capture it in the parse result state and handle it that way?
-			if sc > 0 {
-				http.Error(rw, response, sc)
-				return
-			}
+		if err != nil && respondParseError(rw, req, reqState, err, options.BanList, logger) {
+			return
 		}
 
+		parseResult.StorageNamespace = options.StorageNamespace
 		metatileData := parseResult.AdditionalData.(*state.MetatileParseData)
-		reqState.Coord = &metatileData.Coord
+		requestedCoord := metatileData.Coord
+		reqState.Coord = &requestedCoord
 		reqState.Format = reqState.Coord.Format
+		reqState.IsUnknownFormat = metatileData.IsUnknownFormat
 		reqState.HttpData = parseResult.HttpData
+		reqState.Build = parseResult.BuildID
+		if parseResult.CacheKeyParams != nil {
+			rw.Header().Set(cacheKeyParamsHeader, *parseResult.CacheKeyParams)
+		}
+		if options.TileTracker != nil {
+			options.TileTracker.Record(requestedCoord)
+		}
+
+		if options.BuildManifest != nil {
+			rw.Header().Add("Vary", asOfHeader)
+		}
+		for _, header := range parseResult.KeyHeaders {
+			rw.Header().Add("Vary", header)
+		}
+		if !resolveAsOf(rw, reqState, parseResult, options.BuildManifest, logger) {
+			return
+		}
+		applyTenant(req, parseResult)
+
+		degraded := options.Degradation != nil && options.Degradation.Active()
+		reqState.IsDegraded = degraded
+
+		if options.MaxZoom > 0 && requestedCoord.Z > options.MaxZoom {
+			reqState.IsOverMaxZoom = true
+			if options.MaxZoomPolicy != MaxZoomPolicy_Overzoom {
+				http.NotFound(rw, req)
+				reqState.ResponseState = state.ResponseState_NotFound
+				return
+			}
+			// serve, and cache, the ancestor tile in place of the requested one
+			metatileData.Coord = requestedCoord.Ancestor(options.MaxZoom)
+		}
+
+		metatileTTL, tileTTL := cacheMetatileTTL, cacheVectorTileTTL
+		maxAge, hasMaxAge := ttlForZoom(options.TTLSchedule, metatileData.Coord.Z)
+		if hasMaxAge {
+			maxAge = jitterTTL(maxAge, options.TTLJitter)
+			metatileTTL, tileTTL = maxAge, maxAge
+		} else {
+			metatileTTL, tileTTL = jitterTTL(metatileTTL, options.TTLJitter), jitterTTL(tileTTL, options.TTLJitter)
+		}
+
+		writeResponse := func(vectorData *state.VectorTileResponseData) error {
+			if metatileData.ContentHash != "" || options.ContentHashes {
+				hash, err := contentHash(vectorData)
+				if err != nil {
+					return err
+				}
+				if metatileData.ContentHash != "" {
+					if hash != metatileData.ContentHash {
+						// the URL is for content which isn't being served,
+						// eg. from a previous build
+						reqState.IsHashMismatch = true
+						http.NotFound(rw, req)
+						reqState.ResponseState = state.ResponseState_NotFound
+						return nil
+					}
+					rw.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", immutableMaxAge))
+				}
+				rw.Header().Set(contentHashHeader, hash)
+			}
+			// tombstones and stale tiles have their own lifetimes
+			if hasMaxAge && !reqState.IsTombstone && !reqState.IsStale && metatileData.ContentHash == "" {
+				rw.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(maxAge/time.Second)))
+			}
+			if options.ServerTiming {
+				if timing := serverTiming(&reqState.Duration); timing != "" {
+					rw.Header().Set("Server-Timing", timing)
+				}
+			}
+			return writeVectorTileResponse(reqState, rw, vectorData)
+		}
+
+		acceptsGzip := acceptsEncoding(req, encodingGzip)
+		compressVariant := !degraded && (options.StoreCompressedTiles || options.CacheCompressedTiles && acceptsGzip)
+		// writeTile writes the response, compressing and caching the tile
+		// in gzip if enabled. It returns whether the compressed tile is
+		// being cached.
+		writeTile := func(vectorData *state.VectorTileResponseData) (bool, error) {
+			cachingVariant := false
+			if compressVariant {
+				variant, err := gzipVariant(vectorData)
+				if err != nil {
+					logger.Warning(log.LogCategory_ResponseError, "Failed to compress tile: %+v", err)
+				} else {
+					goCacheSet(func() {
+						timeoutCtx, cancel := context.WithTimeout(context.Background(), cacheSetTimeout)
+						err := tileCache.SetTileVariant(timeoutCtx, parseResult, encodingGzip, variant, tileTTL)
+						cancel()
+						if err != nil {
+							logger.Warning(log.LogCategory_ResponseError, "Failed to set compressed tile cache: %+v", err)
+						}
+					})
+					cachingVariant = true
+					if acceptsGzip {
+						vectorData = variant
+					}
+				}
+			}
+			return cachingVariant, writeResponse(vectorData)
+		}
 
 		// Check for requested vector tile in cache before doing work to extract it from metatile
 		vecCacheLookupStart := time.Now()
-		timeoutCtx, cancel := context.WithTimeout(req.Context(), cacheTimeout)
-		cachedVecResp, err := tileCache.GetTile(timeoutCtx, parseResult)
-		cancel()
-		reqState.Duration.VectorCacheLookup = time.Since(vecCacheLookupStart)
-		if err != nil {
-			reqState.IsCacheLookupError = true
-			logger.Warning(log.LogCategory_ResponseError, "Error checking vector cache: %+v", err)
+		var cachedVecResp *state.VectorTileResponseData
+		// compressed tiles are stored only in gzip when StoreCompressedTiles
+		// is set, so they're looked up whether or not it's degraded
+		if compressVariant || options.StoreCompressedTiles {
+			timeoutCtx, cancel := context.WithTimeout(req.Context(), cacheTimeout)
+			cachedVecResp, err = tileCache.GetTileVariant(timeoutCtx, parseResult, encodingGzip)
+			cancel()
+			if err != nil {
+				reqState.IsCacheLookupError = true
+				logger.Warning(log.LogCategory_ResponseError, "Error checking compressed vector cache: %+v", err)
+			}
+			if cachedVecResp != nil {
+				reqState.Cache.CompressedCacheHit = true
+			}
+		}
+		if cachedVecResp == nil {
+			timeoutCtx, cancel := context.WithTimeout(req.Context(), cacheTimeout)
+			cachedVecResp, err = tileCache.GetTile(timeoutCtx, parseResult)
+			cancel()
+			if err != nil {
+				reqState.IsCacheLookupError = true
+				logger.Warning(log.LogCategory_ResponseError, "Error checking vector cache: %+v", err)
+			}
 		}
+		reqState.Duration.VectorCacheLookup = time.Since(vecCacheLookupStart)
 
 		if cachedVecResp != nil {
-			err := writeVectorTileResponse(reqState, rw, cachedVecResp)
+			var err error
+			if reqState.Cache.CompressedCacheHit {
+				if cachedVecResp.ContentEncoding == encodingGzip && !acceptsGzip {
+					cachedVecResp, err = gunzipVariant(cachedVecResp)
+				}
+				if err == nil {
+					err = writeResponse(cachedVecResp)
+				}
+			} else {
+				_, err = writeTile(cachedVecResp)
+			}
 			if err != nil {
 				logger.Error(log.LogCategory_ResponseError, "Failed to write cachedVecResp response body: %#v", err)
 				http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -125,12 +432,27 @@ func MetatileHandler(
 			}
 
 			reqState.Cache.VectorCacheHit = true
-			reqState.ResponseState = state.ResponseState_Success
 			return
 		}
 
+		buildMetatileSize, buildTileSize, buildMetatileMaxDetailZoom := metatileSize, tileSize, metatileMaxDetailZoom
+		if options.BuildMetadata != nil {
+			metadata, err := options.BuildMetadata.Get(parseResult.BuildID)
+			if err != nil {
+				logger.Error(log.LogCategory_StorageError, "Failed to read build metadata: %s", err.Error())
+				http.Error(rw, "Internal server error", http.StatusInternalServerError)
+				reqState.ResponseState = state.ResponseState_Error
+				return
+			}
+			if metadata != nil {
+				buildMetatileSize = metadata.MetatileSize
+				buildTileSize = metadata.TileSize
+				buildMetatileMaxDetailZoom = metadata.MetatileMaxDetailZoom
+			}
+		}
+
 		// Get the offset coordinate inside the metatile where we should be able to find the vector tile
-		metaCoord, offset, err := metatileData.Coord.MetaAndOffset(metatileSize, tileSize, metatileMaxDetailZoom)
+		metaCoord, offset, err := metatileData.Coord.MetaAndOffset(buildMetatileSize, buildTileSize, buildMetatileMaxDetailZoom)
 		if err != nil {
 			logger.Warning(log.LogCategory_ConfigError, "MetaAndOffset could not be calculated: %s", err.Error())
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -143,7 +465,7 @@ func MetatileHandler(
 
 		// Check for the desired metatile in cache before taking the time to fetch it from storage
 		metaCacheLookupStart := time.Now()
-		timeoutCtx, cancel = context.WithTimeout(req.Context(), cacheTimeout)
+		timeoutCtx, cancel := context.WithTimeout(req.Context(), cacheTimeout)
 		metatileResponseData, err = tileCache.GetMetatile(timeoutCtx, parseResult, metaCoord)
 		cancel()
 		reqState.Duration.MetatileCacheLookup = time.Since(metaCacheLookupStart)
@@ -153,22 +475,52 @@ func MetatileHandler(
 		}
 
 		if metatileResponseData == nil {
-			metatileResponseData, err = fetchMetatile(reqState, stg, parseResult, metaCoord)
+			metatileResponseData, err = fetchMetatile(req.Context(), reqState, stg, parseResult, metaCoord, options.RangedReads)
+			if err != nil && req.Context().Err() != nil {
+				// the caller's deadline has passed, so storage isn't to blame
+				// and nobody is waiting for a stale tile either
+				http.Error(rw, "Request deadline exceeded", http.StatusGatewayTimeout)
+				reqState.IsDeadlineExceeded = true
+				return
+			}
+			if options.Degradation != nil {
+				// archived metatiles aren't a sign of storage failing
+				options.Degradation.RecordFetch(err != nil && !isArchived(err))
+			}
 			if err != nil {
+				if options.ServeStale {
+					staleData := getStaleTile(req.Context(), reqState, tileCache, bufferManager, parseResult, metaCoord, offset, options, logger)
+					if staleData != nil {
+						logger.Warning(log.LogCategory_StorageError, "Serving stale tile %s: %s", requestedCoord.FileName(), err.Error())
+						reqState.IsStale = true
+						rw.Header().Set("Warning", `110 - "Response is Stale"`)
+						rw.Header().Set("X-Cache", "STALE")
+						if err := writeResponse(staleData); err != nil {
+							logger.Error(log.LogCategory_ResponseError, "Failed to write response body: %#v", err)
+						}
+						return
+					}
+				}
+				if respondArchived(rw, req, reqState, err, options.ArchivedPolicy, options.ArchivedRetryAfter) {
+					return
+				}
 				http.Error(rw, err.Error(), http.StatusInternalServerError)
 				reqState.ResponseState = state.ResponseState_Error
 				return
 			}
 
-			// Set the metatile cache on a goroutine so we don't hold up the rest of the request
-			go func() {
-				timeoutCtx, cancel := context.WithTimeout(context.Background(), cacheSetTimeout)
-				err = tileCache.SetMetatile(timeoutCtx, parseResult, metaCoord, metatileResponseData, cacheMetatileTTL)
-				cancel()
-				if err != nil {
-					logger.Warning(log.LogCategory_ResponseError, "Failed to set metatile cache: %+v", err)
-				}
-			}()
+			// Set the metatile cache on a goroutine so we don't hold up the rest of the request.
+			// A not modified response has no metatile to cache, and is only for this client.
+			if !degraded && metatileResponseData.Ranges == nil && metatileResponseData.ResponseState != state.ResponseState_NotModified {
+				goCacheSet(func() {
+					timeoutCtx, cancel := context.WithTimeout(context.Background(), cacheSetTimeout)
+					err := tileCache.SetMetatile(timeoutCtx, parseResult, metaCoord, metatileResponseData, metatileTTL)
+					cancel()
+					if err != nil {
+						logger.Warning(log.LogCategory_ResponseError, "Failed to set metatile cache: %+v", err)
+					}
+				})
+			}
 		} else {
 			reqState.Cache.MetatileCacheHit = true
 		}
@@ -185,48 +537,243 @@ func MetatileHandler(
 			return
 		}
 
-		responseData, err := extractVectorTileFromMetatile(reqState, bufferManager, parseResult, metatileResponseData)
+		tombstones := options.TombstonePolicy == TombstonePolicy_NotFound || options.TombstonePolicy == TombstonePolicy_Blank
+		// writeTombstone responds for a deleted tile without caching the
+		// tile, as the metatile is small and already cached
+		writeTombstone := func() {
+			reqState.IsTombstone = true
+			if options.TombstoneMaxAge > 0 {
+				rw.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(options.TombstoneMaxAge/time.Second)))
+			}
+			if options.TombstonePolicy == TombstonePolicy_NotFound {
+				http.NotFound(rw, req)
+				reqState.ResponseState = state.ResponseState_NotFound
+				return
+			}
+			err := writeResponse(&state.VectorTileResponseData{
+				ContentType:  parseResult.ContentType,
+				Data:         blankTiles[requestedCoord.Format],
+				ETag:         metatileResponseData.ETag,
+				LastModified: metatileResponseData.LastModified,
+			})
+			if err != nil {
+				logger.Error(log.LogCategory_ResponseError, "Failed to write response body: %#v", err)
+			}
+		}
+
+		if tombstones && len(metatileResponseData.Data) == 0 && metatileResponseData.Ranges == nil {
+			writeTombstone()
+			return
+		}
+
+		responseData, err := extractWithFallbacks(reqState, bufferManager, parseResult, metatileResponseData, options)
+		if reqState.IsDuplicateEntry {
+			logger.Warning(log.LogCategory_MetatileError, "Duplicate entries for tile %s in metatile %s", offset.FileName(), metaCoord.FileName())
+		}
+		if errors.Is(err, tile.ErrDuplicateEntry) {
+			http.Error(rw, "Duplicate tile in storage", http.StatusBadGateway)
+			reqState.ResponseState = state.ResponseState_Error
+			return
+		}
+		if errors.Is(err, tile.ErrNoEntry) && len(options.FormatFallbacks[requestedCoord.Format]) > 0 {
+			// with fallbacks, a missing entry is an expected part of a
+			// format migration rather than a broken metatile
+			reqState.IsZipError = false
+			http.NotFound(rw, req)
+			reqState.ResponseState = state.ResponseState_NotFound
+			return
+		}
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			reqState.ResponseState = state.ResponseState_Error
 			return
 		}
 
+		if tombstones && len(responseData.Data) == 0 {
+			writeTombstone()
+			return
+		}
+
+		if options.ValidateTiles && !degraded && requestedCoord.Format == "mvt" {
+			if err := tile.ValidateMvt(responseData.Data); err != nil {
+				logger.Error(log.LogCategory_MetatileError, "Invalid tile %s in metatile %s: %s", requestedCoord.FileName(), metaCoord.FileName(), err.Error())
+				http.Error(rw, "Invalid tile in storage", http.StatusBadGateway)
+				reqState.IsTileInvalid = true
+				reqState.ResponseState = state.ResponseState_Error
+				return
+			}
+		}
+
 		// Copy some of the metatile response data over to the vector tile response data so that it is properly cachedVecResp
 		responseData.ETag = metatileResponseData.ETag
 		responseData.LastModified = metatileResponseData.LastModified
 
-		err = writeVectorTileResponse(reqState, rw, responseData)
+		cachingVariant, err := writeTile(responseData)
 		if err != nil {
 			// TODO Context cancellation might happen here?
 			logger.Error(log.LogCategory_ResponseError, "Failed to write response body: %#v", err)
 			// Still want to set the cache in this case
 		}
 
+		if degraded || cachingVariant && options.StoreCompressedTiles {
+			return
+		}
+
 		// Cache the response
-		go func() {
+		goCacheSet(func() {
 			// Using a longer timeout here so that there's a better chance the set will complete
-			timeoutCtx, cancel = context.WithTimeout(context.Background(), cacheSetTimeout)
-			err = tileCache.SetTile(timeoutCtx, parseResult, responseData, cacheVectorTileTTL)
+			timeoutCtx, cancel := context.WithTimeout(context.Background(), cacheSetTimeout)
+			err := tileCache.SetTile(timeoutCtx, parseResult, responseData, tileTTL)
 			cancel()
 			if err != nil {
 				logger.Error(log.LogCategory_ResponseError, "Failed to set cache: %#v", err)
 			}
-		}()
+		})
 	})
 }
 
-func fetchMetatile(reqState *state.RequestState, stg storage.Storage, parseResult *state.ParseResult, metaCoord tile.TileCoord) (*state.MetatileResponseData, error) {
+// respondParseError records the parse error in the request state, and
+// responds with it unless it's only a condition parse error, which is
+// logged and ignored. It returns whether it responded.
+func respondParseError(rw http.ResponseWriter, req *http.Request, reqState *state.RequestState, err error, banList *BanList, logger log.JsonLogger) bool {
+	var sc int
+	var response string
+
+	if pe, ok := err.(*ParseError); ok {
+		if pe.MimeError != nil {
+			sc = http.StatusNotFound
+			reqState.ResponseState = state.ResponseState_NotFound
+			reqState.Malformed = state.Malformed_Format
+			response = pe.MimeError.Error()
+		} else if pe.CoordError != nil {
+			sc = http.StatusBadRequest
+			reqState.ResponseState = state.ResponseState_BadRequest
+			reqState.Malformed = state.Malformed_Coord
+			response = pe.CoordError.Error()
+		} else if pe.QueryError != nil {
+			sc = http.StatusBadRequest
+			reqState.ResponseState = state.ResponseState_BadRequest
+			reqState.Malformed = state.Malformed_Query
+			response = pe.QueryError.Error()
+		} else if pe.CondError != nil {
+			reqState.IsCondError = true
+			logger.Warning(log.LogCategory_ConditionError, pe.CondError.Error())
+		}
+	} else {
+		logger.Error(log.LogCategory_ParseError, "Unknown parse error: %#v\n", err)
+		sc = http.StatusInternalServerError
+		response = "Internal server error"
+		reqState.ResponseState = state.ResponseState_Error
+	}
+
+	// malformed requests are only recorded in the request's metrics,
+	// rather than logged on their own, as scans make a lot of them
+	if reqState.Malformed != "" && banList != nil && banList.Strike(req) {
+		logger.Warning(log.LogCategory_ParseError, "Banning client after malformed request: %s", err.Error())
+	}
+
+	// only return an error response when not a condition parse error
+	// NOTE: maybe it's better to not consider this an error, but
+	// capture it in the parse result state and handle it that way?
+	if sc > 0 {
+		http.Error(rw, response, sc)
+		return true
+	}
+	return false
+}
+
+// resolveAsOf selects the build of a request made with asof from the
+// manifest. It returns false when it has responded with an error instead.
+func resolveAsOf(rw http.ResponseWriter, reqState *state.RequestState, parseResult *state.ParseResult, manifest *storage.BuildManifestSource, logger log.JsonLogger) bool {
+	if parseResult.AsOf == nil {
+		return true
+	}
+	if manifest == nil {
+		http.Error(rw, "Builds can't be selected by date", http.StatusBadRequest)
+		reqState.ResponseState = state.ResponseState_BadRequest
+		return false
+	}
+	buildID, ok, err := manifest.AsOf(*parseResult.AsOf)
+	if err != nil {
+		if !ok {
+			logger.Error(log.LogCategory_StorageError, "Failed to read build manifest: %s", err.Error())
+			http.Error(rw, "Internal server error", http.StatusInternalServerError)
+			reqState.ResponseState = state.ResponseState_Error
+			return false
+		}
+		logger.Warning(log.LogCategory_StorageError, "Failed to refresh build manifest: %s", err.Error())
+	}
+	if !ok {
+		http.Error(rw, fmt.Sprintf("No build as of %s", parseResult.AsOf.Format(time.RFC3339)), http.StatusNotFound)
+		reqState.ResponseState = state.ResponseState_NotFound
+		return false
+	}
+	parseResult.BuildID = buildID
+	reqState.Build = buildID
+	return true
+}
+
+// getStaleTile returns a stale copy of the vector tile from the cache, or
+// extracts it from a stale copy of the metatile, or returns nil when the
+// cache has neither.
+func getStaleTile(ctx context.Context, reqState *state.RequestState, tileCache cache.Cache, bufferManager buffer.BufferManager, parseResult *state.ParseResult, metaCoord, offset tile.TileCoord, options MetatileOptions, logger log.JsonLogger) *state.VectorTileResponseData {
+	staleCache, ok := tileCache.(cache.StaleCache)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, cacheTimeout)
+	defer cancel()
+
+	vectorData, err := staleCache.GetStaleTile(ctx, parseResult)
+	if err != nil {
+		logger.Warning(log.LogCategory_ResponseError, "Error checking stale vector cache: %+v", err)
+	}
+	if vectorData != nil {
+		return vectorData
+	}
+
+	metatileData, err := staleCache.GetStaleMetatile(ctx, parseResult, metaCoord)
+	if err != nil {
+		logger.Warning(log.LogCategory_ResponseError, "Error checking stale metatile cache: %+v", err)
+	}
+	if metatileData == nil || metatileData.ResponseState == state.ResponseState_NotFound || metatileData.ResponseState == state.ResponseState_NotModified {
+		return nil
+	}
+	metatileData.Offset = offset
+	vectorData, err = extractWithFallbacks(reqState, bufferManager, parseResult, metatileData, options)
+	if err != nil {
+		logger.Warning(log.LogCategory_MetatileError, "Failed to extract tile from stale metatile: %s", err.Error())
+		return nil
+	}
+	vectorData.ETag = metatileData.ETag
+	vectorData.LastModified = metatileData.LastModified
+	return vectorData
+}
+
+// fetchMetatile fetches the metatile from storage, in parts as it's read
+// when ranged and the storage can.
+func fetchMetatile(ctx context.Context, reqState *state.RequestState, stg storage.Storage, parseResult *state.ParseResult, metaCoord tile.TileCoord, ranged bool) (*state.MetatileResponseData, error) {
 	responseData := &state.MetatileResponseData{}
 
 	// Fetch the metatile zip file from storage
 	storageFetchStart := time.Now()
-	storageResult, err := stg.Fetch(metaCoord, parseResult.Cond, parseResult.BuildID)
+	fetch := storage.FetchContext
+	if ranged {
+		fetch = storage.FetchRanges
+	}
+	storageResult, err := fetch(ctx, stg, metaCoord, parseResult.Cond, parseResult.BuildID, parseResult.KeyVariables)
 	reqState.Duration.StorageFetch = time.Since(storageFetchStart)
 
 	if err != nil || storageResult.NotFound {
 		if err != nil {
+			var retried *storage.RetriedError
+			if errors.As(err, &retried) {
+				reqState.StorageRetries = retried.Retries
+			}
 			reqState.FetchState = state.FetchState_FetchError
+			if isArchived(err) {
+				reqState.FetchState = state.FetchState_Archived
+			}
 			reqState.ResponseState = state.ResponseState_Error
 			responseData.ResponseState = state.ResponseState_Error
 			return responseData, fmt.Errorf("metatile storage fetch failure: %w", err)
@@ -239,6 +786,8 @@ func fetchMetatile(reqState *state.RequestState, stg storage.Storage, parseResul
 	}
 
 	reqState.FetchState = state.FetchState_Success
+	reqState.StorageSource = storageResult.Source
+	reqState.StorageRetries = storageResult.Retries
 
 	if storageResult.NotModified {
 		reqState.ResponseState = state.ResponseState_NotModified
@@ -267,18 +816,90 @@ func fetchMetatile(reqState *state.RequestState, stg storage.Storage, parseResul
 
 	responseData.Data = storageBytes
 	responseData.BodySize = int64(len(storageBytes))
+	if storageResp.Ranges != nil {
+		responseData.Ranges = storageResp.Ranges
+		responseData.BodySize = int64(storageResp.Size)
+	}
 
 	return responseData, nil
 }
 
-func extractVectorTileFromMetatile(reqState *state.RequestState, bufferManager buffer.BufferManager, parseResult *state.ParseResult, data *state.MetatileResponseData) (*state.VectorTileResponseData, error) {
+// extractWithFallbacks extracts the requested tile from the metatile, or if
+// it has no entry for the tile, tries the fallback formats configured for
+// the requested one: first those served as they are, then those which are
+// transcoded, unless it's degraded.
+func extractWithFallbacks(reqState *state.RequestState, bufferManager buffer.BufferManager, parseResult *state.ParseResult, data *state.MetatileResponseData, options MetatileOptions) (*state.VectorTileResponseData, error) {
+	responseData, err := extractVectorTileFromMetatile(reqState, bufferManager, parseResult, data, options.DuplicateEntryPolicy)
+	requestedFormat := data.Offset.Format
+	fallbacks := options.FormatFallbacks[requestedFormat]
+	if !errors.Is(err, tile.ErrNoEntry) || len(fallbacks) == 0 {
+		return responseData, err
+	}
+
+	for _, transcoding := range []bool{false, true} {
+		if transcoding && (!options.Transcode || reqState.IsDegraded) {
+			break
+		}
+		for _, format := range fallbacks {
+			transcode := tile.Transcoder(format, requestedFormat)
+			if (transcode != nil) != transcoding {
+				continue
+			}
+
+			fallback := *data
+			fallback.Offset.Format = format
+			reqState.IsZipError = false
+			fallbackData, fallbackErr := extractVectorTileFromMetatile(reqState, bufferManager, parseResult, &fallback, options.DuplicateEntryPolicy)
+			if errors.Is(fallbackErr, tile.ErrNoEntry) {
+				continue
+			}
+			if fallbackErr != nil {
+				return fallbackData, fallbackErr
+			}
+
+			if transcode != nil {
+				coord := parseResult.AdditionalData.(*state.MetatileParseData).Coord
+				transcodeStart := time.Now()
+				fallbackData.Data, fallbackErr = transcode(coord, fallbackData.Data)
+				reqState.Duration.Transcode = time.Since(transcodeStart)
+				if fallbackErr != nil {
+					reqState.ResponseState = state.ResponseState_Error
+					fallbackData.ResponseState = state.ResponseState_Error
+					return fallbackData, fmt.Errorf("failed to transcode %s tile to %s: %w", format, requestedFormat, fallbackErr)
+				}
+				reqState.ResponseSize = len(fallbackData.Data)
+				reqState.IsTranscoded = true
+			}
+			reqState.FormatFallback = format
+			return fallbackData, nil
+		}
+	}
+
+	reqState.IsZipError = true
+	return responseData, err
+}
+
+// extractVectorTileFromMetatile reads the requested tile out of the
+// metatile, choosing between duplicate entries according to
+// duplicateEntryPolicy, where empty means first.
+func extractVectorTileFromMetatile(reqState *state.RequestState, bufferManager buffer.BufferManager, parseResult *state.ParseResult, data *state.MetatileResponseData, duplicateEntryPolicy string) (*state.VectorTileResponseData, error) {
 	responseData := &state.VectorTileResponseData{}
 	responseData.ContentType = parseResult.ContentType
 
 	// Set up the metatile reader to read the vector tile out of the metatile
 	metatileReaderFindStart := time.Now()
-	reader, formatSize, err := tile.NewMetatileReader(data.Offset, bytes.NewReader(data.Data), data.BodySize)
+	if duplicateEntryPolicy == "" {
+		duplicateEntryPolicy = tile.DuplicateEntryPolicy_First
+	}
+	var metatile io.ReaderAt = bytes.NewReader(data.Data)
+	if data.Ranges != nil {
+		metatile = data.Ranges
+	}
+	reader, formatSize, duplicates, err := tile.NewMetatileReaderWithPolicy(data.Offset, metatile, data.BodySize, duplicateEntryPolicy)
 	reqState.Duration.MetatileFind = time.Since(metatileReaderFindStart)
+	if duplicates > 0 {
+		reqState.IsDuplicateEntry = true
+	}
 	if err != nil {
 		reqState.IsZipError = true
 		reqState.ResponseState = state.ResponseState_Error
@@ -315,6 +936,9 @@ func writeVectorTileResponse(reqState *state.RequestState, rw http.ResponseWrite
 	headers := rw.Header()
 
 	headers.Set("Content-Type", vectorData.ContentType)
+	if vectorData.ContentEncoding != "" {
+		headers.Set("Content-Encoding", vectorData.ContentEncoding)
+	}
 	headers.Set("Content-Length", fmt.Sprintf("%d", len(vectorData.Data)))
 
 	if lastMod := vectorData.LastModified; lastMod != nil {
@@ -346,6 +970,31 @@ func writeVectorTileResponse(reqState *state.RequestState, rw http.ResponseWrite
 
 type MetatileMuxParser struct {
 	MimeMap map[string]string
+	// UnknownFormatContentType, if set, is the content type of formats
+	// missing from MimeMap, rather than them failing to parse.
+	UnknownFormatContentType string
+	// KeyQueryVariables are the query parameters allowed to be passed through
+	// to the storage key pattern, with the pattern their values must match.
+	KeyQueryVariables map[string]*regexp.Regexp
+	// KeyPathVariables are the route variables, other than the tile
+	// coordinate, passed through to the storage key pattern. Their values
+	// are constrained by the route's own patterns.
+	KeyPathVariables []string
+	// KeyHeaderVariables are the request headers passed through to the
+	// storage key pattern, by variable name. Responses vary by them.
+	KeyHeaderVariables map[string]*KeyHeaderVariable
+	// WrapX wraps X coordinates around the antimeridian to their canonical
+	// tile, rather than rejecting them as out of range.
+	WrapX bool
+	// CaptureHeaders are the request headers to record in the request state.
+	CaptureHeaders []string
+	// MaxURLLength rejects requests with a longer path and query, 0 for no
+	// limit.
+	MaxURLLength int
+	// CacheKeyParams, if set, are the only query parameters, besides
+	// api_key, which are read from requests. Their normalized values are
+	// part of the tile cache key and the X-Cache-Key-Params header.
+	CacheKeyParams []string
 }
 
 func (mp *MetatileMuxParser) Parse(req *http.Request) (*state.ParseResult, error) {
@@ -359,11 +1008,24 @@ func (mp *MetatileMuxParser) Parse(req *http.Request) (*state.ParseResult, error
 		Type:     state.ParseResultType_Metatile,
 		HttpData: ParseHttpData(req),
 	}
+	parseResult.HttpData.Headers = CaptureHeaders(req, mp.CaptureHeaders)
 	metatileData := &state.MetatileParseData{}
 	parseResult.AdditionalData = metatileData
 
+	if mp.MaxURLLength > 0 && len(req.URL.RequestURI()) > mp.MaxURLLength {
+		return parseResult, &ParseError{QueryError: &QueryParseError{Name: "url", Value: "too long"}}
+	}
+	if len(mp.CacheKeyParams) > 0 {
+		var normalized string
+		req, normalized = SignificantQuery(req, mp.CacheKeyParams)
+		parseResult.CacheKeyParams = &normalized
+	}
+
 	fmt := m["fmt"]
-	if contentType, ok = mp.MimeMap[fmt]; !ok {
+	if contentType, ok = mp.MimeMap[fmt]; !ok && mp.UnknownFormatContentType != "" {
+		contentType = mp.UnknownFormatContentType
+		metatileData.IsUnknownFormat = true
+	} else if !ok {
 		return parseResult, &ParseError{
 			MimeError: &MimeParseError{
 				BadFormat: fmt,
@@ -374,7 +1036,24 @@ func (mp *MetatileMuxParser) Parse(req *http.Request) (*state.ParseResult, error
 	t := &metatileData.Coord
 	t.Format = fmt
 
-	parseResult.BuildID = req.URL.Query().Get("buildid")
+	var queryErr *QueryParseError
+	parseResult.BuildID, queryErr = ParseBuildID(req)
+	if queryErr != nil {
+		return parseResult, &ParseError{QueryError: queryErr}
+	}
+	parseResult.AsOf, queryErr = ParseAsOf(req)
+	if queryErr != nil {
+		return parseResult, &ParseError{QueryError: queryErr}
+	}
+	if parseResult.AsOf != nil && parseResult.BuildID != "" {
+		return parseResult, &ParseError{QueryError: &QueryParseError{Name: "asof", Value: "can't be combined with buildid"}}
+	}
+	if hash, ok := m["hash"]; ok {
+		if !validContentHash.MatchString(hash) {
+			return parseResult, &ParseError{QueryError: &QueryParseError{Name: "hash", Value: hash}}
+		}
+		metatileData.ContentHash = hash
+	}
 
 	var coordError CoordParseError
 	z := m["z"]
@@ -395,11 +1074,48 @@ func (mp *MetatileMuxParser) Parse(req *http.Request) (*state.ParseResult, error
 		coordError.BadY = y
 	}
 
+	// only check the range once all the values have parsed
+	if !coordError.IsError() {
+		if mp.WrapX {
+			*t = t.WrapX()
+		}
+		coordError.OutOfRange = t.Validate()
+	}
+
 	if coordError.IsError() {
 		return parseResult, &ParseError{
 			CoordError: &coordError,
 		}
 	}
+
+	parseResult.KeyVariables, queryErr = ParseKeyVariables(req, mp.KeyQueryVariables)
+	if queryErr != nil {
+		return parseResult, &ParseError{QueryError: queryErr}
+	}
+	for _, name := range mp.KeyPathVariables {
+		value := m[name]
+		if value == "" {
+			continue
+		}
+		if parseResult.KeyVariables == nil {
+			parseResult.KeyVariables = make(map[string]string)
+		}
+		parseResult.KeyVariables[name] = value
+	}
+	headerVariables, queryErr := ParseKeyHeaderVariables(req, mp.KeyHeaderVariables)
+	if queryErr != nil {
+		return parseResult, &ParseError{QueryError: queryErr}
+	}
+	for name, value := range headerVariables {
+		if parseResult.KeyVariables == nil {
+			parseResult.KeyVariables = make(map[string]string)
+		}
+		parseResult.KeyVariables[name] = value
+	}
+	for _, variable := range mp.KeyHeaderVariables {
+		parseResult.KeyHeaders = append(parseResult.KeyHeaders, variable.Header)
+	}
+	sort.Strings(parseResult.KeyHeaders)
 	var condErr *CondParseError
 	parseResult.Cond, condErr = ParseCondition(req)
 	if condErr != nil {
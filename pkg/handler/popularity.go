@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/tilezen/tapalcatl/pkg/log"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+const (
+	// sketchDepth and sketchWidth size the count-min sketch of a
+	// TileTracker. With these, estimates exceed the true count by at most
+	// about 0.1% of all requests, with 98% confidence.
+	sketchDepth = 4
+	sketchWidth = 2048
+)
+
+// TileTracker keeps an approximate list of the most requested tiles, using a
+// count-min sketch to estimate how often each tile has been requested
+// without keeping a count for every one.
+type TileTracker struct {
+	size int
+
+	mu       sync.Mutex
+	sketch   [sketchDepth][sketchWidth]uint64
+	top      map[string]uint64
+	requests uint64
+}
+
+// NewTileTracker returns a tracker keeping the size most requested tiles.
+func NewTileTracker(size int) *TileTracker {
+	return &TileTracker{
+		size: size,
+		top:  make(map[string]uint64, size+1),
+	}
+}
+
+// Record counts a request for the tile.
+func (tt *TileTracker) Record(coord tile.TileCoord) {
+	key := coord.FileName()
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	// the rows are indexed by combinations of two halves of the hash
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	tt.requests++
+	estimate := ^uint64(0)
+	for i := range tt.sketch {
+		cell := &tt.sketch[i][(h1+uint32(i)*h2)%sketchWidth]
+		*cell++
+		if *cell < estimate {
+			estimate = *cell
+		}
+	}
+
+	if _, ok := tt.top[key]; ok || len(tt.top) < tt.size {
+		tt.top[key] = estimate
+		return
+	}
+	minKey, minCount := "", ^uint64(0)
+	for k, count := range tt.top {
+		if count < minCount {
+			minKey, minCount = k, count
+		}
+	}
+	if estimate > minCount {
+		delete(tt.top, minKey)
+		tt.top[key] = estimate
+	}
+}
+
+// HotTile is a tile and the estimated number of requests for it.
+type HotTile struct {
+	Tile  string `json:"tile"`
+	Count uint64 `json:"count"`
+}
+
+// HotTiles is a snapshot of the most requested tiles of a pattern.
+type HotTiles struct {
+	// Requests is the number of tile requests recorded in all.
+	Requests uint64    `json:"requests"`
+	Tiles    []HotTile `json:"tiles"`
+}
+
+// Hot returns the most requested tiles, most requested first.
+func (tt *TileTracker) Hot() *HotTiles {
+	tt.mu.Lock()
+	hot := &HotTiles{
+		Requests: tt.requests,
+		Tiles:    make([]HotTile, 0, len(tt.top)),
+	}
+	for k, count := range tt.top {
+		hot.Tiles = append(hot.Tiles, HotTile{Tile: k, Count: count})
+	}
+	tt.mu.Unlock()
+
+	sort.Slice(hot.Tiles, func(i, j int) bool {
+		if hot.Tiles[i].Count != hot.Tiles[j].Count {
+			return hot.Tiles[i].Count > hot.Tiles[j].Count
+		}
+		return hot.Tiles[i].Tile < hot.Tiles[j].Tile
+	})
+	return hot
+}
+
+// HotTilesHandler serves the most requested tiles of each pattern, or of the
+// one given by the "pattern" parameter, limited to "limit" tiles each.
+func HotTilesHandler(trackers map[string]*TileTracker, logger log.JsonLogger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		limit := 0
+		if value := q.Get("limit"); value != "" {
+			var err error
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 1 {
+				http.Error(rw, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+
+		result := make(map[string]*HotTiles, len(trackers))
+		for pattern, tracker := range trackers {
+			if p := q.Get("pattern"); p != "" && p != pattern {
+				continue
+			}
+			hot := tracker.Hot()
+			if limit > 0 && len(hot.Tiles) > limit {
+				hot.Tiles = hot.Tiles[:limit]
+			}
+			result[pattern] = hot
+		}
+		if p := q.Get("pattern"); p != "" && len(result) == 0 {
+			http.Error(rw, "Unknown pattern", http.StatusNotFound)
+			return
+		}
+		writeJson(rw, logger, result)
+	})
+}
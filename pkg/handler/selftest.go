@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tilezen/tapalcatl/pkg/buffer"
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/storage"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// SelfTestMetatile fetches the metatile containing the given coordinate from
+// storage and extracts the tile from it, exercising the same path as a real
+// request. It returns an error describing the first step which failed.
+func SelfTestMetatile(coord tile.TileCoord, metatileSize, tileSize, metatileMaxDetailZoom int, stg storage.Storage, bufferManager buffer.BufferManager) error {
+	metaCoord, offset, err := coord.MetaAndOffset(metatileSize, tileSize, metatileMaxDetailZoom)
+	if err != nil {
+		return fmt.Errorf("MetaAndOffset could not be calculated: %w", err)
+	}
+
+	reqState := &state.RequestState{}
+	parseResult := &state.ParseResult{
+		Type:           state.ParseResultType_Metatile,
+		AdditionalData: &state.MetatileParseData{Coord: coord},
+	}
+
+	metatileResponseData, err := fetchMetatile(context.Background(), reqState, stg, parseResult, metaCoord, false)
+	if err != nil {
+		return err
+	}
+	if metatileResponseData.ResponseState == state.ResponseState_NotFound {
+		return fmt.Errorf("metatile %s not found in storage", metaCoord.FileName())
+	}
+
+	metatileResponseData.Offset = offset
+	_, err = extractVectorTileFromMetatile(reqState, bufferManager, parseResult, metatileResponseData, tile.DuplicateEntryPolicy_First)
+	return err
+}
+
+// SelfTestTileJson fetches the tilejson for the given format from storage.
+func SelfTestTileJson(format state.TileJsonFormat, stg storage.Storage) error {
+	storageResult, err := stg.TileJson(format, state.Condition{}, "")
+	if err != nil {
+		return fmt.Errorf("tilejson storage fetch failure: %w", err)
+	}
+	if storageResult.NotFound {
+		return fmt.Errorf("tilejson %s not found in storage", format.Name())
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"path"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+)
+
+// Tenant is a customer served its own tiles, identified by the API key of
+// its requests.
+type Tenant struct {
+	Name string
+	// Prefix overrides the storage prefix of all the tenant's requests.
+	// Builds selected with buildid or asof are found under it.
+	Prefix string
+}
+
+type tenantContextKey struct{}
+
+// WithTenant returns a context for a request made by the tenant.
+func WithTenant(ctx context.Context, tenant *Tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant making the request, if any.
+func TenantFromContext(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value(tenantContextKey{}).(*Tenant)
+	return tenant
+}
+
+// applyTenant confines the prefix override of a tenant's request to the
+// tenant's prefix. As ParseBuildID rejects ".." segments, the request can't
+// reach the prefixes of other tenants, and is cached separately from them.
+func applyTenant(req *http.Request, parseResult *state.ParseResult) {
+	if tenant := TenantFromContext(req.Context()); tenant != nil {
+		parseResult.BuildID = path.Join(tenant.Prefix, parseResult.BuildID)
+	}
+}
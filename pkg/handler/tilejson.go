@@ -13,9 +13,22 @@ import (
 	"github.com/tilezen/tapalcatl/pkg/storage"
 )
 
+// TileJsonOptions holds the optional settings of a TileJsonHandler. The zero
+// value gives the default behaviour.
+type TileJsonOptions struct {
+	// TimingUnit is one of the state.TimingUnit_ constants, the unit of the
+	// logged timings, default milliseconds.
+	TimingUnit string
+}
+
 func TileJsonHandler(p state.Parser, stg storage.Storage, mw metrics.MetricsWriter, logger log.JsonLogger) http.Handler {
+	return TileJsonHandlerWithOptions(p, stg, mw, logger, TileJsonOptions{})
+}
+
+func TileJsonHandlerWithOptions(p state.Parser, stg storage.Storage, mw metrics.MetricsWriter, logger log.JsonLogger, options TileJsonOptions) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		tileJsonReqState := state.TileJsonRequestState{}
+		logger := log.ForRequest(req.Context(), logger)
+		tileJsonReqState := state.TileJsonRequestState{TimingUnit: options.TimingUnit}
 
 		startTime := time.Now()
 
@@ -23,7 +36,7 @@ func TileJsonHandler(p state.Parser, stg storage.Storage, mw metrics.MetricsWrit
 			totalDuration := time.Since(startTime)
 			tileJsonReqState.Duration.Total = totalDuration
 
-			logger.TileJson(tileJsonReqState.AsJsonMap())
+			log.TileJson(logger, &tileJsonReqState)
 
 			mw.WriteTileJsonState(&tileJsonReqState)
 		}()
@@ -43,6 +56,11 @@ func TileJsonHandler(p state.Parser, stg storage.Storage, mw metrics.MetricsWrit
 				http.Error(rw, "Not Found", http.StatusNotFound)
 				logger.Warning(log.LogCategory_ParseError, "foo bar!")
 				return
+			case *QueryParseError:
+				tileJsonReqState.ResponseState = state.ResponseState_BadRequest
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				logger.Warning(log.LogCategory_ParseError, err.Error())
+				return
 			case *CondParseError:
 				logger.Warning(log.LogCategory_ConditionError, err.Error())
 				tileJsonReqState.IsCondError = true
@@ -52,6 +70,8 @@ func TileJsonHandler(p state.Parser, stg storage.Storage, mw metrics.MetricsWrit
 			}
 		}
 		tileJsonReqState.HttpData = parseResult.HttpData
+		tileJsonReqState.Build = parseResult.BuildID
+		applyTenant(req, parseResult)
 		tileJsonData := parseResult.AdditionalData.(*TileJsonParseData)
 		tileJsonReqState.Format = &tileJsonData.Format
 
@@ -110,7 +130,13 @@ type TileJsonParseData struct {
 	Format state.TileJsonFormat
 }
 
-type TileJsonParser struct{}
+type TileJsonParser struct {
+	// CaptureHeaders are the request headers to record in the request state.
+	CaptureHeaders []string
+	// Formats maps the format names requested to the documents in storage,
+	// default the builtin formats.
+	Formats map[string]state.TileJsonFormat
+}
 
 func (tp *TileJsonParser) Parse(req *http.Request) (*state.ParseResult, error) {
 	parseResult := &state.ParseResult{
@@ -118,9 +144,17 @@ func (tp *TileJsonParser) Parse(req *http.Request) (*state.ParseResult, error) {
 		ContentType: "application/json",
 		HttpData:    ParseHttpData(req),
 	}
+	parseResult.HttpData.Headers = CaptureHeaders(req, tp.CaptureHeaders)
 	m := mux.Vars(req)
 	formatName := m["fmt"]
-	tileJsonFormat := state.NewTileJsonFormat(formatName)
+	var tileJsonFormat *state.TileJsonFormat
+	if tp.Formats != nil {
+		if format, ok := tp.Formats[formatName]; ok {
+			tileJsonFormat = &format
+		}
+	} else {
+		tileJsonFormat = state.NewTileJsonFormat(formatName)
+	}
 	if tileJsonFormat == nil {
 		return parseResult, &TileJsonParseError{
 			InvalidFormat: &formatName,
@@ -128,6 +162,11 @@ func (tp *TileJsonParser) Parse(req *http.Request) (*state.ParseResult, error) {
 	}
 	tileJsonData := &TileJsonParseData{Format: *tileJsonFormat}
 	parseResult.AdditionalData = tileJsonData
+	var queryErr *QueryParseError
+	parseResult.BuildID, queryErr = ParseBuildID(req)
+	if queryErr != nil {
+		return parseResult, queryErr
+	}
 	var condErr *CondParseError
 	parseResult.Cond, condErr = ParseCondition(req)
 	if condErr != nil {
@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+)
+
+// serverTiming formats the durations of the phases the request went through
+// as a Server-Timing header value. Phases which weren't run are left out, and
+// writing the response can't be included as it happens after the headers.
+func serverTiming(d *state.ReqDuration) string {
+	phases := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"queue", d.Queue},
+		{"parse", d.Parse},
+		{"vector-cache", d.VectorCacheLookup},
+		{"metatile-cache", d.MetatileCacheLookup},
+		{"fetch", d.StorageFetch},
+		{"extract", d.MetatileFind},
+		{"transcode", d.Transcode},
+	}
+
+	var entries []string
+	for _, phase := range phases {
+		if phase.duration > 0 {
+			ms := float64(phase.duration) / float64(time.Millisecond)
+			entries = append(entries, fmt.Sprintf("%s;dur=%.3f", phase.name, ms))
+		}
+	}
+	return strings.Join(entries, ", ")
+}
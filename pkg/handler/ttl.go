@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ZoomTTL sets how long tiles for zooms between MinZoom and MaxZoom
+// inclusive are cached, both by the tile cache and by clients.
+type ZoomTTL struct {
+	MinZoom int
+	MaxZoom int
+	TTL     time.Duration
+}
+
+// ttlForZoom returns the TTL of the first band in the schedule containing z,
+// or false if there is none.
+func ttlForZoom(schedule []ZoomTTL, z int) (time.Duration, bool) {
+	for _, band := range schedule {
+		if z >= band.MinZoom && z <= band.MaxZoom {
+			return band.TTL, true
+		}
+	}
+	return 0, false
+}
+
+// jitterTTL shortens the TTL by a random fraction of it, up to jitter, so that
+// entries written together, eg. as a new build is first requested, don't all
+// expire together and stampede storage.
+func jitterTTL(ttl time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return ttl
+	}
+	return ttl - time.Duration(rand.Float64()*jitter*float64(ttl))
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/log"
+	"github.com/tilezen/tapalcatl/pkg/metrics"
+	"github.com/tilezen/tapalcatl/pkg/state"
+)
+
+// Watchdog checks that the background workers sending metrics and setting
+// the cache are making progress, so that a worker blocked on an endpoint
+// which has gone away doesn't silently lose everything queued behind it.
+type Watchdog struct {
+	// Stall is how long a worker can go without progress before it's
+	// restarted.
+	Stall         time.Duration
+	MetricsWriter metrics.MetricsWriter
+	Logger        log.JsonLogger
+}
+
+// Check restarts any worker which has stalled, returning what it found.
+func (wd *Watchdog) Check() []*state.WatchdogState {
+	var stalled []*state.WatchdogState
+
+	// cache sets are checked first so that their stall is counted by a
+	// restarted metrics worker
+	if d := CacheSetsStalled(); d >= wd.Stall {
+		// each cache set runs on its own goroutine with a timeout, so there's
+		// nothing to replace, but abandoning them stops shutdown waiting on
+		// writes which are never going to complete
+		stalled = append(stalled, &state.WatchdogState{
+			Worker:    "cache-set",
+			Stalled:   d,
+			Pending:   AbandonCacheSets(),
+			Restarted: true,
+		})
+	}
+
+	if wmw, ok := wd.MetricsWriter.(metrics.WatchedMetricsWriter); ok {
+		if d := wmw.Stalled(); d >= wd.Stall {
+			pending := int64(wmw.QueueLength())
+			wmw.RestartWorker()
+			stalled = append(stalled, &state.WatchdogState{
+				Worker:    "metrics",
+				Stalled:   d,
+				Pending:   pending,
+				Restarted: true,
+			})
+		}
+	}
+
+	for _, ws := range stalled {
+		logData := ws.AsJsonMap()
+		logData["type"] = "error"
+		logData["category"] = log.LogCategory_Watchdog.String()
+		wd.Logger.Log(logData)
+		wd.MetricsWriter.WriteWatchdogState(ws)
+	}
+	return stalled
+}
+
+// Run checks the workers periodically until stop is closed.
+func (wd *Watchdog) Run(stop <-chan struct{}) {
+	// check often enough that a stall is noticed within half as long again
+	ticker := time.NewTicker(wd.Stall / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			wd.Check()
+		case <-stop:
+			return
+		}
+	}
+}
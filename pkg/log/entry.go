@@ -0,0 +1,117 @@
+package log
+
+import (
+	"sync"
+	"unicode/utf8"
+)
+
+// Entry is a log line for a request, such as its metrics, which can append
+// its fields as JSON directly rather than building a map for json.Marshal.
+// Both must give the same fields.
+type Entry interface {
+	AsJsonMap() map[string]interface{}
+	// AppendJsonFields appends the members of the entry's JSON object to
+	// buf, each preceded by a comma, for a logger to add to its own.
+	AppendJsonFields(buf []byte) []byte
+}
+
+// EntryLogger is implemented by loggers which can write an Entry's JSON
+// fields directly.
+type EntryLogger interface {
+	LogEntry(category LogCategory, entry Entry)
+}
+
+// Metrics logs a metatile request's metrics, without building a map of them
+// when the logger can write them directly.
+func Metrics(logger JsonLogger, entry Entry) {
+	if el, ok := logger.(EntryLogger); ok {
+		el.LogEntry(LogCategory_Metrics, entry)
+		return
+	}
+	logger.Metrics(entry.AsJsonMap())
+}
+
+// TileJson logs a tilejson request's metrics like Metrics.
+func TileJson(logger JsonLogger, entry Entry) {
+	if el, ok := logger.(EntryLogger); ok {
+		el.LogEntry(LogCategory_TileJson, entry)
+		return
+	}
+	logger.TileJson(entry.AsJsonMap())
+}
+
+// entryBufPool holds the buffers entries are written to, which are a similar
+// size for every request.
+var entryBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 1024)
+		return &buf
+	},
+}
+
+func (l *JsonLoggerImpl) LogEntry(category LogCategory, entry Entry) {
+	bufp := entryBufPool.Get().(*[]byte)
+	buf := append((*bufp)[:0], `{"type":"info","category":`...)
+	buf = AppendJsonString(buf, category.String())
+	buf = append(buf, `,"hostname":`...)
+	buf = AppendJsonString(buf, l.Hostname)
+	buf = entry.AppendJsonFields(buf)
+	buf = append(buf, '}')
+	l.Logger.Output(2, string(buf))
+	*bufp = buf
+	entryBufPool.Put(bufp)
+}
+
+func (_ *NilJsonLogger) LogEntry(_ LogCategory, _ Entry) {}
+
+const hexDigits = "0123456789abcdef"
+
+// AppendJsonString appends s to buf as a JSON string, escaped as json.Marshal
+// would.
+func AppendJsonString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				buf = append(buf, '\\', b)
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
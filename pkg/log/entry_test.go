@@ -0,0 +1,66 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	golog "log"
+	"testing"
+)
+
+func TestAppendJsonString(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"plain",
+		"quote \" backslash \\ slash /",
+		"<script>&amp;</script>",
+		"control \n\r\t\x00\x1f",
+		"unicode \u00e9 \u65e5\u672c \u2028 \u2029",
+		"invalid \xff\xfe utf-8",
+	} {
+		expected, err := json.Marshal(s)
+		if err != nil {
+			t.Fatalf("Unable to marshal %#v: %s", s, err.Error())
+		}
+		if actual := AppendJsonString(nil, s); !bytes.Equal(actual, expected) {
+			t.Fatalf("Expected %#v to be written as %s, got %s", s, expected, actual)
+		}
+	}
+}
+
+type testEntry map[string]interface{}
+
+func (e testEntry) AsJsonMap() map[string]interface{} {
+	return e
+}
+
+func (e testEntry) AppendJsonFields(buf []byte) []byte {
+	for k, v := range e {
+		buf = append(buf, ',')
+		buf = AppendJsonString(buf, k)
+		buf = append(buf, ':')
+		buf = AppendJsonString(buf, v.(string))
+	}
+	return buf
+}
+
+func TestLogEntry(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewJsonLogger(golog.New(&out, "", 0), "host")
+	entry := testEntry{"path": "/0/0/0.mvt"}
+
+	Metrics(logger, entry)
+	direct := out.String()
+	out.Reset()
+	logger.Metrics(testEntry{"path": "/0/0/0.mvt"})
+
+	var expected, actual map[string]interface{}
+	if err := json.Unmarshal([]byte(direct), &actual); err != nil {
+		t.Fatalf("Invalid JSON logged: %s in %s", err.Error(), direct)
+	}
+	if err := json.Unmarshal(out.Bytes(), &expected); err != nil {
+		t.Fatalf("Invalid JSON logged: %s in %s", err.Error(), out.String())
+	}
+	if len(actual) != 4 || actual["path"] != expected["path"] || actual["category"] != "metrics" || actual["type"] != "info" || actual["hostname"] != "host" {
+		t.Fatalf("Expected entry to be logged like its map %v, got %v", expected, actual)
+	}
+}
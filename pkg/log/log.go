@@ -29,6 +29,10 @@ const (
 	LogCategory_Metrics
 	LogCategory_ExpVars
 	LogCategory_TileJson
+	LogCategory_Shutdown
+	LogCategory_Watchdog
+	LogCategory_WorkerExit
+	LogCategory_Mirror
 )
 
 func (lc LogCategory) String() string {
@@ -55,6 +59,14 @@ func (lc LogCategory) String() string {
 		return "expvars"
 	case LogCategory_TileJson:
 		return "tilejson"
+	case LogCategory_Shutdown:
+		return "shutdown"
+	case LogCategory_Watchdog:
+		return "watchdog"
+	case LogCategory_WorkerExit:
+		return "worker_exit"
+	case LogCategory_Mirror:
+		return "mirror"
 	}
 	panic(fmt.Sprintf("Unknown json category: %d\n", int32(lc)))
 }
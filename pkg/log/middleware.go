@@ -1,16 +1,62 @@
 package log
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
 	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// AccessLogFormat_Common is the Common Log Format of Apache and others.
+	AccessLogFormat_Common = "common"
+	// AccessLogFormat_Combined is the Common Log Format followed by the
+	// referer and user agent.
+	AccessLogFormat_Combined = "combined"
+)
+
+// clfTimeFormat is the timestamp layout of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// LoggingOptions holds the optional settings of LoggingMiddlewareWithOptions.
+// The zero value only logs the JSON line for each request.
+type LoggingOptions struct {
+	// AccessLogFormat is one of the AccessLogFormat_ constants to also write
+	// a line for each request in, or empty for none.
+	AccessLogFormat string
+	// AccessLog receives the access log lines, default os.Stdout.
+	AccessLog io.Writer
+	// OmitJson leaves out the JSON line for each request, when the access
+	// log replaces it.
+	OmitJson bool
+	// Consolidate logs the metrics, warnings and errors of handlers using
+	// ForRequest in the JSON line for the request, rather than on their own.
+	Consolidate bool
+}
+
+// IsValidAccessLogFormat returns true when format is one of the
+// AccessLogFormat_ constants.
+func IsValidAccessLogFormat(format string) bool {
+	switch format {
+	case AccessLogFormat_Common, AccessLogFormat_Combined:
+		return true
+	}
+	return false
+}
+
 // responseWriter is a minimal wrapper for http.ResponseWriter that allows the
-// written HTTP status code to be captured for logging.
+// written HTTP status code and body size to be captured for logging.
 type responseWriter struct {
 	http.ResponseWriter
 	status      int
+	size        int64
 	wroteHeader bool
 }
 
@@ -34,14 +80,78 @@ func (rw *responseWriter) WriteHeader(code int) {
 	return
 }
 
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.size += int64(n)
+	return n, err
+}
+
+// clfField returns the value for a Common Log Format field, which is "-"
+// when empty.
+func clfField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// formatAccessLog formats the request as a line in the Common or Combined
+// Log Format.
+func formatAccessLog(format string, r *http.Request, status int, size int64, t time.Time) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	var user string
+	if r.URL.User != nil {
+		user = r.URL.User.Username()
+	}
+	sizeField := "-"
+	if size > 0 {
+		sizeField = strconv.FormatInt(size, 10)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s",
+		clfField(host), clfField(user), t.Format(clfTimeFormat),
+		strconv.Quote(fmt.Sprintf("%s %s %s", r.Method, r.URL.RequestURI(), r.Proto)),
+		status, sizeField)
+	if format == AccessLogFormat_Combined {
+		line += fmt.Sprintf(" %s %s", strconv.Quote(r.Referer()), strconv.Quote(r.UserAgent()))
+	}
+	return line + "\n"
+}
+
+type skipContextKey struct{}
+
+// SkipRequestLog stops the logging middleware writing the JSON line for the
+// request, eg. when its handler samples the requests it logs. The access log
+// line is still written.
+func SkipRequestLog(ctx context.Context) {
+	if skip, ok := ctx.Value(skipContextKey{}).(*int32); ok {
+		atomic.StoreInt32(skip, 1)
+	}
+}
+
 func LoggingMiddleware(logger JsonLogger) func(http.Handler) http.Handler {
+	return LoggingMiddlewareWithOptions(logger, LoggingOptions{})
+}
+
+func LoggingMiddlewareWithOptions(logger JsonLogger, options LoggingOptions) func(http.Handler) http.Handler {
+	if options.AccessLog == nil {
+		options.AccessLog = os.Stdout
+	}
+	var accessLogMu sync.Mutex
+
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			defer func() {
 				if err := recover(); err != nil {
 					w.WriteHeader(http.StatusInternalServerError)
 					logger.Log(map[string]interface{}{
-						"err": err,
+						"err":   err,
 						"trace": debug.Stack(),
 					})
 				}
@@ -49,13 +159,41 @@ func LoggingMiddleware(logger JsonLogger) func(http.Handler) http.Handler {
 
 			start := time.Now()
 			wrapped := wrapResponseWriter(w)
+			var record *Record
+			if options.Consolidate {
+				var ctx context.Context
+				ctx, record = WithRecord(r.Context())
+				r = r.WithContext(ctx)
+			}
+			var skip int32
+			if !options.OmitJson {
+				r = r.WithContext(context.WithValue(r.Context(), skipContextKey{}, &skip))
+			}
 			next.ServeHTTP(wrapped, r)
-			logger.Log(map[string]interface{}{
-				"status": wrapped.status,
-				"method": r.Method,
-				"path": r.URL.EscapedPath(),
-				"duration": time.Since(start),
-			})
+			if !options.OmitJson && atomic.LoadInt32(&skip) == 0 {
+				fields := map[string]interface{}{}
+				if record != nil {
+					fields = record.Fields()
+					fields["type"] = "info"
+					if _, ok := fields["category"]; !ok {
+						fields["category"] = "request"
+					}
+				}
+				fields["status"] = wrapped.status
+				fields["method"] = r.Method
+				fields["path"] = r.URL.EscapedPath()
+				fields["duration"] = time.Since(start)
+				logger.Log(fields)
+			}
+			if options.AccessLogFormat != "" {
+				line := formatAccessLog(options.AccessLogFormat, r, wrapped.status, wrapped.size, start)
+				accessLogMu.Lock()
+				_, err := io.WriteString(options.AccessLog, line)
+				accessLogMu.Unlock()
+				if err != nil {
+					logger.Error(LogCategory_ResponseError, "Failed to write access log: %s", err.Error())
+				}
+			}
 		}
 
 		return http.HandlerFunc(fn)
@@ -0,0 +1,102 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	golog "log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoggingMiddlewareAccessLog(t *testing.T) {
+	var jsonLog, accessLog bytes.Buffer
+	logger := NewJsonLogger(golog.New(&jsonLog, "", 0), "test")
+
+	serve := func(options LoggingOptions) {
+		h := LoggingMiddlewareWithOptions(logger, options)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte("not found"))
+		}))
+		req := httptest.NewRequest("GET", "/osm/0/0/0.mvt?api_key=abc", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Referer", "https://example.com/")
+		req.Header.Set("User-Agent", `test "agent"`)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve(LoggingOptions{AccessLogFormat: AccessLogFormat_Combined, AccessLog: &accessLog})
+	line := accessLog.String()
+	if !strings.HasPrefix(line, "192.0.2.1 - - [") {
+		t.Fatalf("Expected access log to start with the client address, got %#v", line)
+	}
+	expSuffix := `] "GET /osm/0/0/0.mvt?api_key=abc HTTP/1.1" 404 9 "https://example.com/" "test \"agent\""` + "\n"
+	if !strings.HasSuffix(line, expSuffix) {
+		t.Fatalf("Expected combined log line ending %#v, got %#v", expSuffix, line)
+	}
+	if jsonLog.Len() == 0 {
+		t.Fatalf("Expected the JSON line to be logged too")
+	}
+
+	accessLog.Reset()
+	jsonLog.Reset()
+	serve(LoggingOptions{AccessLogFormat: AccessLogFormat_Common, AccessLog: &accessLog, OmitJson: true})
+	if line := accessLog.String(); !strings.HasSuffix(line, `"GET /osm/0/0/0.mvt?api_key=abc HTTP/1.1" 404 9`+"\n") {
+		t.Fatalf("Expected common log line, got %#v", line)
+	}
+	if jsonLog.Len() != 0 {
+		t.Fatalf("Expected the JSON line to be omitted, got %#v", jsonLog.String())
+	}
+}
+
+func TestLoggingMiddlewareConsolidate(t *testing.T) {
+	var jsonLog bytes.Buffer
+	logger := NewJsonLogger(golog.New(&jsonLog, "", 0), "test")
+
+	h := LoggingMiddlewareWithOptions(logger, LoggingOptions{Consolidate: true})(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		reqLogger := ForRequest(req.Context(), logger)
+		reqLogger.Warning(LogCategory_StorageError, "Slow fetch: %d", 1)
+		reqLogger.Metrics(map[string]interface{}{"format": "mvt"})
+		rw.WriteHeader(http.StatusOK)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/osm/0/0/0.mvt", nil))
+
+	lines := strings.Split(strings.TrimSpace(jsonLog.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected a single log line, got %#v", lines)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &fields); err != nil {
+		t.Fatalf("Unable to parse log line: %s", err.Error())
+	}
+	if fields["format"] != "mvt" || fields["category"] != "metrics" || fields["status"] != float64(200) {
+		t.Fatalf("Expected metrics and request fields in the log line, got %#v", fields)
+	}
+	messages, ok := fields["messages"].([]interface{})
+	if !ok || len(messages) != 1 || messages[0].(map[string]interface{})["message"] != "Slow fetch: 1" {
+		t.Fatalf("Expected the warning in the log line, got %#v", fields["messages"])
+	}
+
+	// without a record the request logger is the logger itself
+	if ForRequest(httptest.NewRequest("GET", "/", nil).Context(), logger) != logger {
+		t.Fatalf("Expected the logger to be used as is outside a consolidated request")
+	}
+}
+
+func TestLoggingMiddlewareSkipRequestLog(t *testing.T) {
+	var jsonLog, accessLog bytes.Buffer
+	logger := NewJsonLogger(golog.New(&jsonLog, "", 0), "test")
+
+	h := LoggingMiddlewareWithOptions(logger, LoggingOptions{AccessLogFormat: AccessLogFormat_Common, AccessLog: &accessLog})(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		SkipRequestLog(req.Context())
+		http.NotFound(rw, req)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/osm/16/0/0.mvt", nil))
+	if jsonLog.Len() != 0 {
+		t.Fatalf("Expected the JSON line to be skipped, got %#v", jsonLog.String())
+	}
+	if accessLog.Len() == 0 {
+		t.Fatalf("Expected the access log line to be written")
+	}
+}
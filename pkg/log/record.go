@@ -0,0 +1,101 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+type recordContextKey struct{}
+
+// Record collects what is logged while handling a request, so that it can be
+// written as a single line along with the request's status and duration.
+type Record struct {
+	mu       sync.Mutex
+	fields   map[string]interface{}
+	messages []map[string]interface{}
+}
+
+// WithRecord returns a context carrying a new record for the request.
+func WithRecord(ctx context.Context) (context.Context, *Record) {
+	record := &Record{fields: make(map[string]interface{})}
+	return context.WithValue(ctx, recordContextKey{}, record), record
+}
+
+// RecordFromContext returns the request's record, or nil if its log lines
+// aren't being consolidated.
+func RecordFromContext(ctx context.Context) *Record {
+	record, _ := ctx.Value(recordContextKey{}).(*Record)
+	return record
+}
+
+func (r *Record) addFields(fields map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, v := range fields {
+		r.fields[k] = v
+	}
+}
+
+func (r *Record) addMessage(level string, category LogCategory, msg string, xs ...interface{}) {
+	if len(xs) > 0 {
+		msg = fmt.Sprintf(msg, xs...)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, map[string]interface{}{
+		"type":     level,
+		"category": category.String(),
+		"message":  msg,
+	})
+}
+
+// Fields returns the fields recorded for the request, with any warnings and
+// errors under "messages".
+func (r *Record) Fields() map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fields := make(map[string]interface{}, len(r.fields)+1)
+	for k, v := range r.fields {
+		fields[k] = v
+	}
+	if len(r.messages) > 0 {
+		fields["messages"] = r.messages
+	}
+	return fields
+}
+
+// recordLogger adds the request's metrics, warnings and errors to its record
+// rather than logging them on their own lines.
+type recordLogger struct {
+	JsonLogger
+	record *Record
+}
+
+func (l *recordLogger) Warning(category LogCategory, msg string, xs ...interface{}) {
+	l.record.addMessage("warning", category, msg, xs...)
+}
+
+func (l *recordLogger) Error(category LogCategory, msg string, xs ...interface{}) {
+	l.record.addMessage("error", category, msg, xs...)
+}
+
+func (l *recordLogger) Metrics(metricsData map[string]interface{}) {
+	metricsData["category"] = LogCategory_Metrics.String()
+	l.record.addFields(metricsData)
+}
+
+func (l *recordLogger) TileJson(metricsData map[string]interface{}) {
+	metricsData["category"] = LogCategory_TileJson.String()
+	l.record.addFields(metricsData)
+}
+
+// ForRequest returns the logger to use while handling the request, which
+// adds to the request's record if it has one.
+func ForRequest(ctx context.Context, logger JsonLogger) JsonLogger {
+	record := RecordFromContext(ctx)
+	if record == nil {
+		return logger
+	}
+	return &recordLogger{JsonLogger: logger, record: record}
+}
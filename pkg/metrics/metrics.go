@@ -1,13 +1,45 @@
 package metrics
 
-import "github.com/tilezen/tapalcatl/pkg/state"
+import (
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+)
 
 type MetricsWriter interface {
 	WriteMetatileState(*state.RequestState)
 	WriteTileJsonState(*state.TileJsonRequestState)
+	WriteReplicaFetchState(*state.ReplicaFetchState)
+	WriteStorageFetchState(*state.StorageFetchState)
+	WriteDrainState(*state.DrainState)
+	WriteWatchdogState(*state.WatchdogState)
+	WriteMirrorState(*state.MirrorState)
+}
+
+// QueuedMetricsWriter is implemented by metrics writers which buffer metrics
+// before sending them.
+type QueuedMetricsWriter interface {
+	QueueLength() int
+}
+
+// WatchedMetricsWriter is implemented by metrics writers whose worker can be
+// restarted by a watchdog when it stops making progress.
+type WatchedMetricsWriter interface {
+	QueuedMetricsWriter
+	// Stalled returns how long the worker has been sending the same
+	// metrics, or 0 if it's idle.
+	Stalled() time.Duration
+	// RestartWorker replaces the worker, abandoning the metrics it's
+	// sending.
+	RestartWorker()
 }
 
 type NilMetricsWriter struct{}
 
-func (_ *NilMetricsWriter) WriteMetatileState(reqState *state.RequestState)             {}
-func (_ *NilMetricsWriter) WriteTileJsonState(jsonReqState *state.TileJsonRequestState) {}
+func (_ *NilMetricsWriter) WriteMetatileState(reqState *state.RequestState)              {}
+func (_ *NilMetricsWriter) WriteTileJsonState(jsonReqState *state.TileJsonRequestState)  {}
+func (_ *NilMetricsWriter) WriteReplicaFetchState(replicaState *state.ReplicaFetchState) {}
+func (_ *NilMetricsWriter) WriteStorageFetchState(storageState *state.StorageFetchState) {}
+func (_ *NilMetricsWriter) WriteDrainState(drainState *state.DrainState)                 {}
+func (_ *NilMetricsWriter) WriteWatchdogState(watchdogState *state.WatchdogState)        {}
+func (_ *NilMetricsWriter) WriteMirrorState(mirrorState *state.MirrorState)              {}
@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// MetricNaming_Legacy writes only the original metric names.
+	MetricNaming_Legacy = "legacy"
+	// MetricNaming_Normalized writes only the normalized metric names.
+	MetricNaming_Normalized = "normalized"
+	// MetricNaming_Both writes every metric under both names, so that
+	// dashboards can be migrated without a gap.
+	MetricNaming_Both = "both"
+)
+
+// IsValidMetricNaming returns true when naming is one of the MetricNaming_ constants.
+func IsValidMetricNaming(naming string) bool {
+	switch naming {
+	case MetricNaming_Legacy, MetricNaming_Normalized, MetricNaming_Both:
+		return true
+	}
+	return false
+}
+
+// normalizedPrefixes maps prefixes of legacy metric names to their
+// normalized equivalents. The normalized scheme groups metrics by what they
+// measure, uses "." only between segments and "_" within them:
+//
+//	count                                 requests.total
+//	metatile                              requests.metatile
+//	tilejson                              requests.tilejson
+//	formats.<fmt>                         requests.format.<fmt>
+//	tilejson.formats.<fmt>                requests.tilejson_format.<fmt>
+//	counts.over-max-zoom                  requests.over_max_zoom
+//	counts.fetch-retries                  fetch.retries
+//	responsestate.<state>                 response.state.<state>
+//	response-size                         response.size
+//	builds.<build>.responsestate.<state>  build.<build>.response.state.<state>
+//	fetchstate.<state>                    fetch.state.<state>
+//	fetchsize.<size>                      fetch.<size>
+//	sources.<storage>                     storage.source.<storage>
+//	timers.<phase>                        timing.<phase>
+//	counts.lastmodified                   storage.has_last_modified
+//	counts.etag                           storage.has_etag
+//	errors.<name>-error                   errors.<name>
+//	tile.<flag>                           tiles.<flag>
+//	replicas.<name>.fetchstate.<state>    replica.<name>.fetch.state.<state>
+//	replicas.<name>.timers.fetch          replica.<name>.timing.fetch
+//	replicas.<name>.slow                  replica.<name>.slow
+//	storages.<name>.fetchstate.<state>    storage.<name>.fetch.state.<state>
+//	storages.<name>.timers.fetch          storage.<name>.timing.fetch
+//	storages.<name>.fetch-bytes           storage.<name>.fetch_bytes
+//	shutdown.<gauge>                      shutdown.<gauge>
+//	shutdown.worker-<n>.<gauge>           shutdown.worker_<n>.<gauge>
+//	mirror.<name>-mismatch                mirror.<name>_mismatch
+//	mirror.timers.<response>              mirror.timing.<response>
+//
+// Longer prefixes must come before shorter ones which they start with.
+var normalizedPrefixes = []struct {
+	legacy     string
+	normalized string
+}{
+	{"tilejson.formats.", "requests.tilejson_format."},
+	{"formats.", "requests.format."},
+	{"counts.over-max-zoom", "requests.over_max_zoom"},
+	{"counts.fetch-retries", "fetch.retries"},
+	{"counts.lastmodified", "storage.has_last_modified"},
+	{"counts.etag", "storage.has_etag"},
+	{"responsestate.", "response.state."},
+	{"response-size", "response.size"},
+	{"fetchstate.", "fetch.state."},
+	{"fetchsize.", "fetch."},
+	{"sources.", "storage.source."},
+	{"timers.", "timing."},
+	{"tile.", "tiles."},
+	{"builds.", "build."},
+	{"replicas.", "replica."},
+	{"storages.", "storage."},
+}
+
+// normalizedMetricName returns the normalized name of a legacy metric.
+func normalizedMetricName(legacy string) string {
+	switch legacy {
+	case "count":
+		return "requests.total"
+	case "metatile", "tilejson":
+		return "requests." + legacy
+	}
+
+	name := legacy
+	for _, p := range normalizedPrefixes {
+		if strings.HasPrefix(name, p.legacy) {
+			name = p.normalized + name[len(p.legacy):]
+			break
+		}
+	}
+
+	// nested names within per-build and per-replica metrics
+	name = strings.Replace(name, ".responsestate.", ".response.state.", 1)
+	name = strings.Replace(name, ".fetchstate.", ".fetch.state.", 1)
+	name = strings.Replace(name, ".timers.", ".timing.", 1)
+
+	if strings.HasPrefix(name, "errors.") {
+		name = strings.TrimSuffix(name, "-error")
+	}
+
+	return strings.Replace(name, "-", "_", -1)
+}
+
+// metricNamer decides which names each metric is written under.
+type metricNamer struct {
+	naming string
+	// doubleWriteUntil ends MetricNaming_Both, after which only normalized
+	// names are written. Zero means double writing doesn't end.
+	doubleWriteUntil time.Time
+
+	// normalized caches normalized names, up to normalizedCacheSize, as
+	// the same few dozen are written for every request
+	normalized      sync.Map
+	normalizedCount int32
+}
+
+// normalizedCacheSize bounds the names a metricNamer caches, as names with a
+// build ID aren't limited.
+const normalizedCacheSize = 4096
+
+// normalizedName returns the normalized name of a legacy metric.
+func (n *metricNamer) normalizedName(legacy string) string {
+	if name, ok := n.normalized.Load(legacy); ok {
+		return name.(string)
+	}
+	name := normalizedMetricName(legacy)
+	if atomic.LoadInt32(&n.normalizedCount) < normalizedCacheSize && atomic.AddInt32(&n.normalizedCount, 1) <= normalizedCacheSize {
+		n.normalized.Store(legacy, name)
+	}
+	return name
+}
+
+// names returns the names to write the legacy metric under.
+func (n *metricNamer) names(legacy string) []string {
+	return n.appendNames(nil, legacy)
+}
+
+// appendNames appends the names to write the legacy metric under to names.
+func (n *metricNamer) appendNames(names []string, legacy string) []string {
+	naming := n.naming
+	if naming == MetricNaming_Both && !n.doubleWriteUntil.IsZero() && time.Now().After(n.doubleWriteUntil) {
+		naming = MetricNaming_Normalized
+	}
+
+	switch naming {
+	case MetricNaming_Normalized:
+		return append(names, n.normalizedName(legacy))
+	case MetricNaming_Both:
+		return append(names, legacy, n.normalizedName(legacy))
+	default:
+		return append(names, legacy)
+	}
+}
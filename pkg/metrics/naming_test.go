@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizedMetricName(t *testing.T) {
+	for legacy, expected := range map[string]string{
+		"count":                   "requests.total",
+		"metatile":                "requests.metatile",
+		"formats.mvt":             "requests.format.mvt",
+		"tilejson.formats.mapbox": "requests.tilejson_format.mapbox",
+		"counts.over-max-zoom":    "requests.over_max_zoom",
+		"responsestate.success":   "response.state.success",
+		"response-size":           "response.size",
+		"builds.20210331.responsestate.not-found": "build.20210331.response.state.not_found",
+		"fetchstate.fetch-error":                  "fetch.state.fetch_error",
+		"fetchsize.body-size":                     "fetch.body_size",
+		"timers.storage-fetch":                    "timing.storage_fetch",
+		"counts.lastmodified":                     "storage.has_last_modified",
+		"errors.response-write-error":             "errors.response_write",
+		"replicas.east.fetchstate.success":        "replica.east.fetch.state.success",
+		"replicas.east.timers.fetch":              "replica.east.timing.fetch",
+		"replicas.east.slow":                      "replica.east.slow",
+		"storages.s3-east.fetchstate.fetcherr":    "storage.s3_east.fetch.state.fetcherr",
+		"storages.s3-east.timers.fetch":           "storage.s3_east.timing.fetch",
+		"storages.s3-east.fetch-bytes":            "storage.s3_east.fetch_bytes",
+		"counts.fetch-retries":                    "fetch.retries",
+		"sources.local-mirror":                    "storage.source.local_mirror",
+		"mirror.status-mismatch":                  "mirror.status_mismatch",
+		"mirror.timers.shadow":                    "mirror.timing.shadow",
+		"shutdown.in-flight":                      "shutdown.in_flight",
+		"shutdown.worker-2.in-flight":             "shutdown.worker_2.in_flight",
+	} {
+		if actual := normalizedMetricName(legacy); actual != expected {
+			t.Fatalf("Expected %s to be normalized to %s, got %s", legacy, expected, actual)
+		}
+	}
+}
+
+func TestMetricNamerDoubleWrite(t *testing.T) {
+	namer := metricNamer{naming: MetricNaming_Both}
+	if names := namer.names("count"); len(names) != 2 || names[0] != "count" || names[1] != "requests.total" {
+		t.Fatalf("Expected both names, got %#v", names)
+	}
+
+	namer.doubleWriteUntil = time.Now().Add(-time.Second)
+	if names := namer.names("count"); len(names) != 1 || names[0] != "requests.total" {
+		t.Fatalf("Expected only the normalized name after the double write period, got %#v", names)
+	}
+}
@@ -2,9 +2,12 @@ package metrics
 
 import (
 	"bufio"
-	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tilezen/tapalcatl/pkg/log"
@@ -16,14 +19,100 @@ type StatsdMetricsWriter struct {
 	prefix string
 	logger log.JsonLogger
 	queue  chan requestStateContainer
+	// buildDimension enables per-build response state counts
+	buildDimension bool
+	namer          metricNamer
+	// formats allowed in metric names, or nil to allow any
+	formats map[string]bool
+	// one of the state.TimingUnit_ constants
+	timingUnit string
+	// prefix of the shutdown gauges, with the worker number when set
+	shutdownPrefix string
+
+	// the worker sending metrics from the queue, replaced by RestartWorker
+	workerMu sync.Mutex
+	worker   *statsdWorker
 }
+
+// StatsdOptions holds the optional settings of a StatsdMetricsWriter.
+type StatsdOptions struct {
+	// BuildDimension enables per-build response state counts, which adds a
+	// metric series for every build ID requested.
+	BuildDimension bool
+	// Naming is one of the MetricNaming_ constants, default legacy.
+	Naming string
+	// DoubleWriteUntil, if set, is when MetricNaming_Both switches to
+	// writing only the normalized names.
+	DoubleWriteUntil time.Time
+	// Formats, if set, lists the formats counted by name. Other formats
+	// are counted as "other", so that requests can't create new metrics.
+	Formats []string
+	// TimingUnit is one of the state.TimingUnit_ constants, the precision
+	// of timers, default milliseconds. Timers are always in milliseconds,
+	// with microseconds written as a fraction.
+	TimingUnit string
+	// Worker, if set, is the number of the worker process writing, among
+	// the processes started by a server.Supervisor. Counts and timers from
+	// all the workers are aggregated by statsd, but the shutdown gauges
+	// are written per worker, as shutdown.worker-N.<gauge>, since each
+	// worker would overwrite the others' values.
+	Worker int
+}
+
+// responseStateMetrics and fetchStateMetrics are the names of the counts of
+// each state, so that they aren't formatted for every request.
+var responseStateMetrics, fetchStateMetrics = func() (responseStates [state.ResponseState_Count]string, fetchStates [state.FetchState_Count]string) {
+	for i := range responseStates {
+		responseStates[i] = "responsestate." + state.ReqResponseState(i).String()
+	}
+	for i := range fetchStates {
+		fetchStates[i] = "fetchstate." + state.ReqFetchState(i).String()
+	}
+	return
+}()
+
 type requestStateContainer struct {
 	// one of these will be set
 	metaReqState     *state.RequestState
 	tileJsonReqState *state.TileJsonRequestState
+	replicaState     *state.ReplicaFetchState
+	storageState     *state.StorageFetchState
+	drainState       *state.DrainState
+	watchdogState    *state.WatchdogState
+	mirrorState      *state.MirrorState
+}
+
+// statsdWorker holds what the goroutine sending metrics reuses from one
+// request to the next, so that formatting their metrics doesn't allocate.
+type statsdWorker struct {
+	w   *bufio.Writer
+	psw prefixedStatsdWriter
+
+	// busySince is when the worker started sending the current metrics in
+	// unix nanoseconds, or 0 when it's waiting for more
+	busySince int64
+	// stopped is set when the worker has been replaced, so that it exits
+	// once it's no longer stuck
+	stopped int32
+}
+
+func (smw *StatsdMetricsWriter) newWorker() *statsdWorker {
+	return &statsdWorker{
+		w: bufio.NewWriter(nil),
+		psw: prefixedStatsdWriter{
+			prefix:     smw.prefix,
+			namer:      &smw.namer,
+			timingUnit: smw.timingUnit,
+			buf:        make([]byte, 0, 128),
+		},
+	}
 }
 
 func (smw *StatsdMetricsWriter) Process(reqStateContainer requestStateContainer) {
+	smw.process(reqStateContainer, smw.newWorker())
+}
+
+func (smw *StatsdMetricsWriter) process(reqStateContainer requestStateContainer, worker *statsdWorker) {
 	conn, err := net.DialUDP("udp", nil, smw.addr)
 	if err != nil {
 		smw.logger.Error(log.LogCategory_Metrics, "Metrics Writer failed to connect to %s: %s\n", smw.addr, err)
@@ -31,12 +120,72 @@ func (smw *StatsdMetricsWriter) Process(reqStateContainer requestStateContainer)
 	}
 	defer conn.Close()
 
-	w := bufio.NewWriter(conn)
+	w := worker.w
+	w.Reset(conn)
 	defer w.Flush()
 
-	psw := prefixedStatsdWriter{
-		prefix: smw.prefix,
-		w:      w,
+	psw := &worker.psw
+	psw.w = w
+
+	// replica fetches are part of a request which is counted separately
+	if replicaState := reqStateContainer.replicaState; replicaState != nil {
+		replicaPrefix := "replicas." + sanitizeMetricSegment(replicaState.Name)
+		psw.WriteCount(replicaPrefix+".fetchstate."+replicaState.FetchState.String(), 1)
+		if replicaState.IsSlow {
+			psw.WriteCount(replicaPrefix+".slow", 1)
+		}
+		psw.WriteTimer(replicaPrefix+".timers.fetch", replicaState.Duration)
+		return
+	}
+
+	// as are storage fetches
+	if storageState := reqStateContainer.storageState; storageState != nil {
+		storagePrefix := "storages." + sanitizeMetricSegment(storageState.Name)
+		psw.WriteCount(storagePrefix+".fetchstate."+storageState.FetchState.String(), 1)
+		if storageState.Size > 0 {
+			psw.WriteCount(storagePrefix+".fetch-bytes", int(storageState.Size))
+		}
+		psw.WriteTimer(storagePrefix+".timers.fetch", storageState.Duration)
+		return
+	}
+
+	if drainState := reqStateContainer.drainState; drainState != nil {
+		psw.WriteGauge(smw.shutdownPrefix+"in-flight", int(drainState.InFlight))
+		psw.WriteGauge(smw.shutdownPrefix+"shed-queue", drainState.ShedQueue)
+		psw.WriteGauge(smw.shutdownPrefix+"metrics-queue", drainState.MetricsQueue)
+		psw.WriteGauge(smw.shutdownPrefix+"pending-cache-sets", int(drainState.PendingCacheSets))
+		return
+	}
+
+	if watchdogState := reqStateContainer.watchdogState; watchdogState != nil {
+		watchdogPrefix := "watchdog." + sanitizeMetricSegment(watchdogState.Worker)
+		psw.WriteCount(watchdogPrefix+".stalls", 1)
+		if watchdogState.Restarted {
+			psw.WriteCount(watchdogPrefix+".restarts", 1)
+		}
+		return
+	}
+
+	// replays are of requests which are counted separately
+	if mirrorState := reqStateContainer.mirrorState; mirrorState != nil {
+		if mirrorState.IsDropped {
+			psw.WriteCount("mirror.dropped", 1)
+			return
+		}
+		psw.WriteCount("mirror.count", 1)
+		if mirrorState.ShadowError != "" {
+			psw.WriteCount("mirror.errors", 1)
+			return
+		}
+		if mirrorState.Status != mirrorState.ShadowStatus {
+			psw.WriteCount("mirror.status-mismatch", 1)
+		}
+		if mirrorState.Size != mirrorState.ShadowSize {
+			psw.WriteCount("mirror.size-mismatch", 1)
+		}
+		psw.WriteTimer("mirror.timers.live", mirrorState.Duration)
+		psw.WriteTimer("mirror.timers.shadow", mirrorState.ShadowDuration)
+		return
 	}
 
 	psw.WriteCount("count", 1)
@@ -47,13 +196,20 @@ func (smw *StatsdMetricsWriter) Process(reqStateContainer requestStateContainer)
 	var storageMetadata *state.ReqStorageMetadata
 	var isResponseWriteError *bool
 	var isCondError *bool
+	var build string
 
 	if reqStateContainer.metaReqState != nil {
 		reqState := reqStateContainer.metaReqState
 
 		psw.WriteCount("metatile", 1)
 
-		respState = &reqState.ResponseState
+		// malformed requests are counted apart so that scans don't swamp
+		// the response counts
+		if reqState.Malformed != "" {
+			psw.WriteCount("malformed."+reqState.Malformed, 1)
+		} else {
+			respState = &reqState.ResponseState
+		}
 		fetchState = &reqState.FetchState
 
 		if reqState.FetchSize.BodySize > 0 {
@@ -65,6 +221,7 @@ func (smw *StatsdMetricsWriter) Process(reqStateContainer requestStateContainer)
 		storageMetadata = &reqState.StorageMetadata
 		isResponseWriteError = &reqState.IsResponseWriteError
 		isCondError = &reqState.IsCondError
+		build = reqState.Build
 
 		psw.WriteTimer("timers.parse", reqState.Duration.Parse)
 		psw.WriteTimer("timers.storage-fetch", reqState.Duration.StorageFetch)
@@ -74,11 +231,39 @@ func (smw *StatsdMetricsWriter) Process(reqStateContainer requestStateContainer)
 		psw.WriteTimer("timers.total", reqState.Duration.Total)
 
 		if format := reqState.Format; format != "" {
-			psw.WriteCount(fmt.Sprintf("formats.%s", format), 1)
+			psw.WriteCount("formats."+smw.formatSegment(format), 1)
+		}
+		if retries := reqState.StorageRetries; retries > 0 {
+			psw.WriteCount("counts.fetch-retries", retries)
+		}
+		if source := reqState.StorageSource; source != "" {
+			psw.WriteCount("sources."+sanitizeMetricSegment(source), 1)
 		}
 		if responseSize := reqState.ResponseSize; responseSize > 0 {
 			psw.WriteGauge("response-size", responseSize)
 		}
+		if compression := reqState.Compression; compression != nil {
+			psw.WriteTimer("timers.compress", compression.Duration)
+			psw.WriteGauge("response-size-compressed", compression.Size)
+		}
+		psw.WriteBool("counts.over-max-zoom", reqState.IsOverMaxZoom)
+		psw.WriteBool("counts.unknown-format", reqState.IsUnknownFormat)
+		psw.WriteBool("counts.deadline-exceeded", reqState.IsDeadlineExceeded)
+		psw.WriteBool("counts.duplicate-entry", reqState.IsDuplicateEntry)
+		psw.WriteBool("counts.hash-mismatch", reqState.IsHashMismatch)
+		psw.WriteBool("counts.format-fallback", reqState.FormatFallback != "")
+		psw.WriteBool("counts.transcoded", reqState.IsTranscoded)
+		if reqState.IsTranscoded {
+			psw.WriteTimer("timers.transcode", reqState.Duration.Transcode)
+		}
+		psw.WriteBool("counts.queued", reqState.Duration.Queue > 0)
+		if reqState.Duration.Queue > 0 {
+			psw.WriteTimer("timers.queue", reqState.Duration.Queue)
+		}
+		psw.WriteBool("tile.invalid", reqState.IsTileInvalid)
+		psw.WriteBool("tile.tombstone", reqState.IsTombstone)
+		psw.WriteBool("tile.stale", reqState.IsStale)
+		psw.WriteBool("tile.degraded", reqState.IsDegraded)
 	} else if reqStateContainer.tileJsonReqState != nil {
 		tileJsonReqState := reqStateContainer.tileJsonReqState
 
@@ -88,6 +273,7 @@ func (smw *StatsdMetricsWriter) Process(reqStateContainer requestStateContainer)
 		fetchState = &tileJsonReqState.FetchState
 		isResponseWriteError = &tileJsonReqState.IsResponseWriteError
 		isCondError = &tileJsonReqState.IsCondError
+		build = tileJsonReqState.Build
 
 		psw.WriteTimer("timers.parse", tileJsonReqState.Duration.Parse)
 		psw.WriteTimer("timers.storage-fetch", tileJsonReqState.Duration.StorageFetch)
@@ -95,7 +281,7 @@ func (smw *StatsdMetricsWriter) Process(reqStateContainer requestStateContainer)
 		psw.WriteTimer("timers.storage-read", tileJsonReqState.Duration.StorageReadRespWrite)
 
 		if tileJsonReqState.Format != nil {
-			formatMetricName := fmt.Sprintf("tilejson.formats.%s", tileJsonReqState.Format.Name())
+			formatMetricName := "tilejson.formats." + smw.formatSegment(tileJsonReqState.Format.Name())
 			psw.WriteCount(formatMetricName, 1)
 		}
 
@@ -108,18 +294,22 @@ func (smw *StatsdMetricsWriter) Process(reqStateContainer requestStateContainer)
 
 	if respState != nil {
 		if *respState > state.ResponseState_Nil && *respState < state.ResponseState_Count {
-			respStateName := respState.String()
-			respMetricName := fmt.Sprintf("responsestate.%s", respStateName)
-			psw.WriteCount(respMetricName, 1)
+			psw.WriteCount(responseStateMetrics[*respState], 1)
+
+			if smw.buildDimension {
+				buildName := "default"
+				if build != "" {
+					buildName = sanitizeMetricSegment(build)
+				}
+				psw.WriteCount("builds."+buildName+"."+responseStateMetrics[*respState], 1)
+			}
 		} else {
 			smw.logger.Error(log.LogCategory_InvalidCodeState, "Invalid response state: %d", int32(*respState))
 		}
 	}
 	if fetchState != nil {
 		if *fetchState > state.FetchState_Nil && *fetchState < state.FetchState_Count {
-			fetchStateName := fetchState.String()
-			fetchMetricName := fmt.Sprintf("fetchstate.%s", fetchStateName)
-			psw.WriteCount(fetchMetricName, 1)
+			psw.WriteCount(fetchStateMetrics[*fetchState], 1)
 		} else if *fetchState != state.FetchState_Nil {
 			smw.logger.Error(log.LogCategory_InvalidCodeState, "Invalid fetch state: %d", int32(*fetchState))
 		}
@@ -154,70 +344,195 @@ func (smw *StatsdMetricsWriter) WriteTileJsonState(tileJsonReqState *state.TileJ
 	smw.enqueue(requestStateContainer{tileJsonReqState: tileJsonReqState})
 }
 
-func NewStatsdMetricsWriter(addr *net.UDPAddr, metricsPrefix string, logger log.JsonLogger) MetricsWriter {
-	maxQueueSize := 4096
-	queue := make(chan requestStateContainer, maxQueueSize)
+func (smw *StatsdMetricsWriter) WriteReplicaFetchState(replicaState *state.ReplicaFetchState) {
+	smw.enqueue(requestStateContainer{replicaState: replicaState})
+}
 
-	smw := &StatsdMetricsWriter{
-		addr:   addr,
-		prefix: metricsPrefix,
-		logger: logger,
-		queue:  queue,
-	}
+func (smw *StatsdMetricsWriter) WriteStorageFetchState(storageState *state.StorageFetchState) {
+	smw.enqueue(requestStateContainer{storageState: storageState})
+}
 
-	go func(smw *StatsdMetricsWriter) {
-		for reqStateContainer := range smw.queue {
-			smw.Process(reqStateContainer)
-		}
-	}(smw)
+func (smw *StatsdMetricsWriter) WriteDrainState(drainState *state.DrainState) {
+	smw.enqueue(requestStateContainer{drainState: drainState})
+}
 
-	return smw
+func (smw *StatsdMetricsWriter) WriteWatchdogState(watchdogState *state.WatchdogState) {
+	smw.enqueue(requestStateContainer{watchdogState: watchdogState})
 }
 
-func makeMetricPrefix(prefix string, metric string) string {
-	if prefix == "" {
-		return metric
-	} else {
-		return fmt.Sprintf("%s.%s", prefix, metric)
+func (smw *StatsdMetricsWriter) WriteMirrorState(mirrorState *state.MirrorState) {
+	smw.enqueue(requestStateContainer{mirrorState: mirrorState})
+}
+
+// QueueLength returns the number of metrics waiting to be sent.
+func (smw *StatsdMetricsWriter) QueueLength() int {
+	return len(smw.queue)
+}
+
+// Stalled returns how long the worker has been sending the same metrics, or
+// 0 if it's waiting for more.
+func (smw *StatsdMetricsWriter) Stalled() time.Duration {
+	smw.workerMu.Lock()
+	worker := smw.worker
+	smw.workerMu.Unlock()
+
+	busySince := atomic.LoadInt64(&worker.busySince)
+	if busySince == 0 {
+		return 0
 	}
+	return time.Since(time.Unix(0, busySince))
 }
 
-func makeStatsdLineCount(prefix string, metric string, value int) string {
-	return fmt.Sprintf("%s:%d|c\n", makeMetricPrefix(prefix, metric), value)
+// RestartWorker starts a new worker sending metrics from the queue. The
+// current one exits if it ever finishes sending its metrics.
+func (smw *StatsdMetricsWriter) RestartWorker() {
+	smw.workerMu.Lock()
+	defer smw.workerMu.Unlock()
+	atomic.StoreInt32(&smw.worker.stopped, 1)
+	smw.startWorker()
 }
 
-func makeStatsdLineGauge(prefix string, metric string, value int) string {
-	return fmt.Sprintf("%s:%d|g\n", makeMetricPrefix(prefix, metric), value)
+// startWorker starts a worker sending metrics from the queue, and must be
+// called with workerMu held.
+func (smw *StatsdMetricsWriter) startWorker() {
+	worker := smw.newWorker()
+	smw.worker = worker
+	go func() {
+		for reqStateContainer := range smw.queue {
+			atomic.StoreInt64(&worker.busySince, time.Now().UnixNano())
+			smw.process(reqStateContainer, worker)
+			atomic.StoreInt64(&worker.busySince, 0)
+			if atomic.LoadInt32(&worker.stopped) != 0 {
+				return
+			}
+		}
+	}()
 }
 
-func makeStatsdLineTimer(prefix string, metric string, value time.Duration) string {
-	millis := value.Milliseconds()
-	return fmt.Sprintf("%s:%d|ms\n", makeMetricPrefix(prefix, metric), millis)
+// NewStatsdMetricsWriter creates a metrics writer sending to statsd at addr.
+// When buildDimension is set, response states are also counted per build,
+// which adds a metric series for every build ID requested.
+func NewStatsdMetricsWriter(addr *net.UDPAddr, metricsPrefix string, buildDimension bool, logger log.JsonLogger) MetricsWriter {
+	return NewStatsdMetricsWriterWithOptions(addr, metricsPrefix, logger, StatsdOptions{BuildDimension: buildDimension})
 }
 
-func writeStatsdCount(w io.Writer, prefix string, metric string, value int) {
-	w.Write([]byte(makeStatsdLineCount(prefix, metric, value)))
+func NewStatsdMetricsWriterWithOptions(addr *net.UDPAddr, metricsPrefix string, logger log.JsonLogger, options StatsdOptions) MetricsWriter {
+	maxQueueSize := 4096
+	queue := make(chan requestStateContainer, maxQueueSize)
+
+	if options.Naming == "" {
+		options.Naming = MetricNaming_Legacy
+	}
+
+	smw := &StatsdMetricsWriter{
+		addr:           addr,
+		prefix:         metricsPrefix,
+		logger:         logger,
+		queue:          queue,
+		buildDimension: options.BuildDimension,
+		timingUnit:     options.TimingUnit,
+		shutdownPrefix: "shutdown.",
+		namer: metricNamer{
+			naming:           options.Naming,
+			doubleWriteUntil: options.DoubleWriteUntil,
+		},
+	}
+	if options.Worker > 0 {
+		smw.shutdownPrefix = "shutdown.worker-" + strconv.Itoa(options.Worker) + "."
+	}
+	if len(options.Formats) > 0 {
+		smw.formats = make(map[string]bool, len(options.Formats))
+		for _, format := range options.Formats {
+			smw.formats[format] = true
+		}
+	}
+
+	smw.workerMu.Lock()
+	smw.startWorker()
+	smw.workerMu.Unlock()
+
+	return smw
 }
 
-func writeStatsdGauge(w io.Writer, prefix string, metric string, value int) {
-	w.Write([]byte(makeStatsdLineGauge(prefix, metric, value)))
+// sanitizeMetricSegment replaces characters which statsd treats as
+// separators, or which graphite doesn't allow in paths, so that a value can
+// be used as a single metric name segment.
+func sanitizeMetricSegment(value string) string {
+	if value == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, value)
 }
 
-func writeStatsdTimer(w io.Writer, prefix string, metric string, value time.Duration) {
-	w.Write([]byte(makeStatsdLineTimer(prefix, metric, value)))
+// formatSegment returns the metric name segment for a format, limiting it
+// to the allowed formats.
+func (smw *StatsdMetricsWriter) formatSegment(format string) string {
+	if smw.formats != nil && !smw.formats[format] {
+		return "other"
+	}
+	return sanitizeMetricSegment(format)
 }
 
 type prefixedStatsdWriter struct {
 	prefix string
 	w      io.Writer
+	// namer maps the legacy metric names used by callers to the names
+	// written, if set
+	namer *metricNamer
+	// timingUnit is one of the state.TimingUnit_ constants
+	timingUnit string
+
+	// reused between lines, as a request writes a few dozen
+	buf     []byte
+	nameBuf [2]string
+}
+
+func (psw *prefixedStatsdWriter) write(metric string, value int64, kind string) {
+	psw.writeFixed(metric, value, false, kind)
+}
+
+// writeFixed writes the value, or when thousandths is set the value divided
+// by 1000 to three decimal places.
+func (psw *prefixedStatsdWriter) writeFixed(metric string, value int64, thousandths bool, kind string) {
+	names := append(psw.nameBuf[:0], metric)
+	if psw.namer != nil {
+		names = psw.namer.appendNames(psw.nameBuf[:0], metric)
+	}
+	for _, name := range names {
+		buf := psw.buf[:0]
+		if psw.prefix != "" {
+			buf = append(buf, psw.prefix...)
+			buf = append(buf, '.')
+		}
+		buf = append(buf, name...)
+		buf = append(buf, ':')
+		if thousandths {
+			buf = strconv.AppendInt(buf, value/1000, 10)
+			fraction := value % 1000
+			buf = append(buf, '.', byte('0'+fraction/100), byte('0'+fraction/10%10), byte('0'+fraction%10))
+		} else {
+			buf = strconv.AppendInt(buf, value, 10)
+		}
+		buf = append(buf, '|')
+		buf = append(buf, kind...)
+		buf = append(buf, '\n')
+		psw.w.Write(buf)
+		psw.buf = buf
+	}
 }
 
 func (psw *prefixedStatsdWriter) WriteCount(metric string, value int) {
-	writeStatsdCount(psw.w, psw.prefix, metric, value)
+	psw.write(metric, int64(value), "c")
 }
 
 func (psw *prefixedStatsdWriter) WriteGauge(metric string, value int) {
-	writeStatsdGauge(psw.w, psw.prefix, metric, value)
+	psw.write(metric, int64(value), "g")
 }
 
 func (psw *prefixedStatsdWriter) WriteBool(metric string, value bool) {
@@ -227,5 +542,9 @@ func (psw *prefixedStatsdWriter) WriteBool(metric string, value bool) {
 }
 
 func (psw *prefixedStatsdWriter) WriteTimer(metric string, value time.Duration) {
-	writeStatsdTimer(psw.w, psw.prefix, metric, value)
+	if psw.timingUnit == state.TimingUnit_Microseconds {
+		psw.writeFixed(metric, value.Microseconds(), true, "ms")
+		return
+	}
+	psw.write(metric, value.Milliseconds(), "ms")
 }
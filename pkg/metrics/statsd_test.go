@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/log"
+	"github.com/tilezen/tapalcatl/pkg/state"
+)
+
+func TestFormatSegment(t *testing.T) {
+	smw := &StatsdMetricsWriter{}
+	if segment := smw.formatSegment("mvt.x|y:1@2/z"); segment != "mvt_x_y_1_2_z" {
+		t.Fatalf("Expected format to be sanitized, got %s", segment)
+	}
+
+	smw = NewStatsdMetricsWriterWithOptions(nil, "", nil, StatsdOptions{Formats: []string{"mvt", "json"}}).(*StatsdMetricsWriter)
+	for format, expected := range map[string]string{
+		"mvt":      "mvt",
+		"json":     "json",
+		"whatever": "other",
+	} {
+		if segment := smw.formatSegment(format); segment != expected {
+			t.Fatalf("Expected format %s to give %s, got %s", format, expected, segment)
+		}
+	}
+}
+
+func TestPrefixedStatsdWriter(t *testing.T) {
+	var out bytes.Buffer
+	psw := &prefixedStatsdWriter{
+		prefix: "tapalcatl",
+		w:      &out,
+		namer:  &metricNamer{naming: MetricNaming_Both},
+	}
+	psw.WriteCount("count", 1)
+	psw.WriteTimer("timers.total", 1500*time.Microsecond)
+	psw.WriteGauge("response-size", -2)
+
+	expected := "tapalcatl.count:1|c\ntapalcatl.requests.total:1|c\n" +
+		"tapalcatl.timers.total:1|ms\ntapalcatl.timing.total:1|ms\n" +
+		"tapalcatl.response-size:-2|g\ntapalcatl.response.size:-2|g\n"
+	if out.String() != expected {
+		t.Fatalf("Expected lines %#v, got %#v", expected, out.String())
+	}
+
+	// once the names have been normalized, writing lines reuses the buffers
+	psw.w = ioutil.Discard
+	allocs := testing.AllocsPerRun(100, func() {
+		psw.WriteCount("count", 1)
+		psw.WriteTimer("timers.total", time.Millisecond)
+	})
+	if allocs > 0 {
+		t.Fatalf("Expected no allocations writing lines, got %.0f", allocs)
+	}
+
+	out.Reset()
+	psw = &prefixedStatsdWriter{w: &out, timingUnit: state.TimingUnit_Microseconds}
+	psw.WriteTimer("timers.parse", 42*time.Microsecond)
+	psw.WriteTimer("timers.total", 1500*time.Microsecond)
+	expected = "timers.parse:0.042|ms\ntimers.total:1.500|ms\n"
+	if out.String() != expected {
+		t.Fatalf("Expected lines %#v, got %#v", expected, out.String())
+	}
+}
+
+func TestStatsdRestartWorker(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	smw := NewStatsdMetricsWriterWithOptions(conn.LocalAddr().(*net.UDPAddr), "tapalcatl", &log.NilJsonLogger{}, StatsdOptions{}).(*StatsdMetricsWriter)
+	if stalled := smw.Stalled(); stalled != 0 {
+		t.Fatalf("Expected an idle worker not to be stalled, got %s", stalled)
+	}
+
+	// pretend the worker has been stuck sending for a minute
+	stuck := smw.worker
+	atomic.StoreInt64(&stuck.busySince, time.Now().Add(-time.Minute).UnixNano())
+	if stalled := smw.Stalled(); stalled < time.Minute {
+		t.Fatalf("Expected the worker to be stalled for a minute, got %s", stalled)
+	}
+
+	smw.RestartWorker()
+	if smw.worker == stuck || atomic.LoadInt32(&stuck.stopped) == 0 {
+		t.Fatalf("Expected the stuck worker to be replaced and stopped")
+	}
+	if stalled := smw.Stalled(); stalled != 0 {
+		t.Fatalf("Expected the new worker not to be stalled, got %s", stalled)
+	}
+
+	smw.WriteWatchdogState(&state.WatchdogState{Worker: "metrics", Restarted: true})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected metrics to be sent by the new worker: %s", err)
+	}
+	expected := "tapalcatl.watchdog.metrics.stalls:1|c\ntapalcatl.watchdog.metrics.restarts:1|c\n"
+	if got := string(buf[:n]); got != expected {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestStatsdWorkerShutdownGauges(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	smw := NewStatsdMetricsWriterWithOptions(conn.LocalAddr().(*net.UDPAddr), "tapalcatl", &log.NilJsonLogger{}, StatsdOptions{Worker: 2})
+	smw.WriteDrainState(&state.DrainState{InFlight: 3})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected the shutdown gauges to be sent: %s", err)
+	}
+	if got := string(buf[:n]); !strings.HasPrefix(got, "tapalcatl.shutdown.worker-2.in-flight:3|g\n") {
+		t.Fatalf("Expected the gauges to be written per worker, got %q", got)
+	}
+}
+
+func TestStatsdStorageFetchState(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	smw := NewStatsdMetricsWriterWithOptions(conn.LocalAddr().(*net.UDPAddr), "tapalcatl", &log.NilJsonLogger{}, StatsdOptions{})
+	smw.WriteStorageFetchState(&state.StorageFetchState{Name: "s3.east", FetchState: state.FetchState_Success, Duration: 12 * time.Millisecond, Size: 2048})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected the storage metrics to be sent: %s", err)
+	}
+	expected := "tapalcatl.storages.s3_east.fetchstate.ok:1|c\ntapalcatl.storages.s3_east.fetch-bytes:2048|c\ntapalcatl.storages.s3_east.timers.fetch:12|ms\n"
+	if got := string(buf[:n]); got != expected {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+}
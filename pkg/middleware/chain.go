@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/tilezen/tapalcatl/pkg/handler"
+	"github.com/tilezen/tapalcatl/pkg/log"
+)
+
+// Middleware wraps a handler to add behaviour before or after it.
+type Middleware func(http.Handler) http.Handler
+
+// Chain is an ordered list of middleware, outermost first.
+type Chain []Middleware
+
+// New returns a chain of the given middleware, skipping any which are nil so
+// that optional stages can be listed unconditionally.
+func New(middleware ...Middleware) Chain {
+	return Chain(nil).Append(middleware...)
+}
+
+// Append returns a new chain with the middleware added inside the existing
+// ones.
+func (c Chain) Append(middleware ...Middleware) Chain {
+	chain := make(Chain, 0, len(c)+len(middleware))
+	chain = append(chain, c...)
+	for _, m := range middleware {
+		if m != nil {
+			chain = append(chain, m)
+		}
+	}
+	return chain
+}
+
+// Then wraps h in the chain, so that the first middleware sees the request
+// first.
+func (c Chain) Then(h http.Handler) http.Handler {
+	for i := len(c) - 1; i >= 0; i-- {
+		h = c[i](h)
+	}
+	return h
+}
+
+// Options configures the chains which the server puts around its handlers.
+// The zero value, apart from the Logger, adds no optional behaviour.
+type Options struct {
+	Logger log.JsonLogger
+	// Logging adds an access log in the Common or Combined Log Format to the
+	// JSON line logged for each request, or replaces it.
+	Logging log.LoggingOptions
+
+	// HTTP2 allows cleartext connections to be upgraded to HTTP/2 when set.
+	// It isn't needed when connections are terminated in front of tapalcatl.
+	HTTP2 *http2.Server
+	// InFlight counts the requests being handled, if set.
+	InFlight *handler.InFlightCounter
+	// Headers normalizes the Vary and validator headers of every response.
+	Headers handler.HeaderOptions
+
+	// APIKeys, when not empty, are the keys allowed to request tiles.
+	APIKeys []string
+	// APIKeyVariable is the route variable holding the API key, for routes
+	// with the key in their path rather than the api_key parameter.
+	APIKeyVariable string
+	// Tenants are also allowed to request tiles, keyed by their API keys,
+	// but only their own.
+	Tenants map[string]*handler.Tenant
+	// BanList, if set, rejects tile requests from clients banned for making
+	// too many malformed requests.
+	BanList *handler.BanList
+	// RateLimiter limits the rate of tile requests, if set. It's shared by
+	// every route it's passed to.
+	RateLimiter *RateLimiter
+	// Mirror, if set, replays a sample of the tile requests allowed through
+	// to a shadow deployment.
+	Mirror *Mirror
+	// Timeout bounds the time to respond to a tile request, 0 for no limit.
+	Timeout time.Duration
+	// Deadline is the default budget for the work on a tile request, after
+	// which cache and storage calls are abandoned, 0 for no limit.
+	Deadline time.Duration
+	// DeadlineHeader takes the budget from the X-Request-Deadline-Ms header
+	// when requests have it, eg. as set by an upstream gateway.
+	DeadlineHeader bool
+	// GzipBufferSize buffers compressed responses up to this size so that
+	// they're sent with a Content-Length, 0 to always stream them.
+	GzipBufferSize int
+	// InstrumentCompression records the time spent compressing tiles and
+	// their compressed size with the metatile handler's metrics.
+	InstrumentCompression bool
+}
+
+// ServerChain returns the middleware around every request the server
+// handles, including health checks and admin endpoints.
+func ServerChain(options Options) Chain {
+	var h2c, inFlight Middleware
+	if options.HTTP2 != nil {
+		h2c = H2C(options.HTTP2)
+	}
+	if options.InFlight != nil {
+		inFlight = options.InFlight.Handler
+	}
+
+	return New(
+		h2c,
+		log.LoggingMiddlewareWithOptions(options.Logger, options.Logging),
+		Recovery(options.Logger),
+		inFlight,
+		Headers(options.Headers),
+		Cors(),
+	)
+}
+
+// RouteChain returns the middleware around the handler of each tile or
+// tilejson route.
+func RouteChain(options Options) Chain {
+	var ban, pathAPIKey, auth, rateLimit, mirror, timeout, deadline Middleware
+	if options.BanList != nil {
+		ban = options.BanList.Handler
+	}
+	if options.APIKeyVariable != "" {
+		pathAPIKey = PathAPIKey(options.APIKeyVariable)
+	}
+	if len(options.APIKeys) > 0 || len(options.Tenants) > 0 {
+		auth = TenantAuth(options.APIKeys, options.Tenants)
+	}
+	if options.RateLimiter != nil {
+		rateLimit = options.RateLimiter.Handler
+	}
+	if options.Mirror != nil {
+		mirror = options.Mirror.Handler
+	}
+	if options.Timeout > 0 {
+		timeout = Timeout(options.Timeout)
+	}
+	if options.Deadline > 0 || options.DeadlineHeader {
+		deadline = Deadline(options.Deadline, options.DeadlineHeader)
+	}
+	compression := Compression(options.GzipBufferSize)
+	if options.InstrumentCompression {
+		compression = InstrumentedCompression(options.GzipBufferSize)
+	}
+
+	return New(
+		ban,
+		pathAPIKey,
+		auth,
+		rateLimit,
+		mirror,
+		timeout,
+		deadline,
+		compression,
+	)
+}
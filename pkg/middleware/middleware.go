@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NYTimes/gziphandler"
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/tilezen/tapalcatl/pkg/handler"
+	"github.com/tilezen/tapalcatl/pkg/log"
+)
+
+// H2C supports upgrading an http/1.1 connection to http/2.
+// See https://github.com/thrawn01/h2c-golang-example
+func H2C(server *http2.Server) Middleware {
+	return func(h http.Handler) http.Handler {
+		return h2c.NewHandler(h, server)
+	}
+}
+
+// Recovery responds with a 500 and logs the stack when a handler panics,
+// rather than dropping the connection.
+func Recovery(logger log.JsonLogger) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			defer func() {
+				if err := recover(); err != nil {
+					if err == http.ErrAbortHandler {
+						panic(err)
+					}
+					logger.Error(log.LogCategory_InvalidCodeState, "Panic handling %s: %v\n%s", req.URL.EscapedPath(), err, debug.Stack())
+					rw.WriteHeader(http.StatusInternalServerError)
+				}
+			}()
+			h.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// Headers normalizes the Vary and validator headers of every response.
+func Headers(options handler.HeaderOptions) Middleware {
+	return func(h http.Handler) http.Handler {
+		return handler.NormalizeHeaders(h, options)
+	}
+}
+
+// Cors answers CORS preflight requests and adds CORS headers to responses.
+func Cors() Middleware {
+	return Middleware(handlers.CORS())
+}
+
+// Compression gzips responses for clients which accept it. When bufferSize
+// is positive, responses up to that size are buffered to send them with a
+// Content-Length.
+func Compression(bufferSize int) Middleware {
+	return func(h http.Handler) http.Handler {
+		if bufferSize > 0 {
+			return handler.BufferedGzipHandler(h, bufferSize)
+		}
+		return gziphandler.GzipHandler(h)
+	}
+}
+
+// InstrumentedCompression is Compression, measuring the time spent
+// compressing each response and its compressed size for the metatile
+// handler's metrics.
+func InstrumentedCompression(bufferSize int) Middleware {
+	compress := Compression(bufferSize)
+	return func(h http.Handler) http.Handler {
+		return handler.InstrumentCompression(h, compress)
+	}
+}
+
+// Timeout responds with a 503 when the handler takes longer than timeout.
+func Timeout(timeout time.Duration) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.TimeoutHandler(h, timeout, "")
+	}
+}
+
+// DeadlineHeader is the request header giving the milliseconds an upstream
+// caller will wait for the response.
+const DeadlineHeader = "X-Request-Deadline-Ms"
+
+// Deadline sets the deadline of the request's context to the budget from
+// the X-Request-Deadline-Ms header, if useHeader is set and the request has
+// a valid one, or otherwise to the default budget, if positive. Cache and
+// storage calls made with the context are abandoned once it passes.
+func Deadline(budget time.Duration, useHeader bool) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			requestBudget := budget
+			if useHeader {
+				if ms, err := strconv.ParseInt(req.Header.Get(DeadlineHeader), 10, 64); err == nil && ms > 0 {
+					requestBudget = time.Duration(ms) * time.Millisecond
+				}
+			}
+			if requestBudget > 0 {
+				ctx, cancel := context.WithTimeout(req.Context(), requestBudget)
+				defer cancel()
+				req = req.WithContext(ctx)
+			}
+			h.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// PathAPIKey moves the API key from the route's variable into the api_key
+// query parameter, replacing any key passed there, so that clients putting
+// their key in the path are authenticated, logged and counted the same as
+// those passing it as a parameter. Routes without the variable are passed
+// through unchanged.
+func PathAPIKey(variable string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			key, ok := mux.Vars(req)[variable]
+			if ok {
+				u := *req.URL
+				q := u.Query()
+				q.Set("api_key", key)
+				u.RawQuery = q.Encode()
+				req = req.Clone(req.Context())
+				req.URL = &u
+			}
+			h.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// APIKeyAuth only allows requests with one of the keys in their api_key
+// query parameter. Requests without a key get a 401 and requests with an
+// unknown key a 403.
+func APIKeyAuth(keys []string) Middleware {
+	return TenantAuth(keys, nil)
+}
+
+// TenantAuth allows requests with one of the keys, or one of the tenants'
+// keys, in their api_key query parameter like APIKeyAuth. Requests with a
+// tenant's key are only served the tenant's tiles.
+func TenantAuth(keys []string, tenants map[string]*handler.Tenant) Middleware {
+	allowed := make(map[string]*handler.Tenant, len(keys)+len(tenants))
+	for _, key := range keys {
+		allowed[key] = nil
+	}
+	for key, tenant := range tenants {
+		allowed[key] = tenant
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			key := req.URL.Query().Get("api_key")
+			if key == "" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			tenant, ok := allowed[key]
+			if !ok {
+				rw.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if tenant != nil {
+				req = req.WithContext(handler.WithTenant(req.Context(), tenant))
+			}
+			h.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// RateLimiter is a token bucket limiting the rate of requests across all the
+// handlers it wraps.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter allows rate requests per second on average, and bursts of
+// up to burst requests.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token for a request, returning false if there are none.
+func (l *RateLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Handler responds with a 429 to requests over the rate limit.
+func (l *RateLimiter) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !l.Allow() {
+			rw.Header().Set("Retry-After", "1")
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,189 @@
+package middleware
+
+import (
+	"bytes"
+	golog "log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tilezen/tapalcatl/pkg/log"
+	"github.com/tilezen/tapalcatl/pkg/metrics"
+	"github.com/tilezen/tapalcatl/pkg/state"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	stage := func(name string) Middleware {
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				order = append(order, name)
+				h.ServeHTTP(rw, req)
+			})
+		}
+	}
+
+	chain := New(stage("a"), nil, stage("b")).Append(stage("c"))
+	chain.Then(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		order = append(order, "handler")
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if got := strings.Join(order, ","); got != "a,b,c,handler" {
+		t.Fatalf("Expected middleware to run outermost first, got %s", got)
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	h := APIKeyAuth([]string{"good"})(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+	for url, expected := range map[string]int{
+		"/0/0/0.mvt":              http.StatusUnauthorized,
+		"/0/0/0.mvt?api_key=bad":  http.StatusForbidden,
+		"/0/0/0.mvt?api_key=good": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		if rec.Code != expected {
+			t.Fatalf("Expected %d for %s, got %d", expected, url, rec.Code)
+		}
+	}
+}
+
+func TestPathAPIKey(t *testing.T) {
+	var apiKey string
+	r := mux.NewRouter()
+	r.Handle("/v1/{apikey}/{z}/{x}/{y}.mvt", RouteChain(Options{APIKeys: []string{"good"}, APIKeyVariable: "apikey"}).Then(
+		http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			apiKey = req.URL.Query().Get("api_key")
+		})))
+
+	for url, expected := range map[string]int{
+		"/v1/bad/0/0/0.mvt":              http.StatusForbidden,
+		"/v1/bad/0/0/0.mvt?api_key=good": http.StatusForbidden,
+		"/v1/good/0/0/0.mvt":             http.StatusOK,
+		"/v1/good/0/0/0.mvt?api_key=bad": http.StatusOK,
+	} {
+		apiKey = ""
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		if rec.Code != expected {
+			t.Fatalf("Expected %d for %s, got %d", expected, url, rec.Code)
+		}
+		if expected == http.StatusOK && apiKey != "good" {
+			t.Fatalf("Expected the handler to see api_key good for %s, got %#v", url, apiKey)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	// a rate this low won't refill a token during the test
+	h := NewRateLimiter(0.001, 2).Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/0/0/0.mvt", nil))
+		if rec.Code != expected {
+			t.Fatalf("Expected %d for request %d, got %d", expected, i, rec.Code)
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	budget := func(useHeader bool, header string) time.Duration {
+		var remaining time.Duration
+		h := Deadline(time.Minute, useHeader)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if deadline, ok := req.Context().Deadline(); ok {
+				remaining = time.Until(deadline)
+			}
+		}))
+		req := httptest.NewRequest("GET", "/0/0/0.mvt", nil)
+		if header != "" {
+			req.Header.Set(DeadlineHeader, header)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		return remaining
+	}
+
+	if remaining := budget(true, "100"); remaining <= 0 || remaining > 100*time.Millisecond {
+		t.Fatalf("Expected the header's budget of 100ms, got %s", remaining)
+	}
+	for _, header := range []string{"", "soon", "-5"} {
+		if remaining := budget(true, header); remaining <= 100*time.Millisecond || remaining > time.Minute {
+			t.Fatalf("Expected the default budget for header %#v, got %s", header, remaining)
+		}
+	}
+	if remaining := budget(false, "100"); remaining <= 100*time.Millisecond {
+		t.Fatalf("Expected the header to be ignored unless enabled, got %s", remaining)
+	}
+}
+
+// mirrorStates collects the mirror states written to it.
+type mirrorStates struct {
+	metrics.NilMetricsWriter
+	states chan *state.MirrorState
+}
+
+func (m *mirrorStates) WriteMirrorState(mirrorState *state.MirrorState) {
+	m.states <- mirrorState
+}
+
+func TestMirror(t *testing.T) {
+	var mu sync.Mutex
+	var shadowPath, shadowHeader string
+	shadow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		shadowPath = req.URL.RequestURI()
+		shadowHeader = req.Header.Get(MirrorHeader)
+		mu.Unlock()
+		if strings.HasPrefix(req.URL.Path, "/shadow/1/") {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Write([]byte("tile"))
+	}))
+	defer shadow.Close()
+
+	var jsonLog bytes.Buffer
+	mw := &mirrorStates{states: make(chan *state.MirrorState, 1)}
+	m, err := NewMirror(shadow.URL+"/shadow/", log.NewJsonLogger(golog.New(&jsonLog, "", 0), "test"), mw, MirrorOptions{Fraction: 1})
+	if err != nil {
+		t.Fatalf("Unable to create mirror: %s", err.Error())
+	}
+	h := m.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("tile"))
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/0/0/0.mvt?api_key=good", nil))
+	if rec.Body.String() != "tile" {
+		t.Fatalf("Expected the live response, got %#v", rec.Body.String())
+	}
+	ms := <-mw.states
+	mu.Lock()
+	if shadowPath != "/shadow/0/0/0.mvt?api_key=good" || shadowHeader != "1" {
+		t.Fatalf("Expected the request replayed under the shadow's path with %s, got %s with %#v", MirrorHeader, shadowPath, shadowHeader)
+	}
+	mu.Unlock()
+	if ms.IsMismatch() || ms.Status != http.StatusOK || ms.ShadowSize != 4 {
+		t.Fatalf("Expected matching responses, got %#v", ms)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/1/0/0.mvt", nil))
+	ms = <-mw.states
+	if !ms.IsMismatch() || ms.ShadowStatus != http.StatusNotFound {
+		t.Fatalf("Expected a status mismatch, got %#v", ms)
+	}
+	// the mismatch is logged before the metrics are written
+	if !strings.Contains(jsonLog.String(), `"category":"mirror"`) {
+		t.Fatalf("Expected the mismatch to be logged, got %s", jsonLog.String())
+	}
+
+	if _, err := NewMirror("shadow:8080", nil, mw, MirrorOptions{Fraction: 1}); err == nil {
+		t.Fatalf("Expected a url without a scheme to be rejected")
+	}
+}
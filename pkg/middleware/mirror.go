@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/log"
+	"github.com/tilezen/tapalcatl/pkg/metrics"
+	"github.com/tilezen/tapalcatl/pkg/state"
+)
+
+// MirrorHeader is set on replayed requests, so that the shadow deployment
+// can tell them apart from its own traffic.
+const MirrorHeader = "X-Tapalcatl-Mirror"
+
+// The limits on replays, unless configured otherwise
+const (
+	defaultMirrorTimeout     = 10 * time.Second
+	defaultMirrorMaxInFlight = 64
+)
+
+// MirrorOptions holds the settings of a Mirror.
+type MirrorOptions struct {
+	// Fraction is the share of requests replayed, from 0 to 1.
+	Fraction float64
+	// Timeout bounds each replay, default 10s.
+	Timeout time.Duration
+	// MaxInFlight is the most replays at once, default 64. Requests sampled
+	// while that many are in flight are counted as dropped instead.
+	MaxInFlight int
+	// Client makes the replays, default a client without a timeout of its
+	// own.
+	Client *http.Client
+}
+
+// Mirror replays a sample of the tile requests it wraps to a shadow
+// deployment, eg. of a new build or storage backend, and records how its
+// responses' status, size and latency compare with the live ones. Replays
+// happen after the live response is written, so they don't delay it, and
+// the shadow's responses are discarded.
+type Mirror struct {
+	target   *url.URL
+	options  MirrorOptions
+	logger   log.JsonLogger
+	mw       metrics.MetricsWriter
+	inFlight chan struct{}
+}
+
+func NewMirror(target string, logger log.JsonLogger, mw metrics.MetricsWriter, options MirrorOptions) (*Mirror, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid mirror url %s: %s", target, err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid mirror url %s: must be an absolute http or https url", target)
+	}
+	if options.Fraction <= 0 || options.Fraction > 1 {
+		return nil, fmt.Errorf("Mirror fraction must be more than 0 and at most 1, but is %g", options.Fraction)
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaultMirrorTimeout
+	}
+	if options.MaxInFlight <= 0 {
+		options.MaxInFlight = defaultMirrorMaxInFlight
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{}
+	}
+
+	return &Mirror{
+		target:   u,
+		options:  options,
+		logger:   logger,
+		mw:       mw,
+		inFlight: make(chan struct{}, options.MaxInFlight),
+	}, nil
+}
+
+// mirrorRecorder records the status and size of the live response.
+type mirrorRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (r *mirrorRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *mirrorRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *mirrorRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Handler serves the request, then replays it to the shadow deployment in
+// the background if it's sampled. Only GET and HEAD requests are replayed.
+func (m *Mirror) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if (req.Method != http.MethodGet && req.Method != http.MethodHead) || rand.Float64() >= m.options.Fraction {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		select {
+		case m.inFlight <- struct{}{}:
+		default:
+			m.mw.WriteMirrorState(&state.MirrorState{Path: req.URL.RequestURI(), IsDropped: true})
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		// the request may be changed by the handler, so its replay is made
+		// beforehand
+		shadowURL := *m.target
+		shadowURL.Path = strings.TrimSuffix(m.target.Path, "/") + req.URL.Path
+		shadowURL.RawPath = ""
+		shadowURL.RawQuery = req.URL.RawQuery
+		header := req.Header.Clone()
+		header.Set(MirrorHeader, "1")
+		mirrorState := &state.MirrorState{Path: req.URL.RequestURI()}
+
+		rec := &mirrorRecorder{ResponseWriter: rw}
+		start := time.Now()
+		h.ServeHTTP(rec, req)
+		mirrorState.Duration = time.Since(start)
+		mirrorState.Status = rec.status
+		if mirrorState.Status == 0 {
+			mirrorState.Status = http.StatusOK
+		}
+		mirrorState.Size = rec.size
+
+		go func() {
+			defer func() { <-m.inFlight }()
+			m.replay(req.Method, shadowURL.String(), header, mirrorState)
+		}()
+	})
+}
+
+// replay makes the request to the shadow deployment, recording and logging
+// how its response compares.
+func (m *Mirror) replay(method, u string, header http.Header, mirrorState *state.MirrorState) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.options.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := func() error {
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return err
+		}
+		req.Header = header
+		resp, err := m.options.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		mirrorState.ShadowStatus = resp.StatusCode
+		mirrorState.ShadowSize, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}()
+	mirrorState.ShadowDuration = time.Since(start)
+	if err != nil {
+		mirrorState.ShadowError = err.Error()
+	}
+
+	if mirrorState.IsMismatch() {
+		logData := mirrorState.AsJsonMap()
+		logData["type"] = "warning"
+		logData["category"] = log.LogCategory_Mirror.String()
+		m.logger.Log(logData)
+	}
+	m.mw.WriteMirrorState(mirrorState)
+}
@@ -0,0 +1,272 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Router_Mux matches each pattern in turn with gorilla/mux, which allows
+	// regexps in pattern variables.
+	Router_Mux = "mux"
+	// Router_Tree matches patterns with a Tree, in time depending on the
+	// length of the path rather than the number of patterns.
+	Router_Tree = "tree"
+)
+
+// IsValidRouter returns true when router is one of the Router_ constants.
+func IsValidRouter(router string) bool {
+	switch router {
+	case Router_Mux, Router_Tree:
+		return true
+	}
+	return false
+}
+
+// Tree matches request paths against patterns using a tree of their path
+// segments, for servers with too many patterns to try each in turn. Patterns
+// use the gorilla/mux syntax without regexps: each segment is either literal
+// or a template of literal text and {name} variables, such as {y}.{fmt}.
+// Literal segments take priority over templates, and templates with more
+// literal text over those with less.
+//
+// A Tree is added to a mux.Router as a single route with MatchRoute, so that
+// matched requests have their variables available from mux.Vars as usual.
+type Tree struct {
+	root *node
+}
+
+type node struct {
+	static    map[string]*node
+	templates []*templateNode
+	route     *route
+}
+
+type templateNode struct {
+	segment string
+	parts   []templatePart
+	node    *node
+}
+
+// templatePart is either literal text or, when variable is set, a variable
+// matching at least one character.
+type templatePart struct {
+	text     string
+	variable bool
+}
+
+type route struct {
+	handler http.Handler
+	methods []string
+	// muxRoute carries the pattern as its path template, so that
+	// mux.CurrentRoute and the explain endpoint see the pattern matched
+	// rather than the Tree's catch-all route.
+	muxRoute *mux.Route
+}
+
+func NewTree() *Tree {
+	return &Tree{root: &node{}}
+}
+
+// Handle adds a route for the pattern, allowing the given methods or any
+// method if there are none. It returns an error for patterns the Tree can't
+// match, such as those with regexps, and for duplicate patterns.
+func (t *Tree) Handle(pattern string, h http.Handler, methods ...string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("Pattern %s must start with /", pattern)
+	}
+
+	n := t.root
+	for _, segment := range strings.Split(pattern[1:], "/") {
+		if !strings.Contains(segment, "{") {
+			child, ok := n.static[segment]
+			if !ok {
+				if n.static == nil {
+					n.static = make(map[string]*node)
+				}
+				child = &node{}
+				n.static[segment] = child
+			}
+			n = child
+			continue
+		}
+
+		var child *node
+		for _, tn := range n.templates {
+			if tn.segment == segment {
+				child = tn.node
+				break
+			}
+		}
+		if child == nil {
+			parts, err := parseTemplate(segment)
+			if err != nil {
+				return fmt.Errorf("Pattern %s can't be matched by the tree router: %s", pattern, err.Error())
+			}
+			child = &node{}
+			n.addTemplate(&templateNode{segment: segment, parts: parts, node: child})
+		}
+		n = child
+	}
+
+	if n.route != nil {
+		return fmt.Errorf("Pattern %s is already handled", pattern)
+	}
+	muxRoute := mux.NewRouter().Path(pattern).Handler(h)
+	if err := muxRoute.GetError(); err != nil {
+		return fmt.Errorf("Invalid pattern %s: %s", pattern, err.Error())
+	}
+	n.route = &route{handler: h, methods: methods, muxRoute: muxRoute}
+	return nil
+}
+
+// addTemplate adds a template child, keeping those with more literal text
+// first so that {y}@2x.{fmt} is tried before {y}.{fmt}, whichever order the
+// patterns were added in.
+func (n *node) addTemplate(tn *templateNode) {
+	i := len(n.templates)
+	for i > 0 && n.templates[i-1].literalLen() < tn.literalLen() {
+		i--
+	}
+	n.templates = append(n.templates, nil)
+	copy(n.templates[i+1:], n.templates[i:])
+	n.templates[i] = tn
+}
+
+func (tn *templateNode) literalLen() int {
+	length := 0
+	for _, part := range tn.parts {
+		if !part.variable {
+			length += len(part.text)
+		}
+	}
+	return length
+}
+
+// parseTemplate splits a path segment into its literal text and variables.
+func parseTemplate(segment string) ([]templatePart, error) {
+	var parts []templatePart
+	for segment != "" {
+		start := strings.Index(segment, "{")
+		if start < 0 {
+			parts = append(parts, templatePart{text: segment})
+			break
+		}
+		if start > 0 {
+			parts = append(parts, templatePart{text: segment[:start]})
+		}
+		end := strings.Index(segment, "}")
+		if end < start {
+			return nil, fmt.Errorf("unbalanced braces in %s", segment)
+		}
+		name := segment[start+1 : end]
+		switch {
+		case name == "":
+			return nil, fmt.Errorf("empty variable name in %s", segment)
+		case strings.ContainsAny(name, ":{"):
+			return nil, fmt.Errorf("variable %s has a regexp", name)
+		case len(parts) > 0 && parts[len(parts)-1].variable:
+			return nil, fmt.Errorf("variable %s directly follows another variable", name)
+		}
+		parts = append(parts, templatePart{text: name, variable: true})
+		segment = segment[end+1:]
+	}
+	return parts, nil
+}
+
+// MatchRoute is a mux.MatcherFunc matching requests against the Tree's
+// patterns, setting the matched route's handler and variables. Requests for a
+// pattern which doesn't allow their method fail to match with
+// mux.ErrMethodMismatch, for mux to respond 405 as it would to its own routes.
+func (t *Tree) MatchRoute(req *http.Request, match *mux.RouteMatch) bool {
+	var vars []string
+	r := t.root.lookup(strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/"), &vars)
+	if r == nil {
+		return false
+	}
+
+	if len(r.methods) > 0 {
+		allowed := false
+		for _, method := range r.methods {
+			if method == req.Method {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			match.MatchErr = mux.ErrMethodMismatch
+			return false
+		}
+	}
+
+	match.Route = r.muxRoute
+	match.Handler = r.handler
+	match.Vars = make(map[string]string, len(vars)/2)
+	for i := 0; i < len(vars); i += 2 {
+		match.Vars[vars[i]] = vars[i+1]
+	}
+	return true
+}
+
+// lookup returns the route for the remaining path segments, appending the
+// names and values of the variables matched along the way to vars.
+func (n *node) lookup(segments []string, vars *[]string) *route {
+	if len(segments) == 0 {
+		return n.route
+	}
+
+	segment, rest := segments[0], segments[1:]
+	if child, ok := n.static[segment]; ok {
+		if r := child.lookup(rest, vars); r != nil {
+			return r
+		}
+	}
+
+	mark := len(*vars)
+	for _, tn := range n.templates {
+		if matchTemplate(tn.parts, segment, vars) {
+			if r := tn.node.lookup(rest, vars); r != nil {
+				return r
+			}
+		}
+		*vars = (*vars)[:mark]
+	}
+	return nil
+}
+
+// matchTemplate matches a path segment against a template, appending the
+// variables' names and values to vars. Like the [^/]+ regexp mux uses for
+// variables, each variable matches as much of the segment as it can.
+func matchTemplate(parts []templatePart, segment string, vars *[]string) bool {
+	if len(parts) == 0 {
+		return segment == ""
+	}
+
+	part := parts[0]
+	if !part.variable {
+		return strings.HasPrefix(segment, part.text) && matchTemplate(parts[1:], segment[len(part.text):], vars)
+	}
+	if segment == "" {
+		return false
+	}
+	if len(parts) == 1 {
+		*vars = append(*vars, part.text, segment)
+		return true
+	}
+
+	// a variable is always followed by literal text, so try the latest
+	// occurrence of it first
+	next := parts[1].text
+	mark := len(*vars)
+	for end := strings.LastIndex(segment, next); end > 0; end = strings.LastIndex(segment[:end], next) {
+		*vars = append(*vars, part.text, segment[:end])
+		if matchTemplate(parts[1:], segment[end:], vars) {
+			return true
+		}
+		*vars = (*vars)[:mark]
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTree(t *testing.T) {
+	tree := NewTree()
+	for _, pattern := range []string{
+		"/osm/{z}/{x}/{y}.{fmt}",
+		"/osm/{z}/{x}/{y}@2x.{fmt}",
+		"/osm/tilejson.{fmt}",
+		"/v1/{apikey}/tiles/{z}/{x}/{y}.{fmt}",
+	} {
+		if err := tree.Handle(pattern, http.NotFoundHandler(), "GET"); err != nil {
+			t.Fatalf("Unable to handle %s: %s", pattern, err.Error())
+		}
+	}
+
+	for path, expected := range map[string]map[string]string{
+		"/osm/1/2/3.mvt":               {"z": "1", "x": "2", "y": "3", "fmt": "mvt"},
+		"/osm/1/2/3@2x.mvt":            {"z": "1", "x": "2", "y": "3", "fmt": "mvt"},
+		"/osm/1/2/3.4.mvt":             {"z": "1", "x": "2", "y": "3.4", "fmt": "mvt"},
+		"/osm/tilejson.json":           {"fmt": "json"},
+		"/v1/key/tiles/1/2/3.topojson": {"apikey": "key", "z": "1", "x": "2", "y": "3", "fmt": "topojson"},
+		"/osm/1/2/3":                   nil,
+		"/osm/1/2/.mvt":                nil,
+		"/osm/1/2/3.mvt/":              nil,
+		"/other/1/2/3.mvt":             nil,
+	} {
+		var match mux.RouteMatch
+		matched := tree.MatchRoute(httptest.NewRequest("GET", path, nil), &match)
+		if matched != (expected != nil) {
+			t.Fatalf("Expected %s to match %t", path, expected != nil)
+		}
+		if matched && !reflect.DeepEqual(match.Vars, expected) {
+			t.Fatalf("Expected %s to have variables %v, got %v", path, expected, match.Vars)
+		}
+	}
+
+	var match mux.RouteMatch
+	if tree.MatchRoute(httptest.NewRequest("POST", "/osm/1/2/3.mvt", nil), &match) || match.MatchErr != mux.ErrMethodMismatch {
+		t.Fatalf("Expected a method mismatch for POST")
+	}
+
+	for _, pattern := range []string{"/{z:[0-9]+}/{x}/{y}.{fmt}", "/{z}/{x}{y}", "/{z", "osm/{z}", "/osm/{z}/{x}/{y}.{fmt}"} {
+		if err := tree.Handle(pattern, http.NotFoundHandler()); err == nil {
+			t.Fatalf("Expected an error for pattern %s", pattern)
+		}
+	}
+}
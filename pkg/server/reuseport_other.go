@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// CanReusePort is false on platforms without SO_REUSEPORT, where only one
+// process can listen on an address.
+const CanReusePort = false
+
+// ListenReusePort fails on platforms without SO_REUSEPORT.
+func ListenReusePort(addr string) (net.Listener, error) {
+	return nil, fmt.Errorf("listening with SO_REUSEPORT isn't supported on this platform")
+}
@@ -0,0 +1,1259 @@
+// Package server builds the tapalcatl tile server from its configuration, so
+// that other Go services can mount the tile handlers on their own mux rather
+// than running the tapalcatl binary.
+//
+// A minimal embedding, with the handler config as JSON like the -handler flag:
+//
+//	hc := config.HandlerConfig{}
+//	if err := hc.Set(handlerJson); err != nil { ... }
+//	s, err := server.New(hc, server.Options{Logger: logger})
+//	if err != nil { ... }
+//	mux.PathPrefix("/tiles/").Handler(http.StripPrefix("/tiles", s.Handler()))
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/oxtoacart/bpool"
+	"golang.org/x/net/http2"
+
+	"github.com/tilezen/tapalcatl/pkg/buffer"
+	"github.com/tilezen/tapalcatl/pkg/cache"
+	"github.com/tilezen/tapalcatl/pkg/config"
+	"github.com/tilezen/tapalcatl/pkg/golden"
+	"github.com/tilezen/tapalcatl/pkg/handler"
+	"github.com/tilezen/tapalcatl/pkg/log"
+	"github.com/tilezen/tapalcatl/pkg/metrics"
+	"github.com/tilezen/tapalcatl/pkg/middleware"
+	"github.com/tilezen/tapalcatl/pkg/router"
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/storage"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// Options are the server settings other than the handler config, which the
+// tapalcatl binary sets from its flags. The zero value, apart from the
+// Logger, is a server without any of the optional behaviour.
+type Options struct {
+	Logger log.JsonLogger
+	// AccessLog adds an access log in the Common or Combined Log Format, for
+	// log processors which only parse those.
+	AccessLog log.LoggingOptions
+
+	// URL paths of the healthcheck and readiness check, not served if empty.
+	Healthcheck string
+	ReadyCheck  string
+	// HealthcheckInterval, if positive, reuses the result of the storage
+	// healthchecks for this long rather than checking on every request.
+	HealthcheckInterval time.Duration
+	// HealthcheckTimeout, if positive, fails the healthcheck of a storage
+	// which takes longer than this.
+	HealthcheckTimeout time.Duration
+	// ReadyCheckCache fails the readiness check while the cache is unhealthy.
+	ReadyCheckCache bool
+
+	// Number and size of buffers to pool, both 0 to allocate them on demand.
+	PoolNumEntries int
+	PoolEntrySize  int
+
+	// MetricsStatsdAddr is the host:port to send statsd metrics to, if any.
+	MetricsStatsdAddr   string
+	MetricsStatsdPrefix string
+	// MetricsBuildDimension counts response states per requested build.
+	MetricsBuildDimension bool
+	// MetricsNaming is one of the metrics.MetricNaming_ constants, default legacy.
+	MetricsNaming string
+	// MetricsDoubleWritePeriod ends writing both metric names this long after
+	// the server is created, 0 for no limit.
+	MetricsDoubleWritePeriod time.Duration
+	// MetricsFormats are the formats counted by name, default those in the
+	// handler config's Mime and the tilejson formats.
+	MetricsFormats []string
+	// CaptureHeaders are request headers whose values are logged with each
+	// tile and tilejson request.
+	CaptureHeaders []string
+
+	// RedisAddr is the address of redis to cache tiles in, if any.
+	RedisAddr string
+	// DynamoDBCacheTable is the DynamoDB table to cache tiles in, if any,
+	// in place of redis. Its partition key is the string attribute "key".
+	DynamoDBCacheTable string
+	// DynamoDBTTLAttribute is the attribute of the table's items
+	// holding when they expire, default "expires".
+	DynamoDBTTLAttribute string
+	// MemcachedAddrs are the memcached servers to cache tiles in, if any,
+	// in place of redis, with keys spread between them.
+	MemcachedAddrs []string
+	// CacheCompressedTiles caches gzipped tiles alongside the uncompressed ones.
+	CacheCompressedTiles bool
+	// StoreCompressedTiles caches gzipped tiles in place of the uncompressed
+	// ones, decompressing them for clients which don't accept gzip.
+	StoreCompressedTiles bool
+	// CacheStaleTTL keeps cached tiles this long past their TTL, to serve
+	// when storage is unavailable.
+	CacheStaleTTL time.Duration
+	// CacheTTLJitter shortens cache TTLs and max-ages by a random fraction
+	// of them, up to this fraction from 0 to 1, so that tiles cached
+	// together don't all expire together.
+	CacheTTLJitter float64
+	// ServeStale serves stale cached tiles when storage fetches fail.
+	ServeStale bool
+	// DiskCache keeps metatiles on local disk in front of redis, if its
+	// Dir is set.
+	DiskCache cache.DiskCacheOptions
+	// WatchdogStall is how long the metrics worker and background cache
+	// sets can go without progress before the watchdog restarts them, 0 to
+	// not watch them.
+	WatchdogStall time.Duration
+
+	// MaxZoom is the deepest zoom served by metatile patterns, 0 for no limit.
+	MaxZoom int
+	// MaxZoomPolicy is one of the handler.MaxZoomPolicy_ constants, default notfound.
+	MaxZoomPolicy string
+	// TombstonePolicy is one of the handler.TombstonePolicy_ constants,
+	// default ignore.
+	TombstonePolicy string
+	// TombstoneMaxAge is the max-age of responses for tombstoned tiles.
+	TombstoneMaxAge time.Duration
+	// ArchivedPolicy is one of the handler.ArchivedPolicy_ constants,
+	// default unavailable.
+	ArchivedPolicy string
+	// ArchivedRetryAfter is the Retry-After of unavailable responses for
+	// archived metatiles.
+	ArchivedRetryAfter time.Duration
+	// DuplicateEntryPolicy is one of the tile.DuplicateEntryPolicy_
+	// constants, default first.
+	DuplicateEntryPolicy string
+	// ValidateTiles checks mvt tiles are well formed before serving them.
+	ValidateTiles bool
+	// AllowUnknownFormats serves formats missing from the handler config's
+	// Mime as application/octet-stream, rather than responding 404.
+	AllowUnknownFormats bool
+	// ServerTiming adds a Server-Timing header to tile responses.
+	ServerTiming bool
+	// TimingUnit is one of the state.TimingUnit_ constants, the unit of the
+	// logged timings and the precision of statsd timers, default
+	// milliseconds.
+	TimingUnit string
+	// Worker is the number of this process among the workers started by a
+	// Supervisor, or 0 when it's the only process.
+	Worker int
+
+	// ShedMaxInFlight is the number of tile requests handled at once before
+	// queueing them, 0 to disable load shedding.
+	ShedMaxInFlight  int
+	ShedMaxQueue     int
+	ShedQueueTimeout time.Duration
+
+	// Degradation enters degraded mode, turning off expensive features,
+	// while the storage error rate is high. It can also be switched with the
+	// admin endpoint.
+	Degradation handler.DegradationOptions
+
+	// APIKeys, when not empty, are the keys allowed to request tiles.
+	APIKeys []string
+	// APIKeyVariable is the pattern variable holding the API key, for
+	// patterns like /v1/{apikey}/tiles/{z}/{x}/{y}.mvt.
+	APIKeyVariable string
+	// RateLimit is the maximum tile requests per second, 0 for no limit.
+	RateLimit      float64
+	RateLimitBurst int
+	// BanMalformedStrikes bans clients for BanMalformedDuration once they've
+	// made this many malformed tile requests within BanMalformedWindow, 0
+	// to never ban them.
+	BanMalformedStrikes  int
+	BanMalformedWindow   time.Duration
+	BanMalformedDuration time.Duration
+	// MirrorURL, if set, is a shadow deployment to replay a sample of tile
+	// requests to, eg. https://shadow.example.com, comparing its responses
+	// with the live ones.
+	MirrorURL string
+	Mirror    middleware.MirrorOptions
+	// MaxURLLength rejects tile requests with a longer path and query as
+	// malformed, 0 for no limit.
+	MaxURLLength int
+	// CacheKeyParams, if set, are the only query parameters of tile
+	// requests, besides api_key, which affect the response. They're part
+	// of the tile cache keys and echoed in the X-Cache-Key-Params header.
+	CacheKeyParams []string
+	// RequestTimeout bounds the time to respond to a tile request, 0 for no limit.
+	RequestTimeout time.Duration
+	// RequestDeadline is the default budget for the cache and storage calls
+	// of a tile request, after which they're abandoned, 0 for no limit.
+	RequestDeadline time.Duration
+	// RequestDeadlineHeader takes the budget from the X-Request-Deadline-Ms
+	// header of requests which have one.
+	RequestDeadlineHeader bool
+
+	// GzipBufferSize buffers compressed responses up to this size so that
+	// they're sent with a Content-Length, 0 to always stream them.
+	GzipBufferSize int
+	// InstrumentCompression records the time spent compressing tiles and
+	// their compressed size with the tile metrics.
+	InstrumentCompression bool
+	// Vary lists request headers to add to the Vary header of every response.
+	Vary []string
+	// ETagStyle is one of the handler.ETagStyle_ constants, default preserve.
+	ETagStyle string
+	// StripErrorValidators removes ETag and Last-Modified from error responses.
+	StripErrorValidators bool
+	// HTTP2 allows cleartext connections to be upgraded to HTTP/2 when set.
+	HTTP2 *http2.Server
+
+	// SelfTest fetches one tile per pattern while creating the server, and
+	// fails if any can't be fetched.
+	SelfTest bool
+	// SelfTestTile is the default z/x/y.fmt tile to fetch, default 0/0/0.mvt.
+	SelfTestTile string
+
+	// Router is how tile patterns are matched, one of the router.Router_
+	// constants, default router.Router_Mux. router.Router_Tree is faster with
+	// many patterns, but doesn't allow regexps in pattern variables.
+	Router string
+
+	// Admin enables the /admin endpoints, which expose internal state.
+	Admin bool
+	// HotTiles is the number of most requested tiles of each metatile
+	// pattern served by /admin/hot, 0 to not track them.
+	HotTiles int
+	// AdminSettings are shown alongside the handler config by /admin/config,
+	// eg. the values of the binary's flags.
+	AdminSettings map[string]string
+	// BuildWebhookToken, when set, enables the /admin/builds endpoint for
+	// the build pipeline to call with this bearer token when a build lands.
+	BuildWebhookToken string
+	// WarmPaths are the tile paths requested by /admin/builds to fill the
+	// cache after a build lands, including any api_key they need.
+	WarmPaths []string
+	// GoldenPaths are the tile paths recorded and compared by the
+	// /admin/golden endpoints, including any api_key they need.
+	GoldenPaths []string
+	// GoldenStore is where golden tile recordings are kept, a directory or
+	// an s3://bucket/prefix URL. The endpoints are enabled when it and
+	// GoldenPaths are set.
+	GoldenStore string
+
+	// Chaos, if set, injects faults into storage and cache calls to
+	// exercise the server's resilience in staging. Never set it in
+	// production.
+	Chaos *ChaosOptions
+}
+
+// ChaosOptions are the faults injected by a server for resilience testing.
+type ChaosOptions struct {
+	// Storage faults are injected into each s3 and file storage, so that
+	// replicated and fallback storages see theirs fail independently.
+	Storage storage.ChaosOptions
+	// CacheTimeoutRate is the fraction of cache calls, from 0 to 1, which
+	// time out.
+	CacheTimeoutRate float64
+}
+
+// Server is a configured tile server.
+type Server struct {
+	router  *mux.Router
+	handler http.Handler
+
+	metricsWriter metrics.MetricsWriter
+	loadShedder   *handler.LoadShedder
+	inFlight      *handler.InFlightCounter
+	degradation   *handler.Degradation
+	banList       *handler.BanList
+	watchdog      *handler.Watchdog
+
+	// for the admin diag endpoint
+	buffers         *buffer.CountingBufferManager
+	bufferPoolSize  int
+	patternInFlight map[string]*handler.InFlightCounter
+
+	// for the admin hot endpoint, by pattern
+	tileTrackers map[string]*handler.TileTracker
+
+	// for listing the storages of the patterns
+	explainRoutes map[string]*handler.ExplainRoute
+
+	// closed with the server, to stop their healthchecks
+	replicatedStorages []*storage.ReplicatedStorage
+
+	readinessResponseCode uint32
+}
+
+// New creates the storages, cache, metrics writer and handlers configured by
+// hc and options, returning an error if the configuration is invalid.
+func New(hc config.HandlerConfig, options Options) (*Server, error) {
+	if options.Logger == nil {
+		return nil, errors.New("A logger is required.")
+	}
+	if len(hc.Pattern) == 0 {
+		return nil, errors.New("You must provide at least one pattern.")
+	}
+	if len(hc.Storage) == 0 {
+		return nil, errors.New("You must provide at least one storage.")
+	}
+	if options.MaxZoomPolicy == "" {
+		options.MaxZoomPolicy = handler.MaxZoomPolicy_NotFound
+	}
+	if options.AccessLog.AccessLogFormat != "" && !log.IsValidAccessLogFormat(options.AccessLog.AccessLogFormat) {
+		return nil, fmt.Errorf("Invalid access log format: %s", options.AccessLog.AccessLogFormat)
+	}
+	if options.AccessLog.OmitJson && options.AccessLog.AccessLogFormat == "" {
+		return nil, errors.New("Omitting the JSON request log requires an access log format.")
+	}
+	if options.TombstonePolicy == "" {
+		options.TombstonePolicy = handler.TombstonePolicy_Ignore
+	}
+	if options.ArchivedPolicy == "" {
+		options.ArchivedPolicy = handler.ArchivedPolicy_Unavailable
+	}
+	if !handler.IsValidArchivedPolicy(options.ArchivedPolicy) {
+		return nil, fmt.Errorf("Invalid archived policy: %s", options.ArchivedPolicy)
+	}
+	if options.DuplicateEntryPolicy == "" {
+		options.DuplicateEntryPolicy = tile.DuplicateEntryPolicy_First
+	}
+	if !tile.IsValidDuplicateEntryPolicy(options.DuplicateEntryPolicy) {
+		return nil, fmt.Errorf("Invalid duplicate entry policy: %s", options.DuplicateEntryPolicy)
+	}
+	if options.TimingUnit != "" && !state.IsValidTimingUnit(options.TimingUnit) {
+		return nil, fmt.Errorf("Invalid timing unit: %s", options.TimingUnit)
+	}
+	if options.CacheTTLJitter < 0 || options.CacheTTLJitter > 1 {
+		return nil, fmt.Errorf("Cache TTL jitter must be between 0 and 1, but is %g", options.CacheTTLJitter)
+	}
+	if options.Chaos != nil {
+		if err := options.Chaos.Storage.Validate(); err != nil {
+			return nil, err
+		}
+		options.Logger.Warning(log.LogCategory_ConfigError, "Chaos enabled, injecting faults into storage and cache calls: %+v", *options.Chaos)
+	}
+	if options.SelfTestTile == "" {
+		options.SelfTestTile = "0/0/0.mvt"
+	}
+	if options.Router == "" {
+		options.Router = router.Router_Mux
+	}
+	if !router.IsValidRouter(options.Router) {
+		return nil, fmt.Errorf("Invalid router: %s", options.Router)
+	}
+
+	logger := options.Logger
+	s := &Server{
+		router:                mux.NewRouter(),
+		inFlight:              &handler.InFlightCounter{},
+		degradation:           handler.NewDegradation(options.Degradation, logger),
+		patternInFlight:       make(map[string]*handler.InFlightCounter),
+		tileTrackers:          make(map[string]*handler.TileTracker),
+		explainRoutes:         make(map[string]*handler.ExplainRoute),
+		readinessResponseCode: http.StatusOK,
+	}
+
+	b := &builder{
+		hc:                  &hc,
+		options:             &options,
+		logger:              logger,
+		healthCheckStorages: make(map[config.HealthCheckConfig]storage.Storage),
+		postgresDBs:         make(map[string]*sql.DB),
+		memoryStorages:      make(map[string]*storage.MemoryStorage),
+		diskCaches:          make(map[string]*storage.DiskCache),
+		replicatedStorages:  make(map[string]*storage.ReplicatedStorage),
+		s3HTTPClients:       make(map[string]*http.Client),
+		selfTests:           make(map[string]func() error),
+		explainRoutes:       s.explainRoutes,
+		degradation:         s.degradation,
+		patternInFlight:     s.patternInFlight,
+		tileTrackers:        s.tileTrackers,
+	}
+	// stop the storages' background work if the config turns out invalid
+	built := false
+	defer func() {
+		if !built {
+			for _, rs := range b.replicatedStorages {
+				rs.Close()
+			}
+		}
+	}()
+
+	// buffer manager shared by all handlers
+	if options.PoolNumEntries > 0 && options.PoolEntrySize > 0 {
+		s.buffers = buffer.NewCountingBufferManager(bpool.NewSizedBufferPool(options.PoolNumEntries, options.PoolEntrySize))
+		s.bufferPoolSize = options.PoolNumEntries
+	} else {
+		s.buffers = buffer.NewCountingBufferManager(&buffer.OnDemandBufferManager{})
+	}
+	b.bufferManager = s.buffers
+
+	caches := 0
+	for _, set := range []bool{options.RedisAddr != "", options.DynamoDBCacheTable != "", len(options.MemcachedAddrs) > 0} {
+		if set {
+			caches++
+		}
+	}
+	if caches > 1 {
+		return nil, errors.New("Only one of a redis address, a DynamoDB cache table and memcached addresses can be used.")
+	}
+	if options.RedisAddr != "" {
+		client := redis.NewClient(&redis.Options{
+			Addr: options.RedisAddr,
+		})
+
+		// Ping Redis to make sure it's available before starting.
+		// Using a longer timeout to give time for network connections to spin up, etc.
+		timeoutCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+		if err := client.Ping(timeoutCtx).Err(); err != nil {
+			return nil, fmt.Errorf("Couldn't reach Redis service at %s: %s", options.RedisAddr, err.Error())
+		}
+
+		logger.Info("Redis connected to %s", options.RedisAddr)
+		b.tileCache = cache.NewRedisCacheWithOptions(client, cache.RedisCacheOptions{StaleTTL: options.CacheStaleTTL})
+	} else if options.DynamoDBCacheTable != "" {
+		sess, cfg, err := b.awsConfig(nil)
+		if err != nil {
+			return nil, err
+		}
+		b.tileCache = cache.NewDynamoDBCacheWithOptions(dynamodb.New(sess, cfg), options.DynamoDBCacheTable, cache.DynamoDBCacheOptions{
+			TTLAttribute: options.DynamoDBTTLAttribute,
+			StaleTTL:     options.CacheStaleTTL,
+		})
+
+		// Check the table exists before starting, as for redis.
+		timeoutCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+		if err := b.tileCache.HealthCheck(timeoutCtx); err != nil {
+			return nil, fmt.Errorf("Couldn't reach DynamoDB cache table %s: %s", options.DynamoDBCacheTable, err.Error())
+		}
+
+		logger.Info("DynamoDB cache in table %s", options.DynamoDBCacheTable)
+	} else if len(options.MemcachedAddrs) > 0 {
+		b.tileCache = cache.NewMemcacheCache(options.MemcachedAddrs)
+
+		// Ping memcached to make sure it's available before starting.
+		if err := b.tileCache.HealthCheck(context.Background()); err != nil {
+			return nil, fmt.Errorf("Couldn't reach memcached at %s: %s", strings.Join(options.MemcachedAddrs, ","), err.Error())
+		}
+
+		logger.Info("Memcached connected to %s", strings.Join(options.MemcachedAddrs, ","))
+	} else {
+		b.tileCache = cache.NilCache
+	}
+	if options.DiskCache.Dir != "" {
+		diskCache, err := cache.NewDiskCache(b.tileCache, options.DiskCache)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Disk cache of %d bytes in %s", options.DiskCache.MaxBytes, options.DiskCache.Dir)
+		b.tileCache = diskCache
+	}
+	if options.Chaos != nil && options.Chaos.CacheTimeoutRate > 0 {
+		chaosCache, err := cache.NewChaosCache(b.tileCache, options.Chaos.CacheTimeoutRate)
+		if err != nil {
+			return nil, err
+		}
+		b.tileCache = chaosCache
+	}
+
+	mw, err := newMetricsWriter(&hc, &options)
+	if err != nil {
+		return nil, err
+	}
+	b.mw = mw
+	s.metricsWriter = mw
+
+	for sName, sd := range hc.Storage {
+		switch sd.Type {
+		case "s3", "http", "postgres", "file", "memory", "sftp", "webdav", "replicated", "fallback":
+		default:
+			return nil, fmt.Errorf("Unknown storage type for storage %s: %s", sName, sd.Type)
+		}
+	}
+
+	if len(hc.TileJson) > 0 {
+		b.tileJsonFormats = make(map[string]state.TileJsonFormat, len(hc.TileJson)+3)
+		for _, format := range []state.TileJsonFormat{state.TileJsonFormat_Mvt, state.TileJsonFormat_Json, state.TileJsonFormat_Topojson} {
+			b.tileJsonFormats[format.Name()] = format
+		}
+		for name, document := range hc.TileJson {
+			if name == "" || !state.IsValidTileJsonFormat(document) {
+				return nil, fmt.Errorf("Invalid tilejson format %s: %s", name, document)
+			}
+			b.tileJsonFormats[name] = state.TileJsonFormat(document)
+		}
+	}
+
+	middlewareOptions := middleware.Options{
+		Logger:                logger,
+		Logging:               options.AccessLog,
+		InFlight:              s.inFlight,
+		HTTP2:                 options.HTTP2,
+		APIKeys:               options.APIKeys,
+		APIKeyVariable:        options.APIKeyVariable,
+		Timeout:               options.RequestTimeout,
+		Deadline:              options.RequestDeadline,
+		DeadlineHeader:        options.RequestDeadlineHeader,
+		GzipBufferSize:        options.GzipBufferSize,
+		InstrumentCompression: options.InstrumentCompression,
+		Headers: handler.HeaderOptions{
+			Vary:                 options.Vary,
+			ETagStyle:            options.ETagStyle,
+			StripErrorValidators: options.StripErrorValidators,
+		},
+	}
+	if len(hc.Tenants) > 0 {
+		middlewareOptions.Tenants = make(map[string]*handler.Tenant)
+		plainKeys := make(map[string]bool, len(options.APIKeys))
+		for _, key := range options.APIKeys {
+			plainKeys[key] = true
+		}
+		for name, tc := range hc.Tenants {
+			if tc.Prefix == "" {
+				return nil, fmt.Errorf("Tenant %s must have a prefix", name)
+			}
+			if len(tc.ApiKeys) == 0 {
+				return nil, fmt.Errorf("Tenant %s must have at least one api key", name)
+			}
+			tenant := &handler.Tenant{Name: name, Prefix: tc.Prefix}
+			for _, key := range tc.ApiKeys {
+				if _, ok := middlewareOptions.Tenants[key]; ok || plainKeys[key] {
+					return nil, fmt.Errorf("Api key of tenant %s is already in use", name)
+				}
+				middlewareOptions.Tenants[key] = tenant
+			}
+		}
+	}
+	switch middlewareOptions.Headers.ETagStyle {
+	case "":
+		middlewareOptions.Headers.ETagStyle = handler.ETagStyle_Preserve
+	case handler.ETagStyle_Preserve, handler.ETagStyle_Strong, handler.ETagStyle_Weak, handler.ETagStyle_Encoding:
+	default:
+		return nil, fmt.Errorf("Invalid etag style: %s", options.ETagStyle)
+	}
+	if options.RateLimit > 0 {
+		middlewareOptions.RateLimiter = middleware.NewRateLimiter(options.RateLimit, options.RateLimitBurst)
+	}
+	if options.BanMalformedStrikes > 0 {
+		if options.BanMalformedWindow <= 0 || options.BanMalformedDuration <= 0 {
+			return nil, errors.New("Banning clients for malformed requests needs a positive window and duration.")
+		}
+		s.banList = handler.NewBanList(options.BanMalformedStrikes, options.BanMalformedWindow, options.BanMalformedDuration)
+		b.banList = s.banList
+		middlewareOptions.BanList = s.banList
+	}
+	if options.MirrorURL != "" {
+		middlewareOptions.Mirror, err = middleware.NewMirror(options.MirrorURL, logger, mw, options.Mirror)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.routeChain = middleware.RouteChain(middlewareOptions)
+
+	// shared by all metatile patterns, so that their priorities compete
+	if options.ShedMaxInFlight > 0 {
+		b.loadShedder = handler.NewLoadShedder(options.ShedMaxInFlight, options.ShedMaxQueue, options.ShedQueueTimeout)
+		s.loadShedder = b.loadShedder
+	}
+
+	// create the storage implementations and handler routes for patterns
+	if options.Router == router.Router_Tree {
+		b.tree = router.NewTree()
+	}
+	for reqPattern, rhc := range hc.Pattern {
+		if err := b.addPattern(s.router, reqPattern, rhc); err != nil {
+			return nil, err
+		}
+	}
+	if b.tree != nil {
+		s.router.MatcherFunc(b.tree.MatchRoute)
+	}
+
+	if options.SelfTest {
+		failed := 0
+		for reqPattern, test := range b.selfTests {
+			if err := test(); err != nil {
+				logger.Error(log.LogCategory_ConfigError, "Self-test failed for pattern %s: %s", reqPattern, err.Error())
+				failed++
+			} else {
+				logger.Info("Self-test passed for pattern %s", reqPattern)
+			}
+		}
+		if failed > 0 {
+			return nil, fmt.Errorf("Self-test failed for %d of %d patterns", failed, len(b.selfTests))
+		}
+	}
+
+	if hc.Preview != nil {
+		if hc.Preview.Path == nil || hc.Preview.Template == nil {
+			return nil, errors.New("Preview must have path and template specified")
+		}
+
+		var templateData map[string]interface{}
+		if hc.Preview.Data != nil {
+			templateData = *hc.Preview.Data
+		}
+
+		fileHandler, err := handler.NewFileHandler(*hc.Preview.Template, templateData)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load preview template: %+v", err)
+		}
+
+		s.router.Handle(*hc.Preview.Path, fileHandler).Methods("GET")
+	}
+
+	if len(options.Healthcheck) > 0 {
+		storagesToCheck := make([]storage.Storage, 0, len(b.healthCheckStorages))
+		for _, stg := range b.healthCheckStorages {
+			storagesToCheck = append(storagesToCheck, stg)
+		}
+		healthCheckHandler := handler.HealthCheckHandlerWithOptions(storagesToCheck, b.tileCache, logger, handler.HealthCheckOptions{
+			Interval: options.HealthcheckInterval,
+			Timeout:  options.HealthcheckTimeout,
+		})
+		s.router.Handle(options.Healthcheck, healthCheckHandler).Methods("GET")
+	}
+
+	if options.Admin {
+		configDump, err := config.Dump(options.AdminSettings, &hc)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to dump config: %s", err.Error())
+		}
+
+		admin := s.router.PathPrefix("/admin").Subrouter()
+		admin.Handle("/config", handler.ConfigHandler(configDump, logger)).Methods("GET")
+		admin.Handle("/explain", handler.ExplainHandler(s.router, b.explainRoutes, logger)).Methods("GET")
+		admin.Handle("/list", handler.ListHandler(b.explainRoutes, logger)).Methods("GET")
+		admin.Handle("/degradation", handler.DegradationHandler(s.degradation, logger)).Methods("GET", "POST")
+		admin.Handle("/diag", handler.DiagHandler(s.Diagnostics, logger)).Methods("GET")
+		if options.HotTiles > 0 {
+			admin.Handle("/hot", handler.HotTilesHandler(s.tileTrackers, logger)).Methods("GET")
+		}
+		if options.BuildWebhookToken != "" {
+			webhookOptions := handler.BuildWebhookOptions{
+				Token:     options.BuildWebhookToken,
+				Manifests: b.buildManifests,
+				Cache:     b.tileCache,
+				WarmPaths: options.WarmPaths,
+				Warmer:    s.router,
+			}
+			admin.Handle("/builds", handler.BuildWebhookHandler(webhookOptions, logger)).Methods("POST")
+		}
+		if len(options.GoldenPaths) > 0 && options.GoldenStore != "" {
+			store, err := b.goldenStore(options.GoldenStore)
+			if err != nil {
+				return nil, err
+			}
+			recorder := &golden.Recorder{Handler: s.router, Paths: options.GoldenPaths, Store: store}
+			admin.Handle("/golden/record", handler.GoldenRecordHandler(recorder, logger)).Methods("POST")
+			admin.Handle("/golden/compare", handler.GoldenCompareHandler(recorder, logger)).Methods("GET")
+		}
+	}
+
+	// Readiness probe for graceful shutdown support
+	if len(options.ReadyCheck) > 0 {
+		tileCache := b.tileCache
+		s.router.HandleFunc(options.ReadyCheck, func(w http.ResponseWriter, r *http.Request) {
+			code := int(atomic.LoadUint32(&s.readinessResponseCode))
+			if code == http.StatusOK && options.ReadyCheckCache {
+				if err := handler.CheckCacheHealth(r.Context(), tileCache); err != nil {
+					logger.Warning(log.LogCategory_StorageError, "Readiness check on cache failed: %s", err.Error())
+					code = http.StatusServiceUnavailable
+				}
+			}
+			w.WriteHeader(code)
+		})
+	}
+
+	s.handler = middleware.ServerChain(middlewareOptions).Then(s.router)
+
+	if options.WatchdogStall > 0 {
+		s.watchdog = &handler.Watchdog{
+			Stall:         options.WatchdogStall,
+			MetricsWriter: s.metricsWriter,
+			Logger:        logger,
+		}
+	}
+
+	for _, rs := range b.replicatedStorages {
+		s.replicatedStorages = append(s.replicatedStorages, rs)
+	}
+	built = true
+	return s, nil
+}
+
+// Close stops the background work of the server's storages, eg. periodic
+// healthchecks, once it no longer serves requests.
+func (s *Server) Close() {
+	for _, rs := range s.replicatedStorages {
+		rs.Close()
+	}
+}
+
+// List returns a page of the keys in the storage of the pattern, or of its
+// storage for the format if it has one per format, as served by the admin
+// list endpoint.
+func (s *Server) List(pattern, format, prefix, after string, limit int) (*storage.ListResult, error) {
+	route, ok := s.explainRoutes[pattern]
+	if !ok {
+		return nil, fmt.Errorf("Unknown pattern: %s", pattern)
+	}
+	if format != "" {
+		if route, ok = route.ByFormat[format]; !ok {
+			return nil, fmt.Errorf("No storage configured for format %s on pattern %s", format, pattern)
+		}
+	}
+	lister, ok := route.Storage.(storage.Lister)
+	if !ok {
+		return nil, fmt.Errorf("Storage for pattern %s can't list keys", pattern)
+	}
+	return lister.List(prefix, after, limit)
+}
+
+// Handler returns the handler for all the server's routes, wrapped in the
+// same middleware as the tapalcatl binary uses.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Router returns the server's routes without the middleware around every
+// request, for embedders which provide their own logging and CORS handling.
+// The tile routes keep their own middleware, eg. for compression.
+func (s *Server) Router() *mux.Router {
+	return s.router
+}
+
+// SetReady sets whether the readiness check succeeds, so that load balancers
+// stop sending requests before the server shuts down.
+func (s *Server) SetReady(ready bool) {
+	code := uint32(http.StatusOK)
+	if !ready {
+		code = http.StatusInternalServerError
+	}
+	atomic.StoreUint32(&s.readinessResponseCode, code)
+}
+
+// Watchdog returns the watchdog for the server's background workers, for the
+// caller to run, or nil if they aren't watched.
+func (s *Server) Watchdog() *handler.Watchdog {
+	return s.watchdog
+}
+
+// MetricsWriter returns the metrics writer shared by the server's handlers.
+func (s *Server) MetricsWriter() metrics.MetricsWriter {
+	return s.metricsWriter
+}
+
+// Degradation returns the switch for the server's degraded mode.
+func (s *Server) Degradation() *handler.Degradation {
+	return s.degradation
+}
+
+// DrainState returns the work still outstanding during shutdown.
+func (s *Server) DrainState(elapsed time.Duration, done bool) *state.DrainState {
+	ds := &state.DrainState{
+		Elapsed:          elapsed,
+		InFlight:         s.inFlight.Count(),
+		PendingCacheSets: handler.PendingCacheSets(),
+		Done:             done,
+	}
+	if s.loadShedder != nil {
+		ds.ShedQueue = s.loadShedder.QueueLength()
+	}
+	if qmw, ok := s.metricsWriter.(metrics.QueuedMetricsWriter); ok {
+		ds.MetricsQueue = qmw.QueueLength()
+	}
+	return ds
+}
+
+// Diagnostics returns a snapshot of the server's internal state.
+func (s *Server) Diagnostics() *handler.Diagnostics {
+	diag := &handler.Diagnostics{
+		Goroutines:        runtime.NumGoroutine(),
+		BuffersInUse:      s.buffers.InUse(),
+		BufferPoolSize:    s.bufferPoolSize,
+		PendingCacheSets:  handler.PendingCacheSets(),
+		InFlight:          s.inFlight.Count(),
+		InFlightByPattern: make(map[string]int64, len(s.patternInFlight)),
+	}
+	if s.loadShedder != nil {
+		diag.ShedQueue = s.loadShedder.QueueLength()
+	}
+	if qmw, ok := s.metricsWriter.(metrics.QueuedMetricsWriter); ok {
+		diag.MetricsQueue = qmw.QueueLength()
+	}
+	if s.banList != nil {
+		diag.BannedClients = s.banList.Len()
+	}
+	for pattern, counter := range s.patternInFlight {
+		diag.InFlightByPattern[pattern] = counter.Count()
+	}
+	return diag
+}
+
+func newMetricsWriter(hc *config.HandlerConfig, options *Options) (metrics.MetricsWriter, error) {
+	if options.MetricsStatsdAddr == "" {
+		return &metrics.NilMetricsWriter{}, nil
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp4", options.MetricsStatsdAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid metricsstatsdaddr %s: %s", options.MetricsStatsdAddr, err)
+	}
+	naming := options.MetricsNaming
+	if naming == "" {
+		naming = metrics.MetricNaming_Legacy
+	}
+	if !metrics.IsValidMetricNaming(naming) {
+		return nil, fmt.Errorf("Invalid metrics naming: %s", naming)
+	}
+	statsdOptions := metrics.StatsdOptions{
+		BuildDimension: options.MetricsBuildDimension,
+		Naming:         naming,
+		Formats:        options.MetricsFormats,
+		TimingUnit:     options.TimingUnit,
+		Worker:         options.Worker,
+	}
+	if len(statsdOptions.Formats) == 0 {
+		for format := range hc.Mime {
+			statsdOptions.Formats = append(statsdOptions.Formats, format)
+		}
+		// tilejson formats aren't in the mime config
+		for _, format := range []state.TileJsonFormat{state.TileJsonFormat_Mvt, state.TileJsonFormat_Json, state.TileJsonFormat_Topojson} {
+			statsdOptions.Formats = append(statsdOptions.Formats, format.Name())
+		}
+		for _, document := range hc.TileJson {
+			statsdOptions.Formats = append(statsdOptions.Formats, document)
+		}
+	}
+	if options.MetricsDoubleWritePeriod > 0 {
+		statsdOptions.DoubleWriteUntil = time.Now().Add(options.MetricsDoubleWritePeriod)
+	}
+	return metrics.NewStatsdMetricsWriterWithOptions(udpAddr, options.MetricsStatsdPrefix, options.Logger, statsdOptions), nil
+}
+
+// builder holds the state shared between patterns while creating a server.
+type builder struct {
+	hc      *config.HandlerConfig
+	options *Options
+	logger  log.JsonLogger
+
+	bufferManager buffer.BufferManager
+	tileCache     cache.Cache
+	mw            metrics.MetricsWriter
+	routeChain    middleware.Chain
+	loadShedder   *handler.LoadShedder
+	degradation   *handler.Degradation
+	banList       *handler.BanList
+	// set when tile patterns are matched by a tree rather than by mux
+	tree *router.Tree
+
+	// set if we have s3 storage configured, and shared across all s3 sessions
+	awsSession *session.Session
+	// http clients of the s3 storages with tuned connections, keyed by
+	// definition name, so that patterns sharing a definition share its
+	// connection pool
+	s3HTTPClients map[string]*http.Client
+	// connection pools of the postgres storages, keyed by definition name,
+	// so that patterns sharing a definition share its pool
+	postgresDBs map[string]*sql.DB
+	// files loaded by the memory storages, keyed by definition name, so
+	// that patterns sharing a definition don't each load them
+	memoryStorages map[string]*storage.MemoryStorage
+	// disk caches of the storages, keyed by definition name, so that
+	// patterns sharing a definition share its directory
+	diskCaches map[string]*storage.DiskCache
+	// replicated storages, keyed by definition name and the pattern's
+	// overrides of it, so that patterns sharing one share its replicas'
+	// cooldowns and healthchecks, which run until the server is closed
+	replicatedStorages map[string]*storage.ReplicatedStorage
+
+	// keep track of the storages so we can healthcheck them
+	// we only need to check unique type/healthcheck configurations
+	healthCheckStorages map[config.HealthCheckConfig]storage.Storage
+	// self-tests to run once all the patterns are configured, keyed by pattern
+	selfTests map[string]func() error
+	// per-pattern details used by the admin explain endpoint
+	explainRoutes map[string]*handler.ExplainRoute
+	// the tilejson formats requestable, set when configured beyond the builtin ones
+	tileJsonFormats map[string]state.TileJsonFormat
+	// refreshed by the admin builds endpoint
+	buildManifests []*storage.BuildManifestSource
+	// counts the requests in flight for each pattern
+	patternInFlight map[string]*handler.InFlightCounter
+	// tracks the most requested tiles of each metatile pattern
+	tileTrackers map[string]*handler.TileTracker
+}
+
+// addPattern creates the storages and handler for a request pattern.
+func (b *builder) addPattern(r *mux.Router, reqPattern string, rhc config.RouteHandlerConfig) error {
+	if rhc.Storage == "" && len(rhc.StorageByFormat) == 0 {
+		return fmt.Errorf("Pattern %s must have a storage or storageByFormat", reqPattern)
+	}
+
+	if rhc.Type == nil || *rhc.Type == "metatile" {
+		return b.addMetatilePattern(r, reqPattern, rhc)
+	} else if *rhc.Type == "tilejson" {
+		return b.addTileJsonPattern(r, reqPattern, rhc)
+	} else if *rhc.Type == "archive" {
+		return b.addArchivePattern(r, reqPattern, rhc)
+	}
+	return fmt.Errorf("Invalid route handler type: %s", *rhc.Type)
+}
+
+// handle routes GET requests for a tile pattern to h, counting those in
+// flight.
+func (b *builder) handle(r *mux.Router, reqPattern string, h http.Handler) error {
+	counter := &handler.InFlightCounter{}
+	b.patternInFlight[reqPattern] = counter
+	h = counter.Handler(h)
+	if b.tree != nil {
+		return b.tree.Handle(reqPattern, h, "GET")
+	}
+	r.Handle(reqPattern, h).Methods("GET")
+	return nil
+}
+
+// metatileParser creates the parser of a tile or archive pattern, for the
+// formats in mimeMap.
+func (b *builder) metatileParser(reqPattern string, rhc config.RouteHandlerConfig, mimeMap map[string]string) (*handler.MetatileMuxParser, error) {
+	// key query variables are ignored unless they're cache key params
+	cacheKeyParams := make(map[string]bool, len(b.options.CacheKeyParams))
+	for _, name := range b.options.CacheKeyParams {
+		cacheKeyParams[name] = true
+	}
+	keyQueryVariables := make(map[string]*regexp.Regexp, len(rhc.KeyQueryVariables))
+	for name, pattern := range rhc.KeyQueryVariables {
+		if storage.IsBuiltinKeyVariable(name) {
+			return nil, fmt.Errorf("Key query variable %s on pattern %s would replace a builtin variable", name, reqPattern)
+		}
+		// the whole value must match, not just part of it
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regexp for key query variable %s on pattern %s: %s", name, reqPattern, err.Error())
+		}
+		keyQueryVariables[name] = re
+		if len(cacheKeyParams) > 0 && !cacheKeyParams[name] {
+			return nil, fmt.Errorf("Key query variable %s on pattern %s must be one of the cache key params", name, reqPattern)
+		}
+	}
+	for _, name := range rhc.KeyPathVariables {
+		if storage.IsBuiltinKeyVariable(name) {
+			return nil, fmt.Errorf("Key path variable %s on pattern %s would replace a builtin variable", name, reqPattern)
+		}
+		if _, ok := keyQueryVariables[name]; ok {
+			return nil, fmt.Errorf("Key path variable %s on pattern %s is also a key query variable", name, reqPattern)
+		}
+		if !strings.Contains(reqPattern, "{"+name+"}") && !strings.Contains(reqPattern, "{"+name+":") {
+			return nil, fmt.Errorf("Key path variable %s is not a variable of pattern %s", name, reqPattern)
+		}
+	}
+
+	keyHeaderVariables := make(map[string]*handler.KeyHeaderVariable, len(rhc.KeyHeaderVariables))
+	for name, khv := range rhc.KeyHeaderVariables {
+		if storage.IsBuiltinKeyVariable(name) {
+			return nil, fmt.Errorf("Key header variable %s on pattern %s would replace a builtin variable", name, reqPattern)
+		}
+		if _, ok := keyQueryVariables[name]; ok {
+			return nil, fmt.Errorf("Key header variable %s on pattern %s is also a key query variable", name, reqPattern)
+		}
+		for _, pathName := range rhc.KeyPathVariables {
+			if name == pathName {
+				return nil, fmt.Errorf("Key header variable %s on pattern %s is also a key path variable", name, reqPattern)
+			}
+		}
+		if khv.Header == "" {
+			return nil, fmt.Errorf("Key header variable %s on pattern %s has no header", name, reqPattern)
+		}
+		re, err := regexp.Compile("^(?:" + khv.Pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regexp for key header variable %s on pattern %s: %s", name, reqPattern, err.Error())
+		}
+		keyHeaderVariables[name] = &handler.KeyHeaderVariable{
+			Header:  http.CanonicalHeaderKey(khv.Header),
+			Pattern: re,
+		}
+	}
+
+	parser := &handler.MetatileMuxParser{
+		MimeMap:            mimeMap,
+		KeyQueryVariables:  keyQueryVariables,
+		KeyPathVariables:   rhc.KeyPathVariables,
+		KeyHeaderVariables: keyHeaderVariables,
+		CaptureHeaders:     b.options.CaptureHeaders,
+		WrapX:              rhc.WrapX,
+		MaxURLLength:       b.options.MaxURLLength,
+		CacheKeyParams:     b.options.CacheKeyParams,
+	}
+	return parser, nil
+}
+
+func (b *builder) addMetatilePattern(r *mux.Router, reqPattern string, rhc config.RouteHandlerConfig) error {
+	parser, err := b.metatileParser(reqPattern, rhc, b.hc.Mime)
+	if err != nil {
+		return err
+	}
+	if b.options.AllowUnknownFormats {
+		parser.UnknownFormatContentType = "application/octet-stream"
+	}
+
+	metatileOptions := handler.MetatileOptions{
+		MaxZoom:              b.options.MaxZoom,
+		MaxZoomPolicy:        b.options.MaxZoomPolicy,
+		ValidateTiles:        b.options.ValidateTiles,
+		CacheCompressedTiles: b.options.CacheCompressedTiles,
+		StoreCompressedTiles: b.options.StoreCompressedTiles,
+		ServerTiming:         b.options.ServerTiming,
+		TimingUnit:           b.options.TimingUnit,
+		TombstonePolicy:      b.options.TombstonePolicy,
+		TombstoneMaxAge:      b.options.TombstoneMaxAge,
+		ArchivedPolicy:       b.options.ArchivedPolicy,
+		ArchivedRetryAfter:   b.options.ArchivedRetryAfter,
+		DuplicateEntryPolicy: b.options.DuplicateEntryPolicy,
+		ServeStale:           b.options.ServeStale,
+		TTLJitter:            b.options.CacheTTLJitter,
+		Degradation:          b.degradation,
+		BanList:              b.banList,
+	}
+	if rhc.ServeStale != nil {
+		metatileOptions.ServeStale = *rhc.ServeStale
+	}
+	for _, band := range rhc.CacheTTLs {
+		if band.MinZoom > band.MaxZoom {
+			return fmt.Errorf("Invalid cache TTL band %d-%d on pattern %s", band.MinZoom, band.MaxZoom, reqPattern)
+		}
+		ttl, err := time.ParseDuration(band.TTL)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("Invalid cache TTL %#v for zooms %d-%d on pattern %s", band.TTL, band.MinZoom, band.MaxZoom, reqPattern)
+		}
+		metatileOptions.TTLSchedule = append(metatileOptions.TTLSchedule, handler.ZoomTTL{MinZoom: band.MinZoom, MaxZoom: band.MaxZoom, TTL: ttl})
+	}
+	if rhc.ValidateTiles != nil {
+		metatileOptions.ValidateTiles = *rhc.ValidateTiles
+	}
+	for format, fallbacks := range rhc.FormatFallbacks {
+		if _, ok := b.hc.Mime[format]; !ok && !b.options.AllowUnknownFormats {
+			return fmt.Errorf("Format %s with fallbacks on pattern %s isn't in the mime map", format, reqPattern)
+		}
+		for _, fallback := range fallbacks {
+			if fallback == format {
+				return fmt.Errorf("Format %s on pattern %s can't fall back to itself", format, reqPattern)
+			}
+		}
+	}
+	metatileOptions.FormatFallbacks = rhc.FormatFallbacks
+	metatileOptions.Transcode = rhc.Transcode
+	metatileOptions.ContentHashes = rhc.ContentHashes
+	if sample := rhc.NotFoundLogSample; sample != nil {
+		if *sample < 0 || *sample > 1 {
+			return fmt.Errorf("Not found log sample on pattern %s must be between 0 and 1, but is %g", reqPattern, *sample)
+		}
+		metatileOptions.SkipNotFoundLogs = 1 - *sample
+	}
+	if rhc.MaxZoom != nil {
+		metatileOptions.MaxZoom = *rhc.MaxZoom
+	}
+	if rhc.MaxZoomPolicy != nil {
+		metatileOptions.MaxZoomPolicy = *rhc.MaxZoomPolicy
+	}
+	switch metatileOptions.MaxZoomPolicy {
+	case handler.MaxZoomPolicy_NotFound, handler.MaxZoomPolicy_Overzoom:
+	default:
+		return fmt.Errorf("Invalid max zoom policy for pattern %s: %s", reqPattern, metatileOptions.MaxZoomPolicy)
+	}
+	if rhc.TombstonePolicy != nil {
+		metatileOptions.TombstonePolicy = *rhc.TombstonePolicy
+	}
+	if !handler.IsValidTombstonePolicy(metatileOptions.TombstonePolicy) {
+		return fmt.Errorf("Invalid tombstone policy for pattern %s: %s", reqPattern, metatileOptions.TombstonePolicy)
+	}
+
+	if b.options.Admin && b.options.HotTiles > 0 {
+		metatileOptions.TileTracker = handler.NewTileTracker(b.options.HotTiles)
+		b.tileTrackers[reqPattern] = metatileOptions.TileTracker
+	}
+
+	newMetatileHandler := func(ps *patternStorage) http.Handler {
+		options := metatileOptions
+		options.BuildMetadata = ps.buildMetadata
+		options.BuildManifest = ps.buildManifest
+		options.RangedReads = ps.rangedReads
+		options.StorageNamespace = ps.cacheNamespace
+		return handler.MetatileHandlerWithOptions(parser, ps.metatileSize, ps.tileSize, ps.metatileMaxDetailZoom, ps.stg, b.bufferManager, b.mw, b.logger, b.tileCache, options)
+	}
+
+	// the storage used for formats not listed in StorageByFormat, if any
+	var defaultStorage *patternStorage
+	var defaultHandler http.Handler
+	explainRoute := &handler.ExplainRoute{
+		Type:   "metatile",
+		Parser: parser,
+	}
+	if rhc.Storage != "" {
+		defaultStorage, err = b.newPatternStorage(reqPattern, &rhc, rhc.Storage)
+		if err != nil {
+			return err
+		}
+		defaultHandler = newMetatileHandler(defaultStorage)
+		explainRoute.MetatileSize = defaultStorage.metatileSize
+		explainRoute.TileSize = defaultStorage.tileSize
+		explainRoute.MetatileMaxDetailZoom = defaultStorage.metatileMaxDetailZoom
+		explainRoute.Storage = defaultStorage.stg
+		explainRoute.StorageNamespace = defaultStorage.cacheNamespace
+		explainRoute.BuildMetadata = defaultStorage.buildMetadata
+	}
+
+	formatStorages := make(map[string]*patternStorage, len(rhc.StorageByFormat))
+	var h http.Handler
+	if len(rhc.StorageByFormat) == 0 {
+		h = defaultHandler
+	} else {
+		formatHandlers := make(map[string]http.Handler, len(rhc.StorageByFormat))
+		explainRoute.ByFormat = make(map[string]*handler.ExplainRoute, len(rhc.StorageByFormat))
+		for format, storageDefinitionName := range rhc.StorageByFormat {
+			ps, err := b.newPatternStorage(reqPattern, &rhc, storageDefinitionName)
+			if err != nil {
+				return err
+			}
+			formatStorages[format] = ps
+			formatHandlers[format] = newMetatileHandler(ps)
+			explainRoute.ByFormat[format] = &handler.ExplainRoute{
+				Type:                  "metatile",
+				Parser:                parser,
+				MetatileSize:          ps.metatileSize,
+				TileSize:              ps.tileSize,
+				MetatileMaxDetailZoom: ps.metatileMaxDetailZoom,
+				Storage:               ps.stg,
+				StorageNamespace:      ps.cacheNamespace,
+				BuildMetadata:         ps.buildMetadata,
+			}
+		}
+		h = handler.FormatHandler(formatHandlers, defaultHandler)
+	}
+
+	if b.loadShedder != nil {
+		bands := make([]handler.ZoomBand, len(rhc.ZoomPriorities))
+		for i, band := range rhc.ZoomPriorities {
+			if band.MinZoom > band.MaxZoom {
+				return fmt.Errorf("Invalid zoom priority band %d-%d on pattern %s", band.MinZoom, band.MaxZoom, reqPattern)
+			}
+			bands[i] = handler.ZoomBand{MinZoom: band.MinZoom, MaxZoom: band.MaxZoom, Weight: band.Weight}
+		}
+		h = b.loadShedder.Handler(h, handler.ZoomPriority(bands))
+	}
+
+	if err := b.handle(r, reqPattern, b.routeChain.Then(h)); err != nil {
+		return err
+	}
+
+	b.explainRoutes[reqPattern] = explainRoute
+
+	if b.options.SelfTest {
+		testTile := b.options.SelfTestTile
+		if rhc.SelfTestTile != nil {
+			testTile = *rhc.SelfTestTile
+		}
+		coord, err := tile.ParseTileCoord(testTile)
+		if err != nil {
+			return fmt.Errorf("Invalid self-test tile for pattern %s: %s", reqPattern, err.Error())
+		}
+		ps, ok := formatStorages[coord.Format]
+		if !ok {
+			ps = defaultStorage
+		}
+		if ps == nil {
+			return fmt.Errorf("No storage for self-test tile %s on pattern %s", testTile, reqPattern)
+		}
+		b.selfTests[reqPattern] = func() error {
+			metatileSize, tileSize, metatileMaxDetailZoom := ps.metatileSize, ps.tileSize, ps.metatileMaxDetailZoom
+			if ps.buildMetadata != nil {
+				metadata, err := ps.buildMetadata.Get("")
+				if err != nil {
+					return err
+				}
+				if metadata != nil {
+					metatileSize, tileSize, metatileMaxDetailZoom = metadata.MetatileSize, metadata.TileSize, metadata.MetatileMaxDetailZoom
+				}
+			}
+			return handler.SelfTestMetatile(coord, metatileSize, tileSize, metatileMaxDetailZoom, ps.stg, b.bufferManager)
+		}
+	}
+
+	return nil
+}
+
+// addArchivePattern serves the whole metatiles of the pattern's storage, at
+// the metatile coordinates in the pattern, in the zip format.
+func (b *builder) addArchivePattern(r *mux.Router, reqPattern string, rhc config.RouteHandlerConfig) error {
+	if rhc.Storage == "" {
+		return fmt.Errorf("Archive pattern %s must have a storage", reqPattern)
+	}
+	parser, err := b.metatileParser(reqPattern, rhc, map[string]string{"zip": "application/zip"})
+	if err != nil {
+		return err
+	}
+	ps, err := b.newPatternStorage(reqPattern, &rhc, rhc.Storage)
+	if err != nil {
+		return err
+	}
+
+	options := handler.ArchiveOptions{
+		BuildManifest:      ps.buildManifest,
+		BanList:            b.banList,
+		TTLJitter:          b.options.CacheTTLJitter,
+		TimingUnit:         b.options.TimingUnit,
+		ArchivedPolicy:     b.options.ArchivedPolicy,
+		ArchivedRetryAfter: b.options.ArchivedRetryAfter,
+		StorageNamespace:   ps.cacheNamespace,
+	}
+	h := handler.ArchiveHandler(parser, ps.stg, b.mw, b.logger, b.tileCache, options)
+	if err := b.handle(r, reqPattern, b.routeChain.Then(h)); err != nil {
+		return err
+	}
+
+	b.explainRoutes[reqPattern] = &handler.ExplainRoute{
+		Type:    "archive",
+		Parser:  parser,
+		Storage: ps.stg,
+	}
+	return nil
+}
+
+func (b *builder) addTileJsonPattern(r *mux.Router, reqPattern string, rhc config.RouteHandlerConfig) error {
+	if rhc.Storage == "" {
+		return fmt.Errorf("Tilejson pattern %s must have a storage", reqPattern)
+	}
+	ps, err := b.newPatternStorage(reqPattern, &rhc, rhc.Storage)
+	if err != nil {
+		return err
+	}
+
+	parser := &handler.TileJsonParser{CaptureHeaders: b.options.CaptureHeaders, Formats: b.tileJsonFormats}
+	h := handler.TileJsonHandlerWithOptions(parser, ps.stg, b.mw, b.logger, handler.TileJsonOptions{TimingUnit: b.options.TimingUnit})
+	if err := b.handle(r, reqPattern, b.routeChain.Then(h)); err != nil {
+		return err
+	}
+
+	b.explainRoutes[reqPattern] = &handler.ExplainRoute{
+		Type:    "tilejson",
+		Parser:  parser,
+		Storage: ps.stg,
+	}
+
+	if b.options.SelfTest {
+		b.selfTests[reqPattern] = func() error {
+			return handler.SelfTestTileJson(state.TileJsonFormat_Mvt, ps.stg)
+		}
+	}
+	return nil
+}
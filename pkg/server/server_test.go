@@ -0,0 +1,539 @@
+package server
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	golog "log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/cache"
+	"github.com/tilezen/tapalcatl/pkg/config"
+	"github.com/tilezen/tapalcatl/pkg/handler"
+	"github.com/tilezen/tapalcatl/pkg/log"
+)
+
+// writeMetatile writes a metatile containing the tile 0/0/0.json to dir.
+func writeMetatile(t *testing.T, dir, content string) {
+	writeMetatileEntry(t, dir, "0/0/0.json", content)
+}
+
+// writeMetatileEntry writes a metatile containing the named tile to dir.
+func writeMetatileEntry(t *testing.T, dir, name, content string) {
+	dir = filepath.Join(dir, "0", "0")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Unable to create tile dir: %s", err.Error())
+	}
+	f, err := os.Create(filepath.Join(dir, "0.zip"))
+	if err != nil {
+		t.Fatalf("Unable to create metatile: %s", err.Error())
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	entry, err := w.Create(name)
+	if err != nil {
+		t.Fatalf("Unable to create tile in metatile: %s", err.Error())
+	}
+	if _, err := entry.Write([]byte(content)); err != nil {
+		t.Fatalf("Unable to write tile: %s", err.Error())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unable to finish metatile: %s", err.Error())
+	}
+}
+
+func TestNewServesTiles(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	writeMetatile(t, filepath.Join(baseDir, "all"), "{}")
+
+	hc := config.HandlerConfig{}
+	err = hc.Set(`{
+		"Storage": {"local": {"Type": "file", "BaseDir": "` + baseDir + `", "Layer": "all", "MetatileSize": 1}},
+		"Pattern": {"/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}": {"Storage": "local"}},
+		"Mime": {"json": "application/json"}
+	}`)
+	if err != nil {
+		t.Fatalf("Unable to parse handler config: %s", err.Error())
+	}
+
+	logger := log.NewJsonLogger(golog.New(ioutil.Discard, "", 0), "test")
+	s, err := New(hc, Options{Logger: logger, ReadyCheck: "/ready"})
+	if err != nil {
+		t.Fatalf("Unable to create server: %s", err.Error())
+	}
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/0/0/0.json", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "{}" {
+		t.Fatalf("Expected tile to be served, got %d %#v", rec.Code, rec.Body.String())
+	}
+
+	s.SetReady(false)
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected readiness check to fail after SetReady(false), got %d", rec.Code)
+	}
+}
+
+func TestNewMemoryStorage(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	writeMetatile(t, filepath.Join(baseDir, "all"), "{}")
+
+	hc := config.HandlerConfig{}
+	err = hc.Set(`{
+		"Storage": {"memory": {"Type": "memory", "BaseDir": "` + baseDir + `", "Layer": "all", "MetatileSize": 1}},
+		"Pattern": {
+			"/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}": {"Storage": "memory"},
+			"/other/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}": {"Storage": "memory", "Layer": "other"}
+		},
+		"Mime": {"json": "application/json"}
+	}`)
+	if err != nil {
+		t.Fatalf("Unable to parse handler config: %s", err.Error())
+	}
+
+	logger := log.NewJsonLogger(golog.New(ioutil.Discard, "", 0), "test")
+	s, err := New(hc, Options{Logger: logger})
+	if err != nil {
+		t.Fatalf("Unable to create server: %s", err.Error())
+	}
+	// served from memory once loaded
+	os.RemoveAll(baseDir)
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/0/0/0.json", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "{}" {
+		t.Fatalf("Expected tile to be served from memory, got %d %#v", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/other/0/0/0.json", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected tile missing from the pattern's layer to be not found, got %d", rec.Code)
+	}
+}
+
+func TestNewTreeRouter(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	writeMetatile(t, filepath.Join(baseDir, "all"), "{}")
+
+	logger := log.NewJsonLogger(golog.New(ioutil.Discard, "", 0), "test")
+	hc := config.HandlerConfig{}
+	err = hc.Set(`{
+		"Storage": {"local": {"Type": "file", "BaseDir": "` + baseDir + `", "Layer": "all", "MetatileSize": 1}},
+		"Pattern": {"/osm/{z}/{x}/{y}.{fmt}": {"Storage": "local"}},
+		"Mime": {"json": "application/json"}
+	}`)
+	if err != nil {
+		t.Fatalf("Unable to parse handler config: %s", err.Error())
+	}
+	s, err := New(hc, Options{Logger: logger, Router: "tree", Healthcheck: "/health", Admin: true})
+	if err != nil {
+		t.Fatalf("Unable to create server: %s", err.Error())
+	}
+
+	for path, expected := range map[string]int{
+		"/osm/0/0/0.json": http.StatusOK,
+		"/osm/0/0.json":   http.StatusNotFound,
+		"/health":         http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != expected {
+			t.Fatalf("Expected %d for %s, got %d", expected, path, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("POST", "/osm/0/0/0.json", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected 405 for POST, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/admin/explain?path=/osm/0/0/0.json", nil))
+	if !strings.Contains(rec.Body.String(), `"pattern": "/osm/{z}/{x}/{y}.{fmt}"`) {
+		t.Fatalf("Expected explain to find the pattern, got %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/admin/diag", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"/osm/{z}/{x}/{y}.{fmt}": 0`) {
+		t.Fatalf("Expected diag to count the pattern's requests in flight, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	hc = config.HandlerConfig{}
+	err = hc.Set(`{
+		"Storage": {"local": {"Type": "file", "BaseDir": "` + baseDir + `", "Layer": "all", "MetatileSize": 1}},
+		"Pattern": {"/{z:[0-9]+}/{x}/{y}.{fmt}": {"Storage": "local"}}
+	}`)
+	if err != nil {
+		t.Fatalf("Unable to parse handler config: %s", err.Error())
+	}
+	if _, err := New(hc, Options{Logger: logger, Router: "tree"}); err == nil {
+		t.Fatalf("Expected an error for a pattern with a regexp with the tree router")
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	logger := log.NewJsonLogger(golog.New(ioutil.Discard, "", 0), "test")
+
+	hc := config.HandlerConfig{}
+	if _, err := New(hc, Options{Logger: logger}); err == nil {
+		t.Fatalf("Expected an error for a config without patterns")
+	}
+
+	err := hc.Set(`{
+		"Storage": {"local": {"Type": "file", "BaseDir": "/tmp", "MetatileSize": 3}},
+		"Pattern": {"/{z}/{x}/{y}.{fmt}": {"Storage": "local"}}
+	}`)
+	if err != nil {
+		t.Fatalf("Unable to parse handler config: %s", err.Error())
+	}
+	if _, err := New(hc, Options{Logger: logger}); err == nil {
+		t.Fatalf("Expected an error for a metatile size which isn't a power of two")
+	}
+
+	for _, name := range []string{"prefix", "style"} {
+		hc = config.HandlerConfig{}
+		err = hc.Set(`{
+			"Storage": {"local": {"Type": "file", "BaseDir": "/tmp", "MetatileSize": 1}},
+			"Pattern": {"/{lang}/{z}/{x}/{y}.{fmt}": {"Storage": "local", "KeyPathVariables": ["` + name + `"]}}
+		}`)
+		if err != nil {
+			t.Fatalf("Unable to parse handler config: %s", err.Error())
+		}
+		if _, err := New(hc, Options{Logger: logger}); err == nil {
+			t.Fatalf("Expected an error for key path variable %s", name)
+		}
+	}
+
+	for _, variable := range []string{
+		`"prefix": {"Header": "X-Prefix", "Pattern": ".*"}`,
+		`"date": {"Pattern": "[0-9]+"}`,
+		`"date": {"Header": "X-Build-Date", "Pattern": "[0-9"}`,
+	} {
+		hc = config.HandlerConfig{}
+		err = hc.Set(`{
+			"Storage": {"local": {"Type": "file", "BaseDir": "/tmp", "MetatileSize": 1}},
+			"Pattern": {"/{z}/{x}/{y}.{fmt}": {"Storage": "local", "KeyHeaderVariables": {` + variable + `}}}
+		}`)
+		if err != nil {
+			t.Fatalf("Unable to parse handler config: %s", err.Error())
+		}
+		if _, err := New(hc, Options{Logger: logger}); err == nil {
+			t.Fatalf("Expected an error for key header variable %s", variable)
+		}
+	}
+
+	hc = config.HandlerConfig{}
+	err = hc.Set(`{
+		"Storage": {"local": {"Type": "file", "BaseDir": "/tmp", "MetatileSize": 1}},
+		"Pattern": {"/{z}/{x}/{y}.{fmt}": {"Storage": "local"}}
+	}`)
+	if err != nil {
+		t.Fatalf("Unable to parse handler config: %s", err.Error())
+	}
+	if _, err := New(hc, Options{Logger: logger, RedisAddr: "localhost:6379", DynamoDBCacheTable: "tiles"}); err == nil || !strings.Contains(err.Error(), "DynamoDB") {
+		t.Fatalf("Expected an error for both a redis and a DynamoDB cache, got %v", err)
+	}
+	if _, err := New(hc, Options{Logger: logger, DynamoDBCacheTable: "tiles", MemcachedAddrs: []string{"localhost:11211"}}); err == nil || !strings.Contains(err.Error(), "memcached") {
+		t.Fatalf("Expected an error for both a DynamoDB and a memcached cache, got %v", err)
+	}
+}
+
+func TestNewTenants(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	writeMetatile(t, filepath.Join(baseDir, "tenants", "a"), `"a"`)
+	writeMetatile(t, filepath.Join(baseDir, "tenants", "a", "20230901"), `"a 20230901"`)
+	writeMetatile(t, filepath.Join(baseDir, "tenants", "b"), `"b"`)
+
+	hc := config.HandlerConfig{}
+	err = hc.Set(`{
+		"Storage": {"local": {"Type": "file", "BaseDir": "` + baseDir + `", "MetatileSize": 1}},
+		"Pattern": {"/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}": {"Storage": "local"}},
+		"Mime": {"json": "application/json"},
+		"Tenants": {
+			"a": {"ApiKeys": ["key-a"], "Prefix": "tenants/a"},
+			"b": {"ApiKeys": ["key-b"], "Prefix": "tenants/b"}
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("Unable to parse handler config: %s", err.Error())
+	}
+
+	logger := log.NewJsonLogger(golog.New(ioutil.Discard, "", 0), "test")
+	s, err := New(hc, Options{Logger: logger})
+	if err != nil {
+		t.Fatalf("Unable to create server: %s", err.Error())
+	}
+
+	for url, expected := range map[string]struct {
+		status int
+		body   string
+	}{
+		"/0/0/0.json?api_key=key-a":                   {http.StatusOK, `"a"`},
+		"/0/0/0.json?api_key=key-b":                   {http.StatusOK, `"b"`},
+		"/0/0/0.json?api_key=key-a&buildid=20230901":  {http.StatusOK, `"a 20230901"`},
+		"/0/0/0.json?api_key=key-b&buildid=../a":      {http.StatusBadRequest, ""},
+		"/0/0/0.json?api_key=key-b&buildid=tenants/a": {http.StatusNotFound, ""},
+		"/0/0/0.json":               {http.StatusUnauthorized, ""},
+		"/0/0/0.json?api_key=key-c": {http.StatusForbidden, ""},
+	} {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		if rec.Code != expected.status {
+			t.Fatalf("Expected %d for %s, got %d", expected.status, url, rec.Code)
+		}
+		if expected.body != "" && rec.Body.String() != expected.body {
+			t.Fatalf("Expected %s for %s, got %s", expected.body, url, rec.Body.String())
+		}
+	}
+
+	hc.Tenants["c"] = config.TenantConfig{ApiKeys: []string{"key-a"}, Prefix: "tenants/c"}
+	if _, err := New(hc, Options{Logger: logger}); err == nil {
+		t.Fatalf("Expected an error for an api key shared by tenants")
+	}
+}
+
+func TestNewTileJsonFormats(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	if err := os.MkdirAll(filepath.Join(baseDir, "tilejson"), 0755); err != nil {
+		t.Fatalf("Unable to create tilejson dir: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(baseDir, "tilejson", "terrain-v2.json"), []byte(`{"name": "terrain"}`), 0644); err != nil {
+		t.Fatalf("Unable to write tilejson: %s", err.Error())
+	}
+
+	hc := config.HandlerConfig{}
+	err = hc.Set(`{
+		"Storage": {"local": {"Type": "file", "BaseDir": "` + baseDir + `", "MetatileSize": 1}},
+		"Pattern": {"/tilejson/{fmt}.json": {"Type": "tilejson", "Storage": "local"}},
+		"TileJson": {"terrain": "terrain-v2"}
+	}`)
+	if err != nil {
+		t.Fatalf("Unable to parse handler config: %s", err.Error())
+	}
+
+	logger := log.NewJsonLogger(golog.New(ioutil.Discard, "", 0), "test")
+	s, err := New(hc, Options{Logger: logger})
+	if err != nil {
+		t.Fatalf("Unable to create server: %s", err.Error())
+	}
+
+	for path, expected := range map[string]int{
+		"/tilejson/terrain.json":    http.StatusOK,
+		"/tilejson/terrain-v2.json": http.StatusNotFound,
+		"/tilejson/buildings.json":  http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != expected {
+			t.Fatalf("Expected %d for %s, got %d", expected, path, rec.Code)
+		}
+	}
+
+	hc.TileJson = map[string]string{"escape": "../secrets"}
+	if _, err := New(hc, Options{Logger: logger}); err == nil {
+		t.Fatalf("Expected an error for a tilejson document outside the tilejson directory")
+	}
+}
+
+func TestNewDiskCacheStorage(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	writeMetatile(t, filepath.Join(baseDir, "all"), "{}")
+	cacheDir := filepath.Join(baseDir, "cache")
+
+	newServer := func(storages string) error {
+		hc := config.HandlerConfig{}
+		err := hc.Set(`{
+			"Storage": {` + storages + `},
+			"Pattern": {"/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}": {"Storage": "local", "Layer": "all"}},
+			"Mime": {"json": "application/json"}
+		}`)
+		if err != nil {
+			t.Fatalf("Unable to parse handler config: %s", err.Error())
+		}
+		logger := log.NewJsonLogger(golog.New(ioutil.Discard, "", 0), "test")
+		s, err := New(hc, Options{Logger: logger})
+		if err != nil {
+			return err
+		}
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/0/0/0.json", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "{}" {
+			t.Fatalf("Expected tile to be served through the disk cache, got %d %#v", rec.Code, rec.Body.String())
+		}
+		return nil
+	}
+
+	local := `"local": {"Type": "file", "BaseDir": "` + baseDir + `", "MetatileSize": 1, "DiskCacheDir": "` + cacheDir + `", "DiskCacheMaxBytes": 1048576}`
+	if err := newServer(local); err != nil {
+		t.Fatalf("Unable to create server: %s", err.Error())
+	}
+	if matches, _ := filepath.Glob(filepath.Join(cacheDir, "*.metatile")); len(matches) != 1 {
+		t.Fatalf("Expected the metatile to be cached on disk, got %v", matches)
+	}
+
+	other := `"other": {"Type": "file", "BaseDir": "` + baseDir + `", "DiskCacheDir": "` + cacheDir + `/", "DiskCacheMaxBytes": 1048576}`
+	if err := newServer(local + ", " + other); err == nil {
+		t.Fatalf("Expected an error for storages sharing a disk cache dir")
+	}
+}
+
+func TestNewStorageByFormatCache(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	writeMetatileEntry(t, filepath.Join(baseDir, "json", "all"), "0/0/0.json", "{}")
+	writeMetatileEntry(t, filepath.Join(baseDir, "png", "all"), "0/0/0.png", "png")
+
+	hc := config.HandlerConfig{}
+	err = hc.Set(`{
+		"Storage": {
+			"json": {"Type": "file", "BaseDir": "` + filepath.Join(baseDir, "json") + `", "MetatileSize": 1, "Layer": "all"},
+			"png": {"Type": "file", "BaseDir": "` + filepath.Join(baseDir, "png") + `", "MetatileSize": 1, "Layer": "all"}
+		},
+		"Pattern": {"/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}": {"StorageByFormat": {"json": "json", "png": "png"}}},
+		"Mime": {"json": "application/json", "png": "image/png"}
+	}`)
+	if err != nil {
+		t.Fatalf("Unable to parse handler config: %s", err.Error())
+	}
+	logger := log.NewJsonLogger(golog.New(ioutil.Discard, "", 0), "test")
+	s, err := New(hc, Options{Logger: logger, DiskCache: cache.DiskCacheOptions{Dir: filepath.Join(baseDir, "cache"), MaxBytes: 1048576}})
+	if err != nil {
+		t.Fatalf("Unable to create server: %s", err.Error())
+	}
+
+	// the metatile cached for one format isn't served for the other
+	for _, tc := range []struct{ path, body string }{
+		{"/0/0/0.json", "{}"},
+		{"/0/0/0.png", "png"},
+		{"/0/0/0.json", "{}"},
+	} {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != tc.body {
+			t.Fatalf("Expected %s from its own storage, got %d %#v", tc.path, rec.Code, rec.Body.String())
+		}
+		for deadline := time.Now().Add(time.Second); handler.PendingCacheSets() > 0 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestNewSharesReplicatedStorages(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	hc := config.HandlerConfig{}
+	err = hc.Set(`{
+		"Storage": {
+			"local": {"Type": "file", "BaseDir": "` + baseDir + `", "MetatileSize": 1, "Healthcheck": "health"},
+			"replicated": {"Type": "replicated", "MetatileSize": 1, "Layer": "all", "Replicas": [{"Storage": "local"}], "ReplicaHealthCheckInterval": "1h"}
+		},
+		"Pattern": {
+			"/a/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}": {"Storage": "replicated"},
+			"/b/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}": {"Storage": "replicated"},
+			"/c/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}": {"Storage": "replicated", "Layer": "other"}
+		},
+		"Mime": {"json": "application/json"}
+	}`)
+	if err != nil {
+		t.Fatalf("Unable to parse handler config: %s", err.Error())
+	}
+	logger := log.NewJsonLogger(golog.New(ioutil.Discard, "", 0), "test")
+	s, err := New(hc, Options{Logger: logger})
+	if err != nil {
+		t.Fatalf("Unable to create server: %s", err.Error())
+	}
+	defer s.Close()
+
+	// patterns with the same overrides share the replicas' state
+	if len(s.replicatedStorages) != 2 {
+		t.Fatalf("Expected one replicated storage per layer, got %d", len(s.replicatedStorages))
+	}
+}
+
+func TestServerList(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	writeMetatile(t, filepath.Join(baseDir, "all"), "{}")
+
+	pattern := "/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}"
+	hc := config.HandlerConfig{}
+	err = hc.Set(`{
+		"Storage": {"local": {"Type": "file", "BaseDir": "` + baseDir + `", "Layer": "all", "MetatileSize": 1}},
+		"Pattern": {"` + pattern + `": {"Storage": "local"}},
+		"Mime": {"json": "application/json"}
+	}`)
+	if err != nil {
+		t.Fatalf("Unable to parse handler config: %s", err.Error())
+	}
+	logger := log.NewJsonLogger(golog.New(ioutil.Discard, "", 0), "test")
+	s, err := New(hc, Options{Logger: logger})
+	if err != nil {
+		t.Fatalf("Unable to create server: %s", err.Error())
+	}
+
+	result, err := s.List(pattern, "", "all/", "", 10)
+	if err != nil {
+		t.Fatalf("Unable to list: %s", err.Error())
+	}
+	if len(result.Keys) != 1 || result.Keys[0] != "all/0/0/0.zip" || result.Truncated {
+		t.Fatalf("Expected the metatile's key, got %#v", result)
+	}
+
+	if _, err := s.List("/unknown", "", "", "", 10); err == nil {
+		t.Fatalf("Expected an unknown pattern to fail")
+	}
+	if _, err := s.List(pattern, "mvt", "", "", 10); err == nil {
+		t.Fatalf("Expected a format without its own storage to fail")
+	}
+}
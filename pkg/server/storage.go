@@ -0,0 +1,903 @@
+package server
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	// registers the postgres driver for the postgres storage
+	_ "github.com/lib/pq"
+
+	"github.com/tilezen/tapalcatl/pkg/config"
+	"github.com/tilezen/tapalcatl/pkg/golden"
+	"github.com/tilezen/tapalcatl/pkg/log"
+	"github.com/tilezen/tapalcatl/pkg/storage"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+const (
+	// The time a failing storage replica is excluded for, unless configured otherwise
+	defaultReplicaCooldown = 30 * time.Second
+	// How often to read build manifests again, unless configured otherwise
+	defaultBuildManifestRefresh = time.Minute
+)
+
+// patternStorage is a storage along with the metatile layout it was
+// configured with for a pattern.
+type patternStorage struct {
+	stg                   storage.Storage
+	metatileSize          int
+	tileSize              int
+	metatileMaxDetailZoom int
+	// set when the storage definition has RangedReads
+	rangedReads bool
+	// set when the storage definition has BuildMetadata
+	buildMetadata *storage.BuildMetadataSource
+	// set when the storage definition has BuildManifest
+	buildManifest *storage.BuildManifestSource
+	// names the definition and layer in the keys of cached metatiles
+	cacheNamespace string
+}
+
+// newPatternStorage creates the storage for the named definition, with the
+// pattern's overrides applied.
+func (b *builder) newPatternStorage(reqPattern string, rhc *config.RouteHandlerConfig, storageDefinitionName string) (*patternStorage, error) {
+	sd, ok := b.hc.Storage[storageDefinitionName]
+	if !ok {
+		return nil, fmt.Errorf("Unknown storage definition: %s", storageDefinitionName)
+	}
+	metatileSize := sd.MetatileSize
+	if rhc.MetatileSize != nil {
+		metatileSize = *rhc.MetatileSize
+	}
+	// with build metadata, the configured size is only a fallback for
+	// builds without any, and can be left out
+	if !tile.IsPowerOfTwo(metatileSize) && !(sd.BuildMetadata != "" && metatileSize == 0) {
+		return nil, fmt.Errorf("Metatile size must be power of two, but %d is not", metatileSize)
+	}
+
+	tileSize := 1
+	if sd.TileSize != nil {
+		tileSize = *sd.TileSize
+	}
+	if rhc.TileSize != nil {
+		tileSize = *rhc.TileSize
+	}
+	if !tile.IsPowerOfTwo(tileSize) {
+		return nil, fmt.Errorf("Tile size must be power of two, but %d is not", tileSize)
+	}
+	if sd.RangedReads && sd.Type != "s3" {
+		return nil, fmt.Errorf("Storage %s has ranged reads, which only s3 storage supports", storageDefinitionName)
+	}
+	if sd.Type == "postgres" && sd.Tiles && metatileSize != 1 {
+		return nil, fmt.Errorf("Postgres storage %s holds individual tiles, so needs a metatile size of 1, but is %d", storageDefinitionName, metatileSize)
+	}
+
+	metatileMaxDetailZoom := 0
+	if sd.MetatileMaxDetailZoom != nil {
+		metatileMaxDetailZoom = *sd.MetatileMaxDetailZoom
+	}
+
+	stg, err := b.newStorage(reqPattern, rhc, storageDefinitionName, false)
+	if err != nil {
+		return nil, err
+	}
+	layer := sd.Layer
+	if rhc.Layer != nil {
+		layer = *rhc.Layer
+	}
+	ps := &patternStorage{
+		stg:                   stg,
+		metatileSize:          metatileSize,
+		tileSize:              tileSize,
+		metatileMaxDetailZoom: metatileMaxDetailZoom,
+		rangedReads:           sd.RangedReads,
+		cacheNamespace:        storageDefinitionName + "/" + layer,
+	}
+	if sd.BuildMetadata != "" {
+		reader, ok := ps.stg.(storage.MetadataReader)
+		if !ok {
+			return nil, fmt.Errorf("Storage %s can't read build metadata", storageDefinitionName)
+		}
+		ps.buildMetadata = storage.NewBuildMetadataSource(reader, sd.BuildMetadata)
+	}
+	if sd.BuildManifest != "" {
+		reader, ok := ps.stg.(storage.MetadataReader)
+		if !ok {
+			return nil, fmt.Errorf("Storage %s can't read a build manifest", storageDefinitionName)
+		}
+		refresh, err := parseDurationCfg("buildManifestRefresh", sd.BuildManifestRefresh, defaultBuildManifestRefresh)
+		if err != nil {
+			return nil, err
+		}
+		ps.buildManifest = storage.NewBuildManifestSource(reader, sd.BuildManifest, refresh)
+		b.buildManifests = append(b.buildManifests, ps.buildManifest)
+	}
+	return ps, nil
+}
+
+// Version is the tapalcatl version sent in the user agent of S3 requests.
+// Builds can set it with -ldflags "-X github.com/tilezen/tapalcatl/pkg/server.Version=...".
+var Version = "1.4.0"
+
+var validRequestTag = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// tagRequests adds tapalcatl, its version and the details to the user agent
+// of the client's requests, and the tags as x- query parameters. S3 ignores
+// those parameters but records them in its server access logs, so traffic
+// can be attributed to deployments and layers.
+func tagRequests(client *s3.S3, tags map[string]string, details ...string) {
+	client.Handlers.Build.PushBack(request.MakeAddToUserAgentHandler("tapalcatl", Version, details...))
+	if len(tags) == 0 {
+		return
+	}
+	client.Handlers.Build.PushBackNamed(request.NamedHandler{
+		Name: "tapalcatl.RequestTags",
+		Fn: func(r *request.Request) {
+			query := r.HTTPRequest.URL.Query()
+			for name, value := range tags {
+				query.Set("x-"+name, value)
+			}
+			r.HTTPRequest.URL.RawQuery = query.Encode()
+		},
+	})
+}
+
+// awsConfig returns the AWS session shared by all clients, setting it up
+// on first use, and the config for a client with the given overrides.
+func (b *builder) awsConfig(overrides *aws.Config) (*session.Session, *aws.Config, error) {
+	hc := b.hc
+	if b.awsSession == nil {
+		var err error
+		if hc.Aws != nil && hc.Aws.Region != nil {
+			b.awsSession, err = session.NewSessionWithOptions(session.Options{
+				Config:            aws.Config{Region: hc.Aws.Region},
+				SharedConfigState: session.SharedConfigEnable,
+			})
+		} else {
+			b.awsSession, err = session.NewSessionWithOptions(session.Options{
+				SharedConfigState: session.SharedConfigEnable,
+			})
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to set up AWS session: %s", err.Error())
+		}
+	}
+
+	cfg := &aws.Config{}
+	if overrides != nil {
+		cfg = overrides.Copy()
+	}
+	if hc.Aws != nil && hc.Aws.Role != nil {
+		cfg.Credentials = stscreds.NewCredentials(b.awsSession, *hc.Aws.Role)
+	}
+	return b.awsSession, cfg, nil
+}
+
+// s3Client creates a client for S3 requests, sharing the AWS session, with
+// its requests tagged as by tagRequests. The overrides, if any, apply to
+// this client only, eg. the region of a bucket replicated across regions.
+func (b *builder) s3Client(overrides *aws.Config, tags map[string]string, details ...string) (s3iface.S3API, error) {
+	sess, cfg, err := b.awsConfig(overrides)
+	if err != nil {
+		return nil, err
+	}
+	s3Client := s3.New(sess, cfg)
+	tagRequests(s3Client, tags, details...)
+	return s3Client, nil
+}
+
+// goldenStore creates the store for golden tile recordings at location,
+// either a directory or an s3://bucket/prefix URL.
+func (b *builder) goldenStore(location string) (golden.Store, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return golden.NewFileStore(location), nil
+	}
+
+	bucket := strings.TrimPrefix(location, "s3://")
+	prefix := ""
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, prefix = bucket[:i], bucket[i+1:]
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("Golden store %s is missing a bucket", location)
+	}
+	s3Client, err := b.s3Client(nil, nil, "golden")
+	if err != nil {
+		return nil, err
+	}
+	return golden.NewS3Store(s3Client, bucket, prefix), nil
+}
+
+// newStorage creates the storage for the named definition, with the
+// pattern's overrides applied. Nested storages, such as replicas, are not
+// registered for the healthcheck themselves.
+func (b *builder) newStorage(reqPattern string, rhc *config.RouteHandlerConfig, storageDefinitionName string, nested bool) (storage.Storage, error) {
+	hc, logger := b.hc, b.logger
+
+	sd, ok := hc.Storage[storageDefinitionName]
+	if !ok {
+		return nil, fmt.Errorf("Unknown storage definition: %s", storageDefinitionName)
+	}
+
+	layer := sd.Layer
+	if rhc.Layer != nil {
+		layer = *rhc.Layer
+	}
+
+	var stg storage.Storage
+	var healthcheck string
+
+	switch sd.Type {
+	case "s3":
+		if rhc.DefaultPrefix == nil {
+			return nil, fmt.Errorf("S3 configuration requires defaultPrefix")
+		}
+		prefix := *rhc.DefaultPrefix
+
+		for name := range sd.RequestTags {
+			if !validRequestTag.MatchString(name) {
+				return nil, fmt.Errorf("Invalid request tag name for storage %s: %#v", storageDefinitionName, name)
+			}
+		}
+		if sd.DisableSSL && sd.SSECustomerKeyFile != "" {
+			return nil, fmt.Errorf("Storage %s can't send its SSE-C key with SSL disabled", storageDefinitionName)
+		}
+		httpClient, err := b.s3HTTPClient(storageDefinitionName)
+		if err != nil {
+			return nil, err
+		}
+		overrides := s3Overrides(sd)
+		overrides.HTTPClient = httpClient
+		s3Client, err := b.s3Client(overrides, sd.RequestTags, "storage "+storageDefinitionName, "pattern "+reqPattern)
+		if err != nil {
+			return nil, err
+		}
+
+		keyPattern := sd.KeyPattern
+		if rhc.KeyPattern != nil {
+			keyPattern = *rhc.KeyPattern
+		}
+
+		if sd.Bucket == "" {
+			return nil, fmt.Errorf("S3 storage missing bucket configuration")
+		}
+		if keyPattern == "" {
+			return nil, fmt.Errorf("S3 storage missing key pattern")
+		}
+
+		if sd.Healthcheck == "" {
+			logger.Warning(log.LogCategory_ConfigError, "Missing healthcheck for storage s3")
+		}
+
+		if sd.HealthcheckMethod != "" && !storage.IsValidHealthcheckMethod(sd.HealthcheckMethod) {
+			return nil, fmt.Errorf("Invalid healthcheck method for storage %s: %s", storageDefinitionName, sd.HealthcheckMethod)
+		}
+		hashFunc, hashCompatibility, err := b.keyHash(reqPattern, rhc, storageDefinitionName, layer)
+		if err != nil {
+			return nil, err
+		}
+
+		revalidateTTL, err := parseDurationCfg("revalidateTTL", sd.RevalidateTTL, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		var buildVersions map[string]time.Time
+		for buildID, value := range sd.BuildVersions {
+			asOf, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid time of build %s on storage %s: %s", buildID, storageDefinitionName, err.Error())
+			}
+			if buildVersions == nil {
+				buildVersions = make(map[string]time.Time, len(sd.BuildVersions))
+			}
+			buildVersions[buildID] = asOf
+		}
+
+		var sseCustomerKey []byte
+		if sd.SSECustomerKeyFile != "" {
+			sseCustomerKey, err = readSSECustomerKey(sd.SSECustomerKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("Storage %s: %s", storageDefinitionName, err.Error())
+			}
+		}
+
+		s3Options := storage.S3Options{
+			HealthcheckMethod: sd.HealthcheckMethod,
+			KeyVariables:      rhc.KeyVariables,
+			Hash:              hashFunc,
+			HashCompatibility: hashCompatibility,
+			RevalidateTTL:     revalidateTTL,
+			MinRange:          sd.RangeMinBytes,
+			RequesterPays:     sd.RequesterPays,
+			SSECustomerKey:    sseCustomerKey,
+			HeadConditional:   sd.HeadConditional,
+			BuildVersions:     buildVersions,
+		}
+
+		healthcheck = sd.Healthcheck
+		stg = storage.NewS3StorageWithOptions(s3Client, sd.Bucket, keyPattern, prefix, layer, healthcheck, s3Options)
+
+	case "http":
+		if sd.URLPattern == "" {
+			return nil, fmt.Errorf("HTTP storage missing url pattern")
+		}
+		prefix := ""
+		if rhc.DefaultPrefix != nil {
+			prefix = *rhc.DefaultPrefix
+		}
+
+		if sd.Healthcheck == "" {
+			logger.Warning(log.LogCategory_ConfigError, "Missing healthcheck for storage http")
+		}
+
+		hashFunc, hashCompatibility, err := b.keyHash(reqPattern, rhc, storageDefinitionName, layer)
+		if err != nil {
+			return nil, err
+		}
+
+		httpOptions := storage.HTTPOptions{
+			MetadataURLPattern: sd.MetadataURLPattern,
+			KeyVariables:       rhc.KeyVariables,
+			Hash:               hashFunc,
+			HashCompatibility:  hashCompatibility,
+		}
+
+		healthcheck = sd.Healthcheck
+		stg = storage.NewHTTPStorageWithOptions(sd.URLPattern, prefix, layer, healthcheck, httpOptions)
+
+	case "postgres":
+		prefix := ""
+		if rhc.DefaultPrefix != nil {
+			prefix = *rhc.DefaultPrefix
+		}
+		db, err := b.postgresDB(storageDefinitionName)
+		if err != nil {
+			return nil, err
+		}
+
+		postgresOptions := storage.PostgresOptions{
+			Table:       sd.Table,
+			Tiles:       sd.Tiles,
+			Healthcheck: sd.Healthcheck,
+		}
+		stg, err = storage.NewPostgresStorageWithOptions(db, prefix, postgresOptions)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid postgres storage %s: %s", storageDefinitionName, err.Error())
+		}
+		// each database is checked, whatever its query
+		healthcheck = storageDefinitionName
+
+	case "file":
+		if sd.BaseDir == "" {
+			return nil, fmt.Errorf("File storage missing base dir")
+		}
+
+		if sd.Healthcheck == "" {
+			logger.Warning(log.LogCategory_ConfigError, "Missing healthcheck for storage file")
+		}
+
+		healthcheck = sd.Healthcheck
+		stg = storage.NewFileStorage(sd.BaseDir, layer, healthcheck)
+
+	case "memory":
+		if sd.BaseDir == "" {
+			return nil, fmt.Errorf("Memory storage missing base dir")
+		}
+
+		if sd.Healthcheck == "" {
+			logger.Warning(log.LogCategory_ConfigError, "Missing healthcheck for storage memory")
+		}
+
+		memoryStorage, err := b.memoryStorage(storageDefinitionName)
+		if err != nil {
+			return nil, err
+		}
+		healthcheck = sd.Healthcheck
+		stg = memoryStorage.WithLayer(layer)
+
+	case "sftp":
+		if sd.BaseDir == "" {
+			return nil, fmt.Errorf("SFTP storage missing base dir")
+		}
+
+		if sd.Healthcheck == "" {
+			logger.Warning(log.LogCategory_ConfigError, "Missing healthcheck for storage sftp")
+		}
+
+		dial, err := sftpDialer(storageDefinitionName, sd)
+		if err != nil {
+			return nil, err
+		}
+		healthcheck = sd.Healthcheck
+		stg = storage.NewSFTPStorageWithOptions(dial, sd.BaseDir, layer, healthcheck, storage.SFTPOptions{
+			MaxConns: sd.MaxOpenConns,
+		})
+
+	case "webdav":
+		if sd.BaseURL == "" {
+			return nil, fmt.Errorf("WebDAV storage %s missing base url", storageDefinitionName)
+		}
+
+		if sd.Healthcheck == "" {
+			logger.Warning(log.LogCategory_ConfigError, "Missing healthcheck for storage webdav")
+		}
+
+		options := storage.WebDAVOptions{User: sd.User}
+		if sd.PasswordFile != "" {
+			password, err := ioutil.ReadFile(sd.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read password of storage %s: %s", storageDefinitionName, err.Error())
+			}
+			options.Password = strings.TrimRight(string(password), "\r\n")
+		}
+		webDAVStorage, err := storage.NewWebDAVStorage(sd.BaseURL, layer, sd.Healthcheck, options)
+		if err != nil {
+			return nil, fmt.Errorf("Storage %s: %s", storageDefinitionName, err.Error())
+		}
+		healthcheck = sd.Healthcheck
+		stg = webDAVStorage
+
+	case "replicated":
+		if len(sd.Replicas) == 0 {
+			return nil, fmt.Errorf("Replicated storage %s has no replicas", storageDefinitionName)
+		}
+		// the replicas' cooldowns and healthchecks are shared by the
+		// patterns whose overrides give the same storage
+		replicatedKey := fmt.Sprintf("%s\x00%s\x00%v\x00%v\x00%v", storageDefinitionName, layer, stringOrNil(rhc.DefaultPrefix), stringOrNil(rhc.KeyPattern), rhc.KeyVariables)
+		if rs, ok := b.replicatedStorages[replicatedKey]; ok {
+			healthcheck = storageDefinitionName
+			stg = rs
+			break
+		}
+		cooldown, err := parseDurationCfg("replicaCooldown", sd.ReplicaCooldown, defaultReplicaCooldown)
+		if err != nil {
+			return nil, err
+		}
+		healthCheckInterval, err := parseDurationCfg("replicaHealthCheckInterval", sd.ReplicaHealthCheckInterval, 0)
+		if err != nil {
+			return nil, err
+		}
+		healthCheckTimeout, err := parseDurationCfg("replicaHealthCheckTimeout", sd.ReplicaHealthCheckTimeout, storage.DefaultReplicaHealthCheckTimeout)
+		if err != nil {
+			return nil, err
+		}
+		latencyThreshold, err := parseDurationCfg("replicaLatencyThreshold", sd.ReplicaLatencyThreshold, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		replicas := make([]*storage.Replica, len(sd.Replicas))
+		for i, rc := range sd.Replicas {
+			replicaDefinition, ok := hc.Storage[rc.Storage]
+			if !ok {
+				return nil, fmt.Errorf("Unknown storage definition for replica: %s", rc.Storage)
+			}
+			if replicaDefinition.Type == "replicated" || replicaDefinition.Type == "fallback" {
+				return nil, fmt.Errorf("Replica %s of storage %s must not itself be %s", rc.Storage, storageDefinitionName, replicaDefinition.Type)
+			}
+			weight := 1
+			if rc.Weight != nil {
+				weight = *rc.Weight
+			}
+			replica, err := b.newStorage(reqPattern, rhc, rc.Storage, true)
+			if err != nil {
+				return nil, err
+			}
+			replicas[i] = &storage.Replica{
+				Name:    rc.Storage,
+				Storage: replica,
+				Weight:  weight,
+			}
+		}
+
+		// the replicated storage is healthy as long as one replica is, so
+		// it is checked as a whole rather than by each replica's key.
+		healthcheck = storageDefinitionName
+		rs := storage.NewReplicatedStorageWithOptions(replicas, b.mw, storage.ReplicatedOptions{
+			Cooldown:            cooldown,
+			HealthCheckInterval: healthCheckInterval,
+			HealthCheckTimeout:  healthCheckTimeout,
+			LatencyThreshold:    latencyThreshold,
+		})
+		b.replicatedStorages[replicatedKey] = rs
+		stg = rs
+
+	case "fallback":
+		if len(sd.Fallback) == 0 {
+			return nil, fmt.Errorf("Fallback storage %s has no storages", storageDefinitionName)
+		}
+		backends := make([]*storage.FallbackBackend, len(sd.Fallback))
+		for i, name := range sd.Fallback {
+			backendDefinition, ok := hc.Storage[name]
+			if !ok {
+				return nil, fmt.Errorf("Unknown storage definition for fallback: %s", name)
+			}
+			if backendDefinition.Type == "fallback" {
+				return nil, fmt.Errorf("Fallback %s of storage %s must not itself be a fallback", name, storageDefinitionName)
+			}
+			backend, err := b.newStorage(reqPattern, rhc, name, true)
+			if err != nil {
+				return nil, err
+			}
+			backends[i] = &storage.FallbackBackend{Name: name, Storage: backend}
+		}
+
+		// as with replicated storages, the storages are checked as a whole
+		healthcheck = storageDefinitionName
+		stg = storage.NewFallbackStorage(backends)
+
+	default:
+		return nil, fmt.Errorf("Unknown storage type: %s", sd.Type)
+	}
+
+	if sd.BundlePattern != "" {
+		if sd.RangedReads || len(sd.FanOutPrefixes) > 0 {
+			return nil, fmt.Errorf("Storage %s reads bundles, which can't be combined with ranged reads or fanning out", storageDefinitionName)
+		}
+		indexTTL, err := parseDurationCfg("bundleIndexTTL", sd.BundleIndexTTL, 0)
+		if err != nil {
+			return nil, err
+		}
+		bundleStorage, err := storage.NewBundleStorage(stg, storage.BundleOptions{
+			Pattern:  sd.BundlePattern,
+			MaxZoom:  sd.BundleMaxZoom,
+			IndexTTL: indexTTL,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Storage %s: %w", storageDefinitionName, err)
+		}
+		stg = bundleStorage
+	}
+
+	if b.options.Chaos != nil && sd.Type != "replicated" && sd.Type != "fallback" {
+		stg = storage.NewChaosStorage(stg, b.options.Chaos.Storage)
+	}
+
+	if sd.Retries > 0 {
+		if sd.Type == "replicated" || sd.Type == "fallback" {
+			return nil, fmt.Errorf("Storage %s has retries, but %s storages retry through their storages", storageDefinitionName, sd.Type)
+		}
+		retryBaseDelay, err := parseDurationCfg("retryBaseDelay", sd.RetryBaseDelay, storage.DefaultRetryBaseDelay)
+		if err != nil {
+			return nil, err
+		}
+		retryMaxDelay, err := parseDurationCfg("retryMaxDelay", sd.RetryMaxDelay, storage.DefaultRetryMaxDelay)
+		if err != nil {
+			return nil, err
+		}
+		stg = storage.NewRetryStorage(stg, storage.RetryOptions{
+			MaxRetries: sd.Retries,
+			BaseDelay:  retryBaseDelay,
+			MaxDelay:   retryMaxDelay,
+		})
+	}
+
+	if sd.DiskCacheDir != "" {
+		if sd.RangedReads {
+			return nil, fmt.Errorf("Storage %s is cached on disk, which needs whole metatiles rather than ranged reads", storageDefinitionName)
+		}
+		diskCache, err := b.diskCache(storageDefinitionName)
+		if err != nil {
+			return nil, err
+		}
+		diskCacheStorage, err := storage.NewDiskCacheStorage(stg, diskCache)
+		if err != nil {
+			return nil, fmt.Errorf("Storage %s: %w", storageDefinitionName, err)
+		}
+		stg = diskCacheStorage
+	}
+
+	if len(sd.FanOutPrefixes) > 0 {
+		if sd.RangedReads {
+			return nil, fmt.Errorf("Storage %s fans out across prefixes, which can't be read with ranged reads", storageDefinitionName)
+		}
+		stg = storage.NewFanOutStorage(stg, sd.FanOutPrefixes)
+	}
+
+	// measured as a whole, including retries, as its callers see it
+	stg = storage.NewInstrumentedStorage(storageDefinitionName, stg, b.mw)
+
+	if healthcheck != "" && !nested {
+		storageErr := stg.HealthCheck()
+		if storageErr != nil {
+			logger.Warning(log.LogCategory_ConfigError, "Healthcheck failed on storage: %s", storageErr)
+		}
+
+		hcc := config.HealthCheckConfig{
+			Type:        sd.Type,
+			Healthcheck: healthcheck,
+		}
+
+		if _, ok := b.healthCheckStorages[hcc]; !ok {
+			b.healthCheckStorages[hcc] = stg
+		}
+	}
+
+	return stg, nil
+}
+
+// s3Overrides returns the settings of the storage's S3 client which differ
+// from the session's.
+func s3Overrides(sd config.StorageDefinition) *aws.Config {
+	overrides := &aws.Config{}
+	if sd.Region != "" {
+		overrides.Region = aws.String(sd.Region)
+	}
+	if sd.Endpoint != "" {
+		overrides.Endpoint = aws.String(sd.Endpoint)
+	}
+	if sd.ForcePathStyle {
+		overrides.S3ForcePathStyle = aws.Bool(true)
+	}
+	if sd.DisableSSL {
+		overrides.DisableSSL = aws.Bool(true)
+	}
+	if sd.Retries > 0 {
+		// retried by the storage instead, so they aren't compounded
+		overrides.MaxRetries = aws.Int(0)
+	}
+	return overrides
+}
+
+// s3HTTPClient returns the http client of the named s3 storage with its
+// connections tuned, or nil to use the default client when they aren't.
+func (b *builder) s3HTTPClient(storageDefinitionName string) (*http.Client, error) {
+	if client, ok := b.s3HTTPClients[storageDefinitionName]; ok {
+		return client, nil
+	}
+	sd := b.hc.Storage[storageDefinitionName]
+	if sd.MaxIdleConnsPerHost == 0 && sd.IdleConnTimeout == "" && sd.DialTimeout == "" &&
+		sd.TLSHandshakeTimeout == "" && sd.ResponseHeaderTimeout == "" && !sd.DisableHTTP2 {
+		return nil, nil
+	}
+	if sd.MaxIdleConnsPerHost < 0 {
+		return nil, fmt.Errorf("Storage %s has a negative maxIdleConnsPerHost", storageDefinitionName)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if sd.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = sd.MaxIdleConnsPerHost
+		// the total would otherwise cap the connections kept per host
+		if transport.MaxIdleConns < sd.MaxIdleConnsPerHost {
+			transport.MaxIdleConns = sd.MaxIdleConnsPerHost
+		}
+	}
+	var err error
+	transport.IdleConnTimeout, err = parseDurationCfg("idleConnTimeout", sd.IdleConnTimeout, transport.IdleConnTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if sd.DialTimeout != "" {
+		dialTimeout, err := parseDurationCfg("dialTimeout", sd.DialTimeout, 0)
+		if err != nil {
+			return nil, err
+		}
+		transport.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	transport.TLSHandshakeTimeout, err = parseDurationCfg("tlsHandshakeTimeout", sd.TLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	transport.ResponseHeaderTimeout, err = parseDurationCfg("responseHeaderTimeout", sd.ResponseHeaderTimeout, transport.ResponseHeaderTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if sd.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		// a non-nil empty map stops the transport upgrading to HTTP/2
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	client := &http.Client{Transport: transport}
+	b.s3HTTPClients[storageDefinitionName] = client
+	return client, nil
+}
+
+// sftpDialer returns a dialer connecting to the storage's SFTP server,
+// authenticating with its private key and checking the server's host key.
+func sftpDialer(storageDefinitionName string, sd config.StorageDefinition) (storage.SFTPDialer, error) {
+	if sd.Address == "" || sd.User == "" || sd.PrivateKeyFile == "" {
+		return nil, fmt.Errorf("SFTP storage %s needs an address, user and private key file", storageDefinitionName)
+	}
+	if sd.KnownHostsFile == "" {
+		return nil, fmt.Errorf("SFTP storage %s needs a known hosts file to check the server is genuine", storageDefinitionName)
+	}
+
+	key, err := ioutil.ReadFile(sd.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read private key of storage %s: %s", storageDefinitionName, err.Error())
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid private key for storage %s: %s", storageDefinitionName, err.Error())
+	}
+	hostKeyCallback, err := knownhosts.New(sd.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid known hosts file for storage %s: %s", storageDefinitionName, err.Error())
+	}
+	dialTimeout, err := parseDurationCfg("dialTimeout", sd.DialTimeout, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	address := sd.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+	return storage.NewSSHDialer(address, &ssh.ClientConfig{
+		User:            sd.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         dialTimeout,
+	}), nil
+}
+
+// readSSECustomerKey reads a base64 encoded 256 bit key for SSE-C from the
+// file, eg. as generated by openssl rand -base64 32.
+func readSSECustomerKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read SSE-C key: %s", err.Error())
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SSE-C key in %s: %s", path, err.Error())
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Invalid SSE-C key in %s: must be 256 bits, but is %d", path, len(key)*8)
+	}
+	return key, nil
+}
+
+// postgresDB returns the connection pool of the named postgres storage,
+// opening it on first use. Connections are made lazily, so a database which
+// is down doesn't stop the server starting.
+func (b *builder) postgresDB(storageDefinitionName string) (*sql.DB, error) {
+	if db, ok := b.postgresDBs[storageDefinitionName]; ok {
+		return db, nil
+	}
+	sd := b.hc.Storage[storageDefinitionName]
+	if sd.ConnectionString == "" {
+		return nil, fmt.Errorf("Postgres storage %s missing connection string", storageDefinitionName)
+	}
+	connMaxLifetime, err := parseDurationCfg("connMaxLifetime", sd.ConnMaxLifetime, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", sd.ConnectionString)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open postgres storage %s: %s", storageDefinitionName, err.Error())
+	}
+	db.SetMaxOpenConns(sd.MaxOpenConns)
+	if sd.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(sd.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(connMaxLifetime)
+
+	b.postgresDBs[storageDefinitionName] = db
+	return db, nil
+}
+
+// memoryStorage returns the named memory storage, loading its files on
+// first use.
+func (b *builder) memoryStorage(storageDefinitionName string) (*storage.MemoryStorage, error) {
+	if m, ok := b.memoryStorages[storageDefinitionName]; ok {
+		return m, nil
+	}
+	sd := b.hc.Storage[storageDefinitionName]
+	m, err := storage.NewMemoryStorage(sd.BaseDir, sd.Layer, sd.Healthcheck, sd.MemoryMaxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Storage %s: %s", storageDefinitionName, err.Error())
+	}
+	b.logger.Info("Loaded %d files into memory storage %s", m.Len(), storageDefinitionName)
+
+	b.memoryStorages[storageDefinitionName] = m
+	return m, nil
+}
+
+// diskCache returns the disk cache of the named storage, clearing its
+// directory on first use.
+func (b *builder) diskCache(storageDefinitionName string) (*storage.DiskCache, error) {
+	if dc, ok := b.diskCaches[storageDefinitionName]; ok {
+		return dc, nil
+	}
+	sd := b.hc.Storage[storageDefinitionName]
+	// each storage clears its directory, and keys may be the same in others
+	for name, other := range b.hc.Storage {
+		if name != storageDefinitionName && other.DiskCacheDir != "" && filepath.Clean(other.DiskCacheDir) == filepath.Clean(sd.DiskCacheDir) {
+			return nil, fmt.Errorf("Storages %s and %s have the same disk cache dir", storageDefinitionName, name)
+		}
+	}
+	ttl, err := parseDurationCfg("diskCacheTTL", sd.DiskCacheTTL, 0)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := storage.NewDiskCache(storage.DiskCacheOptions{
+		Dir:      sd.DiskCacheDir,
+		MaxBytes: sd.DiskCacheMaxBytes,
+		TTL:      ttl,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Storage %s: %s", storageDefinitionName, err.Error())
+	}
+	b.logger.Info("Disk cache of %d bytes in %s for storage %s", sd.DiskCacheMaxBytes, sd.DiskCacheDir, storageDefinitionName)
+
+	b.diskCaches[storageDefinitionName] = dc
+	return dc, nil
+}
+
+// keyHash returns how the {hash} key variable of the storage is computed,
+// checking the pattern's key variables don't replace it or the other
+// builtin variables.
+func (b *builder) keyHash(reqPattern string, rhc *config.RouteHandlerConfig, storageDefinitionName, layer string) (storage.HashFunc, string, error) {
+	sd, logger := b.hc.Storage[storageDefinitionName], b.logger
+
+	for name := range rhc.KeyVariables {
+		if storage.IsBuiltinKeyVariable(name) {
+			return nil, "", fmt.Errorf("Key variable %s on pattern %s would replace a builtin variable", name, reqPattern)
+		}
+	}
+	hashScheme := storage.DefaultHashScheme
+	if sd.HashScheme != "" {
+		hashScheme = sd.HashScheme
+	}
+	hashFunc, err := storage.NewHashFunc(hashScheme)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid hash scheme for storage %s: %s", storageDefinitionName, err.Error())
+	}
+
+	hashCompatibility := sd.HashCompatibility
+	if hashCompatibility == "" {
+		hashCompatibility = storage.InferHashCompatibility(layer)
+		logger.Info("Storage %s on pattern %s hashes keys with the %s scheme, inferred from its layer %#v", storageDefinitionName, reqPattern, hashCompatibility, layer)
+	} else if !storage.IsValidHashCompatibility(hashCompatibility) {
+		return nil, "", fmt.Errorf("Invalid hash compatibility for storage %s: %s", storageDefinitionName, hashCompatibility)
+	} else if hashCompatibility == storage.HashCompatibility_LegacyLayerSlash && layer == "" {
+		return nil, "", fmt.Errorf("Storage %s on pattern %s has %s hash compatibility, which needs a layer", storageDefinitionName, reqPattern, hashCompatibility)
+	} else {
+		logger.Info("Storage %s on pattern %s hashes keys with the %s scheme", storageDefinitionName, reqPattern, hashCompatibility)
+	}
+	return hashFunc, hashCompatibility, nil
+}
+
+// stringOrNil quotes an optional string from the handler config, telling
+// apart one which isn't set from an empty one.
+func stringOrNil(value *string) string {
+	if value == nil {
+		return "nil"
+	}
+	return strconv.Quote(*value)
+}
+
+// parseDurationCfg parses an optional duration from the handler config,
+// returning the default when it is empty.
+func parseDurationCfg(name, value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s duration %#v: %s", name, value, err.Error())
+	}
+	return d, nil
+}
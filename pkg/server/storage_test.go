@@ -0,0 +1,153 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/tilezen/tapalcatl/pkg/config"
+)
+
+func TestTagRequests(t *testing.T) {
+	var received *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req
+		rw.Write([]byte("tile"))
+	}))
+	defer srv.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(srv.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatalf("Unable to create session: %s", err.Error())
+	}
+	client := s3.New(sess)
+	tagRequests(client, map[string]string{"deployment": "staging"}, "storage osm")
+
+	output, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("0/0/0.zip")})
+	if err != nil {
+		t.Fatalf("Unable to get object: %s", err.Error())
+	}
+	output.Body.Close()
+
+	if ua := received.Header.Get("User-Agent"); !strings.Contains(ua, "tapalcatl/"+Version+" (storage osm)") {
+		t.Fatalf("Expected tapalcatl in the user agent, got %#v", ua)
+	}
+	if tag := received.URL.Query().Get("x-deployment"); tag != "staging" {
+		t.Fatalf("Expected the deployment tag as a query parameter, got %#v", received.URL.RawQuery)
+	}
+}
+
+func TestS3Overrides(t *testing.T) {
+	var received *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req
+		rw.Write([]byte("tile"))
+	}))
+	defer srv.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	if err != nil {
+		t.Fatalf("Unable to create session: %s", err.Error())
+	}
+	// a host without a scheme, as for a local MinIO
+	client := s3.New(sess, s3Overrides(config.StorageDefinition{
+		Endpoint:       strings.TrimPrefix(srv.URL, "http://"),
+		ForcePathStyle: true,
+		DisableSSL:     true,
+	}))
+
+	output, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("0/0/0.zip")})
+	if err != nil {
+		t.Fatalf("Unable to get object from the endpoint: %s", err.Error())
+	}
+	output.Body.Close()
+
+	if received.URL.Path != "/bucket/0/0/0.zip" {
+		t.Fatalf("Expected the bucket in the path, got %#v", received.URL.Path)
+	}
+}
+
+func TestS3HTTPClient(t *testing.T) {
+	b := &builder{
+		hc: &config.HandlerConfig{Storage: map[string]config.StorageDefinition{
+			"default": {Type: "s3"},
+			"tuned": {
+				Type:                  "s3",
+				MaxIdleConnsPerHost:   256,
+				IdleConnTimeout:       "2m",
+				ResponseHeaderTimeout: "5s",
+				DisableHTTP2:          true,
+			},
+			"invalid": {Type: "s3", DialTimeout: "soon"},
+		}},
+		s3HTTPClients: make(map[string]*http.Client),
+	}
+
+	if client, err := b.s3HTTPClient("default"); client != nil || err != nil {
+		t.Fatalf("Expected the default client for a storage without tuning, got %#v, %v", client, err)
+	}
+
+	client, err := b.s3HTTPClient("tuned")
+	if err != nil {
+		t.Fatalf("Unable to create http client: %s", err.Error())
+	}
+	transport := client.Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 256 || transport.MaxIdleConns < 256 {
+		t.Fatalf("Expected 256 idle connections per host, got %d of %d", transport.MaxIdleConnsPerHost, transport.MaxIdleConns)
+	}
+	if transport.IdleConnTimeout != 2*time.Minute || transport.ResponseHeaderTimeout != 5*time.Second {
+		t.Fatalf("Expected the configured timeouts, got %s and %s", transport.IdleConnTimeout, transport.ResponseHeaderTimeout)
+	}
+	if transport.TLSHandshakeTimeout != http.DefaultTransport.(*http.Transport).TLSHandshakeTimeout {
+		t.Fatalf("Expected the default TLS handshake timeout, got %s", transport.TLSHandshakeTimeout)
+	}
+	if transport.ForceAttemptHTTP2 || transport.TLSNextProto == nil {
+		t.Fatalf("Expected HTTP/2 to be disabled")
+	}
+	if again, _ := b.s3HTTPClient("tuned"); again != client {
+		t.Fatalf("Expected patterns sharing the storage to share its client")
+	}
+
+	if _, err := b.s3HTTPClient("invalid"); err == nil {
+		t.Fatalf("Expected an error for an invalid dial timeout")
+	}
+}
+
+func TestSFTPDialerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("Unable to write key: %s", err.Error())
+	}
+
+	sd := config.StorageDefinition{Type: "sftp", Address: "files", User: "tiles", PrivateKeyFile: keyFile}
+	if _, err := sftpDialer("legacy", sd); err == nil || !strings.Contains(err.Error(), "known hosts") {
+		t.Fatalf("Expected an error without a known hosts file, got %v", err)
+	}
+	sd.KnownHostsFile = filepath.Join(dir, "known_hosts")
+	if _, err := sftpDialer("legacy", sd); err == nil || !strings.Contains(err.Error(), "Invalid private key") {
+		t.Fatalf("Expected an error for an invalid private key, got %v", err)
+	}
+}
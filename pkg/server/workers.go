@@ -0,0 +1,206 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/log"
+)
+
+// WorkerEnv is the environment variable set to the worker number in the
+// processes started by a Supervisor.
+const WorkerEnv = "TAPALCATL_WORKER"
+
+// The time to wait before restarting a worker which exited, unless
+// configured otherwise
+const defaultWorkerRestartDelay = time.Second
+
+// How soon after starting a worker's exit counts as failing to start, and
+// how many such exits in a row make the supervisor give up, unless
+// configured otherwise
+const (
+	defaultWorkerFastExit     = 10 * time.Second
+	defaultWorkerMaxFastExits = 5
+)
+
+// WorkerNumber returns the worker number of this process and true when it was
+// started by a Supervisor.
+func WorkerNumber() (int, bool) {
+	value, ok := os.LookupEnv(WorkerEnv)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// SupervisorOptions are the settings of a Supervisor.
+type SupervisorOptions struct {
+	// Workers is the number of worker processes to keep running.
+	Workers int
+	// Command and Args start a worker, eg. this executable with the same
+	// arguments. The worker number is added to the environment as WorkerEnv.
+	Command string
+	Args    []string
+	// RestartDelay is how long to wait before restarting a worker which
+	// exited, default a second.
+	RestartDelay time.Duration
+	// FastExit is how soon after starting a worker's exit counts as failing
+	// to start, default 10s. MaxFastExits such exits of a worker in a row,
+	// default 5, fail the supervisor rather than restarting it forever, eg.
+	// when the config is invalid.
+	FastExit     time.Duration
+	MaxFastExits int
+}
+
+// Supervisor keeps a number of worker processes running, each serving the
+// same address with ListenReusePort, so that GC pauses and panics only
+// affect the requests of one worker. Workers which exit are restarted until
+// the supervisor is stopped, which passes SIGTERM on to them so that they
+// drain as they would on their own, or until a worker keeps exiting as soon
+// as it starts, which fails the supervisor.
+type Supervisor struct {
+	options SupervisorOptions
+	logger  log.JsonLogger
+	failed  chan error
+
+	mu       sync.Mutex
+	stopping bool
+	workers  map[int]*os.Process
+	wg       sync.WaitGroup
+}
+
+func NewSupervisor(options SupervisorOptions, logger log.JsonLogger) (*Supervisor, error) {
+	if options.Workers <= 0 {
+		return nil, fmt.Errorf("Number of workers must be positive, but is %d", options.Workers)
+	}
+	if !CanReusePort {
+		return nil, fmt.Errorf("Worker processes need SO_REUSEPORT, which isn't supported on this platform")
+	}
+	if options.RestartDelay <= 0 {
+		options.RestartDelay = defaultWorkerRestartDelay
+	}
+	if options.FastExit <= 0 {
+		options.FastExit = defaultWorkerFastExit
+	}
+	if options.MaxFastExits <= 0 {
+		options.MaxFastExits = defaultWorkerMaxFastExits
+	}
+	return &Supervisor{
+		options: options,
+		logger:  logger,
+		failed:  make(chan error, 1),
+		workers: make(map[int]*os.Process),
+	}, nil
+}
+
+// Failed receives an error once a worker has exited MaxFastExits times in a
+// row as soon as it started. The supervisor doesn't restart it again, and
+// is to be stopped.
+func (s *Supervisor) Failed() <-chan error {
+	return s.failed
+}
+
+// Start starts the workers, returning an error if any of them can't be
+// started. Workers which started are stopped again in that case.
+func (s *Supervisor) Start() error {
+	for n := 1; n <= s.options.Workers; n++ {
+		cmd, err := s.start(n)
+		if err != nil {
+			s.Stop()
+			return err
+		}
+		s.wg.Add(1)
+		go s.supervise(n, cmd)
+	}
+	return nil
+}
+
+// start starts worker n, unless the supervisor is stopping.
+func (s *Supervisor) start(n int) (*exec.Cmd, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopping {
+		return nil, nil
+	}
+	cmd := exec.Command(s.options.Command, s.options.Args...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", WorkerEnv, n))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Unable to start worker %d: %s", n, err.Error())
+	}
+	s.workers[n] = cmd.Process
+	s.logger.Info("Started worker %d with pid %d", n, cmd.Process.Pid)
+	return cmd, nil
+}
+
+// supervise waits for worker n to exit, restarting it until the supervisor
+// is stopping or the worker keeps exiting as soon as it starts. Workers
+// which fail to start are retried after the delay too.
+func (s *Supervisor) supervise(n int, cmd *exec.Cmd) {
+	defer s.wg.Done()
+
+	fastExits := 0
+	for cmd != nil {
+		startedAt := time.Now()
+		err := cmd.Wait()
+
+		s.mu.Lock()
+		delete(s.workers, n)
+		stopping := s.stopping
+		s.mu.Unlock()
+		if stopping {
+			s.logger.Info("Worker %d exited: %v", n, err)
+			return
+		}
+		if time.Since(startedAt) < s.options.FastExit {
+			fastExits++
+		} else {
+			fastExits = 0
+		}
+		if fastExits >= s.options.MaxFastExits {
+			failure := fmt.Errorf("Worker %d exited %d times in a row within %s of starting, last with: %v", n, fastExits, s.options.FastExit, err)
+			s.logger.Error(log.LogCategory_WorkerExit, "%s", failure.Error())
+			select {
+			case s.failed <- failure:
+			default:
+			}
+			return
+		}
+		s.logger.Warning(log.LogCategory_WorkerExit, "Worker %d exited, restarting it in %s: %v", n, s.options.RestartDelay, err)
+
+		for {
+			time.Sleep(s.options.RestartDelay)
+			cmd, err = s.start(n)
+			if err == nil {
+				break
+			}
+			s.logger.Error(log.LogCategory_WorkerExit, "%s", err.Error())
+		}
+	}
+}
+
+// Stop sends SIGTERM to the workers and waits for them to exit, without
+// restarting them.
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	s.stopping = true
+	for n, p := range s.workers {
+		if err := p.Signal(syscall.SIGTERM); err != nil {
+			s.logger.Info("Unable to signal worker %d: %+v", n, err)
+		}
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/log"
+)
+
+func TestListenReusePort(t *testing.T) {
+	if !CanReusePort {
+		t.Skip("SO_REUSEPORT isn't supported on this platform")
+	}
+	first, err := ListenReusePort("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+	}
+	defer first.Close()
+	second, err := ListenReusePort(first.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected a second listener on %s, got %s", first.Addr(), err.Error())
+	}
+	second.Close()
+}
+
+func TestSupervisor(t *testing.T) {
+	if !CanReusePort {
+		t.Skip("SO_REUSEPORT isn't supported on this platform")
+	}
+	dir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	started := filepath.Join(dir, "started")
+
+	// worker 1 exits straight away, worker 2 runs until terminated
+	script := `echo $` + WorkerEnv + ` >> ` + started + `
+if [ "$` + WorkerEnv + `" = 1 ]; then exit 1; fi
+trap 'exit 0' TERM
+while true; do sleep 0.01; done`
+	supervisor, err := NewSupervisor(SupervisorOptions{
+		Workers:      2,
+		Command:      "/bin/sh",
+		Args:         []string{"-c", script},
+		RestartDelay: 10 * time.Millisecond,
+	}, &log.NilJsonLogger{})
+	if err != nil {
+		t.Fatalf("Unable to create supervisor: %s", err.Error())
+	}
+	if err := supervisor.Start(); err != nil {
+		t.Fatalf("Unable to start workers: %s", err.Error())
+	}
+
+	var starts map[string]int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		data, _ := ioutil.ReadFile(started)
+		starts = make(map[string]int)
+		for _, n := range strings.Fields(string(data)) {
+			starts[n]++
+		}
+		if starts["1"] >= 3 {
+			break
+		}
+	}
+	if starts["1"] < 3 || starts["2"] != 1 {
+		t.Fatalf("Expected worker 1 to be restarted and worker 2 started once, got %v", starts)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		supervisor.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the workers to exit on SIGTERM")
+	}
+}
+
+func TestSupervisorFastExits(t *testing.T) {
+	if !CanReusePort {
+		t.Skip("SO_REUSEPORT isn't supported on this platform")
+	}
+
+	// worker 1 fails as soon as it starts, eg. with an invalid config
+	script := `if [ "$` + WorkerEnv + `" = 1 ]; then exit 1; fi
+trap 'exit 0' TERM
+while true; do sleep 0.01; done`
+	supervisor, err := NewSupervisor(SupervisorOptions{
+		Workers:      2,
+		Command:      "/bin/sh",
+		Args:         []string{"-c", script},
+		RestartDelay: 10 * time.Millisecond,
+		MaxFastExits: 3,
+	}, &log.NilJsonLogger{})
+	if err != nil {
+		t.Fatalf("Unable to create supervisor: %s", err.Error())
+	}
+	if err := supervisor.Start(); err != nil {
+		t.Fatalf("Unable to start workers: %s", err.Error())
+	}
+	defer supervisor.Stop()
+
+	select {
+	case err := <-supervisor.Failed():
+		if !strings.Contains(err.Error(), "Worker 1 exited 3 times") {
+			t.Fatalf("Expected worker 1 to fail the supervisor, got %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a worker which keeps exiting to fail the supervisor")
+	}
+}
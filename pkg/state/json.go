@@ -0,0 +1,265 @@
+package state
+
+import (
+	"strconv"
+
+	"github.com/tilezen/tapalcatl/pkg/log"
+)
+
+// jsonWriter appends the members of JSON objects to a buffer, for the log
+// entries written for every request.
+type jsonWriter struct {
+	buf []byte
+	// set when the next member follows another
+	comma bool
+}
+
+func (w *jsonWriter) key(name string) {
+	if w.comma {
+		w.buf = append(w.buf, ',')
+	}
+	w.buf = log.AppendJsonString(w.buf, name)
+	w.buf = append(w.buf, ':')
+	w.comma = true
+}
+
+func (w *jsonWriter) str(name, value string) {
+	w.key(name)
+	w.buf = log.AppendJsonString(w.buf, value)
+}
+
+func (w *jsonWriter) int(name string, value int64) {
+	w.key(name)
+	w.buf = strconv.AppendInt(w.buf, value, 10)
+}
+
+func (w *jsonWriter) bool(name string, value bool) {
+	w.key(name)
+	w.buf = strconv.AppendBool(w.buf, value)
+}
+
+// object starts a nested object, which is ended with end.
+func (w *jsonWriter) object(name string) {
+	w.key(name)
+	w.buf = append(w.buf, '{')
+	w.comma = false
+}
+
+func (w *jsonWriter) end() {
+	w.buf = append(w.buf, '}')
+	w.comma = true
+}
+
+func (w *jsonWriter) metadata(metadata ReqStorageMetadata) {
+	w.object("metadata")
+	w.bool("has_last_modified", metadata.HasLastModified)
+	w.bool("has_etag", metadata.HasEtag)
+	w.end()
+}
+
+// httpData writes the members of the "http" object common to metatile and
+// tilejson requests.
+func (w *jsonWriter) httpData(httpData *HttpRequestData) {
+	w.str("path", httpData.Path)
+	if httpData.UserAgent != "" {
+		w.str("user_agent", httpData.UserAgent)
+	}
+	if httpData.Referrer != "" {
+		w.str("referer", httpData.Referrer)
+	}
+	if httpData.ApiKey != "" {
+		w.str("api_key", httpData.ApiKey)
+	}
+	if len(httpData.Headers) > 0 {
+		w.object("headers")
+		for name, value := range httpData.Headers {
+			w.str(name, value)
+		}
+		w.end()
+	}
+}
+
+// AppendJsonFields appends the fields of AsJsonMap to buf as JSON.
+func (reqState *RequestState) AppendJsonFields(buf []byte) []byte {
+	w := jsonWriter{buf: buf, comma: true}
+
+	if reqState.FetchState > FetchState_Nil {
+		w.object("fetch")
+		w.str("state", reqState.FetchState.String())
+		if reqState.FetchSize.BodySize > 0 {
+			w.object("size")
+			w.int("body", reqState.FetchSize.BodySize)
+			w.int("bytes_len", reqState.FetchSize.BytesLength)
+			w.int("bytes_cap", reqState.FetchSize.BytesCap)
+			w.end()
+		}
+		w.metadata(reqState.StorageMetadata)
+		w.end()
+	}
+
+	if reqState.IsZipError || reqState.IsResponseWriteError || reqState.IsCondError || reqState.IsCacheLookupError {
+		w.object("error")
+		if reqState.IsZipError {
+			w.bool("zip", true)
+		}
+		if reqState.IsResponseWriteError {
+			w.bool("response_write", true)
+		}
+		if reqState.IsCondError {
+			w.bool("cond", true)
+		}
+		if reqState.IsCacheLookupError {
+			w.bool("cache_lookup", true)
+		}
+		w.end()
+	}
+
+	if reqState.IsTileInvalid {
+		w.bool("tile_invalid", true)
+	}
+	if reqState.IsTombstone {
+		w.bool("tombstone", true)
+	}
+	if reqState.IsStale {
+		w.bool("stale", true)
+	}
+	if reqState.IsDegraded {
+		w.bool("degraded", true)
+	}
+	if reqState.IsOverMaxZoom {
+		w.bool("over_max_zoom", true)
+	}
+	if reqState.IsUnknownFormat {
+		w.bool("unknown_format", true)
+	}
+	if reqState.IsDeadlineExceeded {
+		w.bool("deadline_exceeded", true)
+	}
+	if reqState.IsDuplicateEntry {
+		w.bool("duplicate_entry", true)
+	}
+	if reqState.IsHashMismatch {
+		w.bool("hash_mismatch", true)
+	}
+	if reqState.Malformed != "" {
+		w.str("malformed", reqState.Malformed)
+	}
+	if reqState.FormatFallback != "" {
+		w.str("format_fallback", reqState.FormatFallback)
+	}
+	if reqState.IsTranscoded {
+		w.bool("transcoded", true)
+	}
+
+	w.object("timing")
+	w.int("parse", DurationIn(reqState.Duration.Parse, reqState.TimingUnit))
+	w.int("vector_cache_lookup", DurationIn(reqState.Duration.VectorCacheLookup, reqState.TimingUnit))
+	w.int("metatile_cache_lookup", DurationIn(reqState.Duration.MetatileCacheLookup, reqState.TimingUnit))
+	w.int("cache_set", DurationIn(reqState.Duration.CacheSet, reqState.TimingUnit))
+	w.int("storage_fetch", DurationIn(reqState.Duration.StorageFetch, reqState.TimingUnit))
+	w.int("storage_read", DurationIn(reqState.Duration.StorageRead, reqState.TimingUnit))
+	w.int("metatile_find", DurationIn(reqState.Duration.MetatileFind, reqState.TimingUnit))
+	w.int("resp_write", DurationIn(reqState.Duration.RespWrite, reqState.TimingUnit))
+	w.int("total", DurationIn(reqState.Duration.Total, reqState.TimingUnit))
+	if compression := reqState.Compression; compression != nil {
+		w.int("compress", DurationIn(compression.Duration, reqState.TimingUnit))
+	}
+	if reqState.IsTranscoded {
+		w.int("transcode", DurationIn(reqState.Duration.Transcode, reqState.TimingUnit))
+	}
+	if reqState.Duration.Queue > 0 {
+		w.int("queue", DurationIn(reqState.Duration.Queue, reqState.TimingUnit))
+	}
+	w.end()
+	if reqState.TimingUnit == TimingUnit_Microseconds {
+		w.str("timing_unit", reqState.TimingUnit)
+	}
+
+	w.object("http")
+	w.httpData(&reqState.HttpData)
+	// the coord's format replaces the requested one, even when empty
+	if reqState.Coord != nil {
+		w.str("format", reqState.Coord.Format)
+	} else if reqState.Format != "" {
+		w.str("format", reqState.Format)
+	}
+	if reqState.ResponseSize > 0 {
+		w.int("response_size", int64(reqState.ResponseSize))
+	}
+	if compression := reqState.Compression; compression != nil {
+		w.int("compressed_size", int64(compression.Size))
+	}
+	w.int("status", int64(reqState.ResponseState.AsStatusCode()))
+	w.end()
+
+	if reqState.Coord != nil {
+		w.object("coord")
+		w.int("x", int64(reqState.Coord.X))
+		w.int("y", int64(reqState.Coord.Y))
+		w.int("z", int64(reqState.Coord.Z))
+		w.end()
+	}
+	if reqState.Build != "" {
+		w.str("build", reqState.Build)
+	}
+
+	w.object("cache")
+	w.bool("vector_hit", reqState.Cache.VectorCacheHit)
+	w.bool("metatile_hit", reqState.Cache.MetatileCacheHit)
+	if reqState.Cache.CompressedCacheHit {
+		w.bool("compressed_hit", true)
+	}
+	w.end()
+
+	return w.buf
+}
+
+// AppendJsonFields appends the fields of AsJsonMap to buf as JSON.
+func (tileJsonReqState *TileJsonRequestState) AppendJsonFields(buf []byte) []byte {
+	w := jsonWriter{buf: buf, comma: true}
+
+	if tileJsonReqState.FetchState > FetchState_Nil {
+		w.object("fetch")
+		w.str("state", tileJsonReqState.FetchState.String())
+		if tileJsonReqState.FetchSize > 0 {
+			w.key("size")
+			w.buf = strconv.AppendUint(w.buf, tileJsonReqState.FetchSize, 10)
+		}
+		w.metadata(tileJsonReqState.StorageMetadata)
+		w.end()
+	}
+
+	if tileJsonReqState.IsResponseWriteError || tileJsonReqState.IsCondError {
+		w.object("error")
+		if tileJsonReqState.IsResponseWriteError {
+			w.bool("response_write", true)
+		}
+		if tileJsonReqState.IsCondError {
+			w.bool("cond", true)
+		}
+		w.end()
+	}
+
+	w.object("timing")
+	w.int("parse", DurationIn(tileJsonReqState.Duration.Parse, tileJsonReqState.TimingUnit))
+	w.int("storage_fetch", DurationIn(tileJsonReqState.Duration.StorageFetch, tileJsonReqState.TimingUnit))
+	w.int("storage_read_resp_write", DurationIn(tileJsonReqState.Duration.StorageReadRespWrite, tileJsonReqState.TimingUnit))
+	w.int("total", DurationIn(tileJsonReqState.Duration.Total, tileJsonReqState.TimingUnit))
+	w.end()
+	if tileJsonReqState.TimingUnit == TimingUnit_Microseconds {
+		w.str("timing_unit", tileJsonReqState.TimingUnit)
+	}
+
+	w.object("http")
+	w.httpData(&tileJsonReqState.HttpData)
+	if tileJsonReqState.Format != nil {
+		w.str("format", tileJsonReqState.Format.Name())
+	}
+	w.end()
+
+	if tileJsonReqState.Build != "" {
+		w.str("build", tileJsonReqState.Build)
+	}
+
+	return w.buf
+}
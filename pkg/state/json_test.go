@@ -0,0 +1,103 @@
+package state
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// checkJsonFields checks that entry's AppendJsonFields writes the same
+// fields as its AsJsonMap.
+func checkJsonFields(t *testing.T, name string, entry interface {
+	AsJsonMap() map[string]interface{}
+	AppendJsonFields([]byte) []byte
+}) {
+	var expected, actual map[string]interface{}
+	mapJson, err := json.Marshal(entry.AsJsonMap())
+	if err != nil {
+		t.Fatalf("Unable to marshal %s: %s", name, err.Error())
+	}
+	if err := json.Unmarshal(mapJson, &expected); err != nil {
+		t.Fatalf("Unable to unmarshal %s: %s", name, err.Error())
+	}
+
+	fields := entry.AppendJsonFields([]byte(`{"type":"info"`))
+	fields = append(fields, '}')
+	if err := json.Unmarshal(fields, &actual); err != nil {
+		t.Fatalf("Invalid JSON for %s: %s in %s", name, err.Error(), fields)
+	}
+	delete(actual, "type")
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("Expected fields of %s to be %s, got %s", name, mapJson, fields)
+	}
+}
+
+func TestAppendJsonFields(t *testing.T) {
+	checkJsonFields(t, "empty request state", &RequestState{})
+
+	checkJsonFields(t, "request state", &RequestState{
+		ResponseState:   ResponseState_Success,
+		FetchState:      FetchState_Success,
+		FetchSize:       ReqFetchSize{BodySize: 100, BytesLength: 200, BytesCap: 300},
+		StorageMetadata: ReqStorageMetadata{HasEtag: true},
+		Cache:           ReqCacheData{MetatileCacheHit: true, CompressedCacheHit: true},
+		IsZipError:      true,
+		IsCondError:     true,
+		IsTombstone:     true,
+		IsDegraded:      true,
+		Duration:        ReqDuration{Parse: time.Millisecond, StorageFetch: 20 * time.Millisecond, Total: 30 * time.Millisecond},
+		Coord:           &tile.TileCoord{Z: 1, X: 2, Y: 3, Format: "mvt"},
+		HttpData: HttpRequestData{
+			Path:      "/osm/1/2/3.mvt",
+			ApiKey:    "key",
+			UserAgent: "agent \"quoted\" <b> \n",
+			Headers:   map[string]string{"X-Client": "app", "Origin": "https://example.com"},
+		},
+		Format:       "json",
+		ResponseSize: 1234,
+		Compression:  &ReqCompression{Duration: 2 * time.Millisecond, Size: 567},
+		Build:        "20210331",
+	})
+
+	format := TileJsonFormat(TileJsonFormat_Topojson)
+	checkJsonFields(t, "tilejson request state", &TileJsonRequestState{
+		Duration:        TileJsonDuration{Total: 5 * time.Millisecond},
+		Format:          &format,
+		ResponseState:   ResponseState_NotModified,
+		FetchState:      FetchState_Success,
+		FetchSize:       42,
+		StorageMetadata: ReqStorageMetadata{HasLastModified: true},
+		IsCondError:     true,
+		HttpData:        HttpRequestData{Path: "/tilejson/topojson.json", Referrer: "https://example.com"},
+	})
+
+	reqState := &RequestState{Duration: ReqDuration{Parse: 250 * time.Microsecond}, TimingUnit: TimingUnit_Microseconds}
+	checkJsonFields(t, "request state timed in microseconds", reqState)
+	if parse := reqState.AsJsonMap()["timing"].(map[string]int64)["parse"]; parse != 250 {
+		t.Fatalf("Expected the parse time in microseconds, got %d", parse)
+	}
+	checkJsonFields(t, "tilejson request state timed in microseconds", &TileJsonRequestState{
+		Duration:   TileJsonDuration{Total: 1500 * time.Microsecond},
+		TimingUnit: TimingUnit_Microseconds,
+	})
+}
+
+func TestAppendJsonFieldsAllocations(t *testing.T) {
+	reqState := &RequestState{
+		ResponseState: ResponseState_Success,
+		FetchState:    FetchState_Success,
+		Coord:         &tile.TileCoord{Z: 1, X: 2, Y: 3, Format: "mvt"},
+		HttpData:      HttpRequestData{Path: "/osm/1/2/3.mvt", UserAgent: "agent"},
+	}
+	buf := make([]byte, 0, 1024)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf = reqState.AppendJsonFields(buf[:0])
+	})
+	if allocs > 0 {
+		t.Fatalf("Expected no allocations writing request state, got %.0f", allocs)
+	}
+}
@@ -1,8 +1,9 @@
 package state
 
 import (
-	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/tilezen/tapalcatl/pkg/tile"
@@ -67,6 +68,9 @@ const (
 	FetchState_FetchError
 	FetchState_ReadError
 	FetchState_ConfigError
+	// FetchState_Archived is a fetch of a metatile which is archived, eg.
+	// in Glacier, rather than one which failed
+	FetchState_Archived
 	FetchState_Count
 )
 
@@ -84,6 +88,8 @@ func (rfs ReqFetchState) String() string {
 		return "readerr"
 	case FetchState_ConfigError:
 		return "configerr"
+	case FetchState_Archived:
+		return "archived"
 	default:
 		return "unknown"
 	}
@@ -94,11 +100,16 @@ type HttpRequestData struct {
 	ApiKey    string
 	UserAgent string
 	Referrer  string
+	// Headers holds the values of the request headers configured to be
+	// captured, by their canonical names
+	Headers map[string]string
 }
 
 type ReqCacheData struct {
 	VectorCacheHit   bool
 	MetatileCacheHit bool
+	// CompressedCacheHit is set when a compressed variant was served from cache
+	CompressedCacheHit bool
 }
 
 type ParseResultType int
@@ -119,16 +130,33 @@ type ParseResult struct {
 	ContentType string
 	HttpData    HttpRequestData
 	BuildID     string
+	// AsOf selects the newest build made at or before it, when BuildID isn't
+	// given
+	AsOf *time.Time
+	// KeyVariables are extra variables for the storage key pattern, taken
+	// from allow-listed query parameters, path variables and headers
+	KeyVariables map[string]string
+	// KeyHeaders are the request headers key variables are taken from,
+	// which responses vary by
+	KeyHeaders []string
+	// CacheKeyParams are the significant query parameters of the request,
+	// normalized, when the parser is configured with them
+	CacheKeyParams *string
+	// StorageNamespace tells apart the metatiles of different storages in
+	// the cache, set by the handler for the storage it fetches from
+	StorageNamespace string
 	// set to be more specific data based on parse type
 	AdditionalData interface{}
 }
 
 type VectorTileResponseData struct {
-	ContentType   string
-	LastModified  *time.Time
-	ETag          *string
-	ResponseState ReqResponseState
-	Data          []byte
+	ContentType string
+	// ContentEncoding is set when Data is compressed, eg. "gzip"
+	ContentEncoding string
+	LastModified    *time.Time
+	ETag            *string
+	ResponseState   ReqResponseState
+	Data            []byte
 }
 
 type MetatileResponseData struct {
@@ -138,6 +166,9 @@ type MetatileResponseData struct {
 	Data          []byte
 	Offset        tile.TileCoord
 	BodySize      int64
+	// Ranges, if set, reads the metatile of BodySize bytes from storage in
+	// parts, in place of the Data. Such metatiles aren't cached.
+	Ranges io.ReaderAt `msgpack:"-"`
 }
 
 type Condition struct {
@@ -147,8 +178,25 @@ type Condition struct {
 
 type MetatileParseData struct {
 	Coord tile.TileCoord
+	// IsUnknownFormat is set when the format wasn't in the mime map, and
+	// the fallback content type was used
+	IsUnknownFormat bool
+	// ContentHash is the hash of the tile's content given in the URL, if
+	// any, which the tile served must match
+	ContentHash string
 }
 
+const (
+	// Malformed_Coord marks requests for coordinates which don't parse or
+	// are outside the world.
+	Malformed_Coord = "coord"
+	// Malformed_Format marks requests for formats which aren't served.
+	Malformed_Format = "format"
+	// Malformed_Query marks requests with invalid query parameters, or
+	// URLs which are too long.
+	Malformed_Query = "query"
+)
+
 type RequestState struct {
 	ResponseState        ReqResponseState
 	FetchState           ReqFetchState
@@ -159,11 +207,51 @@ type RequestState struct {
 	IsResponseWriteError bool
 	IsCondError          bool
 	IsCacheLookupError   bool
+	IsOverMaxZoom        bool
+	IsTileInvalid        bool
+	IsTombstone          bool
+	IsStale              bool
+	IsDegraded           bool
+	IsUnknownFormat      bool
+	IsDeadlineExceeded   bool
+	IsDuplicateEntry     bool
+	IsHashMismatch       bool
 	Duration             ReqDuration
 	Coord                *tile.TileCoord
 	HttpData             HttpRequestData
 	Format               string
 	ResponseSize         int
+	// Malformed is one of the Malformed_ constants when the request failed
+	// to parse, as those are mostly from bots and are counted apart from
+	// other responses
+	Malformed string
+	// FormatFallback is the format of the entry served when the metatile
+	// had none in the requested format, and IsTranscoded is set when it
+	// was converted to the requested format
+	FormatFallback string
+	IsTranscoded   bool
+	// Compression is set when the response was compressed by the server,
+	// and compression is being instrumented
+	Compression *ReqCompression
+	// Build is the build ID requested, empty for the default build
+	Build string
+	// StorageSource names the storage which served the metatile, when the
+	// storage is a fallback between several, or the build prefix, when
+	// fanning out across several
+	StorageSource string
+	// StorageRetries is the number of times the storage fetch was retried
+	// after a transient error
+	StorageRetries int
+	// TimingUnit is one of the TimingUnit_ constants, the unit of the
+	// logged timings, default milliseconds
+	TimingUnit string
+}
+
+// ReqCompression is the time spent compressing a response, and its size once
+// compressed.
+type ReqCompression struct {
+	Duration time.Duration
+	Size     int
 }
 
 func (reqState *RequestState) AsJsonMap() map[string]interface{} {
@@ -174,6 +262,12 @@ func (reqState *RequestState) AsJsonMap() map[string]interface{} {
 		fetchResult := make(map[string]interface{})
 
 		fetchResult["state"] = reqState.FetchState.String()
+		if reqState.StorageSource != "" {
+			fetchResult["source"] = reqState.StorageSource
+		}
+		if reqState.StorageRetries > 0 {
+			fetchResult["retries"] = reqState.StorageRetries
+		}
 
 		if reqState.FetchSize.BodySize > 0 {
 			fetchResult["size"] = map[string]int64{
@@ -208,16 +302,66 @@ func (reqState *RequestState) AsJsonMap() map[string]interface{} {
 		result["error"] = reqStateErrs
 	}
 
-	result["timing"] = map[string]int64{
-		"parse":                 reqState.Duration.Parse.Milliseconds(),
-		"vector_cache_lookup":   reqState.Duration.VectorCacheLookup.Milliseconds(),
-		"metatile_cache_lookup": reqState.Duration.MetatileCacheLookup.Milliseconds(),
-		"cache_set":             reqState.Duration.CacheSet.Milliseconds(),
-		"storage_fetch":         reqState.Duration.StorageFetch.Milliseconds(),
-		"storage_read":          reqState.Duration.StorageRead.Milliseconds(),
-		"metatile_find":         reqState.Duration.MetatileFind.Milliseconds(),
-		"resp_write":            reqState.Duration.RespWrite.Milliseconds(),
-		"total":                 reqState.Duration.Total.Milliseconds(),
+	if reqState.IsTileInvalid {
+		result["tile_invalid"] = true
+	}
+	if reqState.IsTombstone {
+		result["tombstone"] = true
+	}
+	if reqState.IsStale {
+		result["stale"] = true
+	}
+	if reqState.IsDegraded {
+		result["degraded"] = true
+	}
+	if reqState.IsOverMaxZoom {
+		result["over_max_zoom"] = true
+	}
+	if reqState.IsUnknownFormat {
+		result["unknown_format"] = true
+	}
+	if reqState.IsDeadlineExceeded {
+		result["deadline_exceeded"] = true
+	}
+	if reqState.IsDuplicateEntry {
+		result["duplicate_entry"] = true
+	}
+	if reqState.IsHashMismatch {
+		result["hash_mismatch"] = true
+	}
+	if reqState.Malformed != "" {
+		result["malformed"] = reqState.Malformed
+	}
+	if reqState.FormatFallback != "" {
+		result["format_fallback"] = reqState.FormatFallback
+	}
+	if reqState.IsTranscoded {
+		result["transcoded"] = true
+	}
+
+	timing := map[string]int64{
+		"parse":                 DurationIn(reqState.Duration.Parse, reqState.TimingUnit),
+		"vector_cache_lookup":   DurationIn(reqState.Duration.VectorCacheLookup, reqState.TimingUnit),
+		"metatile_cache_lookup": DurationIn(reqState.Duration.MetatileCacheLookup, reqState.TimingUnit),
+		"cache_set":             DurationIn(reqState.Duration.CacheSet, reqState.TimingUnit),
+		"storage_fetch":         DurationIn(reqState.Duration.StorageFetch, reqState.TimingUnit),
+		"storage_read":          DurationIn(reqState.Duration.StorageRead, reqState.TimingUnit),
+		"metatile_find":         DurationIn(reqState.Duration.MetatileFind, reqState.TimingUnit),
+		"resp_write":            DurationIn(reqState.Duration.RespWrite, reqState.TimingUnit),
+		"total":                 DurationIn(reqState.Duration.Total, reqState.TimingUnit),
+	}
+	if compression := reqState.Compression; compression != nil {
+		timing["compress"] = DurationIn(compression.Duration, reqState.TimingUnit)
+	}
+	if reqState.IsTranscoded {
+		timing["transcode"] = DurationIn(reqState.Duration.Transcode, reqState.TimingUnit)
+	}
+	if reqState.Duration.Queue > 0 {
+		timing["queue"] = DurationIn(reqState.Duration.Queue, reqState.TimingUnit)
+	}
+	result["timing"] = timing
+	if reqState.TimingUnit == TimingUnit_Microseconds {
+		result["timing_unit"] = reqState.TimingUnit
 	}
 
 	httpJsonData := make(map[string]interface{})
@@ -231,6 +375,9 @@ func (reqState *RequestState) AsJsonMap() map[string]interface{} {
 	if apiKey := reqState.HttpData.ApiKey; apiKey != "" {
 		httpJsonData["api_key"] = apiKey
 	}
+	if headers := reqState.HttpData.Headers; len(headers) > 0 {
+		httpJsonData["headers"] = headers
+	}
 	if format := reqState.Format; format != "" {
 		httpJsonData["format"] = format
 	}
@@ -246,12 +393,21 @@ func (reqState *RequestState) AsJsonMap() map[string]interface{} {
 	if responseSize := reqState.ResponseSize; responseSize > 0 {
 		httpJsonData["response_size"] = responseSize
 	}
+	if compression := reqState.Compression; compression != nil {
+		httpJsonData["compressed_size"] = compression.Size
+	}
+	if build := reqState.Build; build != "" {
+		result["build"] = build
+	}
 	httpJsonData["status"] = reqState.ResponseState.AsStatusCode()
 	result["http"] = httpJsonData
 
 	cacheJsonData := make(map[string]interface{})
 	cacheJsonData["vector_hit"] = reqState.Cache.VectorCacheHit
 	cacheJsonData["metatile_hit"] = reqState.Cache.MetatileCacheHit
+	if reqState.Cache.CompressedCacheHit {
+		cacheJsonData["compressed_hit"] = true
+	}
 	result["cache"] = cacheJsonData
 
 	return result
@@ -271,6 +427,11 @@ type TileJsonRequestState struct {
 	IsCondError          bool
 	IsResponseWriteError bool
 	HttpData             HttpRequestData
+	// Build is the build ID requested, empty for the default build
+	Build string
+	// TimingUnit is one of the TimingUnit_ constants, the unit of the
+	// logged timings, default milliseconds
+	TimingUnit string
 }
 
 func (tileJsonReqState *TileJsonRequestState) AsJsonMap() map[string]interface{} {
@@ -303,10 +464,13 @@ func (tileJsonReqState *TileJsonRequestState) AsJsonMap() map[string]interface{}
 	}
 
 	result["timing"] = map[string]int64{
-		"parse":                   tileJsonReqState.Duration.Parse.Milliseconds(),
-		"storage_fetch":           tileJsonReqState.Duration.StorageFetch.Milliseconds(),
-		"storage_read_resp_write": tileJsonReqState.Duration.StorageReadRespWrite.Milliseconds(),
-		"total":                   tileJsonReqState.Duration.Total.Milliseconds(),
+		"parse":                   DurationIn(tileJsonReqState.Duration.Parse, tileJsonReqState.TimingUnit),
+		"storage_fetch":           DurationIn(tileJsonReqState.Duration.StorageFetch, tileJsonReqState.TimingUnit),
+		"storage_read_resp_write": DurationIn(tileJsonReqState.Duration.StorageReadRespWrite, tileJsonReqState.TimingUnit),
+		"total":                   DurationIn(tileJsonReqState.Duration.Total, tileJsonReqState.TimingUnit),
+	}
+	if tileJsonReqState.TimingUnit == TimingUnit_Microseconds {
+		result["timing_unit"] = tileJsonReqState.TimingUnit
 	}
 
 	httpJsonData := make(map[string]interface{})
@@ -320,14 +484,44 @@ func (tileJsonReqState *TileJsonRequestState) AsJsonMap() map[string]interface{}
 	if apiKey := tileJsonReqState.HttpData.ApiKey; apiKey != "" {
 		httpJsonData["api_key"] = apiKey
 	}
+	if headers := tileJsonReqState.HttpData.Headers; len(headers) > 0 {
+		httpJsonData["headers"] = headers
+	}
 	if format := tileJsonReqState.Format; format != nil {
 		httpJsonData["format"] = format.Name()
 	}
 	result["http"] = httpJsonData
 
+	if build := tileJsonReqState.Build; build != "" {
+		result["build"] = build
+	}
+
 	return result
 }
 
+// ReplicaFetchState records the outcome of a fetch from one replica of a
+// replicated storage.
+type ReplicaFetchState struct {
+	Name       string
+	FetchState ReqFetchState
+	Duration   time.Duration
+	// IsSlow is set when the fetch took the replica's average latency over
+	// the threshold, excluding it from the next fetches
+	IsSlow bool
+}
+
+// StorageFetchState records the outcome of a metatile fetch from one of the
+// configured storages, including those nested in replicated and fallback
+// storages.
+type StorageFetchState struct {
+	Name       string
+	FetchState ReqFetchState
+	Duration   time.Duration
+	// Size is the bytes fetched, 0 for ranged reads which fetch as they're
+	// read
+	Size int64
+}
+
 type ReqFetchSize struct {
 	BodySize    int64
 	BytesLength int64
@@ -339,6 +533,28 @@ type ReqStorageMetadata struct {
 	HasEtag         bool
 }
 
+const (
+	// TimingUnit_Milliseconds logs timings in whole milliseconds.
+	TimingUnit_Milliseconds = "ms"
+	// TimingUnit_Microseconds logs timings in whole microseconds, so that
+	// phases taking under a millisecond aren't all 0.
+	TimingUnit_Microseconds = "us"
+)
+
+// IsValidTimingUnit returns true when unit is one of the TimingUnit_ constants.
+func IsValidTimingUnit(unit string) bool {
+	return unit == TimingUnit_Milliseconds || unit == TimingUnit_Microseconds
+}
+
+// DurationIn returns d as a whole number of the unit, one of the
+// TimingUnit_ constants, default milliseconds.
+func DurationIn(d time.Duration, unit string) int64 {
+	if unit == TimingUnit_Microseconds {
+		return d.Microseconds()
+	}
+	return d.Milliseconds()
+}
+
 type ReqDuration struct {
 	Parse               time.Duration
 	StorageFetch        time.Duration
@@ -349,6 +565,11 @@ type ReqDuration struct {
 	RespWrite           time.Duration
 	Total               time.Duration
 	CacheSet            time.Duration
+	// Transcode is set when a fallback entry was transcoded
+	Transcode time.Duration
+	// Queue is set when the request waited for the load shedder, before
+	// the Total time spent handling it
+	Queue time.Duration
 }
 
 // durations will be logged in milliseconds
@@ -362,26 +583,22 @@ type JsonReqDuration struct {
 	Total        int64
 }
 
-type TileJsonFormat int
+// TileJsonFormat is the name of a tilejson document in storage, without its
+// .json extension. Besides the builtin formats, more can be configured.
+type TileJsonFormat string
 
 const (
-	TileJsonFormat_Mvt = iota
-	TileJsonFormat_Json
-	TileJsonFormat_Topojson
+	TileJsonFormat_Mvt      TileJsonFormat = "mapbox"
+	TileJsonFormat_Json     TileJsonFormat = "geojson"
+	TileJsonFormat_Topojson TileJsonFormat = "topojson"
 )
 
-func (f *TileJsonFormat) Name() string {
-	switch *f {
-	case TileJsonFormat_Mvt:
-		return "mapbox"
-	case TileJsonFormat_Json:
-		return "geojson"
-	case TileJsonFormat_Topojson:
-		return "topojson"
-	}
-	panic(fmt.Sprintf("Unknown tilejson format: %d", int(*f)))
+func (f TileJsonFormat) Name() string {
+	return string(f)
 }
 
+// NewTileJsonFormat returns the builtin format with the name, or nil if
+// there isn't one.
 func NewTileJsonFormat(name string) *TileJsonFormat {
 	var format TileJsonFormat
 	switch name {
@@ -396,3 +613,98 @@ func NewTileJsonFormat(name string) *TileJsonFormat {
 	}
 	return &format
 }
+
+// IsValidTileJsonFormat returns true when name can be used as a tilejson
+// document's name in storage, without escaping the tilejson directory.
+func IsValidTileJsonFormat(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// DrainState is a snapshot of the work outstanding during graceful shutdown.
+type DrainState struct {
+	// Elapsed is the time since shutdown started
+	Elapsed          time.Duration
+	InFlight         int64
+	ShedQueue        int
+	MetricsQueue     int
+	PendingCacheSets int64
+	// Done is set on the final snapshot, once the server has shut down
+	Done bool
+}
+
+func (drainState *DrainState) AsJsonMap() map[string]interface{} {
+	return map[string]interface{}{
+		"elapsed":            drainState.Elapsed.Milliseconds(),
+		"in_flight":          drainState.InFlight,
+		"shed_queue":         drainState.ShedQueue,
+		"metrics_queue":      drainState.MetricsQueue,
+		"pending_cache_sets": drainState.PendingCacheSets,
+		"cache_sets_flushed": drainState.PendingCacheSets == 0,
+		"done":               drainState.Done,
+	}
+}
+
+// WatchdogState records a background worker which stopped making progress.
+type WatchdogState struct {
+	// Worker is the kind of worker, "metrics" or "cache-set"
+	Worker string
+	// Stalled is how long the worker had gone without progress
+	Stalled time.Duration
+	// Pending is the work the worker had outstanding
+	Pending int64
+	// Restarted is set when the worker was replaced
+	Restarted bool
+}
+
+func (watchdogState *WatchdogState) AsJsonMap() map[string]interface{} {
+	return map[string]interface{}{
+		"worker":    watchdogState.Worker,
+		"stalled":   watchdogState.Stalled.Milliseconds(),
+		"pending":   watchdogState.Pending,
+		"restarted": watchdogState.Restarted,
+	}
+}
+
+// MirrorState compares a request's response with that of its replay to a
+// shadow deployment.
+type MirrorState struct {
+	// Path is the path and query of the request
+	Path string
+	// Status, Size and Duration are those of the live response
+	Status   int
+	Size     int64
+	Duration time.Duration
+	// ShadowStatus, ShadowSize and ShadowDuration are those of the shadow
+	// deployment's response
+	ShadowStatus   int
+	ShadowSize     int64
+	ShadowDuration time.Duration
+	// ShadowError is set when the replay failed, eg. timing out
+	ShadowError string
+	// IsDropped is set when the request wasn't replayed because too many
+	// replays were already in flight
+	IsDropped bool
+}
+
+// IsMismatch returns true when the shadow deployment responded differently.
+func (mirrorState *MirrorState) IsMismatch() bool {
+	return mirrorState.ShadowError != "" ||
+		mirrorState.Status != mirrorState.ShadowStatus ||
+		mirrorState.Size != mirrorState.ShadowSize
+}
+
+func (mirrorState *MirrorState) AsJsonMap() map[string]interface{} {
+	result := map[string]interface{}{
+		"path":            mirrorState.Path,
+		"status":          mirrorState.Status,
+		"size":            mirrorState.Size,
+		"duration":        mirrorState.Duration.Milliseconds(),
+		"shadow_status":   mirrorState.ShadowStatus,
+		"shadow_size":     mirrorState.ShadowSize,
+		"shadow_duration": mirrorState.ShadowDuration.Milliseconds(),
+	}
+	if mirrorState.ShadowError != "" {
+		result["shadow_error"] = mirrorState.ShadowError
+	}
+	return result
+}
@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// BundleIndexSuffix is added to the name of a bundle to name its index.
+const BundleIndexSuffix = ".index"
+
+// The builds other than the default whose indexes are kept
+const maxBundleBuilds = 8
+
+// The builds without bundles which are remembered as missing
+const maxBundleMissing = 1024
+
+// DefaultBundleIndexTTL is how long the indexes of a build are used before
+// they're reloaded, unless configured otherwise.
+const DefaultBundleIndexTTL = time.Minute
+
+// BundleOptions holds the settings of a BundleStorage.
+type BundleOptions struct {
+	// Pattern is the name of the bundle holding the metatiles of a zoom,
+	// relative to the build's prefix, with a {z} variable, eg.
+	// "bundles/{z}.zip".
+	Pattern string
+	// MaxZoom is the highest zoom of the metatiles bundled.
+	MaxZoom int
+	// IndexTTL is how long the indexes of a build are used before they're
+	// reloaded, to pick up bundles which have been rewritten.
+	IndexTTL time.Duration
+}
+
+// bundleSpan is where a metatile is stored within its bundle.
+type bundleSpan struct {
+	offset int64
+	length int64
+}
+
+// bundleIndex locates the metatiles of a build within its bundles.
+type bundleIndex struct {
+	// spans of the metatiles by zoom, then x and y
+	spans []map[[2]int]bundleSpan
+	// validators of the index of each zoom, which change whenever the
+	// bundle is rewritten
+	lastModified []*time.Time
+	etags        []*string
+	// found is whether any zoom has a bundle
+	found    bool
+	loadedAt time.Time
+}
+
+// bundleLoad is the loading of the indexes of a build, which concurrent
+// requests for the build wait for rather than loading them again.
+type bundleLoad struct {
+	done  chan struct{}
+	index *bundleIndex
+	err   error
+}
+
+// BundleStorage fetches metatiles from bundles holding every metatile of a
+// zoom, eg. one zip per zoom, rather than from an object per metatile,
+// which makes for far fewer objects in planet-scale builds. The metatiles
+// are stored uncompressed within the bundle, and are located by an index
+// alongside it, with the BundleIndexSuffix, with a line for each:
+//
+//	z/x/y offset length
+//
+// They are read from the bundle with ranged reads. The indexes of the
+// default build are loaded when the storage is made, and those of other
+// builds when they're first requested. They're reloaded after the IndexTTL,
+// so a bundle rewritten in place may be read with its old offsets until
+// then; writing new bundles under a new build avoids that. Builds found to
+// have no bundles are remembered as missing for the IndexTTL too, so that
+// requests for made up builds don't each read every zoom's index.
+type BundleStorage struct {
+	storage Storage
+	// the storage as a MetadataReader and RangeReader
+	reader      MetadataReader
+	rangeReader RangeReader
+	options     BundleOptions
+
+	mu      sync.Mutex
+	indexes map[string]*bundleIndex
+	// the empty indexes of builds without bundles, kept apart so that
+	// they can't push out the indexes of builds which exist
+	missing map[string]*bundleIndex
+	loads   map[string]*bundleLoad
+}
+
+var _ MetadataReader = &BundleStorage{}
+
+// NewBundleStorage loads the indexes of the default build from storage,
+// which must be able to read metadata and ranges.
+func NewBundleStorage(storage Storage, options BundleOptions) (*BundleStorage, error) {
+	reader, ok := storage.(MetadataReader)
+	if !ok {
+		return nil, fmt.Errorf("storage can't read bundle indexes")
+	}
+	rangeReader, ok := storage.(RangeReader)
+	if !ok {
+		return nil, fmt.Errorf("storage can't read ranges of bundles")
+	}
+	if !strings.Contains(options.Pattern, "{z}") {
+		return nil, fmt.Errorf("bundle pattern %#v has no {z} variable", options.Pattern)
+	}
+	if options.IndexTTL <= 0 {
+		options.IndexTTL = DefaultBundleIndexTTL
+	}
+
+	bs := &BundleStorage{
+		storage:     storage,
+		reader:      reader,
+		rangeReader: rangeReader,
+		options:     options,
+		indexes:     make(map[string]*bundleIndex),
+		missing:     make(map[string]*bundleIndex),
+		loads:       make(map[string]*bundleLoad),
+	}
+	if _, err := bs.index(""); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+// bundleName returns the name of the bundle holding the metatiles of zoom z.
+func (bs *BundleStorage) bundleName(z int) string {
+	return strings.Replace(bs.options.Pattern, "{z}", strconv.Itoa(z), -1)
+}
+
+// index returns the index of the build with the prefix, loading it if it
+// isn't already, or reloading it once it's older than the IndexTTL. While
+// it's reloaded, other requests use the old index. The lock isn't held while
+// loading, so requests for one build don't wait on the loading of another.
+func (bs *BundleStorage) index(prefix string) (*bundleIndex, error) {
+	bs.mu.Lock()
+	cached, ok := bs.indexes[prefix]
+	if ok && time.Since(cached.loadedAt) < bs.options.IndexTTL {
+		bs.mu.Unlock()
+		return cached, nil
+	}
+	if missing, ok := bs.missing[prefix]; ok && time.Since(missing.loadedAt) < bs.options.IndexTTL {
+		bs.mu.Unlock()
+		return missing, nil
+	}
+	if load, loading := bs.loads[prefix]; loading {
+		bs.mu.Unlock()
+		if ok {
+			return cached, nil
+		}
+		<-load.done
+		return load.index, load.err
+	}
+	load := &bundleLoad{done: make(chan struct{})}
+	bs.loads[prefix] = load
+	bs.mu.Unlock()
+
+	load.index, load.err = bs.load(prefix, cached)
+
+	bs.mu.Lock()
+	delete(bs.loads, prefix)
+	// builds without bundles are kept apart, so requests for made up
+	// builds can't push out those which exist
+	if load.err == nil && (load.index.found || prefix == "") {
+		if _, ok := bs.indexes[prefix]; !ok && prefix != "" {
+			bs.evictLocked()
+		}
+		bs.indexes[prefix] = load.index
+		delete(bs.missing, prefix)
+	} else if load.err == nil {
+		bs.addMissingLocked(prefix, load.index)
+	}
+	bs.mu.Unlock()
+	close(load.done)
+
+	// serving with the previous index is better than failing
+	if load.err != nil && cached != nil {
+		return cached, nil
+	}
+	return load.index, load.err
+}
+
+// evictLocked removes the index of a build other than the default when
+// there are as many as are kept.
+func (bs *BundleStorage) evictLocked() {
+	builds := len(bs.indexes)
+	if _, ok := bs.indexes[""]; ok {
+		builds--
+	}
+	if builds < maxBundleBuilds {
+		return
+	}
+	for other := range bs.indexes {
+		if other != "" {
+			delete(bs.indexes, other)
+			return
+		}
+	}
+}
+
+// addMissingLocked remembers the build as missing, removing those which
+// have expired, or any other, when as many as are kept are missing.
+func (bs *BundleStorage) addMissingLocked(prefix string, index *bundleIndex) {
+	if _, ok := bs.missing[prefix]; !ok && len(bs.missing) >= maxBundleMissing {
+		for other, missing := range bs.missing {
+			if time.Since(missing.loadedAt) >= bs.options.IndexTTL {
+				delete(bs.missing, other)
+			}
+		}
+		for other := range bs.missing {
+			if len(bs.missing) < maxBundleMissing {
+				break
+			}
+			delete(bs.missing, other)
+		}
+	}
+	bs.missing[prefix] = index
+}
+
+// load reads the indexes of the build with the prefix. The spans of the
+// previous index of a zoom are reused if its index hasn't changed.
+func (bs *BundleStorage) load(prefix string, previous *bundleIndex) (*bundleIndex, error) {
+	index := &bundleIndex{
+		spans:        make([]map[[2]int]bundleSpan, bs.options.MaxZoom+1),
+		lastModified: make([]*time.Time, bs.options.MaxZoom+1),
+		etags:        make([]*string, bs.options.MaxZoom+1),
+	}
+	for z := 0; z <= bs.options.MaxZoom; z++ {
+		name := bs.bundleName(z) + BundleIndexSuffix
+		resp, err := bs.reader.ReadMetadata(name, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("reading bundle index %s: %w", name, err)
+		}
+		// zooms without a bundle have no metatiles
+		if resp.Response == nil {
+			continue
+		}
+		index.found = true
+		etag := resp.Response.ETag
+		if previous != nil && etag != nil && previous.etags[z] != nil && *previous.etags[z] == *etag {
+			index.spans[z] = previous.spans[z]
+		} else {
+			index.spans[z], err = parseBundleIndex(z, resp.Response.Body)
+			if err != nil {
+				return nil, fmt.Errorf("reading bundle index %s: %w", name, err)
+			}
+		}
+		index.lastModified[z] = resp.Response.LastModified
+		index.etags[z] = etag
+	}
+	index.loadedAt = time.Now()
+	return index, nil
+}
+
+// parseBundleIndex parses the lines of the index of the bundle of zoom z.
+func parseBundleIndex(z int, data []byte) (map[[2]int]bundleSpan, error) {
+	spans := make(map[[2]int]bundleSpan)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected z/x/y offset length", line)
+		}
+		var coord [3]int
+		parts := strings.Split(fields[0], "/")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("line %d: invalid coordinate %#v", line, fields[0])
+		}
+		for i, part := range parts {
+			var err error
+			if coord[i], err = strconv.Atoi(part); err != nil {
+				return nil, fmt.Errorf("line %d: invalid coordinate %#v", line, fields[0])
+			}
+		}
+		if coord[0] != z {
+			return nil, fmt.Errorf("line %d: metatile %s isn't at zoom %d", line, fields[0], z)
+		}
+		offset, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("line %d: invalid offset %#v", line, fields[1])
+		}
+		length, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("line %d: invalid length %#v", line, fields[2])
+		}
+		spans[[2]int{coord[1], coord[2]}] = bundleSpan{offset: offset, length: length}
+	}
+	return spans, scanner.Err()
+}
+
+// Fetch reads the metatile from its zoom's bundle. Its validators are those
+// of the bundle's index, with its offset, so that they change when it's
+// rewritten.
+func (bs *BundleStorage) Fetch(t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	index, err := bs.index(prefixOverride)
+	if err != nil {
+		return nil, err
+	}
+	if t.Z < 0 || t.Z >= len(index.spans) || index.spans[t.Z] == nil {
+		return &StorageResponse{NotFound: true}, nil
+	}
+	span, ok := index.spans[t.Z][[2]int{t.X, t.Y}]
+	if !ok {
+		return &StorageResponse{NotFound: true}, nil
+	}
+
+	var etag *string
+	if indexETag := index.etags[t.Z]; indexETag != nil {
+		e := fmt.Sprintf("\"%s-%x\"", strings.Trim(stripWeak(*indexETag), "\""), span.offset)
+		etag = &e
+	}
+	lastModified := index.lastModified[t.Z]
+	if isNotModified(c, lastModified, etag) {
+		return &StorageResponse{NotModified: true}, nil
+	}
+
+	body := []byte{}
+	if span.length > 0 {
+		body, err = bs.rangeReader.ReadRange(bs.bundleName(t.Z), prefixOverride, span.offset, span.length)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s from bundle %s: %w", t.FileName(), bs.bundleName(t.Z), err)
+		}
+	}
+	return &StorageResponse{
+		Response: &SuccessfulResponse{
+			Body:         body,
+			LastModified: lastModified,
+			ETag:         etag,
+			Size:         uint64(len(body)),
+		},
+	}, nil
+}
+
+func (bs *BundleStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*StorageResponse, error) {
+	return bs.storage.TileJson(f, c, prefixOverride)
+}
+
+func (bs *BundleStorage) ReadMetadata(name, prefixOverride string) (*StorageResponse, error) {
+	return bs.reader.ReadMetadata(name, prefixOverride)
+}
+
+func (bs *BundleStorage) HealthCheck() error {
+	return bs.storage.HealthCheck()
+}
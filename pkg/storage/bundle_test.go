@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+func TestBundleStorage(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	writeFile := func(name, content string) {
+		p := filepath.Join(baseDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Unable to create dir: %s", err.Error())
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write file: %s", err.Error())
+		}
+	}
+	writeFile("bundles/0.zip", "zero")
+	writeFile("bundles/0.zip.index", "0/0/0 0 4\n")
+	writeFile("bundles/1.zip", "onetwo")
+	writeFile("bundles/1.zip.index", "1/0/0 0 3\n1/1/0 3 3\n")
+	// zoom 2 has no bundle
+	writeFile("20210331/bundles/0.zip", "build zero")
+	writeFile("20210331/bundles/0.zip.index", "0/0/0 6 4\n")
+
+	memoryStorage, err := NewMemoryStorage(baseDir, "", "", 0)
+	if err != nil {
+		t.Fatalf("Unable to load memory storage: %s", err.Error())
+	}
+	stg, err := NewBundleStorage(memoryStorage, BundleOptions{Pattern: "bundles/{z}.zip", MaxZoom: 2})
+	if err != nil {
+		t.Fatalf("Unable to create bundle storage: %s", err.Error())
+	}
+
+	fetch := func(z, x, y int, c state.Condition, prefix string) *StorageResponse {
+		resp, err := stg.Fetch(tile.TileCoord{Z: z, X: x, Y: y, Format: "zip"}, c, prefix, nil)
+		if err != nil {
+			t.Fatalf("Unable to fetch %d/%d/%d: %s", z, x, y, err.Error())
+		}
+		return resp
+	}
+	for _, tc := range []struct {
+		z, x, y int
+		body    string
+	}{
+		{0, 0, 0, "zero"},
+		{1, 0, 0, "one"},
+		{1, 1, 0, "two"},
+	} {
+		resp := fetch(tc.z, tc.x, tc.y, state.Condition{}, "")
+		if resp.Response == nil || string(resp.Response.Body) != tc.body {
+			t.Errorf("Expected %d/%d/%d to be %#v, got %#v", tc.z, tc.x, tc.y, tc.body, resp)
+		}
+	}
+
+	for _, coord := range [][3]int{{1, 0, 1}, {2, 0, 0}, {3, 0, 0}} {
+		if resp := fetch(coord[0], coord[1], coord[2], state.Condition{}, ""); !resp.NotFound {
+			t.Errorf("Expected %v to be not found, got %#v", coord, resp)
+		}
+	}
+
+	one := fetch(1, 0, 0, state.Condition{}, "")
+	two := fetch(1, 1, 0, state.Condition{}, "")
+	if one.Response.ETag == nil || two.Response.ETag == nil || *one.Response.ETag == *two.Response.ETag {
+		t.Fatalf("Expected metatiles of a bundle to have distinct etags, got %v and %v", one.Response.ETag, two.Response.ETag)
+	}
+	if resp := fetch(1, 0, 0, state.Condition{IfNoneMatch: one.Response.ETag}, ""); !resp.NotModified {
+		t.Errorf("Expected matching If-None-Match to give not modified, got %#v", resp)
+	}
+
+	if resp := fetch(0, 0, 0, state.Condition{}, "20210331"); resp.Response == nil || string(resp.Response.Body) != "zero" {
+		t.Errorf("Expected the build's metatile, got %#v", resp)
+	}
+}
+
+func TestBundleStorageInvalidIndex(t *testing.T) {
+	for _, index := range []string{
+		"0/0/0 0\n",
+		"1/0/0 0 4\n",
+		"0/0 0 4\n",
+		"0/0/0 -1 4\n",
+	} {
+		memoryStorage, err := newMemoryStorageWith(map[string]string{
+			"bundles/0.zip":       "zero",
+			"bundles/0.zip.index": index,
+		})
+		if err != nil {
+			t.Fatalf("Unable to load memory storage: %s", err.Error())
+		}
+		if _, err := NewBundleStorage(memoryStorage, BundleOptions{Pattern: "bundles/{z}.zip"}); err == nil {
+			t.Errorf("Expected index %#v to fail", index)
+		}
+	}
+
+	if _, err := NewBundleStorage(&countingStorage{}, BundleOptions{Pattern: "bundles/{z}.zip"}); err == nil {
+		t.Errorf("Expected a storage which can't read ranges to fail")
+	}
+}
+
+// bundleFiles holds bundles and their indexes by prefix and name, counting
+// the indexes read, which can block until release is closed.
+type bundleFiles struct {
+	countingStorage
+	mu      sync.Mutex
+	files   map[string]string
+	reads   int
+	release chan struct{}
+}
+
+func (bf *bundleFiles) set(path, content string) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	bf.files[path] = content
+}
+
+func (bf *bundleFiles) indexReads() int {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	return bf.reads
+}
+
+func (bf *bundleFiles) ReadMetadata(name, prefixOverride string) (*StorageResponse, error) {
+	if bf.release != nil {
+		<-bf.release
+	}
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	bf.reads++
+	content, ok := bf.files[prefixOverride+"/"+name]
+	if !ok {
+		return &StorageResponse{NotFound: true}, nil
+	}
+	etag := fmt.Sprintf("\"%x\"", content)
+	return &StorageResponse{Response: &SuccessfulResponse{Body: []byte(content), ETag: &etag}}, nil
+}
+
+func (bf *bundleFiles) ReadRange(name, prefixOverride string, offset, length int64) ([]byte, error) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	return []byte(bf.files[prefixOverride+"/"+name][offset : offset+length]), nil
+}
+
+func TestBundleStorageLoading(t *testing.T) {
+	files := &bundleFiles{files: map[string]string{
+		"/0.zip":       "zero",
+		"/0.zip.index": "0/0/0 0 4\n",
+	}}
+	stg, err := NewBundleStorage(files, BundleOptions{Pattern: "{z}.zip", IndexTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("Unable to create bundle storage: %s", err.Error())
+	}
+	fetch := func(prefix string) *StorageResponse {
+		resp, err := stg.Fetch(tile.TileCoord{Format: "zip"}, state.Condition{}, prefix, nil)
+		if err != nil {
+			t.Fatalf("Unable to fetch from %#v: %s", prefix, err.Error())
+		}
+		return resp
+	}
+
+	// builds without bundles are remembered as missing, apart from those
+	// which exist
+	reads := files.indexReads()
+	for i := 0; i < 3; i++ {
+		if resp := fetch("missing"); !resp.NotFound {
+			t.Fatalf("Expected a build without bundles to be not found, got %#v", resp)
+		}
+	}
+	if got := files.indexReads() - reads; got != 1 {
+		t.Fatalf("Expected a build without bundles to be looked for once, got %d reads", got)
+	}
+	if len(stg.indexes) != 1 || len(stg.missing) != 1 {
+		t.Fatalf("Expected only the default build to be kept, got %d and %d missing", len(stg.indexes), len(stg.missing))
+	}
+
+	// no more than maxBundleBuilds others are kept
+	for i := 0; i < maxBundleBuilds+3; i++ {
+		prefix := fmt.Sprintf("build%d", i)
+		files.set(prefix+"/0.zip", "zero")
+		files.set(prefix+"/0.zip.index", "0/0/0 0 4\n")
+		if resp := fetch(prefix); resp.Response == nil {
+			t.Fatalf("Expected the metatile of %s, got %#v", prefix, resp)
+		}
+	}
+	if len(stg.indexes) != maxBundleBuilds+1 {
+		t.Fatalf("Expected %d builds and the default to be kept, got %d", maxBundleBuilds, len(stg.indexes)-1)
+	}
+
+	// concurrent requests for a build load its index once, without holding
+	// up requests for other builds
+	files.release = make(chan struct{})
+	files.set("slow/0.zip", "zero")
+	files.set("slow/0.zip.index", "0/0/0 0 4\n")
+	reads = files.indexReads()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fetch("slow")
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if resp := fetch(""); resp.Response == nil {
+		t.Fatalf("Expected the default build to be served while another loads, got %#v", resp)
+	}
+	close(files.release)
+	wg.Wait()
+	files.release = nil
+	if got := files.indexReads() - reads; got != 1 {
+		t.Fatalf("Expected the build's index to be read once, got %d reads", got)
+	}
+}
+
+func TestBundleStorageReload(t *testing.T) {
+	files := &bundleFiles{files: map[string]string{
+		"/0.zip":       "zero",
+		"/0.zip.index": "0/0/0 0 4\n",
+	}}
+	stg, err := NewBundleStorage(files, BundleOptions{Pattern: "{z}.zip", IndexTTL: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unable to create bundle storage: %s", err.Error())
+	}
+
+	// the bundle is rewritten in place
+	files.set("/0.zip", "new zero")
+	files.set("/0.zip.index", "0/0/0 4 4\n")
+	time.Sleep(5 * time.Millisecond)
+
+	resp, err := stg.Fetch(tile.TileCoord{Format: "zip"}, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "zero" {
+		t.Fatalf("Expected the metatile at its new offset after the index TTL, got %#v, %v", resp, err)
+	}
+
+	// a build missing when first requested is found once it lands
+	if resp, err := stg.Fetch(tile.TileCoord{Format: "zip"}, state.Condition{}, "late", nil); err != nil || !resp.NotFound {
+		t.Fatalf("Expected a missing build to be not found, got %#v, %v", resp, err)
+	}
+	files.set("late/0.zip", "late")
+	files.set("late/0.zip.index", "0/0/0 0 4\n")
+	time.Sleep(5 * time.Millisecond)
+	resp, err = stg.Fetch(tile.TileCoord{Format: "zip"}, state.Condition{}, "late", nil)
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "late" {
+		t.Fatalf("Expected the build's metatile after the index TTL, got %#v, %v", resp, err)
+	}
+}
+
+func newMemoryStorageWith(files map[string]string) (*MemoryStorage, error) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(baseDir)
+	for name, content := range files {
+		p := filepath.Join(baseDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return NewMemoryStorage(baseDir, "", "", 0)
+}
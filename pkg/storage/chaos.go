@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// ErrChaos is the error of fetches failed on purpose by a ChaosStorage.
+var ErrChaos = errors.New("chaos: injected storage error")
+
+// ChaosOptions are the faults injected by a ChaosStorage. Rates are the
+// fraction of fetches affected, from 0 to 1.
+type ChaosOptions struct {
+	// Latency delays LatencyRate of fetches by up to this long.
+	Latency     time.Duration
+	LatencyRate float64
+	// ErrorRate of fetches fail with ErrChaos.
+	ErrorRate float64
+}
+
+// Validate returns an error if a rate isn't between 0 and 1.
+func (o ChaosOptions) Validate() error {
+	if o.LatencyRate < 0 || o.LatencyRate > 1 {
+		return fmt.Errorf("chaos latency rate must be between 0 and 1, but is %g", o.LatencyRate)
+	}
+	if o.ErrorRate < 0 || o.ErrorRate > 1 {
+		return fmt.Errorf("chaos error rate must be between 0 and 1, but is %g", o.ErrorRate)
+	}
+	return nil
+}
+
+// ChaosStorage injects latency and errors into the fetches of another
+// storage, so that the handling of a misbehaving storage can be exercised
+// in staging. Health checks aren't affected.
+type ChaosStorage struct {
+	storage Storage
+	options ChaosOptions
+	// rand returns a number in [0, 1), replaced by tests
+	rand func() float64
+}
+
+var _ ContextFetcher = &ChaosStorage{}
+var _ MetadataReader = &ChaosStorage{}
+var _ KeyResolver = &ChaosStorage{}
+var _ Lister = &ChaosStorage{}
+
+func NewChaosStorage(storage Storage, options ChaosOptions) *ChaosStorage {
+	return &ChaosStorage{
+		storage: storage,
+		options: options,
+		rand:    rand.Float64,
+	}
+}
+
+// inject delays and fails a fetch as configured, returning an error if it
+// should fail or the context is done while it's delayed.
+func (cs *ChaosStorage) inject(ctx context.Context) error {
+	if cs.options.LatencyRate > 0 && cs.rand() < cs.options.LatencyRate {
+		delay := time.Duration(cs.rand() * float64(cs.options.Latency))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	if cs.options.ErrorRate > 0 && cs.rand() < cs.options.ErrorRate {
+		return ErrChaos
+	}
+	return nil
+}
+
+func (cs *ChaosStorage) Fetch(t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return cs.FetchContext(context.Background(), t, c, prefixOverride, keyVars)
+}
+
+func (cs *ChaosStorage) FetchContext(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	if err := cs.inject(ctx); err != nil {
+		return nil, err
+	}
+	return FetchContext(ctx, cs.storage, t, c, prefixOverride, keyVars)
+}
+
+// FetchRanges injects faults into the first request for the metatile, but
+// not the ranged requests which follow.
+func (cs *ChaosStorage) FetchRanges(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	if err := cs.inject(ctx); err != nil {
+		return nil, err
+	}
+	return FetchRanges(ctx, cs.storage, t, c, prefixOverride, keyVars)
+}
+
+func (cs *ChaosStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*StorageResponse, error) {
+	if err := cs.inject(context.Background()); err != nil {
+		return nil, err
+	}
+	return cs.storage.TileJson(f, c, prefixOverride)
+}
+
+func (cs *ChaosStorage) ReadMetadata(name, prefixOverride string) (*StorageResponse, error) {
+	reader, ok := cs.storage.(MetadataReader)
+	if !ok {
+		return nil, fmt.Errorf("storage can't read metadata")
+	}
+	if err := cs.inject(context.Background()); err != nil {
+		return nil, err
+	}
+	return reader.ReadMetadata(name, prefixOverride)
+}
+
+func (cs *ChaosStorage) ResolveKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	resolver, ok := cs.storage.(KeyResolver)
+	if !ok {
+		return "", fmt.Errorf("storage can't resolve keys")
+	}
+	return resolver.ResolveKey(t, prefixOverride, keyVars)
+}
+
+func (cs *ChaosStorage) List(prefix, after string, limit int) (*ListResult, error) {
+	lister, ok := cs.storage.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("storage can't list keys")
+	}
+	return lister.List(prefix, after, limit)
+}
+
+func (cs *ChaosStorage) HealthCheck() error {
+	return cs.storage.HealthCheck()
+}
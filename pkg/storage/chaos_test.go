@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+func TestChaosStorage(t *testing.T) {
+	inner := &countingStorage{}
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+
+	cs := NewChaosStorage(inner, ChaosOptions{ErrorRate: 0.5})
+	cs.rand = func() float64 { return 0.25 }
+	if _, err := cs.Fetch(coord, state.Condition{}, "", nil); !errors.Is(err, ErrChaos) {
+		t.Fatalf("Expected an injected error, got %v", err)
+	}
+	cs.rand = func() float64 { return 0.75 }
+	if _, err := cs.Fetch(coord, state.Condition{}, "", nil); err != nil {
+		t.Fatalf("Expected the fetch to be passed on, got %v", err)
+	}
+	if inner.fetches != 1 {
+		t.Fatalf("Expected only the fetch without an error to reach storage, got %d", inner.fetches)
+	}
+
+	cs = NewChaosStorage(inner, ChaosOptions{Latency: time.Hour, LatencyRate: 1})
+	cs.rand = func() float64 { return 0.5 }
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := cs.FetchContext(ctx, coord, state.Condition{}, "", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the delayed fetch to be abandoned at the deadline, got %v", err)
+	}
+
+	if err := (ChaosOptions{ErrorRate: 2}).Validate(); err == nil {
+		t.Fatalf("Expected a rate over 1 to be invalid")
+	}
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"strings"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+)
+
+// stripWeak removes the weak validator prefix from an entity tag, so that
+// W/"abc" and "abc" compare equal. CDNs often weaken ETags when they
+// transform a response, eg. by compressing it.
+func stripWeak(etag string) string {
+	return strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+}
+
+// etagMatches reports whether an If-None-Match header value matches the
+// given entity tag, using the weak comparison function from RFC 7232.
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = stripWeak(etag)
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || stripWeak(candidate) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// isNotModified evaluates the request condition against the validators of a
+// stored object. If-None-Match takes precedence over If-Modified-Since, as
+// required by RFC 7232.
+func isNotModified(c state.Condition, lastModified *time.Time, etag *string) bool {
+	if c.IfNoneMatch != nil {
+		return etag != nil && etagMatches(*c.IfNoneMatch, *etag)
+	}
+	if c.IfModifiedSince != nil && lastModified != nil {
+		// HTTP dates only have second resolution
+		return !lastModified.Truncate(time.Second).After(*c.IfModifiedSince)
+	}
+	return false
+}
+
+// normalizeCondition strips weak validator prefixes from If-None-Match so
+// that backends which only do strong comparison still match.
+func normalizeCondition(c state.Condition) state.Condition {
+	if c.IfNoneMatch == nil {
+		return c
+	}
+	parts := strings.Split(*c.IfNoneMatch, ",")
+	for i, part := range parts {
+		parts[i] = stripWeak(part)
+	}
+	ifNoneMatch := strings.Join(parts, ", ")
+	c.IfNoneMatch = &ifNoneMatch
+	return c
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/diskstore"
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// DiskCacheOptions are the settings of a DiskCache.
+type DiskCacheOptions struct {
+	// Dir is the directory to keep metatiles in, created if missing.
+	// Metatiles left in it by a previous process are removed, as their
+	// validators aren't known.
+	Dir string
+	// MaxBytes bounds the size of the metatiles kept, evicting the least
+	// recently used ones to stay under it.
+	MaxBytes int64
+	// TTL is how long a metatile is served from disk without asking
+	// storage. After that it's revalidated with its ETag, so that it's
+	// only fetched again if it changed. 0 revalidates on every fetch.
+	TTL time.Duration
+}
+
+// diskCacheMeta is what's kept with a metatile on disk: its validators, and
+// when it was last checked against storage.
+type diskCacheMeta struct {
+	lastModified *time.Time
+	etag         *string
+	checkedAt    time.Time
+}
+
+// DiskCache keeps metatiles fetched from storage in files on local disk,
+// for the DiskCacheStorages of a storage definition.
+type DiskCache struct {
+	options DiskCacheOptions
+	// store holds the metatiles, with a *diskCacheMeta as their Meta
+	store *diskstore.Store
+	// now returns the current time, replaced by tests
+	now func() time.Time
+}
+
+// NewDiskCache clears the options' Dir of metatiles left by a previous
+// process, creating it if needed.
+func NewDiskCache(options DiskCacheOptions) (*DiskCache, error) {
+	store, err := diskstore.New(diskstore.Options{Dir: options.Dir, MaxBytes: options.MaxBytes})
+	if err != nil {
+		return nil, err
+	}
+	return &DiskCache{
+		options: options,
+		store:   store,
+		now:     time.Now,
+	}, nil
+}
+
+// Size returns the bytes of the metatiles kept.
+func (dc *DiskCache) Size() int64 {
+	return dc.store.Size()
+}
+
+// checked marks the entry as revalidated.
+func (dc *DiskCache) checked(entry diskstore.Entry) {
+	meta := *entry.Meta.(*diskCacheMeta)
+	meta.checkedAt = dc.now()
+	dc.store.SetMeta(entry, &meta)
+}
+
+// write keeps the metatile at key.
+func (dc *DiskCache) write(key string, resp *SuccessfulResponse) error {
+	return dc.store.Write(key, resp.Body, &diskCacheMeta{
+		lastModified: resp.LastModified,
+		etag:         resp.ETag,
+		checkedAt:    dc.now(),
+	})
+}
+
+// DiskCacheStorage is a read-through cache of the metatiles of another
+// storage in a DiskCache, eg. on the local NVMe of edge instances, so that
+// hot metatiles aren't transferred from S3 over and over. Metatiles are
+// cached by the key the storage resolves for them. Within the cache's TTL
+// they're served from disk alone, and after it they're revalidated with
+// their ETag. Metatiles are always fetched whole, and the other methods go
+// straight to the storage.
+type DiskCacheStorage struct {
+	storage  Storage
+	resolver KeyResolver
+	cache    *DiskCache
+}
+
+var _ ContextFetcher = &DiskCacheStorage{}
+var _ MetadataReader = &DiskCacheStorage{}
+var _ KeyResolver = &DiskCacheStorage{}
+var _ Lister = &DiskCacheStorage{}
+
+// NewDiskCacheStorage caches the metatiles of storage, which must be able to
+// resolve their keys, in cache.
+func NewDiskCacheStorage(storage Storage, cache *DiskCache) (*DiskCacheStorage, error) {
+	resolver, ok := storage.(KeyResolver)
+	if !ok {
+		return nil, fmt.Errorf("storage can't resolve keys to cache metatiles by")
+	}
+	return &DiskCacheStorage{
+		storage:  storage,
+		resolver: resolver,
+		cache:    cache,
+	}, nil
+}
+
+// cacheKey returns the key the metatile is cached by, which is the key of
+// the storage, with the key variables in case the storage doesn't use them
+// all.
+func (ds *DiskCacheStorage) cacheKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	key, err := ds.resolver.ResolveKey(t, prefixOverride, keyVars)
+	if err != nil {
+		return "", err
+	}
+	if len(keyVars) == 0 {
+		return key, nil
+	}
+	names := make([]string, 0, len(keyVars))
+	for name := range keyVars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	sb.WriteString(key)
+	for _, name := range names {
+		fmt.Fprintf(&sb, "\x00%s=%s", name, keyVars[name])
+	}
+	return sb.String(), nil
+}
+
+func (ds *DiskCacheStorage) Fetch(t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return ds.FetchContext(context.Background(), t, c, prefixOverride, keyVars)
+}
+
+// FetchContext serves the metatile from disk, fetching it from the storage
+// when it isn't cached and revalidating it when its TTL is up.
+func (ds *DiskCacheStorage) FetchContext(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	key, err := ds.cacheKey(t, prefixOverride, keyVars)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, cached := ds.cache.store.Lookup(key)
+	if cached && ds.cache.now().Sub(entry.Meta.(*diskCacheMeta).checkedAt) < ds.cache.options.TTL {
+		if resp, ok := ds.respondWithEntry(entry, c); ok {
+			return resp, nil
+		}
+		cached = false
+	}
+
+	// a cached metatile is revalidated, otherwise the request's condition
+	// saves fetching a metatile the client already has
+	cond := c
+	if cached && entry.Meta.(*diskCacheMeta).etag != nil {
+		cond = state.Condition{IfNoneMatch: entry.Meta.(*diskCacheMeta).etag}
+	}
+	resp, err := FetchContext(ctx, ds.storage, t, cond, prefixOverride, keyVars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.NotModified && cached && entry.Meta.(*diskCacheMeta).etag != nil:
+		ds.cache.checked(entry)
+		if cached, ok := ds.respondWithEntry(entry, c); ok {
+			return cached, nil
+		}
+		// the file was lost, so it's fetched again in full
+		return FetchContext(ctx, ds.storage, t, c, prefixOverride, keyVars)
+	case resp.Response != nil:
+		// failing to keep the metatile on disk doesn't fail the fetch
+		_ = ds.cache.write(key, resp.Response)
+		if isNotModified(c, resp.Response.LastModified, resp.Response.ETag) {
+			return &StorageResponse{NotModified: true, Retries: resp.Retries}, nil
+		}
+	case resp.NotFound:
+		ds.cache.store.Drop(key)
+	}
+	return resp, nil
+}
+
+// respondWithEntry responds with the cached metatile, or false if its file
+// can't be read.
+func (ds *DiskCacheStorage) respondWithEntry(entry diskstore.Entry, c state.Condition) (*StorageResponse, bool) {
+	meta := entry.Meta.(*diskCacheMeta)
+	if isNotModified(c, meta.lastModified, meta.etag) {
+		return &StorageResponse{NotModified: true}, true
+	}
+	body, release, ok := ds.cache.store.Read(entry)
+	if !ok {
+		return nil, false
+	}
+	release()
+	return &StorageResponse{
+		Response: &SuccessfulResponse{
+			Body:         body,
+			LastModified: meta.lastModified,
+			ETag:         meta.etag,
+			Size:         uint64(len(body)),
+		},
+	}, true
+}
+
+func (ds *DiskCacheStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*StorageResponse, error) {
+	return ds.storage.TileJson(f, c, prefixOverride)
+}
+
+func (ds *DiskCacheStorage) ReadMetadata(name, prefixOverride string) (*StorageResponse, error) {
+	reader, ok := ds.storage.(MetadataReader)
+	if !ok {
+		return nil, fmt.Errorf("storage can't read metadata")
+	}
+	return reader.ReadMetadata(name, prefixOverride)
+}
+
+func (ds *DiskCacheStorage) ResolveKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	return ds.resolver.ResolveKey(t, prefixOverride, keyVars)
+}
+
+func (ds *DiskCacheStorage) List(prefix, after string, limit int) (*ListResult, error) {
+	lister, ok := ds.storage.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("storage can't list keys")
+	}
+	return lister.List(prefix, after, limit)
+}
+
+func (ds *DiskCacheStorage) HealthCheck() error {
+	return ds.storage.HealthCheck()
+}
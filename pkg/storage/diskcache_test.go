@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// versionedStorage serves metatiles with a body and ETag by file name,
+// responding not modified to a matching If-None-Match, and counting the
+// bodies it sends.
+type versionedStorage struct {
+	countingStorage
+	bodies map[string]string
+	etags  map[string]string
+	sent   int
+}
+
+func (v *versionedStorage) Fetch(t tile.TileCoord, cond state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	v.fetches++
+	body, ok := v.bodies[t.FileName()]
+	if !ok {
+		return &StorageResponse{NotFound: true}, nil
+	}
+	etag := v.etags[t.FileName()]
+	if cond.IfNoneMatch != nil && *cond.IfNoneMatch == etag {
+		return &StorageResponse{NotModified: true}, nil
+	}
+	v.sent++
+	return &StorageResponse{Response: &SuccessfulResponse{Body: []byte(body), ETag: &etag}}, nil
+}
+
+func (v *versionedStorage) ResolveKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	return prefixOverride + "/" + t.FileName(), nil
+}
+
+func TestDiskCacheStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	dc, err := NewDiskCache(DiskCacheOptions{Dir: dir, MaxBytes: 10, TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("Unable to create disk cache: %s", err.Error())
+	}
+	now := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	dc.now = func() time.Time { return now }
+
+	stg := &versionedStorage{
+		bodies: map[string]string{"0/0/0.zip": "zero", "1/0/0.zip": "one!", "1/1/0.zip": "two!"},
+		etags:  map[string]string{"0/0/0.zip": `"a"`, "1/0/0.zip": `"b"`, "1/1/0.zip": `"c"`},
+	}
+	ds, err := NewDiskCacheStorage(stg, dc)
+	if err != nil {
+		t.Fatalf("Unable to create disk cache storage: %s", err.Error())
+	}
+
+	fetch := func(z, x, y int, c state.Condition) *StorageResponse {
+		resp, err := ds.Fetch(tile.TileCoord{Z: z, X: x, Y: y, Format: "zip"}, c, "", nil)
+		if err != nil {
+			t.Fatalf("Unable to fetch %d/%d/%d: %s", z, x, y, err.Error())
+		}
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp := fetch(0, 0, 0, state.Condition{}); resp.Response == nil || string(resp.Response.Body) != "zero" {
+			t.Fatalf("Expected the metatile, got %#v", resp)
+		}
+	}
+	if stg.fetches != 1 {
+		t.Fatalf("Expected the metatile to be fetched once within the TTL, but was fetched %d times", stg.fetches)
+	}
+	etag := `"a"`
+	if resp := fetch(0, 0, 0, state.Condition{IfNoneMatch: &etag}); !resp.NotModified {
+		t.Fatalf("Expected not modified from disk, got %#v", resp)
+	}
+
+	// after the TTL it's revalidated, but not sent again
+	now = now.Add(2 * time.Minute)
+	if resp := fetch(0, 0, 0, state.Condition{}); resp.Response == nil || string(resp.Response.Body) != "zero" {
+		t.Fatalf("Expected the revalidated metatile, got %#v", resp)
+	}
+	if stg.fetches != 2 || stg.sent != 1 {
+		t.Fatalf("Expected a revalidation without the body, got %d fetches and %d bodies", stg.fetches, stg.sent)
+	}
+
+	// and fetched again once it's changed
+	now = now.Add(2 * time.Minute)
+	stg.bodies["0/0/0.zip"], stg.etags["0/0/0.zip"] = "ZERO", `"a2"`
+	if resp := fetch(0, 0, 0, state.Condition{}); resp.Response == nil || string(resp.Response.Body) != "ZERO" {
+		t.Fatalf("Expected the changed metatile, got %#v", resp)
+	}
+
+	// the least recently used metatile is evicted to stay under MaxBytes
+	fetch(1, 0, 0, state.Condition{})
+	fetch(1, 1, 0, state.Condition{})
+	if dc.Size() != 8 {
+		t.Fatalf("Expected two metatiles to be kept, got %d bytes", dc.Size())
+	}
+	fetches := stg.fetches
+	fetch(0, 0, 0, state.Condition{})
+	if stg.fetches != fetches+1 {
+		t.Fatalf("Expected the evicted metatile to be fetched again")
+	}
+
+	if resp := fetch(2, 0, 0, state.Condition{}); !resp.NotFound {
+		t.Fatalf("Expected a missing metatile to be not found, got %#v", resp)
+	}
+
+	if _, err := NewDiskCacheStorage(&countingStorage{}, dc); err == nil {
+		t.Fatalf("Expected a storage which can't resolve keys to fail")
+	}
+}
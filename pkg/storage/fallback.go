@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// FallbackBackend is one of the storages of a FallbackStorage.
+type FallbackBackend struct {
+	Name    string
+	Storage Storage
+}
+
+// FallbackStorage tries its storages in order, returning the first response
+// which isn't not found, eg. from a partial local mirror on an edge node and
+// then from S3. Storages which fail are skipped too, but their errors are
+// returned if no later storage has the object. Responses name the storage
+// which served them in their Source.
+type FallbackStorage struct {
+	backends []*FallbackBackend
+}
+
+func NewFallbackStorage(backends []*FallbackBackend) *FallbackStorage {
+	return &FallbackStorage{backends: backends}
+}
+
+// try fetches from each storage in turn until one has the object. Once ctx
+// is done it stops.
+func (fs *FallbackStorage) try(ctx context.Context, fetch func(Storage) (*StorageResponse, error)) (*StorageResponse, error) {
+	var errs []string
+	for _, b := range fs.backends {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		resp, err := fetch(b.Storage)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			errs = append(errs, fmt.Sprintf("%s: %s", b.Name, err.Error()))
+			continue
+		}
+		if resp.NotFound {
+			continue
+		}
+		resp.Source = b.Name
+		return resp, nil
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("no storage had the object: %s", strings.Join(errs, "; "))
+	}
+	return &StorageResponse{NotFound: true}, nil
+}
+
+func (fs *FallbackStorage) Fetch(t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return fs.try(context.Background(), func(s Storage) (*StorageResponse, error) {
+		return s.Fetch(t, c, prefixOverride, keyVars)
+	})
+}
+
+// FetchContext is Fetch, abandoning the storages when ctx is done.
+func (fs *FallbackStorage) FetchContext(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return fs.try(ctx, func(s Storage) (*StorageResponse, error) {
+		return FetchContext(ctx, s, t, c, prefixOverride, keyVars)
+	})
+}
+
+func (fs *FallbackStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*StorageResponse, error) {
+	return fs.try(context.Background(), func(s Storage) (*StorageResponse, error) {
+		return s.TileJson(f, c, prefixOverride)
+	})
+}
+
+// ReadMetadata reads from the storages in the same way as Fetch, skipping
+// those which can't read metadata.
+func (fs *FallbackStorage) ReadMetadata(name, prefixOverride string) (*StorageResponse, error) {
+	return fs.try(context.Background(), func(s Storage) (*StorageResponse, error) {
+		reader, ok := s.(MetadataReader)
+		if !ok {
+			return &StorageResponse{NotFound: true}, nil
+		}
+		return reader.ReadMetadata(name, prefixOverride)
+	})
+}
+
+// ResolveKey returns the key of the first storage able to resolve one.
+func (fs *FallbackStorage) ResolveKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	for _, b := range fs.backends {
+		if resolver, ok := b.Storage.(KeyResolver); ok {
+			return resolver.ResolveKey(t, prefixOverride, keyVars)
+		}
+	}
+	return "", fmt.Errorf("no storage can resolve keys")
+}
+
+// HealthCheck checks every storage, and fails only when none is healthy, as
+// the others can still serve what they have.
+func (fs *FallbackStorage) HealthCheck() error {
+	var errs []string
+	for _, b := range fs.backends {
+		if err := b.Storage.HealthCheck(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", b.Name, err.Error()))
+		}
+	}
+	if len(errs) == len(fs.backends) {
+		return fmt.Errorf("no healthy storage: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+func TestFallbackStorage(t *testing.T) {
+	local := &countingStorage{notFound: true}
+	failing := &countingStorage{err: errors.New("down")}
+	remote := &countingStorage{}
+
+	fs := NewFallbackStorage([]*FallbackBackend{
+		{Name: "local", Storage: local},
+		{Name: "failing", Storage: failing},
+		{Name: "remote", Storage: remote},
+	})
+
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	resp, err := fs.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil {
+		t.Fatalf("Expected the remote storage to serve the fetch, got %#v, %v", resp, err)
+	}
+	if resp.Source != "remote" {
+		t.Fatalf("Expected the response's source to be remote, got %#v", resp.Source)
+	}
+	if local.fetches != 1 || failing.fetches != 1 || remote.fetches != 1 {
+		t.Fatalf("Expected each storage to be tried once, got %d, %d and %d", local.fetches, failing.fetches, remote.fetches)
+	}
+
+	local.notFound = false
+	resp, err = fs.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Source != "local" || failing.fetches != 1 {
+		t.Fatalf("Expected the local storage to serve the fetch alone, got %#v, %v", resp, err)
+	}
+
+	// nothing found, but a storage failed, which may have had the metatile
+	local.notFound, remote.notFound = true, true
+	if _, err := fs.Fetch(coord, state.Condition{}, "", nil); err == nil {
+		t.Fatalf("Expected an error when a storage failed and none had the metatile")
+	}
+	failing.err = nil
+	failing.notFound = true
+	resp, err = fs.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || !resp.NotFound {
+		t.Fatalf("Expected not found when no storage had the metatile, got %#v, %v", resp, err)
+	}
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// FanOutStorage fetches metatiles from several build prefixes of another
+// storage in parallel, serving the newest by Last-Modified, so that a new
+// build can be rolled out gradually as its metatiles are written rather
+// than with a cutover of the default prefix. Ties, and metatiles without a
+// Last-Modified, go to the prefix listed first. Responses name the prefix
+// which served them in their Source. Requests for a build by its ID are
+// passed through.
+type FanOutStorage struct {
+	storage  Storage
+	prefixes []string
+}
+
+var _ ContextFetcher = &FanOutStorage{}
+var _ MetadataReader = &FanOutStorage{}
+var _ KeyResolver = &FanOutStorage{}
+var _ Lister = &FanOutStorage{}
+
+func NewFanOutStorage(storage Storage, prefixes []string) *FanOutStorage {
+	return &FanOutStorage{
+		storage:  storage,
+		prefixes: prefixes,
+	}
+}
+
+func (fs *FanOutStorage) Fetch(t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return fs.FetchContext(context.Background(), t, c, prefixOverride, keyVars)
+}
+
+// FetchContext fetches the metatile from every prefix, abandoning them when
+// ctx is done. The fetches are unconditional, as the condition applies to
+// whichever is newest, so it's checked against that afterwards.
+func (fs *FanOutStorage) FetchContext(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	if prefixOverride != "" {
+		return FetchContext(ctx, fs.storage, t, c, prefixOverride, keyVars)
+	}
+
+	type result struct {
+		resp *StorageResponse
+		err  error
+	}
+	results := make([]result, len(fs.prefixes))
+	done := make(chan struct{}, len(fs.prefixes))
+	for i, prefix := range fs.prefixes {
+		go func(i int, prefix string) {
+			resp, err := FetchContext(ctx, fs.storage, t, state.Condition{}, prefix, keyVars)
+			results[i] = result{resp, err}
+			done <- struct{}{}
+		}(i, prefix)
+	}
+	for range fs.prefixes {
+		<-done
+	}
+
+	var newest *SuccessfulResponse
+	var source string
+	var errs []string
+	for i, r := range results {
+		if r.err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", fs.prefixes[i], r.err.Error()))
+			continue
+		}
+		if r.resp.Response == nil {
+			continue
+		}
+		if newest == nil || (r.resp.Response.LastModified != nil && (newest.LastModified == nil || r.resp.Response.LastModified.After(*newest.LastModified))) {
+			newest = r.resp.Response
+			source = fs.prefixes[i]
+		}
+	}
+
+	// a failed prefix may be the newest, but serving an older build is
+	// better than failing
+	if newest == nil {
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("no prefix had the metatile: %s", strings.Join(errs, "; "))
+		}
+		return &StorageResponse{NotFound: true}, nil
+	}
+	if isNotModified(c, newest.LastModified, newest.ETag) {
+		return &StorageResponse{NotModified: true, Source: source}, nil
+	}
+	return &StorageResponse{Response: newest, Source: source}, nil
+}
+
+func (fs *FanOutStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*StorageResponse, error) {
+	return fs.storage.TileJson(f, c, prefixOverride)
+}
+
+func (fs *FanOutStorage) ReadMetadata(name, prefixOverride string) (*StorageResponse, error) {
+	reader, ok := fs.storage.(MetadataReader)
+	if !ok {
+		return nil, fmt.Errorf("storage can't read metadata")
+	}
+	return reader.ReadMetadata(name, prefixOverride)
+}
+
+// ResolveKey returns the key under the first prefix, unless a build is
+// requested.
+func (fs *FanOutStorage) ResolveKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	resolver, ok := fs.storage.(KeyResolver)
+	if !ok {
+		return "", fmt.Errorf("storage can't resolve keys")
+	}
+	if prefixOverride == "" && len(fs.prefixes) > 0 {
+		prefixOverride = fs.prefixes[0]
+	}
+	return resolver.ResolveKey(t, prefixOverride, keyVars)
+}
+
+func (fs *FanOutStorage) List(prefix, after string, limit int) (*ListResult, error) {
+	lister, ok := fs.storage.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("storage can't list keys")
+	}
+	return lister.List(prefix, after, limit)
+}
+
+func (fs *FanOutStorage) HealthCheck() error {
+	return fs.storage.HealthCheck()
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// prefixStorage responds with the metatiles of each prefix, last modified
+// at the given times, or fails for prefixes with an error.
+type prefixStorage struct {
+	countingStorage
+	modified map[string]time.Time
+	errs     map[string]error
+}
+
+func (p *prefixStorage) Fetch(t tile.TileCoord, cond state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	if err, ok := p.errs[prefixOverride]; ok {
+		return nil, err
+	}
+	modified, ok := p.modified[prefixOverride]
+	if !ok {
+		return &StorageResponse{NotFound: true}, nil
+	}
+	etag := prefixOverride
+	return &StorageResponse{Response: &SuccessfulResponse{Body: []byte(prefixOverride), LastModified: &modified, ETag: &etag}}, nil
+}
+
+func TestFanOutStorage(t *testing.T) {
+	old := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	stg := &prefixStorage{
+		modified: map[string]time.Time{"v1": old, "v2": old.Add(time.Hour)},
+		errs:     map[string]error{"v3": errors.New("down")},
+	}
+	fs := NewFanOutStorage(stg, []string{"v1", "v2", "v3", "v4"})
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+
+	resp, err := fs.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "v2" || resp.Source != "v2" {
+		t.Fatalf("Expected the newest build v2 to be served, got %#v, %v", resp, err)
+	}
+
+	etag := "v2"
+	resp, err = fs.Fetch(coord, state.Condition{IfNoneMatch: &etag}, "", nil)
+	if err != nil || !resp.NotModified {
+		t.Fatalf("Expected not modified for the newest build's ETag, got %#v, %v", resp, err)
+	}
+
+	resp, err = fs.Fetch(coord, state.Condition{}, "v1", nil)
+	if err != nil || string(resp.Response.Body) != "v1" || resp.Source != "" {
+		t.Fatalf("Expected a requested build to be served alone, got %#v, %v", resp, err)
+	}
+
+	stg.modified = nil
+	if _, err := fs.Fetch(coord, state.Condition{}, "", nil); err == nil {
+		t.Fatalf("Expected an error when no prefix had the metatile and one failed")
+	}
+}
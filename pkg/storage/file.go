@@ -1,10 +1,14 @@
 package storage
 
 import (
+	"crypto/md5"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/tilezen/tapalcatl/pkg/state"
 	"github.com/tilezen/tapalcatl/pkg/tile"
@@ -46,17 +50,210 @@ func respondWithPath(path string) (*StorageResponse, error) {
 	}
 }
 
-func (f *FileStorage) Fetch(t tile.TileCoord, c state.Condition, prefix string) (*StorageResponse, error) {
-	tilepath := filepath.Join(f.baseDir, f.layer, filepath.FromSlash(t.FileName()))
-	return respondWithPath(tilepath)
+// respondWithPathCond reads the file at path, setting Last-Modified from its
+// modification time and an ETag from its content, and responds with
+// NotModified when the condition matches.
+func respondWithPathCond(path string, c state.Condition) (*StorageResponse, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &StorageResponse{NotFound: true}, nil
+		}
+		return nil, err
+	}
+
+	resp, err := respondWithPath(path)
+	if err != nil || resp.Response == nil {
+		return resp, err
+	}
+
+	lastModified := info.ModTime()
+	etag := fmt.Sprintf("\"%x\"", md5.Sum(resp.Response.Body))
+	if isNotModified(c, &lastModified, &etag) {
+		return &StorageResponse{NotModified: true}, nil
+	}
+
+	resp.Response.LastModified = &lastModified
+	resp.Response.ETag = &etag
+	resp.Response.Size = uint64(len(resp.Response.Body))
+	return resp, nil
+}
+
+// respondWithFile reads the metatile at path, setting Last-Modified from its
+// modification time and an ETag from its size and modification time, so
+// that it isn't read at all when the condition matches.
+func respondWithFile(path string, c state.Condition) (*StorageResponse, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &StorageResponse{NotFound: true}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	lastModified := info.ModTime()
+	etag := fmt.Sprintf("\"%x-%x\"", lastModified.UnixNano(), info.Size())
+	if isNotModified(c, &lastModified, &etag) {
+		return &StorageResponse{NotModified: true}, nil
+	}
+
+	body, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	resp := &StorageResponse{
+		Response: &SuccessfulResponse{
+			Body:         body,
+			LastModified: &lastModified,
+			ETag:         &etag,
+			Size:         uint64(len(body)),
+		},
+	}
+	return resp, nil
+}
+
+// tilePath returns the path of the tile on disk. A prefix override selects a
+// build stored in a subdirectory of the base dir.
+func (f *FileStorage) tilePath(t tile.TileCoord, prefix string) string {
+	return filepath.Join(f.baseDir, filepath.FromSlash(prefix), f.layer, filepath.FromSlash(t.FileName()))
+}
+
+// Fetch reads the metatile, or if it isn't stored uncompressed, the gzipped
+// metatile with the CompressedSuffix, decompressing it. The condition is
+// checked against the validators of whichever file is read.
+func (f *FileStorage) Fetch(t tile.TileCoord, c state.Condition, prefix string, keyVars map[string]string) (*StorageResponse, error) {
+	return respondWithCompressed(f.tilePath(t, prefix), func(path string) (*StorageResponse, error) {
+		return respondWithFile(path, c)
+	})
+}
+
+// ResolveKey returns the path on disk which Fetch would read for the tile,
+// when it's stored uncompressed.
+func (f *FileStorage) ResolveKey(t tile.TileCoord, prefix string, keyVars map[string]string) (string, error) {
+	return f.tilePath(t, prefix), nil
 }
 
 func (s *FileStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefix string) (*StorageResponse, error) {
 	dirpath := "tilejson"
 	tileJsonExt := "json"
 	filename := fmt.Sprintf("%s.%s", f.Name(), tileJsonExt)
-	tilejsonPath := filepath.Join(s.baseDir, dirpath, filename)
-	return respondWithPath(tilejsonPath)
+	tilejsonPath := filepath.Join(s.baseDir, filepath.FromSlash(prefix), dirpath, filename)
+	return respondWithPathCond(tilejsonPath, c)
+}
+
+// ReadMetadata reads the file with the given name in the build's directory.
+func (s *FileStorage) ReadMetadata(name, prefix string) (*StorageResponse, error) {
+	return respondWithPath(filepath.Join(s.baseDir, filepath.FromSlash(prefix), filepath.FromSlash(name)))
+}
+
+// ReadRange reads part of the file with the given name in the build's
+// directory.
+func (s *FileStorage) ReadRange(name, prefix string, offset, length int64) ([]byte, error) {
+	f, err := os.Open(filepath.Join(s.baseDir, filepath.FromSlash(prefix), filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ErrInvalidListPrefix is returned when listing with a prefix which could
+// reach outside the storage, ie. with a ".." segment.
+var ErrInvalidListPrefix = errors.New("invalid list prefix")
+
+// errListFull stops the walk once a page of keys has been found.
+var errListFull = errors.New("list is full")
+
+// List walks the base dir, with keys being slash separated paths relative to
+// it. The directories are walked in the order of their keys, skipping those
+// which can't hold keys after the given one with the prefix, and the walk
+// stops once it has found one more key than the limit.
+func (s *FileStorage) List(prefix, after string, limit int) (*ListResult, error) {
+	for _, segment := range strings.Split(prefix, "/") {
+		if segment == ".." {
+			return nil, ErrInvalidListPrefix
+		}
+	}
+
+	var keys []string
+	var walk func(dir, dirKey string) error
+	walk = func(dir, dirKey string) error {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) && dirKey == "" {
+				return nil
+			}
+			return err
+		}
+
+		// directories are ordered by their keys, which end with a slash,
+		// so that eg. a/b comes after a.b
+		entryKeys := make([]string, len(infos))
+		for i, info := range infos {
+			entryKeys[i] = dirKey + info.Name()
+			if info.IsDir() {
+				entryKeys[i] += "/"
+			}
+		}
+		sort.Sort(byKey{infos, entryKeys})
+
+		for i, info := range infos {
+			key := entryKeys[i]
+			if !info.IsDir() {
+				if strings.HasPrefix(key, prefix) && key > after {
+					keys = append(keys, key)
+					if len(keys) > limit {
+						return errListFull
+					}
+				}
+				continue
+			}
+
+			// every key in the directory begins with its key
+			if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+				continue
+			}
+			if key <= after && !strings.HasPrefix(after, key) {
+				continue
+			}
+			if err := walk(filepath.Join(dir, info.Name()), key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(s.baseDir, ""); err != nil && err != errListFull {
+		return nil, err
+	}
+
+	result := &ListResult{Keys: keys}
+	if len(keys) > limit {
+		result.Keys = keys[:limit]
+		result.Truncated = true
+	}
+	return result, nil
+}
+
+// byKey sorts directory entries by their list keys.
+type byKey struct {
+	infos []os.FileInfo
+	keys  []string
+}
+
+func (b byKey) Len() int           { return len(b.keys) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.infos[i], b.infos[j] = b.infos[j], b.infos[i]
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
 }
 
 func (s *FileStorage) HealthCheck() error {
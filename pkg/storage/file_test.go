@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+func TestFileStorageTileJsonConditional(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	err = os.MkdirAll(filepath.Join(baseDir, "tilejson"), 0755)
+	if err != nil {
+		t.Fatalf("Unable to create tilejson dir: %s", err.Error())
+	}
+	err = ioutil.WriteFile(filepath.Join(baseDir, "tilejson", "mapbox.json"), []byte("{}"), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write tilejson: %s", err.Error())
+	}
+
+	storage := NewFileStorage(baseDir, "", "")
+	format := state.TileJsonFormat(state.TileJsonFormat_Mvt)
+
+	resp, err := storage.TileJson(format, state.Condition{}, "")
+	if err != nil {
+		t.Fatalf("Unable to get tilejson: %s", err.Error())
+	}
+	if resp.Response == nil || resp.Response.ETag == nil || resp.Response.LastModified == nil {
+		t.Fatalf("Expected tilejson response with validators, got %#v", resp)
+	}
+
+	weakETag := "W/" + *resp.Response.ETag
+	resp, err = storage.TileJson(format, state.Condition{IfNoneMatch: &weakETag}, "")
+	if err != nil {
+		t.Fatalf("Unable to get tilejson: %s", err.Error())
+	}
+	if !resp.NotModified {
+		t.Fatalf("Expected matching If-None-Match to give not modified")
+	}
+
+	future := time.Now().Add(time.Hour)
+	resp, err = storage.TileJson(format, state.Condition{IfModifiedSince: &future}, "")
+	if err != nil {
+		t.Fatalf("Unable to get tilejson: %s", err.Error())
+	}
+	if !resp.NotModified {
+		t.Fatalf("Expected If-Modified-Since after modification to give not modified")
+	}
+
+	past := time.Now().Add(-time.Hour)
+	resp, err = storage.TileJson(format, state.Condition{IfModifiedSince: &past}, "")
+	if err != nil {
+		t.Fatalf("Unable to get tilejson: %s", err.Error())
+	}
+	if resp.Response == nil {
+		t.Fatalf("Expected If-Modified-Since before modification to give a response")
+	}
+}
+
+func TestFileStorageBuildPrefix(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	for _, build := range []string{"", "20210331"} {
+		dir := filepath.Join(baseDir, build, "all", "0", "0")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Unable to create tile dir: %s", err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "0.zip"), []byte("build "+build), 0644); err != nil {
+			t.Fatalf("Unable to write tile: %s", err.Error())
+		}
+	}
+
+	storage := NewFileStorage(baseDir, "all", "")
+	for _, build := range []string{"", "20210331"} {
+		resp, err := storage.Fetch(coord, state.Condition{}, build, nil)
+		if err != nil {
+			t.Fatalf("Unable to fetch tile: %s", err.Error())
+		}
+		if resp.Response == nil || string(resp.Response.Body) != "build "+build {
+			t.Fatalf("Expected tile from build %#v, got %#v", build, resp)
+		}
+	}
+
+	resp, err := storage.Fetch(coord, state.Condition{}, "20200101", nil)
+	if err != nil {
+		t.Fatalf("Unable to fetch tile: %s", err.Error())
+	}
+	if !resp.NotFound {
+		t.Fatalf("Expected tile from missing build to be not found")
+	}
+}
+
+func TestFileStorageFetchConditional(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	dir := filepath.Join(baseDir, "all", "0", "0")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Unable to create tile dir: %s", err.Error())
+	}
+	path := filepath.Join(dir, "0.zip")
+	if err := ioutil.WriteFile(path, []byte("metatile"), 0644); err != nil {
+		t.Fatalf("Unable to write tile: %s", err.Error())
+	}
+
+	storage := NewFileStorage(baseDir, "all", "")
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	resp, err := storage.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil || resp.Response.ETag == nil || resp.Response.LastModified == nil {
+		t.Fatalf("Expected metatile response with validators, got %#v, %v", resp, err)
+	}
+	etag := *resp.Response.ETag
+
+	resp, err = storage.Fetch(coord, state.Condition{IfNoneMatch: &etag}, "", nil)
+	if err != nil || !resp.NotModified {
+		t.Fatalf("Expected matching If-None-Match to give not modified, got %#v, %v", resp, err)
+	}
+
+	future := time.Now().Add(time.Hour)
+	resp, err = storage.Fetch(coord, state.Condition{IfModifiedSince: &future}, "", nil)
+	if err != nil || !resp.NotModified {
+		t.Fatalf("Expected If-Modified-Since after modification to give not modified, got %#v, %v", resp, err)
+	}
+
+	// rewriting the metatile changes its ETag
+	if err := ioutil.WriteFile(path, []byte("new metatile"), 0644); err != nil {
+		t.Fatalf("Unable to write tile: %s", err.Error())
+	}
+	resp, err = storage.Fetch(coord, state.Condition{IfNoneMatch: &etag}, "", nil)
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "new metatile" {
+		t.Fatalf("Expected the changed metatile, got %#v, %v", resp, err)
+	}
+}
+
+func TestFileStorageCompressed(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	dir := filepath.Join(baseDir, "all", "0", "0")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Unable to create tile dir: %s", err.Error())
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte("compressed"))
+	w.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, "0.zip.gz"), buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Unable to write tile: %s", err.Error())
+	}
+
+	storage := NewFileStorage(baseDir, "all", "")
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	resp, err := storage.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "compressed" {
+		t.Fatalf("Expected the decompressed metatile, got %#v, %v", resp, err)
+	}
+
+	// an uncompressed metatile is preferred
+	if err := ioutil.WriteFile(filepath.Join(dir, "0.zip"), []byte("uncompressed"), 0644); err != nil {
+		t.Fatalf("Unable to write tile: %s", err.Error())
+	}
+	resp, err = storage.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "uncompressed" {
+		t.Fatalf("Expected the uncompressed metatile, got %#v, %v", resp, err)
+	}
+}
+
+func TestFileStorageBuildMetadata(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	writeMetadata := func(build, content string) {
+		err := os.MkdirAll(filepath.Join(baseDir, build), 0755)
+		if err != nil {
+			t.Fatalf("Unable to create build dir: %s", err.Error())
+		}
+		err = ioutil.WriteFile(filepath.Join(baseDir, build, "metadata.json"), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("Unable to write metadata: %s", err.Error())
+		}
+	}
+	writeMetadata("20210331", `{"metatile_size": 8, "tile_size": 2, "metatile_max_detail_zoom": 14}`)
+	writeMetadata("20210401", `{"metatile_size": 3}`)
+
+	source := NewBuildMetadataSource(NewFileStorage(baseDir, "", ""), "metadata.json")
+
+	metadata, err := source.Get("20210331")
+	if err != nil {
+		t.Fatalf("Unable to get build metadata: %s", err.Error())
+	}
+	expected := BuildMetadata{MetatileSize: 8, TileSize: 2, MetatileMaxDetailZoom: 14}
+	if metadata == nil || *metadata != expected {
+		t.Fatalf("Expected metadata %#v, got %#v", expected, metadata)
+	}
+
+	metadata, err = source.Get("20210402")
+	if err != nil {
+		t.Fatalf("Unable to get build metadata: %s", err.Error())
+	}
+	if metadata != nil {
+		t.Fatalf("Expected no metadata for a build without it, got %#v", metadata)
+	}
+
+	_, err = source.Get("20210401")
+	if err == nil {
+		t.Fatalf("Expected an error for a metatile size which isn't a power of two")
+	}
+}
+
+func TestFileStorageBuildManifest(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	source := NewBuildManifestSource(NewFileStorage(baseDir, "", ""), "manifest.json", time.Hour)
+	if _, ok, err := source.AsOf(time.Now()); ok || err != nil {
+		t.Fatalf("Expected no build without a manifest, got %v %v", ok, err)
+	}
+
+	manifest := `{"builds": [
+		{"build_id": "20230801", "created": "2023-08-01T10:00:00Z"},
+		{"build_id": "20230901", "created": "2023-09-01T10:00:00Z"},
+		{"build_id": "20230815", "created": "2023-08-15T10:00:00Z"}
+	]}`
+	if err := ioutil.WriteFile(filepath.Join(baseDir, "manifest.json"), []byte(manifest), 0644); err != nil {
+		t.Fatalf("Unable to write manifest: %s", err.Error())
+	}
+
+	for asOf, expected := range map[string]string{
+		"2023-09-01T10:00:00Z": "20230901",
+		"2023-09-01T09:59:59Z": "20230815",
+		"2023-08-20T00:00:00Z": "20230815",
+		"2024-01-01T00:00:00Z": "20230901",
+	} {
+		at, err := time.Parse(time.RFC3339, asOf)
+		if err != nil {
+			t.Fatalf("Unable to parse time: %s", err.Error())
+		}
+		buildID, ok, err := source.AsOf(at)
+		if err != nil || !ok || buildID != expected {
+			t.Fatalf("Expected build %s as of %s, got %s %v %v", expected, asOf, buildID, ok, err)
+		}
+	}
+
+	if _, ok, _ := source.AsOf(time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)); ok {
+		t.Fatalf("Expected no build before the first one")
+	}
+}
+
+func TestFileStorageList(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	for _, name := range []string{"20210331/all/0/0/0.zip", "20210331/all/1/0/0.zip", "20210331/all/1/1/0.zip", "20210401/all/0/0/0.zip"} {
+		path := filepath.Join(baseDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Unable to create dir: %s", err.Error())
+		}
+		if err := ioutil.WriteFile(path, []byte("zip"), 0644); err != nil {
+			t.Fatalf("Unable to write tile: %s", err.Error())
+		}
+	}
+
+	storage := NewFileStorage(baseDir, "all", "")
+
+	result, err := storage.List("20210331/all/1", "", 1)
+	if err != nil {
+		t.Fatalf("Unable to list: %s", err.Error())
+	}
+	if len(result.Keys) != 1 || result.Keys[0] != "20210331/all/1/0/0.zip" || !result.Truncated {
+		t.Fatalf("Expected first page with 20210331/all/1/0/0.zip, got %#v", result)
+	}
+
+	result, err = storage.List("20210331/all/1", result.Keys[0], 1)
+	if err != nil {
+		t.Fatalf("Unable to list: %s", err.Error())
+	}
+	if len(result.Keys) != 1 || result.Keys[0] != "20210331/all/1/1/0.zip" || result.Truncated {
+		t.Fatalf("Expected last page with 20210331/all/1/1/0.zip, got %#v", result)
+	}
+
+	result, err = storage.List("2021", "", 10)
+	if err != nil {
+		t.Fatalf("Unable to list: %s", err.Error())
+	}
+	if len(result.Keys) != 4 {
+		t.Fatalf("Expected all 4 keys, got %#v", result.Keys)
+	}
+
+	result, err = storage.List("missing/all", "", 10)
+	if err != nil {
+		t.Fatalf("Unable to list missing dir: %s", err.Error())
+	}
+	if len(result.Keys) != 0 {
+		t.Fatalf("Expected no keys for missing dir, got %#v", result.Keys)
+	}
+
+	// keys are in lexical order even where a file sorts between a directory
+	// and its contents
+	if err := ioutil.WriteFile(filepath.Join(baseDir, "20210331", "all.txt"), []byte("txt"), 0644); err != nil {
+		t.Fatalf("Unable to write file: %s", err.Error())
+	}
+	result, err = storage.List("20210331/all", "", 1)
+	if err != nil {
+		t.Fatalf("Unable to list: %s", err.Error())
+	}
+	if len(result.Keys) != 1 || result.Keys[0] != "20210331/all.txt" || !result.Truncated {
+		t.Fatalf("Expected first page with 20210331/all.txt, got %#v", result)
+	}
+	result, err = storage.List("20210331/all", result.Keys[0], 10)
+	if err != nil {
+		t.Fatalf("Unable to list: %s", err.Error())
+	}
+	if len(result.Keys) != 3 || result.Keys[0] != "20210331/all/0/0/0.zip" || result.Truncated {
+		t.Fatalf("Expected the directory's 3 keys, got %#v", result)
+	}
+
+	for _, prefix := range []string{"../", "20210331/../../etc/", ".."} {
+		if _, err := storage.List(prefix, "", 10); err != ErrInvalidListPrefix {
+			t.Fatalf("Expected prefix %s to be rejected, got %v", prefix, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// CompressedSuffix is added to the names of metatiles stored gzipped on
+// disk, eg. 0/0/0.zip.gz, which are read when the metatile isn't stored
+// uncompressed.
+const CompressedSuffix = ".gz"
+
+// isGzipEncoding returns true when the Content-Encoding of an object says
+// it's stored gzipped.
+func isGzipEncoding(encoding *string) bool {
+	return encoding != nil && strings.EqualFold(strings.TrimSpace(*encoding), "gzip")
+}
+
+// respondWithCompressed responds with the metatile at key, or if it isn't
+// stored uncompressed, the gzipped metatile at key with the
+// CompressedSuffix, decompressing it.
+func respondWithCompressed(key string, respond func(key string) (*StorageResponse, error)) (*StorageResponse, error) {
+	resp, err := respond(key)
+	if err != nil || !resp.NotFound {
+		return resp, err
+	}
+
+	resp, err = respond(key + CompressedSuffix)
+	if err != nil || resp.Response == nil {
+		return resp, err
+	}
+	body, err := gunzip(resp.Response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", key+CompressedSuffix, err)
+	}
+	resp.Response.Body = body
+	return resp, nil
+}
+
+// gunzip decompresses a gzipped metatile, so that the metatile reader is
+// handed the zip it holds.
+func gunzip(body []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzipped metatile: %w", err)
+	}
+	defer r.Close()
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzipped metatile: %w", err)
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+// HashFunc computes the sharding hash used for the {hash} key pattern
+// variable from the tile path.
+type HashFunc func(toHash string) string
+
+// DefaultHashScheme is the 5 character md5 prefix used by tilequeue.
+const DefaultHashScheme = "md5-5"
+
+const (
+	// HashCompatibility_LegacyLayerSlash hashes "/layer/z/x/y.fmt", as
+	// tilequeue did before https://github.com/tilezen/tilequeue/pull/344.
+	HashCompatibility_LegacyLayerSlash = "legacy-layer-slash"
+	// HashCompatibility_Tilequeue344 hashes "z/x/y.fmt", without the layer
+	// or a leading slash, as tilequeue has since that PR.
+	HashCompatibility_Tilequeue344 = "tilequeue-344"
+)
+
+// IsValidHashCompatibility returns true when compatibility is one of the
+// HashCompatibility_ constants.
+func IsValidHashCompatibility(compatibility string) bool {
+	switch compatibility {
+	case HashCompatibility_LegacyLayerSlash, HashCompatibility_Tilequeue344:
+		return true
+	}
+	return false
+}
+
+// InferHashCompatibility returns the compatibility implied by the layer, as
+// storages without an explicit one have always had: the legacy hash when
+// there's a layer, and the tilequeue-344 hash when there isn't.
+func InferHashCompatibility(layer string) string {
+	if layer != "" {
+		return HashCompatibility_LegacyLayerSlash
+	}
+	return HashCompatibility_Tilequeue344
+}
+
+// NewHashFunc returns the hash function for a scheme, which is one of:
+//
+//	none       the {hash} variable is empty
+//	md5-N      the first N hex characters of the md5 sum
+//	sha1-N     the first N hex characters of the sha1 sum
+//	crc32-hex  the 8 hex characters of the IEEE crc32 checksum
+func NewHashFunc(scheme string) (HashFunc, error) {
+	switch scheme {
+	case "none":
+		return func(string) string { return "" }, nil
+	case "crc32-hex":
+		return func(toHash string) string {
+			return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(toHash)))
+		}, nil
+	}
+
+	dash := strings.LastIndex(scheme, "-")
+	if dash < 0 {
+		return nil, fmt.Errorf("unknown hash scheme %#v", scheme)
+	}
+	length, err := strconv.Atoi(scheme[dash+1:])
+	if err != nil || length <= 0 {
+		return nil, fmt.Errorf("invalid length in hash scheme %#v", scheme)
+	}
+
+	switch scheme[:dash] {
+	case "md5":
+		if length > md5.Size*2 {
+			return nil, fmt.Errorf("hash scheme %#v is longer than an md5 sum", scheme)
+		}
+		return func(toHash string) string {
+			return fmt.Sprintf("%x", md5.Sum([]byte(toHash)))[0:length]
+		}, nil
+	case "sha1":
+		if length > sha1.Size*2 {
+			return nil, fmt.Errorf("hash scheme %#v is longer than a sha1 sum", scheme)
+		}
+		return func(toHash string) string {
+			return fmt.Sprintf("%x", sha1.Sum([]byte(toHash)))[0:length]
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown hash scheme %#v", scheme)
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+
+	"github.com/imkira/go-interpol"
+)
+
+// DefaultHTTPTimeout bounds the requests to an origin made without a
+// request's context, unless configured otherwise.
+const DefaultHTTPTimeout = 10 * time.Second
+
+// HTTPOptions holds the optional settings of an HTTPStorage. The zero value
+// gives the default behaviour.
+type HTTPOptions struct {
+	// Client makes the requests to the origin, default a client without a
+	// timeout, as FetchContext is bounded by the request's context.
+	Client *http.Client
+	// Timeout bounds the requests which have no request context to bound
+	// them: Fetch, metadata, tilejson and healthchecks.
+	Timeout time.Duration
+	// MetadataURLPattern is the URL of objects stored under a build's
+	// prefix, with {prefix} and {name} variables, eg.
+	// https://origin/{prefix}/{name}. Tilejson documents are read from it
+	// with the name tilejson/<format>.json. When empty, the storage has no
+	// metadata or tilejson.
+	MetadataURLPattern string
+	// KeyVariables are extra fixed variables available to the URL pattern.
+	KeyVariables map[string]string
+	// Hash computes the {hash} URL variable, default DefaultHashScheme.
+	Hash HashFunc
+	// HashCompatibility is one of the HashCompatibility_ constants, choosing
+	// the path which is hashed. When empty it's inferred from the layer
+	// with InferHashCompatibility.
+	HashCompatibility string
+}
+
+// StatusError is the error of a request to which the origin responded with
+// an unexpected status.
+type StatusError struct {
+	Status int
+	URL    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d from %s", e.Status, e.URL)
+}
+
+// HTTPStorage fetches metatiles from an upstream HTTP(S) origin, such as
+// another tapalcatl's storage behind a CDN, at URLs made from a pattern with
+// the same variables as S3 key patterns, eg.
+// https://origin/{prefix}/{hash}/{z}/{x}/{y}.{fmt}.
+type HTTPStorage struct {
+	urlPattern    string
+	defaultPrefix string
+	layer         string
+	healthcheck   string
+	options       HTTPOptions
+}
+
+func NewHTTPStorage(urlPattern, defaultPrefix, layer, healthcheck string) *HTTPStorage {
+	return NewHTTPStorageWithOptions(urlPattern, defaultPrefix, layer, healthcheck, HTTPOptions{})
+}
+
+func NewHTTPStorageWithOptions(urlPattern, defaultPrefix, layer, healthcheck string, options HTTPOptions) *HTTPStorage {
+	if options.Client == nil {
+		options.Client = &http.Client{}
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultHTTPTimeout
+	}
+	if options.Hash == nil {
+		options.Hash, _ = NewHashFunc(DefaultHashScheme)
+	}
+	if options.HashCompatibility == "" {
+		options.HashCompatibility = InferHashCompatibility(layer)
+	}
+
+	return &HTTPStorage{
+		urlPattern:    urlPattern,
+		defaultPrefix: defaultPrefix,
+		layer:         layer,
+		healthcheck:   healthcheck,
+		options:       options,
+	}
+}
+
+func (h *HTTPStorage) prefix(prefixOverride string) string {
+	if prefixOverride != "" {
+		return prefixOverride
+	}
+	return h.defaultPrefix
+}
+
+// escapeValues path escapes the values of the key variables, which can come
+// from the request. The builtin variables are left as they are, so that
+// prefixes can contain slashes.
+func escapeValues(vars map[string]string) map[string]string {
+	escaped := make(map[string]string, len(vars))
+	for k, v := range vars {
+		escaped[k] = url.PathEscape(v)
+	}
+	return escaped
+}
+
+func (h *HTTPStorage) tileURL(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	hash := tileHash(h.options.Hash, h.options.HashCompatibility, h.layer, t)
+	m := keyVariables(t, hash, h.prefix(prefixOverride), h.layer, escapeValues(h.options.KeyVariables), escapeValues(keyVars))
+	return interpol.WithMap(h.urlPattern, m)
+}
+
+// ResolveKey returns the URL which Fetch would request for the tile.
+func (h *HTTPStorage) ResolveKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	return h.tileURL(t, prefixOverride, keyVars)
+}
+
+// respondWithURL requests the URL with the condition's headers.
+func (h *HTTPStorage) respondWithURL(ctx context.Context, u string, c state.Condition) (*StorageResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return respondWithRequest(h.options.Client, req, c)
+}
+
+// respondWithRequest makes the GET request with the condition's headers.
+// The condition is checked again against the response's validators, for
+// servers which ignore conditional requests.
+func respondWithRequest(client *http.Client, req *http.Request, c state.Condition) (*StorageResponse, error) {
+	u := req.URL.String()
+	if c.IfNoneMatch != nil {
+		req.Header.Set("If-None-Match", *c.IfNoneMatch)
+	}
+	if c.IfModifiedSince != nil {
+		req.Header.Set("If-Modified-Since", c.IfModifiedSince.UTC().Format(http.TimeFormat))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return &StorageResponse{NotModified: true}, nil
+	case http.StatusNotFound, http.StatusGone:
+		return &StorageResponse{NotFound: true}, nil
+	default:
+		// drain the body so the connection can be reused
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil, &StatusError{Status: resp.StatusCode, URL: u}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastModified *time.Time
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		lastModified = &t
+	}
+	var etag *string
+	if value := resp.Header.Get("ETag"); value != "" {
+		etag = &value
+	}
+	if isNotModified(c, lastModified, etag) {
+		return &StorageResponse{NotModified: true}, nil
+	}
+
+	return &StorageResponse{
+		Response: &SuccessfulResponse{
+			Body:         body,
+			LastModified: lastModified,
+			ETag:         etag,
+			Size:         uint64(len(body)),
+		},
+	}, nil
+}
+
+func (h *HTTPStorage) Fetch(t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.options.Timeout)
+	defer cancel()
+	return h.FetchContext(ctx, t, c, prefixOverride, keyVars)
+}
+
+// FetchContext is Fetch, abandoning the request to the origin when ctx is
+// done.
+func (h *HTTPStorage) FetchContext(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	u, err := h.tileURL(t, prefixOverride, keyVars)
+	if err != nil {
+		return nil, err
+	}
+	return h.respondWithURL(ctx, u, c)
+}
+
+// ReadMetadata reads the object with the given name under the prefix from
+// the metadata URL pattern, if there is one.
+func (h *HTTPStorage) ReadMetadata(name, prefixOverride string) (*StorageResponse, error) {
+	return h.readMetadata(name, state.Condition{}, prefixOverride)
+}
+
+func (h *HTTPStorage) readMetadata(name string, c state.Condition, prefixOverride string) (*StorageResponse, error) {
+	if h.options.MetadataURLPattern == "" {
+		return &StorageResponse{NotFound: true}, nil
+	}
+	u, err := interpol.WithMap(h.options.MetadataURLPattern, map[string]string{
+		"prefix": h.prefix(prefixOverride),
+		"name":   name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.options.Timeout)
+	defer cancel()
+	return h.respondWithURL(ctx, u, c)
+}
+
+func (h *HTTPStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*StorageResponse, error) {
+	return h.readMetadata(fmt.Sprintf("tilejson/%s.json", f.Name()), c, prefixOverride)
+}
+
+// HealthCheck requests the healthcheck URL with HEAD, which must respond
+// with a 2xx status within the timeout.
+func (h *HTTPStorage) HealthCheck() error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.options.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, h.healthcheck, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.options.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("healthcheck %s responded with status %d", h.healthcheck, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+func TestHTTPStorage(t *testing.T) {
+	lastModified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var requested string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Path
+		switch r.URL.Path {
+		case "/builds/b1/64a4d/1/2/3.zip":
+			if r.Header.Get("If-None-Match") == `"abc"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"abc"`)
+			w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+			w.Write([]byte("metatile"))
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	hash, _ := NewHashFunc("md5-5")
+	stg := NewHTTPStorageWithOptions(origin.URL+"/{prefix}/{hash}/{z}/{x}/{y}.{fmt}", "builds/b1", "", origin.URL+"/broken", HTTPOptions{Hash: hash})
+	coord := tile.TileCoord{Z: 1, X: 2, Y: 3, Format: "zip"}
+
+	resp, err := stg.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil {
+		t.Fatalf("Unable to fetch: %s", err.Error())
+	}
+	if resp.Response == nil || string(resp.Response.Body) != "metatile" {
+		t.Fatalf("Expected the metatile from %s, got %#v", requested, resp)
+	}
+	if resp.Response.ETag == nil || *resp.Response.ETag != `"abc"` {
+		t.Fatalf("Expected the origin's ETag, got %v", resp.Response.ETag)
+	}
+	if resp.Response.LastModified == nil || !resp.Response.LastModified.Equal(lastModified) {
+		t.Fatalf("Expected the origin's Last-Modified, got %v", resp.Response.LastModified)
+	}
+
+	etag := `"abc"`
+	resp, err = stg.Fetch(coord, state.Condition{IfNoneMatch: &etag}, "", nil)
+	if err != nil || !resp.NotModified {
+		t.Fatalf("Expected the condition to be forwarded and not modified, got %#v, %v", resp, err)
+	}
+	since := lastModified.Add(time.Hour)
+	resp, err = stg.Fetch(coord, state.Condition{IfModifiedSince: &since}, "", nil)
+	if err != nil || !resp.NotModified {
+		t.Fatalf("Expected the condition to be checked against Last-Modified, got %#v, %v", resp, err)
+	}
+
+	resp, err = stg.Fetch(coord, state.Condition{}, "builds/b2", nil)
+	if err != nil || !resp.NotFound {
+		t.Fatalf("Expected the other build to be not found, got %#v, %v", resp, err)
+	}
+	if requested != "/builds/b2/64a4d/1/2/3.zip" {
+		t.Fatalf("Expected the prefix override in the URL, got %s", requested)
+	}
+
+	if err := stg.HealthCheck(); err == nil {
+		t.Fatalf("Expected the healthcheck to fail with the origin's error status")
+	}
+}
+
+func TestHTTPStorageTimeout(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	stg := NewHTTPStorageWithOptions(origin.URL+"/{prefix}/{z}/{x}/{y}.{fmt}", "builds/b1", "", origin.URL+"/health", HTTPOptions{
+		MetadataURLPattern: origin.URL + "/{prefix}/{name}",
+		Timeout:            10 * time.Millisecond,
+	})
+
+	// requests without a request's context to bound them time out
+	if _, err := stg.TileJson(state.TileJsonFormat_Mvt, state.Condition{}, ""); err == nil {
+		t.Fatalf("Expected tilejson from a hung origin to time out")
+	}
+	if err := stg.HealthCheck(); err == nil {
+		t.Fatalf("Expected the healthcheck of a hung origin to time out")
+	}
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/metrics"
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// InstrumentedStorage writes the outcome, duration and size of each metatile
+// fetch from another storage to the metrics writer under the storage's
+// name, so that a slow or failing storage among several can be told apart.
+// Fetches abandoned by the caller aren't recorded.
+type InstrumentedStorage struct {
+	name    string
+	storage Storage
+	mw      metrics.MetricsWriter
+}
+
+var _ ContextFetcher = &InstrumentedStorage{}
+var _ RangeFetcher = &InstrumentedStorage{}
+var _ MetadataReader = &InstrumentedStorage{}
+var _ KeyResolver = &InstrumentedStorage{}
+var _ Lister = &InstrumentedStorage{}
+
+func NewInstrumentedStorage(name string, storage Storage, mw metrics.MetricsWriter) *InstrumentedStorage {
+	return &InstrumentedStorage{
+		name:    name,
+		storage: storage,
+		mw:      mw,
+	}
+}
+
+// Name returns the name of the storage definition, for reporting.
+func (is *InstrumentedStorage) Name() string {
+	return is.name
+}
+
+// measure makes the fetch, writing its state unless ctx is done.
+func (is *InstrumentedStorage) measure(ctx context.Context, fetch func() (*StorageResponse, error)) (*StorageResponse, error) {
+	start := time.Now()
+	resp, err := fetch()
+	storageState := &state.StorageFetchState{
+		Name:     is.name,
+		Duration: time.Since(start),
+	}
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		return resp, err
+	case errors.As(err, new(*ArchivedError)):
+		storageState.FetchState = state.FetchState_Archived
+	case err != nil:
+		storageState.FetchState = state.FetchState_FetchError
+	case resp.NotFound:
+		storageState.FetchState = state.FetchState_NotFound
+	default:
+		storageState.FetchState = state.FetchState_Success
+		if r := resp.Response; r != nil && r.Ranges == nil {
+			storageState.Size = int64(r.Size)
+			if storageState.Size == 0 {
+				storageState.Size = int64(len(r.Body))
+			}
+		}
+	}
+	is.mw.WriteStorageFetchState(storageState)
+	return resp, err
+}
+
+func (is *InstrumentedStorage) Fetch(t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return is.FetchContext(context.Background(), t, c, prefixOverride, keyVars)
+}
+
+func (is *InstrumentedStorage) FetchContext(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return is.measure(ctx, func() (*StorageResponse, error) {
+		return FetchContext(ctx, is.storage, t, c, prefixOverride, keyVars)
+	})
+}
+
+// FetchRanges measures the first request for the metatile, but not the
+// ranged requests which follow.
+func (is *InstrumentedStorage) FetchRanges(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return is.measure(ctx, func() (*StorageResponse, error) {
+		return FetchRanges(ctx, is.storage, t, c, prefixOverride, keyVars)
+	})
+}
+
+func (is *InstrumentedStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*StorageResponse, error) {
+	return is.storage.TileJson(f, c, prefixOverride)
+}
+
+func (is *InstrumentedStorage) ReadMetadata(name, prefixOverride string) (*StorageResponse, error) {
+	reader, ok := is.storage.(MetadataReader)
+	if !ok {
+		return nil, fmt.Errorf("storage can't read metadata")
+	}
+	return reader.ReadMetadata(name, prefixOverride)
+}
+
+func (is *InstrumentedStorage) ResolveKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	resolver, ok := is.storage.(KeyResolver)
+	if !ok {
+		return "", fmt.Errorf("storage can't resolve keys")
+	}
+	return resolver.ResolveKey(t, prefixOverride, keyVars)
+}
+
+func (is *InstrumentedStorage) List(prefix, after string, limit int) (*ListResult, error) {
+	lister, ok := is.storage.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("storage can't list keys")
+	}
+	return lister.List(prefix, after, limit)
+}
+
+func (is *InstrumentedStorage) HealthCheck() error {
+	return is.storage.HealthCheck()
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/tilezen/tapalcatl/pkg/metrics"
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// storageStateRecorder records the storage fetch states written to it.
+type storageStateRecorder struct {
+	metrics.NilMetricsWriter
+	states []*state.StorageFetchState
+}
+
+func (r *storageStateRecorder) WriteStorageFetchState(storageState *state.StorageFetchState) {
+	r.states = append(r.states, storageState)
+}
+
+func TestInstrumentedStorage(t *testing.T) {
+	mw := &storageStateRecorder{}
+	inner := &countingStorage{}
+	stg := NewInstrumentedStorage("local", inner, mw)
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+
+	if _, err := stg.Fetch(coord, state.Condition{}, "", nil); err != nil {
+		t.Fatalf("Unable to fetch: %s", err.Error())
+	}
+	inner.notFound = true
+	stg.Fetch(coord, state.Condition{}, "", nil)
+	inner.err = errors.New("down")
+	stg.Fetch(coord, state.Condition{}, "", nil)
+
+	// abandoned fetches aren't the storage's fault
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stg.FetchContext(ctx, coord, state.Condition{}, "", nil)
+
+	expected := []state.ReqFetchState{state.FetchState_Success, state.FetchState_NotFound, state.FetchState_FetchError}
+	if len(mw.states) != len(expected) {
+		t.Fatalf("Expected %d fetches to be recorded, got %d", len(expected), len(mw.states))
+	}
+	for i, storageState := range mw.states {
+		if storageState.Name != "local" || storageState.FetchState != expected[i] {
+			t.Fatalf("Expected fetch %d of local to be %s, got %#v", i, expected[i], storageState)
+		}
+	}
+	if mw.states[0].Size != 2 {
+		t.Fatalf("Expected the size of the metatile fetched, got %d", mw.states[0].Size)
+	}
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BuildManifestEntry is one build listed in a build manifest.
+type BuildManifestEntry struct {
+	// BuildID is the prefix override which selects the build.
+	BuildID string `json:"build_id"`
+	// Created is when the build was made.
+	Created time.Time `json:"created"`
+}
+
+// BuildManifest lists the builds available in a storage.
+type BuildManifest struct {
+	Builds []BuildManifestEntry `json:"builds"`
+}
+
+// AsOf returns the id of the newest build created at or before t, or false
+// if every build is newer.
+func (m *BuildManifest) AsOf(t time.Time) (string, bool) {
+	var newest *BuildManifestEntry
+	for i := range m.Builds {
+		entry := &m.Builds[i]
+		if entry.Created.After(t) {
+			continue
+		}
+		if newest == nil || entry.Created.After(newest.Created) {
+			newest = entry
+		}
+	}
+	if newest == nil {
+		return "", false
+	}
+	return newest.BuildID, true
+}
+
+// BuildManifestSource reads the manifest object under the default prefix of
+// a storage. New builds are added to the manifest, so it is read again once
+// it's older than the refresh interval.
+type BuildManifestSource struct {
+	reader  MetadataReader
+	name    string
+	refresh time.Duration
+
+	mu       sync.Mutex
+	manifest *BuildManifest
+	readAt   time.Time
+}
+
+func NewBuildManifestSource(reader MetadataReader, name string, refresh time.Duration) *BuildManifestSource {
+	return &BuildManifestSource{
+		reader:  reader,
+		name:    name,
+		refresh: refresh,
+	}
+}
+
+// Get returns the manifest, or nil if the storage doesn't have one. If the
+// manifest can't be read again, the previous one is returned with the error.
+func (s *BuildManifestSource) Get() (*BuildManifest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.manifest != nil && time.Since(s.readAt) < s.refresh {
+		return s.manifest, nil
+	}
+	return s.read()
+}
+
+// Refresh reads the manifest again without waiting for the refresh
+// interval, eg. when told a new build has been added.
+func (s *BuildManifestSource) Refresh() (*BuildManifest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.read()
+}
+
+// read reads the manifest from storage, keeping it if it's valid. The mutex
+// must be held.
+func (s *BuildManifestSource) read() (*BuildManifest, error) {
+	resp, err := s.reader.ReadMetadata(s.name, "")
+	if err != nil {
+		return s.manifest, err
+	}
+	if resp.NotFound || resp.Response == nil {
+		return nil, nil
+	}
+
+	manifest := &BuildManifest{}
+	if err := json.Unmarshal(resp.Response.Body, manifest); err != nil {
+		return s.manifest, fmt.Errorf("invalid build manifest %s: %s", s.name, err.Error())
+	}
+	for _, entry := range manifest.Builds {
+		if entry.BuildID == "" || entry.Created.IsZero() {
+			return s.manifest, fmt.Errorf("invalid build manifest %s: builds must have a build_id and created time", s.name)
+		}
+	}
+
+	s.manifest = manifest
+	s.readAt = time.Now()
+	return manifest, nil
+}
+
+// AsOf returns the id of the newest build created at or before t, or false
+// if there's no such build or no manifest.
+func (s *BuildManifestSource) AsOf(t time.Time) (string, bool, error) {
+	manifest, err := s.Get()
+	if manifest == nil {
+		return "", false, err
+	}
+	buildID, ok := manifest.AsOf(t)
+	return buildID, ok, err
+}
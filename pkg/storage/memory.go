@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// memoryObject is a file loaded by a MemoryStorage.
+type memoryObject struct {
+	body         []byte
+	lastModified time.Time
+	etag         string
+}
+
+// MemoryStorage serves the files of a directory, laid out as for a
+// FileStorage, from memory, having loaded them all when it was made. It
+// suits integration tests and small deployments, such as demos, where the
+// tiles fit in memory and reading them from disk is only a cost. Files
+// changed after loading aren't seen.
+type MemoryStorage struct {
+	layer       string
+	healthcheck string
+	objects     map[string]*memoryObject
+	// keys are the keys of objects, sorted for List
+	keys []string
+}
+
+var _ MetadataReader = &MemoryStorage{}
+var _ KeyResolver = &MemoryStorage{}
+var _ Lister = &MemoryStorage{}
+var _ RangeReader = &MemoryStorage{}
+
+// NewMemoryStorage loads the files under baseDir. When maxBytes is
+// positive, directories holding more than that fail to load rather than
+// exhaust memory.
+func NewMemoryStorage(baseDir, layer, healthcheck string, maxBytes int64) (*MemoryStorage, error) {
+	m := &MemoryStorage{
+		layer:       layer,
+		healthcheck: healthcheck,
+		objects:     make(map[string]*memoryObject),
+	}
+
+	var total int64
+	err := filepath.Walk(baseDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		total += info.Size()
+		if maxBytes > 0 && total > maxBytes {
+			return fmt.Errorf("%s holds more than the limit of %d bytes", baseDir, maxBytes)
+		}
+		body, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(baseDir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		m.objects[key] = &memoryObject{
+			body:         body,
+			lastModified: info.ModTime(),
+			etag:         fmt.Sprintf("\"%x\"", md5.Sum(body)),
+		}
+		m.keys = append(m.keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load memory storage: %w", err)
+	}
+	sort.Strings(m.keys)
+	return m, nil
+}
+
+// Len returns the number of files loaded.
+func (m *MemoryStorage) Len() int {
+	return len(m.keys)
+}
+
+// WithLayer returns a storage serving the same files for another layer,
+// without loading them again.
+func (m *MemoryStorage) WithLayer(layer string) *MemoryStorage {
+	withLayer := *m
+	withLayer.layer = layer
+	return &withLayer
+}
+
+// respond responds with the object at key, or NotModified when the
+// condition matches it.
+func (m *MemoryStorage) respond(key string, c state.Condition) *StorageResponse {
+	object, ok := m.objects[key]
+	if !ok {
+		return &StorageResponse{NotFound: true}
+	}
+	if isNotModified(c, &object.lastModified, &object.etag) {
+		return &StorageResponse{NotModified: true}
+	}
+	// the body is shared, which is safe as responses aren't modified
+	lastModified, etag := object.lastModified, object.etag
+	return &StorageResponse{
+		Response: &SuccessfulResponse{
+			Body:         object.body,
+			LastModified: &lastModified,
+			ETag:         &etag,
+			Size:         uint64(len(object.body)),
+		},
+	}
+}
+
+func (m *MemoryStorage) tileKey(t tile.TileCoord, prefix string) string {
+	return path.Join(prefix, m.layer, t.FileName())
+}
+
+// Fetch responds with the metatile, or if it wasn't stored uncompressed, the
+// gzipped metatile with the CompressedSuffix, decompressing it.
+func (m *MemoryStorage) Fetch(t tile.TileCoord, c state.Condition, prefix string, keyVars map[string]string) (*StorageResponse, error) {
+	return respondWithCompressed(m.tileKey(t, prefix), func(key string) (*StorageResponse, error) {
+		return m.respond(key, c), nil
+	})
+}
+
+// ResolveKey returns the key relative to the base dir which Fetch would
+// respond with for the tile, when it was stored uncompressed.
+func (m *MemoryStorage) ResolveKey(t tile.TileCoord, prefix string, keyVars map[string]string) (string, error) {
+	return m.tileKey(t, prefix), nil
+}
+
+func (m *MemoryStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefix string) (*StorageResponse, error) {
+	return m.respond(path.Join(prefix, "tilejson", f.Name()+".json"), c), nil
+}
+
+// ReadMetadata responds with the file with the given name in the build's
+// directory.
+func (m *MemoryStorage) ReadMetadata(name, prefix string) (*StorageResponse, error) {
+	return m.respond(path.Join(prefix, name), state.Condition{}), nil
+}
+
+// ReadRange returns part of the file with the given name in the build's
+// directory.
+func (m *MemoryStorage) ReadRange(name, prefix string, offset, length int64) ([]byte, error) {
+	key := path.Join(prefix, name)
+	object, ok := m.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%s wasn't loaded", key)
+	}
+	if offset < 0 || length < 0 || offset+length > int64(len(object.body)) {
+		return nil, fmt.Errorf("range of %d bytes at %d is outside %s", length, offset, key)
+	}
+	return object.body[offset : offset+length], nil
+}
+
+// List returns the keys of the loaded files, relative to the base dir.
+func (m *MemoryStorage) List(prefix, after string, limit int) (*ListResult, error) {
+	start := after
+	if prefix > start {
+		start = prefix
+	}
+	result := &ListResult{}
+	for i := sort.SearchStrings(m.keys, start); i < len(m.keys); i++ {
+		key := m.keys[i]
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if key == after {
+			continue
+		}
+		if len(result.Keys) == limit {
+			result.Truncated = true
+			break
+		}
+		result.Keys = append(result.Keys, key)
+	}
+	return result, nil
+}
+
+func (m *MemoryStorage) HealthCheck() error {
+	if _, ok := m.objects[m.healthcheck]; !ok {
+		return fmt.Errorf("healthcheck file %#v wasn't loaded", m.healthcheck)
+	}
+	return nil
+}
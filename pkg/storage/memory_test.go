@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	writeFile := func(name, content string) {
+		p := filepath.Join(baseDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Unable to create dir: %s", err.Error())
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write file: %s", err.Error())
+		}
+	}
+	writeFile("all/0/0/0.zip", "metatile")
+	writeFile("20210331/all/0/0/0.zip", "build metatile")
+	writeFile("tilejson/mapbox.json", "{}")
+	writeFile("healthcheck", "ok")
+
+	stg, err := NewMemoryStorage(baseDir, "all", "healthcheck", 0)
+	if err != nil {
+		t.Fatalf("Unable to load memory storage: %s", err.Error())
+	}
+
+	// files written after loading aren't seen
+	os.RemoveAll(filepath.Join(baseDir, "all"))
+
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	resp, err := stg.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "metatile" {
+		t.Fatalf("Expected the loaded metatile, got %#v, %v", resp, err)
+	}
+	resp, err = stg.Fetch(coord, state.Condition{IfNoneMatch: resp.Response.ETag}, "", nil)
+	if err != nil || !resp.NotModified {
+		t.Fatalf("Expected matching If-None-Match to give not modified, got %#v, %v", resp, err)
+	}
+	resp, err = stg.Fetch(coord, state.Condition{}, "20210331", nil)
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "build metatile" {
+		t.Fatalf("Expected the build's metatile, got %#v, %v", resp, err)
+	}
+	resp, err = stg.Fetch(tile.TileCoord{Z: 1, X: 0, Y: 0, Format: "zip"}, state.Condition{}, "", nil)
+	if err != nil || !resp.NotFound {
+		t.Fatalf("Expected a missing metatile to be not found, got %#v, %v", resp, err)
+	}
+
+	resp, err = stg.TileJson(state.TileJsonFormat_Mvt, state.Condition{}, "")
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "{}" {
+		t.Fatalf("Expected the tilejson, got %#v, %v", resp, err)
+	}
+
+	list, err := stg.List("20210331/", "", 10)
+	if err != nil || !reflect.DeepEqual(list.Keys, []string{"20210331/all/0/0/0.zip"}) || list.Truncated {
+		t.Fatalf("Expected the build's keys, got %#v, %v", list, err)
+	}
+	list, err = stg.List("", "all/0/0/0.zip", 1)
+	if err != nil || !reflect.DeepEqual(list.Keys, []string{"healthcheck"}) || !list.Truncated {
+		t.Fatalf("Expected one key after the metatile, got %#v, %v", list, err)
+	}
+
+	if err := stg.HealthCheck(); err != nil {
+		t.Fatalf("Expected the healthcheck to pass, got %s", err.Error())
+	}
+	if err := stg.WithLayer("other").HealthCheck(); err != nil {
+		t.Fatalf("Expected the healthcheck to pass for another layer, got %s", err.Error())
+	}
+
+	if _, err := NewMemoryStorage(baseDir, "all", "healthcheck", 4); err == nil {
+		t.Fatalf("Expected files over the limit to fail to load")
+	}
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// BuildMetadata describes the metatiles of a build, as written alongside
+// them by tilequeue.
+type BuildMetadata struct {
+	MetatileSize          int `json:"metatile_size"`
+	TileSize              int `json:"tile_size"`
+	MetatileMaxDetailZoom int `json:"metatile_max_detail_zoom"`
+}
+
+// Validate checks the sizes are usable to locate tiles within metatiles.
+func (m *BuildMetadata) Validate() error {
+	if !tile.IsPowerOfTwo(m.MetatileSize) {
+		return fmt.Errorf("metatile size must be a power of two, but %d is not", m.MetatileSize)
+	}
+	if !tile.IsPowerOfTwo(m.TileSize) {
+		return fmt.Errorf("tile size must be a power of two, but %d is not", m.TileSize)
+	}
+	if m.TileSize > m.MetatileSize {
+		return fmt.Errorf("tile size must not be greater than metatile size, but %d > %d", m.TileSize, m.MetatileSize)
+	}
+	if m.MetatileMaxDetailZoom < 0 {
+		return fmt.Errorf("metatile max detail zoom must not be negative, but is %d", m.MetatileMaxDetailZoom)
+	}
+	return nil
+}
+
+// MetadataReader is implemented by storages which can read objects stored
+// under the prefix of a build, next to its tiles.
+type MetadataReader interface {
+	ReadMetadata(name, prefixOverride string) (*StorageResponse, error)
+}
+
+// BuildMetadataSource reads the metadata object of each build from storage.
+// A build's metadata doesn't change, so it is read once and kept.
+type BuildMetadataSource struct {
+	reader MetadataReader
+	name   string
+
+	mu    sync.RWMutex
+	known map[string]*BuildMetadata
+}
+
+func NewBuildMetadataSource(reader MetadataReader, name string) *BuildMetadataSource {
+	return &BuildMetadataSource{
+		reader: reader,
+		name:   name,
+		known:  make(map[string]*BuildMetadata),
+	}
+}
+
+// Get returns the metadata for the build with the given prefix override, or
+// nil if the build doesn't have any.
+func (s *BuildMetadataSource) Get(prefixOverride string) (*BuildMetadata, error) {
+	s.mu.RLock()
+	metadata, ok := s.known[prefixOverride]
+	s.mu.RUnlock()
+	if ok {
+		return metadata, nil
+	}
+
+	resp, err := s.reader.ReadMetadata(s.name, prefixOverride)
+	if err != nil {
+		return nil, err
+	}
+	// builds without metadata aren't remembered, as the prefix comes from the
+	// request and could be anything, and the metadata may yet be written.
+	if resp.NotFound || resp.Response == nil {
+		return nil, nil
+	}
+
+	metadata = &BuildMetadata{}
+	if err := json.Unmarshal(resp.Response.Body, metadata); err != nil {
+		return nil, fmt.Errorf("invalid build metadata %s: %s", s.name, err.Error())
+	}
+	if metadata.TileSize == 0 {
+		metadata.TileSize = 1
+	}
+	if err := metadata.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid build metadata %s: %s", s.name, err.Error())
+	}
+
+	s.mu.Lock()
+	s.known[prefixOverride] = metadata
+	s.mu.Unlock()
+
+	return metadata, nil
+}
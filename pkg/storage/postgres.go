@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"fmt"
+	"regexp"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// DefaultPostgresTable is the table tiles are read from, unless configured
+// otherwise.
+const DefaultPostgresTable = "tiles"
+
+// DefaultPostgresHealthcheck is the query run to check the database, unless
+// configured otherwise.
+const DefaultPostgresHealthcheck = "SELECT 1"
+
+// validPostgresTable matches table names, optionally qualified by a schema,
+// which are safe to put into queries unquoted.
+var validPostgresTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// PostgresOptions holds the optional settings of a PostgresStorage. The zero
+// value gives the default behaviour.
+type PostgresOptions struct {
+	// Table is the table to read from, default DefaultPostgresTable. It has
+	// z, x, y, build and data columns, and a format column with Tiles.
+	Table string
+	// Tiles is set when the rows are individual tiles, one per format,
+	// rather than metatile zips. The tiles of a coordinate are packed into
+	// a metatile of size 1, so the pattern's metatile size must be 1.
+	Tiles bool
+	// Healthcheck is the query run to check the database, default
+	// DefaultPostgresHealthcheck.
+	Healthcheck string
+}
+
+// PostgresStorage reads metatiles from a Postgres table keyed by coordinate
+// and build, for tiles rendered into a database shared with other services.
+// The build is the prefix, either the default or the request's buildid.
+// The database is a pool of connections, sized by the caller, and needs a
+// registered driver, eg. github.com/lib/pq.
+type PostgresStorage struct {
+	db           *sql.DB
+	defaultBuild string
+	options      PostgresOptions
+	query        string
+}
+
+func NewPostgresStorage(db *sql.DB, defaultBuild string) (*PostgresStorage, error) {
+	return NewPostgresStorageWithOptions(db, defaultBuild, PostgresOptions{})
+}
+
+func NewPostgresStorageWithOptions(db *sql.DB, defaultBuild string, options PostgresOptions) (*PostgresStorage, error) {
+	if options.Table == "" {
+		options.Table = DefaultPostgresTable
+	}
+	if !validPostgresTable.MatchString(options.Table) {
+		return nil, fmt.Errorf("invalid postgres table name %#v", options.Table)
+	}
+	if options.Healthcheck == "" {
+		options.Healthcheck = DefaultPostgresHealthcheck
+	}
+
+	query := fmt.Sprintf("SELECT data FROM %s WHERE z = $1 AND x = $2 AND y = $3 AND build = $4", options.Table)
+	if options.Tiles {
+		query = fmt.Sprintf("SELECT format, data FROM %s WHERE z = $1 AND x = $2 AND y = $3 AND build = $4 ORDER BY format", options.Table)
+	}
+
+	return &PostgresStorage{
+		db:           db,
+		defaultBuild: defaultBuild,
+		options:      options,
+		query:        query,
+	}, nil
+}
+
+func (p *PostgresStorage) build(prefixOverride string) string {
+	if prefixOverride != "" {
+		return prefixOverride
+	}
+	return p.defaultBuild
+}
+
+// ResolveKey returns the row which Fetch would read for the tile.
+func (p *PostgresStorage) ResolveKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	return fmt.Sprintf("%s z=%d x=%d y=%d build=%s", p.options.Table, t.Z, t.X, t.Y, p.build(prefixOverride)), nil
+}
+
+func (p *PostgresStorage) Fetch(t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return p.FetchContext(context.Background(), t, c, prefixOverride, keyVars)
+}
+
+// FetchContext is Fetch, cancelling the query when ctx is done. The ETag is
+// a hash of the metatile, as the table has no validators of its own.
+func (p *PostgresStorage) FetchContext(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	rows, err := p.db.QueryContext(ctx, p.query, t.Z, t.X, t.Y, p.build(prefixOverride))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var body []byte
+	if p.options.Tiles {
+		body, err = packTiles(rows)
+	} else if rows.Next() {
+		err = rows.Scan(&body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return &StorageResponse{NotFound: true}, nil
+	}
+
+	etag := fmt.Sprintf("\"%x\"", md5.Sum(body))
+	if isNotModified(c, nil, &etag) {
+		return &StorageResponse{NotModified: true}, nil
+	}
+	return &StorageResponse{
+		Response: &SuccessfulResponse{
+			Body: body,
+			ETag: &etag,
+			Size: uint64(len(body)),
+		},
+	}, nil
+}
+
+// packTiles zips the format and data rows into a metatile of size 1, or
+// returns nil when there are no rows.
+func packTiles(rows *sql.Rows) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	empty := true
+	for rows.Next() {
+		var format string
+		var data []byte
+		if err := rows.Scan(&format, &data); err != nil {
+			return nil, err
+		}
+		offset := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: format}
+		f, err := w.CreateHeader(&zip.FileHeader{Name: offset.FileName(), Method: zip.Store})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(data); err != nil {
+			return nil, err
+		}
+		empty = false
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if empty {
+		return nil, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// TileJson always responds not found, as the table only holds tiles.
+func (p *PostgresStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*StorageResponse, error) {
+	return &StorageResponse{NotFound: true}, nil
+}
+
+// HealthCheck runs the healthcheck query.
+func (p *PostgresStorage) HealthCheck() error {
+	rows, err := p.db.Query(p.options.Healthcheck)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// fakeTileRow is a row of the fake tiles table.
+type fakeTileRow struct {
+	z, x, y int64
+	build   string
+	format  string
+	data    []byte
+}
+
+// fakeTilesDriver is a database/sql driver answering the PostgresStorage
+// queries from rows in memory.
+type fakeTilesDriver struct {
+	rows []fakeTileRow
+}
+
+func (d *fakeTilesDriver) Open(name string) (driver.Conn, error) { return &fakeTilesConn{d}, nil }
+
+type fakeTilesConn struct{ d *fakeTilesDriver }
+
+func (c *fakeTilesConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeTilesStmt{c.d, query}, nil
+}
+func (c *fakeTilesConn) Close() error              { return nil }
+func (c *fakeTilesConn) Begin() (driver.Tx, error) { return nil, fmt.Errorf("not supported") }
+
+type fakeTilesStmt struct {
+	d     *fakeTilesDriver
+	query string
+}
+
+func (s *fakeTilesStmt) Close() error { return nil }
+func (s *fakeTilesStmt) NumInput() int {
+	return strings.Count(s.query, "$")
+}
+func (s *fakeTilesStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (s *fakeTilesStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if len(args) == 0 {
+		return &fakeTilesRows{columns: []string{"?column?"}, values: [][]driver.Value{{int64(1)}}}, nil
+	}
+	tiles := strings.HasPrefix(s.query, "SELECT format")
+	result := &fakeTilesRows{columns: []string{"data"}}
+	if tiles {
+		result.columns = []string{"format", "data"}
+	}
+	for _, row := range s.d.rows {
+		if row.z != args[0] || row.x != args[1] || row.y != args[2] || row.build != args[3] {
+			continue
+		}
+		if tiles {
+			result.values = append(result.values, []driver.Value{row.format, row.data})
+		} else {
+			result.values = append(result.values, []driver.Value{row.data})
+		}
+	}
+	return result, nil
+}
+
+type fakeTilesRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeTilesRows) Columns() []string { return r.columns }
+func (r *fakeTilesRows) Close() error      { return nil }
+func (r *fakeTilesRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func init() {
+	sql.Register("faketiles", &fakeTilesDriver{rows: []fakeTileRow{
+		{z: 1, x: 2, y: 3, build: "b1", data: []byte("metatile")},
+		{z: 1, x: 2, y: 3, build: "b2", data: []byte("other build")},
+		{z: 4, x: 5, y: 6, build: "b1", format: "mvt", data: []byte("mvt tile")},
+		{z: 4, x: 5, y: 6, build: "b1", format: "json", data: []byte("json tile")},
+	}})
+}
+
+func TestPostgresStorage(t *testing.T) {
+	db, err := sql.Open("faketiles", "")
+	if err != nil {
+		t.Fatalf("Unable to open database: %s", err.Error())
+	}
+	defer db.Close()
+
+	if _, err := NewPostgresStorageWithOptions(db, "b1", PostgresOptions{Table: "tiles; DROP TABLE tiles"}); err == nil {
+		t.Fatalf("Expected an unsafe table name to be rejected")
+	}
+
+	stg, err := NewPostgresStorage(db, "b1")
+	if err != nil {
+		t.Fatalf("Unable to create storage: %s", err.Error())
+	}
+	if err := stg.HealthCheck(); err != nil {
+		t.Fatalf("Expected the healthcheck to pass, got %s", err.Error())
+	}
+
+	coord := tile.TileCoord{Z: 1, X: 2, Y: 3, Format: "zip"}
+	resp, err := stg.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "metatile" {
+		t.Fatalf("Expected the default build's metatile, got %#v, %v", resp, err)
+	}
+	resp, err = stg.Fetch(coord, state.Condition{IfNoneMatch: resp.Response.ETag}, "", nil)
+	if err != nil || !resp.NotModified {
+		t.Fatalf("Expected not modified for a matching ETag, got %#v, %v", resp, err)
+	}
+	resp, err = stg.Fetch(coord, state.Condition{}, "b2", nil)
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "other build" {
+		t.Fatalf("Expected the requested build's metatile, got %#v, %v", resp, err)
+	}
+	resp, err = stg.Fetch(tile.TileCoord{Z: 1, X: 0, Y: 0, Format: "zip"}, state.Condition{}, "", nil)
+	if err != nil || !resp.NotFound {
+		t.Fatalf("Expected a missing row to be not found, got %#v, %v", resp, err)
+	}
+
+	tiles, err := NewPostgresStorageWithOptions(db, "b1", PostgresOptions{Tiles: true})
+	if err != nil {
+		t.Fatalf("Unable to create storage: %s", err.Error())
+	}
+	resp, err = tiles.Fetch(tile.TileCoord{Z: 4, X: 5, Y: 6, Format: "zip"}, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil {
+		t.Fatalf("Expected the tiles packed into a metatile, got %#v, %v", resp, err)
+	}
+	for format, expected := range map[string]string{"mvt": "mvt tile", "json": "json tile"} {
+		offset := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: format}
+		r, _, err := tile.NewMetatileReader(offset, bytes.NewReader(resp.Response.Body), int64(len(resp.Response.Body)))
+		if err != nil {
+			t.Fatalf("Unable to read %s tile from metatile: %s", format, err.Error())
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(data) != expected {
+			t.Fatalf("Expected %#v for %s, got %#v", expected, format, string(data))
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultMinRange is the least a ranged read fetches, unless configured
+// otherwise. It's enough for the central directory of a metatile with many
+// formats, and for most tiles in a single request with their local header.
+const DefaultMinRange = 64 * 1024
+
+// rangeBlock is a fetched part of an object.
+type rangeBlock struct {
+	offset int64
+	data   []byte
+}
+
+// rangeReader reads an object of a known size in parts, fetching each part
+// the first time it's read, at least minRange bytes at a time. Reading a
+// tile from a metatile reads its central directory from the end of the
+// object and then its entry, so only those are fetched.
+type rangeReader struct {
+	size     int64
+	minRange int64
+	// fetch returns the bytes of the object from start to end exclusive
+	fetch func(start, end int64) ([]byte, error)
+
+	mu     sync.Mutex
+	blocks []rangeBlock
+}
+
+func newRangeReader(size, minRange int64, fetch func(start, end int64) ([]byte, error), first rangeBlock) *rangeReader {
+	return &rangeReader{
+		size:     size,
+		minRange: minRange,
+		fetch:    fetch,
+		blocks:   []rangeBlock{first},
+	}
+}
+
+// ReadAt implements io.ReaderAt, reading from a fetched block when one holds
+// the whole of p.
+func (r *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= r.size {
+		return 0, fmt.Errorf("read at %d outside object of %d bytes", off, r.size)
+	}
+	end := off + int64(len(p))
+	if end > r.size {
+		end = r.size
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	block := r.blockLocked(off, end)
+	if block == nil {
+		fetchEnd := end
+		if fetchEnd-off < r.minRange {
+			fetchEnd = off + r.minRange
+			if fetchEnd > r.size {
+				fetchEnd = r.size
+			}
+		}
+		if err := r.fetchLocked(off, fetchEnd); err != nil {
+			return 0, err
+		}
+		block = &r.blocks[len(r.blocks)-1]
+	}
+	n := copy(p, block.data[off-block.offset:end-block.offset])
+	return n, readAtErr(n, p)
+}
+
+// Prefetch implements tile.Prefetcher, fetching the n bytes at off in one
+// request unless a fetched block holds them.
+func (r *rangeReader) Prefetch(off, n int64) error {
+	if off < 0 || n <= 0 || off+n > r.size {
+		return fmt.Errorf("prefetch of %d bytes at %d outside object of %d bytes", n, off, r.size)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.blockLocked(off, off+n) != nil {
+		return nil
+	}
+	return r.fetchLocked(off, off+n)
+}
+
+// blockLocked returns the fetched block holding start to end exclusive, or
+// nil. The caller holds mu.
+func (r *rangeReader) blockLocked(start, end int64) *rangeBlock {
+	for i := range r.blocks {
+		block := &r.blocks[i]
+		if start >= block.offset && end <= block.offset+int64(len(block.data)) {
+			return block
+		}
+	}
+	return nil
+}
+
+// fetchLocked fetches start to end exclusive as a new block. The caller
+// holds mu.
+func (r *rangeReader) fetchLocked(start, end int64) error {
+	data, err := r.fetch(start, end)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != end-start {
+		return fmt.Errorf("ranged read of %d-%d returned %d bytes", start, end-1, len(data))
+	}
+	r.blocks = append(r.blocks, rangeBlock{offset: start, data: data})
+	return nil
+}
+
+// readAtErr is the error for a read of n bytes into p, which is io.EOF when
+// the read reached the end of the object before filling p.
+func readAtErr(n int, p []byte) error {
+	if n < len(p) {
+		return io.EOF
+	}
+	return nil
+}
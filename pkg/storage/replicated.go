@@ -0,0 +1,379 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/metrics"
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// Replica is one of a set of equivalent storages.
+type Replica struct {
+	Name    string
+	Storage Storage
+	// Weight is the relative share of requests sent to this replica while
+	// healthy. Replicas with zero weight are only used when all others fail.
+	Weight int
+
+	// unix nanos until which the replica is excluded after a failed or slow
+	// fetch
+	unhealthyUntil int64
+	// unix nanos until which the replica is excluded after a failed
+	// healthcheck, kept apart so that a passing healthcheck only ends the
+	// exclusions of healthchecks
+	checkFailedUntil int64
+	// moving average of the replica's fetch durations in nanos, or 0 before
+	// the first fetch
+	latency int64
+	// the healthcheck still running, or nil, guarded by the storage's mu
+	check *replicaCheck
+}
+
+// replicaCheck is a healthcheck of a replica, whose err is set once done is
+// closed.
+type replicaCheck struct {
+	done chan struct{}
+	err  error
+}
+
+func (r *Replica) isHealthy(now time.Time) bool {
+	return atomic.LoadInt64(&r.unhealthyUntil) <= now.UnixNano() && atomic.LoadInt64(&r.checkFailedUntil) <= now.UnixNano()
+}
+
+func (r *Replica) markUnhealthy(until time.Time) {
+	atomic.StoreInt64(&r.unhealthyUntil, until.UnixNano())
+}
+
+func (r *Replica) markCheckFailed(until time.Time) {
+	atomic.StoreInt64(&r.checkFailedUntil, until.UnixNano())
+}
+
+func (r *Replica) markCheckPassed() {
+	atomic.StoreInt64(&r.checkFailedUntil, 0)
+}
+
+// observeLatency adds the duration of a fetch to the moving average of the
+// replica's latency, returning the new average. Concurrent fetches may lose
+// each other's updates, which only makes the average less smooth.
+func (r *Replica) observeLatency(d time.Duration) time.Duration {
+	avg := atomic.LoadInt64(&r.latency)
+	if avg == 0 {
+		avg = int64(d)
+	} else {
+		avg += (int64(d) - avg) / replicaLatencySmoothing
+	}
+	atomic.StoreInt64(&r.latency, avg)
+	return time.Duration(avg)
+}
+
+// replicaLatencySmoothing is how many fetches the moving average of a
+// replica's latency is roughly over.
+const replicaLatencySmoothing = 5
+
+// The time a replica's healthcheck may take, unless configured otherwise
+const DefaultReplicaHealthCheckTimeout = 5 * time.Second
+
+// ReplicatedOptions holds the settings of a ReplicatedStorage.
+type ReplicatedOptions struct {
+	// Cooldown is how long a failing replica is excluded for.
+	Cooldown time.Duration
+	// HealthCheckInterval, if positive, is how often to check every replica,
+	// so that they're excluded before requests fail on them, until the
+	// storage is closed.
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout fails the healthcheck of a replica which hasn't
+	// answered within it, default DefaultReplicaHealthCheckTimeout.
+	HealthCheckTimeout time.Duration
+	// LatencyThreshold, if positive, excludes a replica for the cooldown
+	// when the moving average of its fetch durations goes over it, so that
+	// requests fail over from a region which is slow rather than down.
+	LatencyThreshold time.Duration
+}
+
+// ReplicatedStorage spreads requests across several equivalent storages
+// according to their weights. A replica which returns an error is excluded
+// for the cooldown period, and the request is retried on another replica.
+// With the copies of a bucket in several regions as replicas, and zero
+// weights for the standby regions, it fails over between regions.
+type ReplicatedStorage struct {
+	replicas []*Replica
+	options  ReplicatedOptions
+	mw       metrics.MetricsWriter
+
+	mu sync.Mutex
+	// closed to stop the periodic healthchecks
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  sync.WaitGroup
+}
+
+func NewReplicatedStorage(replicas []*Replica, cooldown, healthCheckInterval time.Duration, mw metrics.MetricsWriter) *ReplicatedStorage {
+	return NewReplicatedStorageWithOptions(replicas, mw, ReplicatedOptions{Cooldown: cooldown, HealthCheckInterval: healthCheckInterval})
+}
+
+func NewReplicatedStorageWithOptions(replicas []*Replica, mw metrics.MetricsWriter, options ReplicatedOptions) *ReplicatedStorage {
+	if options.HealthCheckTimeout <= 0 {
+		options.HealthCheckTimeout = DefaultReplicaHealthCheckTimeout
+	}
+	rs := &ReplicatedStorage{
+		replicas: replicas,
+		options:  options,
+		mw:       mw,
+		stop:     make(chan struct{}),
+	}
+
+	if options.HealthCheckInterval > 0 {
+		rs.stopped.Add(1)
+		go rs.runHealthChecks()
+	}
+
+	return rs
+}
+
+// runHealthChecks checks the replicas every HealthCheckInterval until the
+// storage is closed.
+func (rs *ReplicatedStorage) runHealthChecks() {
+	defer rs.stopped.Done()
+	ticker := time.NewTicker(rs.options.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// a tick may be ready along with the stop
+			select {
+			case <-rs.stop:
+				return
+			default:
+			}
+			rs.HealthCheck()
+		case <-rs.stop:
+			return
+		}
+	}
+}
+
+// Close stops the periodic healthchecks of the replicas, waiting for any
+// which is running to finish or time out.
+func (rs *ReplicatedStorage) Close() {
+	rs.stopOnce.Do(func() {
+		close(rs.stop)
+	})
+	rs.stopped.Wait()
+}
+
+// order returns the replicas in the order they should be tried: healthy
+// replicas in a weighted random order, then healthy standbys with no weight,
+// followed by unhealthy ones as a last resort.
+func (rs *ReplicatedStorage) order() []*Replica {
+	now := time.Now()
+	healthy := make([]*Replica, 0, len(rs.replicas))
+	var standby, unhealthy []*Replica
+	totalWeight := 0
+	for _, r := range rs.replicas {
+		switch {
+		case !r.isHealthy(now):
+			unhealthy = append(unhealthy, r)
+		case r.Weight > 0:
+			healthy = append(healthy, r)
+			totalWeight += r.Weight
+		default:
+			standby = append(standby, r)
+		}
+	}
+
+	result := make([]*Replica, 0, len(rs.replicas))
+	for len(healthy) > 0 {
+		pick := rand.Intn(totalWeight)
+		for i, r := range healthy {
+			if pick < r.Weight {
+				result = append(result, r)
+				totalWeight -= r.Weight
+				healthy = append(healthy[:i], healthy[i+1:]...)
+				break
+			}
+			pick -= r.Weight
+		}
+	}
+
+	result = append(result, standby...)
+	return append(result, unhealthy...)
+}
+
+// try fetches from each replica in turn until one succeeds. Once ctx is
+// done it stops, without blaming the replica it was waiting for.
+func (rs *ReplicatedStorage) try(ctx context.Context, fetch func(Storage) (*StorageResponse, error)) (*StorageResponse, error) {
+	var errs []string
+	for _, r := range rs.order() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		resp, err := fetch(r.Storage)
+		replicaState := &state.ReplicaFetchState{
+			Name:     r.Name,
+			Duration: time.Since(start),
+		}
+
+		if err != nil && ctx.Err() != nil {
+			return nil, err
+		}
+		if err != nil {
+			replicaState.FetchState = state.FetchState_FetchError
+			rs.mw.WriteReplicaFetchState(replicaState)
+			r.markUnhealthy(time.Now().Add(rs.options.Cooldown))
+			errs = append(errs, fmt.Sprintf("%s: %s", r.Name, err.Error()))
+			continue
+		}
+
+		// a slow replica still serves this request, but not the next ones
+		if rs.options.LatencyThreshold > 0 && r.observeLatency(replicaState.Duration) > rs.options.LatencyThreshold {
+			replicaState.IsSlow = true
+			r.markUnhealthy(time.Now().Add(rs.options.Cooldown))
+			// measure the replica afresh once it's back
+			atomic.StoreInt64(&r.latency, 0)
+		}
+
+		if resp.NotFound {
+			replicaState.FetchState = state.FetchState_NotFound
+		} else {
+			replicaState.FetchState = state.FetchState_Success
+		}
+		rs.mw.WriteReplicaFetchState(replicaState)
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("all replicas failed: %s", strings.Join(errs, "; "))
+}
+
+func (rs *ReplicatedStorage) Fetch(t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return rs.try(context.Background(), func(s Storage) (*StorageResponse, error) {
+		return s.Fetch(t, c, prefixOverride, keyVars)
+	})
+}
+
+// FetchContext is Fetch, abandoning the replicas when ctx is done.
+func (rs *ReplicatedStorage) FetchContext(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return rs.try(ctx, func(s Storage) (*StorageResponse, error) {
+		return FetchContext(ctx, s, t, c, prefixOverride, keyVars)
+	})
+}
+
+func (rs *ReplicatedStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*StorageResponse, error) {
+	return rs.try(context.Background(), func(s Storage) (*StorageResponse, error) {
+		return s.TileJson(f, c, prefixOverride)
+	})
+}
+
+// ReadMetadata reads from the replicas in the same way as Fetch. Replicas
+// which can't read metadata are treated as failing.
+func (rs *ReplicatedStorage) ReadMetadata(name, prefixOverride string) (*StorageResponse, error) {
+	return rs.try(context.Background(), func(s Storage) (*StorageResponse, error) {
+		reader, ok := s.(MetadataReader)
+		if !ok {
+			return nil, fmt.Errorf("storage can't read metadata")
+		}
+		return reader.ReadMetadata(name, prefixOverride)
+	})
+}
+
+// ResolveKey returns the key of the first replica able to resolve one.
+func (rs *ReplicatedStorage) ResolveKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	for _, r := range rs.replicas {
+		if resolver, ok := r.Storage.(KeyResolver); ok {
+			return resolver.ResolveKey(t, prefixOverride, keyVars)
+		}
+	}
+	return "", fmt.Errorf("no replica can resolve keys")
+}
+
+// List lists keys from the replicas in the order Fetch would try them,
+// skipping those which can't list or fail to.
+func (rs *ReplicatedStorage) List(prefix, after string, limit int) (*ListResult, error) {
+	var errs []string
+	for _, r := range rs.order() {
+		lister, ok := r.Storage.(Lister)
+		if !ok {
+			continue
+		}
+		result, err := lister.List(prefix, after, limit)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", r.Name, err.Error()))
+			continue
+		}
+		return result, nil
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no replica can list keys")
+	}
+	return nil, fmt.Errorf("all replicas failed: %s", strings.Join(errs, "; "))
+}
+
+// checkReplica runs the healthcheck of the replica, giving up after the
+// timeout. A replica's HealthCheck can't be cancelled, so one which times
+// out is left to finish in the background, and later checks wait for it
+// rather than starting another against a replica which may be hung.
+func (rs *ReplicatedStorage) checkReplica(r *Replica) error {
+	rs.mu.Lock()
+	check := r.check
+	if check == nil {
+		check = &replicaCheck{done: make(chan struct{})}
+		r.check = check
+		go func() {
+			check.err = r.Storage.HealthCheck()
+			rs.mu.Lock()
+			r.check = nil
+			rs.mu.Unlock()
+			close(check.done)
+		}()
+	}
+	rs.mu.Unlock()
+
+	timer := time.NewTimer(rs.options.HealthCheckTimeout)
+	defer timer.Stop()
+	select {
+	case <-check.done:
+		return check.err
+	case <-timer.C:
+		return fmt.Errorf("healthcheck timed out after %s", rs.options.HealthCheckTimeout)
+	}
+}
+
+// HealthCheck checks every replica in parallel, updating which are
+// excluded, and fails only when no replica is healthy. A passing
+// healthcheck doesn't end the cooldown of a replica excluded for failed or
+// slow fetches, as a replica can answer healthchecks while failing or slow
+// to serve metatiles.
+func (rs *ReplicatedStorage) HealthCheck() error {
+	checkErrs := make([]error, len(rs.replicas))
+	var wg sync.WaitGroup
+	for i, r := range rs.replicas {
+		wg.Add(1)
+		go func(i int, r *Replica) {
+			defer wg.Done()
+			checkErrs[i] = rs.checkReplica(r)
+		}(i, r)
+	}
+	wg.Wait()
+
+	var errs []string
+	for i, r := range rs.replicas {
+		if err := checkErrs[i]; err != nil {
+			r.markCheckFailed(time.Now().Add(rs.options.Cooldown))
+			errs = append(errs, fmt.Sprintf("%s: %s", r.Name, err.Error()))
+		} else {
+			r.markCheckPassed()
+		}
+	}
+
+	if len(errs) == len(rs.replicas) {
+		return fmt.Errorf("no healthy replicas: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/metrics"
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+type countingStorage struct {
+	err      error
+	delay    time.Duration
+	notFound bool
+	fetches  int
+}
+
+func (c *countingStorage) Fetch(t tile.TileCoord, cond state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	c.fetches++
+	time.Sleep(c.delay)
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.notFound {
+		return &StorageResponse{NotFound: true}, nil
+	}
+	return &StorageResponse{Response: &SuccessfulResponse{Body: []byte("{}")}}, nil
+}
+
+func (c *countingStorage) TileJson(f state.TileJsonFormat, cond state.Condition, prefixOverride string) (*StorageResponse, error) {
+	return c.Fetch(tile.TileCoord{}, cond, prefixOverride, nil)
+}
+
+func (c *countingStorage) HealthCheck() error {
+	return c.err
+}
+
+func TestReplicatedStorageSkipsFailingReplica(t *testing.T) {
+	failing := &countingStorage{err: errors.New("replica down")}
+	working := &countingStorage{}
+
+	rs := NewReplicatedStorage([]*Replica{
+		{Name: "failing", Storage: failing, Weight: 1},
+		{Name: "working", Storage: working, Weight: 1},
+	}, time.Minute, 0, &metrics.NilMetricsWriter{})
+
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	for i := 0; i < 10; i++ {
+		resp, err := rs.Fetch(coord, state.Condition{}, "", nil)
+		if err != nil {
+			t.Fatalf("Expected fetch to succeed on working replica, but got error: %s", err.Error())
+		}
+		if resp.Response == nil {
+			t.Fatalf("Expected successful response from working replica")
+		}
+	}
+
+	// after the first failure, the failing replica is excluded for the cooldown
+	if failing.fetches > 1 {
+		t.Fatalf("Expected failing replica to be tried at most once, but was tried %d times", failing.fetches)
+	}
+	if working.fetches != 10 {
+		t.Fatalf("Expected working replica to serve all 10 fetches, but served %d", working.fetches)
+	}
+
+	if err := rs.HealthCheck(); err != nil {
+		t.Fatalf("Expected healthcheck to pass with one healthy replica, but got: %s", err.Error())
+	}
+	working.err = errors.New("replica down")
+	if err := rs.HealthCheck(); err == nil {
+		t.Fatalf("Expected healthcheck to fail with no healthy replicas")
+	}
+}
+
+func TestReplicatedStorageFailsOverSlowReplica(t *testing.T) {
+	primary := &countingStorage{delay: 20 * time.Millisecond}
+	standby := &countingStorage{}
+
+	rs := NewReplicatedStorageWithOptions([]*Replica{
+		{Name: "primary", Storage: primary, Weight: 1},
+		{Name: "standby", Storage: standby, Weight: 0},
+	}, &metrics.NilMetricsWriter{}, ReplicatedOptions{
+		Cooldown:         time.Minute,
+		LatencyThreshold: 5 * time.Millisecond,
+	})
+
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	for i := 0; i < 5; i++ {
+		resp, err := rs.Fetch(coord, state.Condition{}, "", nil)
+		if err != nil || resp.Response == nil {
+			t.Fatalf("Expected fetch to succeed, but got %#v, %v", resp, err)
+		}
+	}
+
+	// the slow fetch is still served, then the standby takes over
+	if primary.fetches != 1 {
+		t.Fatalf("Expected slow primary to serve only the first fetch, but served %d", primary.fetches)
+	}
+	if standby.fetches != 4 {
+		t.Fatalf("Expected standby to serve the other 4 fetches, but served %d", standby.fetches)
+	}
+
+	// the slow primary still answers healthchecks, which doesn't bring it
+	// back before its cooldown
+	if err := rs.HealthCheck(); err != nil {
+		t.Fatalf("Expected healthcheck to pass, but got: %s", err.Error())
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := rs.Fetch(coord, state.Condition{}, "", nil); err != nil {
+			t.Fatalf("Expected fetch to succeed, but got %s", err.Error())
+		}
+	}
+	if primary.fetches != 1 {
+		t.Fatalf("Expected slow primary to stay excluded after a passing healthcheck, but served %d fetches", primary.fetches)
+	}
+}
+
+func TestReplicatedStorageHealthCheckExclusion(t *testing.T) {
+	primary := &countingStorage{}
+	standby := &countingStorage{}
+
+	rs := NewReplicatedStorage([]*Replica{
+		{Name: "primary", Storage: primary, Weight: 1},
+		{Name: "standby", Storage: standby, Weight: 0},
+	}, time.Minute, 0, &metrics.NilMetricsWriter{})
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+
+	// a replica excluded by a failed healthcheck is back once one passes
+	primary.err = errors.New("replica down")
+	rs.HealthCheck()
+	primary.err = nil
+	if _, err := rs.Fetch(coord, state.Condition{}, "", nil); err != nil || primary.fetches != 0 {
+		t.Fatalf("Expected the standby to serve while the primary fails healthchecks, got %d primary fetches, %v", primary.fetches, err)
+	}
+	rs.HealthCheck()
+	if _, err := rs.Fetch(coord, state.Condition{}, "", nil); err != nil || primary.fetches != 1 {
+		t.Fatalf("Expected the primary to serve once healthchecks pass, got %d primary fetches, %v", primary.fetches, err)
+	}
+}
+
+func TestReplicatedStorageFetchContextDone(t *testing.T) {
+	replica := &countingStorage{}
+	rs := NewReplicatedStorage([]*Replica{
+		{Name: "replica", Storage: replica, Weight: 1},
+	}, time.Minute, 0, &metrics.NilMetricsWriter{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	if _, err := rs.FetchContext(ctx, coord, state.Condition{}, "", nil); err != context.Canceled {
+		t.Fatalf("Expected fetch to be abandoned, got %v", err)
+	}
+	if replica.fetches != 0 {
+		t.Fatalf("Expected no fetch once the context is done, got %d", replica.fetches)
+	}
+	if !rs.replicas[0].isHealthy(time.Now()) {
+		t.Fatalf("Expected replica not to be blamed for an abandoned fetch")
+	}
+}
+
+// hungStorage's healthcheck counts its calls, and takes until release is
+// closed.
+type hungStorage struct {
+	countingStorage
+	checks  int32
+	release chan struct{}
+}
+
+func (h *hungStorage) HealthCheck() error {
+	atomic.AddInt32(&h.checks, 1)
+	<-h.release
+	return nil
+}
+
+func TestReplicatedStorageHungHealthCheck(t *testing.T) {
+	hung := &hungStorage{release: make(chan struct{})}
+	defer close(hung.release)
+	working := &hungStorage{release: make(chan struct{})}
+	close(working.release)
+
+	rs := NewReplicatedStorageWithOptions([]*Replica{
+		{Name: "hung", Storage: hung, Weight: 1},
+		{Name: "working", Storage: working, Weight: 1},
+	}, &metrics.NilMetricsWriter{}, ReplicatedOptions{Cooldown: time.Minute, HealthCheckInterval: 5 * time.Millisecond, HealthCheckTimeout: 10 * time.Millisecond})
+
+	// the hung replica times out without holding up the others, and later
+	// checks wait for it rather than checking it again
+	start := time.Now()
+	if err := rs.HealthCheck(); err != nil {
+		t.Fatalf("Expected the healthcheck to pass on the working replica, got %s", err.Error())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the hung replica to time out, but the healthcheck took %s", elapsed)
+	}
+	if rs.replicas[0].isHealthy(time.Now()) || !rs.replicas[1].isHealthy(time.Now()) {
+		t.Fatalf("Expected only the hung replica to be excluded")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if checks := atomic.LoadInt32(&hung.checks); checks != 1 {
+		t.Fatalf("Expected the hung replica to be checked once, got %d checks", checks)
+	}
+
+	// closing stops the periodic healthchecks
+	rs.Close()
+	checks := atomic.LoadInt32(&working.checks)
+	time.Sleep(50 * time.Millisecond)
+	if after := atomic.LoadInt32(&working.checks); after != checks {
+		t.Fatalf("Expected no healthchecks once closed, got %d more", after-checks)
+	}
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// The backoff between retries, unless configured otherwise
+const (
+	DefaultRetryBaseDelay = 50 * time.Millisecond
+	DefaultRetryMaxDelay  = time.Second
+)
+
+// IsTransientError returns true when a fetch which failed with err may
+// succeed if it's made again: timeouts, reset connections, 5xx responses
+// and S3 asking for requests to slow down.
+func IsTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Status >= 500 || statusErr.Status == 429
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		if reqErr.StatusCode() >= 500 {
+			return true
+		}
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "SlowDown", "RequestTimeout", "Throttling", "ThrottlingException", "RequestError":
+			return true
+		}
+		if awsErr.OrigErr() != nil {
+			return IsTransientError(awsErr.OrigErr())
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// RetriedError is the error of a fetch which failed after being retried.
+type RetriedError struct {
+	Retries int
+	Err     error
+}
+
+func (e *RetriedError) Error() string {
+	return fmt.Sprintf("after %d retries: %s", e.Retries, e.Err.Error())
+}
+
+func (e *RetriedError) Unwrap() error {
+	return e.Err
+}
+
+// RetryOptions are the settings of a RetryStorage.
+type RetryOptions struct {
+	// MaxRetries is the most times a fetch is made again after failing.
+	MaxRetries int
+	// BaseDelay is the backoff before the first retry, doubling for each
+	// one after, up to MaxDelay. A random part of each delay is waited,
+	// so that retries from many requests are spread out.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// RetryStorage makes the fetches of another storage again when they fail
+// with a transient error, backing off exponentially with jitter, so that a
+// single dropped connection or throttled request doesn't fail the request
+// for the tile. Responses record the retries they took in their Retries,
+// and errors after retries are RetriedErrors. Health checks aren't retried.
+type RetryStorage struct {
+	storage Storage
+	options RetryOptions
+	// rand returns a number in [0, 1), replaced by tests
+	rand func() float64
+}
+
+var _ ContextFetcher = &RetryStorage{}
+var _ RangeFetcher = &RetryStorage{}
+var _ MetadataReader = &RetryStorage{}
+var _ KeyResolver = &RetryStorage{}
+var _ Lister = &RetryStorage{}
+
+func NewRetryStorage(storage Storage, options RetryOptions) *RetryStorage {
+	if options.BaseDelay <= 0 {
+		options.BaseDelay = DefaultRetryBaseDelay
+	}
+	if options.MaxDelay <= 0 {
+		options.MaxDelay = DefaultRetryMaxDelay
+	}
+	return &RetryStorage{
+		storage: storage,
+		options: options,
+		rand:    rand.Float64,
+	}
+}
+
+// delay returns the backoff before the given retry, counting from 0.
+func (rs *RetryStorage) delay(retry int) time.Duration {
+	d := rs.options.BaseDelay
+	for i := 0; i < retry && d < rs.options.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > rs.options.MaxDelay {
+		d = rs.options.MaxDelay
+	}
+	return time.Duration(rs.rand() * float64(d))
+}
+
+// try fetches until the fetch succeeds, fails with an error which isn't
+// transient, or runs out of retries. Once ctx is done it stops.
+func (rs *RetryStorage) try(ctx context.Context, fetch func() (*StorageResponse, error)) (*StorageResponse, error) {
+	for retry := 0; ; retry++ {
+		resp, err := fetch()
+		if err == nil {
+			resp.Retries += retry
+			return resp, nil
+		}
+		if retry >= rs.options.MaxRetries || !IsTransientError(err) || ctx.Err() != nil {
+			if retry > 0 {
+				return nil, &RetriedError{Retries: retry, Err: err}
+			}
+			return nil, err
+		}
+
+		timer := time.NewTimer(rs.delay(retry))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, &RetriedError{Retries: retry, Err: err}
+		}
+	}
+}
+
+func (rs *RetryStorage) Fetch(t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return rs.FetchContext(context.Background(), t, c, prefixOverride, keyVars)
+}
+
+func (rs *RetryStorage) FetchContext(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return rs.try(ctx, func() (*StorageResponse, error) {
+		return FetchContext(ctx, rs.storage, t, c, prefixOverride, keyVars)
+	})
+}
+
+// FetchRanges retries the first request for the metatile, but not the
+// ranged requests which follow.
+func (rs *RetryStorage) FetchRanges(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	return rs.try(ctx, func() (*StorageResponse, error) {
+		return FetchRanges(ctx, rs.storage, t, c, prefixOverride, keyVars)
+	})
+}
+
+func (rs *RetryStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*StorageResponse, error) {
+	return rs.try(context.Background(), func() (*StorageResponse, error) {
+		return rs.storage.TileJson(f, c, prefixOverride)
+	})
+}
+
+func (rs *RetryStorage) ReadMetadata(name, prefixOverride string) (*StorageResponse, error) {
+	reader, ok := rs.storage.(MetadataReader)
+	if !ok {
+		return nil, fmt.Errorf("storage can't read metadata")
+	}
+	return rs.try(context.Background(), func() (*StorageResponse, error) {
+		return reader.ReadMetadata(name, prefixOverride)
+	})
+}
+
+func (rs *RetryStorage) ResolveKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	resolver, ok := rs.storage.(KeyResolver)
+	if !ok {
+		return "", fmt.Errorf("storage can't resolve keys")
+	}
+	return resolver.ResolveKey(t, prefixOverride, keyVars)
+}
+
+func (rs *RetryStorage) List(prefix, after string, limit int) (*ListResult, error) {
+	lister, ok := rs.storage.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("storage can't list keys")
+	}
+	return lister.List(prefix, after, limit)
+}
+
+func (rs *RetryStorage) HealthCheck() error {
+	return rs.storage.HealthCheck()
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// flakyStorage fails its first failures fetches with err.
+type flakyStorage struct {
+	countingStorage
+	failures int
+}
+
+func (f *flakyStorage) Fetch(t tile.TileCoord, cond state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	if f.failures > 0 {
+		f.failures--
+		f.fetches++
+		return nil, f.err
+	}
+	return &StorageResponse{Response: &SuccessfulResponse{Body: []byte("{}")}}, nil
+}
+
+func TestIsTransientError(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{awserr.New("SlowDown", "reduce your request rate", nil), true},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "", nil), http.StatusServiceUnavailable, ""), true},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), http.StatusForbidden, ""), false},
+		{&StatusError{Status: http.StatusBadGateway}, true},
+		{&StatusError{Status: http.StatusTooManyRequests}, true},
+		{&StatusError{Status: http.StatusForbidden}, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("invalid key pattern"), false},
+	} {
+		if IsTransientError(tc.err) != tc.transient {
+			t.Fatalf("Expected transient %t for %#v", tc.transient, tc.err)
+		}
+	}
+}
+
+func TestRetryStorage(t *testing.T) {
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	newRetryStorage := func(stg Storage) *RetryStorage {
+		rs := NewRetryStorage(stg, RetryOptions{MaxRetries: 2})
+		rs.rand = func() float64 { return 0 }
+		return rs
+	}
+
+	flaky := &flakyStorage{countingStorage: countingStorage{err: awserr.New("SlowDown", "", nil)}, failures: 2}
+	resp, err := newRetryStorage(flaky).Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil {
+		t.Fatalf("Expected the fetch to succeed on its last retry, got %#v, %v", resp, err)
+	}
+	if resp.Retries != 2 {
+		t.Fatalf("Expected the response to record 2 retries, got %d", resp.Retries)
+	}
+
+	flaky = &flakyStorage{countingStorage: countingStorage{err: awserr.New("SlowDown", "", nil)}, failures: 3}
+	_, err = newRetryStorage(flaky).Fetch(coord, state.Condition{}, "", nil)
+	var retried *RetriedError
+	if !errors.As(err, &retried) || retried.Retries != 2 || flaky.fetches != 3 {
+		t.Fatalf("Expected a retried error after 2 retries, got %v after %d fetches", err, flaky.fetches)
+	}
+
+	flaky = &flakyStorage{countingStorage: countingStorage{err: errors.New("bad key")}, failures: 1}
+	_, err = newRetryStorage(flaky).Fetch(coord, state.Condition{}, "", nil)
+	if err == nil || errors.As(err, &retried) || flaky.fetches != 1 {
+		t.Fatalf("Expected a permanent error not to be retried, got %v after %d fetches", err, flaky.fetches)
+	}
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+)
+
+// revalidationMaxEntries bounds the objects a revalidation cache keeps, as
+// the keys can come from request parameters such as the buildid.
+const revalidationMaxEntries = 1024
+
+// revalidationCache keeps small, frequently polled objects such as tilejson
+// and build manifests in process. Within the TTL of reading an object it is
+// served without asking storage at all, and after that it's revalidated with
+// its ETag so that an unchanged object isn't transferred again.
+type revalidationCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*revalidationEntry
+}
+
+type revalidationEntry struct {
+	response  *SuccessfulResponse
+	checkedAt time.Time
+}
+
+func newRevalidationCache(ttl time.Duration) *revalidationCache {
+	return &revalidationCache{
+		ttl:     ttl,
+		entries: make(map[string]*revalidationEntry),
+	}
+}
+
+// fetch returns the object at key, using get to read or revalidate it when
+// the cached copy is missing or older than the TTL. The request condition is
+// evaluated against the cached object, rather than passed on to storage.
+func (rc *revalidationCache) fetch(key string, c state.Condition, get func(key string, c state.Condition) (*StorageResponse, error)) (*StorageResponse, error) {
+	rc.mu.Lock()
+	entry := rc.entries[key]
+	rc.mu.Unlock()
+
+	now := time.Now()
+	if entry == nil || now.Sub(entry.checkedAt) >= rc.ttl {
+		var cond state.Condition
+		if entry != nil && entry.response.ETag != nil {
+			cond.IfNoneMatch = entry.response.ETag
+		}
+		result, err := get(key, cond)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case result.NotModified && entry != nil:
+			entry = &revalidationEntry{response: entry.response, checkedAt: now}
+			rc.put(key, entry)
+		case result.Response != nil:
+			entry = &revalidationEntry{response: result.Response, checkedAt: now}
+			rc.put(key, entry)
+		default:
+			rc.mu.Lock()
+			delete(rc.entries, key)
+			rc.mu.Unlock()
+			return result, nil
+		}
+	}
+
+	if isNotModified(c, entry.response.LastModified, entry.response.ETag) {
+		return &StorageResponse{NotModified: true}, nil
+	}
+	return &StorageResponse{Response: entry.response}, nil
+}
+
+// put stores the entry, dropping expired entries to make room when full. If
+// there is still no room the entry isn't kept.
+func (rc *revalidationCache) put(key string, entry *revalidationEntry) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if _, ok := rc.entries[key]; !ok && len(rc.entries) >= revalidationMaxEntries {
+		for k, e := range rc.entries {
+			if entry.checkedAt.Sub(e.checkedAt) >= rc.ttl {
+				delete(rc.entries, k)
+			}
+		}
+		if len(rc.entries) >= revalidationMaxEntries {
+			return
+		}
+	}
+	rc.entries[key] = entry
+}
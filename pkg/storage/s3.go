@@ -1,20 +1,84 @@
 package storage
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
 	"io/ioutil"
 	"strconv"
+	"time"
 
 	"github.com/tilezen/tapalcatl/pkg/state"
 	"github.com/tilezen/tapalcatl/pkg/tile"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/imkira/go-interpol"
 )
 
+const (
+	// HealthcheckMethod_Head checks the healthcheck key exists with HeadObject.
+	HealthcheckMethod_Head = "head"
+	// HealthcheckMethod_Get fetches the whole healthcheck object with GetObject.
+	HealthcheckMethod_Get = "get"
+	// HealthcheckMethod_List lists at most one key under the healthcheck prefix with ListObjectsV2.
+	HealthcheckMethod_List = "list"
+)
+
+// S3Options holds the optional settings of an S3Storage. The zero value
+// gives the default behaviour.
+type S3Options struct {
+	// HealthcheckMethod is one of the HealthcheckMethod_ constants, default head.
+	HealthcheckMethod string
+	// KeyVariables are extra fixed variables available to the key pattern.
+	KeyVariables map[string]string
+	// Hash computes the {hash} key variable, default DefaultHashScheme.
+	Hash HashFunc
+	// HashCompatibility is one of the HashCompatibility_ constants, choosing
+	// the path which is hashed. When empty it's inferred from the layer
+	// with InferHashCompatibility.
+	HashCompatibility string
+	// RevalidateTTL, if positive, keeps tilejson and metadata objects in
+	// process for this long before revalidating them with their ETag.
+	RevalidateTTL time.Duration
+	// MinRange is the least FetchRanges fetches in a request, default
+	// DefaultMinRange.
+	MinRange int64
+	// RequesterPays is set for requester pays buckets, acknowledging that
+	// the requests are charged to this account rather than the bucket's.
+	RequesterPays bool
+	// SSECustomerKey, if set, is the 256 bit key the objects are encrypted
+	// with by S3 (SSE-C), sent with each request to read them. Objects
+	// encrypted with KMS keys (SSE-KMS) need no key in requests.
+	SSECustomerKey []byte
+	// HeadConditional checks the validators of metatiles with HeadObject
+	// before fetching them when the request is conditional, responding not
+	// modified without transferring the body when they match.
+	HeadConditional bool
+	// BuildVersions maps build IDs to the time of the build in a versioned
+	// bucket. Requests for one of these builds are served from the versions
+	// of the default prefix's objects which were current at that time,
+	// rather than from a prefix named by the build.
+	BuildVersions map[string]time.Time
+}
+
+// builtinKeyVariables are always set by the storage and can't be overridden.
+var builtinKeyVariables = []string{"z", "x", "y", "fmt", "hash", "prefix", "layer"}
+
+// IsBuiltinKeyVariable returns true when name is set by the storage itself,
+// so can't be supplied by configuration or the request.
+func IsBuiltinKeyVariable(name string) bool {
+	for _, builtin := range builtinKeyVariables {
+		if name == builtin {
+			return true
+		}
+	}
+	return false
+}
+
 type S3Storage struct {
 	client          s3iface.S3API
 	bucket          string
@@ -23,83 +87,152 @@ type S3Storage struct {
 	defaultPrefix   string
 	layer           string
 	healthcheck     string
+	options         S3Options
+	// set when options.RevalidateTTL is positive
+	revalidation *revalidationCache
 }
 
 func NewS3Storage(api s3iface.S3API, bucket, keyPattern, defaultPrefix, layer, healthcheck string) *S3Storage {
-	return &S3Storage{
+	return NewS3StorageWithOptions(api, bucket, keyPattern, defaultPrefix, layer, healthcheck, S3Options{})
+}
+
+func NewS3StorageWithOptions(api s3iface.S3API, bucket, keyPattern, defaultPrefix, layer, healthcheck string, options S3Options) *S3Storage {
+	if options.HealthcheckMethod == "" {
+		options.HealthcheckMethod = HealthcheckMethod_Head
+	}
+	if options.Hash == nil {
+		options.Hash, _ = NewHashFunc(DefaultHashScheme)
+	}
+	if options.HashCompatibility == "" {
+		options.HashCompatibility = InferHashCompatibility(layer)
+	}
+	if options.MinRange <= 0 {
+		options.MinRange = DefaultMinRange
+	}
+
+	s := &S3Storage{
 		client:        api,
 		bucket:        bucket,
 		keyPattern:    keyPattern,
 		defaultPrefix: defaultPrefix,
 		layer:         layer,
 		healthcheck:   healthcheck,
+		options:       options,
+	}
+	if options.RevalidateTTL > 0 {
+		s.revalidation = newRevalidationCache(options.RevalidateTTL)
 	}
+	return s
 }
 
-func (s *S3Storage) s3Hash(t tile.TileCoord) string {
+// IsValidHealthcheckMethod returns true when method is one of the HealthcheckMethod_ constants.
+func IsValidHealthcheckMethod(method string) bool {
+	switch method {
+	case HealthcheckMethod_Head, HealthcheckMethod_Get, HealthcheckMethod_List:
+		return true
+	}
+	return false
+}
+
+// tileHash computes the {hash} key variable of the tile with hash.
+func tileHash(hash HashFunc, compatibility, layer string, t tile.TileCoord) string {
 	toHash := fmt.Sprintf("%d/%d/%d.%s", t.Z, t.X, t.Y, t.Format)
 
 	// In versions of code before https://github.com/tilezen/tilequeue/pull/344,
 	// we included the layer and leading slash in the hashed string. after that
 	// PR, we no longer support having a layer in the path and _also_ drop the
 	// leading slash from the hashed string.
-	if s.layer != "" {
-		toHash = fmt.Sprintf("/%s/%s", s.layer, toHash)
+	if compatibility == HashCompatibility_LegacyLayerSlash {
+		toHash = fmt.Sprintf("/%s/%s", layer, toHash)
 	}
 
-	hash := md5.Sum([]byte(toHash))
+	return hash(toHash)
+}
 
-	return fmt.Sprintf("%x", hash)[0:5]
+// keyVariables returns the variables available to a key pattern for the
+// tile. Request variables take precedence over configured ones, but neither
+// can replace the builtin variables.
+func keyVariables(t tile.TileCoord, hash, prefix, layer string, configured, request map[string]string) map[string]string {
+	m := make(map[string]string, len(builtinKeyVariables)+len(configured)+len(request))
+	for k, v := range configured {
+		m[k] = v
+	}
+	for k, v := range request {
+		m[k] = v
+	}
+	m["z"] = strconv.Itoa(t.Z)
+	m["x"] = strconv.Itoa(t.X)
+	m["y"] = strconv.Itoa(t.Y)
+	m["fmt"] = t.Format
+	m["hash"] = hash
+	m["prefix"] = prefix
+	m["layer"] = layer
+	return m
 }
 
-func (s *S3Storage) objectKey(t tile.TileCoord, prefixOverride string) (string, error) {
+func (s *S3Storage) objectKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
 	actualPrefix := s.defaultPrefix
 	if prefixOverride != "" {
 		actualPrefix = prefixOverride
 	}
 
-	m := map[string]string{
-		"z":      strconv.Itoa(t.Z),
-		"x":      strconv.Itoa(t.X),
-		"y":      strconv.Itoa(t.Y),
-		"fmt":    t.Format,
-		"hash":   s.s3Hash(t),
-		"prefix": actualPrefix,
-		"layer":  s.layer,
+	hash := tileHash(s.options.Hash, s.options.HashCompatibility, s.layer, t)
+	m := keyVariables(t, hash, actualPrefix, s.layer, s.options.KeyVariables, keyVars)
+	return interpol.WithMap(s.keyPattern, m)
+}
+
+// ResolveKey returns the S3 key which Fetch would request for the tile. For
+// builds served from versions it's followed by the time of the version.
+func (s *S3Storage) ResolveKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	if asOf, ok := s.buildVersion(prefixOverride); ok {
+		key, err := s.objectKey(t, "", keyVars)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s?versionAsOf=%s", key, asOf.Format(time.RFC3339)), nil
 	}
+	return s.objectKey(t, prefixOverride, keyVars)
+}
 
-	return interpol.WithMap(s.keyPattern, m)
+// requestPayer returns the RequestPayer of the storage's requests, nil
+// unless the bucket is requester pays.
+func (s *S3Storage) requestPayer() *string {
+	if !s.options.RequesterPays {
+		return nil
+	}
+	return aws.String(s3.RequestPayerRequester)
+}
+
+// sseCustomerKey returns the algorithm and key of the storage's requests for
+// objects, both nil unless they're encrypted with a customer key.
+func (s *S3Storage) sseCustomerKey() (*string, *string) {
+	if len(s.options.SSECustomerKey) == 0 {
+		return nil, nil
+	}
+	// the sdk encodes the key and adds its MD5
+	return aws.String(s3.ServerSideEncryptionAes256), aws.String(string(s.options.SSECustomerKey))
 }
 
 func (s *S3Storage) respondWithKey(key string, c state.Condition) (*StorageResponse, error) {
+	return s.respondWithGet(s.client.GetObject, key, c)
+}
+
+// respondWithGet requests the key with get, which is GetObject or a
+// GetObjectWithContext bound to a context. S3 only compares strong
+// validators, so weak prefixes, eg. added by a CDN, are stripped from the
+// condition.
+func (s *S3Storage) respondWithGet(get func(*s3.GetObjectInput) (*s3.GetObjectOutput, error), key string, c state.Condition) (*StorageResponse, error) {
 	var result *StorageResponse
 
-	input := &s3.GetObjectInput{Bucket: &s.bucket, Key: &key}
+	input := &s3.GetObjectInput{Bucket: &s.bucket, Key: &key, RequestPayer: s.requestPayer()}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = s.sseCustomerKey()
 	input.IfModifiedSince = c.IfModifiedSince
-	input.IfNoneMatch = c.IfNoneMatch
+	input.IfNoneMatch = normalizeCondition(c).IfNoneMatch
 
-	output, err := s.client.GetObject(input)
+	output, err := get(input)
 	// check if we are an error, 304, or 404
 	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			// NOTE: the way to distinguish seems to be string matching on the code ...
-			switch awsErr.Code() {
-			case "NoSuchKey":
-				result = &StorageResponse{
-					NotFound: true,
-				}
-				return result, nil
-			case "NotModified":
-				result = &StorageResponse{
-					NotModified: true,
-				}
-				return result, nil
-			default:
-				return nil, err
-			}
-		}
-
-		return nil, err
+		return respondWithGetError(err)
 	}
 
 	// ensure that it's safe to always close the body upstream
@@ -112,6 +245,14 @@ func (s *S3Storage) respondWithKey(key string, c state.Condition) (*StorageRespo
 		if err != nil {
 			return nil, err
 		}
+		// objects stored gzipped are decompressed here, unless the http
+		// client already did so, in which case it removed the encoding
+		if isGzipEncoding(output.ContentEncoding) {
+			body, err = gunzip(body)
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %w", key, err)
+			}
+		}
 
 		if output.ContentLength != nil {
 			storageSize = uint64(*output.ContentLength)
@@ -130,33 +271,382 @@ func (s *S3Storage) respondWithKey(key string, c state.Condition) (*StorageRespo
 	return result, nil
 }
 
-func (s *S3Storage) Fetch(t tile.TileCoord, c state.Condition, prefixOverride string) (*StorageResponse, error) {
-	key, err := s.objectKey(t, prefixOverride)
+// respondWithGetError maps the errors for missing and not modified objects
+// to their responses, and those for objects in Glacier to ArchivedErrors,
+// returning other errors as they are.
+func respondWithGetError(err error) (*StorageResponse, error) {
+	if awsErr, ok := err.(awserr.Error); ok {
+		// NOTE: the way to distinguish seems to be string matching on the code ...
+		switch awsErr.Code() {
+		case "NoSuchKey":
+			return &StorageResponse{NotFound: true}, nil
+		case "NotModified":
+			return &StorageResponse{NotModified: true}, nil
+		case "InvalidObjectState":
+			return nil, &ArchivedError{Err: err}
+		}
+	}
+	return nil, err
+}
+
+// buildVersion returns the time of the build's versions, if it's one of the
+// BuildVersions.
+func (s *S3Storage) buildVersion(prefixOverride string) (time.Time, bool) {
+	if prefixOverride == "" {
+		return time.Time{}, false
+	}
+	asOf, ok := s.options.BuildVersions[prefixOverride]
+	return asOf, ok
+}
+
+// versionAsOf returns the ID of the version of key which was current at
+// asOf, or "" if there was none or the key was deleted then.
+func (s *S3Storage) versionAsOf(ctx context.Context, key string, asOf time.Time) (string, error) {
+	var newest *time.Time
+	var versionID string
+	consider := func(k *string, lastModified *time.Time, id *string, deleted bool) {
+		if k == nil || *k != key || lastModified == nil || lastModified.After(asOf) {
+			return
+		}
+		if newest == nil || lastModified.After(*newest) {
+			newest = lastModified
+			versionID = ""
+			if !deleted && id != nil {
+				versionID = *id
+			}
+		}
+	}
+
+	// the SDK's ListObjectVersionsInput has no RequestPayer, so the header
+	// is set directly
+	var opts []request.Option
+	if payer := s.requestPayer(); payer != nil {
+		opts = append(opts, request.WithSetRequestHeaders(map[string]string{"X-Amz-Request-Payer": *payer}))
+	}
+	input := &s3.ListObjectVersionsInput{Bucket: &s.bucket, Prefix: &key}
+	for {
+		output, err := s.client.ListObjectVersionsWithContext(ctx, input, opts...)
+		if err != nil {
+			return "", err
+		}
+		for _, v := range output.Versions {
+			consider(v.Key, v.LastModified, v.VersionId, false)
+		}
+		for _, m := range output.DeleteMarkers {
+			consider(m.Key, m.LastModified, m.VersionId, true)
+		}
+		if output.IsTruncated == nil || !*output.IsTruncated {
+			return versionID, nil
+		}
+		input.KeyMarker, input.VersionIdMarker = output.NextKeyMarker, output.NextVersionIdMarker
+	}
+}
+
+// respondWithVersion requests the version of key which was current at asOf.
+func (s *S3Storage) respondWithVersion(ctx context.Context, key string, asOf time.Time, c state.Condition) (*StorageResponse, error) {
+	versionID, err := s.versionAsOf(ctx, key, asOf)
 	if err != nil {
 		return nil, err
 	}
+	if versionID == "" {
+		return &StorageResponse{NotFound: true}, nil
+	}
+	get := func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		input.VersionId = &versionID
+		return s.client.GetObjectWithContext(ctx, input)
+	}
+	return s.respondWithGet(get, key, c)
+}
 
+// respondWithHead checks the condition against the key's validators with
+// head, which is HeadObject or a HeadObjectWithContext bound to a context,
+// when the storage has HeadConditional set. It returns a nil response when
+// the object should be fetched.
+func (s *S3Storage) respondWithHead(head func(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error), key string, c state.Condition) (*StorageResponse, error) {
+	if !s.options.HeadConditional || (c.IfNoneMatch == nil && c.IfModifiedSince == nil) {
+		return nil, nil
+	}
+
+	input := &s3.HeadObjectInput{Bucket: &s.bucket, Key: &key, RequestPayer: s.requestPayer()}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = s.sseCustomerKey()
+	output, err := head(input)
+	if err != nil {
+		// HeadObject has no body to give the NoSuchKey code in
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NotFound" {
+			return &StorageResponse{NotFound: true}, nil
+		}
+		return nil, err
+	}
+	if isNotModified(c, output.LastModified, output.ETag) {
+		return &StorageResponse{NotModified: true}, nil
+	}
+	return nil, nil
+}
+
+func (s *S3Storage) Fetch(t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	if _, ok := s.buildVersion(prefixOverride); ok {
+		return s.FetchContext(context.Background(), t, c, prefixOverride, keyVars)
+	}
+	key, err := s.objectKey(t, prefixOverride, keyVars)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, err := s.respondWithHead(s.client.HeadObject, key, c); resp != nil || err != nil {
+		return resp, err
+	}
 	return s.respondWithKey(key, c)
 }
 
+// FetchContext is Fetch, abandoning the request to S3 when ctx is done.
+func (s *S3Storage) FetchContext(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	if asOf, ok := s.buildVersion(prefixOverride); ok {
+		key, err := s.objectKey(t, "", keyVars)
+		if err != nil {
+			return nil, err
+		}
+		return s.respondWithVersion(ctx, key, asOf, c)
+	}
+	key, err := s.objectKey(t, prefixOverride, keyVars)
+	if err != nil {
+		return nil, err
+	}
+
+	head := func(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+		return s.client.HeadObjectWithContext(ctx, input)
+	}
+	if resp, err := s.respondWithHead(head, key, c); resp != nil || err != nil {
+		return resp, err
+	}
+	get := func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		return s.client.GetObjectWithContext(ctx, input)
+	}
+	return s.respondWithGet(get, key, c)
+}
+
+// FetchRanges fetches the end of the metatile, which holds the zip central
+// directory, and responds with a reader fetching the rest of it in ranges as
+// it's read. The ranged requests are made with If-Match on the metatile's
+// ETag, so that they fail rather than mix the parts of two metatiles if it's
+// replaced while it's being read.
+func (s *S3Storage) FetchRanges(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	// versions are read whole, as the ranges would each need the version
+	if _, ok := s.buildVersion(prefixOverride); ok {
+		return s.FetchContext(ctx, t, c, prefixOverride, keyVars)
+	}
+	key, err := s.objectKey(t, prefixOverride, keyVars)
+	if err != nil {
+		return nil, err
+	}
+
+	tail := fmt.Sprintf("bytes=-%d", s.options.MinRange)
+	input := &s3.GetObjectInput{Bucket: &s.bucket, Key: &key, Range: &tail, RequestPayer: s.requestPayer()}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = s.sseCustomerKey()
+	input.IfModifiedSince = c.IfModifiedSince
+	input.IfNoneMatch = normalizeCondition(c).IfNoneMatch
+	output, err := s.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		// empty objects have no range to read, so are fetched whole
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidRange" {
+			return s.FetchContext(ctx, t, c, prefixOverride, keyVars)
+		}
+		return respondWithGetError(err)
+	}
+	// the parts of gzipped objects can't be read on their own
+	if isGzipEncoding(output.ContentEncoding) {
+		output.Body.Close()
+		return s.FetchContext(ctx, t, c, prefixOverride, keyVars)
+	}
+	body, err := ioutil.ReadAll(output.Body)
+	output.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// objects smaller than the range are returned whole
+	first := rangeBlock{offset: 0, data: body}
+	size := int64(len(body))
+	if output.ContentRange != nil {
+		var end int64
+		if _, err := fmt.Sscanf(*output.ContentRange, "bytes %d-%d/%d", &first.offset, &end, &size); err != nil {
+			return nil, fmt.Errorf("unexpected content range %#v for %s: %w", *output.ContentRange, key, err)
+		}
+	}
+
+	etag := output.ETag
+	fetch := func(start, end int64) ([]byte, error) {
+		byteRange := fmt.Sprintf("bytes=%d-%d", start, end-1)
+		input := &s3.GetObjectInput{
+			Bucket:       &s.bucket,
+			Key:          &key,
+			Range:        &byteRange,
+			IfMatch:      etag,
+			RequestPayer: s.requestPayer(),
+		}
+		input.SSECustomerAlgorithm, input.SSECustomerKey = s.sseCustomerKey()
+		output, err := s.client.GetObjectWithContext(ctx, input)
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "PreconditionFailed" {
+				return nil, fmt.Errorf("metatile %s changed while it was read: %w", key, err)
+			}
+			return nil, err
+		}
+		defer output.Body.Close()
+		return ioutil.ReadAll(output.Body)
+	}
+
+	return &StorageResponse{
+		Response: &SuccessfulResponse{
+			LastModified: output.LastModified,
+			ETag:         etag,
+			Size:         uint64(size),
+			Ranges:       newRangeReader(size, s.options.MinRange, fetch, first),
+		},
+	}, nil
+}
+
 func (s *S3Storage) HealthCheck() error {
-	input := &s3.GetObjectInput{Bucket: &s.bucket, Key: &s.healthcheck}
-	resp, err := s.client.GetObject(input)
-	if resp != nil && resp.Body != nil {
-		resp.Body.Close()
+	switch s.options.HealthcheckMethod {
+	case HealthcheckMethod_Get:
+		input := &s3.GetObjectInput{Bucket: &s.bucket, Key: &s.healthcheck, RequestPayer: s.requestPayer()}
+		input.SSECustomerAlgorithm, input.SSECustomerKey = s.sseCustomerKey()
+		resp, err := s.client.GetObject(input)
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+		return err
+
+	case HealthcheckMethod_List:
+		var maxKeys int64 = 1
+		input := &s3.ListObjectsV2Input{Bucket: &s.bucket, Prefix: &s.healthcheck, MaxKeys: &maxKeys, RequestPayer: s.requestPayer()}
+		resp, err := s.client.ListObjectsV2(input)
+		if err != nil {
+			return err
+		}
+		if len(resp.Contents) == 0 {
+			return fmt.Errorf("no keys found under healthcheck prefix %#v", s.healthcheck)
+		}
+		return nil
+
+	default:
+		input := &s3.HeadObjectInput{Bucket: &s.bucket, Key: &s.healthcheck, RequestPayer: s.requestPayer()}
+		input.SSECustomerAlgorithm, input.SSECustomerKey = s.sseCustomerKey()
+		_, err := s.client.HeadObject(input)
+		return err
 	}
-	return err
 }
 
-func (s *S3Storage) TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*StorageResponse, error) {
-	filename := f.Name()
-	toHash := fmt.Sprintf("/tilejson/%s.json", filename)
+// List lists keys in the bucket with ListObjectsV2, so limit can't usefully
+// be more than the 1000 keys S3 returns at once.
+func (s *S3Storage) List(prefix, after string, limit int) (*ListResult, error) {
+	maxKeys := int64(limit)
+	input := &s3.ListObjectsV2Input{Bucket: &s.bucket, Prefix: &prefix, MaxKeys: &maxKeys, RequestPayer: s.requestPayer()}
+	if after != "" {
+		input.StartAfter = &after
+	}
+	resp, err := s.client.ListObjectsV2(input)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ListResult{Keys: make([]string, 0, len(resp.Contents))}
+	for _, object := range resp.Contents {
+		if object.Key != nil {
+			result.Keys = append(result.Keys, *object.Key)
+		}
+	}
+	result.Truncated = resp.IsTruncated != nil && *resp.IsTruncated
+	return result, nil
+}
+
+// ReadMetadata reads the object with the given name directly under the prefix.
+func (s *S3Storage) ReadMetadata(name, prefixOverride string) (*StorageResponse, error) {
+	if asOf, ok := s.buildVersion(prefixOverride); ok {
+		return s.respondWithVersion(context.Background(), fmt.Sprintf("%s/%s", s.defaultPrefix, name), asOf, state.Condition{})
+	}
+	actualPrefix := s.defaultPrefix
+	if prefixOverride != "" {
+		actualPrefix = prefixOverride
+	}
+	key := fmt.Sprintf("%s/%s", actualPrefix, name)
+	if s.revalidation != nil {
+		return s.revalidation.fetch(key, state.Condition{}, s.respondWithKey)
+	}
+	return s.respondWithKey(key, state.Condition{})
+}
+
+// ReadRange reads part of the object with the given name directly under the
+// prefix with a Range request. For BuildVersions, it reads the version of
+// the object under the default prefix, as ReadMetadata does.
+func (s *S3Storage) ReadRange(name, prefixOverride string, offset, length int64) ([]byte, error) {
+	actualPrefix := s.defaultPrefix
+	asOf, versioned := s.buildVersion(prefixOverride)
+	if prefixOverride != "" && !versioned {
+		actualPrefix = prefixOverride
+	}
+	key := fmt.Sprintf("%s/%s", actualPrefix, name)
+	byteRange := fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	input := &s3.GetObjectInput{Bucket: &s.bucket, Key: &key, Range: &byteRange, RequestPayer: s.requestPayer()}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = s.sseCustomerKey()
+	if versioned {
+		versionID, err := s.versionAsOf(context.Background(), key, asOf)
+		if err != nil {
+			return nil, err
+		}
+		if versionID == "" {
+			return nil, fmt.Errorf("no version of %s as of %s", key, asOf.Format(time.RFC3339))
+		}
+		input.VersionId = &versionID
+	}
+	output, err := s.client.GetObjectWithContext(context.Background(), input)
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	data, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("ranged read of %s returned %d bytes rather than %d", key, len(data), length)
+	}
+	return data, nil
+}
+
+// tileJsonKey returns the key of the tilejson of the format under prefix.
+func tileJsonKey(f state.TileJsonFormat, prefix string) string {
+	toHash := fmt.Sprintf("/tilejson/%s.json", f.Name())
 	hash := md5.Sum([]byte(toHash))
 	hashUrlPathSegment := fmt.Sprintf("%x", hash)[0:5]
+	return fmt.Sprintf("%s/%s/%s", prefix, hashUrlPathSegment, toHash)
+}
+
+// TileJson reads the tilejson under the prefix, or for BuildVersions, the
+// version of the tilejson under the default prefix.
+func (s *S3Storage) TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*StorageResponse, error) {
+	asOf, versioned := s.buildVersion(prefixOverride)
 	actualPrefix := s.defaultPrefix
-	if prefixOverride != "" {
+	if prefixOverride != "" && !versioned {
 		actualPrefix = prefixOverride
 	}
-	key := fmt.Sprintf("%s/%s/%s", actualPrefix, hashUrlPathSegment, toHash)
-	return s.respondWithKey(key, c)
+	key := tileJsonKey(f, actualPrefix)
+	if s.revalidation != nil && !versioned {
+		return s.revalidation.fetch(key, c, s.respondWithKey)
+	}
+
+	// re-check the condition ourselves in case S3 still responded
+	var result *StorageResponse
+	var err error
+	if versioned {
+		result, err = s.respondWithVersion(context.Background(), key, asOf, c)
+	} else {
+		result, err = s.respondWithKey(key, c)
+	}
+	if err != nil || result.Response == nil {
+		return result, err
+	}
+	if isNotModified(c, result.Response.LastModified, result.Response.ETag) {
+		return &StorageResponse{NotModified: true}, nil
+	}
+	return result, nil
 }
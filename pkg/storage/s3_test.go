@@ -1,15 +1,22 @@
 package storage
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"net/http"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/tilezen/tapalcatl/pkg/state"
@@ -58,7 +65,7 @@ func TestS3StorageEmpty(t *testing.T) {
 
 	storage := NewS3Storage(api, bucket, keyPattern, prefix, layer, healthcheck)
 
-	resp, err := storage.Fetch(tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}, state.Condition{}, "actualprefix")
+	resp, err := storage.Fetch(tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}, state.Condition{}, "actualprefix", nil)
 	if err != nil {
 		t.Fatalf("Unable to Get tile from Mock S3: %s", err.Error())
 	}
@@ -82,7 +89,7 @@ func TestS3Storage(t *testing.T) {
 	storage := NewS3Storage(api, bucket, keyPattern, prefix, layer, healthcheck)
 
 	tile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
-	key, err := storage.objectKey(tile, "prefix")
+	key, err := storage.objectKey(tile, "prefix", nil)
 	if err != nil {
 		t.Fatalf("Unable to calculate key for tile: %s", err.Error())
 	}
@@ -90,7 +97,7 @@ func TestS3Storage(t *testing.T) {
 		t.Fatalf("Unexpected key calculation. Expected %#v, got %#v.", api.expectedKey, key)
 	}
 
-	resp, err := storage.Fetch(tile, state.Condition{}, "prefix")
+	resp, err := storage.Fetch(tile, state.Condition{}, "prefix", nil)
 	if err != nil {
 		t.Fatalf("Unable to Get tile from Mock S3: %s", err.Error())
 	}
@@ -125,6 +132,13 @@ func TestS3Storage(t *testing.T) {
 	}
 }
 
+func (m *mockS3) HeadObject(i *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if *i.Key == m.expectedKey || *i.Key == m.healthcheck {
+		return &s3.HeadObjectOutput{}, nil
+	}
+	return nil, awserr.New("NotFound", "The key was not found.", fmt.Errorf("Not Found."))
+}
+
 type nullBodyS3 struct {
 	s3iface.S3API
 }
@@ -148,6 +162,10 @@ func (n *nullBodyS3) GetObject(i *s3.GetObjectInput) (*s3.GetObjectOutput, error
 	return obj, nil
 }
 
+func (n *nullBodyS3) HeadObject(i *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return &s3.HeadObjectOutput{}, nil
+}
+
 // looks like sometimes the S3 body returned will be null, so we should check
 // that before trying to close it.
 func TestS3StorageNullBody(t *testing.T) {
@@ -161,7 +179,7 @@ func TestS3StorageNullBody(t *testing.T) {
 
 	storage := NewS3Storage(api, bucket, keyPattern, prefix, layer, healthcheck)
 
-	_, err := storage.Fetch(tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}, state.Condition{}, "actualprefix")
+	_, err := storage.Fetch(tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}, state.Condition{}, "actualprefix", nil)
 	if err != nil {
 		t.Fatalf("Unable to Get tile from null body S3: %s", err.Error())
 	}
@@ -181,6 +199,10 @@ func (e *errorS3) GetObject(i *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
 	return nil, errors.New("Error getting object from error S3")
 }
 
+func (e *errorS3) HeadObject(i *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return nil, errors.New("Error getting object from error S3")
+}
+
 func TestS3StorageError(t *testing.T) {
 	api := &errorS3{}
 
@@ -198,3 +220,608 @@ func TestS3StorageError(t *testing.T) {
 		t.Fatalf("Got an OK healthcheck from error storage")
 	}
 }
+
+// archivedS3 holds objects which have been lifecycled to Glacier.
+type archivedS3 struct {
+	s3iface.S3API
+}
+
+func (a *archivedS3) GetObject(i *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return nil, awserr.NewRequestFailure(awserr.New("InvalidObjectState", "The operation is not valid for the object's storage class", nil), 403, "")
+}
+
+func TestS3StorageArchived(t *testing.T) {
+	storage := NewS3Storage(&archivedS3{}, "bucket", "/{prefix}/{z}/{x}/{y}.{fmt}", "prefix", "", "")
+	_, err := storage.Fetch(tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}, state.Condition{}, "", nil)
+	var archived *ArchivedError
+	if !errors.As(err, &archived) {
+		t.Fatalf("Expected an archived error, got %v", err)
+	}
+	if IsTransientError(err) {
+		t.Fatalf("Expected an archived object not to be retried")
+	}
+}
+
+func TestS3StorageHealthcheckMethods(t *testing.T) {
+	healthcheck := "healthcheck"
+	api := &mockS3{healthcheck: healthcheck}
+
+	for _, method := range []string{HealthcheckMethod_Head, HealthcheckMethod_Get} {
+		storage := NewS3StorageWithOptions(api, "bucket", "/{z}/{x}/{y}.{fmt}", "prefix", "layer", healthcheck, S3Options{HealthcheckMethod: method})
+		if err := storage.HealthCheck(); err != nil {
+			t.Fatalf("Unable to healthcheck Mock S3 storage with %s, got error: %s", method, err.Error())
+		}
+	}
+
+	missing := NewS3Storage(api, "bucket", "/{z}/{x}/{y}.{fmt}", "prefix", "layer", "missing")
+	if err := missing.HealthCheck(); err == nil {
+		t.Fatalf("Expected healthcheck of missing key to fail")
+	}
+}
+
+func TestS3StorageKeyVariables(t *testing.T) {
+	keyPattern := "/{prefix}/{dataset}/{version}/{z}/{x}/{y}.{fmt}"
+	options := S3Options{KeyVariables: map[string]string{"dataset": "osm", "version": "v1", "z": "99"}}
+	storage := NewS3StorageWithOptions(&mockS3{}, "bucket", keyPattern, "prefix", "", "", options)
+
+	tile := tile.TileCoord{Z: 1, X: 2, Y: 3, Format: "zip"}
+	key, err := storage.objectKey(tile, "", map[string]string{"version": "v2"})
+	if err != nil {
+		t.Fatalf("Unable to calculate key for tile: %s", err.Error())
+	}
+	expKey := "/prefix/osm/v2/1/2/3.zip"
+	if key != expKey {
+		t.Fatalf("Unexpected key calculation. Expected %#v, got %#v.", expKey, key)
+	}
+}
+
+func TestS3StorageHashSchemes(t *testing.T) {
+	keyPattern := "/{prefix}/{hash}/{z}/{x}/{y}.{fmt}"
+	tile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+
+	expKeys := map[string]string{
+		"md5-5":     "/prefix/fa9bb/0/0/0.zip",
+		"md5-3":     "/prefix/fa9/0/0/0.zip",
+		"none":      "/prefix//0/0/0.zip",
+		"crc32-hex": "/prefix/" + fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte("/layer/0/0/0.zip"))) + "/0/0/0.zip",
+	}
+	for scheme, expKey := range expKeys {
+		hashFunc, err := NewHashFunc(scheme)
+		if err != nil {
+			t.Fatalf("Unable to create hash scheme %s: %s", scheme, err.Error())
+		}
+		storage := NewS3StorageWithOptions(&mockS3{}, "bucket", keyPattern, "prefix", "layer", "", S3Options{Hash: hashFunc})
+		key, err := storage.objectKey(tile, "", nil)
+		if err != nil {
+			t.Fatalf("Unable to calculate key for tile: %s", err.Error())
+		}
+		if key != expKey {
+			t.Fatalf("Unexpected key calculation for %s. Expected %#v, got %#v.", scheme, expKey, key)
+		}
+	}
+
+	for _, scheme := range []string{"md5", "md5-0", "md5-33", "sha256-5", "crc32"} {
+		if _, err := NewHashFunc(scheme); err == nil {
+			t.Fatalf("Expected invalid hash scheme %s to be rejected", scheme)
+		}
+	}
+}
+
+func TestS3StorageHashCompatibility(t *testing.T) {
+	keyPattern := "/{prefix}/{hash}/{layer}/{z}/{x}/{y}.{fmt}"
+	tile := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	sum := func(s string) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(s)))[:5]
+	}
+
+	for _, tc := range []struct {
+		layer, compatibility, expKey string
+	}{
+		{"layer", "", "/prefix/" + sum("/layer/0/0/0.zip") + "/layer/0/0/0.zip"},
+		{"", "", "/prefix/" + sum("0/0/0.zip") + "//0/0/0.zip"},
+		{"layer", HashCompatibility_LegacyLayerSlash, "/prefix/" + sum("/layer/0/0/0.zip") + "/layer/0/0/0.zip"},
+		{"layer", HashCompatibility_Tilequeue344, "/prefix/" + sum("0/0/0.zip") + "/layer/0/0/0.zip"},
+	} {
+		storage := NewS3StorageWithOptions(&mockS3{}, "bucket", keyPattern, "prefix", tc.layer, "", S3Options{HashCompatibility: tc.compatibility})
+		key, err := storage.objectKey(tile, "", nil)
+		if err != nil {
+			t.Fatalf("Unable to calculate key for tile: %s", err.Error())
+		}
+		if key != tc.expKey {
+			t.Fatalf("Unexpected key with layer %#v and compatibility %#v. Expected %#v, got %#v.", tc.layer, tc.compatibility, tc.expKey, key)
+		}
+	}
+}
+
+// countingS3 serves one object, counting the requests made for it and
+// responding 304 to requests with a matching If-None-Match.
+type countingS3 struct {
+	s3iface.S3API
+	etag        string
+	gets        int
+	notModified int
+}
+
+func (c *countingS3) GetObject(i *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	c.gets++
+	if i.IfNoneMatch != nil && *i.IfNoneMatch == c.etag {
+		c.notModified++
+		return nil, awserr.New("NotModified", "Not Modified", nil)
+	}
+	etag := c.etag
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(bytes.NewBufferString(`{"tiles": []}`)),
+		ETag: &etag,
+	}, nil
+}
+
+// headS3 is countingS3, also counting HeadObject requests.
+type headS3 struct {
+	countingS3
+	heads int
+}
+
+func (h *headS3) GetObjectWithContext(ctx aws.Context, i *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return h.GetObject(i)
+}
+
+func (h *headS3) HeadObject(i *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	h.heads++
+	etag := h.etag
+	return &s3.HeadObjectOutput{ETag: &etag}, nil
+}
+
+func (h *headS3) HeadObjectWithContext(ctx aws.Context, i *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return h.HeadObject(i)
+}
+
+func TestS3StorageHeadConditional(t *testing.T) {
+	api := &headS3{countingS3: countingS3{etag: `"v1"`}}
+	storage := NewS3StorageWithOptions(api, "bucket", "/{prefix}/{z}/{x}/{y}.{fmt}", "prefix", "", "", S3Options{HeadConditional: true})
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+
+	// unconditional fetches don't need checking first
+	resp, err := storage.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil || api.heads != 0 || api.gets != 1 {
+		t.Fatalf("Expected a single GetObject, got %#v, %v with %d heads and %d gets", resp, err, api.heads, api.gets)
+	}
+
+	match := `W/"v1"`
+	resp, err = storage.FetchContext(context.Background(), coord, state.Condition{IfNoneMatch: &match}, "", nil)
+	if err != nil || !resp.NotModified || api.heads != 1 || api.gets != 1 {
+		t.Fatalf("Expected a matching etag to be not modified after HeadObject alone, got %#v, %v with %d heads and %d gets", resp, err, api.heads, api.gets)
+	}
+
+	other := `"v0"`
+	resp, err = storage.Fetch(coord, state.Condition{IfNoneMatch: &other}, "", nil)
+	if err != nil || resp.Response == nil || api.heads != 2 || api.gets != 2 {
+		t.Fatalf("Expected a changed metatile to be fetched after HeadObject, got %#v, %v with %d heads and %d gets", resp, err, api.heads, api.gets)
+	}
+}
+
+func TestS3StorageFetchWeakETag(t *testing.T) {
+	api := &countingS3{etag: `"v1"`}
+	storage := NewS3Storage(api, "bucket", "/{prefix}/{z}/{x}/{y}.{fmt}", "prefix", "", "")
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+
+	// S3 only compares strong validators, so weak ones are made strong
+	match := `W/"v1"`
+	resp, err := storage.Fetch(coord, state.Condition{IfNoneMatch: &match}, "", nil)
+	if err != nil || !resp.NotModified || api.notModified != 1 {
+		t.Fatalf("Expected a weak matching etag to be not modified, got %#v, %v", resp, err)
+	}
+}
+
+// versionedS3 holds the versions of one key, oldest first, which are
+// deleted where their body is empty.
+type versionedS3 struct {
+	s3iface.S3API
+	key      string
+	bodies   []string
+	modified []time.Time
+	// headers of the last listing of versions
+	listHeaders http.Header
+}
+
+func (v *versionedS3) ListObjectVersionsWithContext(ctx aws.Context, i *s3.ListObjectVersionsInput, opts ...request.Option) (*s3.ListObjectVersionsOutput, error) {
+	r := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+	for _, opt := range opts {
+		opt(r)
+	}
+	v.listHeaders = r.HTTPRequest.Header
+
+	output := &s3.ListObjectVersionsOutput{}
+	if *i.Prefix != v.key {
+		return output, nil
+	}
+	for n := len(v.bodies) - 1; n >= 0; n-- {
+		id := fmt.Sprintf("v%d", n)
+		modified := v.modified[n]
+		if v.bodies[n] == "" {
+			output.DeleteMarkers = append(output.DeleteMarkers, &s3.DeleteMarkerEntry{Key: &v.key, VersionId: &id, LastModified: &modified})
+		} else {
+			output.Versions = append(output.Versions, &s3.ObjectVersion{Key: &v.key, VersionId: &id, LastModified: &modified})
+		}
+	}
+	return output, nil
+}
+
+func (v *versionedS3) GetObjectWithContext(ctx aws.Context, i *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	n := len(v.bodies) - 1
+	if i.VersionId != nil {
+		fmt.Sscanf(*i.VersionId, "v%d", &n)
+	}
+	if *i.Key != v.key || v.bodies[n] == "" {
+		return nil, awserr.New("NoSuchKey", "The key was not found.", nil)
+	}
+	body := v.bodies[n]
+	if i.Range != nil {
+		var first, last int
+		fmt.Sscanf(*i.Range, "bytes=%d-%d", &first, &last)
+		body = body[first : last+1]
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+}
+
+func TestS3StorageBuildVersions(t *testing.T) {
+	first := time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)
+	api := &versionedS3{
+		key:      "/prefix/0/0/0.zip",
+		bodies:   []string{"march", "", "may"},
+		modified: []time.Time{first, first.AddDate(0, 1, 0), first.AddDate(0, 2, 0)},
+	}
+	storage := NewS3StorageWithOptions(api, "bucket", "/{prefix}/{z}/{x}/{y}.{fmt}", "prefix", "", "", S3Options{
+		BuildVersions: map[string]time.Time{
+			"20210201": first.AddDate(0, -1, 0),
+			"20210315": first.AddDate(0, 0, 14),
+			"20210415": first.AddDate(0, 1, 14),
+			"20210515": first.AddDate(0, 2, 14),
+		},
+	})
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+
+	for build, body := range map[string]string{"": "may", "20210315": "march", "20210515": "may"} {
+		resp, err := storage.FetchContext(context.Background(), coord, state.Condition{}, build, nil)
+		if err != nil || resp.Response == nil || string(resp.Response.Body) != body {
+			t.Errorf("Expected build %#v to be %#v, got %#v, %v", build, body, resp, err)
+		}
+	}
+	for _, build := range []string{"20210201", "20210415"} {
+		resp, err := storage.Fetch(coord, state.Condition{}, build, nil)
+		if err != nil || !resp.NotFound {
+			t.Errorf("Expected build %s, before the object or when it was deleted, to be not found, got %#v, %v", build, resp, err)
+		}
+	}
+
+	key, err := storage.ResolveKey(coord, "20210315", nil)
+	if err != nil || key != "/prefix/0/0/0.zip?versionAsOf=2021-03-15T00:00:00Z" {
+		t.Errorf("Expected the key with the time of the version, got %#v, %v", key, err)
+	}
+}
+
+func TestS3StorageBuildVersionsRangesAndTileJson(t *testing.T) {
+	first := time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)
+	options := S3Options{
+		BuildVersions: map[string]time.Time{"20210315": first.AddDate(0, 0, 14)},
+		RequesterPays: true,
+	}
+
+	api := &versionedS3{
+		key:      "prefix/bundles/0.zip",
+		bodies:   []string{"march", "may"},
+		modified: []time.Time{first, first.AddDate(0, 2, 0)},
+	}
+	storage := NewS3StorageWithOptions(api, "bucket", "/{prefix}/{z}/{x}/{y}.{fmt}", "prefix", "", "", options)
+	data, err := storage.ReadRange("bundles/0.zip", "20210315", 1, 3)
+	if err != nil || string(data) != "arc" {
+		t.Fatalf("Expected the range of the build's version, got %#v, %v", string(data), err)
+	}
+	if got := api.listHeaders.Get("x-amz-request-payer"); got != "requester" {
+		t.Fatalf("Expected versions to be listed as the requester, got %#v", got)
+	}
+	if _, err := storage.ReadRange("bundles/1.zip", "20210315", 0, 1); err == nil {
+		t.Fatalf("Expected a range of an object without a version then to fail")
+	}
+
+	api = &versionedS3{
+		key:      tileJsonKey(state.TileJsonFormat_Mvt, "prefix"),
+		bodies:   []string{`{"build": "march"}`, `{"build": "may"}`},
+		modified: []time.Time{first, first.AddDate(0, 2, 0)},
+	}
+	storage = NewS3StorageWithOptions(api, "bucket", "/{prefix}/{z}/{x}/{y}.{fmt}", "prefix", "", "", options)
+	resp, err := storage.TileJson(state.TileJsonFormat_Mvt, state.Condition{}, "20210315")
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != `{"build": "march"}` {
+		t.Fatalf("Expected the tilejson of the build's version, got %#v, %v", resp, err)
+	}
+}
+
+func TestS3StorageRevalidate(t *testing.T) {
+	api := &countingS3{etag: `"v1"`}
+	storage := NewS3StorageWithOptions(api, "bucket", "/{prefix}/{z}/{x}/{y}.{fmt}", "prefix", "", "", S3Options{RevalidateTTL: time.Hour})
+
+	for i := 0; i < 3; i++ {
+		resp, err := storage.TileJson(state.TileJsonFormat_Mvt, state.Condition{}, "")
+		if err != nil {
+			t.Fatalf("Unable to get tilejson: %s", err.Error())
+		}
+		if resp.Response == nil || string(resp.Response.Body) != `{"tiles": []}` {
+			t.Fatalf("Expected tilejson body, but got %#v", resp)
+		}
+	}
+	if api.gets != 1 {
+		t.Fatalf("Expected tilejson to be read once within the TTL, but was read %d times", api.gets)
+	}
+
+	// the request condition is checked against the cached object
+	etag := `W/"v1"`
+	resp, err := storage.TileJson(state.TileJsonFormat_Mvt, state.Condition{IfNoneMatch: &etag}, "")
+	if err != nil {
+		t.Fatalf("Unable to get tilejson: %s", err.Error())
+	}
+	if !resp.NotModified {
+		t.Fatalf("Expected 304 for matching If-None-Match, but got %#v", resp)
+	}
+
+	// once expired, the object is revalidated rather than read again
+	storage.revalidation.ttl = 0
+	resp, err = storage.TileJson(state.TileJsonFormat_Mvt, state.Condition{}, "")
+	if err != nil {
+		t.Fatalf("Unable to get tilejson: %s", err.Error())
+	}
+	if resp.Response == nil || api.gets != 2 || api.notModified != 1 {
+		t.Fatalf("Expected expired tilejson to be revalidated, got %#v after %d requests", resp, api.gets)
+	}
+
+	api.etag = `"v2"`
+	resp, err = storage.TileJson(state.TileJsonFormat_Mvt, state.Condition{}, "")
+	if err != nil {
+		t.Fatalf("Unable to get tilejson: %s", err.Error())
+	}
+	if resp.Response == nil || *resp.Response.ETag != `"v2"` {
+		t.Fatalf("Expected changed tilejson to replace the cached one, but got %#v", resp)
+	}
+}
+
+type listingS3 struct {
+	s3iface.S3API
+	input *s3.ListObjectsV2Input
+}
+
+func (l *listingS3) ListObjectsV2(i *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	l.input = i
+	truncated := true
+	return &s3.ListObjectsV2Output{
+		Contents:    []*s3.Object{{Key: aws.String("prefix/a.zip")}, {Key: aws.String("prefix/b.zip")}},
+		IsTruncated: &truncated,
+	}, nil
+}
+
+func TestS3StorageList(t *testing.T) {
+	api := &listingS3{}
+	storage := NewS3Storage(api, "bucket", "", "prefix", "", "")
+
+	result, err := storage.List("prefix/", "prefix/0.zip", 2)
+	if err != nil {
+		t.Fatalf("Unable to list: %s", err.Error())
+	}
+	if *api.input.Prefix != "prefix/" || *api.input.StartAfter != "prefix/0.zip" || *api.input.MaxKeys != 2 {
+		t.Fatalf("Unexpected list input %#v", api.input)
+	}
+	if len(result.Keys) != 2 || result.Keys[1] != "prefix/b.zip" || !result.Truncated {
+		t.Fatalf("Unexpected list result %#v", result)
+	}
+}
+
+// rangingS3 serves one object with Range requests, recording the ranges
+// requested, and fails requests whose If-Match doesn't match its ETag.
+type rangingS3 struct {
+	s3iface.S3API
+	object []byte
+	etag   string
+	ranges []string
+}
+
+func (r *rangingS3) GetObjectWithContext(ctx aws.Context, i *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	if i.IfMatch != nil && *i.IfMatch != r.etag {
+		return nil, awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil)
+	}
+	if i.IfNoneMatch != nil && *i.IfNoneMatch == r.etag {
+		return nil, awserr.New("NotModified", "Not Modified", nil)
+	}
+	size := int64(len(r.object))
+	start, end := int64(0), size-1
+	if i.Range != nil {
+		r.ranges = append(r.ranges, *i.Range)
+		var suffix int64
+		if _, err := fmt.Sscanf(*i.Range, "bytes=-%d", &suffix); err == nil {
+			if suffix < size {
+				start = size - suffix
+			}
+		} else if _, err := fmt.Sscanf(*i.Range, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, err
+		}
+	}
+	contentRange := fmt.Sprintf("bytes %d-%d/%d", start, end, size)
+	etag := r.etag
+	return &s3.GetObjectOutput{
+		Body:         ioutil.NopCloser(bytes.NewReader(r.object[start : end+1])),
+		ContentRange: &contentRange,
+		ETag:         &etag,
+	}, nil
+}
+
+func TestS3StorageFetchRanges(t *testing.T) {
+	// a metatile with large tiles, of which only one is read
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for i := 0; i < 8; i++ {
+		f, _ := w.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("0/0/%d.mvt", i), Method: zip.Store})
+		f.Write(bytes.Repeat([]byte{byte('a' + i)}, 100000))
+	}
+	w.Close()
+
+	api := &rangingS3{object: buf.Bytes(), etag: `"v1"`}
+	stg := NewS3StorageWithOptions(api, "bucket", "/{prefix}/{z}/{x}/{y}.{fmt}", "prefix", "", "", S3Options{MinRange: 4096})
+	resp, err := stg.FetchRanges(context.Background(), tile.TileCoord{Z: 1, X: 0, Y: 0, Format: "zip"}, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil || resp.Response.Ranges == nil {
+		t.Fatalf("Expected a ranged response, got %#v, %v", resp, err)
+	}
+	if resp.Response.Size != uint64(buf.Len()) {
+		t.Fatalf("Expected the size of the whole metatile, got %d", resp.Response.Size)
+	}
+
+	offset := tile.TileCoord{Z: 0, X: 0, Y: 5, Format: "mvt"}
+	r, _, err := tile.NewMetatileReader(offset, resp.Response.Ranges, int64(resp.Response.Size))
+	if err != nil {
+		t.Fatalf("Unable to read metatile: %s", err.Error())
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(data, bytes.Repeat([]byte{'f'}, 100000)) {
+		t.Fatalf("Expected the tile's content, got %d bytes, %v", len(data), err)
+	}
+	if len(api.ranges) != 3 {
+		t.Fatalf("Expected the end of the metatile, the tile's local header and its data to be fetched, got %v", api.ranges)
+	}
+	fetched := int64(0)
+	for _, block := range resp.Response.Ranges.(*rangeReader).blocks {
+		fetched += int64(len(block.data))
+	}
+	if fetched > 2*100000 {
+		t.Fatalf("Expected to fetch little more than the tile, got %d of %d bytes in %v", fetched, buf.Len(), api.ranges)
+	}
+
+	// a metatile replaced while it's read fails rather than mixing the two
+	resp, err = stg.FetchRanges(context.Background(), tile.TileCoord{Z: 1, X: 0, Y: 0, Format: "zip"}, state.Condition{}, "", nil)
+	if err != nil {
+		t.Fatalf("Unable to fetch: %s", err.Error())
+	}
+	api.etag = `"v2"`
+	if _, _, err := tile.NewMetatileReader(offset, resp.Response.Ranges, int64(resp.Response.Size)); err == nil {
+		t.Fatalf("Expected reading a replaced metatile to fail")
+	}
+
+	// S3 only compares strong validators, so weak ones are made strong
+	weak := `W/"v2"`
+	resp, err = stg.FetchRanges(context.Background(), tile.TileCoord{Z: 1, X: 0, Y: 0, Format: "zip"}, state.Condition{IfNoneMatch: &weak}, "", nil)
+	if err != nil || !resp.NotModified {
+		t.Fatalf("Expected a weak matching etag to be not modified, got %#v, %v", resp, err)
+	}
+}
+
+// payerS3 fails requests which don't accept being charged for them.
+type payerS3 struct {
+	mockS3
+}
+
+func (p *payerS3) GetObject(i *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if i.RequestPayer == nil || *i.RequestPayer != s3.RequestPayerRequester {
+		return nil, awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "")
+	}
+	return p.mockS3.GetObject(i)
+}
+
+func (p *payerS3) HeadObject(i *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if i.RequestPayer == nil || *i.RequestPayer != s3.RequestPayerRequester {
+		return nil, awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "")
+	}
+	return &s3.HeadObjectOutput{}, nil
+}
+
+func TestS3StorageRequesterPays(t *testing.T) {
+	api := &payerS3{mockS3{expectedKey: "/prefix/0/0/0.zip", healthcheck: "healthcheck"}}
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+
+	storage := NewS3Storage(api, "bucket", "/{prefix}/{z}/{x}/{y}.{fmt}", "prefix", "", "healthcheck")
+	if _, err := storage.Fetch(coord, state.Condition{}, "", nil); err == nil {
+		t.Fatalf("Expected fetches from a requester pays bucket to fail without the option")
+	}
+
+	storage = NewS3StorageWithOptions(api, "bucket", "/{prefix}/{z}/{x}/{y}.{fmt}", "prefix", "", "healthcheck", S3Options{RequesterPays: true})
+	resp, err := storage.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil {
+		t.Fatalf("Expected the fetch to succeed as requester, got %#v, %v", resp, err)
+	}
+	if err := storage.HealthCheck(); err != nil {
+		t.Fatalf("Expected the healthcheck to succeed as requester, got %s", err.Error())
+	}
+}
+
+// sseS3 fails requests without the customer key its objects are encrypted with.
+type sseS3 struct {
+	mockS3
+	key string
+}
+
+func (e *sseS3) GetObject(i *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if i.SSECustomerAlgorithm == nil || *i.SSECustomerAlgorithm != "AES256" || i.SSECustomerKey == nil || *i.SSECustomerKey != e.key {
+		return nil, awserr.NewRequestFailure(awserr.New("InvalidRequest", "The object was stored using a form of Server Side Encryption.", nil), 400, "")
+	}
+	return e.mockS3.GetObject(i)
+}
+
+func TestS3StorageSSECustomerKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	api := &sseS3{mockS3: mockS3{expectedKey: "/prefix/0/0/0.zip"}, key: string(key)}
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+
+	storage := NewS3Storage(api, "bucket", "/{prefix}/{z}/{x}/{y}.{fmt}", "prefix", "", "healthcheck")
+	if _, err := storage.Fetch(coord, state.Condition{}, "", nil); err == nil {
+		t.Fatalf("Expected fetches of encrypted objects to fail without the key")
+	}
+
+	storage = NewS3StorageWithOptions(api, "bucket", "/{prefix}/{z}/{x}/{y}.{fmt}", "prefix", "", "healthcheck", S3Options{SSECustomerKey: key})
+	resp, err := storage.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil {
+		t.Fatalf("Expected the fetch to succeed with the key, got %#v, %v", resp, err)
+	}
+}
+
+// gzipS3 serves one object stored gzipped, always whole.
+type gzipS3 struct {
+	s3iface.S3API
+	object []byte
+}
+
+func (g *gzipS3) GetObjectWithContext(ctx aws.Context, i *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return g.GetObject(i)
+}
+
+func (g *gzipS3) GetObject(i *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	encoding := "gzip"
+	length := int64(len(g.object))
+	return &s3.GetObjectOutput{
+		Body:            ioutil.NopCloser(bytes.NewReader(g.object)),
+		ContentEncoding: &encoding,
+		ContentLength:   &length,
+	}, nil
+}
+
+func TestS3StorageGzipEncoding(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte("metatile"))
+	w.Close()
+
+	api := &gzipS3{object: buf.Bytes()}
+	stg := NewS3Storage(api, "bucket", "/{prefix}/{z}/{x}/{y}.{fmt}", "prefix", "", "")
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+
+	resp, err := stg.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "metatile" {
+		t.Fatalf("Expected the decompressed metatile, got %#v, %v", resp, err)
+	}
+	if resp.Response.Size != uint64(buf.Len()) {
+		t.Fatalf("Expected the stored size of the metatile, got %d", resp.Response.Size)
+	}
+
+	resp, err = stg.FetchRanges(context.Background(), coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil || resp.Response.Ranges != nil || string(resp.Response.Body) != "metatile" {
+		t.Fatalf("Expected a gzipped metatile to be fetched whole, got %#v, %v", resp, err)
+	}
+
+	api.object = []byte("not gzipped")
+	if _, err := stg.Fetch(coord, state.Condition{}, "", nil); err == nil {
+		t.Fatalf("Expected an error for an object which isn't gzipped")
+	}
+}
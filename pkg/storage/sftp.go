@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// The connections kept to the server, unless configured otherwise
+const defaultSFTPMaxConns = 4
+
+// How long an operation without a tile request's context may take, unless
+// configured otherwise
+const defaultSFTPTimeout = 10 * time.Second
+
+// SFTPDialer opens a connection to an SFTP server, returning the client and
+// a function closing the connection.
+type SFTPDialer func() (*sftp.Client, func() error, error)
+
+// NewSSHDialer returns a dialer connecting to the SFTP subsystem of the SSH
+// server at addr, eg. host:22.
+func NewSSHDialer(addr string, config *ssh.ClientConfig) SFTPDialer {
+	return func() (*sftp.Client, func() error, error) {
+		conn, err := ssh.Dial("tcp", addr, config)
+		if err != nil {
+			return nil, nil, err
+		}
+		client, err := sftp.NewClient(conn)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		// the connection is closed first, as closing the client waits for
+		// its reads from the server to end
+		closeConn := func() error {
+			err := conn.Close()
+			client.Close()
+			return err
+		}
+		return client, closeConn, nil
+	}
+}
+
+// SFTPOptions holds the optional settings of an SFTPStorage. The zero value
+// gives the default behaviour.
+type SFTPOptions struct {
+	// MaxConns is the most connections open to the server at once, default
+	// 4. Fetches wait for a connection when they're all in use.
+	MaxConns int
+	// Timeout bounds the operations which aren't made for a tile request,
+	// whose context bounds them instead, default 10s. Waiting for a
+	// connection from the pool counts towards it.
+	Timeout time.Duration
+}
+
+// sftpConn is a pooled connection.
+type sftpConn struct {
+	client *sftp.Client
+	close  func() error
+}
+
+// SFTPStorage fetches metatiles from a directory on an SFTP server, laid out
+// as for a FileStorage, over a pool of connections which are opened as
+// they're needed and reopened once they fail.
+type SFTPStorage struct {
+	dial        SFTPDialer
+	baseDir     string
+	layer       string
+	healthcheck string
+	timeout     time.Duration
+	// conns holds MaxConns connections, nil until they're first used
+	conns chan *sftpConn
+}
+
+var _ ContextFetcher = &SFTPStorage{}
+var _ MetadataReader = &SFTPStorage{}
+var _ KeyResolver = &SFTPStorage{}
+
+func NewSFTPStorage(dial SFTPDialer, baseDir, layer, healthcheck string) *SFTPStorage {
+	return NewSFTPStorageWithOptions(dial, baseDir, layer, healthcheck, SFTPOptions{})
+}
+
+func NewSFTPStorageWithOptions(dial SFTPDialer, baseDir, layer, healthcheck string, options SFTPOptions) *SFTPStorage {
+	if options.MaxConns <= 0 {
+		options.MaxConns = defaultSFTPMaxConns
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaultSFTPTimeout
+	}
+	conns := make(chan *sftpConn, options.MaxConns)
+	for i := 0; i < options.MaxConns; i++ {
+		conns <- nil
+	}
+	return &SFTPStorage{
+		dial:        dial,
+		baseDir:     baseDir,
+		layer:       layer,
+		healthcheck: healthcheck,
+		timeout:     options.Timeout,
+		conns:       conns,
+	}
+}
+
+// isSFTPFileError returns true when err is about the file requested, rather
+// than the connection, which can then be reused.
+func isSFTPFileError(err error) bool {
+	var statusErr *sftp.StatusError
+	return os.IsNotExist(err) || os.IsPermission(err) || errors.As(err, &statusErr)
+}
+
+// sftpResult is the outcome of an operation over a pooled connection.
+type sftpResult struct {
+	resp *StorageResponse
+	err  error
+}
+
+// withConn calls f with a connection from the pool, opening one if needed,
+// and closes the connection if f fails other than for the file. When ctx is
+// done first, the wait for a connection or f is abandoned, and the
+// connection f is using is closed, failing f, to be reopened by the next
+// fetch.
+func (s *SFTPStorage) withConn(ctx context.Context, f func(*sftp.Client) (*StorageResponse, error)) (*StorageResponse, error) {
+	var conn *sftpConn
+	select {
+	case conn = <-s.conns:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if conn == nil {
+		client, closeConn, err := s.dial()
+		if err != nil {
+			s.conns <- nil
+			return nil, fmt.Errorf("unable to connect to sftp server: %w", err)
+		}
+		conn = &sftpConn{client: client, close: closeConn}
+	}
+
+	done := make(chan sftpResult, 1)
+	go func() {
+		resp, err := f(conn.client)
+		done <- sftpResult{resp: resp, err: err}
+	}()
+
+	var result sftpResult
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		go conn.close()
+		s.conns <- nil
+		return nil, ctx.Err()
+	}
+	if result.err != nil && !isSFTPFileError(result.err) {
+		conn.close()
+		conn = nil
+	}
+	s.conns <- conn
+	return result.resp, result.err
+}
+
+// withTimeout calls f with a context for an operation without a tile
+// request's context, which ends after the timeout.
+func (s *SFTPStorage) withTimeout(f func(context.Context) (*StorageResponse, error)) (*StorageResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return f(ctx)
+}
+
+// respond reads the file at p, with Last-Modified and an ETag as for a
+// FileStorage, responding NotModified without reading it when the
+// condition matches.
+func (s *SFTPStorage) respond(ctx context.Context, p string, c state.Condition) (*StorageResponse, error) {
+	resp, err := s.withConn(ctx, func(client *sftp.Client) (*StorageResponse, error) {
+		file, err := client.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		lastModified := info.ModTime()
+		etag := fmt.Sprintf("\"%x-%x\"", lastModified.UnixNano(), info.Size())
+		if isNotModified(c, &lastModified, &etag) {
+			return &StorageResponse{NotModified: true}, nil
+		}
+
+		body, err := ioutil.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		return &StorageResponse{
+			Response: &SuccessfulResponse{
+				Body:         body,
+				LastModified: &lastModified,
+				ETag:         &etag,
+				Size:         uint64(len(body)),
+			},
+		}, nil
+	})
+	if os.IsNotExist(err) {
+		return &StorageResponse{NotFound: true}, nil
+	}
+	return resp, err
+}
+
+func (s *SFTPStorage) tilePath(t tile.TileCoord, prefix string) string {
+	return path.Join(s.baseDir, prefix, s.layer, t.FileName())
+}
+
+// Fetch reads the metatile, or if it isn't stored uncompressed, the gzipped
+// metatile with the CompressedSuffix, decompressing it.
+func (s *SFTPStorage) Fetch(t tile.TileCoord, c state.Condition, prefix string, keyVars map[string]string) (*StorageResponse, error) {
+	return s.withTimeout(func(ctx context.Context) (*StorageResponse, error) {
+		return s.FetchContext(ctx, t, c, prefix, keyVars)
+	})
+}
+
+// FetchContext is Fetch, abandoning the wait for a connection or the reads
+// over it when ctx is done.
+func (s *SFTPStorage) FetchContext(ctx context.Context, t tile.TileCoord, c state.Condition, prefix string, keyVars map[string]string) (*StorageResponse, error) {
+	return respondWithCompressed(s.tilePath(t, prefix), func(p string) (*StorageResponse, error) {
+		return s.respond(ctx, p, c)
+	})
+}
+
+// ResolveKey returns the path on the server which Fetch would read for the
+// tile, when it's stored uncompressed.
+func (s *SFTPStorage) ResolveKey(t tile.TileCoord, prefix string, keyVars map[string]string) (string, error) {
+	return s.tilePath(t, prefix), nil
+}
+
+func (s *SFTPStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefix string) (*StorageResponse, error) {
+	return s.withTimeout(func(ctx context.Context) (*StorageResponse, error) {
+		return s.respond(ctx, path.Join(s.baseDir, prefix, "tilejson", f.Name()+".json"), c)
+	})
+}
+
+// ReadMetadata reads the file with the given name in the build's directory.
+func (s *SFTPStorage) ReadMetadata(name, prefix string) (*StorageResponse, error) {
+	return s.withTimeout(func(ctx context.Context) (*StorageResponse, error) {
+		return s.respond(ctx, path.Join(s.baseDir, prefix, name), state.Condition{})
+	})
+}
+
+// HealthCheck checks the healthcheck file exists, over a pooled connection,
+// within the timeout.
+func (s *SFTPStorage) HealthCheck() error {
+	_, err := s.withTimeout(func(ctx context.Context) (*StorageResponse, error) {
+		return s.withConn(ctx, func(client *sftp.Client) (*StorageResponse, error) {
+			_, err := client.Stat(path.Join(s.baseDir, s.healthcheck))
+			return nil, err
+		})
+	})
+	return err
+}
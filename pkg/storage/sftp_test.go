@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// pipeSFTPDialer connects to SFTP servers of the local filesystem over
+// pipes, recording the servers so that tests can break their connections.
+type pipeSFTPDialer struct {
+	servers []*sftp.Server
+	// stalled is set to make the servers stop responding until they're
+	// closed
+	stalled int32
+}
+
+// stallingWriter is a server's end of a pipe, which blocks writes while its
+// dialer is stalled, until it's closed.
+type stallingWriter struct {
+	*io.PipeWriter
+	stalled *int32
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (w *stallingWriter) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(w.stalled) != 0 {
+		<-w.closed
+		return 0, io.ErrClosedPipe
+	}
+	return w.PipeWriter.Write(p)
+}
+
+func (w *stallingWriter) Close() error {
+	w.once.Do(func() { close(w.closed) })
+	return w.PipeWriter.Close()
+}
+
+func (d *pipeSFTPDialer) dial() (*sftp.Client, func() error, error) {
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverR, &stallingWriter{PipeWriter: serverW, stalled: &d.stalled, closed: make(chan struct{})}}, sftp.ReadOnly())
+	if err != nil {
+		return nil, nil, err
+	}
+	go server.Serve()
+	d.servers = append(d.servers, server)
+
+	client, err := sftp.NewClientPipe(clientR, clientW)
+	if err != nil {
+		server.Close()
+		return nil, nil, err
+	}
+	closeConn := func() error {
+		err := server.Close()
+		client.Close()
+		return err
+	}
+	return client, closeConn, nil
+}
+
+func TestSFTPStorage(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	dir := filepath.Join(baseDir, "all", "0", "0")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Unable to create tile dir: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "0.zip"), []byte("metatile"), 0644); err != nil {
+		t.Fatalf("Unable to write tile: %s", err.Error())
+	}
+
+	dialer := &pipeSFTPDialer{}
+	stg := NewSFTPStorageWithOptions(dialer.dial, filepath.ToSlash(baseDir), "all", "all/0/0/0.zip", SFTPOptions{MaxConns: 1})
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+
+	resp, err := stg.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "metatile" {
+		t.Fatalf("Expected the metatile, got %#v, %v", resp, err)
+	}
+	resp, err = stg.Fetch(coord, state.Condition{IfNoneMatch: resp.Response.ETag}, "", nil)
+	if err != nil || !resp.NotModified {
+		t.Fatalf("Expected matching If-None-Match to give not modified, got %#v, %v", resp, err)
+	}
+	resp, err = stg.Fetch(tile.TileCoord{Z: 1, X: 0, Y: 0, Format: "zip"}, state.Condition{}, "", nil)
+	if err != nil || !resp.NotFound {
+		t.Fatalf("Expected a missing metatile to be not found, got %#v, %v", resp, err)
+	}
+	if err := stg.HealthCheck(); err != nil {
+		t.Fatalf("Expected the healthcheck to pass, got %s", err.Error())
+	}
+	if len(dialer.servers) != 1 {
+		t.Fatalf("Expected the connection to be reused, got %d connections", len(dialer.servers))
+	}
+
+	// a broken connection fails the fetch using it, and is replaced
+	dialer.servers[0].Close()
+	if _, err := stg.Fetch(coord, state.Condition{}, "", nil); err == nil {
+		t.Fatalf("Expected the fetch over a broken connection to fail")
+	}
+	resp, err = stg.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil {
+		t.Fatalf("Expected the metatile over a new connection, got %#v, %v", resp, err)
+	}
+	if len(dialer.servers) != 2 {
+		t.Fatalf("Expected the broken connection to be replaced, got %d connections", len(dialer.servers))
+	}
+}
+
+func TestSFTPStorageStalled(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "tapalcatl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(baseDir)
+
+	dir := filepath.Join(baseDir, "all", "0", "0")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Unable to create tile dir: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "0.zip"), []byte("metatile"), 0644); err != nil {
+		t.Fatalf("Unable to write tile: %s", err.Error())
+	}
+
+	dialer := &pipeSFTPDialer{}
+	stg := NewSFTPStorageWithOptions(dialer.dial, filepath.ToSlash(baseDir), "all", "all/0/0/0.zip", SFTPOptions{MaxConns: 1, Timeout: 50 * time.Millisecond})
+	coord := tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}
+	if err := stg.HealthCheck(); err != nil {
+		t.Fatalf("Expected the healthcheck to pass, got %s", err.Error())
+	}
+
+	// a fetch on a stalled connection holds the only connection until its
+	// context is done, while other fetches give up waiting for it
+	atomic.StoreInt32(&dialer.stalled, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	stalled := make(chan error, 1)
+	go func() {
+		_, err := stg.FetchContext(ctx, coord, state.Condition{}, "", nil)
+		stalled <- err
+	}()
+	for len(stg.conns) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := stg.Fetch(coord, state.Condition{}, "", nil); err != context.DeadlineExceeded {
+		t.Fatalf("Expected a fetch waiting for a connection to time out, got %v", err)
+	}
+	if err := stg.HealthCheck(); err != context.DeadlineExceeded {
+		t.Fatalf("Expected a healthcheck waiting for a connection to time out, got %v", err)
+	}
+	cancel()
+	if err := <-stalled; err != context.Canceled {
+		t.Fatalf("Expected the stalled fetch to be abandoned, got %v", err)
+	}
+
+	// the stalled connection was closed, and is replaced
+	atomic.StoreInt32(&dialer.stalled, 0)
+	resp, err := stg.Fetch(coord, state.Condition{}, "", nil)
+	if err != nil || resp.Response == nil || string(resp.Response.Body) != "metatile" {
+		t.Fatalf("Expected the metatile over a new connection, got %#v, %v", resp, err)
+	}
+	if len(dialer.servers) != 2 {
+		t.Fatalf("Expected the stalled connection to be replaced, got %d connections", len(dialer.servers))
+	}
+}
@@ -1,6 +1,9 @@
 package storage
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"time"
 
 	"github.com/tilezen/tapalcatl/pkg/state"
@@ -8,20 +11,112 @@ import (
 )
 
 type Storage interface {
-	Fetch(t tile.TileCoord, c state.Condition, prefixOverride string) (*StorageResponse, error)
+	// Fetch retrieves the metatile at t. The keyVars are extra variables
+	// parsed from the request, for storages with key patterns.
+	Fetch(t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error)
 	TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*StorageResponse, error)
 	HealthCheck() error
 }
 
+// KeyResolver is implemented by storages which can report where a tile would
+// be fetched from, without fetching it.
+type KeyResolver interface {
+	ResolveKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error)
+}
+
+// ContextFetcher is implemented by storages which can abandon a fetch when
+// its context is done, eg. once the caller's deadline has passed.
+type ContextFetcher interface {
+	FetchContext(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error)
+}
+
+// FetchContext fetches from storage with its FetchContext method if it has
+// one. Otherwise it only checks the context isn't done before fetching.
+func FetchContext(ctx context.Context, stg Storage, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	if cf, ok := stg.(ContextFetcher); ok {
+		return cf.FetchContext(ctx, t, c, prefixOverride, keyVars)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return stg.Fetch(t, c, prefixOverride, keyVars)
+}
+
+// ArchivedError is the error of a fetch of an object which has been
+// archived, eg. to S3 Glacier by a lifecycle rule, and can't be read until
+// it's restored. It isn't transient, so isn't retried.
+type ArchivedError struct {
+	Err error
+}
+
+func (e *ArchivedError) Error() string {
+	return fmt.Sprintf("object is archived: %s", e.Err.Error())
+}
+
+func (e *ArchivedError) Unwrap() error {
+	return e.Err
+}
+
+// RangeFetcher is implemented by storages which can read a metatile in
+// parts, so that a tile can be extracted without fetching all of it.
+type RangeFetcher interface {
+	// FetchRanges responds with a Ranges reader in place of the Body, which
+	// fetches the parts of the metatile as they are read. It's only valid
+	// until ctx is done.
+	FetchRanges(ctx context.Context, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error)
+}
+
+// FetchRanges fetches the metatile in parts with the storage's FetchRanges
+// method if it has one, otherwise whole with FetchContext.
+func FetchRanges(ctx context.Context, stg Storage, t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*StorageResponse, error) {
+	if rf, ok := stg.(RangeFetcher); ok {
+		return rf.FetchRanges(ctx, t, c, prefixOverride, keyVars)
+	}
+	return FetchContext(ctx, stg, t, c, prefixOverride, keyVars)
+}
+
+// RangeReader is implemented by storages which can read part of an object
+// stored under the prefix of a build, as ReadMetadata reads the whole of it.
+type RangeReader interface {
+	// ReadRange returns the length bytes at offset of the named object.
+	ReadRange(name, prefixOverride string, offset, length int64) ([]byte, error)
+}
+
+// Lister is implemented by storages which can enumerate the objects they
+// hold, for admin tooling such as cache warming and exports.
+type Lister interface {
+	// List returns up to limit keys beginning with prefix, in lexical order,
+	// starting after the key after. Keys are relative to the root of the
+	// storage, such as its bucket or base directory, and the last key of one
+	// page is the after of the next.
+	List(prefix, after string, limit int) (*ListResult, error)
+}
+
+// ListResult is one page of keys from a Lister.
+type ListResult struct {
+	Keys []string
+	// Truncated is set when there are more keys after the last one.
+	Truncated bool
+}
+
 type SuccessfulResponse struct {
 	Body         []byte
 	LastModified *time.Time
 	ETag         *string
 	Size         uint64
+	// Ranges, if set, reads the object of Size bytes in parts, in place of
+	// the Body.
+	Ranges io.ReaderAt
 }
 
 type StorageResponse struct {
 	Response    *SuccessfulResponse
 	NotModified bool
 	NotFound    bool
+	// Source names the storage which responded, when it's one of several,
+	// eg. of a FallbackStorage, or the build prefix of a FanOutStorage.
+	Source string
+	// Retries is the number of times the fetch was made again after
+	// failing, by a RetryStorage.
+	Retries int
 }
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// webDAVPropfind asks for as little as possible about the healthcheck path.
+const webDAVPropfind = `<?xml version="1.0" encoding="utf-8"?><d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/></d:prop></d:propfind>`
+
+// WebDAVOptions holds the optional settings of a WebDAVStorage. The zero
+// value gives the default behaviour.
+type WebDAVOptions struct {
+	// Client makes the requests to the server, default a plain client.
+	Client *http.Client
+	// Timeout bounds each request to the server which isn't made for a
+	// tile request, whose context bounds it instead, default
+	// DefaultHTTPTimeout.
+	Timeout time.Duration
+	// User and Password are sent with basic auth, when User is set.
+	User     string
+	Password string
+}
+
+// WebDAVStorage fetches metatiles from a directory on a WebDAV server, such
+// as Nextcloud, laid out as for a FileStorage under its base URL, eg.
+// https://cloud/remote.php/dav/files/tiles. Metatiles are read with
+// conditional GET requests, and health is checked with PROPFIND.
+type WebDAVStorage struct {
+	baseURL     *url.URL
+	layer       string
+	healthcheck string
+	options     WebDAVOptions
+}
+
+var _ ContextFetcher = &WebDAVStorage{}
+var _ MetadataReader = &WebDAVStorage{}
+var _ KeyResolver = &WebDAVStorage{}
+
+func NewWebDAVStorage(baseURL, layer, healthcheck string, options WebDAVOptions) (*WebDAVStorage, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webdav base url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("webdav base url %#v isn't http or https", baseURL)
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{}
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultHTTPTimeout
+	}
+	return &WebDAVStorage{
+		baseURL:     u,
+		layer:       layer,
+		healthcheck: healthcheck,
+		options:     options,
+	}, nil
+}
+
+// url returns the URL of the path under the base URL.
+func (w *WebDAVStorage) url(parts ...string) string {
+	u := *w.baseURL
+	u.Path = path.Join(append([]string{"/", w.baseURL.Path}, parts...)...)
+	u.RawPath = ""
+	return u.String()
+}
+
+// timeout returns a context for a request without a tile request's
+// context, which ends after the Timeout.
+func (w *WebDAVStorage) timeout() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), w.options.Timeout)
+}
+
+// request makes a request to the server, authenticated if the storage has
+// a user.
+func (w *WebDAVStorage) request(ctx context.Context, method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if w.options.User != "" {
+		req.SetBasicAuth(w.options.User, w.options.Password)
+	}
+	return req, nil
+}
+
+func (w *WebDAVStorage) respond(ctx context.Context, u string, c state.Condition) (*StorageResponse, error) {
+	req, err := w.request(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return respondWithRequest(w.options.Client, req, c)
+}
+
+func (w *WebDAVStorage) tileURL(t tile.TileCoord, prefix string) string {
+	return w.url(prefix, w.layer, t.FileName())
+}
+
+func (w *WebDAVStorage) Fetch(t tile.TileCoord, c state.Condition, prefix string, keyVars map[string]string) (*StorageResponse, error) {
+	ctx, cancel := w.timeout()
+	defer cancel()
+	return w.FetchContext(ctx, t, c, prefix, keyVars)
+}
+
+// FetchContext reads the metatile, or if it isn't stored uncompressed, the
+// gzipped metatile with the CompressedSuffix, decompressing it. The request
+// is abandoned when ctx is done.
+func (w *WebDAVStorage) FetchContext(ctx context.Context, t tile.TileCoord, c state.Condition, prefix string, keyVars map[string]string) (*StorageResponse, error) {
+	return respondWithCompressed(w.tileURL(t, prefix), func(u string) (*StorageResponse, error) {
+		return w.respond(ctx, u, c)
+	})
+}
+
+// ResolveKey returns the URL which Fetch would request for the tile, when
+// it's stored uncompressed.
+func (w *WebDAVStorage) ResolveKey(t tile.TileCoord, prefix string, keyVars map[string]string) (string, error) {
+	return w.tileURL(t, prefix), nil
+}
+
+func (w *WebDAVStorage) TileJson(f state.TileJsonFormat, c state.Condition, prefix string) (*StorageResponse, error) {
+	ctx, cancel := w.timeout()
+	defer cancel()
+	return w.respond(ctx, w.url(prefix, "tilejson", f.Name()+".json"), c)
+}
+
+// ReadMetadata reads the file with the given name in the build's directory.
+func (w *WebDAVStorage) ReadMetadata(name, prefix string) (*StorageResponse, error) {
+	ctx, cancel := w.timeout()
+	defer cancel()
+	return w.respond(ctx, w.url(prefix, name), state.Condition{})
+}
+
+// HealthCheck checks the healthcheck path exists with PROPFIND, which must
+// respond with a multi-status within the timeout.
+func (w *WebDAVStorage) HealthCheck() error {
+	ctx, cancel := w.timeout()
+	defer cancel()
+	u := w.url(w.healthcheck)
+	req, err := w.request(ctx, "PROPFIND", u, strings.NewReader(webDAVPropfind))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := w.options.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return &StatusError{Status: resp.StatusCode, URL: u}
+	}
+	return nil
+}
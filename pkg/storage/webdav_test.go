@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+func TestWebDAVStorage(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("compressed metatile"))
+	gz.Close()
+
+	files := map[string][]byte{
+		"/dav/tiles/all/0/0/0.zip":        []byte("metatile"),
+		"/dav/tiles/all/1/0/0.zip.gz":     compressed.Bytes(),
+		"/dav/tiles/b1/all/0/0/0.zip":     []byte("build metatile"),
+		"/dav/tiles/tilejson/mapbox.json": []byte("{}"),
+		"/dav/tiles/healthcheck":          []byte("ok"),
+		"/dav/tiles/b1/build.json":        []byte(`{"metatileSize": 1}`),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "tiles" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "PROPFIND":
+			if r.Header.Get("Depth") != "0" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusMultiStatus)
+		case http.MethodGet:
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(body)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	stg, err := NewWebDAVStorage(server.URL+"/dav/tiles", "all", "healthcheck", WebDAVOptions{User: "tiles", Password: "secret"})
+	if err != nil {
+		t.Fatalf("Unable to create webdav storage: %s", err.Error())
+	}
+	fetch := func(z int, c state.Condition, prefix string) *StorageResponse {
+		resp, err := stg.Fetch(tile.TileCoord{Z: z, X: 0, Y: 0, Format: "zip"}, c, prefix, nil)
+		if err != nil {
+			t.Fatalf("Unable to fetch: %s", err.Error())
+		}
+		return resp
+	}
+
+	if resp := fetch(0, state.Condition{}, ""); resp.Response == nil || string(resp.Response.Body) != "metatile" {
+		t.Fatalf("Expected the metatile, got %#v", resp)
+	}
+	etag := `"v1"`
+	if resp := fetch(0, state.Condition{IfNoneMatch: &etag}, ""); !resp.NotModified {
+		t.Fatalf("Expected the condition to be forwarded and not modified, got %#v", resp)
+	}
+	if resp := fetch(0, state.Condition{}, "b1"); resp.Response == nil || string(resp.Response.Body) != "build metatile" {
+		t.Fatalf("Expected the build's metatile, got %#v", resp)
+	}
+	if resp := fetch(1, state.Condition{}, ""); resp.Response == nil || string(resp.Response.Body) != "compressed metatile" {
+		t.Fatalf("Expected the gzipped metatile decompressed, got %#v", resp)
+	}
+	if resp := fetch(2, state.Condition{}, ""); !resp.NotFound {
+		t.Fatalf("Expected a missing metatile to be not found, got %#v", resp)
+	}
+
+	if resp, err := stg.TileJson(state.TileJsonFormat_Mvt, state.Condition{}, ""); err != nil || resp.Response == nil {
+		t.Fatalf("Expected the tilejson, got %#v, %v", resp, err)
+	}
+	if resp, err := stg.ReadMetadata("build.json", "b1"); err != nil || resp.Response == nil {
+		t.Fatalf("Expected the build metadata, got %#v, %v", resp, err)
+	}
+	if key, _ := stg.ResolveKey(tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}, "b1", nil); key != server.URL+"/dav/tiles/b1/all/0/0/0.zip" {
+		t.Fatalf("Expected the metatile's url, got %s", key)
+	}
+
+	if err := stg.HealthCheck(); err != nil {
+		t.Fatalf("Expected the healthcheck to pass, got %s", err.Error())
+	}
+	unauthorized, _ := NewWebDAVStorage(server.URL+"/dav/tiles", "all", "healthcheck", WebDAVOptions{})
+	if err := unauthorized.HealthCheck(); err == nil {
+		t.Fatalf("Expected the healthcheck to fail without credentials")
+	}
+	if _, err := unauthorized.Fetch(tile.TileCoord{Z: 0, X: 0, Y: 0, Format: "zip"}, state.Condition{}, "", nil); err == nil {
+		t.Fatalf("Expected fetches to fail without credentials")
+	}
+
+	if _, err := NewWebDAVStorage("ftp://files/tiles", "", "", WebDAVOptions{}); err == nil {
+		t.Fatalf("Expected a base url which isn't http to fail")
+	}
+}
+
+func TestWebDAVStorageTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	stg, err := NewWebDAVStorage(server.URL+"/tiles", "all", "health", WebDAVOptions{Timeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unable to create webdav storage: %s", err.Error())
+	}
+	if _, err := stg.TileJson(state.TileJsonFormat_Mvt, state.Condition{}, "builds"); err == nil {
+		t.Fatalf("Expected tilejson from a hung server to time out")
+	}
+	if _, err := stg.ReadMetadata("build.json", "builds"); err == nil {
+		t.Fatalf("Expected metadata from a hung server to time out")
+	}
+	if err := stg.HealthCheck(); err == nil {
+		t.Fatalf("Expected the healthcheck of a hung server to time out")
+	}
+}
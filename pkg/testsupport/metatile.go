@@ -0,0 +1,55 @@
+package testsupport
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+var (
+	// CannedMvt is a vector tile with a single empty layer named "test".
+	CannedMvt = []byte{
+		0x1a, 0x0b, // layer, 11 bytes
+		0x0a, 0x04, 't', 'e', 's', 't', // name
+		0x78, 0x02, // version 2
+		0x28, 0x80, 0x20, // extent 4096
+	}
+	// CorruptMvt is CannedMvt truncated part way through its layer, as an
+	// interrupted upload might leave it.
+	CorruptMvt = CannedMvt[:8]
+	// CannedJson is an empty GeoJSON tile.
+	CannedJson = []byte(`{"type":"FeatureCollection","features":[]}`)
+)
+
+// Metatile returns a metatile zip containing the tiles, which are keyed by
+// their offset within the metatile.
+func Metatile(tiles map[tile.TileCoord][]byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	for offset, content := range tiles {
+		f, err := w.Create(offset.FileName())
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create file %#v in zip: %s", offset.FileName(), err.Error())
+		}
+		if _, err := f.Write(content); err != nil {
+			return nil, fmt.Errorf("Unable to write file %#v to zip: %s", offset.FileName(), err.Error())
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("Error while finalizing zip file: %s", err.Error())
+	}
+	return buf.Bytes(), nil
+}
+
+// MetatileFor returns the coordinate of the metatile containing coord for the
+// given sizes, and a metatile zip with the content at the tile's offset.
+func MetatileFor(coord tile.TileCoord, metatileSize, tileSize, metatileMaxDetailZoom int, content []byte) (tile.TileCoord, []byte, error) {
+	meta, offset, err := coord.MetaAndOffset(metatileSize, tileSize, metatileMaxDetailZoom)
+	if err != nil {
+		return meta, nil, err
+	}
+	body, err := Metatile(map[tile.TileCoord][]byte{offset: content})
+	return meta, body, err
+}
@@ -0,0 +1,131 @@
+package testsupport
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/storage"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+// TilePattern is a request pattern providing the mux variables which the
+// metatile parser reads.
+const TilePattern = "/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{fmt}"
+
+// TilePath returns the path of the tile under TilePattern.
+func TilePath(coord tile.TileCoord) string {
+	return "/" + coord.FileName()
+}
+
+// RandomTiles returns n tiles inside the world up to maxZoom, each in one of
+// the formats. Pass a seeded rand to make failures reproducible.
+func RandomTiles(r *rand.Rand, n, maxZoom int, formats []string) []tile.TileCoord {
+	tiles := make([]tile.TileCoord, n)
+	for i := range tiles {
+		z := r.Intn(maxZoom + 1)
+		limit := int64(1) << uint(z)
+		tiles[i] = tile.TileCoord{
+			Z:      z,
+			X:      int(r.Int63n(limit)),
+			Y:      int(r.Int63n(limit)),
+			Format: formats[r.Intn(len(formats))],
+		}
+	}
+	return tiles
+}
+
+// InvalidTilePaths returns paths which match TilePattern, but which a parser
+// must reject rather than fetch anything for.
+func InvalidTilePaths(format string) []string {
+	return []string{
+		// outside the world
+		fmt.Sprintf("/1/2/0.%s", format),
+		fmt.Sprintf("/1/0/2.%s", format),
+		fmt.Sprintf("/%d/0/0.%s", tile.MaxZoom+1, format),
+		// too big for an int
+		fmt.Sprintf("/0/99999999999999999999/0.%s", format),
+		// unknown formats
+		"/0/0/0.unknown",
+		"/0/0/0.zip.exe",
+		// invalid build id
+		fmt.Sprintf("/0/0/0.%s?buildid=../../etc", format),
+	}
+}
+
+// parse routes the request like the server, so that mux variables are set.
+func parse(p state.Parser, path string) (*state.ParseResult, error) {
+	var result *state.ParseResult
+	var err error
+	parsed := false
+
+	r := mux.NewRouter()
+	r.HandleFunc(TilePattern, func(rw http.ResponseWriter, req *http.Request) {
+		result, err = p.Parse(req)
+		parsed = true
+	})
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+
+	if !parsed {
+		return nil, fmt.Errorf("Path %s doesn't match the tile pattern", path)
+	}
+	return result, err
+}
+
+// CheckMetatileParser checks p parses tiles requested under TilePattern the
+// way the metatile handler expects: valid tiles give a *MetatileParseData
+// with their coordinate, and invalid ones give an error.
+func CheckMetatileParser(p state.Parser, formats []string, r *rand.Rand) error {
+	for _, coord := range RandomTiles(r, 100, tile.MaxZoom, formats) {
+		result, err := parse(p, TilePath(coord))
+		if err != nil {
+			return fmt.Errorf("Unable to parse valid tile %s: %s", coord.FileName(), err.Error())
+		}
+		data, ok := result.AdditionalData.(*state.MetatileParseData)
+		if !ok {
+			return fmt.Errorf("Parse result for %s has %T, not *state.MetatileParseData", coord.FileName(), result.AdditionalData)
+		}
+		if data.Coord != coord {
+			return fmt.Errorf("Parsed %s as %s", coord.FileName(), data.Coord.FileName())
+		}
+		if result.ContentType == "" {
+			return fmt.Errorf("Parse result for %s has no content type", coord.FileName())
+		}
+	}
+
+	for _, path := range InvalidTilePaths(formats[0]) {
+		if _, err := parse(p, path); err == nil {
+			return fmt.Errorf("Expected parsing invalid path %s to fail", path)
+		}
+	}
+	return nil
+}
+
+// CheckStorage checks stg fetches metatiles the way the handlers expect:
+// present is a metatile in stg, which must have a body, and missing must be
+// reported as not found rather than as an error.
+func CheckStorage(stg storage.Storage, prefix string, present, missing tile.TileCoord) error {
+	resp, err := stg.Fetch(present, state.Condition{}, prefix, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch %s: %s", present.FileName(), err.Error())
+	}
+	if resp == nil || resp.NotFound || resp.Response == nil {
+		return fmt.Errorf("Expected %s to be found, got %#v", present.FileName(), resp)
+	}
+	if len(resp.Response.Body) == 0 {
+		return fmt.Errorf("Expected %s to have a body", present.FileName())
+	}
+
+	resp, err = stg.Fetch(missing, state.Condition{}, prefix, nil)
+	if err != nil {
+		return fmt.Errorf("Expected missing %s to be not found, but got error: %s", missing.FileName(), err.Error())
+	}
+	if resp == nil || !resp.NotFound || resp.Response != nil {
+		return fmt.Errorf("Expected missing %s to be not found, got %#v", missing.FileName(), resp)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Package testsupport provides fakes and fixtures for testing custom parsers
+// and storages against the contracts which tapalcatl's handlers assume.
+package testsupport
+
+import (
+	"path"
+	"sync"
+
+	"github.com/tilezen/tapalcatl/pkg/state"
+	"github.com/tilezen/tapalcatl/pkg/storage"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+type metatileKey struct {
+	prefix string
+	coord  tile.TileCoord
+}
+
+type tileJsonKey struct {
+	prefix string
+	format state.TileJsonFormat
+}
+
+// Storage is an in-memory storage.Storage. Metatiles and tilejson are kept
+// per prefix override, with "" being the default build.
+type Storage struct {
+	mu        sync.Mutex
+	metatiles map[metatileKey][]byte
+	tileJson  map[tileJsonKey][]byte
+	err       error
+	fetches   int
+}
+
+var _ storage.Storage = &Storage{}
+var _ storage.KeyResolver = &Storage{}
+
+func NewStorage() *Storage {
+	return &Storage{
+		metatiles: make(map[metatileKey][]byte),
+		tileJson:  make(map[tileJsonKey][]byte),
+	}
+}
+
+// PutMetatile stores the body of the metatile at coord, whose format should
+// be "zip".
+func (s *Storage) PutMetatile(prefix string, coord tile.TileCoord, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metatiles[metatileKey{prefix, coord}] = body
+}
+
+// PutTile stores a metatile containing only the tile, laid out for the given
+// sizes as the metatile handler expects.
+func (s *Storage) PutTile(prefix string, coord tile.TileCoord, metatileSize, tileSize, metatileMaxDetailZoom int, content []byte) error {
+	meta, body, err := MetatileFor(coord, metatileSize, tileSize, metatileMaxDetailZoom, content)
+	if err != nil {
+		return err
+	}
+	s.PutMetatile(prefix, meta, body)
+	return nil
+}
+
+// PutTileJson stores the tilejson of the format.
+func (s *Storage) PutTileJson(prefix string, format state.TileJsonFormat, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tileJson[tileJsonKey{prefix, format}] = body
+}
+
+// SetError makes every fetch and healthcheck fail with err, or succeed again
+// if err is nil.
+func (s *Storage) SetError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// Fetches returns the number of metatile and tilejson fetches made.
+func (s *Storage) Fetches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func (s *Storage) respond(body []byte, ok bool) (*storage.StorageResponse, error) {
+	s.fetches++
+	if s.err != nil {
+		return nil, s.err
+	}
+	if !ok {
+		return &storage.StorageResponse{NotFound: true}, nil
+	}
+	return &storage.StorageResponse{
+		Response: &storage.SuccessfulResponse{
+			Body: body,
+			Size: uint64(len(body)),
+		},
+	}, nil
+}
+
+func (s *Storage) Fetch(t tile.TileCoord, c state.Condition, prefixOverride string, keyVars map[string]string) (*storage.StorageResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, ok := s.metatiles[metatileKey{prefixOverride, t}]
+	return s.respond(body, ok)
+}
+
+func (s *Storage) TileJson(f state.TileJsonFormat, c state.Condition, prefixOverride string) (*storage.StorageResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, ok := s.tileJson[tileJsonKey{prefixOverride, f}]
+	return s.respond(body, ok)
+}
+
+func (s *Storage) HealthCheck() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// ResolveKey returns the prefix and file name of the metatile.
+func (s *Storage) ResolveKey(t tile.TileCoord, prefixOverride string, keyVars map[string]string) (string, error) {
+	return path.Join(prefixOverride, t.FileName()), nil
+}
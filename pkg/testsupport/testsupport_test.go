@@ -0,0 +1,78 @@
+package testsupport_test
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/tilezen/tapalcatl/pkg/buffer"
+	"github.com/tilezen/tapalcatl/pkg/cache"
+	"github.com/tilezen/tapalcatl/pkg/handler"
+	"github.com/tilezen/tapalcatl/pkg/log"
+	"github.com/tilezen/tapalcatl/pkg/metrics"
+	"github.com/tilezen/tapalcatl/pkg/testsupport"
+	"github.com/tilezen/tapalcatl/pkg/tile"
+)
+
+func TestBuiltinsMeetContracts(t *testing.T) {
+	parser := &handler.MetatileMuxParser{MimeMap: map[string]string{
+		"mvt":  "application/x-protobuf",
+		"json": "application/json",
+	}}
+	if err := testsupport.CheckMetatileParser(parser, []string{"mvt", "json"}, rand.New(rand.NewSource(1))); err != nil {
+		t.Fatalf("Metatile parser doesn't meet its contract: %s", err.Error())
+	}
+
+	stg := testsupport.NewStorage()
+	present := tile.TileCoord{Z: 1, X: 0, Y: 1, Format: "mvt"}
+	if err := stg.PutTile("", present, 1, 1, 0, testsupport.CannedMvt); err != nil {
+		t.Fatalf("Unable to store tile: %s", err.Error())
+	}
+	meta := tile.TileCoord{Z: 1, X: 0, Y: 1, Format: "zip"}
+	missing := tile.TileCoord{Z: 1, X: 1, Y: 1, Format: "zip"}
+	if err := testsupport.CheckStorage(stg, "", meta, missing); err != nil {
+		t.Fatalf("Fake storage doesn't meet its contract: %s", err.Error())
+	}
+}
+
+func TestCannedMvt(t *testing.T) {
+	if err := tile.ValidateMvt(testsupport.CannedMvt); err != nil {
+		t.Fatalf("Expected canned mvt to be valid, got %s", err.Error())
+	}
+	if err := tile.ValidateMvt(testsupport.CorruptMvt); err == nil {
+		t.Fatalf("Expected corrupt mvt to be invalid")
+	}
+}
+
+func TestStorageServesHandler(t *testing.T) {
+	stg := testsupport.NewStorage()
+	coord := tile.TileCoord{Z: 3, X: 5, Y: 2, Format: "mvt"}
+	if err := stg.PutTile("", coord, 2, 1, 0, testsupport.CannedMvt); err != nil {
+		t.Fatalf("Unable to store tile: %s", err.Error())
+	}
+
+	parser := &handler.MetatileMuxParser{MimeMap: map[string]string{"mvt": "application/x-protobuf"}}
+	h := handler.MetatileHandler(parser, 2, 1, 0, stg, &buffer.OnDemandBufferManager{}, &metrics.NilMetricsWriter{}, &log.NilJsonLogger{}, cache.NilCache)
+	r := mux.NewRouter()
+	r.Handle(testsupport.TilePattern, h)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", testsupport.TilePath(coord), nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != string(testsupport.CannedMvt) {
+		t.Fatalf("Expected canned tile, got %d %#v", rec.Code, rec.Body.String())
+	}
+
+	stg.SetError(errors.New("unavailable"))
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", testsupport.TilePath(coord), nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected storage error to give 500, got %d", rec.Code)
+	}
+	if stg.Fetches() != 2 {
+		t.Fatalf("Expected 2 fetches, got %d", stg.Fetches())
+	}
+}
@@ -2,8 +2,11 @@ package tile
 
 import (
 	"archive/zip"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 )
 
 type TileCoord struct {
@@ -15,6 +18,81 @@ func (t TileCoord) FileName() string {
 	return fmt.Sprintf("%d/%d/%d.%s", t.Z, t.X, t.Y, t.Format)
 }
 
+// MaxZoom is the deepest zoom level a TileCoord may have. It keeps 2^z well
+// within the range of an int on all platforms.
+const MaxZoom = 30
+
+// Validate checks that the coordinate is inside the world, that is
+// 0 <= z <= MaxZoom and 0 <= x,y < 2^z.
+func (t TileCoord) Validate() error {
+	if t.Z < 0 || t.Z > MaxZoom {
+		return fmt.Errorf("Zoom %d is outside the range 0 to %d.", t.Z, MaxZoom)
+	}
+	limit := 1 << uint(t.Z)
+	if t.X < 0 || t.X >= limit {
+		return fmt.Errorf("X %d is outside the range 0 to %d at zoom %d.", t.X, limit-1, t.Z)
+	}
+	if t.Y < 0 || t.Y >= limit {
+		return fmt.Errorf("Y %d is outside the range 0 to %d at zoom %d.", t.Y, limit-1, t.Z)
+	}
+	return nil
+}
+
+// WrapX returns the tile with its X wrapped around the antimeridian into the
+// range 0 to 2^z-1, as clients panning across the dateline may request tiles
+// outside it. Tiles with a zoom out of range are returned unchanged.
+func (t TileCoord) WrapX() TileCoord {
+	if t.Z < 0 || t.Z > MaxZoom {
+		return t
+	}
+	limit := 1 << uint(t.Z)
+	t.X %= limit
+	if t.X < 0 {
+		t.X += limit
+	}
+	return t
+}
+
+// Ancestor returns the tile at zoom z which contains this one. If z is not
+// less than the tile's zoom, the tile itself is returned.
+func (t TileCoord) Ancestor(z int) TileCoord {
+	if z >= t.Z || z < 0 {
+		return t
+	}
+	deltaZ := uint(t.Z - z)
+	return TileCoord{Z: z, X: t.X >> deltaZ, Y: t.Y >> deltaZ, Format: t.Format}
+}
+
+// ParseTileCoord parses a coordinate written as "z/x/y.fmt", the same form
+// that FileName produces.
+func ParseTileCoord(s string) (TileCoord, error) {
+	var t TileCoord
+
+	dot := strings.LastIndex(s, ".")
+	if dot < 0 {
+		return t, fmt.Errorf("Tile coordinate %#v is missing a format.", s)
+	}
+	t.Format = s[dot+1:]
+
+	parts := strings.Split(s[:dot], "/")
+	if len(parts) != 3 {
+		return t, fmt.Errorf("Tile coordinate %#v must be in the form z/x/y.fmt.", s)
+	}
+
+	var err error
+	if t.Z, err = strconv.Atoi(parts[0]); err != nil {
+		return t, fmt.Errorf("Invalid z in tile coordinate %#v: %s", s, err.Error())
+	}
+	if t.X, err = strconv.Atoi(parts[1]); err != nil {
+		return t, fmt.Errorf("Invalid x in tile coordinate %#v: %s", s, err.Error())
+	}
+	if t.Y, err = strconv.Atoi(parts[2]); err != nil {
+		return t, fmt.Errorf("Invalid y in tile coordinate %#v: %s", s, err.Error())
+	}
+
+	return t, nil
+}
+
 // IsPowerOfTwo return true when the given integer is a power of two.
 // See https://graphics.stanford.edu/~seander/bithacks.html#DetermineIfPowerOf2
 // for details.
@@ -61,8 +139,18 @@ func min(a, b int) int {
 // that you want to extract, both in units of "standard" 256px tiles.
 //
 // For example, to extract a 1x1 regular 256px tile from a 2x2 metatile, one
-// would call MetaAndOffset(2, 1). To extract the 512px tile from the same,
-// call MetaAndOffset(2, 2).
+// would call MetaAndOffset(2, 1, 0). To extract the 512px tile from the same,
+// call MetaAndOffset(2, 2, 0).
+//
+// The argument metatileMaxDetailZoom, when greater than zero, is the deepest
+// zoom at which metatiles exist. Requests for tiles whose metatile would be
+// deeper than that are served from the metatile at metatileMaxDetailZoom
+// instead, with the offset reaching further down inside it. The offset is
+// clamped so that it never goes deeper than metaSize allows; if the tile is
+// too deep to fit, the returned metatile is one which doesn't exist, so the
+// request fails as not found rather than by unzipping a metatile which can't
+// contain it. A value of zero disables this and metatiles are expected at
+// every zoom.
 func (t TileCoord) MetaAndOffset(metaSize, tileSize, metatileMaxDetailZoom int) (meta, offset TileCoord, err error) {
 	// check that sizes are powers of two before proceeding.
 	if !IsPowerOfTwo(metaSize) {
@@ -124,20 +212,112 @@ func (t TileCoord) MetaAndOffset(metaSize, tileSize, metatileMaxDetailZoom int)
 	return
 }
 
+const (
+	// DuplicateEntryPolicy_First serves the first of the entries with the
+	// tile's name, as zip readers conventionally do.
+	DuplicateEntryPolicy_First = "first"
+	// DuplicateEntryPolicy_Last serves the last of the entries with the
+	// tile's name, as it was the last written.
+	DuplicateEntryPolicy_Last = "last"
+	// DuplicateEntryPolicy_Error fails to read a tile which has more than
+	// one entry, returning ErrDuplicateEntry.
+	DuplicateEntryPolicy_Error = "error"
+)
+
+// ErrDuplicateEntry is returned under DuplicateEntryPolicy_Error when a
+// metatile has more than one entry for the tile.
+var ErrDuplicateEntry = errors.New("duplicate entry in metatile")
+
+// ErrNoEntry is returned when a metatile has no entry for the tile.
+var ErrNoEntry = errors.New("no entry in metatile")
+
+// IsValidDuplicateEntryPolicy returns true when policy is one of the
+// DuplicateEntryPolicy_ constants.
+func IsValidDuplicateEntryPolicy(policy string) bool {
+	switch policy {
+	case DuplicateEntryPolicy_First, DuplicateEntryPolicy_Last, DuplicateEntryPolicy_Error:
+		return true
+	}
+	return false
+}
+
+const (
+	// zipDataDescriptorFlag is set on zip entries with a data descriptor
+	// after their data
+	zipDataDescriptorFlag = 0x8
+	// zipMaxDataDescriptorLen is the length of a zip64 data descriptor with
+	// its optional signature
+	zipMaxDataDescriptorLen = 24
+)
+
+// Prefetcher is implemented by metatile readers which fetch what's read from
+// elsewhere, eg. with ranged requests to storage, so that a tile's entry is
+// fetched in one piece rather than in the chunks it's read in.
+type Prefetcher interface {
+	// Prefetch fetches the n bytes at off, if they haven't been already.
+	Prefetch(off, n int64) error
+}
+
 func NewMetatileReader(t TileCoord, r io.ReaderAt, size int64) (io.ReadCloser, uint64, error) {
+	result, formatSize, _, err := NewMetatileReaderWithPolicy(t, r, size, DuplicateEntryPolicy_First)
+	return result, formatSize, err
+}
+
+// NewMetatileReaderWithPolicy reads the tile out of the metatile, choosing
+// between entries with the same name according to policy, one of the
+// DuplicateEntryPolicy_ constants. It also returns the number of duplicate
+// entries for the tile, which is non-zero only for malformed metatiles. When
+// r is a Prefetcher, the tile's entry is prefetched before it's read.
+func NewMetatileReaderWithPolicy(t TileCoord, r io.ReaderAt, size int64, policy string) (io.ReadCloser, uint64, int, error) {
 	z, err := zip.NewReader(r, size)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, 0, err
 	}
 
 	target := t.FileName()
 
+	var found *zip.File
+	duplicates := 0
 	for _, f := range z.File {
-		if f.Name == target {
-			result, err := f.Open()
-			return result, f.UncompressedSize64, err
+		if f.Name != target {
+			continue
+		}
+		if found == nil {
+			found = f
+			continue
+		}
+		duplicates++
+		if policy == DuplicateEntryPolicy_Last {
+			found = f
+		}
+	}
+
+	if found == nil {
+		return nil, 0, 0, fmt.Errorf("Unable to find relative tile offset %#v in metatile: %w", target, ErrNoEntry)
+	}
+	if duplicates > 0 && policy == DuplicateEntryPolicy_Error {
+		return nil, 0, duplicates, fmt.Errorf("%w: %d entries for %s", ErrDuplicateEntry, duplicates+1, target)
+	}
+
+	if p, ok := r.(Prefetcher); ok {
+		offset, err := found.DataOffset()
+		if err == nil {
+			// the data may be followed by a descriptor, which the reader
+			// checks once it has read the data
+			end := offset + int64(found.CompressedSize64)
+			if found.Flags&zipDataDescriptorFlag != 0 {
+				end += zipMaxDataDescriptorLen
+			}
+			if end > size {
+				end = size
+			}
+			err = p.Prefetch(offset, end-offset)
+		}
+		if err != nil {
+			return nil, 0, duplicates, err
 		}
 	}
 
-	return nil, 0, fmt.Errorf("Unable to find relative tile offset %#v in metatile.", target)
+	result, err := found.Open()
+	return result, found.UncompressedSize64, duplicates, err
 }
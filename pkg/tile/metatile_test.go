@@ -3,6 +3,7 @@ package tile
 import (
 	"archive/zip"
 	"bytes"
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -62,6 +63,43 @@ func TestReadZipMissing(t *testing.T) {
 	}
 }
 
+func TestReadZipDuplicate(t *testing.T) {
+	tile := TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	for _, content := range []string{"first", "last"} {
+		f, err := w.Create(tile.FileName())
+		if err != nil {
+			t.Fatalf("Unable to create file in zip: %s", err.Error())
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error while finalizing zip file: %s", err.Error())
+	}
+	readerAt := bytes.NewReader(buf.Bytes())
+
+	for _, policy := range []string{DuplicateEntryPolicy_First, DuplicateEntryPolicy_Last} {
+		reader, _, duplicates, err := NewMetatileReaderWithPolicy(tile, readerAt, int64(buf.Len()), policy)
+		if err != nil {
+			t.Fatalf("Unable to read test zip: %s", err.Error())
+		}
+		if duplicates != 1 {
+			t.Fatalf("Expected 1 duplicate, got %d", duplicates)
+		}
+		tileBuf := new(bytes.Buffer)
+		tileBuf.ReadFrom(reader)
+		if tileBuf.String() != policy {
+			t.Fatalf("Expected the %s entry to be served, but got %#v.", policy, tileBuf.String())
+		}
+	}
+
+	_, _, _, err := NewMetatileReaderWithPolicy(tile, readerAt, int64(buf.Len()), DuplicateEntryPolicy_Error)
+	if !errors.Is(err, ErrDuplicateEntry) {
+		t.Fatalf("Expected a duplicate entry error, got %v", err)
+	}
+}
+
 func coordEquals(t *testing.T, name string, exp, act TileCoord) {
 	if exp.Z != act.Z {
 		t.Fatalf("Expected %s Z to be %d but was %d.", name, exp.Z, act.Z)
@@ -130,3 +168,48 @@ func TestMetaOffset(t *testing.T) {
 		TileCoord{Z: 13, X: 4663, Y: 2372, Format: "zip"},
 		TileCoord{Z: 3, X: 7, Y: 0, Format: "json"})
 }
+
+func TestValidate(t *testing.T) {
+	valid := []TileCoord{
+		{Z: 0, X: 0, Y: 0},
+		{Z: 1, X: 1, Y: 1},
+		{Z: 16, X: 65535, Y: 0},
+		{Z: MaxZoom, X: 1<<MaxZoom - 1, Y: 1<<MaxZoom - 1},
+	}
+	for _, coord := range valid {
+		if err := coord.Validate(); err != nil {
+			t.Fatalf("Expected %s to be valid, but got: %s", coord.FileName(), err.Error())
+		}
+	}
+
+	invalid := []TileCoord{
+		{Z: -1, X: 0, Y: 0},
+		{Z: 0, X: 1, Y: 0},
+		{Z: 0, X: 0, Y: 1},
+		{Z: 1, X: -1, Y: 0},
+		{Z: 16, X: 0, Y: 65536},
+		{Z: MaxZoom + 1, X: 0, Y: 0},
+		{Z: 64, X: 0, Y: 0},
+	}
+	for _, coord := range invalid {
+		if err := coord.Validate(); err == nil {
+			t.Fatalf("Expected %s to be invalid", coord.FileName())
+		}
+	}
+}
+
+func TestWrapX(t *testing.T) {
+	for coord, expected := range map[TileCoord]TileCoord{
+		{Z: 0, X: 3, Y: 0}:    {Z: 0, X: 0, Y: 0},
+		{Z: 2, X: -1, Y: 1}:   {Z: 2, X: 3, Y: 1},
+		{Z: 2, X: -9, Y: 1}:   {Z: 2, X: 3, Y: 1},
+		{Z: 2, X: 4, Y: 1}:    {Z: 2, X: 0, Y: 1},
+		{Z: 2, X: 2, Y: 5}:    {Z: 2, X: 2, Y: 5},
+		{Z: -1, X: -1, Y: 0}:  {Z: -1, X: -1, Y: 0},
+		{Z: 64, X: 100, Y: 0}: {Z: 64, X: 100, Y: 0},
+	} {
+		if wrapped := coord.WrapX(); wrapped != expected {
+			t.Fatalf("Expected %s to wrap to %s, but got %s", coord.FileName(), expected.FileName(), wrapped.FileName())
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package tile
+
+import (
+	"errors"
+	"fmt"
+)
+
+// protobuf wire types used in vector tiles
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// field numbers from the Mapbox Vector Tile specification
+const (
+	mvtTileLayers   = 3
+	mvtLayerName    = 1
+	mvtLayerExtent  = 5
+	mvtLayerVersion = 15
+)
+
+var errTruncated = errors.New("truncated protobuf")
+
+// readVarint decodes the varint at the start of buf, returning it and the
+// number of bytes it used.
+func readVarint(buf []byte) (uint64, int, error) {
+	var value uint64
+	for i := 0; i < len(buf) && i < 10; i++ {
+		b := buf[i]
+		value |= uint64(b&0x7f) << (7 * uint(i))
+		if b < 0x80 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, errTruncated
+}
+
+// walkFields calls fn with each field of the protobuf message in buf. For
+// length delimited and fixed size fields, data is the field's content; for
+// varint fields it is nil and value holds the varint.
+func walkFields(buf []byte, fn func(field uint64, wireType int, value uint64, data []byte) error) error {
+	for len(buf) > 0 {
+		key, n, err := readVarint(buf)
+		if err != nil {
+			return err
+		}
+		buf = buf[n:]
+		field, wireType := key>>3, int(key&7)
+		if field == 0 {
+			return errors.New("invalid protobuf field number 0")
+		}
+
+		var value uint64
+		var data []byte
+		switch wireType {
+		case wireVarint:
+			value, n, err = readVarint(buf)
+			if err != nil {
+				return err
+			}
+		case wireFixed64:
+			n = 8
+			if n <= len(buf) {
+				data = buf[:n]
+			}
+		case wireFixed32:
+			n = 4
+			if n <= len(buf) {
+				data = buf[:n]
+			}
+		case wireBytes:
+			length, m, err := readVarint(buf)
+			if err != nil {
+				return err
+			}
+			if length > uint64(len(buf)-m) {
+				return errTruncated
+			}
+			data = buf[m : m+int(length)]
+			n = m + int(length)
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", wireType)
+		}
+		if n > len(buf) {
+			return errTruncated
+		}
+		buf = buf[n:]
+
+		if err := fn(field, wireType, value, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateMvt checks that data is a well formed Mapbox Vector Tile: a
+// protobuf message in which every layer has a name and a supported version.
+// It doesn't decode features, so is cheap enough to run on every tile
+// served, but only catches structural corruption such as truncation.
+func ValidateMvt(data []byte) error {
+	layer := 0
+	return walkFields(data, func(field uint64, wireType int, value uint64, layerData []byte) error {
+		if field != mvtTileLayers {
+			// the spec allows extensions, so ignore unknown fields
+			return nil
+		}
+		if wireType != wireBytes {
+			return fmt.Errorf("layer %d has wire type %d, not a message", layer, wireType)
+		}
+
+		hasName := false
+		version := uint64(1)
+		err := walkFields(layerData, func(field uint64, wireType int, value uint64, data []byte) error {
+			switch field {
+			case mvtLayerName:
+				if wireType != wireBytes || len(data) == 0 {
+					return errors.New("invalid name")
+				}
+				hasName = true
+			case mvtLayerVersion:
+				if wireType != wireVarint {
+					return errors.New("invalid version")
+				}
+				version = value
+			case mvtLayerExtent:
+				if wireType != wireVarint {
+					return errors.New("invalid extent")
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("layer %d: %s", layer, err.Error())
+		}
+		if !hasName {
+			return fmt.Errorf("layer %d has no name", layer)
+		}
+		if version < 1 || version > 2 {
+			return fmt.Errorf("layer %d has unsupported version %d", layer, version)
+		}
+
+		layer++
+		return nil
+	})
+}
+
+// MvtLayerNames returns the names of the layers in the vector tile, in the
+// order they appear.
+func MvtLayerNames(data []byte) ([]string, error) {
+	var names []string
+	err := walkFields(data, func(field uint64, wireType int, value uint64, layerData []byte) error {
+		if field != mvtTileLayers || wireType != wireBytes {
+			return nil
+		}
+		return walkFields(layerData, func(field uint64, wireType int, value uint64, data []byte) error {
+			if field == mvtLayerName && wireType == wireBytes {
+				names = append(names, string(data))
+			}
+			return nil
+		})
+	})
+	return names, err
+}
@@ -0,0 +1,48 @@
+package tile
+
+import (
+	"testing"
+)
+
+func TestValidateMvt(t *testing.T) {
+	layer := []byte{
+		0x78, 0x02, // version 2
+		0x0a, 0x05, 'w', 'a', 't', 'e', 'r', // name
+		0x28, 0x80, 0x20, // extent 4096
+	}
+	valid := append([]byte{0x1a, byte(len(layer))}, layer...)
+
+	if err := ValidateMvt(valid); err != nil {
+		t.Fatalf("Expected valid tile, got %s", err.Error())
+	}
+	if err := ValidateMvt([]byte{}); err != nil {
+		t.Fatalf("Expected empty tile to be valid, got %s", err.Error())
+	}
+
+	invalid := map[string][]byte{
+		"truncated":   valid[:len(valid)-2],
+		"not a layer": {0x18, 0x01},
+		"no name":     {0x1a, 0x02, 0x78, 0x02},
+		"bad version": {0x1a, 0x05, 0x78, 0x03, 0x0a, 0x01, 'a'},
+		"not mvt":     []byte("{\"type\": \"FeatureCollection\"}"),
+	}
+	for name, data := range invalid {
+		if err := ValidateMvt(data); err == nil {
+			t.Fatalf("Expected %s tile to be invalid", name)
+		}
+	}
+}
+
+func TestMvtLayerNames(t *testing.T) {
+	data := []byte{
+		0x1a, 0x07, 0x0a, 0x05, 'w', 'a', 't', 'e', 'r',
+		0x1a, 0x07, 0x0a, 0x05, 'r', 'o', 'a', 'd', 's',
+	}
+	names, err := MvtLayerNames(data)
+	if err != nil {
+		t.Fatalf("Unable to read layer names: %s", err.Error())
+	}
+	if len(names) != 2 || names[0] != "water" || names[1] != "roads" {
+		t.Fatalf("Expected water and roads layers, got %#v", names)
+	}
+}
@@ -0,0 +1,371 @@
+package tile
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// TranscodeFunc converts the data of the tile at coord from one format to
+// another.
+type TranscodeFunc func(coord TileCoord, data []byte) ([]byte, error)
+
+// transcoders are keyed by the formats they convert from and to.
+var transcoders = map[[2]string]TranscodeFunc{
+	{"mvt", "json"}: MvtToJson,
+}
+
+// Transcoder returns the function converting tiles in the format from to the
+// format to, or nil if they can't be converted.
+func Transcoder(from, to string) TranscodeFunc {
+	return transcoders[[2]string{from, to}]
+}
+
+// field numbers from the Mapbox Vector Tile specification, beyond those
+// needed to validate tiles
+const (
+	mvtLayerFeatures = 2
+	mvtLayerKeys     = 3
+	mvtLayerValues   = 4
+
+	mvtFeatureID       = 1
+	mvtFeatureTags     = 2
+	mvtFeatureType     = 3
+	mvtFeatureGeometry = 4
+
+	mvtValueString = 1
+	mvtValueFloat  = 2
+	mvtValueDouble = 3
+	mvtValueInt    = 4
+	mvtValueUint   = 5
+	mvtValueSint   = 6
+	mvtValueBool   = 7
+)
+
+// geometry types and commands from the Mapbox Vector Tile specification
+const (
+	mvtPoint      = 1
+	mvtLineString = 2
+	mvtPolygon    = 3
+
+	mvtMoveTo    = 1
+	mvtLineTo    = 2
+	mvtClosePath = 7
+)
+
+const defaultMvtExtent = 4096
+
+type geojsonGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type geojsonFeature struct {
+	Type       string                 `json:"type"`
+	ID         *uint64                `json:"id,omitempty"`
+	Geometry   *geojsonGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geojsonFeatureCollection struct {
+	Type     string            `json:"type"`
+	Features []*geojsonFeature `json:"features"`
+}
+
+// MvtToJson converts a Mapbox Vector Tile to a Tilezen json tile, which has
+// a GeoJSON FeatureCollection for each layer keyed by the layer's name.
+// Coordinates are converted from the tile's extent to longitude and latitude
+// with coord.
+func MvtToJson(coord TileCoord, data []byte) ([]byte, error) {
+	layers := make(map[string]*geojsonFeatureCollection)
+	layer := 0
+	err := walkFields(data, func(field uint64, wireType int, value uint64, layerData []byte) error {
+		if field != mvtTileLayers || wireType != wireBytes {
+			return nil
+		}
+		name, fc, err := decodeMvtLayer(coord, layerData)
+		if err != nil {
+			return fmt.Errorf("layer %d: %s", layer, err.Error())
+		}
+		layers[name] = fc
+		layer++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(layers)
+}
+
+// rawMvtFeature holds a feature's fields until the layer's keys and values,
+// which may follow the features, have been read.
+type rawMvtFeature struct {
+	id       *uint64
+	tags     []uint64
+	geomType uint64
+	geometry []uint64
+}
+
+func decodeMvtLayer(coord TileCoord, data []byte) (string, *geojsonFeatureCollection, error) {
+	var name string
+	var keys []string
+	var values []interface{}
+	var features []*rawMvtFeature
+	extent := uint64(defaultMvtExtent)
+
+	err := walkFields(data, func(field uint64, wireType int, value uint64, data []byte) error {
+		switch field {
+		case mvtLayerName:
+			name = string(data)
+		case mvtLayerExtent:
+			extent = value
+		case mvtLayerKeys:
+			keys = append(keys, string(data))
+		case mvtLayerValues:
+			v, err := decodeMvtValue(data)
+			if err != nil {
+				return err
+			}
+			values = append(values, v)
+		case mvtLayerFeatures:
+			feature, err := decodeMvtFeature(data)
+			if err != nil {
+				return err
+			}
+			features = append(features, feature)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "" {
+		return "", nil, errors.New("no name")
+	}
+	if extent == 0 {
+		return "", nil, errors.New("invalid extent 0")
+	}
+
+	fc := &geojsonFeatureCollection{Type: "FeatureCollection", Features: make([]*geojsonFeature, 0, len(features))}
+	for _, raw := range features {
+		if len(raw.tags)%2 != 0 {
+			return "", nil, errors.New("odd number of feature tags")
+		}
+		properties := make(map[string]interface{}, len(raw.tags)/2)
+		for i := 0; i < len(raw.tags); i += 2 {
+			k, v := raw.tags[i], raw.tags[i+1]
+			if k >= uint64(len(keys)) || v >= uint64(len(values)) {
+				return "", nil, errors.New("feature tag out of range")
+			}
+			properties[keys[k]] = values[v]
+		}
+
+		geometry, err := decodeMvtGeometry(coord, extent, raw.geomType, raw.geometry)
+		if err != nil {
+			return "", nil, err
+		}
+		fc.Features = append(fc.Features, &geojsonFeature{
+			Type:       "Feature",
+			ID:         raw.id,
+			Geometry:   geometry,
+			Properties: properties,
+		})
+	}
+	return name, fc, nil
+}
+
+// readPacked decodes a packed repeated varint field.
+func readPacked(data []byte) ([]uint64, error) {
+	var result []uint64
+	for len(data) > 0 {
+		v, n, err := readVarint(data)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+		data = data[n:]
+	}
+	return result, nil
+}
+
+func decodeMvtFeature(data []byte) (*rawMvtFeature, error) {
+	feature := &rawMvtFeature{}
+	err := walkFields(data, func(field uint64, wireType int, value uint64, data []byte) error {
+		var err error
+		switch field {
+		case mvtFeatureID:
+			id := value
+			feature.id = &id
+		case mvtFeatureType:
+			feature.geomType = value
+		case mvtFeatureTags:
+			feature.tags, err = readPacked(data)
+		case mvtFeatureGeometry:
+			feature.geometry, err = readPacked(data)
+		}
+		return err
+	})
+	return feature, err
+}
+
+func decodeMvtValue(data []byte) (interface{}, error) {
+	var result interface{}
+	err := walkFields(data, func(field uint64, wireType int, value uint64, data []byte) error {
+		switch field {
+		case mvtValueString:
+			result = string(data)
+		case mvtValueFloat:
+			if len(data) != 4 {
+				return errTruncated
+			}
+			result = finite(float64(math.Float32frombits(binary.LittleEndian.Uint32(data))))
+		case mvtValueDouble:
+			if len(data) != 8 {
+				return errTruncated
+			}
+			result = finite(math.Float64frombits(binary.LittleEndian.Uint64(data)))
+		case mvtValueInt:
+			result = int64(value)
+		case mvtValueUint:
+			result = value
+		case mvtValueSint:
+			result = zigzag(value)
+		case mvtValueBool:
+			result = value != 0
+		}
+		return nil
+	})
+	return result, err
+}
+
+// finite returns f, or nil if it can't be written in JSON.
+func finite(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return f
+}
+
+func zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// decodeMvtRings decodes geometry commands into lines of points in tile
+// coordinates. ClosePath closes the line by repeating its first point.
+func decodeMvtRings(geometry []uint64) ([][][2]int64, error) {
+	var lines [][][2]int64
+	var x, y int64
+	for i := 0; i < len(geometry); {
+		command, count := geometry[i]&7, int(geometry[i]>>3)
+		i++
+		switch command {
+		case mvtMoveTo, mvtLineTo:
+			if count > (len(geometry)-i)/2 {
+				return nil, errors.New("truncated geometry")
+			}
+			for j := 0; j < count; j++ {
+				x += zigzag(geometry[i])
+				y += zigzag(geometry[i+1])
+				i += 2
+				if command == mvtMoveTo {
+					lines = append(lines, nil)
+				} else if len(lines) == 0 {
+					return nil, errors.New("LineTo before MoveTo")
+				}
+				lines[len(lines)-1] = append(lines[len(lines)-1], [2]int64{x, y})
+			}
+		case mvtClosePath:
+			if len(lines) == 0 || len(lines[len(lines)-1]) == 0 {
+				return nil, errors.New("ClosePath before MoveTo")
+			}
+			line := lines[len(lines)-1]
+			lines[len(lines)-1] = append(line, line[0])
+		default:
+			return nil, fmt.Errorf("unknown geometry command %d", command)
+		}
+	}
+	return lines, nil
+}
+
+// ringArea is the signed area of the ring by the surveyor's formula, which
+// the specification uses to tell exterior rings, with positive area, from
+// interior ones.
+func ringArea(ring [][2]int64) int64 {
+	var area int64
+	for i := 0; i+1 < len(ring); i++ {
+		area += ring[i][0]*ring[i+1][1] - ring[i+1][0]*ring[i][1]
+	}
+	return area
+}
+
+func decodeMvtGeometry(coord TileCoord, extent, geomType uint64, geometry []uint64) (*geojsonGeometry, error) {
+	lines, err := decodeMvtRings(geometry)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	scale := float64(uint64(1) << uint(coord.Z))
+	lonLat := func(p [2]int64) [2]float64 {
+		fx := (float64(coord.X) + float64(p[0])/float64(extent)) / scale
+		fy := (float64(coord.Y) + float64(p[1])/float64(extent)) / scale
+		lat := math.Atan(math.Sinh(math.Pi*(1-2*fy))) * 180 / math.Pi
+		return [2]float64{fx*360 - 180, lat}
+	}
+	toLonLat := func(line [][2]int64) [][2]float64 {
+		result := make([][2]float64, len(line))
+		for i, p := range line {
+			result[i] = lonLat(p)
+		}
+		return result
+	}
+
+	switch geomType {
+	case mvtPoint:
+		var points [][2]float64
+		for _, line := range lines {
+			points = append(points, toLonLat(line)...)
+		}
+		if len(points) == 1 {
+			return &geojsonGeometry{Type: "Point", Coordinates: points[0]}, nil
+		}
+		return &geojsonGeometry{Type: "MultiPoint", Coordinates: points}, nil
+
+	case mvtLineString:
+		if len(lines) == 1 {
+			return &geojsonGeometry{Type: "LineString", Coordinates: toLonLat(lines[0])}, nil
+		}
+		multi := make([][][2]float64, len(lines))
+		for i, line := range lines {
+			multi[i] = toLonLat(line)
+		}
+		return &geojsonGeometry{Type: "MultiLineString", Coordinates: multi}, nil
+
+	case mvtPolygon:
+		var polygons [][][][2]float64
+		for _, ring := range lines {
+			area := ringArea(ring)
+			if area == 0 {
+				continue
+			}
+			if area > 0 || len(polygons) == 0 {
+				polygons = append(polygons, [][][2]float64{toLonLat(ring)})
+			} else {
+				last := len(polygons) - 1
+				polygons[last] = append(polygons[last], toLonLat(ring))
+			}
+		}
+		if len(polygons) == 0 {
+			return nil, nil
+		}
+		if len(polygons) == 1 {
+			return &geojsonGeometry{Type: "Polygon", Coordinates: polygons[0]}, nil
+		}
+		return &geojsonGeometry{Type: "MultiPolygon", Coordinates: polygons}, nil
+	}
+	return nil, nil
+}
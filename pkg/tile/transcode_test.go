@@ -0,0 +1,127 @@
+package tile
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+// pbField encodes a length delimited protobuf field.
+func pbField(field uint64, data []byte) []byte {
+	buf := appendVarint(nil, field<<3|wireBytes)
+	buf = appendVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func pbVarint(field, v uint64) []byte {
+	return appendVarint(appendVarint(nil, field<<3|wireVarint), v)
+}
+
+func pbPacked(field uint64, values ...uint64) []byte {
+	var data []byte
+	for _, v := range values {
+		data = appendVarint(data, v)
+	}
+	return pbField(field, data)
+}
+
+func zz(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func concat(parts ...[]byte) []byte {
+	var buf []byte
+	for _, part := range parts {
+		buf = append(buf, part...)
+	}
+	return buf
+}
+
+func TestMvtToJson(t *testing.T) {
+	point := concat(
+		pbVarint(mvtFeatureID, 7),
+		pbPacked(mvtFeatureTags, 0, 0),
+		pbVarint(mvtFeatureType, mvtPoint),
+		pbPacked(mvtFeatureGeometry, 1<<3|mvtMoveTo, zz(2048), zz(2048)),
+	)
+	square := concat(
+		pbVarint(mvtFeatureType, mvtPolygon),
+		pbPacked(mvtFeatureGeometry,
+			1<<3|mvtMoveTo, zz(0), zz(0),
+			3<<3|mvtLineTo, zz(4096), zz(0), zz(0), zz(4096), zz(-4096), zz(0),
+			1<<3|mvtClosePath),
+	)
+	layer := concat(
+		pbVarint(mvtLayerVersion, 2),
+		pbField(mvtLayerName, []byte("pois")),
+		pbField(mvtLayerFeatures, point),
+		pbField(mvtLayerFeatures, square),
+		pbField(mvtLayerKeys, []byte("name")),
+		pbField(mvtLayerValues, pbField(mvtValueString, []byte("centre"))),
+		pbVarint(mvtLayerExtent, 4096),
+	)
+	data := pbField(mvtTileLayers, layer)
+
+	transcode := Transcoder("mvt", "json")
+	if transcode == nil {
+		t.Fatalf("Expected a transcoder from mvt to json")
+	}
+	body, err := transcode(TileCoord{Z: 0, X: 0, Y: 0, Format: "json"}, data)
+	if err != nil {
+		t.Fatalf("Unable to transcode tile: %s", err.Error())
+	}
+
+	var result map[string]struct {
+		Type     string `json:"type"`
+		Features []struct {
+			ID       *uint64 `json:"id"`
+			Geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatalf("Unable to parse transcoded tile %s: %s", body, err.Error())
+	}
+	pois, ok := result["pois"]
+	if !ok || pois.Type != "FeatureCollection" || len(pois.Features) != 2 {
+		t.Fatalf("Expected a pois FeatureCollection with 2 features, got %s", body)
+	}
+
+	centre := pois.Features[0]
+	if centre.ID == nil || *centre.ID != 7 || centre.Properties["name"] != "centre" || centre.Geometry.Type != "Point" {
+		t.Fatalf("Unexpected point feature in %s", body)
+	}
+	var lonLat [2]float64
+	json.Unmarshal(centre.Geometry.Coordinates, &lonLat)
+	if math.Abs(lonLat[0]) > 1e-9 || math.Abs(lonLat[1]) > 1e-9 {
+		t.Fatalf("Expected the centre of tile 0/0/0 at 0,0, got %v", lonLat)
+	}
+
+	world := pois.Features[1]
+	var rings [][][2]float64
+	json.Unmarshal(world.Geometry.Coordinates, &rings)
+	if world.Geometry.Type != "Polygon" || len(rings) != 1 || len(rings[0]) != 5 || rings[0][0] != rings[0][4] {
+		t.Fatalf("Expected a closed polygon ring, got %s", body)
+	}
+	if rings[0][0][0] != -180 || math.Abs(rings[0][0][1]-85.0511287798) > 1e-9 {
+		t.Fatalf("Expected the polygon to start at the top left of the world, got %v", rings[0][0])
+	}
+
+	if _, err := transcode(TileCoord{}, data[:len(data)-3]); err == nil {
+		t.Fatalf("Expected a truncated tile not to transcode")
+	}
+	if Transcoder("json", "mvt") != nil {
+		t.Fatalf("Expected no transcoder from json to mvt")
+	}
+}